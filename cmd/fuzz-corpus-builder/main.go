@@ -0,0 +1,190 @@
+// Command fuzz-corpus-builder writes a seed corpus of small, valid J2K
+// codestreams for the codestream fuzz targets.
+//
+// Every combination of quantization style, wavelet transform, progression
+// order, precinct configuration, comment presence and component count is
+// emitted as one corpus entry in the "go test fuzz v1" file format.
+//
+// Run from the repository root with:
+//
+//	go run ./cmd/fuzz-corpus-builder
+//	go test -fuzz=FuzzReadHeader ./internal/codestream/
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+)
+
+const (
+	imageSize  = 16
+	numDecomp  = 2
+	bitDepth   = 8
+	guardBits  = 2
+	numSubband = 3*numDecomp + 1
+)
+
+// variant describes one corpus entry.
+type variant struct {
+	quantization  uint8
+	wavelet       uint8
+	progression   codestream.ProgressionOrder
+	precincts     bool
+	comment       bool
+	numComponents int
+}
+
+func (v variant) name() string {
+	return fmt.Sprintf("q%d-w%d-p%d-prec%t-com%t-c%d",
+		v.quantization, v.wavelet, v.progression, v.precincts, v.comment, v.numComponents)
+}
+
+func main() {
+	out := flag.String("out", filepath.Join("internal", "codestream", "testdata", "fuzz", "FuzzReadHeader"),
+		"output directory for corpus files")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
+	variants := allVariants()
+	for _, v := range variants {
+		path := filepath.Join(*out, v.name())
+		if err := os.WriteFile(path, corpusEntry(buildCodestream(v)), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("wrote %d corpus entries to %s\n", len(variants), *out)
+}
+
+// allVariants enumerates every supported marker combination.
+func allVariants() []variant {
+	quantizations := []uint8{
+		codestream.QuantizationNone,
+		codestream.QuantizationScalarDerived,
+		codestream.QuantizationScalarExpounded,
+	}
+	progressions := []codestream.ProgressionOrder{
+		codestream.LRCP, codestream.RLCP, codestream.RPCL, codestream.PCRL, codestream.CPRL,
+	}
+
+	var variants []variant
+	for _, q := range quantizations {
+		for _, w := range []uint8{0, 1} {
+			for _, p := range progressions {
+				for _, prec := range []bool{false, true} {
+					for _, com := range []bool{false, true} {
+						for _, nc := range []int{1, 3, 4} {
+							variants = append(variants, variant{
+								quantization:  q,
+								wavelet:       w,
+								progression:   p,
+								precincts:     prec,
+								comment:       com,
+								numComponents: nc,
+							})
+						}
+					}
+				}
+			}
+		}
+	}
+	return variants
+}
+
+// corpusEntry encodes data in the file format read by go test -fuzz.
+func corpusEntry(data []byte) []byte {
+	return []byte(fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", data))
+}
+
+// buildCodestream assembles a single-tile codestream for v.
+func buildCodestream(v variant) []byte {
+	var b []byte
+	b = appendMarker(b, codestream.SOC)
+
+	// SIZ
+	siz := make([]byte, 0, 38+3*v.numComponents)
+	siz = binary.BigEndian.AppendUint16(siz, 0) // Rsiz
+	siz = binary.BigEndian.AppendUint32(siz, imageSize)
+	siz = binary.BigEndian.AppendUint32(siz, imageSize)
+	siz = binary.BigEndian.AppendUint32(siz, 0)
+	siz = binary.BigEndian.AppendUint32(siz, 0)
+	siz = binary.BigEndian.AppendUint32(siz, imageSize)
+	siz = binary.BigEndian.AppendUint32(siz, imageSize)
+	siz = binary.BigEndian.AppendUint32(siz, 0)
+	siz = binary.BigEndian.AppendUint32(siz, 0)
+	siz = binary.BigEndian.AppendUint16(siz, uint16(v.numComponents))
+	for i := 0; i < v.numComponents; i++ {
+		siz = append(siz, bitDepth-1, 1, 1)
+	}
+	b = appendSegment(b, codestream.SIZ, siz)
+
+	// COD
+	var scod uint8
+	if v.precincts {
+		scod |= codestream.CodingStylePrecincts
+	}
+	var mct uint8
+	if v.numComponents >= 3 {
+		mct = 1
+	}
+	cod := []byte{scod, uint8(v.progression), 0, 1, mct, numDecomp, 4, 4, 0, v.wavelet}
+	if v.precincts {
+		for r := 0; r <= numDecomp; r++ {
+			cod = append(cod, 0x77)
+		}
+	}
+	b = appendSegment(b, codestream.COD, cod)
+
+	// QCD
+	qcd := []byte{guardBits<<5 | v.quantization}
+	switch v.quantization {
+	case codestream.QuantizationNone:
+		for i := 0; i < numSubband; i++ {
+			qcd = append(qcd, (bitDepth+1)<<3)
+		}
+	case codestream.QuantizationScalarDerived:
+		qcd = binary.BigEndian.AppendUint16(qcd, 8<<11|0x100)
+	case codestream.QuantizationScalarExpounded:
+		for i := 0; i < numSubband; i++ {
+			qcd = binary.BigEndian.AppendUint16(qcd, uint16(8+i/3)<<11|0x100)
+		}
+	}
+	b = appendSegment(b, codestream.QCD, qcd)
+
+	// COM
+	if v.comment {
+		com := binary.BigEndian.AppendUint16(nil, codestream.CommentLatin1)
+		com = append(com, "fuzz corpus"...)
+		b = appendSegment(b, codestream.COM, com)
+	}
+
+	// SOT, SOD and a token amount of tile data
+	tileData := []byte{0x00, 0x00}
+	sot := binary.BigEndian.AppendUint16(nil, 0)
+	sot = binary.BigEndian.AppendUint32(sot, uint32(12+2+len(tileData)))
+	sot = append(sot, 0, 1)
+	b = appendSegment(b, codestream.SOT, sot)
+	b = appendMarker(b, codestream.SOD)
+	b = append(b, tileData...)
+
+	return appendMarker(b, codestream.EOC)
+}
+
+func appendMarker(b []byte, m codestream.Marker) []byte {
+	return binary.BigEndian.AppendUint16(b, uint16(m))
+}
+
+// appendSegment appends marker m followed by its length and payload.
+func appendSegment(b []byte, m codestream.Marker, payload []byte) []byte {
+	b = appendMarker(b, m)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
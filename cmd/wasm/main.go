@@ -0,0 +1,73 @@
+//go:build js && wasm
+
+// Command wasm exposes the JPEG 2000 decoder to JavaScript.
+//
+// Build with:
+//
+//	GOOS=js GOARCH=wasm go build -o jpeg2000.wasm ./cmd/wasm
+//
+// Once the module is running, the global function decodeJP2 accepts a
+// Uint8Array holding a JP2 file or raw J2K codestream and returns an
+// object {width, height, pixels, error}. pixels is a Uint8Array of
+// non-premultiplied RGBA samples suitable for ImageData.
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"syscall/js"
+
+	jpeg2000 "github.com/mrjoshuak/go-jpeg2000"
+)
+
+func main() {
+	js.Global().Set("decodeJP2", js.FuncOf(decodeJP2))
+
+	// Keep the Go runtime alive so decodeJP2 remains callable.
+	select {}
+}
+
+// decodeJP2 is the JavaScript entry point.
+func decodeJP2(this js.Value, args []js.Value) any {
+	result := map[string]any{
+		"width":  0,
+		"height": 0,
+		"pixels": js.Null(),
+		"error":  "",
+	}
+
+	if len(args) != 1 || args[0].Type() != js.TypeObject {
+		result["error"] = "decodeJP2: expected a Uint8Array argument"
+		return result
+	}
+
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+
+	img, err := jpeg2000.Decode(bytes.NewReader(data))
+	if err != nil {
+		result["error"] = err.Error()
+		return result
+	}
+
+	rgba := toNRGBA(img)
+	pixels := js.Global().Get("Uint8Array").New(len(rgba.Pix))
+	js.CopyBytesToJS(pixels, rgba.Pix)
+
+	result["width"] = rgba.Rect.Dx()
+	result["height"] = rgba.Rect.Dy()
+	result["pixels"] = pixels
+	return result
+}
+
+// toNRGBA converts img to a tightly packed NRGBA image with origin (0, 0).
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if n, ok := img.(*image.NRGBA); ok && b.Min == (image.Point{}) && n.Stride == 4*b.Dx() {
+		return n
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	return dst
+}
@@ -2,10 +2,18 @@ package jpeg2000
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/mrjoshuak/go-jpeg2000/internal/box"
 	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
@@ -20,6 +28,84 @@ type decoder struct {
 	header     *codestream.Header
 	jp2Header  *box.JP2Header
 	codestream []byte
+
+	// tiles locates the packet data of each tile in codestream, and
+	// holds the coding parameters of its tile-part headers;
+	// tilePartErr is the error that stopped reading the tile-parts, if
+	// any
+	tiles       []*tileParts
+	tilePartErr error
+
+	// scratch holds the buffers of a Decoder reused across decodes, or
+	// is nil to allocate afresh.
+	scratch *decodeScratch
+
+	// dst, if set, receives the decoded image; its bounds must match
+	// the decoded area.
+	dst draw.Image
+
+	// resilient recovers from damaged packets and code-blocks, for
+	// Config.ErrorResilient.
+	resilient bool
+
+	// model, if set, is the color model of the output image, for
+	// Config.OutputModel.
+	model color.Model
+
+	// traces collects the packets decoded from each tile, indexed by
+	// tile, for Config.Debug; nil when not tracing.
+	traces [][]packetTrace
+}
+
+// decodeScratch holds the buffers a Decoder keeps between frames.
+type decodeScratch struct {
+	codestream   bytes.Buffer
+	tileDecoders []*tcd.TileDecoder
+	planes       [][]int32
+	floats       [3][]float64
+}
+
+// tileDecoder returns the tile decoder of worker w for h. Scratch tile
+// decoders reuse their sample buffers, which is only safe when decoded
+// tiles are not kept beyond the next one, so not with a TileCache.
+func (d *decoder) tileDecoder(w int, cfg *Config) *tcd.TileDecoder {
+	if d.scratch == nil || (cfg != nil && cfg.TileCache != nil) {
+		return tcd.NewTileDecoder(d.header)
+	}
+	s := d.scratch
+	for len(s.tileDecoders) <= w {
+		td := tcd.NewTileDecoder(d.header)
+		td.ReuseBuffers(true)
+		s.tileDecoders = append(s.tileDecoders, td)
+	}
+	s.tileDecoders[w].SetHeader(d.header)
+	return s.tileDecoders[w]
+}
+
+// componentPlanes returns numComp zeroed planes of n samples each, reusing
+// the scratch planes when there are any.
+func (d *decoder) componentPlanes(numComp, n int) [][]int32 {
+	componentData := make([][]int32, numComp)
+	if d.scratch == nil {
+		for c := range componentData {
+			componentData[c] = make([]int32, n)
+		}
+		return componentData
+	}
+	s := d.scratch
+	for len(s.planes) < numComp {
+		s.planes = append(s.planes, nil)
+	}
+	for c := range componentData {
+		if cap(s.planes[c]) < n {
+			s.planes[c] = make([]int32, n)
+		} else {
+			s.planes[c] = s.planes[c][:n]
+			clear(s.planes[c])
+		}
+		componentData[c] = s.planes[c]
+	}
+	return componentData
 }
 
 // newDecoder creates a new decoder.
@@ -50,8 +136,23 @@ func (d *decoder) decode(cfg *Config) (image.Image, error) {
 	return img, nil
 }
 
+// decodeInto decodes the image into dst, whose bounds must match the
+// decoded area. dst is filled in place when it has the type decode would
+// return; otherwise the decoded image is converted into it.
+func (d *decoder) decodeInto(dst draw.Image, cfg *Config) error {
+	d.dst = dst
+	img, err := d.decode(cfg)
+	if err != nil {
+		return err
+	}
+	if img != image.Image(dst) {
+		draw.Draw(dst, dst.Bounds(), img, dst.Bounds().Min, draw.Src)
+	}
+	return nil
+}
+
 // readMetadata reads only the metadata without decoding.
-func (d *decoder) readMetadata() (*Metadata, error) {
+func (d *decoder) readMetadata(cfg *Config) (*Metadata, error) {
 	if err := d.readFormat(); err != nil {
 		return nil, err
 	}
@@ -59,7 +160,12 @@ func (d *decoder) readMetadata() (*Metadata, error) {
 	if err := d.parseCodestream(); err != nil {
 		return nil, err
 	}
+	return d.metadata(cfg)
+}
 
+// metadata describes the parsed headers, computing the values requested
+// by cfg.
+func (d *decoder) metadata(cfg *Config) (*Metadata, error) {
 	h := d.header
 	m := &Metadata{
 		Format:           d.format,
@@ -68,75 +174,90 @@ func (d *decoder) readMetadata() (*Metadata, error) {
 		NumComponents:    int(h.NumComponents),
 		BitsPerComponent: make([]int, h.NumComponents),
 		Signed:           make([]bool, h.NumComponents),
+		SubsamplingX:     make([]int, h.NumComponents),
+		SubsamplingY:     make([]int, h.NumComponents),
 		Profile:          Profile(h.Profile),
-		NumResolutions:   int(h.CodingStyle.NumDecompositions) + 1,
+		IsHTJ2K:          h.IsHTJ2K(),
+		NumResolutions:   h.CodingStyle.NumResolutions(),
+		WaveletTransform: int(h.CodingStyle.WaveletTransform),
 		NumQualityLayers: int(h.CodingStyle.NumLayers),
 		TileWidth:        int(h.TileWidth),
 		TileHeight:       int(h.TileHeight),
 		NumTilesX:        int(h.NumTilesX),
 		NumTilesY:        int(h.NumTilesY),
 		Comment:          h.Comment,
+		Comments:         h.Comments,
+		BinaryComments:   h.BinaryComments,
 		ColorSpace:       ColorSpaceUnspecified, // Default for J2K without JP2 container
 	}
 
+	for _, c := range h.Comments {
+		if rate, count, ok := parseCinemaComment(c); ok {
+			m.CinemaFrameRate = rate
+			m.CinemaFrameCount = count
+		}
+	}
+
 	for i, c := range h.ComponentInfo {
 		m.BitsPerComponent[i] = c.Precision()
 		m.Signed[i] = c.IsSigned()
+		m.SubsamplingX[i] = int(c.SubsamplingX)
+		m.SubsamplingY[i] = int(c.SubsamplingY)
+		if coc, ok := h.ComponentCodingStyles[uint16(i)]; ok {
+			m.NumResolutions = min(m.NumResolutions, int(coc.NumDecompositions)+1)
+		}
 	}
 
 	// Get color space from JP2 header if available
 	if d.jp2Header != nil && d.jp2Header.ColorSpec != nil {
-		switch d.jp2Header.ColorSpec.EnumeratedColorspace {
-		case box.CSBilevel1, box.CSBilevel2:
-			m.ColorSpace = ColorSpaceBilevel
-		case box.CSGray:
-			m.ColorSpace = ColorSpaceGray
-		case box.CSSRGB:
-			m.ColorSpace = ColorSpaceSRGB
-		case box.CSYCbCr1, box.CSsYCC:
-			m.ColorSpace = ColorSpaceSYCC
-		case box.CSYCbCr2:
-			m.ColorSpace = ColorSpaceYCbCr2
-		case box.CSYCbCr3:
-			m.ColorSpace = ColorSpaceYCbCr3
-		case box.CSPhotoYCC:
-			m.ColorSpace = ColorSpacePhotoYCC
-		case box.CSCMY:
-			m.ColorSpace = ColorSpaceCMY
-		case box.CSCMYK:
-			m.ColorSpace = ColorSpaceCMYK
-		case box.CSYCCK:
-			m.ColorSpace = ColorSpaceYCCK
-		case box.CSCIELab:
-			m.ColorSpace = ColorSpaceCIELab
-		case box.CSCIEJab:
-			m.ColorSpace = ColorSpaceCIEJab
-		case box.CSeSRGB:
-			m.ColorSpace = ColorSpaceESRGB
-		case box.CSROMMRGB:
-			m.ColorSpace = ColorSpaceROMMRGB
-		case box.CSYPbPr1125:
-			m.ColorSpace = ColorSpaceYPbPr60
-		case box.CSYPbPr1250:
-			m.ColorSpace = ColorSpaceYPbPr50
-		case box.CSeSYCC:
-			m.ColorSpace = ColorSpaceEYCC
-		default:
-			// Unknown enumcs value - not supported
-			m.ColorSpace = ColorSpaceUnknown
+		m.ColorSpace = d.getColorSpace()
+		m.ColorSpaceMethod = int(d.jp2Header.ColorSpec.Method)
+		m.ICCProfile = d.iccProfile()
+		if len(m.ICCProfile) > 0 {
+			// A malformed profile is not fatal; the raw bytes remain available
+			m.ParsedICC, _ = parseICCProfile(m.ICCProfile)
+		}
+	}
+
+	if cfg != nil && cfg.ComputeLayerBoundaries {
+		boundaries, err := d.layerBoundaries()
+		if err != nil {
+			return nil, fmt.Errorf("computing layer boundaries: %w", err)
 		}
-		m.ICCProfile = d.jp2Header.ColorSpec.ICCProfile
+		m.LayerBoundaries = boundaries
 	}
 
 	return m, nil
 }
 
+// parseCinemaComment extracts the frame rate and frame count from a DCI
+// timing comment written by the encoder.
+func parseCinemaComment(c string) (Rational, int, bool) {
+	if !strings.HasPrefix(c, cinemaCommentPrefix) {
+		return Rational{}, 0, false
+	}
+	var rate Rational
+	var count int
+	_, err := fmt.Sscanf(c[len(cinemaCommentPrefix):], "FrameRate=%d/%d FrameCount=%d",
+		&rate.Num, &rate.Den, &count)
+	if err != nil || rate.Den == 0 {
+		return Rational{}, 0, false
+	}
+	return rate, count, true
+}
+
 // getColorSpace returns the ColorSpace from the JP2 header.
 func (d *decoder) getColorSpace() ColorSpace {
 	if d.jp2Header == nil || d.jp2Header.ColorSpec == nil {
 		return ColorSpaceUnspecified
 	}
 
+	// An ICC profile rather than an enumerated space governs colour
+	switch d.jp2Header.ColorSpec.Method {
+	case box.ColorMethodRestrictedICC, box.ColorMethodICC:
+		return ColorSpaceUnspecified
+	}
+
 	switch d.jp2Header.ColorSpec.EnumeratedColorspace {
 	case box.CSBilevel1, box.CSBilevel2:
 		return ColorSpaceBilevel
@@ -177,20 +298,27 @@ func (d *decoder) getColorSpace() ColorSpace {
 	}
 }
 
+// iccProfile returns the ICC profile from the JP2 colour specification
+// box, or nil if there is none.
+func (d *decoder) iccProfile() []byte {
+	if d.jp2Header == nil || d.jp2Header.ColorSpec == nil || len(d.jp2Header.ColorSpec.ICCProfile) == 0 {
+		return nil
+	}
+	return d.jp2Header.ColorSpec.ICCProfile
+}
+
 // readFormat detects the file format and reads file-level structures.
 func (d *decoder) readFormat() error {
 	// Peek at first bytes to detect format
-	magic, err := d.r.Peek(12)
-	if err != nil {
+	magic, err := d.r.Peek(len(jp2Signature))
+	if err != nil && err != io.EOF {
 		return err
 	}
 
 	// Check for JP2 signature
-	if len(magic) >= 12 &&
-		magic[0] == 0x00 && magic[1] == 0x00 && magic[2] == 0x00 && magic[3] == 0x0C &&
-		magic[4] == 'j' && magic[5] == 'P' && magic[6] == ' ' && magic[7] == ' ' {
+	if len(magic) == len(jp2Signature) && bytes.Equal(magic[:8], jp2Signature[:8]) {
 		d.format = FormatJP2
-		return d.readJP2()
+		return truncated(d.readJP2())
 	}
 
 	// Check for J2K codestream (SOC marker)
@@ -199,7 +327,20 @@ func (d *decoder) readFormat() error {
 		return d.readJ2K()
 	}
 
-	return fmt.Errorf("unrecognized file format")
+	// Input too short to hold either signature, but starting like one
+	if bytes.HasPrefix(jp2Signature[:], magic) || bytes.HasPrefix([]byte{0xFF, 0x4F}, magic) {
+		return fmt.Errorf("%w: %d bytes", ErrTruncated, len(magic))
+	}
+	return ErrInvalidSignature
+}
+
+// truncated wraps err with ErrTruncated if it reports that the input ended
+// early.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	return err
 }
 
 // readJP2 reads a JP2 file.
@@ -207,7 +348,7 @@ func (d *decoder) readJP2() error {
 	boxReader := box.NewReader(d.r)
 
 	for {
-		b, err := boxReader.ReadBox()
+		boxType, n, err := boxReader.ReadHeader()
 		if err == io.EOF {
 			break
 		}
@@ -215,45 +356,102 @@ func (d *decoder) readJP2() error {
 			return err
 		}
 
-		switch b.Type {
+		switch boxType {
+		case box.TypeContCodestream:
+			// Store codestream for later parsing. Like a raw J2K file it
+			// is not subject to the box size limit.
+			if n < 0 {
+				d.codestream, err = io.ReadAll(d.r)
+			} else {
+				d.codestream, err = boxReader.ReadContents(n)
+			}
+			return err
+		case box.TypeJP2Signature, box.TypeFileType, box.TypeJP2Header:
+		default:
+			// Skip other boxes without buffering them. A box that
+			// extends to EOF is the last one, so the codestream is missing.
+			if n < 0 {
+				return fmt.Errorf("no codestream found in JP2 file")
+			}
+			if err := boxReader.Skip(n); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var contents []byte
+		if n < 0 {
+			contents, err = io.ReadAll(d.r)
+		} else {
+			contents, err = boxReader.ReadContents(n)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch boxType {
 		case box.TypeJP2Signature:
 			// Verify signature
-			if len(b.Contents) < 4 ||
-				b.Contents[0] != 0x0D || b.Contents[1] != 0x0A ||
-				b.Contents[2] != 0x87 || b.Contents[3] != 0x0A {
-				return fmt.Errorf("invalid JP2 signature")
+			if len(contents) < 4 ||
+				contents[0] != 0x0D || contents[1] != 0x0A ||
+				contents[2] != 0x87 || contents[3] != 0x0A {
+				return fmt.Errorf("%w: invalid JP2 signature box", ErrInvalidSignature)
 			}
 
 		case box.TypeFileType:
 			// Parse file type box
 			ftyp := &box.FileTypeBox{}
-			if err := ftyp.Parse(b.Contents); err != nil {
+			if err := ftyp.Parse(contents); err != nil {
 				return err
 			}
+			if ftyp.Brand == box.BrandJPX {
+				d.format = FormatJPX
+			}
 
 		case box.TypeJP2Header:
 			// Parse JP2 header
-			var err error
-			d.jp2Header, err = box.ParseJP2Header(b.Contents)
+			d.jp2Header, err = box.ParseJP2Header(contents)
 			if err != nil {
 				return err
 			}
-
-		case box.TypeContCodestream:
-			// Store codestream for later parsing
-			d.codestream = b.Contents
-			return nil
 		}
 	}
 
 	if d.codestream == nil {
-		return fmt.Errorf("no codestream found in JP2 file")
+		return fmt.Errorf("%w: no codestream found in JP2 file", ErrTruncated)
 	}
 	return nil
 }
 
+// floatPlanes returns the three planes of n samples the inverse ICT works
+// in, reusing the scratch planes when there are any. Every sample is
+// overwritten by the caller, so they are not cleared.
+func (d *decoder) floatPlanes(n int) [][]float64 {
+	if d.scratch == nil {
+		return [][]float64{make([]float64, n), make([]float64, n), make([]float64, n)}
+	}
+	f := &d.scratch.floats
+	for c := range f {
+		if cap(f[c]) < n {
+			f[c] = make([]float64, n)
+		}
+		f[c] = f[c][:n]
+	}
+	return f[:]
+}
+
 // readJ2K reads a raw J2K codestream.
 func (d *decoder) readJ2K() error {
+	if d.scratch != nil {
+		buf := &d.scratch.codestream
+		buf.Reset()
+		if _, err := buf.ReadFrom(d.r); err != nil {
+			return err
+		}
+		d.codestream = buf.Bytes()
+		return nil
+	}
+
 	// Read entire codestream
 	data, err := io.ReadAll(d.r)
 	if err != nil {
@@ -269,166 +467,1263 @@ func (d *decoder) parseCodestream() error {
 		return fmt.Errorf("no codestream available")
 	}
 
-	parser := codestream.NewParser(&byteReader{data: d.codestream})
+	if len(d.codestream) >= 2 && (d.codestream[0] != 0xFF || d.codestream[1] != 0x4F) {
+		return fmt.Errorf("%w: codestream does not start with SOC", ErrInvalidSignature)
+	}
+
+	r := &byteReader{data: d.codestream}
+	parser := codestream.NewParser(r)
 	header, err := parser.ReadHeader()
 	if err != nil {
-		return err
+		return truncated(err)
 	}
 	d.header = header
+
+	// A codestream whose tile-parts cannot all be read still yields its
+	// header; tiles without tile-parts decode as if they had no packets.
+	d.tiles, d.tilePartErr = readTileParts(parser, r, header)
 	return nil
 }
 
+// thumbnailReduction returns the largest resolution reduction that keeps
+// the long edge of the decoded image at least maxDim pixels, or 0 if the
+// full-resolution image is already smaller.
+func (d *decoder) thumbnailReduction(maxDim int) int {
+	h := d.header
+	levels := -1
+	for c := range h.ComponentInfo {
+		if n := int(h.ComponentCodingStyle(c).NumDecompositions); levels < 0 || n < levels {
+			levels = n
+		}
+	}
+
+	w, ht := int(h.ImageWidth-h.ImageXOffset), int(h.ImageHeight-h.ImageYOffset)
+	reduce := 0
+	for reduce < levels {
+		w, ht = (w+1)/2, (ht+1)/2
+		if max(w, ht) < maxDim {
+			break
+		}
+		reduce++
+	}
+	return reduce
+}
+
 // decodeTiles decodes all tiles and assembles the output image.
 func (d *decoder) decodeTiles(cfg *Config) (image.Image, error) {
+	componentData, bounds, luminance, err := d.decodePlanes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if luminance {
+		return d.finishLuminance(componentData[0], bounds)
+	}
+	return d.finishImage(componentData, bounds)
+}
+
+// decodePlanes decodes the tiles cfg selects into one plane per
+// component, on the reference grid, covering the returned bounds. The
+// samples are reconstructed wavelet output: no component transform or DC
+// level shift has been applied. luminance reports that only the first
+// component was decoded, for Config.LuminanceOnly.
+func (d *decoder) decodePlanes(cfg *Config) (componentData [][]int32, bounds image.Rectangle, luminance bool, err error) {
 	h := d.header
+	if h.IsHTJ2K() {
+		return nil, image.Rectangle{}, false, ErrUnsupportedHTJ2K
+	}
+
+	if cfg != nil && cfg.QualityLayers < 0 {
+		return nil, image.Rectangle{}, false, fmt.Errorf("invalid number of quality layers: %d", cfg.QualityLayers)
+	}
+	if cfg != nil && cfg.ReduceResolution < 0 {
+		return nil, image.Rectangle{}, false, fmt.Errorf("invalid resolution reduction: %d", cfg.ReduceResolution)
+	}
+	if cfg != nil && cfg.ReduceResolution > 0 {
+		for c := range h.ComponentInfo {
+			if levels := int(h.ComponentCodingStyle(c).NumDecompositions); cfg.ReduceResolution > levels {
+				return nil, image.Rectangle{}, false, fmt.Errorf("resolution reduction %d exceeds the %d decomposition levels of component %d",
+					cfg.ReduceResolution, levels, c)
+			}
+		}
+	}
+	if cfg != nil && cfg.MaxWorkers < 0 {
+		return nil, image.Rectangle{}, false, fmt.Errorf("invalid number of workers: %d", cfg.MaxWorkers)
+	}
+	d.resilient = cfg != nil && cfg.ErrorResilient
+	if d.tilePartErr != nil && !d.resilient {
+		return nil, image.Rectangle{}, false, d.tilePartErr
+	}
+	d.model = nil
+	if cfg != nil {
+		d.model = cfg.OutputModel
+	}
+	d.traces = nil
+	if cfg != nil && cfg.Debug != nil {
+		d.traces = make([][]packetTrace, int(h.NumTilesX)*int(h.NumTilesY))
+	}
 
-	// Calculate output dimensions
-	width := int(h.ImageWidth - h.ImageXOffset)
-	height := int(h.ImageHeight - h.ImageYOffset)
+	// The image area starts at (XOsiz, YOsiz) on the reference grid.
+	origin := image.Pt(int(h.ImageXOffset), int(h.ImageYOffset))
+	bounds = image.Rect(origin.X, origin.Y, int(h.ImageWidth), int(h.ImageHeight))
+
+	// Restrict decoding to the requested area, given in full-resolution
+	// reference grid coordinates.
+	area := bounds
+	if cfg != nil && cfg.DecodeArea != nil {
+		area = cfg.DecodeArea.Intersect(bounds)
+		if area.Empty() {
+			return nil, image.Rectangle{}, false, fmt.Errorf("decode area %v does not overlap image bounds %v", *cfg.DecodeArea, bounds)
+		}
+	}
 
+	// Component planes cover the decoded area, relative to the image
+	// origin.
+	planes := area.Sub(origin)
 	if cfg != nil && cfg.ReduceResolution > 0 {
 		// Reduce resolution
 		for i := 0; i < cfg.ReduceResolution; i++ {
-			width = (width + 1) / 2
-			height = (height + 1) / 2
+			origin = image.Pt((origin.X+1)/2, (origin.Y+1)/2)
+			planes = image.Rect((planes.Min.X+1)/2, (planes.Min.Y+1)/2, (planes.Max.X+1)/2, (planes.Max.Y+1)/2)
 		}
 	}
+	if d.dst != nil && d.dst.Bounds() != planes.Add(origin) {
+		return nil, image.Rectangle{}, false, fmt.Errorf("destination bounds %v do not match decoded bounds %v",
+			d.dst.Bounds(), planes.Add(origin))
+	}
 
 	// Create output image based on number of components
 	numComp := int(h.NumComponents)
 	if numComp == 0 || len(h.ComponentInfo) == 0 {
-		return nil, fmt.Errorf("invalid image: no components")
+		return nil, image.Rectangle{}, false, fmt.Errorf("invalid image: no components")
+	}
+	luminance = d.luminanceOnly(cfg)
+	if luminance {
+		numComp = 1
 	}
-	precision := h.ComponentInfo[0].Precision()
-	signed := h.ComponentInfo[0].IsSigned()
 
 	// Allocate component data
-	componentData := make([][]int32, numComp)
-	for c := 0; c < numComp; c++ {
-		componentData[c] = make([]int32, width*height)
+	componentData = d.componentPlanes(numComp, planes.Dx()*planes.Dy())
+
+	// Find the tiles that overlap the area
+	var tiles []int
+	for ty := 0; ty < int(h.NumTilesY); ty++ {
+		for tx := 0; tx < int(h.NumTilesX); tx++ {
+			tileX0 := int(h.TileXOffset) + tx*int(h.TileWidth)
+			tileY0 := int(h.TileYOffset) + ty*int(h.TileHeight)
+			tileRect := image.Rect(tileX0, tileY0, tileX0+int(h.TileWidth), tileY0+int(h.TileHeight))
+			if tileRect.Overlaps(area) {
+				tiles = append(tiles, ty*int(h.NumTilesX)+tx)
+			}
+		}
 	}
 
-	// Decode each tile
-	tileDecoder := tcd.NewTileDecoder(h)
-	numTiles := int(h.NumTilesX * h.NumTilesY)
+	// Decode the tiles on a pool of workers, each with its own tile
+	// decoder. Tiles cover disjoint parts of the component planes, so
+	// they are pasted without locking.
+	numWorkers := runtime.GOMAXPROCS(0)
+	if cfg != nil && cfg.MaxWorkers > 0 {
+		numWorkers = cfg.MaxWorkers
+	}
+	if numWorkers > len(tiles) {
+		numWorkers = len(tiles)
+	}
+
+	jobs := make(chan int, len(tiles))
+	for i := range tiles {
+		jobs <- i
+	}
+	close(jobs)
+
+	errs := make([]error, len(tiles))
+	damaged := make([]int, len(tiles))
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		tileDecoder := d.tileDecoder(w, cfg)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				dt, err := d.decodeTileCached(tileDecoder, tiles[i], numComp, cfg)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				damaged[i] = dt.damaged
+				dt.paste(componentData, planes)
+			}
+		}()
+	}
+	wg.Wait()
 
-	for tileIdx := 0; tileIdx < numTiles; tileIdx++ {
-		if err := d.decodeTile(tileDecoder, tileIdx, componentData, width, height, cfg); err != nil {
-			return nil, fmt.Errorf("decoding tile %d: %w", tileIdx, err)
+	// The trace covers the tiles decoded before any error, to help
+	// diagnose it
+	if d.traces != nil {
+		if err := writeTrace(cfg.Debug, d.traces, tiles); err != nil {
+			return nil, image.Rectangle{}, false, fmt.Errorf("tracing packets: %w", err)
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			return nil, image.Rectangle{}, false, fmt.Errorf("decoding tile %d: %w", tiles[i], err)
+		}
+	}
+	if cfg != nil && cfg.CollectStats != nil {
+		*cfg.CollectStats = DecodeStats{}
+		for _, n := range damaged {
+			cfg.CollectStats.RecoveredErrors += n
 		}
 	}
 
-	// Apply inverse MCT if needed
-	if h.CodingStyle.MultipleComponentXf != 0 && numComp >= 3 {
-		if h.CodingStyle.IsReversible() {
-			mct.InverseRCT(componentData[0], componentData[1], componentData[2])
-		} else {
-			// Convert to float for ICT
-			compFloat := make([][]float64, 3)
-			for c := 0; c < 3; c++ {
-				compFloat[c] = make([]float64, len(componentData[c]))
-				for i, v := range componentData[c] {
-					compFloat[c][i] = float64(v)
-				}
+	return componentData, planes.Add(origin), luminance, nil
+}
+
+// decodeComponents decodes the component planes selected by cfg and
+// reconstructs their samples without converting them to an image.
+func (d *decoder) decodeComponents(cfg *Config) ([][]int32, *Metadata, error) {
+	if err := d.readFormat(); err != nil {
+		return nil, nil, fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return nil, nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+	m, err := d.metadata(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	componentData, _, luminance, err := d.decodePlanes(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding tiles: %w", err)
+	}
+	if luminance {
+		if info := d.header.ComponentInfo[0]; !info.IsSigned() {
+			mct.DCLevelShiftInverse(componentData[0], info.Precision())
+		}
+		return componentData, m, nil
+	}
+	if err := d.reconstructSamples(componentData); err != nil {
+		return nil, nil, fmt.Errorf("decoding tiles: %w", err)
+	}
+	return componentData, m, nil
+}
+
+// luminanceOnly reports whether cfg asks for the luminance alone and the
+// first component of the image carries it.
+func (d *decoder) luminanceOnly(cfg *Config) bool {
+	h := d.header
+	if cfg == nil || !cfg.LuminanceOnly || h.NumComponents < 3 || len(h.MCTStageOrder) > 0 {
+		return false
+	}
+	if d.jp2Header != nil && d.jp2Header.Palette != nil {
+		return false
+	}
+	if h.CodingStyle.MultipleComponentXf != 0 {
+		return true
+	}
+	switch d.getColorSpace() {
+	case ColorSpaceSYCC, ColorSpaceEYCC, ColorSpaceYCbCr2, ColorSpaceYCbCr3,
+		ColorSpacePhotoYCC, ColorSpaceYPbPr60, ColorSpaceYPbPr50:
+		return true
+	}
+	return false
+}
+
+// finishLuminance applies the DC level shift to the luminance plane of a
+// LuminanceOnly decode, which covers bounds, and builds a grayscale image.
+func (d *decoder) finishLuminance(plane []int32, bounds image.Rectangle) (image.Image, error) {
+	info := d.header.ComponentInfo[0]
+	signed := info.IsSigned()
+	precision := info.Precision()
+	if !signed {
+		mct.DCLevelShiftInverse(plane, precision)
+	}
+
+	componentData := [][]int32{plane}
+	if precision > 16 && d.model == nil {
+		return gray32Image(d.dst, plane, bounds, min(precision, 32), signed), nil
+	}
+	if signed && precision > 1 {
+		precision = wrapSigned(componentData, precision)
+	}
+	return d.createImage(componentData, bounds, 1, precision, signed)
+}
+
+// eachTile decodes the tiles in raster order, one at a time, and passes
+// each to fn as an image covering the part of the tile inside the image
+// area. Only one tile's samples are held at a time. An error from fn
+// stops the walk and is returned unchanged.
+func (d *decoder) eachTile(fn func(tile image.Image, tileX, tileY int) error) error {
+	if err := d.readFormat(); err != nil {
+		return fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return fmt.Errorf("parsing codestream: %w", err)
+	}
+
+	h := d.header
+	if h.IsHTJ2K() {
+		return ErrUnsupportedHTJ2K
+	}
+	if d.tilePartErr != nil {
+		return d.tilePartErr
+	}
+	numComp := int(h.NumComponents)
+	if numComp == 0 || len(h.ComponentInfo) == 0 {
+		return fmt.Errorf("invalid image: no components")
+	}
+
+	origin := image.Pt(int(h.ImageXOffset), int(h.ImageYOffset))
+	imageArea := image.Rect(0, 0, int(h.ImageWidth-h.ImageXOffset), int(h.ImageHeight-h.ImageYOffset))
+	tileDecoder := tcd.NewTileDecoder(h)
+
+	for ty := 0; ty < int(h.NumTilesY); ty++ {
+		for tx := 0; tx < int(h.NumTilesX); tx++ {
+			tileIdx := ty*int(h.NumTilesX) + tx
+			dt, err := d.decodeTile(tileDecoder, tileIdx, d.qualityLayers(nil), 0, numComp)
+			if err != nil {
+				return fmt.Errorf("decoding tile %d: %w", tileIdx, err)
 			}
-			mct.InverseICT(compFloat[0], compFloat[1], compFloat[2])
-			for c := 0; c < 3; c++ {
-				for i, v := range compFloat[c] {
-					componentData[c][i] = int32(v + 0.5)
-				}
+
+			area := dt.rect.Intersect(imageArea)
+			if area.Empty() {
+				continue
+			}
+			componentData := make([][]int32, numComp)
+			for c := range componentData {
+				componentData[c] = make([]int32, area.Dx()*area.Dy())
+			}
+			dt.paste(componentData, area)
+
+			img, err := d.finishImage(componentData, area.Add(origin))
+			if err != nil {
+				return fmt.Errorf("decoding tile %d: %w", tileIdx, err)
+			}
+			if err := fn(img, tx, ty); err != nil {
+				return err
 			}
 		}
 	}
 
-	// Apply DC level shift
-	for c := 0; c < numComp; c++ {
-		if !h.ComponentInfo[c].IsSigned() {
-			mct.DCLevelShiftInverse(componentData[c], h.ComponentInfo[c].Precision())
+	return nil
+}
+
+// finishImage applies the inverse component transform, DC level shift,
+// precision normalization and color conversion to componentData, whose
+// planes cover bounds, and builds the output image.
+func (d *decoder) finishImage(componentData [][]int32, bounds image.Rectangle) (image.Image, error) {
+	h := d.header
+	numComp := int(h.NumComponents)
+	signed := h.ComponentInfo[0].IsSigned()
+
+	if err := d.reconstructSamples(componentData); err != nil {
+		return nil, err
+	}
+
+	// Expand palette indices into the palette's output channels
+	info := h.ComponentInfo
+	if d.jp2Header != nil && d.jp2Header.Palette != nil {
+		var err error
+		componentData, info, err = applyPalette(d.jp2Header.Palette, d.jp2Header.ComponentMap, componentData, info)
+		if err != nil {
+			return nil, err
+		}
+		numComp = len(componentData)
+		signed = info[0].IsSigned()
+	}
+
+	// Put the channels in the roles the channel definition box gives them
+	alpha := alphaUnspecified
+	if d.jp2Header != nil && d.jp2Header.ChannelDef != nil {
+		var err error
+		componentData, info, alpha, err = arrangeChannels(d.jp2Header.ChannelDef, componentData, info)
+		if err != nil {
+			return nil, err
 		}
+		numComp = len(componentData)
 	}
 
-	// Apply color space conversion if needed
+	// Bring mixed-precision components to a common bit depth
+	precision := normalizePrecision(componentData, info)
+
+	// Apply color space conversion if needed. Four-colour spaces convert
+	// to RGB in the first three channels, so the fourth is dropped.
 	if d.jp2Header != nil && d.jp2Header.ColorSpec != nil {
 		cs := d.getColorSpace()
 		if conv := getColorConversion(cs); conv != nil {
 			conv(componentData, precision)
+			if (cs == ColorSpaceCMYK || cs == ColorSpaceYCCK) && numComp >= 4 {
+				componentData = append(componentData[:3:3], componentData[4:]...)
+				numComp--
+			}
 		}
 	}
 
-	// Create output image
-	return d.createImage(componentData, width, height, numComp, precision, signed)
-}
+	// Keep deep grayscale samples at full precision rather than
+	// truncating them to 16 bits
+	if numComp == 1 && precision > 16 && d.model == nil {
+		return gray32Image(d.dst, componentData[0], bounds, min(precision, 32), signed), nil
+	}
 
-// decodeTile decodes a single tile.
-func (d *decoder) decodeTile(
-	tileDecoder *tcd.TileDecoder,
-	tileIdx int,
-	componentData [][]int32,
-	imgWidth, imgHeight int,
-	cfg *Config,
-) error {
-	h := d.header
+	if signed && precision > 1 {
+		precision = wrapSigned(componentData, precision)
+	}
 
-	// Initialize tile
-	tileDecoder.InitTile(tileIdx)
+	return d.composeImage(componentData, bounds, numComp, precision, signed, alpha)
+}
 
-	// For now, we'll do a simplified decode
-	// A full implementation would:
-	// 1. Read tile-part headers and data from codestream
-	// 2. Decode T2 packets
-	// 3. Decode T1 code-blocks
-	// 4. Apply inverse DWT
+// alphaKind is the meaning of the last channel of an image whose channels
+// are arranged by arrangeChannels.
+type alphaKind int
 
-	tile := tileDecoder.Tile()
-	if tile == nil {
-		return fmt.Errorf("tile %d not initialized", tileIdx)
-	}
+const (
+	// alphaUnspecified means there is no channel definition box: a
+	// second or fourth channel is taken as alpha and copied unchanged
+	// into RGBA images.
+	alphaUnspecified alphaKind = iota
 
-	// Copy tile data to output (placeholder - actual decode would happen here)
-	for c := 0; c < len(tile.Components) && c < len(componentData); c++ {
-		tc := tile.Components[c]
-		if tc == nil {
-			continue
-		}
+	// alphaNone means every channel is a colour channel.
+	alphaNone
 
-		// Apply inverse DWT
-		tileDecoder.ApplyInverseDWT(tc)
+	// alphaStraight and alphaPremultiplied mean the last channel is
+	// opacity, which the colour channels are not or are multiplied by.
+	alphaStraight
+	alphaPremultiplied
+)
 
-		// Copy to output
-		for y := tc.Y0; y < tc.Y1 && y-int(h.ImageYOffset) < imgHeight; y++ {
-			for x := tc.X0; x < tc.X1 && x-int(h.ImageXOffset) < imgWidth; x++ {
-				srcIdx := (y-tc.Y0)*(tc.X1-tc.X0) + (x - tc.X0)
-				dstX := x - int(h.ImageXOffset)
-				dstY := y - int(h.ImageYOffset)
-				if dstX >= 0 && dstY >= 0 && dstX < imgWidth && dstY < imgHeight {
-					dstIdx := dstY*imgWidth + dstX
-					if srcIdx < len(tc.Data) {
-						componentData[c][dstIdx] = tc.Data[srcIdx]
-					}
-				}
+// arrangeChannels orders the channels of componentData as cdef describes
+// them: the colour channels by the colour they are associated with, then
+// the first opacity channel if there is one. Channels without a colour or
+// opacity role are dropped. If cdef gives no colour channels the channels
+// are returned as they are.
+func arrangeChannels(
+	cdef *box.ChannelDefBox,
+	componentData [][]int32,
+	info []codestream.ComponentInfo,
+) ([][]int32, []codestream.ComponentInfo, alphaKind, error) {
+	var colors []box.ChannelDefinition
+	var opacity *box.ChannelDefinition
+	for i, def := range cdef.Definitions {
+		if int(def.Channel) >= len(componentData) {
+			return nil, nil, 0, fmt.Errorf("channel definition for channel %d of %d", def.Channel, len(componentData))
+		}
+		switch def.Type {
+		case box.ChannelColor:
+			if def.Association != box.AssociationImage && def.Association != box.ChannelUnspecified {
+				colors = append(colors, def)
+			}
+		case box.ChannelOpacity, box.ChannelPremultipliedOpacity:
+			if opacity == nil {
+				opacity = &cdef.Definitions[i]
 			}
 		}
 	}
-
-	return nil
+	if len(colors) == 0 {
+		return componentData, info, alphaUnspecified, nil
+	}
+	slices.SortStableFunc(colors, func(a, b box.ChannelDefinition) int {
+		return int(a.Association) - int(b.Association)
+	})
+
+	var data [][]int32
+	var arranged []codestream.ComponentInfo
+	for _, def := range colors {
+		data = append(data, componentData[def.Channel])
+		arranged = append(arranged, info[def.Channel])
+	}
+	alpha := alphaNone
+	if opacity != nil {
+		data = append(data, componentData[opacity.Channel])
+		arranged = append(arranged, info[opacity.Channel])
+		alpha = alphaStraight
+		if opacity.Type == box.ChannelPremultipliedOpacity {
+			alpha = alphaPremultiplied
+		}
+	}
+	return data, arranged, alpha, nil
 }
 
-// createImage creates the output image from component data.
-func (d *decoder) createImage(
+// composeImage builds the output image from channels arranged by
+// arrangeChannels, whose last channel has the meaning alpha. Straight
+// alpha gives an NRGBA or NRGBA64 image and premultiplied alpha an RGBA
+// or RGBA64 one. Four colour channels that were not converted to RGB are
+// taken as CMYK.
+func (d *decoder) composeImage(
 	componentData [][]int32,
-	width, height int,
+	bounds image.Rectangle,
 	numComp int,
 	precision int,
 	signed bool,
+	alpha alphaKind,
 ) (image.Image, error) {
-	// Determine scaling factor
-	maxVal := int32((1 << precision) - 1)
+	if alpha == alphaNone && numComp == 2 {
+		// Two colours have no image type; keep the first as gray
+		componentData, numComp = componentData[:1], 1
+	}
+	if alpha == alphaPremultiplied && numComp == 2 {
+		componentData = [][]int32{componentData[0], componentData[0], componentData[0], componentData[1]}
+		numComp = 4
+	}
 
-	switch numComp {
-	case 1:
-		// Grayscale
+	if d.model != nil {
+		if alpha == alphaNone && numComp == 4 {
+			convertCMYKToRGB(componentData, precision)
+			componentData, numComp = componentData[:3], 3
+		}
+		if alpha == alphaPremultiplied {
+			unpremultiply(componentData, precision)
+		}
+		return d.modelImage(d.model, componentData, bounds, numComp, precision)
+	}
+
+	switch {
+	case alpha == alphaNone && numComp == 4:
+		return d.cmykImage(componentData, bounds, precision), nil
+	case alpha == alphaStraight && precision <= 8:
+		return d.modelImage(color.NRGBAModel, componentData, bounds, numComp, precision)
+	case alpha == alphaStraight:
+		return d.modelImage(color.NRGBA64Model, componentData, bounds, numComp, precision)
+	}
+	return d.createImage(componentData, bounds, numComp, precision, signed)
+}
+
+// unpremultiply divides the colour channels of componentData by the
+// opacity in its last channel.
+func unpremultiply(componentData [][]int32, precision int) {
+	maxVal := int64(1)<<min(precision, 31) - 1
+	a := componentData[len(componentData)-1]
+	for _, data := range componentData[:len(componentData)-1] {
+		for i, v := range data {
+			if a[i] > 0 {
+				data[i] = int32(min(int64(v)*maxVal/int64(a[i]), maxVal))
+			}
+		}
+	}
+}
+
+// cmykImage builds an 8-bit CMYK image from four colour channels.
+func (d *decoder) cmykImage(componentData [][]int32, bounds image.Rectangle, precision int) *image.CMYK {
+	maxVal := int64(1)<<min(precision, 31) - 1
+	img := outputImage(d.dst, bounds, image.NewCMYK)
+	w := bounds.Dx()
+	for i := range componentData[0] {
+		var c [4]uint8
+		for k := range c {
+			c[k] = uint8(min(max(int64(componentData[k][i]), 0), maxVal) * 255 / maxVal)
+		}
+		img.SetCMYK(bounds.Min.X+i%w, bounds.Min.Y+i/w, color.CMYK{C: c[0], M: c[1], Y: c[2], K: c[3]})
+	}
+	return img
+}
+
+// reconstructSamples applies the inverse component transform and the DC
+// level shift to componentData, leaving each component's samples in its
+// own signed or unsigned precision range.
+func (d *decoder) reconstructSamples(componentData [][]int32) error {
+	h := d.header
+	numComp := int(h.NumComponents)
+
+	// Apply the inverse component transform: the Part 2 stages listed
+	// by an MCO marker if present, otherwise RCT/ICT
+	if len(h.MCTStageOrder) > 0 {
+		if err := inverseMCC(h, componentData); err != nil {
+			return err
+		}
+	} else if h.CodingStyle.MultipleComponentXf != 0 && numComp >= 3 {
+		if h.CodingStyle.IsReversible() {
+			mct.InverseRCT(componentData[0], componentData[1], componentData[2])
+		} else {
+			// Convert to float for ICT
+			compFloat := d.floatPlanes(len(componentData[0]))
+			for c := 0; c < 3; c++ {
+				for i, v := range componentData[c] {
+					compFloat[c][i] = float64(v)
+				}
+			}
+			mct.InverseICT(compFloat[0], compFloat[1], compFloat[2])
+			for c := 0; c < 3; c++ {
+				for i, v := range compFloat[c] {
+					componentData[c][i] = int32(math.Round(v))
+				}
+			}
+		}
+	}
+
+	// Apply DC level shift
+	for c := 0; c < numComp; c++ {
+		if !h.ComponentInfo[c].IsSigned() {
+			mct.DCLevelShiftInverse(componentData[c], h.ComponentInfo[c].Precision())
+		}
+	}
+
+	return nil
+}
+
+// colorModel returns the color model of the image finishImage builds:
+// palettes are expanded first, then the widest component decides between
+// 8- and 16-bit samples.
+func (d *decoder) colorModel() (color.Model, error) {
+	h := d.header
+	info := h.ComponentInfo
+	if len(info) == 0 {
+		return nil, fmt.Errorf("invalid image: no components")
+	}
+	if d.jp2Header != nil && d.jp2Header.Palette != nil {
+		var err error
+		_, info, err = applyPalette(d.jp2Header.Palette, d.jp2Header.ComponentMap, make([][]int32, len(info)), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alpha := alphaUnspecified
+	if d.jp2Header != nil && d.jp2Header.ChannelDef != nil {
+		var err error
+		_, info, alpha, err = arrangeChannels(d.jp2Header.ChannelDef, make([][]int32, len(info)), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	precision := 0
+	for _, ci := range info {
+		precision = max(precision, ci.Precision())
+	}
+
+	numComp := len(info)
+	if cs := d.getColorSpace(); (cs == ColorSpaceCMYK || cs == ColorSpaceYCCK) && numComp >= 4 {
+		numComp--
+	}
+	switch {
+	case alpha == alphaNone && numComp == 4:
+		return color.CMYKModel, nil
+	case alpha == alphaNone && numComp == 2:
+		numComp = 1
+	case alpha == alphaStraight && precision <= 8:
+		return color.NRGBAModel, nil
+	case alpha == alphaStraight:
+		return color.NRGBA64Model, nil
+	case alpha == alphaPremultiplied:
+		numComp = 4
+	}
+
+	switch numComp {
+	case 1:
+		if precision <= 8 {
+			return color.GrayModel, nil
+		}
+		return color.Gray16Model, nil
+	case 3, 4:
+		if precision <= 8 {
+			return color.RGBAModel, nil
+		}
+		return color.RGBA64Model, nil
+	default:
+		return nil, &UnsupportedFeatureError{Feature: fmt.Sprintf("%d components", numComp)}
+	}
+}
+
+// part2Tools names the Part 2 coding tools whose marker segments the
+// parser skips; a codestream using them decodes incorrectly.
+var part2Tools = map[codestream.Marker]string{
+	codestream.DCO: "variable DC offset",
+	codestream.VMS: "visual masking",
+	codestream.DFS: "downsampling factor styles",
+	codestream.ADS: "arbitrary decomposition styles",
+	codestream.NLT: "non-linearity point transformation",
+	codestream.ATK: "arbitrary wavelet kernels",
+}
+
+// unsupportedFeatures lists the features of the parsed main header that
+// the decoder cannot handle: those it rejects with an
+// *UnsupportedFeatureError and the Part 2 coding tools it would ignore.
+func (d *decoder) unsupportedFeatures() []string {
+	h := d.header
+	var features []string
+	if h.IsHTJ2K() {
+		features = append(features, ErrUnsupportedHTJ2K.(*UnsupportedFeatureError).Feature)
+	}
+
+	for _, m := range h.UnknownMarkers {
+		if tool, ok := part2Tools[m]; ok {
+			features = append(features, fmt.Sprintf("%s marker (Part 2 %s)", m, tool))
+		}
+	}
+
+	if w := h.CodingStyle.WaveletTransform; w > 1 {
+		features = append(features, fmt.Sprintf("wavelet transform %d", w))
+	}
+	if q := h.Quantization.QuantizationStyle; q > 2 {
+		features = append(features, fmt.Sprintf("quantization style %d", q))
+	}
+	for c := uint16(0); c < h.NumComponents; c++ {
+		if coc, ok := h.ComponentCodingStyles[c]; ok && coc.WaveletTransform > 1 {
+			features = append(features, fmt.Sprintf("wavelet transform %d in component %d", coc.WaveletTransform, c))
+		}
+		if qcc, ok := h.ComponentQuantization[c]; ok && qcc.QuantizationStyle > 2 {
+			features = append(features, fmt.Sprintf("quantization style %d in component %d", qcc.QuantizationStyle, c))
+		}
+	}
+
+	for _, idx := range h.MCTStageOrder {
+		if stage := h.Stage(idx); stage != nil {
+			for _, col := range stage.Collections {
+				if col.Type != codestream.MCCDecorrelation {
+					features = append(features, fmt.Sprintf("MCC transform type %d", col.Type))
+				}
+			}
+		}
+	}
+
+	var ufe *UnsupportedFeatureError
+	if _, err := d.colorModel(); errors.As(err, &ufe) {
+		features = append(features, ufe.Feature)
+	}
+	return features
+}
+
+// inverseMCC applies the array-based multiple component transform stages
+// of a Part 2 codestream, in the order given by the MCO marker. Only
+// square decorrelation arrays are supported; dependency and
+// wavelet-based transforms are rejected.
+func inverseMCC(h *codestream.Header, componentData [][]int32) error {
+	planes := func(idx []uint16) ([][]int32, error) {
+		p := make([][]int32, len(idx))
+		for i, c := range idx {
+			if int(c) >= len(componentData) {
+				return nil, fmt.Errorf("MCC references component %d of %d", c, len(componentData))
+			}
+			p[i] = componentData[c]
+		}
+		return p, nil
+	}
+
+	for _, idx := range h.MCTStageOrder {
+		stage := h.Stage(idx)
+		if stage == nil {
+			return fmt.Errorf("MCO references undefined MCC stage %d", idx)
+		}
+		for _, col := range stage.Collections {
+			if col.Type != codestream.MCCDecorrelation {
+				return fmt.Errorf("MCC stage %d: %w", idx, &UnsupportedFeatureError{Feature: fmt.Sprintf("MCC transform type %d", col.Type)})
+			}
+			in, err := planes(col.Inputs)
+			if err != nil {
+				return err
+			}
+			out, err := planes(col.Outputs)
+			if err != nil {
+				return err
+			}
+
+			matrix := h.Array(col.MatrixIndex)
+			if len(in) != len(out) || col.MatrixIndex == 0 || matrix == nil ||
+				matrix.Type != codestream.MCTArrayDecorrelation || len(matrix.Values) != len(in)*len(out) {
+				return fmt.Errorf("MCC stage %d: missing or mismatched decorrelation array %d", idx, col.MatrixIndex)
+			}
+			var offsets []float64
+			if col.OffsetIndex != 0 {
+				a := h.Array(col.OffsetIndex)
+				if a == nil || a.Type != codestream.MCTArrayOffset || len(a.Values) != len(out) {
+					return fmt.Errorf("MCC stage %d: missing or mismatched offset array %d", idx, col.OffsetIndex)
+				}
+				offsets = a.Values
+			}
+
+			// The array holds the decoder's matrix, so it is applied as
+			// the inverse transform as is.
+			xf := &mct.CustomMCT{Inverse: matrix.Values, NumComponents: len(in)}
+			compFloat := make([][]float64, len(in))
+			for c, plane := range in {
+				compFloat[c] = make([]float64, len(plane))
+				mct.ConvertInt32ToFloat64(plane, compFloat[c])
+			}
+			xf.ApplyInverse(compFloat)
+			for c, plane := range out {
+				if offsets != nil {
+					for i := range compFloat[c] {
+						compFloat[c][i] += offsets[c]
+					}
+				}
+				mct.ConvertFloat64ToInt32(compFloat[c], plane)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeTileCached returns the decoded tile with its first numComp
+// components, consulting cfg.TileCache before decoding and populating it
+// afterwards.
+func (d *decoder) decodeTileCached(
+	tileDecoder *tcd.TileDecoder,
+	tileIdx int,
+	numComp int,
+	cfg *Config,
+) (*decodedTile, error) {
+	reduce := 0
+	if cfg != nil {
+		reduce = cfg.ReduceResolution
+	}
+	if cfg == nil || cfg.TileCache == nil {
+		return d.decodeTile(tileDecoder, tileIdx, d.qualityLayers(cfg), reduce, numComp)
+	}
+
+	key := tileCacheKey(tileIdx, d.qualityLayers(cfg), reduce)
+	if numComp < int(d.header.NumComponents) {
+		key += fmt.Sprintf("/components=%d", numComp)
+	}
+	if d.resilient {
+		key += "/resilient"
+	}
+	if img, ok := cfg.TileCache.Get(key); ok {
+		if dt, ok := img.(*decodedTile); ok {
+			return dt, nil
+		}
+	}
+
+	dt, err := d.decodeTile(tileDecoder, tileIdx, d.qualityLayers(cfg), reduce, numComp)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TileCache.Set(key, dt)
+	return dt, nil
+}
+
+// tileCacheKey builds the TileCache key for a tile decoded with the given
+// number of quality layers and resolution reduction.
+func tileCacheKey(tileIdx, layers, reduce int) string {
+	return fmt.Sprintf("tile=%d/layers=%d/reduce=%d", tileIdx, layers, reduce)
+}
+
+// qualityLayers returns the number of quality layers to decode under cfg:
+// Config.QualityLayers clamped to the layers in the codestream, with 0
+// meaning all of them.
+func (d *decoder) qualityLayers(cfg *Config) int {
+	n := int(d.header.CodingStyle.NumLayers)
+	if cfg != nil && cfg.QualityLayers > 0 && cfg.QualityLayers < n {
+		return cfg.QualityLayers
+	}
+	return n
+}
+
+// decodeTile decodes the first numComp components of a single tile from
+// its first layers quality layers, discarding the reduce highest
+// resolution levels.
+func (d *decoder) decodeTile(tileDecoder *tcd.TileDecoder, tileIdx, layers, reduce, numComp int) (*decodedTile, error) {
+	h := d.header
+	th := d.tileHeader(tileIdx)
+	if th.IsHTJ2K() {
+		return nil, ErrUnsupportedHTJ2K
+	}
+	for c := range th.ComponentInfo[:min(numComp, len(th.ComponentInfo))] {
+		if levels := int(th.ComponentCodingStyle(c).NumDecompositions); reduce > levels {
+			return nil, fmt.Errorf("resolution reduction %d exceeds the %d decomposition levels of component %d",
+				reduce, levels, c)
+		}
+	}
+	// Decoding every layer the main header signals decodes every layer of
+	// the tile, whose COD may signal more
+	if layers >= int(h.CodingStyle.NumLayers) {
+		layers = max(layers, int(th.CodingStyle.NumLayers))
+	}
+
+	// Initialize tile
+	tileDecoder.SetHeader(th)
+	tileDecoder.SetReduce(reduce)
+	tileDecoder.SetResilient(d.resilient)
+	tileDecoder.InitTile(tileIdx)
+	tile := tileDecoder.Tile()
+	if tile == nil {
+		return nil, fmt.Errorf("tile %d not initialized", tileIdx)
+	}
+
+	damaged, err := d.decodePackets(tile, layers, d.resilient)
+	if err != nil {
+		return nil, err
+	}
+	components := tile.Components[:min(numComp, len(tile.Components))]
+	for _, tc := range components {
+		if err := tileDecoder.DecodeComponent(tc); err != nil {
+			return nil, fmt.Errorf("component %d: %w", tc.Index, err)
+		}
+	}
+
+	// Apply inverse DWT, one goroutine per component
+	if len(components) == len(tile.Components) {
+		tileDecoder.ApplyInverseDWTTile(tile)
+	} else {
+		for _, tc := range components {
+			tileDecoder.ApplyInverseDWT(tc)
+		}
+	}
+
+	// Component bounds at the decoded resolution, relative to the image
+	// origin at that resolution
+	scale := func(v int) int { return (v + 1<<reduce - 1) >> reduce }
+	ox, oy := scale(int(h.ImageXOffset)), scale(int(h.ImageYOffset))
+	dt := &decodedTile{
+		rect:       image.Rect(scale(tile.X0)-ox, scale(tile.Y0)-oy, scale(tile.X1)-ox, scale(tile.Y1)-oy),
+		origin:     image.Pt(ox, oy),
+		components: make([]tileComponentData, len(components)),
+		damaged:    damaged + tileDecoder.DamagedBlocks(),
+	}
+	for c, tc := range components {
+		info := h.ComponentInfo[tc.Index]
+		dt.components[c] = tileComponentData{
+			rect: image.Rect(scale(tc.X0), scale(tc.Y0), scale(tc.X1), scale(tc.Y1)),
+			data: tc.Data,
+			dx:   int(info.SubsamplingX),
+			dy:   int(info.SubsamplingY),
+			regX: int(info.RegistrationX),
+			regY: int(info.RegistrationY),
+		}
+	}
+
+	return dt, nil
+}
+
+// tileHeader returns the header tile tileIdx is coded with: the main
+// header with the overrides of the tile's tile-part headers applied.
+func (d *decoder) tileHeader(tileIdx int) *codestream.Header {
+	if tileIdx < len(d.tiles) && d.tiles[tileIdx] != nil {
+		return d.tiles[tileIdx].header
+	}
+	return d.header
+}
+
+// decodePackets reads the packets of tile, in progression order, into the
+// code-blocks of its precincts, keeping the contributions of the first
+// layers quality layers. Packets of the discarded resolution levels are
+// still read, since later packets can only be found by parsing them.
+// A packet that cannot be parsed, or that the tile's data ends in the
+// middle of, stops decoding with an error, wrapping ErrTruncated in the
+// latter case. SOP and EPH markers are skipped when the COD in force for
+// the tile signals them.
+//
+// With resilient set, decoding instead stops quietly at such a packet,
+// keeping the code-block data read so far. If SOP markers are in use as
+// well, the packet is undone: its precinct keeps what earlier packets
+// gave it and takes nothing more, and decoding resumes at the next SOP
+// marker. The number of damaged packets is returned.
+func (d *decoder) decodePackets(tile *tcd.Tile, layers int, resilient bool) (int, error) {
+	if tile.Index >= len(d.tiles) || d.tiles[tile.Index] == nil {
+		return 0, nil
+	}
+	parts := d.tiles[tile.Index]
+	var data []byte
+	for _, seg := range parts.segments {
+		data = append(data, d.codestream[seg[0]:seg[1]]...)
+	}
+
+	cod := parts.header.CodingStyle
+	sop := cod.CodingStyle&codestream.CodingStyleSOP != 0
+	eph := cod.CodingStyle&codestream.CodingStyleEPH != 0
+	it := tilePackets(tile, cod, parts.header.ProgressionOrderChanges)
+	dec := tcd.NewPacketDecoder(data)
+	if parts.headers != nil {
+		// Headers moved into PPM or PPT marker segments
+		dec = tcd.NewPackedPacketDecoder(parts.headers, data)
+	}
+	// Resynchronizing needs the SOP markers, and headers in the packet
+	// bodies, which they delimit
+	resync := resilient && sop && parts.headers == nil
+
+	// The layers of a precinct arrive in order, so the state of its
+	// code-blocks when its first unwanted layer arrives is what the
+	// wanted layers left.
+	type blockState struct{ passes, data int }
+	var kept map[*tcd.CodeBlock]blockState
+
+	// For resilient decoding: the precincts that lost a packet, the
+	// first packet after the damage that can be decoded, and the last
+	// packet decoded along with the state of its precinct beforehand
+	var (
+		damaged  = make(map[*tcd.Precinct]bool)
+		damages  int
+		resume   int
+		last     *tcd.Precinct
+		lastFrom int
+		before   map[*tcd.CodeBlock]blockState
+	)
+	// undo restores the precinct of the last packet to its state before
+	// it and marks it damaged
+	undo := func() {
+		for cb, st := range before {
+			cb.Passes = cb.Passes[:st.passes]
+			cb.Data = cb.Data[:st.data]
+			if k, ok := kept[cb]; ok {
+				kept[cb] = blockState{min(k.passes, st.passes), min(k.data, st.data)}
+			}
+		}
+		damaged[last] = true
+		damages++
+		last = nil
+	}
+	// resyncSOP moves to the first SOP marker at or after from and sets
+	// resume to the first packet from next on with its sequence number
+	resyncSOP := func(from, next int) bool {
+		seq, ok := dec.ResyncSOP(from)
+		resume = next + (seq-next)&0xFFFF
+		return ok
+	}
+
+	// decode decodes packet p into prec, adding it to the tile's trace
+	// when tracing
+	decode := func(prec *tcd.Precinct, p tcd.Packet) error {
+		if d.traces == nil {
+			return dec.DecodePacket(prec, p.Layer, sop, eph)
+		}
+
+		// The presence bit leads the packet header, after any SOP
+		start, header := dec.Position(), data
+		pos := start
+		if parts.headers != nil {
+			header, pos = parts.headers, dec.HeaderPosition()
+		} else if _, ok := dec.SOP(); ok && sop {
+			pos += 6
+		}
+		present := pos < len(header) && header[pos]&0x80 != 0
+		var passes []int
+		for _, cbs := range prec.CodeBlocks {
+			for _, cb := range cbs {
+				passes = append(passes, len(cb.Passes))
+			}
+		}
+
+		err := dec.DecodePacket(prec, p.Layer, sop, eph)
+
+		// Code-blocks the packet includes gain coding passes; the
+		// first packet of a precinct starts its code-blocks afresh
+		t := packetTrace{
+			Tile:    tile.Index,
+			Packet:  &tracePacket{Layer: p.Layer, Resolution: p.Resolution, Component: p.Component, Precinct: p.Precinct},
+			Bytes:   int64(dec.Position() - start),
+			Present: present,
+		}
+		i := 0
+		for _, cbs := range prec.CodeBlocks {
+			for _, cb := range cbs {
+				if p.Layer == 0 {
+					passes[i] = 0
+				}
+				if len(cb.Passes) > passes[i] {
+					t.CodeBlocks++
+				}
+				i++
+			}
+		}
+		if err != nil {
+			t.Error = err.Error()
+		}
+		d.traces[tile.Index] = append(d.traces[tile.Index], t)
+		return err
+	}
+
+	n := -1 // sequence number of the packet, as SOP markers count them
+	for p, ok := it.Next(); ok; p, ok = it.Next() {
+		prec := tilePrecinct(tile, p)
+		if prec == nil {
+			continue
+		}
+		n++
+		if p.Layer == layers {
+			if kept == nil {
+				kept = make(map[*tcd.CodeBlock]blockState)
+			}
+			for _, cbs := range prec.CodeBlocks {
+				for _, cb := range cbs {
+					kept[cb] = blockState{len(cb.Passes), len(cb.Data)}
+				}
+			}
+		}
+
+		if !resync {
+			if err := decode(prec, p); err != nil {
+				if !resilient {
+					return 0, truncated(fmt.Errorf("packet %d: %w", n, err))
+				}
+				break
+			}
+			continue
+		}
+
+		if n >= resume {
+			if seq, ok := dec.SOP(); !ok || seq != n&0xFFFF {
+				// The packet before overran or stopped short of this one
+				from := dec.Position()
+				if last != nil {
+					from = lastFrom + 1
+					undo()
+				}
+				if !resyncSOP(from, n) {
+					break
+				}
+			}
+		}
+		// Packets skipped over are lost, and a precinct that lost one
+		// cannot parse the headers of its later packets
+		if n < resume {
+			damaged[prec] = true
+			continue
+		}
+		if damaged[prec] {
+			last = nil
+			dec.ResyncSOP(dec.Position() + 1)
+			continue
+		}
+
+		last, lastFrom, before = prec, dec.Position(), make(map[*tcd.CodeBlock]blockState)
+		for _, cbs := range prec.CodeBlocks {
+			for _, cb := range cbs {
+				before[cb] = blockState{len(cb.Passes), len(cb.Data)}
+			}
+		}
+		if err := decode(prec, p); err != nil {
+			undo()
+			if !resyncSOP(lastFrom+1, n+1) {
+				break
+			}
+		}
+	}
+
+	for cb, st := range kept {
+		cb.Passes = cb.Passes[:st.passes]
+		cb.Data = cb.Data[:st.data]
+	}
+	return damages, nil
+}
+
+// decodedTile holds the reconstructed samples of a single tile, before
+// inverse MCT and DC level shifting. It implements image.Image so that it
+// can be stored in a TileCache; At reports the first component as gray.
+type decodedTile struct {
+	rect       image.Rectangle
+	origin     image.Point // image origin on the reference grid
+	components []tileComponentData
+
+	// damaged counts the packets and code-blocks skipped by a
+	// resilient decode
+	damaged int
+}
+
+// tileComponentData holds one component's samples within a decoded tile.
+type tileComponentData struct {
+	// rect is the area of the samples on the component's own grid
+	rect image.Rectangle
+	data []int32
+
+	// dx and dy are the subsampling factors, and regX and regY the CRG
+	// registration offsets, in units of 1/65536 of dx and dy.
+	dx, dy     int
+	regX, regY int
+}
+
+// aligned reports whether the component's samples coincide with the
+// reference grid, so no interpolation is needed.
+func (tc *tileComponentData) aligned() bool {
+	return tc.dx == 1 && tc.dy == 1 && tc.regX == 0 && tc.regY == 0
+}
+
+// at returns the component's value at reference grid point (x, y).
+// Sample (i, j) lies at (dx*(i+regX/65536), dy*(j+regY/65536)), so
+// points between samples are interpolated bilinearly; samples beyond
+// the tile are taken from its edge.
+func (tc *tileComponentData) at(x, y int) int32 {
+	r := tc.rect
+	if r.Empty() {
+		return 0
+	}
+	sample := func(i, j int64) int64 {
+		i = max(int64(r.Min.X), min(i, int64(r.Max.X-1)))
+		j = max(int64(r.Min.Y), min(j, int64(r.Max.Y-1)))
+		return int64(tc.data[(int(j)-r.Min.Y)*r.Dx()+int(i)-r.Min.X])
+	}
+	if tc.aligned() {
+		return int32(sample(int64(x), int64(y)))
+	}
+
+	// Position on the sample grid in 1/65536 units
+	u := int64(x)<<16/int64(tc.dx) - int64(tc.regX)
+	v := int64(y)<<16/int64(tc.dy) - int64(tc.regY)
+	i, fx := u>>16, u&0xFFFF
+	j, fy := v>>16, v&0xFFFF
+
+	top := (sample(i, j)*(1<<16-fx) + sample(i+1, j)*fx + 1<<15) >> 16
+	bottom := (sample(i, j+1)*(1<<16-fx) + sample(i+1, j+1)*fx + 1<<15) >> 16
+	return int32((top*(1<<16-fy) + bottom*fy + 1<<15) >> 16)
+}
+
+// ColorModel implements image.Image.
+func (t *decodedTile) ColorModel() color.Model { return color.Gray16Model }
+
+// Bounds implements image.Image.
+func (t *decodedTile) Bounds() image.Rectangle { return t.rect }
+
+// At implements image.Image.
+func (t *decodedTile) At(x, y int) color.Color {
+	if len(t.components) == 0 {
+		return color.Gray16{}
+	}
+	if !(image.Point{x, y}.In(t.rect)) {
+		return color.Gray16{}
+	}
+	v := t.components[0].at(x+t.origin.X, y+t.origin.Y)
+	return color.Gray16{Y: uint16(clampInt32(v, 0, 0xFFFF))}
+}
+
+// paste copies the tile samples into component planes covering area,
+// upsampling subsampled components to the reference grid and applying
+// their registration offsets.
+func (t *decodedTile) paste(componentData [][]int32, area image.Rectangle) {
+	r := t.rect.Intersect(area)
+	for c := 0; c < len(t.components) && c < len(componentData); c++ {
+		tc := &t.components[c]
+		if !tc.aligned() {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					componentData[c][(y-area.Min.Y)*area.Dx()+(x-area.Min.X)] = tc.at(x+t.origin.X, y+t.origin.Y)
+				}
+			}
+			continue
+		}
+
+		w := tc.rect.Dx()
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				srcIdx := (y+t.origin.Y-tc.rect.Min.Y)*w + (x + t.origin.X - tc.rect.Min.X)
+				if srcIdx < len(tc.data) {
+					componentData[c][(y-area.Min.Y)*area.Dx()+(x-area.Min.X)] = tc.data[srcIdx]
+				}
+			}
+		}
+	}
+}
+
+// createImage creates the output image from component data.
+func (d *decoder) createImage(
+	componentData [][]int32,
+	bounds image.Rectangle,
+	numComp int,
+	precision int,
+	signed bool,
+) (image.Image, error) {
+	if d.model != nil {
+		return d.modelImage(d.model, componentData, bounds, numComp, precision)
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Determine scaling factor
+	maxVal := int32((1 << precision) - 1)
+
+	switch numComp {
+	case 1:
+		if precision == 1 {
+			return bilevelImage(d.dst, componentData[0], bounds, signed), nil
+		}
+		// Grayscale
 		if precision <= 8 {
-			img := image.NewGray(image.Rect(0, 0, width, height))
+			img := outputImage(d.dst, bounds, image.NewGray)
 			for y := 0; y < height; y++ {
 				for x := 0; x < width; x++ {
 					idx := y*width + x
@@ -443,13 +1738,13 @@ func (d *decoder) createImage(
 					if precision != 8 {
 						v = v * 255 / maxVal
 					}
-					img.SetGray(x, y, color.Gray{Y: uint8(v)})
+					img.SetGray(bounds.Min.X+x, bounds.Min.Y+y, color.Gray{Y: uint8(v)})
 				}
 			}
 			return img, nil
 		}
 		// 16-bit grayscale
-		img := image.NewGray16(image.Rect(0, 0, width, height))
+		img := outputImage(d.dst, bounds, image.NewGray16)
 		for y := 0; y < height; y++ {
 			for x := 0; x < width; x++ {
 				idx := y*width + x
@@ -461,8 +1756,8 @@ func (d *decoder) createImage(
 					v = maxVal
 				}
 				// Scale to 16-bit
-				v = v * 65535 / maxVal
-				img.SetGray16(x, y, color.Gray16{Y: uint16(v)})
+				v = scale16(v, maxVal)
+				img.SetGray16(bounds.Min.X+x, bounds.Min.Y+y, color.Gray16{Y: uint16(v)})
 			}
 		}
 		return img, nil
@@ -470,7 +1765,7 @@ func (d *decoder) createImage(
 	case 3:
 		// RGB
 		if precision <= 8 {
-			img := image.NewRGBA(image.Rect(0, 0, width, height))
+			img := outputImage(d.dst, bounds, image.NewRGBA)
 			for y := 0; y < height; y++ {
 				for x := 0; x < width; x++ {
 					idx := y*width + x
@@ -490,7 +1785,7 @@ func (d *decoder) createImage(
 						b = b * 255 / maxVal
 					}
 
-					img.SetRGBA(x, y, color.RGBA{
+					img.SetRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
 						R: uint8(r),
 						G: uint8(g),
 						B: uint8(b),
@@ -501,7 +1796,7 @@ func (d *decoder) createImage(
 			return img, nil
 		}
 		// 16-bit RGB
-		img := image.NewRGBA64(image.Rect(0, 0, width, height))
+		img := outputImage(d.dst, bounds, image.NewRGBA64)
 		for y := 0; y < height; y++ {
 			for x := 0; x < width; x++ {
 				idx := y*width + x
@@ -514,11 +1809,11 @@ func (d *decoder) createImage(
 				b = clampInt32(b, 0, maxVal)
 
 				// Scale to 16-bit
-				r = r * 65535 / maxVal
-				g = g * 65535 / maxVal
-				b = b * 65535 / maxVal
+				r = scale16(r, maxVal)
+				g = scale16(g, maxVal)
+				b = scale16(b, maxVal)
 
-				img.SetRGBA64(x, y, color.RGBA64{
+				img.SetRGBA64(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA64{
 					R: uint16(r),
 					G: uint16(g),
 					B: uint16(b),
@@ -531,7 +1826,7 @@ func (d *decoder) createImage(
 	case 4:
 		// RGBA
 		if precision <= 8 {
-			img := image.NewRGBA(image.Rect(0, 0, width, height))
+			img := outputImage(d.dst, bounds, image.NewRGBA)
 			for y := 0; y < height; y++ {
 				for x := 0; x < width; x++ {
 					idx := y*width + x
@@ -547,7 +1842,7 @@ func (d *decoder) createImage(
 						a = a * 255 / maxVal
 					}
 
-					img.SetRGBA(x, y, color.RGBA{
+					img.SetRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
 						R: uint8(r),
 						G: uint8(g),
 						B: uint8(b),
@@ -558,7 +1853,7 @@ func (d *decoder) createImage(
 			return img, nil
 		}
 		// 16-bit RGBA
-		img := image.NewRGBA64(image.Rect(0, 0, width, height))
+		img := outputImage(d.dst, bounds, image.NewRGBA64)
 		for y := 0; y < height; y++ {
 			for x := 0; x < width; x++ {
 				idx := y*width + x
@@ -567,12 +1862,12 @@ func (d *decoder) createImage(
 				b := clampInt32(componentData[2][idx], 0, maxVal)
 				a := clampInt32(componentData[3][idx], 0, maxVal)
 
-				r = r * 65535 / maxVal
-				g = g * 65535 / maxVal
-				b = b * 65535 / maxVal
-				a = a * 65535 / maxVal
+				r = scale16(r, maxVal)
+				g = scale16(g, maxVal)
+				b = scale16(b, maxVal)
+				a = scale16(a, maxVal)
 
-				img.SetRGBA64(x, y, color.RGBA64{
+				img.SetRGBA64(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA64{
 					R: uint16(r),
 					G: uint16(g),
 					B: uint16(b),
@@ -583,8 +1878,239 @@ func (d *decoder) createImage(
 		return img, nil
 
 	default:
-		return nil, fmt.Errorf("unsupported number of components: %d", numComp)
+		return nil, &UnsupportedFeatureError{Feature: fmt.Sprintf("%d components", numComp)}
+	}
+}
+
+// modelImage builds an image of the given color model from component
+// data of the given precision. One component is gray and two are gray
+// and alpha; three are RGB and four RGB and straight alpha. Samples are
+// scaled to 16 bits, then converted: color to gray by the luma weights
+// of color.GrayModel, dropping alpha, to premultiplied alpha for RGBA
+// and RGBA64, and to 8 bits by discarding the low byte.
+func (d *decoder) modelImage(
+	model color.Model,
+	componentData [][]int32,
+	bounds image.Rectangle,
+	numComp int,
+	precision int,
+) (image.Image, error) {
+	if numComp < 1 || numComp > 4 {
+		return nil, &UnsupportedFeatureError{Feature: fmt.Sprintf("%d components", numComp)}
+	}
+	maxVal := int64(1)<<min(precision, 31) - 1
+	sample := func(c, i int) uint32 {
+		v := min(max(int64(componentData[c][i]), 0), maxVal)
+		return uint32(v * 0xFFFF / maxVal)
+	}
+	// pixel returns the straight-alpha 16-bit color of sample i
+	pixel := func(i int) (r, g, b, a uint32) {
+		a = 0xFFFF
+		switch numComp {
+		case 1, 2:
+			r = sample(0, i)
+			g, b = r, r
+		default:
+			r, g, b = sample(0, i), sample(1, i), sample(2, i)
+		}
+		if numComp == 2 || numComp == 4 {
+			a = sample(numComp-1, i)
+		}
+		return r, g, b, a
+	}
+	luma := func(r, g, b uint32) uint32 {
+		return (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+	}
+
+	n := bounds.Dx() * bounds.Dy()
+	switch model {
+	case color.GrayModel:
+		img := outputImage(d.dst, bounds, image.NewGray)
+		for i := 0; i < n; i++ {
+			r, g, b, _ := pixel(i)
+			img.SetGray(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(), color.Gray{Y: uint8(luma(r, g, b) >> 8)})
+		}
+		return img, nil
+	case color.Gray16Model:
+		img := outputImage(d.dst, bounds, image.NewGray16)
+		for i := 0; i < n; i++ {
+			r, g, b, _ := pixel(i)
+			img.SetGray16(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(), color.Gray16{Y: uint16(luma(r, g, b))})
+		}
+		return img, nil
+	case color.NRGBAModel:
+		img := outputImage(d.dst, bounds, image.NewNRGBA)
+		for i := 0; i < n; i++ {
+			r, g, b, a := pixel(i)
+			img.SetNRGBA(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(),
+				color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
+		}
+		return img, nil
+	case color.NRGBA64Model:
+		img := outputImage(d.dst, bounds, image.NewNRGBA64)
+		for i := 0; i < n; i++ {
+			r, g, b, a := pixel(i)
+			img.SetNRGBA64(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(),
+				color.NRGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+		}
+		return img, nil
+	case color.RGBAModel:
+		img := outputImage(d.dst, bounds, image.NewRGBA)
+		for i := 0; i < n; i++ {
+			r, g, b, a := pixel(i)
+			img.SetRGBA(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(),
+				color.RGBA{uint8(r * a / 0xFFFF >> 8), uint8(g * a / 0xFFFF >> 8), uint8(b * a / 0xFFFF >> 8), uint8(a >> 8)})
+		}
+		return img, nil
+	case color.RGBA64Model:
+		img := outputImage(d.dst, bounds, image.NewRGBA64)
+		for i := 0; i < n; i++ {
+			r, g, b, a := pixel(i)
+			img.SetRGBA64(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(),
+				color.RGBA64{uint16(r * a / 0xFFFF), uint16(g * a / 0xFFFF), uint16(b * a / 0xFFFF), uint16(a)})
+		}
+		return img, nil
+	}
+	return nil, &UnsupportedFeatureError{Feature: "output color model"}
+}
+
+// outputImage returns dst if it is an image of type T covering bounds, so
+// that it is decoded into without allocating, and otherwise a new image
+// made by newImage.
+func outputImage[T image.Image](dst draw.Image, bounds image.Rectangle, newImage func(image.Rectangle) T) T {
+	if img, ok := dst.(T); ok && img.Bounds() == bounds {
+		return img
+	}
+	return newImage(bounds)
+}
+
+// scale16 maps v in [0, maxVal] onto [0, 65535] without overflowing for
+// 16-bit inputs.
+func scale16(v, maxVal int32) int32 {
+	return int32(int64(v) * 65535 / int64(maxVal))
+}
+
+// bilevelImage converts a 1-bit component to black and white, into dst
+// if it is an image.Gray covering bounds. Unsigned samples are 0 or 1
+// after the DC level shift; signed samples are -1 or 0 and are offset by
+// one first. Anything above 0 is white, so values that drift past the
+// range under lossy coding still threshold correctly.
+func bilevelImage(dst draw.Image, data []int32, bounds image.Rectangle, signed bool) *image.Gray {
+	img := outputImage(dst, bounds, image.NewGray)
+	offset := int32(0)
+	if signed {
+		offset = 1
+	}
+	width := bounds.Dx()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:width]
+		for x, v := range data[y*width : (y+1)*width] {
+			row[x] = 0
+			if v+offset > 0 {
+				row[x] = 255
+			}
+		}
 	}
+	return img
+}
+
+// applyPalette maps components through a JP2 palette as directed by the
+// component mapping box, returning the output channels and their bit
+// depths. Indices outside the palette are clamped to it. Without a cmap
+// box every palette column is looked up from the first component.
+func applyPalette(pclr *box.PaletteBox, cmap *box.ComponentMapBox, componentData [][]int32, info []codestream.ComponentInfo) ([][]int32, []codestream.ComponentInfo, error) {
+	var mappings []box.ComponentMapping
+	if cmap != nil {
+		mappings = cmap.Mappings
+	} else {
+		for col := 0; col < int(pclr.NumColumns); col++ {
+			mappings = append(mappings, box.ComponentMapping{MappingType: 1, PaletteColumn: uint8(col)})
+		}
+	}
+	if len(mappings) == 0 {
+		return nil, nil, fmt.Errorf("component mapping box has no channels")
+	}
+
+	out := make([][]int32, len(mappings))
+	outInfo := make([]codestream.ComponentInfo, len(mappings))
+	for ch, m := range mappings {
+		if int(m.Component) >= len(componentData) {
+			return nil, nil, fmt.Errorf("channel %d maps missing component %d", ch, m.Component)
+		}
+		src := componentData[m.Component]
+
+		switch m.MappingType {
+		case 0:
+			out[ch], outInfo[ch] = src, info[m.Component]
+		case 1:
+			col := int(m.PaletteColumn)
+			if col >= int(pclr.NumColumns) {
+				return nil, nil, fmt.Errorf("channel %d maps missing palette column %d", ch, col)
+			}
+			bits := pclr.BitsPerEntry[col]
+			shift := 31 - int(bits&0x7F) // sign-extends signed entries
+			last := int32(pclr.NumEntries) - 1
+
+			dst := make([]int32, len(src))
+			for i, idx := range src {
+				v := pclr.Entries[clampInt32(idx, 0, last)][col]
+				if bits&0x80 != 0 {
+					dst[i] = int32(v<<shift) >> shift
+				} else {
+					dst[i] = int32(v)
+				}
+			}
+			out[ch] = dst
+			outInfo[ch] = info[m.Component]
+			outInfo[ch].BitDepth = bits
+		default:
+			return nil, nil, fmt.Errorf("channel %d: invalid mapping type %d", ch, m.MappingType)
+		}
+	}
+	return out, outInfo, nil
+}
+
+// normalizePrecision rescales components with mixed bit depths (such as
+// 16/8/8) to the largest precision, so that every component spans the same
+// output range. It returns the common precision.
+func normalizePrecision(componentData [][]int32, info []codestream.ComponentInfo) int {
+	precision := 0
+	for _, ci := range info {
+		if p := ci.Precision(); p > precision {
+			precision = p
+		}
+	}
+
+	maxVal := int64(1)<<precision - 1
+	for c, ci := range info {
+		p := ci.Precision()
+		if p == precision || c >= len(componentData) {
+			continue
+		}
+		cmax := int64(1)<<p - 1
+		for i, v := range componentData[c] {
+			componentData[c][i] = int32(int64(v) * maxVal / cmax)
+		}
+	}
+
+	return precision
+}
+
+// wrapSigned stores signed samples as two's complement in an 8-bit or
+// 16-bit container, the layout Options.Signed reads on encode, and returns
+// the container precision. Samples are not rescaled.
+func wrapSigned(componentData [][]int32, precision int) int {
+	container := 8
+	if precision > 8 {
+		container = 16
+	}
+	mask := int32(1)<<container - 1
+	for _, data := range componentData {
+		for i, v := range data {
+			data[i] = v & mask
+		}
+	}
+	return container
 }
 
 // Helper function
@@ -612,3 +2138,9 @@ func (r *byteReader) Read(p []byte) (int, error) {
 	r.pos += n
 	return n, nil
 }
+
+// Len returns the number of unread bytes, which lets the codestream
+// parser reject marker segments longer than the data left.
+func (r *byteReader) Len() int {
+	return len(r.data) - r.pos
+}
@@ -1,19 +1,23 @@
 package jpeg2000
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"log"
+	"math"
 	"runtime"
 	"sync"
 
 	"github.com/mrjoshuak/go-jpeg2000/internal/box"
 	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
-	"github.com/mrjoshuak/go-jpeg2000/internal/dwt"
 	"github.com/mrjoshuak/go-jpeg2000/internal/entropy"
 	"github.com/mrjoshuak/go-jpeg2000/internal/mct"
+	"github.com/mrjoshuak/go-jpeg2000/internal/tcd"
 )
 
 // encoder handles JPEG 2000 encoding.
@@ -29,8 +33,39 @@ type encoder struct {
 	precision     int
 	signed        bool
 
+	// precisions holds the bit depth of each component when
+	// Options.ComponentPrecision gives them different ones; nil means
+	// every component has precision bits.
+	precisions []int
+
 	// Component data
 	componentData [][]int32
+
+	// componentBytes accumulates the coded size of each component, as
+	// written by encode or predicted by estimateSize, for the
+	// per-component cinema limit.
+	componentBytes []int
+
+	// subsampling holds the XRsiz and YRsiz factors of each component;
+	// nil means no component is subsampled.
+	subsampling []image.Point
+
+	// decorrelated is set when componentData already holds the output of
+	// the irreversible colour transform, as for image.YCbCr input, so
+	// preprocess must not apply it again.
+	decorrelated bool
+
+	// stepSize overrides the quantization step derived from Quality
+	// when non-zero; it is set by rate control.
+	stepSize float64
+
+	// origin is the position of the encoded samples on the reference
+	// grid; it is non-zero for the tiles written by a TileEncoder.
+	origin image.Point
+
+	// header describes the codestream being written, parsed back from
+	// the main header; see codestreamHeader.
+	header *codestream.Header
 }
 
 // newEncoder creates a new encoder.
@@ -45,27 +80,128 @@ func newEncoder(w io.Writer, img image.Image, options *Options) *encoder {
 	}
 }
 
+// reversible reports whether the 5-3 wavelet and the RCT are used, as
+// chosen by Options.Wavelet or else by Lossless and ForceReversible.
+func (e *encoder) reversible() bool {
+	switch e.options.Wavelet {
+	case WaveletReversible53:
+		return true
+	case WaveletIrreversible97:
+		return false
+	}
+	return e.options.Lossless || e.options.ForceReversible
+}
+
+// quantized reports whether the wavelet coefficients are scalar quantized:
+// always with the 9-7 wavelet, and with the 5-3 one unless Lossless or
+// ForceReversible is set.
+func (e *encoder) quantized() bool {
+	return !e.reversible() || !(e.options.Lossless || e.options.ForceReversible)
+}
+
+// checkWavelet rejects an Options.Wavelet that contradicts Lossless or
+// ForceReversible.
+func (e *encoder) checkWavelet() error {
+	switch e.options.Wavelet {
+	case WaveletAuto, WaveletReversible53:
+	case WaveletIrreversible97:
+		if e.options.Lossless || e.options.ForceReversible {
+			return errors.New("jpeg2000: lossless coding requires the 5-3 wavelet, not WaveletIrreversible97")
+		}
+	default:
+		return fmt.Errorf("jpeg2000: invalid wavelet %d", e.options.Wavelet)
+	}
+	return nil
+}
+
+// useMCT reports whether the multiple component transform is applied.
+func (e *encoder) useMCT() bool {
+	mode := e.options.MCT
+	if e.options.NoMCT {
+		mode = MCTNone
+	}
+	if e.numComponents < 3 || mode == MCTNone {
+		return false
+	}
+	// The transform needs the first three components at one bit depth
+	if e.componentPrecision(0) != e.componentPrecision(1) || e.componentPrecision(0) != e.componentPrecision(2) {
+		return false
+	}
+	switch mode {
+	case MCTAuto:
+		switch e.options.ColorSpace {
+		case ColorSpaceUnspecified, ColorSpaceSRGB, ColorSpaceESRGB, ColorSpaceROMMRGB:
+			return true
+		}
+		return false
+	case MCTForce:
+		return true
+	}
+	return false
+}
+
 // encode encodes the image.
 func (e *encoder) encode() error {
-	// Extract image data
-	if err := e.extractImageData(); err != nil {
-		return fmt.Errorf("extracting image data: %w", err)
+	if err := e.applyProfile(); err != nil {
+		return err
+	}
+	if err := e.checkWavelet(); err != nil {
+		return err
+	}
+	if e.options.ForceReversible && !e.options.Lossless {
+		log.Printf("jpeg2000: ForceReversible overrides Lossless=false; using the 5-3 reversible wavelet")
 	}
 
-	// Apply preprocessing
-	if err := e.preprocess(); err != nil {
-		return fmt.Errorf("preprocessing: %w", err)
+	if err := e.checkPrecinctSizes(); err != nil {
+		return err
+	}
+	if err := e.checkProgressionOrderChanges(); err != nil {
+		return err
+	}
+	if err := e.rateControl(); err != nil {
+		return err
 	}
 
-	// Generate codestream
-	codestream, err := e.generateCodestream()
-	if err != nil {
-		return fmt.Errorf("generating codestream: %w", err)
+	var codestream []byte
+	for {
+		// Extract image data
+		if err := e.extractImageData(); err != nil {
+			return fmt.Errorf("extracting image data: %w", err)
+		}
+		if err := e.checkIMFLevel(); err != nil {
+			return err
+		}
+		e.resetStats()
+		e.componentBytes = make([]int, e.numComponents)
+
+		// Apply preprocessing
+		if err := e.preprocess(); err != nil {
+			return fmt.Errorf("preprocessing: %w", err)
+		}
+
+		// Generate codestream
+		var err error
+		codestream, err = e.generateCodestream()
+		if err != nil {
+			return fmt.Errorf("generating codestream: %w", err)
+		}
+
+		// Rate control works from sampled estimates, so a frame can come
+		// out slightly over the limits of its profile; coarsen the step
+		// until it fits.
+		if e.withinFrameLimits(len(codestream)) {
+			break
+		}
+		if !e.quantized() || math.Log2(e.baseStepSize()) >= rateControlMaxLog2Step {
+			return fmt.Errorf("jpeg2000: frame exceeds the bit-rate limit of profile %#04x", uint16(e.options.Profile))
+		}
+		e.stepSize = e.baseStepSize() * limitStepGrowth
+		e.header = nil
 	}
 
 	// Write output based on format
 	switch e.options.Format {
-	case FormatJP2:
+	case FormatJP2, FormatJPX:
 		return e.writeJP2(codestream)
 	case FormatJ2K:
 		_, err := e.w.Write(codestream)
@@ -75,6 +211,257 @@ func (e *encoder) encode() error {
 	}
 }
 
+// Code-block sampling used by estimateSize. Tiles with more than
+// estimateExactJobs code-blocks only entropy code every
+// estimateSampleStride-th block of each band and extrapolate the rest.
+const (
+	estimateExactJobs    = 16
+	estimateSampleStride = 4
+
+	// estimateBlockHeaderBytes approximates the packet header bits that
+	// signal one code-block's inclusion, bit-planes, passes and length.
+	estimateBlockHeaderBytes = 3
+)
+
+// Rate control searches the quantization step in log2 space between these
+// bounds, halving the interval rateControlIterations times.
+const (
+	rateControlMinLog2Step = -8
+	rateControlMaxLog2Step = 16
+	rateControlIterations  = 12
+)
+
+// rateControl sets the quantization step size for Options.CompressionRatio
+// and for the per-frame limits of the cinema and IMF profiles. Sizes are
+// measured with estimateSize, which shrinks monotonically as the step
+// grows, so a bisection finds the finest step whose output fits in the
+// uncompressed size divided by the ratio and within the frame limits.
+// Without a ratio, a frame keeps the step derived from Quality if that
+// already fits.
+// It does nothing for lossless encoding, when neither applies, or when
+// the step is already fixed.
+func (e *encoder) rateControl() error {
+	frame, _ := e.frameLimits()
+	if (e.options.CompressionRatio <= 0 && frame == 0) || !e.quantized() || e.stepSize != 0 {
+		return nil
+	}
+
+	probe := func(log2Step float64) (int, *encoder, error) {
+		p := newEncoder(nil, e.img, e.options)
+		p.stepSize = math.Exp2(log2Step)
+		n, err := p.estimateSize()
+		return n, p, err
+	}
+
+	budget := math.Inf(1)
+	fits := func(n int, p *encoder) bool {
+		if float64(n) > budget {
+			return false
+		}
+		return p.withinFrameLimits(n)
+	}
+
+	hiSize, p, err := probe(rateControlMaxLog2Step)
+	if err != nil {
+		return fmt.Errorf("rate control: %w", err)
+	}
+	lo, hi := float64(rateControlMinLog2Step), float64(rateControlMaxLog2Step)
+	if e.options.CompressionRatio > 0 {
+		bytesPerSample := (p.precision + 7) / 8
+		numSamples := 0
+		for _, data := range p.componentData {
+			numSamples += len(data)
+		}
+		budget = float64(numSamples*bytesPerSample) / e.options.CompressionRatio
+	} else {
+		lo = math.Log2(e.baseStepSize())
+		n, q, err := probe(lo)
+		if err != nil {
+			return fmt.Errorf("rate control: %w", err)
+		}
+		if fits(n, q) {
+			e.stepSize = math.Exp2(lo)
+			return nil
+		}
+	}
+
+	if fits(hiSize, p) {
+		for i := 0; i < rateControlIterations; i++ {
+			mid := (lo + hi) / 2
+			n, q, err := probe(mid)
+			if err != nil {
+				return fmt.Errorf("rate control: %w", err)
+			}
+			if fits(n, q) {
+				hi = mid
+			} else {
+				lo = mid
+			}
+		}
+	}
+	e.stepSize = math.Exp2(hi)
+	return nil
+}
+
+// estimateSize predicts the number of bytes encode would write. The wavelet
+// and colour transforms run in full; only the entropy coding is sampled.
+// Images with no more than estimateExactJobs code-blocks are encoded in
+// full, so their size is exact.
+func (e *encoder) estimateSize() (int, error) {
+	if err := e.applyProfile(); err != nil {
+		return 0, err
+	}
+	if err := e.checkWavelet(); err != nil {
+		return 0, err
+	}
+	if err := e.checkPrecinctSizes(); err != nil {
+		return 0, err
+	}
+	if err := e.checkProgressionOrderChanges(); err != nil {
+		return 0, err
+	}
+	if err := e.rateControl(); err != nil {
+		return 0, err
+	}
+	if err := e.extractImageData(); err != nil {
+		return 0, fmt.Errorf("extracting image data: %w", err)
+	}
+	if err := e.checkIMFLevel(); err != nil {
+		return 0, err
+	}
+	if err := e.preprocess(); err != nil {
+		return 0, fmt.Errorf("preprocessing: %w", err)
+	}
+
+	h, err := e.codestreamHeader()
+	if err != nil {
+		return 0, err
+	}
+	tiles := e.tileIndices(h)
+
+	var jobs []codeBlockJob
+	numPackets := 0
+	for _, tileIdx := range tiles {
+		te := tcd.NewTileEncoder(h)
+		te.InitTile(tileIdx, nil)
+		jobs = append(jobs, e.codeBlockJobs(te.Tile())...)
+		for _, c := range precinctCounts(te.Tile()) {
+			for _, n := range c {
+				numPackets += n[0] * e.numLayers()
+			}
+		}
+	}
+
+	var size int
+	e.componentBytes = make([]int, e.numComponents)
+	if len(jobs) <= estimateExactJobs {
+		// Encode in full, leaving Options.CollectStats alone; the copy
+		// shares componentBytes
+		opts := *e.options
+		opts.CollectStats = nil
+		exact := *e
+		exact.options = &opts
+		cs, err := exact.generateCodestream()
+		if err != nil {
+			return 0, err
+		}
+		size = len(cs)
+	} else {
+		// SOC and main header markers, SOT/SOD per tile, and EOC
+		size = len(e.generateMainHeader()) + 14*len(tiles) + 2
+		if e.options.WriteTLM {
+			// TLM segments with one 6-byte entry per tile
+			numTLM := (len(tiles) + maxTLMEntries - 1) / maxTLMEntries
+			size += 6*numTLM + 6*len(tiles)
+		}
+		if e.options.EmitPLT {
+			// One PLT segment per tile; a packet length rarely needs
+			// more than 3 bytes
+			size += 5*len(tiles) + 3*numPackets
+		}
+		if e.options.EnableSOP {
+			size += 6 * numPackets
+		}
+		if e.options.EnableEPH {
+			size += 2 * numPackets
+		}
+
+		// Each packet header takes about a byte, plus a few bytes for
+		// every code-block it includes. Bands compress very differently,
+		// so each one is sampled and extrapolated on its own.
+		type bandSample struct {
+			coded, sampled, total, seen int64
+			comp                        int
+		}
+		bands := make(map[*tcd.Band]*bandSample)
+		t1 := entropy.GetT1(64, 64)
+		for _, job := range jobs {
+			if job.skip {
+				continue
+			}
+			bs := bands[job.band]
+			if bs == nil {
+				bs = &bandSample{comp: job.comp}
+				bands[job.band] = bs
+			}
+			bs.total += int64(len(job.data))
+			bs.seen++
+			if (bs.seen-1)%estimateSampleStride != 0 {
+				continue
+			}
+			t1.Resize(job.cb.X1-job.cb.X0, job.cb.Y1-job.cb.Y0)
+			t1.SetStyle(job.cb.Style)
+			t1.SetData(job.data)
+			if n := len(t1.Encode(int(job.band.Type))); n > 0 {
+				bs.coded += int64(n + estimateBlockHeaderBytes)
+			}
+			bs.sampled += int64(len(job.data))
+		}
+		entropy.PutT1(t1)
+		size += numPackets
+		for _, bs := range bands {
+			if bs.sampled > 0 {
+				n := int(bs.coded * bs.total / bs.sampled)
+				size += n
+				e.componentBytes[bs.comp] += n
+			}
+		}
+	}
+
+	switch e.options.Format {
+	case FormatJP2, FormatJPX:
+		// Measure the container overhead around an empty codestream
+		cw := &countingWriter{}
+		e.w = cw
+		if err := e.writeJP2(nil); err != nil {
+			return 0, err
+		}
+		size += int(cw.n)
+	case FormatJ2K:
+	default:
+		return 0, fmt.Errorf("unsupported format: %s", e.options.Format)
+	}
+
+	return size, nil
+}
+
+// countingWriter counts the bytes written through it to w, discarding
+// them when w is nil.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.w == nil {
+		w.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
 // extractImageData extracts pixel data from the source image.
 func (e *encoder) extractImageData() error {
 	bounds := e.img.Bounds()
@@ -175,23 +562,23 @@ func (e *encoder) extractImageData() error {
 			}
 		}
 
-	default:
-		// Generic fallback - convert to RGBA
+	case *image.YCbCr:
 		e.numComponents = 3
-		e.precision = 8
-		e.componentData = make([][]int32, 3)
-		for c := 0; c < 3; c++ {
-			e.componentData[c] = make([]int32, e.width*e.height)
+		if !e.directYCbCr() {
+			e.extractRGB()
+			break
 		}
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				idx := (y-bounds.Min.Y)*e.width + (x - bounds.Min.X)
-				r, g, b, _ := e.img.At(x, y).RGBA()
-				e.componentData[0][idx] = int32(r >> 8)
-				e.componentData[1][idx] = int32(g >> 8)
-				e.componentData[2][idx] = int32(b >> 8)
-			}
+		e.extractYCbCr(img)
+
+	default:
+		e.extractRGB()
+	}
+
+	if e.options.Signed {
+		if err := e.signSamples(); err != nil {
+			return err
 		}
+		return e.applyComponentPrecision()
 	}
 
 	// Apply precision override if specified
@@ -209,19 +596,201 @@ func (e *encoder) extractImageData() error {
 		e.precision = targetPrecision
 	}
 
+	return e.applyComponentPrecision()
+}
+
+// applyComponentPrecision brings the components that
+// Options.ComponentPrecision gives their own bit depth to it, rescaling
+// unsigned samples from the common precision and checking that signed
+// ones lie in the signed range.
+func (e *encoder) applyComponentPrecision() error {
+	e.precisions = nil
+	for c, p := range e.options.ComponentPrecision {
+		if p < 0 || p > 16 {
+			return fmt.Errorf("jpeg2000: component %d precision %d outside the range 1 to 16", c, p)
+		}
+		if p == 0 || p == e.precision || c >= e.numComponents {
+			continue
+		}
+		if e.precisions == nil {
+			e.precisions = make([]int, e.numComponents)
+			for i := range e.precisions {
+				e.precisions[i] = e.precision
+			}
+		}
+		e.precisions[c] = p
+
+		if e.signed {
+			lo, hi := int32(-1)<<(p-1), int32(1)<<(p-1)-1
+			for _, v := range e.componentData[c] {
+				if v < lo || v > hi {
+					return fmt.Errorf("jpeg2000: component %d sample %d is outside the signed %d-bit range", c, v, p)
+				}
+			}
+			continue
+		}
+		srcMax := int64(1)<<e.precision - 1
+		dstMax := int64(1)<<p - 1
+		for i, v := range e.componentData[c] {
+			e.componentData[c][i] = int32(int64(v) * dstMax / srcMax)
+		}
+	}
+	return nil
+}
+
+// componentPrecision returns the bit depth of component c.
+func (e *encoder) componentPrecision(c int) int {
+	if e.precisions != nil {
+		return e.precisions[c]
+	}
+	return e.precision
+}
+
+// extractRGB is the generic fallback of extractImageData: it converts
+// every pixel to 8-bit RGB through the image's color model.
+func (e *encoder) extractRGB() {
+	bounds := e.img.Bounds()
+	e.numComponents = 3
+	e.precision = 8
+	e.componentData = make([][]int32, 3)
+	for c := 0; c < 3; c++ {
+		e.componentData[c] = make([]int32, e.width*e.height)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			idx := (y-bounds.Min.Y)*e.width + (x - bounds.Min.X)
+			r, g, b, _ := e.img.At(x, y).RGBA()
+			e.componentData[0][idx] = int32(r >> 8)
+			e.componentData[1][idx] = int32(g >> 8)
+			e.componentData[2][idx] = int32(b >> 8)
+		}
+	}
+}
+
+// directYCbCr reports whether image.YCbCr input is coded from its planes
+// rather than converted to RGB. The JFIF YCbCr of package image is the
+// output of the irreversible colour transform, so this needs lossy coding
+// with the transform enabled for three components.
+func (e *encoder) directYCbCr() bool {
+	return !e.reversible() && !e.options.Signed && e.numComponents == 3 && e.useMCT()
+}
+
+// ycbcrSubsampling returns the XRsiz and YRsiz factors of the chroma
+// planes for ratio.
+func ycbcrSubsampling(ratio image.YCbCrSubsampleRatio) image.Point {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return image.Pt(2, 1)
+	case image.YCbCrSubsampleRatio420:
+		return image.Pt(2, 2)
+	case image.YCbCrSubsampleRatio440:
+		return image.Pt(1, 2)
+	case image.YCbCrSubsampleRatio411:
+		return image.Pt(4, 1)
+	case image.YCbCrSubsampleRatio410:
+		return image.Pt(4, 2)
+	}
+	return image.Pt(1, 1)
+}
+
+// extractYCbCr takes the Y, Cb and Cr planes of img as the three
+// components, marking them as already decorrelated. Subsampled chroma
+// planes become subsampled components, with chroma sample (i, j) taken
+// at reference grid point (i*XRsiz, j*YRsiz).
+func (e *encoder) extractYCbCr(img *image.YCbCr) {
+	bounds := img.Bounds()
+	e.numComponents = 3
+	e.precision = 8
+	e.decorrelated = true
+	if s := ycbcrSubsampling(img.SubsampleRatio); s != image.Pt(1, 1) {
+		e.subsampling = []image.Point{{1, 1}, s, s}
+	}
+
+	e.componentData = make([][]int32, 3)
+	luma := make([]int32, e.width*e.height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			luma[(y-bounds.Min.Y)*e.width+(x-bounds.Min.X)] = int32(img.Y[img.YOffset(x, y)])
+		}
+	}
+	e.componentData[0] = luma
+
+	r := e.componentRect(1)
+	s := e.componentSubsampling(1)
+	cb := make([]int32, r.Dx()*r.Dy())
+	cr := make([]int32, r.Dx()*r.Dy())
+	for j := r.Min.Y; j < r.Max.Y; j++ {
+		for i := r.Min.X; i < r.Max.X; i++ {
+			x := bounds.Min.X + i*s.X - e.origin.X
+			y := bounds.Min.Y + j*s.Y - e.origin.Y
+			off := img.COffset(x, y)
+			idx := (j-r.Min.Y)*r.Dx() + (i - r.Min.X)
+			cb[idx] = int32(img.Cb[off])
+			cr[idx] = int32(img.Cr[off])
+		}
+	}
+	e.componentData[1] = cb
+	e.componentData[2] = cr
+}
+
+// componentSubsampling returns the XRsiz and YRsiz factors of component
+// c.
+func (e *encoder) componentSubsampling(c int) image.Point {
+	if c < len(e.subsampling) {
+		return e.subsampling[c]
+	}
+	return image.Pt(1, 1)
+}
+
+// componentRect returns the area of component c covered by the encoded
+// samples, on the component's own grid; componentData[c] holds it in
+// raster order.
+func (e *encoder) componentRect(c int) image.Rectangle {
+	area := image.Rect(0, 0, e.width, e.height).Add(e.origin)
+	s := e.componentSubsampling(c)
+	return image.Rect(ceilDiv(area.Min.X, s.X), ceilDiv(area.Min.Y, s.Y), ceilDiv(area.Max.X, s.X), ceilDiv(area.Max.Y, s.Y))
+}
+
+// ceilDiv returns a/b rounded up, for non-negative a and positive b.
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// signSamples reinterprets the extracted samples as two's complement
+// values of the source precision and checks them against the signed
+// Precision-bit range, if one is set.
+func (e *encoder) signSamples() error {
+	shift := 32 - e.precision
+	precision := e.precision
+	if e.options.Precision > 0 && e.options.Precision <= e.precision {
+		precision = e.options.Precision
+	}
+	lo, hi := int32(-1)<<(precision-1), int32(1)<<(precision-1)-1
+
+	for c := 0; c < e.numComponents; c++ {
+		for i, v := range e.componentData[c] {
+			v = v << shift >> shift
+			if v < lo || v > hi {
+				return fmt.Errorf("jpeg2000: component %d sample %d is outside the signed %d-bit range", c, v, precision)
+			}
+			e.componentData[c][i] = v
+		}
+	}
+	e.precision = precision
+	e.signed = true
 	return nil
 }
 
 // preprocess applies preprocessing transforms.
 func (e *encoder) preprocess() error {
-	// Apply DC level shift
-	for c := 0; c < e.numComponents; c++ {
-		mct.DCLevelShiftForward(e.componentData[c], e.precision)
+	// Apply DC level shift; signed samples are already centred on zero
+	for c := 0; c < e.numComponents && !e.signed; c++ {
+		mct.DCLevelShiftForward(e.componentData[c], e.componentPrecision(c))
 	}
 
-	// Apply MCT if we have 3+ components
-	if e.numComponents >= 3 {
-		if e.options.Lossless {
+	// Apply MCT to the first three components
+	if e.useMCT() && !e.decorrelated {
+		if e.reversible() {
 			mct.ForwardRCT(e.componentData[0], e.componentData[1], e.componentData[2])
 		} else {
 			// Convert to float for ICT
@@ -245,43 +814,110 @@ func (e *encoder) preprocess() error {
 		}
 	}
 
-	// Apply DWT
-	numLevels := e.options.NumResolutions - 1
-	if numLevels <= 0 {
-		numLevels = 5
+	// Apply the DWT and quantization tile by tile
+	h, err := e.codestreamHeader()
+	if err != nil {
+		return err
+	}
+	for _, tileIdx := range e.tileIndices(h) {
+		e.transformTile(h, tileIdx)
 	}
 
-	for c := 0; c < e.numComponents; c++ {
-		if e.options.Lossless {
-			dwt.DecomposeMultiLevel53(e.componentData[c], e.width, e.height, numLevels)
-		} else {
-			// Convert to float for 9-7 transform
-			dataFloat := make([]float64, len(e.componentData[c]))
-			for i, v := range e.componentData[c] {
-				dataFloat[i] = float64(v)
-			}
-			dwt.DecomposeMultiLevel97(dataFloat, e.width, e.height, numLevels)
-			// Convert back with quantization
-			quality := e.options.Quality
-			if quality <= 0 {
-				quality = 100 // Default to lossless if quality not set
-			}
-			stepSize := 1.0 / float64(quality)
-			for i, v := range dataFloat {
-				if v >= 0 {
-					e.componentData[c][i] = int32(v/stepSize + 0.5)
-				} else {
-					e.componentData[c][i] = int32(v/stepSize - 0.5)
-				}
+	return nil
+}
+
+// transformTile replaces the samples of tile tileIdx in componentData
+// with its quantized wavelet coefficients, in the Mallat layout of the
+// tile: each decomposition level leaves its LL band in the top-left
+// corner of the previous one.
+func (e *encoder) transformTile(h *codestream.Header, tileIdx int) {
+	te := tcd.NewTileEncoder(h)
+	te.InitTile(tileIdx, nil)
+	for c, tc := range te.Tile().Components {
+		r := e.tileRect(c, tc)
+		stride := e.componentRect(c).Dx()
+		tc.Data = make([]int32, r.Dx()*r.Dy())
+		for y := 0; y < r.Dy(); y++ {
+			copy(tc.Data[y*r.Dx():(y+1)*r.Dx()], e.componentData[c][(r.Min.Y+y)*stride+r.Min.X:])
+		}
+
+		te.ApplyForwardDWT(tc)
+		te.Quantize(tc)
+
+		for y := 0; y < r.Dy(); y++ {
+			copy(e.componentData[c][(r.Min.Y+y)*stride+r.Min.X:], tc.Data[y*r.Dx():(y+1)*r.Dx()])
+		}
+	}
+}
+
+// tileRect returns the samples of tile-component tc, of component c,
+// within componentData[c].
+func (e *encoder) tileRect(c int, tc *tcd.TileComponent) image.Rectangle {
+	return image.Rect(tc.X0, tc.Y0, tc.X1, tc.Y1).Sub(e.componentRect(c).Min)
+}
+
+// tileIndices returns the indices of the tiles covering the encoded
+// samples, in raster order.
+func (e *encoder) tileIndices(h *codestream.Header) []int {
+	area := image.Rect(0, 0, e.width, e.height).Add(e.origin)
+	var tiles []int
+	for ty := 0; ty < int(h.NumTilesY); ty++ {
+		for tx := 0; tx < int(h.NumTilesX); tx++ {
+			x0 := int(h.TileXOffset) + tx*int(h.TileWidth)
+			y0 := int(h.TileYOffset) + ty*int(h.TileHeight)
+			if image.Rect(x0, y0, x0+int(h.TileWidth), y0+int(h.TileHeight)).Overlaps(area) {
+				tiles = append(tiles, ty*int(h.NumTilesX)+tx)
 			}
 		}
 	}
+	return tiles
+}
 
-	return nil
+// codestreamHeader returns the parsed main header of the codestream, from
+// which the tile, band and code-block geometry is derived exactly as a
+// decoder derives it.
+func (e *encoder) codestreamHeader() (*codestream.Header, error) {
+	if e.header != nil {
+		return e.header, nil
+	}
+	mh := append(e.generateMainHeader(), 0xFF, 0x90) // stop at SOT
+	h, err := codestream.NewParser(&byteReader{data: mh}).ReadHeader()
+	if err != nil {
+		return nil, fmt.Errorf("parsing main header: %w", err)
+	}
+	e.header = h
+	return h, nil
 }
 
 // generateCodestream generates the JPEG 2000 codestream.
 func (e *encoder) generateCodestream() ([]byte, error) {
+	buf := e.generateMainHeader()
+
+	// Generate tile data
+	tileParts, err := e.generateTiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// TLM marker (optional), written once all tile-part lengths are known
+	if e.options.WriteTLM {
+		tlm := e.generateTLM(tileParts)
+		buf = append(buf, tlm...)
+	}
+
+	for _, tp := range tileParts {
+		buf = append(buf, tp...)
+	}
+
+	// EOC marker
+	buf = append(buf, 0xFF, 0xD9)
+
+	return buf, nil
+}
+
+// generateMainHeader generates the SOC marker and the main header marker
+// segments that precede the tile-parts, apart from TLM.
+func (e *encoder) generateMainHeader() []byte {
 	var buf []byte
 
 	// SOC marker
@@ -301,27 +937,30 @@ func (e *encoder) generateCodestream() ([]byte, error) {
 	cod := e.generateCOD()
 	buf = append(buf, cod...)
 
-	// QCD marker
+	// POC marker (optional)
+	buf = append(buf, e.generatePOC()...)
+
+	// QCD marker, and QCC for components with their own step sizes
 	qcd := e.generateQCD()
 	buf = append(buf, qcd...)
-
-	// Comment marker (optional)
-	if e.options.Comment != "" {
-		com := e.generateCOM()
-		buf = append(buf, com...)
+	for c := 0; c < e.numComponents; c++ {
+		buf = append(buf, e.generateQCC(c)...)
 	}
 
-	// Generate tile data
-	tileData, err := e.generateTiles()
-	if err != nil {
-		return nil, err
+	// DCI timing comment for cinema profiles
+	if e.writesCinemaCOM() {
+		buf = append(buf, e.generateCinemaCOM()...)
 	}
-	buf = append(buf, tileData...)
 
-	// EOC marker
-	buf = append(buf, 0xFF, 0xD9)
+	// Comment markers (optional)
+	for _, c := range e.comments() {
+		buf = append(buf, generateCOM(c)...)
+	}
+	for _, c := range e.options.BinaryComments {
+		buf = append(buf, generateBinaryCOM(c)...)
+	}
 
-	return buf, nil
+	return buf
 }
 
 // generateSIZ generates the SIZ marker segment.
@@ -369,14 +1008,15 @@ func (e *encoder) generateSIZ() []byte {
 	for c := 0; c < numComp; c++ {
 		offset := 40 + c*3
 		// Ssiz: bit depth (precision - 1, with sign bit)
-		ssiz := uint8(e.precision - 1)
+		ssiz := uint8(e.componentPrecision(c) - 1)
 		if e.signed {
 			ssiz |= 0x80
 		}
 		buf[offset] = ssiz
 		// XRsiz, YRsiz: subsampling
-		buf[offset+1] = 1
-		buf[offset+2] = 1
+		s := e.componentSubsampling(c)
+		buf[offset+1] = uint8(s.X)
+		buf[offset+2] = uint8(s.Y)
 	}
 
 	return buf
@@ -389,8 +1029,10 @@ func (e *encoder) generateCOD() []byte {
 		numRes = 6
 	}
 
-	// Base length = 12 (without precinct sizes)
+	// Base length = 12, plus one byte per resolution for precinct sizes
 	length := 12
+	precincts := e.precinctSizes(numRes)
+	length += len(precincts)
 
 	buf := make([]byte, 2+length)
 	binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.COD))
@@ -398,6 +1040,9 @@ func (e *encoder) generateCOD() []byte {
 
 	// Scod: coding style
 	scod := uint8(0)
+	if len(precincts) > 0 {
+		scod |= codestream.CodingStylePrecincts
+	}
 	if e.options.EnableSOP {
 		scod |= codestream.CodingStyleSOP
 	}
@@ -413,7 +1058,9 @@ func (e *encoder) generateCOD() []byte {
 		numLayers = 1
 	}
 	binary.BigEndian.PutUint16(buf[6:8], uint16(numLayers))
-	buf[8] = 1 // MCT (enabled for 3 components)
+	if e.useMCT() {
+		buf[8] = 1 // Multiple component transform
+	}
 
 	// SPcod
 	buf[9] = uint8(numRes - 1) // Number of decomposition levels
@@ -464,72 +1111,257 @@ func (e *encoder) generateCOD() []byte {
 	buf[11] = uint8(cbHeight - 2) // Code-block height exponent
 
 	// Code-block style flags
-	cbStyle := uint8(0)
+	cbStyle := e.options.CodeBlockStyle.scb()
 	if e.options.HighThroughput {
 		cbStyle |= codestream.CodeBlockHT // Set HTJ2K flag (0x40)
 	}
 	buf[12] = cbStyle
 
-	if e.options.Lossless {
+	if e.reversible() {
 		buf[13] = 1 // 5-3 reversible wavelet
 	} else {
 		buf[13] = 0 // 9-7 irreversible wavelet
 	}
 
+	// Precinct sizes, lowest resolution first
+	copy(buf[14:], precincts)
+
 	return buf
 }
 
-// generateQCD generates the QCD marker segment.
-func (e *encoder) generateQCD() []byte {
+// precinctSizes returns the SPcod precinct size bytes (PPy in the high
+// nibble, PPx in the low one) for numRes resolution levels, repeating the
+// last Options.PrecinctSize entry as needed. It returns nil when no
+// precinct sizes are set, which selects the maximal precincts.
+func (e *encoder) precinctSizes(numRes int) []byte {
+	sizes := e.options.PrecinctSize
+	if len(sizes) == 0 {
+		return nil
+	}
+	b := make([]byte, numRes)
+	for r := range b {
+		p := sizes[min(r, len(sizes)-1)]
+		b[r] = uint8(p.Y)<<4 | uint8(p.X)
+	}
+	return b
+}
+
+// checkPrecinctSizes validates Options.PrecinctSize. Exponents must fit
+// in four bits, and every resolution but the lowest needs at least 2x2
+// precincts so that each subband precinct is non-empty.
+func (e *encoder) checkPrecinctSizes() error {
+	sizes := e.options.PrecinctSize
+	if len(sizes) == 0 {
+		return nil
+	}
 	numRes := e.options.NumResolutions
 	if numRes <= 0 {
 		numRes = 6
 	}
+	for r := 0; r < max(numRes, len(sizes)); r++ {
+		p := sizes[min(r, len(sizes)-1)]
+		lowest := 0
+		if r > 0 {
+			lowest = 1
+		}
+		if p.X < lowest || p.X > 15 || p.Y < lowest || p.Y > 15 {
+			return fmt.Errorf("invalid precinct size exponents %v for resolution %d", p, r)
+		}
+	}
+	return nil
+}
 
-	// Calculate number of subbands
-	numBands := 3*(numRes-1) + 1
+// scb returns the Scb flag bits for s.
+func (s CodeBlockStyle) scb() uint8 {
+	var b uint8
+	if s.Selective {
+		b |= codestream.CodeBlockBypass
+	}
+	if s.ResetOnBoundaries {
+		b |= codestream.CodeBlockReset
+	}
+	if s.TerminateOnPass {
+		b |= codestream.CodeBlockTermination
+	}
+	if s.Causal {
+		b |= codestream.CodeBlockVerticalCausal
+	}
+	if s.PredictableTermination {
+		b |= codestream.CodeBlockPredictableTermination
+	}
+	if s.SegmentationSymbols {
+		b |= codestream.CodeBlockSegmentationSymbols
+	}
+	return b
+}
 
-	var buf []byte
-	if e.options.Lossless {
-		// No quantization
-		length := 3 + numBands
-		buf = make([]byte, 2+length)
-		binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.QCD))
-		binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+// qcdGuardBits is the number of guard bits signalled in QCD and QCC.
+const qcdGuardBits = 2
 
-		// Sqcd: no quantization, 0 guard bits
-		buf[4] = codestream.QuantizationNone
+// generatePOC generates the POC marker segment for
+// Options.ProgressionOrderChanges, or nil if there are none.
+func (e *encoder) generatePOC() []byte {
+	changes := e.options.ProgressionOrderChanges
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// Component indices take two bytes when there are more than 256
+	// components
+	wide := e.numComponents >= 257
+	size := 7
+	if wide {
+		size = 9
+	}
+	length := 2 + size*len(changes)
 
-		// SPqcd: one exponent per subband
-		for i := 0; i < numBands; i++ {
-			// Default exponent based on subband level
-			buf[5+i] = uint8(e.precision + i/3) << 3
+	buf := make([]byte, 4, 2+length)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.POC))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+	for _, c := range changes {
+		buf = append(buf, uint8(c.ResolutionStart))
+		if wide {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(c.ComponentStart))
+		} else {
+			buf = append(buf, uint8(c.ComponentStart))
 		}
-	} else {
-		// Scalar derived quantization
-		length := 5
-		buf = make([]byte, 2+length)
-		binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.QCD))
-		binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(c.LayerEnd))
+		buf = append(buf, uint8(c.ResolutionEnd))
+		if wide {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(c.ComponentEnd))
+		} else {
+			buf = append(buf, uint8(c.ComponentEnd)) // 256 wraps to 0, which means 256
+		}
+		buf = append(buf, uint8(c.ProgressionOrder))
+	}
 
-		// Sqcd: scalar derived, 1 guard bit
-		buf[4] = codestream.QuantizationScalarDerived | (1 << 5)
+	return buf
+}
 
-		// Base step size
-		stepSize := uint16(0x4000) // Default step size
-		if e.options.Quality > 0 {
-			// Adjust based on quality
-			stepSize = uint16((100 - e.options.Quality) * 256)
+// checkProgressionOrderChanges validates Options.ProgressionOrderChanges
+// against the ranges of the POC marker fields.
+func (e *encoder) checkProgressionOrderChanges() error {
+	for i, c := range e.options.ProgressionOrderChanges {
+		if c.ResolutionStart < 0 || c.ResolutionEnd <= c.ResolutionStart || c.ResolutionEnd > 33 ||
+			c.ComponentStart < 0 || c.ComponentEnd <= c.ComponentStart || c.ComponentEnd > 16384 ||
+			c.LayerEnd < 1 || c.LayerEnd > 65535 ||
+			c.ProgressionOrder < LRCP || c.ProgressionOrder > CPRL {
+			return fmt.Errorf("invalid progression order change %d: %+v", i, c)
 		}
-		binary.BigEndian.PutUint16(buf[5:7], stepSize)
+	}
+	return nil
+}
+
+// generateQCD generates the QCD marker segment.
+func (e *encoder) generateQCD() []byte {
+	body := e.quantizationSteps(-1)
+
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.QCD))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(2+len(body)))
+	return append(buf, body...)
+}
+
+// generateQCC generates the QCC marker segment for component comp, or nil
+// if the component uses the QCD step sizes.
+func (e *encoder) generateQCC(comp int) []byte {
+	ownRange := e.componentPrecision(comp) != e.precision
+	if !ownRange && (!e.quantized() || !e.hasSubbandGain(comp)) {
+		return nil
+	}
+	body := e.quantizationSteps(comp)
+
+	var cqcc []byte
+	if e.numComponents < 257 {
+		cqcc = []byte{byte(comp)}
+	} else {
+		cqcc = binary.BigEndian.AppendUint16(nil, uint16(comp))
 	}
 
+	buf := binary.BigEndian.AppendUint16(nil, uint16(codestream.QCC))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(2+len(cqcc)+len(body)))
+	buf = append(buf, cqcc...)
+	return append(buf, body...)
+}
+
+// quantizationSteps returns the Sqcd byte and SPqcd step sizes of
+// component comp, or the defaults shared by all components when comp is
+// negative. Lossless coding signals the nominal range of each subband.
+// Quantized coding, with either wavelet, signals every step explicitly:
+// the step derived from Quality (or set by rate control), divided by the
+// subband gain of the component.
+func (e *encoder) quantizationSteps(comp int) []byte {
+	numRes := e.numResolutions()
+
+	precision := e.precision
+	if comp >= 0 {
+		precision = e.componentPrecision(comp)
+	}
+
+	var buf []byte
+	for r := 0; r < numRes; r++ {
+		bands := []tcd.SubbandType{tcd.SubbandHL, tcd.SubbandLH, tcd.SubbandHH}
+		if r == 0 {
+			bands = []tcd.SubbandType{tcd.SubbandLL}
+		}
+		for b, t := range bands {
+			rb := precision + tcd.BandGain(t)
+			if !e.quantized() {
+				if len(buf) == 0 {
+					buf = append(buf, codestream.QuantizationNone|qcdGuardBits<<5)
+				}
+				buf = append(buf, uint8(rb)<<3)
+				continue
+			}
+
+			if len(buf) == 0 {
+				buf = append(buf, codestream.QuantizationScalarExpounded|qcdGuardBits<<5)
+			}
+			step := e.baseStepSize()
+			if comp >= 0 {
+				step /= e.subbandGain(comp, r, b)
+			}
+			s := tcd.EncodeStepSize(step, rb)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(s.Exponent)<<11|s.Mantissa)
+		}
+	}
 	return buf
 }
 
-// generateCOM generates the COM marker segment.
-func (e *encoder) generateCOM() []byte {
-	comment := []byte(e.options.Comment)
+// baseStepSize returns the irreversible quantization step: the one chosen
+// by rate control, or else 1/Quality.
+func (e *encoder) baseStepSize() float64 {
+	if e.stepSize != 0 {
+		return e.stepSize
+	}
+	quality := e.options.Quality
+	if quality <= 0 {
+		quality = 100 // Default to lossless if quality not set
+	}
+	return 1.0 / float64(quality)
+}
+
+// comments returns the text of the COM markers to write: Options.Comment,
+// if set, followed by Options.Comments.
+func (e *encoder) comments() []string {
+	var cs []string
+	if e.options.Comment != "" {
+		cs = append(cs, e.options.Comment)
+	}
+	return append(cs, e.options.Comments...)
+}
+
+// generateBinaryCOM generates a COM marker segment holding binary data.
+func generateBinaryCOM(data []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(codestream.COM))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(4+len(data)))
+	buf = binary.BigEndian.AppendUint16(buf, codestream.CommentBinary)
+	return append(buf, data...)
+}
+
+// generateCOM generates a COM marker segment holding comment as Latin-1
+// text.
+func generateCOM(comment string) []byte {
 	length := 4 + len(comment)
 
 	buf := make([]byte, 2+length)
@@ -541,19 +1373,242 @@ func (e *encoder) generateCOM() []byte {
 	return buf
 }
 
+// cinemaCommentPrefix starts the COM text carrying DCI timing metadata.
+const cinemaCommentPrefix = "DCI "
+
+// DCI limits on the codestream of one frame, in bits per second of
+// sequence. The 2K sub-image of a 4K frame carries the same limits, which
+// the limits on the whole frame already imply.
+const (
+	cinemaMaxBitRate          = 250_000_000
+	cinemaMaxComponentBitRate = 200_000_000
+
+	// cinemaBaseFrameRate is the lowest DCI frame rate; faster sequences
+	// have proportionally less room per frame.
+	cinemaBaseFrameRate = 24
+)
+
+// applyProfile replaces the options with a copy that meets the
+// constraints of a Digital Cinema or IMF profile; see applyCinemaProfile
+// and applyIMFProfile. The caller's options are left untouched.
+func (e *encoder) applyProfile() error {
+	switch p := e.options.Profile; {
+	case p.isCinema():
+		return e.applyCinemaProfile()
+	case p.isIMF():
+		return e.applyIMFProfile()
+	}
+	return nil
+}
+
+// checkContainer fails if the image is larger than the profile allows.
+func (e *encoder) checkContainer(c OptionsConstraints) error {
+	if e.width > c.MaxWidth || e.height > c.MaxHeight {
+		return fmt.Errorf("jpeg2000: %dx%d image exceeds the %dx%d container of profile %#04x",
+			e.width, e.height, c.MaxWidth, c.MaxHeight, uint16(e.options.Profile))
+	}
+	return nil
+}
+
+// applyCinemaProfile sets the options Annex A.10 of ISO/IEC 15444-1 fixes
+// for a Digital Cinema profile: a single tile, the 9-7 wavelet, CPRL
+// progression, the profile's decomposition levels, 32x32 code-blocks,
+// 256x256 precincts (128x128 at the lowest resolution), one layer and
+// 12-bit components. It fails if the image does not fit the profile's
+// container.
+func (e *encoder) applyCinemaProfile() error {
+	c := e.options.Profile.Constraints()
+	if err := e.checkContainer(c); err != nil {
+		return err
+	}
+	if e.options.Precision > c.MaxBitDepth {
+		return fmt.Errorf("jpeg2000: precision %d exceeds the cinema limit of %d bits", e.options.Precision, c.MaxBitDepth)
+	}
+
+	o := *e.options
+	o.Lossless = false
+	o.ForceReversible = false
+	o.Wavelet = WaveletAuto
+	o.Signed = false
+	o.TileSize = image.Point{}
+	o.TileOffset = image.Point{}
+	o.ImageOffset = image.Point{}
+	o.ProgressionOrder = CPRL
+	o.ProgressionOrderChanges = nil
+	o.NumResolutions = c.MaxDecompositions + 1
+	o.CodeBlockSize = image.Point{X: 5, Y: 5}
+	o.CodeBlockStyle = CodeBlockStyle{}
+	o.HighThroughput = false
+	o.PrecinctSize = []image.Point{{X: 7, Y: 7}, {X: 8, Y: 8}}
+	o.NumLayers = 1
+	if o.Precision == 0 {
+		o.Precision = c.MaxBitDepth
+	}
+	e.options = &o
+	return nil
+}
+
+// imfMaxSubLevels holds the highest IMF sublevel allowed at each main
+// level; main level 0 leaves it unrestricted.
+var imfMaxSubLevels = [...]int{9, 1, 1, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+// imfMaxSampleRates holds the highest sample rate, in millions of samples
+// per second over all components, of each IMF main level from 1.
+var imfMaxSampleRates = [...]int{65, 130, 195, 260, 520, 1200, 2400, 4800, 9600, 19200, 38400}
+
+// imfBaseBitRate is the bit-rate limit of IMF sublevel 1, in bits per
+// second; each further sublevel doubles it.
+const imfBaseBitRate = 200_000_000
+
+// applyIMFProfile sets the options the IMF profiles fix: a single tile,
+// the 5-3 wavelet for the reversible profiles and the 9-7 one otherwise,
+// at most the profile's decomposition levels, 32x32 or 64x64 code-blocks
+// without coding modes, and 256x256 precincts (128x128 at the lowest
+// resolution). It fails if the image does not fit the profile's container
+// or the levels in the low byte of the profile are out of range.
+func (e *encoder) applyIMFProfile() error {
+	p := e.options.Profile
+	c := p.Constraints()
+	mainLevel, subLevel := p.imfLevels()
+	if mainLevel >= len(imfMaxSubLevels) {
+		return fmt.Errorf("jpeg2000: IMF main level %d out of range [0, %d]", mainLevel, len(imfMaxSubLevels)-1)
+	}
+	if subLevel > imfMaxSubLevels[mainLevel] {
+		return fmt.Errorf("jpeg2000: IMF sublevel %d exceeds %d for main level %d", subLevel, imfMaxSubLevels[mainLevel], mainLevel)
+	}
+	if err := e.checkContainer(c); err != nil {
+		return err
+	}
+	if e.options.Precision != 0 && (e.options.Precision < 8 || e.options.Precision > c.MaxBitDepth) {
+		return fmt.Errorf("jpeg2000: precision %d outside the IMF range of 8 to %d bits", e.options.Precision, c.MaxBitDepth)
+	}
+
+	o := *e.options
+	o.Lossless = p.imfReversible()
+	o.ForceReversible = false
+	o.Wavelet = WaveletAuto
+	o.Signed = false
+	o.TileSize = image.Point{}
+	o.TileOffset = image.Point{}
+	o.ImageOffset = image.Point{}
+	if o.NumResolutions > c.MaxDecompositions+1 {
+		o.NumResolutions = c.MaxDecompositions + 1
+	}
+	if o.CodeBlockSize.X != 5 {
+		o.CodeBlockSize.X = 6
+	}
+	if o.CodeBlockSize.Y != 5 {
+		o.CodeBlockSize.Y = 6
+	}
+	o.CodeBlockStyle = CodeBlockStyle{}
+	o.HighThroughput = false
+	o.PrecinctSize = []image.Point{{X: 7, Y: 7}, {X: 8, Y: 8}}
+	e.options = &o
+	return nil
+}
+
+// checkIMFLevel checks the extracted components against an IMF profile:
+// at most three components, only the first two chroma ones subsampled
+// and then 2:1 horizontally, and, when FrameRate is set, no more samples
+// per second than the main level allows.
+func (e *encoder) checkIMFLevel() error {
+	p := e.options.Profile
+	if !p.isIMF() {
+		return nil
+	}
+	if e.numComponents > 3 {
+		return fmt.Errorf("jpeg2000: IMF allows at most 3 components, got %d", e.numComponents)
+	}
+	samples := 0
+	for c := 0; c < e.numComponents; c++ {
+		if s := e.componentSubsampling(c); s != (image.Point{X: 1, Y: 1}) && (c == 0 || s != image.Point{X: 2, Y: 1}) {
+			return fmt.Errorf("jpeg2000: IMF does not allow %dx%d subsampling of component %d", s.X, s.Y, c)
+		}
+		samples += e.componentRect(c).Dx() * e.componentRect(c).Dy()
+	}
+
+	mainLevel, _ := p.imfLevels()
+	if r := e.options.FrameRate; mainLevel > 0 && r.Num > 0 && r.Den > 0 {
+		rate := float64(samples) * float64(r.Num) / float64(r.Den)
+		if limit := imfMaxSampleRates[mainLevel-1]; rate > float64(limit)*1e6 {
+			return fmt.Errorf("jpeg2000: %.0f samples/s exceeds the %d Msamples/s of IMF main level %d", rate, limit, mainLevel)
+		}
+	}
+	return nil
+}
+
+// frameLimits returns the largest codestream and the largest per-component
+// share of it that one frame may take under the bit-rate limits of the
+// profile, or zero where there is no limit. Cinema frames are held to the
+// DCI limits; IMF frames to those of the sublevel, if one and FrameRate
+// are set.
+func (e *encoder) frameLimits() (frame, component int) {
+	r := e.options.FrameRate
+	switch p := e.options.Profile; {
+	case p.isCinema():
+		fps := float64(cinemaBaseFrameRate)
+		if r.Den > 0 && r.Num > 0 {
+			fps = max(fps, float64(r.Num)/float64(r.Den))
+		}
+		return int(cinemaMaxBitRate / 8 / fps), int(cinemaMaxComponentBitRate / 8 / fps)
+	case p.isIMF():
+		_, subLevel := p.imfLevels()
+		if subLevel == 0 || r.Den <= 0 || r.Num <= 0 {
+			return 0, 0
+		}
+		fps := float64(r.Num) / float64(r.Den)
+		return int(float64(int64(imfBaseBitRate)<<(subLevel-1)) / 8 / fps), 0
+	}
+	return 0, 0
+}
+
+// limitStepGrowth is the factor by which encode coarsens the quantization
+// step of a frame that came out over the limits of its profile.
+const limitStepGrowth = 1.0905077326652577 // 2^(1/8)
+
+// withinFrameLimits reports whether a codestream of n bytes, with the
+// per-component sizes in componentBytes, meets the limits of frameLimits.
+func (e *encoder) withinFrameLimits(n int) bool {
+	frame, component := e.frameLimits()
+	if frame > 0 && n > frame {
+		return false
+	}
+	if component > 0 {
+		for _, b := range e.componentBytes {
+			if b > component {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writesCinemaCOM reports whether the DCI timing COM marker is written.
+func (e *encoder) writesCinemaCOM() bool {
+	return e.options.Profile.isCinema() && e.options.FrameRate.Den != 0
+}
+
+// generateCinemaCOM generates the COM marker segment holding the frame rate
+// and frame count of a DCI cinema sequence.
+func (e *encoder) generateCinemaCOM() []byte {
+	return generateCOM(fmt.Sprintf("%sFrameRate=%s FrameCount=%d",
+		cinemaCommentPrefix, e.options.FrameRate, e.options.CinemaFrameCount))
+}
+
 // generateCAP generates the CAP (extended capabilities) marker segment.
 // This marker is required for HTJ2K mode to signal the use of the
 // High-Throughput block coder.
 func (e *encoder) generateCAP() []byte {
 	// CAP marker format:
 	// - Marker (2 bytes): 0xFF50
-	// - Length (2 bytes): 6 (length field + Pcap)
+	// - Length (2 bytes): 8 (length field + Pcap + one Ccap)
 	// - Pcap (4 bytes): capabilities flags
-	// Total: 8 bytes
+	// - Ccap15 (2 bytes): Part 15 capabilities, left at 0
+	// Total: 10 bytes
 
-	length := 6 // Length includes itself and Pcap
+	length := 8 // Length includes itself, Pcap and Ccap15
 
-	buf := make([]byte, 8)
+	buf := make([]byte, 10)
 	binary.BigEndian.PutUint16(buf[0:2], uint16(codestream.CAP))
 	binary.BigEndian.PutUint16(buf[2:4], uint16(length))
 
@@ -564,238 +1619,367 @@ func (e *encoder) generateCAP() []byte {
 	return buf
 }
 
-// generateTiles generates tile data.
-func (e *encoder) generateTiles() ([]byte, error) {
+// maxTLMEntries is the number of 6-byte entries that fit in one TLM
+// marker segment, whose Ltlm field counts at most 65535 bytes.
+const maxTLMEntries = (0xFFFF - 4) / 6
+
+// generateTLM generates the TLM (tile-part lengths) marker segments.
+// Each entry holds a 16-bit tile index and a 32-bit tile-part length; the
+// entries are split across as many segments as they need, numbered by
+// Ztlm in order.
+func (e *encoder) generateTLM(tileParts [][]byte) []byte {
+	const entrySize = 6
+
 	var buf []byte
+	for start := 0; start < len(tileParts); start += maxTLMEntries {
+		entries := tileParts[start:min(start+maxTLMEntries, len(tileParts))]
+		buf = binary.BigEndian.AppendUint16(buf, uint16(codestream.TLM))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(4+entrySize*len(entries)))
+		buf = append(buf, byte(start/maxTLMEntries)) // Ztlm: index of this TLM segment
+		buf = append(buf, 0x60)                      // Stlm: ST=2 (16-bit Ttlm), SP=1 (32-bit Ptlm)
+		for _, tp := range entries {
+			buf = append(buf, tp[4:6]...)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(tp)))
+		}
+	}
+	return buf
+}
 
-	// For now, single tile (entire image)
-	tileData, err := e.encodeTile(0)
+// generateTiles generates tile data, returning one entry per tile-part.
+// Each tile-part starts with its SOT marker segment.
+func (e *encoder) generateTiles() ([][]byte, error) {
+	h, err := e.codestreamHeader()
 	if err != nil {
 		return nil, err
 	}
-	buf = append(buf, tileData...)
 
-	return buf, nil
+	var tileParts [][]byte
+	for _, tileIdx := range e.tileIndices(h) {
+		tileData, err := e.encodeTile(h, tileIdx)
+		if err != nil {
+			return nil, err
+		}
+		tileParts = append(tileParts, tileData)
+	}
+
+	return tileParts, nil
 }
 
 // codeBlockJob represents a code-block encoding job for parallel processing.
 type codeBlockJob struct {
-	index       int    // Order in output
-	data        []int32
-	width       int
-	height      int
-	bandType    int
+	cb       *tcd.CodeBlock
+	band     *tcd.Band
+	data     []int32
+	comp     int // Component, resolution and band index, for EncodeStats
+	res      int
+	bandIdx  int
+	skip     bool // Below Options.SparsityThreshold; not entropy coded
 }
 
-// codeBlockResult holds the encoded result.
-type codeBlockResult struct {
-	index   int
-	encoded []byte
-}
+// encodeTile encodes tile tileIdx of the codestream described by h into
+// a tile-part. The code-blocks are entropy coded in parallel, their coding
+// passes are spread over the quality layers by allocateLayers, and the
+// packets are assembled in the progression order.
+func (e *encoder) encodeTile(h *codestream.Header, tileIdx int) ([]byte, error) {
+	te := tcd.NewTileEncoder(h)
+	te.InitTile(tileIdx, nil)
+	tile := te.Tile()
+	jobs := e.codeBlockJobs(tile)
+
+	encode := func(job codeBlockJob) {
+		if job.skip {
+			return
+		}
+		te.EncodeCodeBlock(job.cb, job.data, job.band.Type)
+		if len(job.cb.Passes) > 0 {
+			job.cb.ZeroBitPlanes = job.band.MaxBitPlanes - job.cb.TotalBitPlanes
+		}
+	}
 
-// encodeTile encodes a single tile using parallel code-block encoding.
-func (e *encoder) encodeTile(tileIdx int) ([]byte, error) {
-	// Collect all code-block jobs
-	var jobs []codeBlockJob
+	// Sequential encoding for small job counts or single-threaded mode
+	// Set GOMAXPROCS=1 to force single-threaded encoding
+	numWorkers := min(runtime.GOMAXPROCS(0), len(jobs))
+	if len(jobs) <= 4 || numWorkers == 1 {
+		for _, job := range jobs {
+			encode(job)
+		}
+	} else {
+		// Pre-fill job channel before starting workers to reduce contention
+		jobChan := make(chan codeBlockJob, len(jobs))
+		for _, job := range jobs {
+			jobChan <- job
+		}
+		close(jobChan)
+
+		var wg sync.WaitGroup
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobChan {
+					encode(job)
+				}
+			}()
+		}
+		wg.Wait()
+	}
 
-	numRes := e.options.NumResolutions
-	if numRes <= 0 {
-		numRes = 6
+	for _, job := range jobs {
+		if !job.skip {
+			e.recordStats(job)
+			if e.componentBytes != nil {
+				e.componentBytes[job.comp] += len(job.cb.Data)
+			}
+		}
+	}
+	if n := e.numLayers(); n > 1 {
+		allocateLayers(jobs, n)
 	}
 
-	cbWidth := 1 << (e.options.CodeBlockSize.X + 2)
-	cbHeight := 1 << (e.options.CodeBlockSize.Y + 2)
-	if cbWidth <= 0 {
-		cbWidth = 64
+	// Assemble the packets
+	sop := e.options.EnableSOP
+	eph := e.options.EnableEPH
+	var body bytes.Buffer
+	pe := tcd.NewPacketEncoder(&body)
+	var lengths []int
+	it := tilePackets(tile, h.CodingStyle, h.ProgressionOrderChanges)
+	for p, ok := it.Next(); ok; p, ok = it.Next() {
+		prec := tilePrecinct(tile, p)
+		if prec == nil {
+			continue
+		}
+		start := body.Len()
+		if err := pe.EncodePacket(prec, p.Layer, sop, eph); err != nil {
+			return nil, fmt.Errorf("encoding packet %+v: %w", p, err)
+		}
+		lengths = append(lengths, body.Len()-start)
 	}
-	if cbHeight <= 0 {
-		cbHeight = 64
+	if !e.options.EmitPLT {
+		lengths = nil
 	}
 
-	// First pass: collect all code-block jobs
-	for c := 0; c < e.numComponents; c++ {
-		for r := 0; r < numRes; r++ {
-			var numBands int
-			if r == 0 {
-				numBands = 1 // LL only
-			} else {
-				numBands = 3 // HL, LH, HH
-			}
+	return e.createTileHeader(tileIdx, body.Bytes(), lengths), nil
+}
 
-			for b := 0; b < numBands; b++ {
-				bandType := entropy.BandLL
-				if r > 0 {
-					switch b {
-					case 0:
-						bandType = entropy.BandHL
-					case 1:
-						bandType = entropy.BandLH
-					case 2:
-						bandType = entropy.BandHH
-					}
-				}
+// numResolutions returns the number of resolution levels to encode.
+func (e *encoder) numResolutions() int {
+	if e.options.NumResolutions <= 0 {
+		return 6
+	}
+	return e.options.NumResolutions
+}
 
-				scale := 1 << (numRes - 1 - r)
-				bandWidth := (e.width + scale - 1) / scale
-				bandHeight := (e.height + scale - 1) / scale
+// allocateLayers spreads the coding passes of a tile's code-blocks over
+// numLayers quality layers with PCRD-opt, so each layer adds the passes
+// that remove the most distortion per byte. Layer l may take 2^(l+1-n) of
+// the tile's coded bytes, each layer about doubling the rate of the one
+// before, and the last layer completes every block, so decoding all
+// layers gives the same image as a single-layer encode.
+func allocateLayers(jobs []codeBlockJob, numLayers int) {
+	var blocks []*tcd.CodeBlock
+	total := 0
+	for _, job := range jobs {
+		if job.skip || len(job.cb.Passes) == 0 {
+			continue
+		}
+		blocks = append(blocks, job.cb)
+		total += len(job.cb.Data)
+	}
 
-				if r > 0 {
-					bandWidth = (bandWidth + 1) / 2
-					bandHeight = (bandHeight + 1) / 2
-				}
+	budgets := make([]int, numLayers)
+	for l := range budgets {
+		budgets[l] = int(math.Ldexp(float64(total), l+1-numLayers))
+	}
+	tcd.AllocateLayersPCRD(blocks, budgets)
 
-				for cby := 0; cby*cbHeight < bandHeight; cby++ {
-					for cbx := 0; cbx*cbWidth < bandWidth; cbx++ {
-						actualWidth := cbWidth
-						actualHeight := cbHeight
-						startX := cbx * cbWidth
-						startY := cby * cbHeight
-						if startX+actualWidth > bandWidth {
-							actualWidth = bandWidth - startX
-						}
-						if startY+actualHeight > bandHeight {
-							actualHeight = bandHeight - startY
-						}
-
-						cbData := e.extractCodeBlockData(c, r, bandType, cbx, cby, cbWidth, cbHeight, bandWidth, bandHeight)
-
-						jobs = append(jobs, codeBlockJob{
-							index:    len(jobs),
-							data:     cbData,
-							width:    actualWidth,
-							height:   actualHeight,
-							bandType: bandType,
-						})
+	// Passes off the convex hull are never allocated; the last layer
+	// carries them too
+	for _, cb := range blocks {
+		cb.LayerPasses[numLayers-1] = len(cb.Passes)
+		cb.IncludedInLayers = min(cb.IncludedInLayers, numLayers-1)
+	}
+}
+
+// numLayers returns the number of quality layers to encode.
+func (e *encoder) numLayers() int {
+	if e.options.NumLayers <= 0 {
+		return 1
+	}
+	return e.options.NumLayers
+}
+
+// codeBlockJobs collects the code-blocks of tile, taking their quantized
+// coefficients from the tile's Mallat layout in componentData.
+func (e *encoder) codeBlockJobs(tile *tcd.Tile) []codeBlockJob {
+	var jobs []codeBlockJob
+	for c, tc := range tile.Components {
+		origin := e.tileRect(c, tc).Min
+		stride := e.componentRect(c).Dx()
+		for r, res := range tc.Resolutions {
+			for b, band := range res.Bands {
+				ox, oy := tcd.BandOffset(tc, r, band.Type)
+				for _, cb := range band.CodeBlocks {
+					w, h := cb.X1-cb.X0, cb.Y1-cb.Y0
+					data := make([]int32, w*h)
+					for y := 0; y < h; y++ {
+						sy := origin.Y + oy + cb.Y0 - band.Y0 + y
+						sx := origin.X + ox + cb.X0 - band.X0
+						copy(data[y*w:(y+1)*w], e.componentData[c][sy*stride+sx:])
 					}
+					jobs = append(jobs, codeBlockJob{
+						cb:      cb,
+						band:    band,
+						data:    data,
+						comp:    c,
+						res:     r,
+						bandIdx: b,
+						skip:    e.skipSparseCodeBlock(data, w, h),
+					})
 				}
 			}
 		}
 	}
+	return jobs
+}
 
-	// Sequential encoding for small job counts or single-threaded mode
-	// Set GOMAXPROCS=1 to force single-threaded encoding
-	if len(jobs) <= 4 || runtime.GOMAXPROCS(0) == 1 {
-		var tileData []byte
-		t1 := entropy.GetT1(64, 64)
-		for _, job := range jobs {
-			t1.Resize(job.width, job.height)
-			t1.SetData(job.data)
-			encoded := t1.Encode(job.bandType)
-			tileData = append(tileData, encoded...)
-		}
-		entropy.PutT1(t1)
-		return e.createTileHeader(tileIdx, tileData), nil
+// resetStats sizes Options.CollectStats for the image being encoded.
+func (e *encoder) resetStats() {
+	stats := e.options.CollectStats
+	if stats == nil {
+		return
 	}
 
-	// Parallel encoding - use all available cores
-	numWorkers := runtime.GOMAXPROCS(0)
-	if numWorkers > len(jobs) {
-		numWorkers = len(jobs)
+	numRes := e.options.NumResolutions
+	if numRes <= 0 {
+		numRes = 6
 	}
 
-	// Pre-fill job channel before starting workers to reduce contention
-	jobChan := make(chan codeBlockJob, len(jobs))
-	for _, job := range jobs {
-		jobChan <- job
-	}
-	close(jobChan)
-
-	resultChan := make(chan codeBlockResult, len(jobs))
-
-	// Start workers
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for job := range jobChan {
-				t1 := entropy.GetT1(job.width, job.height)
-				t1.SetData(job.data)
-				encoded := t1.Encode(job.bandType)
-				entropy.PutT1(t1)
-				resultChan <- codeBlockResult{
-					index:   job.index,
-					encoded: encoded,
-				}
+	*stats = EncodeStats{SubbandBytes: make([][][]int64, e.numComponents)}
+	for c := range stats.SubbandBytes {
+		stats.SubbandBytes[c] = make([][]int64, numRes)
+		for r := range stats.SubbandBytes[c] {
+			if r == 0 {
+				stats.SubbandBytes[c][r] = make([]int64, 1)
+			} else {
+				stats.SubbandBytes[c][r] = make([]int64, 3)
 			}
-		}()
+		}
 	}
+}
 
-	// Wait for completion
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
-
-	// Collect results in order
-	results := make([][]byte, len(jobs))
-	for result := range resultChan {
-		results[result.index] = result.encoded
+// recordStats adds a coded code-block to Options.CollectStats.
+func (e *encoder) recordStats(job codeBlockJob) {
+	stats := e.options.CollectStats
+	if stats == nil {
+		return
 	}
 
-	// Combine results in order
-	var tileData []byte
-	for _, encoded := range results {
-		tileData = append(tileData, encoded...)
-	}
+	stats.SubbandBytes[job.comp][job.res][job.bandIdx] += int64(len(job.cb.Data))
 
-	return e.createTileHeader(tileIdx, tileData), nil
+	cb := tcd.CodeBlock{X1: job.cb.X1 - job.cb.X0, Y1: job.cb.Y1 - job.cb.Y0, Coefficients: job.data}
+	stats.CodeBlockCount++
+	stats.MeanSparsity += (cb.SparsityRatio() - stats.MeanSparsity) / float64(stats.CodeBlockCount)
 }
 
-// createTileHeader creates the tile-part header.
-func (e *encoder) createTileHeader(tileIdx int, tileData []byte) []byte {
+// skipSparseCodeBlock reports whether a code-block falls below
+// Options.SparsityThreshold and should not be entropy coded.
+func (e *encoder) skipSparseCodeBlock(data []int32, width, height int) bool {
+	if e.options.SparsityThreshold <= 0 {
+		return false
+	}
+	cb := tcd.CodeBlock{X1: width, Y1: height, Coefficients: data}
+	return cb.SparsityRatio() < e.options.SparsityThreshold
+}
+
+// createTileHeader creates the tile-part header, with PLT marker segments
+// listing packetLengths if it is non-nil.
+func (e *encoder) createTileHeader(tileIdx int, tileData []byte, packetLengths []int) []byte {
 	sotLength := 10
-	tilePartLength := uint32(14 + len(tileData))
 
-	header := make([]byte, 14)
+	header := make([]byte, 12, 14)
 	binary.BigEndian.PutUint16(header[0:2], uint16(codestream.SOT))
 	binary.BigEndian.PutUint16(header[2:4], uint16(sotLength))
 	binary.BigEndian.PutUint16(header[4:6], uint16(tileIdx))
-	binary.BigEndian.PutUint32(header[6:10], tilePartLength)
 	header[10] = 0 // Tile-part index
 	header[11] = 1 // Number of tile-parts
-	binary.BigEndian.PutUint16(header[12:14], uint16(codestream.SOD))
+	if packetLengths != nil {
+		header = append(header, generatePLT(packetLengths)...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(codestream.SOD))
+
+	tilePartLength := uint32(len(header) + len(tileData))
+	binary.BigEndian.PutUint32(header[6:10], tilePartLength)
 
 	return append(header, tileData...)
 }
 
-// extractCodeBlockData extracts data for a code-block.
-func (e *encoder) extractCodeBlockData(comp, res, bandType, cbx, cby, cbWidth, cbHeight, bandWidth, bandHeight int) []int32 {
-	// Calculate actual code-block size (may be smaller at edges)
-	actualWidth := cbWidth
-	actualHeight := cbHeight
-	startX := cbx * cbWidth
-	startY := cby * cbHeight
+// generatePLT generates the PLT (packet lengths, tile-part header) marker
+// segments for lengths. Each length is written seven bits per byte, most
+// significant group first, with the high bit set on all but the last byte.
+// A new segment is started whenever the next length would not fit.
+func generatePLT(lengths []int) []byte {
+	const maxLplt = 0xFFFF
 
-	if startX+actualWidth > bandWidth {
-		actualWidth = bandWidth - startX
-	}
-	if startY+actualHeight > bandHeight {
-		actualHeight = bandHeight - startY
+	var buf []byte
+	segStart := -1 // offset of the current segment's marker
+	numSegments := 0
+	finish := func() {
+		if segStart >= 0 {
+			binary.BigEndian.PutUint16(buf[segStart+2:segStart+4], uint16(len(buf)-segStart-2))
+		}
 	}
-
-	data := make([]int32, actualWidth*actualHeight)
-
-	// Extract from component data
-	// This is simplified - actual implementation would need proper subband addressing
-	for y := 0; y < actualHeight; y++ {
-		for x := 0; x < actualWidth; x++ {
-			srcX := startX + x
-			srcY := startY + y
-			if srcX < e.width && srcY < e.height {
-				srcIdx := srcY*e.width + srcX
-				if srcIdx < len(e.componentData[comp]) {
-					data[y*actualWidth+x] = e.componentData[comp][srcIdx]
-				}
-			}
+	for _, l := range lengths {
+		var entry [5]byte
+		n := len(entry) - 1
+		entry[n] = byte(l & 0x7F)
+		for l >>= 7; l > 0; l >>= 7 {
+			n--
+			entry[n] = 0x80 | byte(l&0x7F)
+		}
+		iplt := entry[n:]
+
+		if segStart < 0 || len(buf)-segStart-2+len(iplt) > maxLplt {
+			finish()
+			segStart = len(buf)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(codestream.PLT))
+			buf = append(buf, 0, 0, byte(numSegments)) // Lplt, filled in by finish; Zplt
+			numSegments++
 		}
+		buf = append(buf, iplt...)
 	}
-
-	return data
+	finish()
+	return buf
 }
 
 // writeJP2 writes a JP2 file.
 func (e *encoder) writeJP2(codestream []byte) error {
+	if err := e.writeJP2Header(); err != nil {
+		return err
+	}
+
+	// Write codestream
+	jp2cBox := box.CreateCodestreamBox(codestream)
+	return box.NewWriter(e.w).WriteBox(jp2cBox)
+}
+
+// jpxReaderRequirements returns the reader requirements of the JPX files
+// the encoder writes: a single contiguous Part 1 codestream, which a
+// reader must support both to understand and to display the file.
+func jpxReaderRequirements() *box.ReaderRequirementsBox {
+	return &box.ReaderRequirementsBox{
+		MaskLength:      1,
+		FullyUnderstand: 0xC0,
+		DisplayContents: 0xC0,
+		StandardFeatures: []box.ReaderFeature{
+			{Feature: box.FeaturePart1Codestream, Mask: 0x80},
+			{Feature: box.FeatureContiguousCodestream, Mask: 0x40},
+		},
+	}
+}
+
+// writeJP2Header writes the boxes of a JP2 or JPX file that precede the
+// codestream box.
+func (e *encoder) writeJP2Header() error {
 	boxWriter := box.NewWriter(e.w)
 
 	// Write signature
@@ -803,11 +1987,23 @@ func (e *encoder) writeJP2(codestream []byte) error {
 		return err
 	}
 
-	// Write file type box
+	// Write file type box, and for JPX the reader requirements box that
+	// must follow it
 	ftypBox := box.CreateFileTypeBox()
+	if e.options.Format == FormatJPX {
+		ftypBox = box.CreateJPXFileTypeBox()
+	}
 	if err := boxWriter.WriteBox(ftypBox); err != nil {
 		return err
 	}
+	if e.options.Format == FormatJPX {
+		rreq := jpxReaderRequirements()
+		rreqBox := &box.Box{Type: box.TypeReaderReq, Contents: rreq.Bytes()}
+		rreqBox.Length = uint64(8 + len(rreqBox.Contents))
+		if err := boxWriter.WriteBox(rreqBox); err != nil {
+			return err
+		}
+	}
 
 	// Determine colorspace from options or default based on components
 	var colorspace uint32
@@ -857,24 +2053,37 @@ func (e *encoder) writeJP2(codestream []byte) error {
 	}
 
 	// Write JP2 header
+	bpc := uint8(e.precision - 1)
+	if e.signed {
+		bpc |= 0x80
+	}
+	if e.precisions != nil {
+		bpc = 0xFF
+	}
 	jp2hBox := box.CreateJP2Header(
 		uint32(e.width),
 		uint32(e.height),
 		uint16(e.numComponents),
-		uint8(e.precision-1),
+		bpc,
 		colorspace,
 	)
-	if err := boxWriter.WriteBox(jp2hBox); err != nil {
-		return err
-	}
 
-	// Write codestream
-	jp2cBox := box.CreateCodestreamBox(codestream)
-	if err := boxWriter.WriteBox(jp2cBox); err != nil {
-		return err
+	// Differing bit depths are listed in a bits per component box
+	if e.precisions != nil {
+		bpcc := &box.BitsPerCompBox{}
+		for c := range e.precisions {
+			d := uint8(e.componentPrecision(c) - 1)
+			if e.signed {
+				d |= 0x80
+			}
+			bpcc.BitsPerComponent = append(bpcc.BitsPerComponent, d)
+		}
+		b := &box.Box{Type: box.TypeBitsPerComp, Contents: bpcc.Bytes()}
+		b.Length = uint64(8 + len(b.Contents))
+		jp2hBox.Contents = append(jp2hBox.Contents, b.Bytes()...)
+		jp2hBox.Length = uint64(8 + len(jp2hBox.Contents))
 	}
-
-	return nil
+	return boxWriter.WriteBox(jp2hBox)
 }
 
 // Ensure encoder implements required interfaces
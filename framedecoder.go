@@ -0,0 +1,61 @@
+package jpeg2000
+
+import (
+	"bufio"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// Decoder decodes a sequence of images with the same configuration, such
+// as the frames of a Motion JPEG 2000 stream, keeping its working buffers
+// between calls. Frames of the same dimensions and layout then decode
+// without reallocating the codestream, coefficient and component buffers;
+// a frame of a different size grows them as needed.
+//
+// A Decoder is not safe for concurrent use.
+type Decoder struct {
+	cfg     *Config
+	r       *bufio.Reader
+	scratch decodeScratch
+}
+
+// NewDecoder returns a Decoder that decodes with cfg, which may be nil.
+// cfg is copied, so later changes to it do not affect the Decoder.
+//
+// Reusing buffers is incompatible with a TileCache, which keeps decoded
+// tiles: with cfg.TileCache set, tile buffers are allocated per tile as
+// for DecodeConfig.
+func NewDecoder(cfg *Config) *Decoder {
+	dec := &Decoder{}
+	if cfg != nil {
+		c := *cfg
+		dec.cfg = &c
+	}
+	return dec
+}
+
+// Decode decodes the image read from r as DecodeConfig does. The returned
+// image is freshly allocated and does not share memory with the Decoder,
+// so it stays valid across later calls; use DecodeInto to decode into a
+// caller-supplied image instead.
+func (dec *Decoder) Decode(r io.Reader) (image.Image, error) {
+	return dec.newDecoder(r).decode(dec.cfg)
+}
+
+// DecodeInto decodes the image read from r into dst, as the package-level
+// DecodeInto does: dst must have the bounds Decode would return, and is
+// filled without allocating an output image when it has the same type.
+func (dec *Decoder) DecodeInto(dst draw.Image, r io.Reader) error {
+	return dec.newDecoder(r).decodeInto(dst, dec.cfg)
+}
+
+// newDecoder returns a decoder reading r with the Decoder's buffers.
+func (dec *Decoder) newDecoder(r io.Reader) *decoder {
+	if dec.r == nil {
+		dec.r = bufio.NewReader(r)
+	} else {
+		dec.r.Reset(r)
+	}
+	return &decoder{r: dec.r, scratch: &dec.scratch}
+}
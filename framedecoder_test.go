@@ -0,0 +1,94 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	frame := func(w, h, seed int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetRGBA(x, y, color.RGBA{uint8(x*seed + y), uint8(y * seed), uint8(x + y*seed), 255})
+			}
+		}
+		return img
+	}
+
+	var frames [][]byte
+	for i, o := range []*Options{
+		{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(32, 32)},
+		{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(32, 32)},
+		{Format: FormatJP2, Quality: 80},
+		{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(32, 32)},
+	} {
+		// The third frame is larger, the last smaller again
+		w, h := 80, 48
+		if i == 2 {
+			w, h = 120, 90
+		}
+		if i == 3 {
+			w, h = 40, 24
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, frame(w, h, i+3), o); err != nil {
+			t.Fatalf("Encode() frame %d error: %v", i, err)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+
+	for _, cfg := range []*Config{nil, {MaxWorkers: 1}} {
+		dec := NewDecoder(cfg)
+		var got []image.Image
+		for i, data := range frames {
+			img, err := dec.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decoder.Decode() frame %d error: %v", i, err)
+			}
+			got = append(got, img)
+		}
+		// Earlier images must not be overwritten by later frames
+		for i, data := range frames {
+			want, err := DecodeConfig(bytes.NewReader(data), nil)
+			if err != nil {
+				t.Fatalf("DecodeConfig() frame %d error: %v", i, err)
+			}
+			if !reflect.DeepEqual(got[i], want) {
+				t.Errorf("Decoder.Decode() frame %d differs from DecodeConfig()", i)
+			}
+		}
+	}
+
+	dec := NewDecoder(nil)
+	if _, err := dec.Decode(bytes.NewReader([]byte("not a jpeg 2000 file"))); err == nil {
+		t.Error("Decoder.Decode() of invalid data succeeded")
+	}
+	if _, err := dec.Decode(bytes.NewReader(frames[0])); err != nil {
+		t.Errorf("Decoder.Decode() after an error: %v", err)
+	}
+}
+
+func BenchmarkDecoder_Frames(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 13)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Format: FormatJ2K, Quality: 80}); err != nil {
+		b.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	dec := NewDecoder(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dec.Decode(bytes.NewReader(data)); err != nil {
+			b.Fatalf("Decoder.Decode() error: %v", err)
+		}
+	}
+}
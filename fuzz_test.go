@@ -2,11 +2,55 @@ package jpeg2000
 
 import (
 	"bytes"
+	"image"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
-// FuzzDecode tests the decoder with arbitrary input data.
-// Run with: go test -fuzz=FuzzDecode -fuzztime=60s
+// fuzzMaxSamples bounds the samples of the images the fuzz targets
+// decode, so that inputs declaring huge images do not exhaust memory.
+const fuzzMaxSamples = 1 << 22
+
+// addEncodedSeeds adds complete J2K and JP2 files, lossless and lossy, to
+// the seed corpus of f, along with the codestreams in testdata.
+func addEncodedSeeds(f *testing.F) {
+	src := image.NewRGBA(image.Rect(0, 0, 17, 13))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 9, 9))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 13)
+	}
+
+	for _, opts := range []*Options{
+		{Format: FormatJ2K, Lossless: true, NumResolutions: 3},
+		{Format: FormatJP2, Lossless: true, NumResolutions: 2, MCT: MCTAuto},
+		{Format: FormatJ2K, Quality: 50, NumResolutions: 3, MCT: MCTAuto, EnableSOP: true, EnableEPH: true},
+		{Format: FormatJ2K, Lossless: true, NumResolutions: 2, TileSize: image.Pt(8, 8), ProgressionOrder: RPCL},
+	} {
+		for _, img := range []image.Image{src, gray} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, img, opts); err != nil {
+				f.Fatalf("Encode() error: %v", err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+
+	for _, name := range []string{"bypass.j2k", "ppm.j2k", "ppt.j2k"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatalf("ReadFile() error: %v", err)
+		}
+		f.Add(data)
+	}
+}
+
+// FuzzDecode tests the decoder with arbitrary input data. Errors are
+// expected; a panic is a bug.
+// Run with: go test -fuzz='^FuzzDecode$' -fuzztime=60s
 func FuzzDecode(f *testing.F) {
 	// Add seed corpus with minimal valid JP2 and J2K headers
 	// Minimal JP2 signature
@@ -25,7 +69,16 @@ func FuzzDecode(f *testing.F) {
 	f.Add([]byte{0x00})
 	f.Add([]byte{0xFF})
 
+	// Complete images, so that mutations reach the tile decoding
+	addEncodedSeeds(f)
+
 	f.Fuzz(func(t *testing.T, data []byte) {
+		// Skip images too large to decode within the fuzzer's memory
+		m, err := DecodeMetadata(bytes.NewReader(data))
+		if err == nil && int64(m.Width)*int64(m.Height)*int64(m.NumComponents) > fuzzMaxSamples {
+			return
+		}
+
 		// The decoder should never panic, regardless of input
 		r := bytes.NewReader(data)
 		_, _ = Decode(r)
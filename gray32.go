@@ -0,0 +1,124 @@
+package jpeg2000
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Gray32 is an in-memory grayscale image with integer samples of up to 32
+// bits. Decode returns a *Gray32 for single-component images whose
+// precision exceeds 16 bits, which image.Gray16 would truncate.
+//
+// Samples are stored unscaled, exactly as reconstructed from the
+// codestream. Signed samples are plain int32 values; unsigned 32-bit
+// samples should be read as uint32 to recover their full range. At
+// reports samples scaled down to 16 bits for use with the image package.
+type Gray32 struct {
+	// Pix holds the image's samples in row-major order. The sample at
+	// (x, y) is Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	Pix []int32
+	// Stride is the Pix stride, in samples, between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Precision is the component bit depth, 17 to 32.
+	Precision int
+	// Signed reports whether samples are signed.
+	Signed bool
+}
+
+// NewGray32 returns a new Gray32 image with the given bounds, precision
+// and signedness.
+func NewGray32(r image.Rectangle, precision int, signed bool) *Gray32 {
+	return &Gray32{
+		Pix:       make([]int32, r.Dx()*r.Dy()),
+		Stride:    r.Dx(),
+		Rect:      r,
+		Precision: precision,
+		Signed:    signed,
+	}
+}
+
+// ColorModel implements image.Image.
+func (p *Gray32) ColorModel() color.Model { return color.Gray16Model }
+
+// Bounds implements image.Image.
+func (p *Gray32) Bounds() image.Rectangle { return p.Rect }
+
+// At implements image.Image.
+func (p *Gray32) At(x, y int) color.Color { return p.Gray16At(x, y) }
+
+// Gray16At returns the sample at (x, y) scaled to 16 bits. Signed samples
+// are offset so that the most negative value maps to zero.
+func (p *Gray32) Gray16At(x, y int) color.Gray16 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.Gray16{}
+	}
+	u := uint32(p.Pix[p.PixOffset(x, y)])
+	if p.Signed {
+		u += 1 << (p.Precision - 1)
+	}
+	return color.Gray16{Y: uint16(u >> (p.Precision - 16))}
+}
+
+// Int32At returns the raw sample at (x, y), or zero outside the bounds.
+func (p *Gray32) Int32At(x, y int) int32 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// Set implements draw.Image, storing the 16-bit gray value of c scaled up
+// to the image's precision.
+func (p *Gray32) Set(x, y int, c color.Color) {
+	u := uint32(color.Gray16Model.Convert(c).(color.Gray16).Y) << (p.Precision - 16)
+	if p.Signed {
+		u -= 1 << (p.Precision - 1)
+	}
+	p.SetInt32(x, y, int32(u))
+}
+
+// SetInt32 sets the raw sample at (x, y).
+func (p *Gray32) SetInt32(x, y int, v int32) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = v
+}
+
+// PixOffset returns the index of the sample in Pix that corresponds to
+// (x, y).
+func (p *Gray32) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// gray32Image builds a Gray32 from one component's samples, clamping them
+// to the range of the given precision. The samples are written into dst
+// if it is a Gray32 covering bounds, which then takes on their precision
+// and signedness.
+func gray32Image(dst draw.Image, data []int32, bounds image.Rectangle, precision int, signed bool) *Gray32 {
+	img := outputImage(dst, bounds, func(r image.Rectangle) *Gray32 {
+		return NewGray32(r, precision, signed)
+	})
+	img.Precision, img.Signed = precision, signed
+	lo, hi := int32(math.MinInt32), int32(math.MaxInt32)
+	switch {
+	case precision >= 32:
+	case signed:
+		lo, hi = int32(-1)<<(precision-1), int32(1)<<(precision-1)-1
+	default:
+		lo, hi = 0, int32(1)<<precision-1
+	}
+	width := bounds.Dx()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:width]
+		for x, v := range data[y*width : (y+1)*width] {
+			row[x] = clampInt32(v, lo, hi)
+		}
+	}
+	return img
+}
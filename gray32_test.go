@@ -0,0 +1,124 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestGray32(t *testing.T) {
+	img := NewGray32(image.Rect(2, 3, 6, 5), 24, false)
+	img.SetInt32(2, 3, 0)
+	img.SetInt32(5, 4, 1<<24-1)
+	img.SetInt32(9, 9, 7) // out of bounds, ignored
+
+	if got := img.Int32At(5, 4); got != 1<<24-1 {
+		t.Errorf("Int32At(5, 4) = %d, want %d", got, 1<<24-1)
+	}
+	if got := img.Int32At(9, 9); got != 0 {
+		t.Errorf("Int32At(9, 9) = %d, want 0", got)
+	}
+	if got := img.At(5, 4); got != (color.Gray16{Y: 0xFFFF}) {
+		t.Errorf("At(5, 4) = %v, want max", got)
+	}
+	if got := img.At(2, 3); got != (color.Gray16{}) {
+		t.Errorf("At(2, 3) = %v, want zero", got)
+	}
+
+	signed := NewGray32(image.Rect(0, 0, 2, 1), 20, true)
+	signed.SetInt32(0, 0, -1<<19)
+	signed.SetInt32(1, 0, 0)
+	if got := signed.Gray16At(0, 0); got.Y != 0 {
+		t.Errorf("signed Gray16At(0, 0) = %d, want 0", got.Y)
+	}
+	if got := signed.Gray16At(1, 0); got.Y != 0x8000 {
+		t.Errorf("signed Gray16At(1, 0) = %#x, want 0x8000", got.Y)
+	}
+
+	full := NewGray32(image.Rect(0, 0, 1, 1), 32, false)
+	full.SetInt32(0, 0, -1) // 0xFFFFFFFF as uint32
+	if got := full.Gray16At(0, 0); got.Y != 0xFFFF {
+		t.Errorf("32-bit Gray16At(0, 0) = %#x, want 0xffff", got.Y)
+	}
+}
+
+func TestGray32Image_Clamps(t *testing.T) {
+	bounds := image.Rect(0, 0, 3, 1)
+	img := gray32Image(nil, []int32{-5, 100, 1 << 20}, bounds, 18, false)
+	if want := []int32{0, 100, 1<<18 - 1}; !equalInt32s(img.Pix, want) {
+		t.Errorf("unsigned Pix = %v, want %v", img.Pix, want)
+	}
+	img = gray32Image(nil, []int32{-1 << 20, -100, 1 << 20}, bounds, 18, true)
+	if want := []int32{-1 << 17, -100, 1<<17 - 1}; !equalInt32s(img.Pix, want) {
+		t.Errorf("signed Pix = %v, want %v", img.Pix, want)
+	}
+}
+
+func equalInt32s(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deepGrayCodestream encodes a small grayscale image and rewrites its SIZ
+// component depth to the given precision and signedness.
+func deepGrayCodestream(t *testing.T, precision int, signed bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2}
+	src := image.NewGray16(image.Rect(0, 0, 8, 4))
+	for i := 0; i < len(src.Pix); i += 2 {
+		src.Pix[i] = 0x80 // mid-grey, so every coded sample is zero
+	}
+	if err := Encode(&buf, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+	ssiz := byte(precision - 1)
+	if signed {
+		ssiz |= 0x80
+	}
+	data[4+38] = ssiz // SOC, SIZ marker, then Ssiz of component 0
+	return data
+}
+
+func TestDecode_Gray32(t *testing.T) {
+	tests := []struct {
+		precision int
+		signed    bool
+		want      int32 // the DC level, since the image is flat
+	}{
+		{24, false, 1 << 23},
+		{24, true, 0},
+		{32, false, -1 << 31}, // 1<<31 read as uint32
+	}
+	for _, tt := range tests {
+		data := deepGrayCodestream(t, tt.precision, tt.signed)
+
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d-bit: Decode() error: %v", tt.precision, err)
+		}
+		img, ok := m.(*Gray32)
+		if !ok {
+			t.Fatalf("%d-bit: Decode() returned %T, want *Gray32", tt.precision, m)
+		}
+		if img.Precision != tt.precision || img.Signed != tt.signed {
+			t.Errorf("%d-bit: Precision, Signed = %d, %v, want %d, %v",
+				tt.precision, img.Precision, img.Signed, tt.precision, tt.signed)
+		}
+		if img.Bounds() != image.Rect(0, 0, 8, 4) {
+			t.Errorf("%d-bit: Bounds() = %v", tt.precision, img.Bounds())
+		}
+		if got := img.Int32At(3, 2); got != tt.want {
+			t.Errorf("%d-bit: Int32At(3, 2) = %d, want %d", tt.precision, got, tt.want)
+		}
+	}
+}
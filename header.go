@@ -0,0 +1,427 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"maps"
+	"math/bits"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+)
+
+// Header describes the main header of a JPEG 2000 codestream: the SIZ,
+// COD/COC, QCD/QCC and COM marker segments.
+type Header struct {
+	// Profile is the Rsiz capabilities value.
+	Profile Profile
+
+	// Width and Height are the size of the image area, and XOffset and
+	// YOffset its position on the reference grid.
+	Width, Height    int
+	XOffset, YOffset int
+
+	// TileWidth and TileHeight are the nominal tile size, and
+	// TileXOffset and TileYOffset the position of the first tile on the
+	// reference grid.
+	TileWidth, TileHeight    int
+	TileXOffset, TileYOffset int
+
+	// NumTilesX and NumTilesY are the number of tiles in each direction.
+	NumTilesX, NumTilesY int
+
+	// ProgressionOrder is the default packet progression order.
+	ProgressionOrder ProgressionOrder
+
+	// NumLayers is the number of quality layers.
+	NumLayers int
+
+	// MultipleComponentTransform reports whether the RCT or ICT is
+	// applied to the first three components.
+	MultipleComponentTransform bool
+
+	// SOP and EPH report whether packets may carry SOP markers and EPH
+	// markers after their headers.
+	SOP, EPH bool
+
+	// HighThroughput reports whether the CAP marker signals HTJ2K
+	// code-blocks.
+	HighThroughput bool
+
+	// Components describes each component, with any COC and QCC
+	// overrides applied.
+	Components []ComponentHeader
+
+	// Comments holds the text of the Latin-1 COM markers, in order.
+	Comments []string
+}
+
+// ComponentHeader describes one component of a codestream.
+type ComponentHeader struct {
+	// Precision is the bit depth and Signed whether samples are signed.
+	Precision int
+	Signed    bool
+
+	// SubsamplingX and SubsamplingY are the XRsiz and YRsiz factors.
+	SubsamplingX, SubsamplingY int
+
+	// RegistrationX and RegistrationY are the CRG offsets of the samples,
+	// in units of 1/65536 of the subsampling factors.
+	RegistrationX, RegistrationY int
+
+	// NumResolutions is the number of resolution levels, one more than
+	// the number of wavelet decompositions.
+	NumResolutions int
+
+	// Reversible reports whether the 5-3 reversible wavelet is used
+	// rather than the 9-7 irreversible one.
+	Reversible bool
+
+	// CodeBlockWidth and CodeBlockHeight are the nominal code-block size.
+	CodeBlockWidth, CodeBlockHeight int
+
+	// CodeBlockStyle holds the code-block coding modes.
+	CodeBlockStyle CodeBlockStyle
+
+	// PrecinctSizes holds the precinct size of each resolution level,
+	// lowest first. It is nil when the maximal precinct size is used.
+	PrecinctSizes []image.Point
+
+	// QuantizationStyle is 0 for no quantization, 1 for scalar derived
+	// and 2 for scalar expounded quantization.
+	QuantizationStyle int
+
+	// GuardBits is the number of guard bits.
+	GuardBits int
+
+	// ROIShift is the region-of-interest max-shift value from an RGN
+	// marker, or 0 when the component has no region of interest.
+	ROIShift int
+}
+
+// DecodeHeader reads the main header of a JPEG 2000 file or codestream
+// without decoding any tiles.
+func DecodeHeader(r io.Reader) (*Header, error) {
+	d := newDecoder(r)
+	if err := d.readFormat(); err != nil {
+		return nil, fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+	return newHeader(d.header), nil
+}
+
+// InspectReport lists the features of a file that Decode cannot handle.
+type InspectReport struct {
+	// Decodable reports whether no unsupported feature was found, so
+	// Decode is expected to succeed on a well-formed file.
+	Decodable bool
+
+	// Unsupported describes each unsupported feature found, such as
+	// "HTJ2K (Part 15) block coding" or "2 components".
+	Unsupported []string
+}
+
+// Inspect reads the main header of a JPEG 2000 file or codestream, and
+// its JP2 header boxes, without decoding any tiles, and reports the
+// features Decode would reject with an *UnsupportedFeatureError or could
+// not decode correctly: HTJ2K block coding, Part 2 coding tools such as
+// arbitrary wavelet kernels, MCC transforms other than decorrelation, and
+// component counts with no Go image type. Tile-part headers are not read.
+// An error means the header itself could not be parsed.
+func Inspect(r io.Reader) (*InspectReport, error) {
+	d := newDecoder(r)
+	if err := d.readFormat(); err != nil {
+		return nil, fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+	features := d.unsupportedFeatures()
+	return &InspectReport{Decodable: len(features) == 0, Unsupported: features}, nil
+}
+
+// PacketCount returns the number of packets of tile tileIndex under the
+// main header's coding parameters: the number of layers times the number
+// of precincts of every resolution level of every component, which varies
+// with the level and with the tile's position on the precinct grid.
+// Tile-part COD and COC markers can change it; use
+// TileMetadata.PacketCount to account for them. PacketCount returns 0 for
+// a tile index out of range.
+func (h *Header) PacketCount(tileIndex int) int {
+	if tileIndex < 0 || tileIndex >= h.NumTilesX*h.NumTilesY {
+		return 0
+	}
+	tx, ty := tileIndex%h.NumTilesX, tileIndex/h.NumTilesX
+	bounds := image.Rect(
+		max(h.TileXOffset+tx*h.TileWidth, h.XOffset),
+		max(h.TileYOffset+ty*h.TileHeight, h.YOffset),
+		min(h.TileXOffset+(tx+1)*h.TileWidth, h.XOffset+h.Width),
+		min(h.TileYOffset+(ty+1)*h.TileHeight, h.YOffset+h.Height),
+	)
+	return packetCount(bounds, h.NumLayers, h.Components)
+}
+
+// TileMetadata describes the coding parameters of one tile: those of the
+// main header with the COD, COC, QCD and QCC overrides of its tile-part
+// headers applied.
+type TileMetadata struct {
+	// Index is the tile index, in raster order.
+	Index int
+
+	// Bounds is the area of the tile on the reference grid, clipped to
+	// the image area.
+	Bounds image.Rectangle
+
+	// NumTileParts is the number of tile-parts found for the tile.
+	NumTileParts int
+
+	// ProgressionOrder is the progression order of the tile's packets.
+	ProgressionOrder ProgressionOrder
+
+	// NumLayers is the number of quality layers.
+	NumLayers int
+
+	// MultipleComponentTransform reports whether the RCT or ICT is
+	// applied to the first three components.
+	MultipleComponentTransform bool
+
+	// Components describes each component of the tile, including its
+	// wavelet, code-block size and quantization.
+	Components []ComponentHeader
+}
+
+// PacketCount returns the number of packets of the tile, as
+// Header.PacketCount does but with the tile's own coding parameters.
+func (m *TileMetadata) PacketCount() int {
+	return packetCount(m.Bounds, m.NumLayers, m.Components)
+}
+
+// packetCount returns the number of packets of a tile covering bounds on
+// the reference grid. Each resolution level of a component is split into
+// precincts on a grid anchored at the origin, so a level has a precinct
+// for every grid cell its area touches, and none if its area is empty.
+func packetCount(bounds image.Rectangle, numLayers int, components []ComponentHeader) int {
+	n := 0
+	for _, c := range components {
+		x0, y0 := ceilDiv(bounds.Min.X, c.SubsamplingX), ceilDiv(bounds.Min.Y, c.SubsamplingY)
+		x1, y1 := ceilDiv(bounds.Max.X, c.SubsamplingX), ceilDiv(bounds.Max.Y, c.SubsamplingY)
+		for r := 0; r < c.NumResolutions; r++ {
+			scale := 1 << (c.NumResolutions - 1 - r)
+			rx0, ry0 := ceilDiv(x0, scale), ceilDiv(y0, scale)
+			rx1, ry1 := ceilDiv(x1, scale), ceilDiv(y1, scale)
+			if rx1 <= rx0 || ry1 <= ry0 {
+				continue
+			}
+			ppx, ppy := 15, 15
+			if r < len(c.PrecinctSizes) {
+				ppx = bits.Len(uint(c.PrecinctSizes[r].X)) - 1
+				ppy = bits.Len(uint(c.PrecinctSizes[r].Y)) - 1
+			}
+			n += (ceilDiv(rx1, 1<<ppx) - rx0>>ppx) * (ceilDiv(ry1, 1<<ppy) - ry0>>ppy)
+		}
+	}
+	return n * numLayers
+}
+
+// DecodeTileMetadata reads the main header and the tile-part headers of a
+// JPEG 2000 file or codestream without decoding any tiles, and returns the
+// coding parameters of every tile in index order. A tile-part COD or QCD
+// takes precedence over the main header's COC or QCC markers, and a
+// tile-part COC or QCC over both. Tiles without tile-parts have the main
+// header's parameters.
+func DecodeTileMetadata(r io.ReadSeeker) ([]TileMetadata, error) {
+	d := newDecoder(r)
+	if err := d.readFormat(); err != nil {
+		return nil, fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+
+	// Walk the tile-part headers, seeking past the tile data
+	rd := bytes.NewReader(d.codestream)
+	p := codestream.NewParser(rd)
+	h, err := p.ReadHeader()
+	if err != nil {
+		return nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+	numTiles := int(h.NumTilesX) * int(h.NumTilesY)
+	tiles := make([]*codestream.Header, numTiles)
+	parts := make([]int, numTiles)
+	for {
+		start := rd.Size() - int64(rd.Len()) - 2 // ReadHeader stops after the SOT marker
+		tph, err := p.ReadTilePartHeader()
+		if err != nil {
+			return nil, fmt.Errorf("tile-part at offset %d: %w", start, truncated(err))
+		}
+		idx := int(tph.TileIndex)
+		if idx >= numTiles {
+			return nil, fmt.Errorf("tile-part at offset %d: tile index %d out of range [0, %d)", start, idx, numTiles)
+		}
+		if tiles[idx] == nil {
+			tiles[idx] = h
+		}
+		tiles[idx] = withTilePartHeader(tiles[idx], tph)
+		parts[idx]++
+		length := int64(tph.TilePartLength)
+		p.ClearTilePartState()
+
+		// A tile-part with Psot 0 runs to the end; a truncated
+		// codestream ends the walk
+		var marker [2]byte
+		if length == 0 {
+			break
+		}
+		if _, err := rd.Seek(start+length, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(rd, marker[:]); err != nil ||
+			codestream.Marker(binary.BigEndian.Uint16(marker[:])) != codestream.SOT {
+			break
+		}
+	}
+
+	metadata := make([]TileMetadata, numTiles)
+	for i := range metadata {
+		th := tiles[i]
+		if th == nil {
+			th = h
+		}
+		hdr := newHeader(th)
+		tx, ty := i%int(h.NumTilesX), i/int(h.NumTilesX)
+		metadata[i] = TileMetadata{
+			Index: i,
+			Bounds: image.Rect(
+				max(int(h.TileXOffset)+tx*int(h.TileWidth), int(h.ImageXOffset)),
+				max(int(h.TileYOffset)+ty*int(h.TileHeight), int(h.ImageYOffset)),
+				min(int(h.TileXOffset)+(tx+1)*int(h.TileWidth), int(h.ImageWidth)),
+				min(int(h.TileYOffset)+(ty+1)*int(h.TileHeight), int(h.ImageHeight)),
+			),
+			NumTileParts:               parts[i],
+			ProgressionOrder:           hdr.ProgressionOrder,
+			NumLayers:                  hdr.NumLayers,
+			MultipleComponentTransform: hdr.MultipleComponentTransform,
+			Components:                 hdr.Components,
+		}
+	}
+	return metadata, nil
+}
+
+// withTilePartHeader returns a copy of h with the coding style and
+// quantization overrides of tph applied. A tile-part COD or QCD replaces
+// the COC or QCC markers of h as well as its COD or QCD.
+func withTilePartHeader(h *codestream.Header, tph *codestream.TilePartHeader) *codestream.Header {
+	th := *h
+	if tph.CodingStyle != nil {
+		th.CodingStyle = *tph.CodingStyle
+		th.ComponentCodingStyles = nil
+	}
+	if len(tph.ComponentCodingStyles) > 0 {
+		cocs := maps.Clone(th.ComponentCodingStyles)
+		if cocs == nil {
+			cocs = make(map[uint16]codestream.CodingStyleComponent)
+		}
+		maps.Copy(cocs, tph.ComponentCodingStyles)
+		th.ComponentCodingStyles = cocs
+	}
+	if tph.Quantization != nil {
+		th.Quantization = *tph.Quantization
+		th.ComponentQuantization = nil
+	}
+	if len(tph.ComponentQuantization) > 0 {
+		qccs := maps.Clone(th.ComponentQuantization)
+		if qccs == nil {
+			qccs = make(map[uint16]codestream.QuantizationComponent)
+		}
+		maps.Copy(qccs, tph.ComponentQuantization)
+		th.ComponentQuantization = qccs
+	}
+	return &th
+}
+
+// newHeader converts a parsed codestream header to its public form.
+func newHeader(h *codestream.Header) *Header {
+	cod := h.CodingStyle
+	hdr := &Header{
+		Profile:                    Profile(h.Profile),
+		Width:                      int(h.ImageWidth - h.ImageXOffset),
+		Height:                     int(h.ImageHeight - h.ImageYOffset),
+		XOffset:                    int(h.ImageXOffset),
+		YOffset:                    int(h.ImageYOffset),
+		TileWidth:                  int(h.TileWidth),
+		TileHeight:                 int(h.TileHeight),
+		TileXOffset:                int(h.TileXOffset),
+		TileYOffset:                int(h.TileYOffset),
+		NumTilesX:                  int(h.NumTilesX),
+		NumTilesY:                  int(h.NumTilesY),
+		ProgressionOrder:           ProgressionOrder(cod.ProgressionOrder),
+		NumLayers:                  int(cod.NumLayers),
+		MultipleComponentTransform: cod.MultipleComponentXf != 0,
+		SOP:                        cod.CodingStyle&codestream.CodingStyleSOP != 0,
+		EPH:                        cod.CodingStyle&codestream.CodingStyleEPH != 0,
+		HighThroughput:             h.Capabilities.IsHTJ2K(),
+		Components:                 make([]ComponentHeader, len(h.ComponentInfo)),
+		Comments:                   append([]string(nil), h.Comments...),
+	}
+
+	for i, info := range h.ComponentInfo {
+		c := ComponentHeader{
+			Precision:         info.Precision(),
+			Signed:            info.IsSigned(),
+			SubsamplingX:      int(info.SubsamplingX),
+			SubsamplingY:      int(info.SubsamplingY),
+			RegistrationX:     int(info.RegistrationX),
+			RegistrationY:     int(info.RegistrationY),
+			NumResolutions:    cod.NumResolutions(),
+			Reversible:        cod.IsReversible(),
+			CodeBlockWidth:    cod.CodeBlockWidth(),
+			CodeBlockHeight:   cod.CodeBlockHeight(),
+			CodeBlockStyle:    codeBlockStyleFromScb(cod.CodeBlockStyle),
+			QuantizationStyle: int(h.Quantization.Style()),
+			GuardBits:         int(h.Quantization.NumGuardBits),
+			ROIShift:          int(h.ROIShifts[uint16(i)]),
+		}
+		scod, precincts := cod.CodingStyle, cod.PrecinctSizes
+
+		if coc, ok := h.ComponentCodingStyles[uint16(i)]; ok {
+			c.NumResolutions = int(coc.NumDecompositions) + 1
+			c.Reversible = coc.WaveletTransform == 1
+			c.CodeBlockWidth = 1 << (coc.CodeBlockWidthExp + 2)
+			c.CodeBlockHeight = 1 << (coc.CodeBlockHeightExp + 2)
+			c.CodeBlockStyle = codeBlockStyleFromScb(coc.CodeBlockStyle)
+			scod, precincts = coc.CodingStyle, coc.PrecinctSizes
+		}
+		if scod&codestream.CodingStylePrecincts != 0 {
+			c.PrecinctSizes = make([]image.Point, len(precincts))
+			for r, p := range precincts {
+				c.PrecinctSizes[r] = image.Pt(p.Width(), p.Height())
+			}
+		}
+
+		if qcc, ok := h.ComponentQuantization[uint16(i)]; ok {
+			c.QuantizationStyle = int(qcc.QuantizationStyle)
+			c.GuardBits = int(qcc.NumGuardBits)
+		}
+
+		hdr.Components[i] = c
+	}
+
+	return hdr
+}
+
+// codeBlockStyleFromScb decodes the Scb flag bits; it is the inverse of
+// CodeBlockStyle.scb.
+func codeBlockStyleFromScb(b uint8) CodeBlockStyle {
+	return CodeBlockStyle{
+		Selective:              b&codestream.CodeBlockBypass != 0,
+		ResetOnBoundaries:      b&codestream.CodeBlockReset != 0,
+		TerminateOnPass:        b&codestream.CodeBlockTermination != 0,
+		Causal:                 b&codestream.CodeBlockVerticalCausal != 0,
+		PredictableTermination: b&codestream.CodeBlockPredictableTermination != 0,
+		SegmentationSymbols:    b&codestream.CodeBlockSegmentationSymbols != 0,
+	}
+}
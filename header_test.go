@@ -0,0 +1,172 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	opts := &Options{
+		Format:           FormatJP2,
+		Lossless:         true,
+		NumResolutions:   3,
+		NumLayers:        2,
+		ProgressionOrder: RPCL,
+		TileSize:         image.Pt(16, 16),
+		CodeBlockSize:    image.Pt(5, 4),
+		CodeBlockStyle:   CodeBlockStyle{Causal: true},
+		EnableSOP:        true,
+		MCT:              MCTForce,
+		Comment:          "header test",
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeHeader() error: %v", err)
+	}
+
+	if h.Width != 40 || h.Height != 30 {
+		t.Errorf("size = %dx%d, want 40x30", h.Width, h.Height)
+	}
+	if h.TileWidth != 16 || h.TileHeight != 16 || h.NumTilesX != 3 || h.NumTilesY != 2 {
+		t.Errorf("tiles %dx%d in a %dx%d grid, want 16x16 in 3x2", h.TileWidth, h.TileHeight, h.NumTilesX, h.NumTilesY)
+	}
+	if h.ProgressionOrder != RPCL || h.NumLayers != 2 {
+		t.Errorf("progression %v with %d layers, want RPCL with 2", h.ProgressionOrder, h.NumLayers)
+	}
+	if !h.SOP || h.EPH || !h.MultipleComponentTransform {
+		t.Errorf("SOP=%v EPH=%v MCT=%v, want true false true", h.SOP, h.EPH, h.MultipleComponentTransform)
+	}
+	if len(h.Comments) == 0 || h.Comments[len(h.Comments)-1] != "header test" {
+		t.Errorf("Comments = %q, want to end with %q", h.Comments, "header test")
+	}
+
+	if len(h.Components) != 3 {
+		t.Fatalf("%d components, want 3", len(h.Components))
+	}
+	for i, c := range h.Components {
+		if c.Precision != 8 || c.Signed || c.SubsamplingX != 1 || c.SubsamplingY != 1 {
+			t.Errorf("component %d: precision %d signed=%v subsampling %dx%d, want 8 unsigned 1x1",
+				i, c.Precision, c.Signed, c.SubsamplingX, c.SubsamplingY)
+		}
+		if c.NumResolutions != 3 || !c.Reversible {
+			t.Errorf("component %d: %d resolutions reversible=%v, want 3 reversible", i, c.NumResolutions, c.Reversible)
+		}
+		if c.CodeBlockWidth != 32 || c.CodeBlockHeight != 16 || c.CodeBlockStyle != (CodeBlockStyle{Causal: true}) {
+			t.Errorf("component %d: code-blocks %dx%d style %+v, want 32x16 causal",
+				i, c.CodeBlockWidth, c.CodeBlockHeight, c.CodeBlockStyle)
+		}
+		if c.QuantizationStyle != 0 {
+			t.Errorf("component %d: quantization style %d, want 0", i, c.QuantizationStyle)
+		}
+	}
+
+	if _, err := DecodeHeader(bytes.NewReader([]byte("not a jpeg 2000 file"))); err == nil {
+		t.Error("DecodeHeader() on garbage succeeded, want error")
+	}
+}
+
+func TestHeaderPacketCount(t *testing.T) {
+	for _, opts := range []*Options{
+		{Format: FormatJ2K, Lossless: true, NumResolutions: 3, NumLayers: 2, TileSize: image.Pt(16, 16)},
+		{
+			Format: FormatJ2K, Lossless: true, NumResolutions: 3, NumLayers: 3, TileSize: image.Pt(32, 16),
+			PrecinctSize: []image.Point{{2, 2}, {3, 2}, {3, 3}},
+		},
+		{Format: FormatJ2K, Quality: 50, NumResolutions: 4, PrecinctSize: []image.Point{{4, 4}, {4, 4}, {4, 4}, {4, 4}}},
+	} {
+		opts.EnableSOP = true
+		var buf bytes.Buffer
+		if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)), opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		data := buf.Bytes()
+
+		h, err := DecodeHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("DecodeHeader() error: %v", err)
+		}
+		tiles, err := DecodeTileMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("DecodeTileMetadata() error: %v", err)
+		}
+		want := bytes.Count(data, []byte{0xFF, 0x91, 0x00, 0x04})
+		got := 0
+		for i := range tiles {
+			n := h.PacketCount(i)
+			if tn := tiles[i].PacketCount(); tn != n {
+				t.Errorf("tile %d: TileMetadata.PacketCount() = %d, Header.PacketCount() = %d", i, tn, n)
+			}
+			got += n
+		}
+		if got != want {
+			t.Errorf("PacketCount() sums to %d over %d tiles, want %d SOP markers", got, len(tiles), want)
+		}
+		if n := h.PacketCount(len(tiles)); n != 0 {
+			t.Errorf("PacketCount(%d) = %d, want 0", len(tiles), n)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	encode := func(opts *Options) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 24, 16)), opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Bytes()
+	}
+	plain := encode(&Options{Format: FormatJ2K, Lossless: true})
+
+	// Insert an ATK marker segment after SIZ
+	sizEnd := 4 + int(binary.BigEndian.Uint16(plain[4:]))
+	atk := append(append(append([]byte{}, plain[:sizEnd]...), 0xFF, 0x79, 0x00, 0x04, 0x00, 0x00), plain[sizEnd:]...)
+
+	// Select wavelet transform 2, a Part 2 arbitrary kernel, in COD
+	wavelet := append([]byte{}, plain...)
+	cod := bytes.Index(wavelet, []byte{0xFF, 0x52})
+	wavelet[cod+13] = 2
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"plain", plain, ""},
+		{"JP2", encode(&Options{Format: FormatJP2, Quality: 50}), ""},
+		{"HTJ2K", encode(&Options{Format: FormatJ2K, Lossless: true, HighThroughput: true}), "HTJ2K"},
+		{"ATK", atk, "ATK marker"},
+		{"wavelet", wavelet, "wavelet transform 2"},
+	}
+	for _, tt := range tests {
+		report, err := Inspect(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: Inspect() error: %v", tt.name, err)
+		}
+		if tt.want == "" {
+			if !report.Decodable || len(report.Unsupported) != 0 {
+				t.Errorf("%s: report = %+v, want decodable", tt.name, report)
+			}
+			if _, err := Decode(bytes.NewReader(tt.data)); err != nil {
+				t.Errorf("%s: Decode() error: %v", tt.name, err)
+			}
+			continue
+		}
+		if report.Decodable || len(report.Unsupported) != 1 || !strings.Contains(report.Unsupported[0], tt.want) {
+			t.Errorf("%s: report = %+v, want one reason mentioning %q", tt.name, report, tt.want)
+		}
+	}
+
+	if _, err := Inspect(bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Inspect(garbage) error = %v, want ErrInvalidSignature", err)
+	}
+}
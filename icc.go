@@ -0,0 +1,153 @@
+package jpeg2000
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// ParsedICCProfile holds the commonly needed fields of an ICC profile.
+//
+// Chromaticities are CIE 1931 xy coordinates computed from the profile's
+// XYZ tags; they are zero when the corresponding tag is absent.
+type ParsedICCProfile struct {
+	// ColorSpace is the data colour space signature, e.g. "RGB" or "GRAY".
+	ColorSpace string
+
+	// Description is the profile description ('desc' tag).
+	Description string
+
+	// CopyrightNotice is the copyright text ('cprt' tag).
+	CopyrightNotice string
+
+	// RenderingIntent is the header rendering intent, e.g. "Perceptual".
+	RenderingIntent string
+
+	// WhitePoint is the media white point ('wtpt' tag), falling back to
+	// the header illuminant.
+	WhitePoint [2]float64
+
+	// RedPrimary, GreenPrimary and BluePrimary are the colorant
+	// chromaticities ('rXYZ', 'gXYZ' and 'bXYZ' tags).
+	RedPrimary, GreenPrimary, BluePrimary [2]float64
+}
+
+// iccHeaderSize is the fixed size of the ICC profile header.
+const iccHeaderSize = 128
+
+// iccRenderingIntents maps header rendering intent values to names.
+var iccRenderingIntents = [...]string{
+	"Perceptual",
+	"Media-Relative Colorimetric",
+	"Saturation",
+	"ICC-Absolute Colorimetric",
+}
+
+// parseICCProfile reads the header and tag table of an ICC profile.
+func parseICCProfile(data []byte) (*ParsedICCProfile, error) {
+	if len(data) < iccHeaderSize+4 {
+		return nil, fmt.Errorf("ICC profile too short: %d bytes", len(data))
+	}
+	if string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid ICC profile signature")
+	}
+
+	p := &ParsedICCProfile{
+		ColorSpace: strings.TrimRight(string(data[16:20]), " \x00"),
+	}
+	intent := binary.BigEndian.Uint32(data[64:68])
+	if intent < uint32(len(iccRenderingIntents)) {
+		p.RenderingIntent = iccRenderingIntents[intent]
+	} else {
+		p.RenderingIntent = fmt.Sprintf("Unknown (%d)", intent)
+	}
+	p.WhitePoint = iccXYZToXY(data[68:80])
+
+	numTags := binary.BigEndian.Uint32(data[iccHeaderSize:])
+	if uint64(numTags)*12 > uint64(len(data)-iccHeaderSize-4) {
+		return nil, fmt.Errorf("ICC tag count %d exceeds profile size", numTags)
+	}
+	for i := 0; i < int(numTags); i++ {
+		entry := data[iccHeaderSize+4+i*12:]
+		offset := uint64(binary.BigEndian.Uint32(entry[4:8]))
+		size := uint64(binary.BigEndian.Uint32(entry[8:12]))
+		if offset+size > uint64(len(data)) || size < 8 {
+			continue
+		}
+		tag := data[offset : offset+size]
+
+		switch string(entry[0:4]) {
+		case "desc":
+			p.Description = iccText(tag)
+		case "cprt":
+			p.CopyrightNotice = iccText(tag)
+		case "wtpt":
+			if xy, ok := iccXYZTag(tag); ok {
+				p.WhitePoint = xy
+			}
+		case "rXYZ":
+			p.RedPrimary, _ = iccXYZTag(tag)
+		case "gXYZ":
+			p.GreenPrimary, _ = iccXYZTag(tag)
+		case "bXYZ":
+			p.BluePrimary, _ = iccXYZTag(tag)
+		}
+	}
+
+	return p, nil
+}
+
+// iccXYZTag decodes an XYZType tag to xy chromaticity.
+func iccXYZTag(tag []byte) ([2]float64, bool) {
+	if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+		return [2]float64{}, false
+	}
+	return iccXYZToXY(tag[8:20]), true
+}
+
+// iccXYZToXY converts an XYZNumber (three s15Fixed16 values) to xy.
+func iccXYZToXY(b []byte) [2]float64 {
+	x := float64(int32(binary.BigEndian.Uint32(b[0:4]))) / 65536
+	y := float64(int32(binary.BigEndian.Uint32(b[4:8]))) / 65536
+	z := float64(int32(binary.BigEndian.Uint32(b[8:12]))) / 65536
+	sum := x + y + z
+	if sum == 0 {
+		return [2]float64{}
+	}
+	return [2]float64{x / sum, y / sum}
+}
+
+// iccText decodes textType, textDescriptionType (v2) and
+// multiLocalizedUnicodeType (v4) tags. For mluc tags the first record
+// is returned.
+func iccText(tag []byte) string {
+	switch string(tag[0:4]) {
+	case "text":
+		return strings.TrimRight(string(tag[8:]), "\x00")
+	case "desc":
+		if len(tag) < 12 {
+			return ""
+		}
+		n := uint64(binary.BigEndian.Uint32(tag[8:12]))
+		if 12+n > uint64(len(tag)) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:12]) == 0 {
+			return ""
+		}
+		n := uint64(binary.BigEndian.Uint32(tag[20:24]))
+		off := uint64(binary.BigEndian.Uint32(tag[24:28]))
+		if off+n > uint64(len(tag)) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[off+uint64(i)*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
@@ -0,0 +1,226 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/box"
+)
+
+func TestParseICCProfile_SRGB(t *testing.T) {
+	data, err := os.ReadFile("testdata/sRGB.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := parseICCProfile(data)
+	if err != nil {
+		t.Fatalf("parseICCProfile() error: %v", err)
+	}
+
+	if p.ColorSpace != "RGB" {
+		t.Errorf("ColorSpace = %q, want RGB", p.ColorSpace)
+	}
+	if p.Description != "sRGB IEC61966-2.1" {
+		t.Errorf("Description = %q", p.Description)
+	}
+	if p.CopyrightNotice != "No copyright, use freely" {
+		t.Errorf("CopyrightNotice = %q", p.CopyrightNotice)
+	}
+	if p.RenderingIntent != "Perceptual" {
+		t.Errorf("RenderingIntent = %q, want Perceptual", p.RenderingIntent)
+	}
+
+	// D65 white and the D50-adapted sRGB colorants
+	tests := []struct {
+		name string
+		got  [2]float64
+		want [2]float64
+	}{
+		{"WhitePoint", p.WhitePoint, [2]float64{0.3127, 0.3290}},
+		{"RedPrimary", p.RedPrimary, [2]float64{0.6484, 0.3309}},
+		{"GreenPrimary", p.GreenPrimary, [2]float64{0.3212, 0.5979}},
+		{"BluePrimary", p.BluePrimary, [2]float64{0.1559, 0.0660}},
+	}
+	for _, tt := range tests {
+		if math.Abs(tt.got[0]-tt.want[0]) > 1e-3 || math.Abs(tt.got[1]-tt.want[1]) > 1e-3 {
+			t.Errorf("%s = %.4f, want %.4f", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestParseICCProfile_Invalid(t *testing.T) {
+	data, err := os.ReadFile("testdata/sRGB.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseICCProfile(data[:64]); err == nil {
+		t.Error("expected error for truncated profile")
+	}
+
+	bad := append([]byte(nil), data...)
+	copy(bad[36:40], "xxxx")
+	if _, err := parseICCProfile(bad); err == nil {
+		t.Error("expected error for missing acsp signature")
+	}
+
+	bad = append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(bad[iccHeaderSize:], 0xFFFFFFFF)
+	if _, err := parseICCProfile(bad); err == nil {
+		t.Error("expected error for oversized tag count")
+	}
+}
+
+func TestICCText_MultiLocalizedUnicode(t *testing.T) {
+	tag := []byte("mluc\x00\x00\x00\x00")
+	tag = binary.BigEndian.AppendUint32(tag, 1)  // Record count
+	tag = binary.BigEndian.AppendUint32(tag, 12) // Record size
+	tag = append(tag, "enUS"...)
+	tag = binary.BigEndian.AppendUint32(tag, 8)  // Length in bytes
+	tag = binary.BigEndian.AppendUint32(tag, 28) // Offset
+	for _, r := range "sRGB" {
+		tag = binary.BigEndian.AppendUint16(tag, uint16(r))
+	}
+
+	if got := iccText(tag); got != "sRGB" {
+		t.Errorf("iccText(mluc) = %q, want sRGB", got)
+	}
+}
+
+// jp2WithICC returns a 16x16 RGB JP2 file whose colr box carries icc with
+// the given method.
+func jp2WithICC(t *testing.T, icc []byte, method uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	var cs bytes.Buffer
+	if err := Encode(&cs, img, &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// Wrap the codestream in a JP2 file whose colr box carries the profile
+	ihdr := &box.ImageHeaderBox{Width: 16, Height: 16, NumComponents: 3, BitsPerComponent: 7, CompressionType: 7}
+	colr := &box.ColorSpecBox{Method: method, ICCProfile: icc}
+	jp2h := append(
+		(&box.Box{Type: box.TypeImageHeader, Length: 8 + 14, Contents: ihdr.Bytes()}).Bytes(),
+		(&box.Box{Type: box.TypeColorSpec, Length: uint64(8 + 3 + len(icc)), Contents: colr.Bytes()}).Bytes()...)
+
+	var file bytes.Buffer
+	w := box.NewWriter(&file)
+	if err := w.WriteSignature(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*box.Box{
+		box.CreateFileTypeBox(),
+		{Type: box.TypeJP2Header, Length: uint64(8 + len(jp2h)), Contents: jp2h},
+		box.CreateCodestreamBox(cs.Bytes()),
+	} {
+		if err := w.WriteBox(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return file.Bytes()
+}
+
+func TestDecodeMetadata_ParsedICC(t *testing.T) {
+	icc, err := os.ReadFile("testdata/sRGB.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := jp2WithICC(t, icc, box.ColorMethodRestrictedICC)
+	m, err := DecodeMetadata(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if len(m.ICCProfile) != len(icc) {
+		t.Fatalf("ICCProfile length = %d, want %d", len(m.ICCProfile), len(icc))
+	}
+	if m.ParsedICC == nil {
+		t.Fatal("ParsedICC is nil")
+	}
+	if m.ParsedICC.Description != "sRGB IEC61966-2.1" || m.ParsedICC.ColorSpace != "RGB" {
+		t.Errorf("ParsedICC = %+v", m.ParsedICC)
+	}
+}
+
+func TestDecodeWithProfile(t *testing.T) {
+	icc, err := os.ReadFile("testdata/sRGB.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, profile, err := DecodeWithProfile(bytes.NewReader(jp2WithICC(t, icc, box.ColorMethodRestrictedICC)))
+	if err != nil {
+		t.Fatalf("DecodeWithProfile() error: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 16, 16) {
+		t.Errorf("Bounds() = %v, want 16x16", img.Bounds())
+	}
+	if !bytes.Equal(profile, icc) {
+		t.Errorf("profile is %d bytes, want the %d-byte embedded profile", len(profile), len(icc))
+	}
+
+	// Enumerated colour spaces and raw codestreams have no profile
+	for _, f := range []Format{FormatJP2, FormatJ2K} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), &Options{Format: f, Lossless: true}); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		_, profile, err := DecodeWithProfile(&buf)
+		if err != nil {
+			t.Fatalf("DecodeWithProfile(%s) error: %v", f, err)
+		}
+		if profile != nil {
+			t.Errorf("DecodeWithProfile(%s) profile = %d bytes, want nil", f, len(profile))
+		}
+	}
+}
+
+func TestDecodeMetadata_ColorSpaceMethod(t *testing.T) {
+	icc, err := os.ReadFile("testdata/sRGB.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []uint8{box.ColorMethodRestrictedICC, box.ColorMethodICC} {
+		m, err := DecodeMetadata(bytes.NewReader(jp2WithICC(t, icc, method)))
+		if err != nil {
+			t.Fatalf("DecodeMetadata() error: %v", err)
+		}
+		if m.ColorSpaceMethod != int(method) || m.ColorSpace != ColorSpaceUnspecified {
+			t.Errorf("method %d: ColorSpaceMethod = %d, ColorSpace = %v; want %d, unspecified",
+				method, m.ColorSpaceMethod, m.ColorSpace, method)
+		}
+		if !bytes.Equal(m.ICCProfile, icc) {
+			t.Errorf("method %d: ICCProfile is %d bytes, want %d", method, len(m.ICCProfile), len(icc))
+		}
+	}
+
+	for _, tt := range []struct {
+		format Format
+		method int
+		cs     ColorSpace
+	}{
+		{FormatJP2, 1, ColorSpaceSRGB},
+		{FormatJ2K, 0, ColorSpaceUnspecified},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), &Options{Format: tt.format, Lossless: true}); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		m, err := DecodeMetadata(&buf)
+		if err != nil {
+			t.Fatalf("DecodeMetadata() error: %v", err)
+		}
+		if m.ColorSpaceMethod != tt.method || m.ColorSpace != tt.cs || m.ICCProfile != nil {
+			t.Errorf("%s: ColorSpaceMethod = %d, ColorSpace = %v, %d-byte profile; want %d, %v, none",
+				tt.format, m.ColorSpaceMethod, m.ColorSpace, len(m.ICCProfile), tt.method, tt.cs)
+		}
+	}
+}
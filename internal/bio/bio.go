@@ -207,7 +207,8 @@ func (w *ByteStuffingWriter) flushByte() error {
 	return err
 }
 
-// Flush writes any remaining bits with padding.
+// Flush writes any remaining bits with padding. If the last byte written
+// is 0xFF, a zero byte follows it so that the output never ends in 0xFF.
 func (w *ByteStuffingWriter) Flush() error {
 	if w.cnt > 0 {
 		maxBits := uint8(8)
@@ -215,6 +216,11 @@ func (w *ByteStuffingWriter) Flush() error {
 			maxBits = 7
 		}
 		w.buf <<= (maxBits - w.cnt)
+		if err := w.flushByte(); err != nil {
+			return err
+		}
+	}
+	if w.delay {
 		return w.flushByte()
 	}
 	return nil
@@ -0,0 +1,168 @@
+package bio
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Throughput benchmarks. Each reports bits/ns so results are comparable
+// across read/write widths.
+
+// benchBytes is the size of the stream processed per iteration.
+const benchBytes = 1 << 20
+
+// benchData returns benchBytes of random data in which about 1% of the
+// bytes are 0xFF, so byte-stuffing paths are exercised.
+func benchData() []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, benchBytes)
+	rng.Read(data)
+	for i := range data {
+		switch {
+		case rng.Intn(100) == 0:
+			data[i] = 0xFF
+		case data[i] == 0xFF:
+			data[i] = 0xFE
+		}
+	}
+	return data
+}
+
+// reportBitsPerNs records the bit throughput of the benchmark.
+func reportBitsPerNs(b *testing.B, bitsPerOp int) {
+	b.ReportMetric(float64(bitsPerOp)*float64(b.N)/float64(b.Elapsed().Nanoseconds()), "bits/ns")
+}
+
+func benchmarkReadBits(b *testing.B, n uint) {
+	data := benchData()
+	src := bytes.NewReader(data)
+	reads := len(data) * 8 / int(n)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(data)
+		r := NewReader(src)
+		for j := 0; j < reads; j++ {
+			if _, err := r.ReadBits(n); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	reportBitsPerNs(b, reads*int(n))
+}
+
+func BenchmarkReadBit(b *testing.B) {
+	data := benchData()
+	src := bytes.NewReader(data)
+	bits := len(data) * 8
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(data)
+		r := NewReader(src)
+		for j := 0; j < bits; j++ {
+			if _, err := r.ReadBit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	reportBitsPerNs(b, bits)
+}
+
+func BenchmarkReadBits8(b *testing.B)  { benchmarkReadBits(b, 8) }
+func BenchmarkReadBits32(b *testing.B) { benchmarkReadBits(b, 32) }
+
+func benchmarkWriteBits(b *testing.B, n uint) {
+	data := benchData()
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	writes := len(data) * 8 / int(n)
+	mask := uint32(1<<n - 1)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := NewWriter(&buf)
+		for j := 0; j < writes; j++ {
+			if err := w.WriteBits(uint32(j)&mask, n); err != nil {
+				b.Fatal(err)
+			}
+		}
+		w.Flush()
+	}
+	reportBitsPerNs(b, writes*int(n))
+}
+
+func BenchmarkWriteBit(b *testing.B) {
+	data := benchData()
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	bits := len(data) * 8
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := NewWriter(&buf)
+		for j := 0; j < bits; j++ {
+			if err := w.WriteBit(int(data[j>>3]>>(7-j&7)) & 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+		w.Flush()
+	}
+	reportBitsPerNs(b, bits)
+}
+
+func BenchmarkWriteBits8(b *testing.B)  { benchmarkWriteBits(b, 8) }
+func BenchmarkWriteBits32(b *testing.B) { benchmarkWriteBits(b, 32) }
+
+func BenchmarkByteStuffingReaderThroughput(b *testing.B) {
+	data := benchData()
+	src := bytes.NewReader(data)
+
+	// Bytes following 0xFF carry only 7 bits
+	bits := 0
+	for i := range data {
+		if i > 0 && data[i-1] == 0xFF {
+			bits += 7
+		} else {
+			bits += 8
+		}
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(data)
+		r := NewByteStuffingReader(src)
+		for j := 0; j < bits/8; j++ {
+			if _, err := r.ReadBits(8); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	reportBitsPerNs(b, bits/8*8)
+}
+
+func BenchmarkByteStuffingWriterThroughput(b *testing.B) {
+	data := benchData()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := NewByteStuffingWriter(io.Discard)
+		for _, v := range data {
+			if err := w.WriteBits(uint32(v), 8); err != nil {
+				b.Fatal(err)
+			}
+		}
+		w.Flush()
+	}
+	reportBitsPerNs(b, len(data)*8)
+}
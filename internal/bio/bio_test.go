@@ -1021,6 +1021,24 @@ func TestByteStuffingWriter_Flush_AfterFF(t *testing.T) {
 	}
 }
 
+func TestByteStuffingWriter_Flush_EndsInFF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewByteStuffingWriter(buf)
+
+	if err := w.WriteBits(0xFF, 8); err != nil {
+		t.Fatalf("WriteBits() returned error: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() returned error: %v", err)
+	}
+
+	// The stuffed zero bit after 0xFF must still be emitted
+	expected := []byte{0xFF, 0x00}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Output = %v, want %v", buf.Bytes(), expected)
+	}
+}
+
 func TestByteStuffingWriter_Flush_Error(t *testing.T) {
 	testErr := errors.New("write error")
 	w := NewByteStuffingWriter(&errWriter{n: 0, err: testErr})
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
 // Box type codes
@@ -19,6 +20,7 @@ const (
 	// Signature and file type
 	TypeJP2Signature  Type = 0x6A502020 // "jP  " - JP2 signature box
 	TypeFileType      Type = 0x66747970 // "ftyp" - File type box
+	TypeReaderReq     Type = 0x72726571 // "rreq" - Reader requirements box (JPX)
 
 	// JP2 header
 	TypeJP2Header     Type = 0x6A703268 // "jp2h" - JP2 header super-box
@@ -48,6 +50,13 @@ const (
 	TypeIPR           Type = 0x6A703269 // "jp2i" - IPR box
 )
 
+// File type brands and compatibility codes
+const (
+	BrandJP2         Type = 0x6A703220 // "jp2 " - JP2 (Part 1)
+	BrandJPX         Type = 0x6A707820 // "jpx " - JPX (Part 2)
+	BrandJPXBaseline Type = 0x6A707862 // "jpxb" - Baseline JPX
+)
+
 // Type represents a 4-byte box type code.
 type Type uint32
 
@@ -94,6 +103,9 @@ func (b *Box) Bytes() []byte {
 type Reader struct {
 	r      io.Reader
 	offset int64
+
+	// headerLen is the length of the last header read, 8 or 16.
+	headerLen int
 }
 
 // NewReader creates a new box reader.
@@ -101,57 +113,120 @@ func NewReader(r io.Reader) *Reader {
 	return &Reader{r: r}
 }
 
+// maxContents bounds the contents ReadBox will buffer.
+const maxContents = 1 << 30 // 1GB limit
+
 // ReadBox reads the next box from the stream.
 func (r *Reader) ReadBox() (*Box, error) {
-	// Read box length and type
+	boxType, contentLen, err := r.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	headerLen := uint64(r.headerLen)
+
+	if contentLen < 0 {
+		return r.readToEOF(boxType, headerLen)
+	}
+	if contentLen > maxContents {
+		return nil, fmt.Errorf("box too large: %d bytes", contentLen)
+	}
+
+	contents, err := r.ReadContents(contentLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{
+		Type:     boxType,
+		Length:   headerLen + uint64(contentLen),
+		Contents: contents,
+	}, nil
+}
+
+// ReadHeader reads the next box header, including the 8-byte XLBox
+// extended length when the length field is 1, and returns the box type
+// and the length of its contents. contentLen is -1 for a box whose length
+// field is 0, which extends to the end of the stream. It returns io.EOF
+// when the stream ends before a new box.
+//
+// The caller must consume the contents with ReadContents or Skip before
+// reading the next box.
+func (r *Reader) ReadHeader() (boxType Type, contentLen int64, err error) {
 	header := make([]byte, 8)
 	n, err := io.ReadFull(r.r, header)
 	if err != nil {
 		if err == io.EOF && n == 0 {
-			return nil, io.EOF
+			return 0, 0, io.EOF
 		}
-		return nil, fmt.Errorf("reading box header: %w", err)
+		return 0, 0, fmt.Errorf("reading box header: %w", err)
 	}
 	r.offset += 8
 
 	length := uint64(binary.BigEndian.Uint32(header[0:4]))
-	boxType := Type(binary.BigEndian.Uint32(header[4:8]))
-
-	headerLen := uint64(8)
-
-	// Handle extended length
-	if length == 1 {
-		extLen := make([]byte, 8)
-		if _, err := io.ReadFull(r.r, extLen); err != nil {
-			return nil, fmt.Errorf("reading extended length: %w", err)
+	boxType = Type(binary.BigEndian.Uint32(header[4:8]))
+	r.headerLen = 8
+
+	switch length {
+	case 0:
+		// Box extends to end of file, which is permitted for the last
+		// box; it is read until the stream is exhausted.
+		return boxType, -1, nil
+	case 1:
+		// Extended length
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return 0, 0, fmt.Errorf("reading extended length: %w", err)
 		}
-		length = binary.BigEndian.Uint64(extLen)
-		headerLen = 16
+		length = binary.BigEndian.Uint64(header)
+		r.headerLen = 16
 		r.offset += 8
-	} else if length == 0 {
-		// Box extends to end of file - we can't handle this without seeking
-		return nil, errors.New("box extends to EOF not supported")
 	}
 
-	if length < headerLen {
-		return nil, fmt.Errorf("invalid box length: %d", length)
+	if length < uint64(r.headerLen) || length-uint64(r.headerLen) > math.MaxInt64 {
+		return 0, 0, fmt.Errorf("invalid box length: %d", length)
 	}
+	return boxType, int64(length - uint64(r.headerLen)), nil
+}
 
-	// Read contents
-	contentLen := length - headerLen
-	if contentLen > 1<<30 { // 1GB limit
-		return nil, fmt.Errorf("box too large: %d bytes", contentLen)
+// ReadContents reads n bytes of box contents. The buffer grows as data
+// arrives, so a corrupt length does not cause a large allocation up front.
+func (r *Reader) ReadContents(n int64) ([]byte, error) {
+	contents, err := io.ReadAll(io.LimitReader(r.r, n))
+	r.offset += int64(len(contents))
+	if err != nil {
+		return nil, fmt.Errorf("reading box contents: %w", err)
+	}
+	if int64(len(contents)) < n {
+		return nil, fmt.Errorf("reading box contents: %w", io.ErrUnexpectedEOF)
 	}
+	return contents, nil
+}
 
-	contents := make([]byte, contentLen)
-	if _, err := io.ReadFull(r.r, contents); err != nil {
+// Skip discards n bytes of box contents without buffering them.
+func (r *Reader) Skip(n int64) error {
+	skipped, err := io.CopyN(io.Discard, r.r, n)
+	r.offset += skipped
+	if err != nil {
+		return fmt.Errorf("skipping box contents: %w", err)
+	}
+	return nil
+}
+
+// readToEOF reads the contents of a box whose length field is 0, meaning
+// the box extends to the end of the stream. The returned box's Length is
+// the header length plus the number of content bytes read.
+func (r *Reader) readToEOF(boxType Type, headerLen uint64) (*Box, error) {
+	contents, err := io.ReadAll(io.LimitReader(r.r, maxContents+1))
+	if err != nil {
 		return nil, fmt.Errorf("reading box contents: %w", err)
 	}
-	r.offset += int64(contentLen)
+	if len(contents) > maxContents {
+		return nil, fmt.Errorf("box too large: more than %d bytes", maxContents)
+	}
+	r.offset += int64(len(contents))
 
 	return &Box{
 		Type:     boxType,
-		Length:   length,
+		Length:   headerLen + uint64(len(contents)),
 		Contents: contents,
 	}, nil
 }
@@ -251,6 +326,18 @@ func (b *BitsPerCompBox) Parse(data []byte) error {
 	return nil
 }
 
+// Bytes returns the bits per component box contents.
+func (b *BitsPerCompBox) Bytes() []byte {
+	return append([]byte(nil), b.BitsPerComponent...)
+}
+
+// Colour specification methods (METH field of the colr box).
+const (
+	ColorMethodEnumerated    uint8 = 1
+	ColorMethodRestrictedICC uint8 = 2
+	ColorMethodICC           uint8 = 3
+)
+
 // ColorSpecBox represents color specification.
 type ColorSpecBox struct {
 	Method             uint8
@@ -293,14 +380,12 @@ func (b *ColorSpecBox) Parse(data []byte) error {
 	b.Approximation = data[2]
 
 	switch b.Method {
-	case 1: // Enumerated colorspace
+	case ColorMethodEnumerated:
 		if len(data) < 7 {
 			return errors.New("color specification box too short for enumerated CS")
 		}
 		b.EnumeratedColorspace = binary.BigEndian.Uint32(data[3:7])
-	case 2: // Restricted ICC profile
-		b.ICCProfile = data[3:]
-	case 3: // Any ICC method (full profile)
+	case ColorMethodRestrictedICC, ColorMethodICC:
 		b.ICCProfile = data[3:]
 	}
 	return nil
@@ -332,11 +417,107 @@ type PaletteBox struct {
 	Entries      [][]uint32
 }
 
+// MaxPaletteEntries is the largest number of entries a pclr box may hold.
+const MaxPaletteEntries = 1024
+
+// Parse parses the palette box. Entries is indexed by entry, then column.
+func (b *PaletteBox) Parse(data []byte) error {
+	if len(data) < 3 {
+		return errors.New("palette box too short")
+	}
+	b.NumEntries = binary.BigEndian.Uint16(data[0:2])
+	b.NumColumns = data[2]
+	if b.NumEntries == 0 || b.NumEntries > MaxPaletteEntries {
+		return fmt.Errorf("invalid palette entry count: %d", b.NumEntries)
+	}
+	if b.NumColumns == 0 {
+		return errors.New("palette has no columns")
+	}
+	data = data[3:]
+	if len(data) < int(b.NumColumns) {
+		return errors.New("palette box too short for bit depths")
+	}
+	b.BitsPerEntry = append([]uint8(nil), data[:b.NumColumns]...)
+	data = data[b.NumColumns:]
+
+	entrySize := 0
+	for _, bits := range b.BitsPerEntry {
+		if int(bits&0x7F)+1 > 32 {
+			return fmt.Errorf("invalid palette bit depth: %d", int(bits&0x7F)+1)
+		}
+		entrySize += b.columnBytes(bits)
+	}
+	if len(data) < int(b.NumEntries)*entrySize {
+		return errors.New("palette box too short for entries")
+	}
+
+	b.Entries = make([][]uint32, b.NumEntries)
+	for j := range b.Entries {
+		b.Entries[j] = make([]uint32, b.NumColumns)
+		for i, bits := range b.BitsPerEntry {
+			n := b.columnBytes(bits)
+			var v uint32
+			for _, c := range data[:n] {
+				v = v<<8 | uint32(c)
+			}
+			b.Entries[j][i] = v
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// Bytes returns the box contents.
+func (b *PaletteBox) Bytes() []byte {
+	data := []byte{byte(b.NumEntries >> 8), byte(b.NumEntries), b.NumColumns}
+	data = append(data, b.BitsPerEntry...)
+	for _, entry := range b.Entries {
+		for i, bits := range b.BitsPerEntry {
+			for k := b.columnBytes(bits) - 1; k >= 0; k-- {
+				data = append(data, byte(entry[i]>>(8*k)))
+			}
+		}
+	}
+	return data
+}
+
+// columnBytes returns the number of bytes used to store one entry of a
+// column with the given Bi value.
+func (b *PaletteBox) columnBytes(bits uint8) int {
+	return (int(bits&0x7F) + 8) / 8
+}
+
 // ComponentMapBox represents component mapping.
 type ComponentMapBox struct {
 	Mappings []ComponentMapping
 }
 
+// Parse parses the component mapping box.
+func (b *ComponentMapBox) Parse(data []byte) error {
+	if len(data)%4 != 0 {
+		return fmt.Errorf("component mapping box length %d is not a multiple of 4", len(data))
+	}
+	b.Mappings = make([]ComponentMapping, len(data)/4)
+	for i := range b.Mappings {
+		m := data[4*i:]
+		b.Mappings[i] = ComponentMapping{
+			Component:     binary.BigEndian.Uint16(m),
+			MappingType:   m[2],
+			PaletteColumn: m[3],
+		}
+	}
+	return nil
+}
+
+// Bytes returns the box contents.
+func (b *ComponentMapBox) Bytes() []byte {
+	data := make([]byte, 0, 4*len(b.Mappings))
+	for _, m := range b.Mappings {
+		data = append(data, byte(m.Component>>8), byte(m.Component), m.MappingType, m.PaletteColumn)
+	}
+	return data
+}
+
 // ComponentMapping maps a channel to a component.
 type ComponentMapping struct {
 	Component uint16
@@ -356,6 +537,51 @@ type ChannelDefinition struct {
 	Association uint16 // Component association
 }
 
+// Channel types and associations of a ChannelDefinition.
+const (
+	ChannelColor                = 0
+	ChannelOpacity              = 1
+	ChannelPremultipliedOpacity = 2
+	ChannelUnspecified          = 0xFFFF
+
+	// AssociationImage associates a channel with the whole image;
+	// colour channels are associated with colour 1, 2, ... of the
+	// colour space.
+	AssociationImage = 0
+)
+
+// Parse parses the channel definition box.
+func (b *ChannelDefBox) Parse(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("channel definition box too short: %d bytes", len(data))
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) != 2+6*n {
+		return fmt.Errorf("channel definition box of %d bytes for %d channels", len(data), n)
+	}
+	b.Definitions = make([]ChannelDefinition, n)
+	for i := range b.Definitions {
+		d := data[2+6*i:]
+		b.Definitions[i] = ChannelDefinition{
+			Channel:     binary.BigEndian.Uint16(d),
+			Type:        binary.BigEndian.Uint16(d[2:]),
+			Association: binary.BigEndian.Uint16(d[4:]),
+		}
+	}
+	return nil
+}
+
+// Bytes returns the box contents.
+func (b *ChannelDefBox) Bytes() []byte {
+	data := binary.BigEndian.AppendUint16(make([]byte, 0, 2+6*len(b.Definitions)), uint16(len(b.Definitions)))
+	for _, d := range b.Definitions {
+		data = binary.BigEndian.AppendUint16(data, d.Channel)
+		data = binary.BigEndian.AppendUint16(data, d.Type)
+		data = binary.BigEndian.AppendUint16(data, d.Association)
+	}
+	return data
+}
+
 // ResolutionBox contains resolution information.
 type ResolutionBox struct {
 	CaptureResX    uint32
@@ -364,6 +590,119 @@ type ResolutionBox struct {
 	DisplayResY    uint32
 }
 
+// Standard features of a ReaderRequirementsBox (ISO/IEC 15444-2
+// Table M.14).
+const (
+	FeaturePart1Codestream      uint16 = 5  // Codestream fully compliant with Part 1
+	FeatureContiguousCodestream uint16 = 12 // Codestream contiguous
+)
+
+// ReaderRequirementsBox represents the rreq box of a JPX file, which
+// lists the features a reader needs. Each feature has a mask with one or
+// more bits set; a reader that supports every feature whose mask bits
+// cover FullyUnderstand can fully read the file, and one that covers
+// DisplayContents can display it.
+type ReaderRequirementsBox struct {
+	// MaskLength is the size of the masks in bytes: 1, 2, 4 or 8.
+	MaskLength uint8
+
+	FullyUnderstand  uint64
+	DisplayContents  uint64
+	StandardFeatures []ReaderFeature
+	VendorFeatures   []VendorFeature
+}
+
+// ReaderFeature is a standard feature of a ReaderRequirementsBox.
+type ReaderFeature struct {
+	Feature uint16
+	Mask    uint64
+}
+
+// VendorFeature is a vendor feature of a ReaderRequirementsBox, named by
+// a UUID.
+type VendorFeature struct {
+	UUID [16]byte
+	Mask uint64
+}
+
+// Parse parses the reader requirements box.
+func (b *ReaderRequirementsBox) Parse(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("reader requirements box too short")
+	}
+	b.MaskLength = data[0]
+	ml := int(b.MaskLength)
+	switch ml {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("reader requirements mask length %d", ml)
+	}
+	mask := func(p []byte) uint64 {
+		var m uint64
+		for _, c := range p[:ml] {
+			m = m<<8 | uint64(c)
+		}
+		return m
+	}
+
+	p := data[1:]
+	if len(p) < 2*ml+2 {
+		return errors.New("reader requirements box too short")
+	}
+	b.FullyUnderstand, b.DisplayContents = mask(p), mask(p[ml:])
+	p = p[2*ml:]
+
+	n := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < n*(2+ml)+2 {
+		return errors.New("reader requirements box too short")
+	}
+	b.StandardFeatures = make([]ReaderFeature, n)
+	for i := range b.StandardFeatures {
+		b.StandardFeatures[i] = ReaderFeature{Feature: binary.BigEndian.Uint16(p), Mask: mask(p[2:])}
+		p = p[2+ml:]
+	}
+
+	n = int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) != n*(16+ml) {
+		return errors.New("reader requirements box length does not match its vendor features")
+	}
+	b.VendorFeatures = make([]VendorFeature, n)
+	for i := range b.VendorFeatures {
+		copy(b.VendorFeatures[i].UUID[:], p)
+		b.VendorFeatures[i].Mask = mask(p[16:])
+		p = p[16+ml:]
+	}
+	return nil
+}
+
+// Bytes returns the reader requirements box contents.
+func (b *ReaderRequirementsBox) Bytes() []byte {
+	ml := int(b.MaskLength)
+	mask := func(data []byte, m uint64) []byte {
+		for i := ml - 1; i >= 0; i-- {
+			data = append(data, byte(m>>(8*i)))
+		}
+		return data
+	}
+
+	data := []byte{b.MaskLength}
+	data = mask(data, b.FullyUnderstand)
+	data = mask(data, b.DisplayContents)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(b.StandardFeatures)))
+	for _, f := range b.StandardFeatures {
+		data = binary.BigEndian.AppendUint16(data, f.Feature)
+		data = mask(data, f.Mask)
+	}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(b.VendorFeatures)))
+	for _, f := range b.VendorFeatures {
+		data = append(data, f.UUID[:]...)
+		data = mask(data, f.Mask)
+	}
+	return data
+}
+
 // FileTypeBox represents the ftyp box.
 type FileTypeBox struct {
 	Brand         Type
@@ -430,11 +769,20 @@ func ParseJP2Header(data []byte) (*JP2Header, error) {
 				return nil, err
 			}
 		case TypeChannelDef:
-			// Parse channel definition
+			h.ChannelDef = &ChannelDefBox{}
+			if err := h.ChannelDef.Parse(box.Contents); err != nil {
+				return nil, err
+			}
 		case TypePalette:
-			// Parse palette
+			h.Palette = &PaletteBox{}
+			if err := h.Palette.Parse(box.Contents); err != nil {
+				return nil, err
+			}
 		case TypeComponentMap:
-			// Parse component map
+			h.ComponentMap = &ComponentMapBox{}
+			if err := h.ComponentMap.Parse(box.Contents); err != nil {
+				return nil, err
+			}
 		case TypeResolution:
 			// Parse resolution
 		}
@@ -514,6 +862,21 @@ func CreateFileTypeBox() *Box {
 	}
 }
 
+// CreateJPXFileTypeBox creates a file type box for a JPX file that a JP2
+// reader can also read: its brand is JPX and its compatibility list
+// names JP2 and baseline JPX as well.
+func CreateJPXFileTypeBox() *Box {
+	ftyp := &FileTypeBox{
+		Brand:         BrandJPX,
+		Compatibility: []Type{BrandJPX, BrandJP2, BrandJPXBaseline},
+	}
+	return &Box{
+		Type:     TypeFileType,
+		Length:   uint64(8 + len(ftyp.Bytes())),
+		Contents: ftyp.Bytes(),
+	}
+}
+
 // CreateCodestreamBox creates a contiguous codestream box.
 func CreateCodestreamBox(codestream []byte) *Box {
 	return &Box{
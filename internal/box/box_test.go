@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"reflect"
 	"testing"
 )
 
@@ -334,6 +335,47 @@ func TestCreateFileTypeBox(t *testing.T) {
 	}
 }
 
+func TestReaderRequirementsBox(t *testing.T) {
+	rreq := &ReaderRequirementsBox{
+		MaskLength:      2,
+		FullyUnderstand: 0x8003,
+		DisplayContents: 0x8001,
+		StandardFeatures: []ReaderFeature{
+			{Feature: FeaturePart1Codestream, Mask: 0x8000},
+			{Feature: FeatureContiguousCodestream, Mask: 0x0001},
+		},
+		VendorFeatures: []VendorFeature{{UUID: [16]byte{1, 2, 3}, Mask: 0x0002}},
+	}
+	data := rreq.Bytes()
+	if len(data) != 1+2*2+2+2*(2+2)+2+(16+2) {
+		t.Errorf("Bytes() has %d bytes", len(data))
+	}
+
+	var got ReaderRequirementsBox
+	if err := got.Parse(data); err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if !reflect.DeepEqual(&got, rreq) {
+		t.Errorf("Parse() = %+v, want %+v", got, *rreq)
+	}
+
+	for _, bad := range [][]byte{nil, {3, 0, 0}, data[:len(data)-1], data[:8]} {
+		if err := got.Parse(bad); err == nil {
+			t.Errorf("Parse(% X) succeeded", bad)
+		}
+	}
+}
+
+func TestCreateJPXFileTypeBox(t *testing.T) {
+	var ftyp FileTypeBox
+	if err := ftyp.Parse(CreateJPXFileTypeBox().Contents); err != nil {
+		t.Fatal(err)
+	}
+	if ftyp.Brand != BrandJPX || !reflect.DeepEqual(ftyp.Compatibility, []Type{BrandJPX, BrandJP2, BrandJPXBaseline}) {
+		t.Errorf("ftyp = %+v", ftyp)
+	}
+}
+
 func TestCreateCodestreamBox(t *testing.T) {
 	codestream := []byte{0xFF, 0x4F, 0xFF, 0xD9} // SOC + EOC
 	box := CreateCodestreamBox(codestream)
@@ -427,15 +469,49 @@ func TestReader_ReadBox_TruncatedHeader(t *testing.T) {
 }
 
 func TestReader_ReadBox_ZeroLength(t *testing.T) {
-	// Length = 0 means box extends to EOF (not supported)
+	// Length = 0 means the last box extends to EOF, whatever its type
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, uint32(0)) // Length = 0
-	binary.Write(&buf, binary.BigEndian, uint32(TypeFileType))
+	binary.Write(&buf, binary.BigEndian, uint32(TypeXML))
+	buf.WriteString("<a/>")
 
 	r := NewReader(&buf)
-	_, err := r.ReadBox()
-	if err == nil {
-		t.Error("ReadBox() expected error for zero length box")
+	box, err := r.ReadBox()
+	if err != nil {
+		t.Fatalf("ReadBox() error: %v", err)
+	}
+	if box.Type != TypeXML || box.Length != 12 || string(box.Contents) != "<a/>" {
+		t.Errorf("box = %v, %d bytes, %q; want xml, 12 bytes, \"<a/>\"", box.Type, box.Length, box.Contents)
+	}
+}
+
+func TestReader_ReadBox_ZeroLengthCodestream(t *testing.T) {
+	// Length = 0 on the codestream box means it extends to EOF
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // Length = 0
+	binary.Write(&buf, binary.BigEndian, uint32(TypeContCodestream))
+	buf.Write([]byte{0xFF, 0x4F, 0xFF, 0x51, 0x00})
+
+	r := NewReader(&buf)
+	box, err := r.ReadBox()
+	if err != nil {
+		t.Fatalf("ReadBox() error: %v", err)
+	}
+	if box.Type != TypeContCodestream {
+		t.Errorf("Type = %v, want %v", box.Type, TypeContCodestream)
+	}
+	if box.Length != 13 {
+		t.Errorf("Length = %d, want 13", box.Length)
+	}
+	if !bytes.Equal(box.Contents, []byte{0xFF, 0x4F, 0xFF, 0x51, 0x00}) {
+		t.Errorf("Contents = %X, want FF4FFF5100", box.Contents)
+	}
+	if r.Offset() != 13 {
+		t.Errorf("Offset() = %d, want 13", r.Offset())
+	}
+
+	if _, err := r.ReadBox(); err != io.EOF {
+		t.Errorf("second ReadBox() error = %v, want EOF", err)
 	}
 }
 
@@ -1198,10 +1274,15 @@ func TestParseJP2Header_WithChannelDef(t *testing.T) {
 	ihdrBox.Length = uint64(8 + len(ihdrBox.Contents))
 	jp2hContents.Write(ihdrBox.Bytes())
 
-	// Channel definition box (stub content)
+	// Channel definition box: blue, green and red stored in reverse order
+	cdef := &ChannelDefBox{Definitions: []ChannelDefinition{
+		{Channel: 0, Type: ChannelColor, Association: 3},
+		{Channel: 1, Type: ChannelColor, Association: 2},
+		{Channel: 2, Type: ChannelColor, Association: 1},
+	}}
 	cdefBox := &Box{
 		Type:     TypeChannelDef,
-		Contents: []byte{0x00, 0x03}, // 3 channels
+		Contents: cdef.Bytes(),
 	}
 	cdefBox.Length = uint64(8 + len(cdefBox.Contents))
 	jp2hContents.Write(cdefBox.Bytes())
@@ -1211,10 +1292,17 @@ func TestParseJP2Header_WithChannelDef(t *testing.T) {
 		t.Fatalf("ParseJP2Header() error: %v", err)
 	}
 
-	// Should parse without error even though channel def parsing is not implemented
 	if h.ImageHeader == nil {
 		t.Error("ImageHeader should not be nil")
 	}
+	if h.ChannelDef == nil || !reflect.DeepEqual(h.ChannelDef.Definitions, cdef.Definitions) {
+		t.Errorf("ChannelDef = %+v, want %+v", h.ChannelDef, cdef)
+	}
+
+	// A box shorter than its channel count is rejected
+	if err := (&ChannelDefBox{}).Parse([]byte{0x00, 0x03}); err == nil {
+		t.Error("Parse() of a truncated channel definition box succeeded")
+	}
 }
 
 func TestParseJP2Header_WithPalette(t *testing.T) {
@@ -1235,10 +1323,14 @@ func TestParseJP2Header_WithPalette(t *testing.T) {
 	ihdrBox.Length = uint64(8 + len(ihdrBox.Contents))
 	jp2hContents.Write(ihdrBox.Bytes())
 
-	// Palette box (stub content)
+	// Palette box: 16 entries, 3 columns, 8 bits each
+	pclr := []byte{0x00, 0x10, 0x03, 0x07, 0x07, 0x07}
+	for i := 0; i < 16; i++ {
+		pclr = append(pclr, byte(i), byte(i*2), byte(i*3))
+	}
 	pclrBox := &Box{
 		Type:     TypePalette,
-		Contents: []byte{0x00, 0x10, 0x03, 0x08, 0x08, 0x08}, // 16 entries, 3 columns, 8 bits each
+		Contents: pclr,
 	}
 	pclrBox.Length = uint64(8 + len(pclrBox.Contents))
 	jp2hContents.Write(pclrBox.Bytes())
@@ -1251,6 +1343,12 @@ func TestParseJP2Header_WithPalette(t *testing.T) {
 	if h.ImageHeader == nil {
 		t.Error("ImageHeader should not be nil")
 	}
+	if h.Palette == nil || h.Palette.NumEntries != 16 || h.Palette.NumColumns != 3 {
+		t.Fatalf("Palette = %+v, want 16 entries of 3 columns", h.Palette)
+	}
+	if e := h.Palette.Entries[15]; e[0] != 15 || e[1] != 30 || e[2] != 45 {
+		t.Errorf("Entries[15] = %v, want [15 30 45]", e)
+	}
 }
 
 func TestParseJP2Header_WithComponentMap(t *testing.T) {
@@ -1375,3 +1473,129 @@ func TestReader_ReadBox_TooLarge(t *testing.T) {
 		t.Error("ReadBox() expected error for box too large")
 	}
 }
+
+func TestReader_ReadHeader_SkipExtended(t *testing.T) {
+	// An XL box larger than ReadBox will buffer, followed by a small box
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, uint32(TypeUUID))
+	binary.Write(&buf, binary.BigEndian, uint64(16+4))
+	buf.Write([]byte{1, 2, 3, 4})
+	binary.Write(&buf, binary.BigEndian, uint32(10))
+	binary.Write(&buf, binary.BigEndian, uint32(TypeXML))
+	buf.Write([]byte("ok"))
+
+	r := NewReader(&buf)
+	boxType, n, err := r.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if boxType != TypeUUID || n != 4 {
+		t.Errorf("ReadHeader() = %v, %d; want uuid, 4", boxType, n)
+	}
+	if err := r.Skip(n); err != nil {
+		t.Fatalf("Skip() error: %v", err)
+	}
+	if r.Offset() != 20 {
+		t.Errorf("Offset() = %d, want 20", r.Offset())
+	}
+
+	b, err := r.ReadBox()
+	if err != nil {
+		t.Fatalf("ReadBox() error: %v", err)
+	}
+	if b.Type != TypeXML || string(b.Contents) != "ok" {
+		t.Errorf("ReadBox() = %v %q, want xml \"ok\"", b.Type, b.Contents)
+	}
+}
+
+func TestReader_ReadHeader_ExtendedTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, uint32(TypeContCodestream))
+	binary.Write(&buf, binary.BigEndian, uint64(6<<30))
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	if _, n, err := r.ReadHeader(); err != nil || n != 6<<30-16 {
+		t.Errorf("ReadHeader() = %d, %v; want %d", n, err, int64(6<<30-16))
+	}
+	if _, err := r.ReadContents(6<<30 - 16); err == nil {
+		t.Error("ReadContents() past the end of the data: expected error")
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	if _, err := r.ReadBox(); err == nil {
+		t.Error("ReadBox() of a 6GB box: expected error")
+	}
+}
+
+func TestPaletteBox_RoundTrip(t *testing.T) {
+	// A 12-bit unsigned column and a signed 4-bit column
+	want := &PaletteBox{
+		NumEntries:   3,
+		NumColumns:   2,
+		BitsPerEntry: []uint8{11, 0x80 | 3},
+		Entries:      [][]uint32{{0, 15}, {2048, 8}, {4095, 1}},
+	}
+	data := want.Bytes()
+	if len(data) != 3+2+3*3 {
+		t.Fatalf("Bytes() length = %d, want 14", len(data))
+	}
+
+	var got PaletteBox
+	if err := got.Parse(data); err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if got.NumEntries != 3 || got.NumColumns != 2 || !bytes.Equal(got.BitsPerEntry, want.BitsPerEntry) {
+		t.Errorf("Parse() = %+v", got)
+	}
+	for j := range want.Entries {
+		for i := range want.Entries[j] {
+			if got.Entries[j][i] != want.Entries[j][i] {
+				t.Errorf("entry %d column %d = %d, want %d", j, i, got.Entries[j][i], want.Entries[j][i])
+			}
+		}
+	}
+}
+
+func TestPaletteBox_Parse_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"too short":      {0, 1},
+		"no entries":     {0, 0, 1, 7},
+		"too many":       {0x04, 0x01, 1, 7},
+		"no columns":     {0, 1, 0},
+		"missing depths": {0, 1, 3, 7},
+		"missing data":   {0, 2, 1, 7, 0xFF},
+	}
+	for name, data := range tests {
+		var b PaletteBox
+		if err := b.Parse(data); err == nil {
+			t.Errorf("%s: Parse() expected error", name)
+		}
+	}
+}
+
+func TestComponentMapBox_RoundTrip(t *testing.T) {
+	want := &ComponentMapBox{Mappings: []ComponentMapping{
+		{Component: 0, MappingType: 1, PaletteColumn: 0},
+		{Component: 0, MappingType: 1, PaletteColumn: 2},
+		{Component: 1, MappingType: 0},
+	}}
+
+	var got ComponentMapBox
+	if err := got.Parse(want.Bytes()); err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if len(got.Mappings) != len(want.Mappings) {
+		t.Fatalf("Mappings = %v, want %v", got.Mappings, want.Mappings)
+	}
+	for i := range want.Mappings {
+		if got.Mappings[i] != want.Mappings[i] {
+			t.Errorf("mapping %d = %+v, want %+v", i, got.Mappings[i], want.Mappings[i])
+		}
+	}
+
+	if err := got.Parse([]byte{0, 0, 1}); err == nil {
+		t.Error("Parse() of a partial mapping: expected error")
+	}
+}
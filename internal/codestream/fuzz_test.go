@@ -27,6 +27,9 @@ func FuzzParseCodestream(f *testing.F) {
 	// Random markers
 	f.Add([]byte{0xFF, 0x90, 0xFF, 0x93, 0xFF, 0xD9})
 
+	// Marker segment claiming far more bytes than remain
+	f.Add([]byte{0xFF, 0x4F, 0xFF, 0x64, 0xFF, 0xFF, 0x00, 0x01})
+
 	f.Fuzz(func(t *testing.T, data []byte) {
 		r := bytes.NewReader(data)
 		p := NewParser(r)
@@ -64,3 +67,19 @@ func FuzzReadMarkerSegments(f *testing.F) {
 		_, _ = p.ReadHeader()
 	})
 }
+
+// FuzzReadHeader tests main header and tile-part header parsing. The seed
+// corpus in testdata/fuzz/FuzzReadHeader is produced by
+// cmd/fuzz-corpus-builder and covers the common marker variations.
+// Run with: go test -fuzz=FuzzReadHeader ./internal/codestream/
+func FuzzReadHeader(f *testing.F) {
+	f.Add([]byte{0xFF, 0x4F})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := NewParser(bytes.NewReader(data))
+		if _, err := p.ReadHeader(); err != nil {
+			return
+		}
+		_, _ = p.ReadTilePartHeader()
+	})
+}
@@ -35,9 +35,20 @@ type Header struct {
 	// Optional per-component quantization (QCC markers)
 	ComponentQuantization map[uint16]QuantizationComponent
 
+	// Optional per-component region-of-interest max-shift values
+	// (RGN markers)
+	ROIShifts map[uint16]uint8
+
 	// CAP marker data (extended capabilities)
 	Capabilities *CapabilitiesMarker
 
+	// Part 2 multiple component transform (MCT, MCC and MCO markers).
+	// MCTStageOrder lists the MCC stage indices in the order the
+	// decoder applies them.
+	MCTArrays     []MCTArray
+	MCTStages     []MCTStage
+	MCTStageOrder []uint8
+
 	// Optional markers
 	ProgressionOrderChanges []ProgressionOrderChange
 	TileLengths            []TileLength
@@ -45,6 +56,12 @@ type Header struct {
 	PackedPacketHeaders    []byte
 	Comment                string
 	CommentType            uint16
+	Comments               []string // All Latin-1 comments, in order
+	BinaryComments         [][]byte // Payloads of all binary comments, in order
+
+	// UnknownMarkers lists the markers the parser skipped in the main
+	// header, in order, such as Part 2 extensions it does not interpret.
+	UnknownMarkers []Marker
 }
 
 // ComponentInfo holds per-component size information from the SIZ marker.
@@ -58,6 +75,11 @@ type ComponentInfo struct {
 
 	// Vertical subsampling factor (YRsiz).
 	SubsamplingY uint8
+
+	// Registration offsets of the samples (Xcrg and Ycrg of the CRG
+	// marker), in units of 1/65536 of the subsampling factors.
+	RegistrationX uint16
+	RegistrationY uint16
 }
 
 // Precision returns the bit precision (1-38).
@@ -139,6 +161,38 @@ type CodingStyleComponent struct {
 	PrecinctSizes      []PrecinctSize
 }
 
+// ComponentCodingStyle returns the coding style of component c: its COC
+// marker if there is one, otherwise the COD defaults.
+func (h *Header) ComponentCodingStyle(c int) CodingStyleComponent {
+	if coc, ok := h.ComponentCodingStyles[uint16(c)]; ok {
+		return coc
+	}
+	cod := h.CodingStyle
+	return CodingStyleComponent{
+		ComponentIndex:     uint16(c),
+		CodingStyle:        cod.CodingStyle,
+		NumDecompositions:  cod.NumDecompositions,
+		CodeBlockWidthExp:  cod.CodeBlockWidthExp,
+		CodeBlockHeightExp: cod.CodeBlockHeightExp,
+		CodeBlockStyle:     cod.CodeBlockStyle,
+		WaveletTransform:   cod.WaveletTransform,
+		PrecinctSizes:      cod.PrecinctSizes,
+	}
+}
+
+// ComponentQuantizationStyle returns the quantization of component c:
+// its QCC marker if there is one, otherwise the QCD defaults.
+func (h *Header) ComponentQuantizationStyle(c int) QuantizationDefault {
+	if qcc, ok := h.ComponentQuantization[uint16(c)]; ok {
+		return QuantizationDefault{
+			QuantizationStyle: qcc.QuantizationStyle,
+			NumGuardBits:      qcc.NumGuardBits,
+			StepSizes:         qcc.StepSizes,
+		}
+	}
+	return h.Quantization
+}
+
 // QuantizationDefault holds data from the QCD marker.
 type QuantizationDefault struct {
 	// Sqcd: Quantization style and guard bits
@@ -200,7 +254,8 @@ type TileLength struct {
 // This marker is used to signal HTJ2K (Part 15) and other extended features.
 type CapabilitiesMarker struct {
 	// Pcap is a 32-bit field indicating which extended capabilities are used.
-	// Bit 15 (0x00008000) indicates HTJ2K is used when set.
+	// Bit 15, counting from 1 at the most significant bit (0x00020000),
+	// indicates HTJ2K is used when set.
 	Pcap uint32
 
 	// CCAPi contains extended component capabilities.
@@ -210,7 +265,7 @@ type CapabilitiesMarker struct {
 
 // CapPcapHTJ2K is the bit in Pcap indicating HTJ2K (Part 15) is used.
 // When this bit is set, the codestream uses the High-Throughput block coder.
-const CapPcapHTJ2K uint32 = 0x00008000 // Bit 15
+const CapPcapHTJ2K uint32 = 0x00020000 // Pcap^15
 
 // IsHTJ2K returns true if the CAP marker indicates HTJ2K mode.
 func (c *CapabilitiesMarker) IsHTJ2K() bool {
@@ -234,6 +289,9 @@ type TilePartHeader struct {
 	ComponentQuantization map[uint16]QuantizationComponent
 	ProgressionOrderChanges []ProgressionOrderChange
 	PackedPacketHeaders   []byte
+
+	// PacketLengths lists the packet lengths from PLT marker segments
+	PacketLengths []uint32
 }
 
 // IsHTJ2K returns true if this header indicates HTJ2K (High-Throughput) mode.
@@ -266,6 +324,22 @@ func (h *Header) Validate() error {
 		return fmt.Errorf("invalid tile dimensions: %dx%d", h.TileWidth, h.TileHeight)
 	}
 
+	// The image area starts at (XOsiz, YOsiz) and the tile grid at
+	// (XTOsiz, YTOsiz); the first tile must overlap the image area.
+	if h.ImageXOffset >= h.ImageWidth || h.ImageYOffset >= h.ImageHeight {
+		return fmt.Errorf("image offset (%d, %d) outside the reference grid %dx%d",
+			h.ImageXOffset, h.ImageYOffset, h.ImageWidth, h.ImageHeight)
+	}
+	if h.TileXOffset > h.ImageXOffset || h.TileYOffset > h.ImageYOffset {
+		return fmt.Errorf("tile offset (%d, %d) exceeds image offset (%d, %d)",
+			h.TileXOffset, h.TileYOffset, h.ImageXOffset, h.ImageYOffset)
+	}
+	if uint64(h.TileXOffset)+uint64(h.TileWidth) <= uint64(h.ImageXOffset) ||
+		uint64(h.TileYOffset)+uint64(h.TileHeight) <= uint64(h.ImageYOffset) {
+		return fmt.Errorf("first tile at (%d, %d) does not overlap image offset (%d, %d)",
+			h.TileXOffset, h.TileYOffset, h.ImageXOffset, h.ImageYOffset)
+	}
+
 	if h.NumComponents == 0 || h.NumComponents > 16384 {
 		return fmt.Errorf("invalid number of components: %d", h.NumComponents)
 	}
@@ -291,11 +365,11 @@ func (h *Header) Validate() error {
 
 // CalculateDerivedValues computes values derived from the main header.
 func (h *Header) CalculateDerivedValues() {
-	// Calculate number of tiles
-	if h.TileWidth > 0 {
-		h.NumTilesX = (h.ImageWidth - h.TileXOffset + h.TileWidth - 1) / h.TileWidth
+	// Calculate number of tiles, counted from the tile grid origin
+	if h.TileWidth > 0 && h.ImageWidth > h.TileXOffset {
+		h.NumTilesX = uint32((uint64(h.ImageWidth-h.TileXOffset) + uint64(h.TileWidth) - 1) / uint64(h.TileWidth))
 	}
-	if h.TileHeight > 0 {
-		h.NumTilesY = (h.ImageHeight - h.TileYOffset + h.TileHeight - 1) / h.TileHeight
+	if h.TileHeight > 0 && h.ImageHeight > h.TileYOffset {
+		h.NumTilesY = uint32((uint64(h.ImageHeight-h.TileYOffset) + uint64(h.TileHeight) - 1) / uint64(h.TileHeight))
 	}
 }
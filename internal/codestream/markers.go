@@ -42,6 +42,12 @@ const (
 	MCT Marker = 0xFF74 // Multiple component transform collection
 	MCC Marker = 0xFF75 // Multiple component transform component
 	MCO Marker = 0xFF77 // Multiple component transform ordering
+	DCO Marker = 0xFF70 // Variable DC offset
+	VMS Marker = 0xFF71 // Visual masking
+	DFS Marker = 0xFF72 // Downsampling factor style
+	ADS Marker = 0xFF73 // Arbitrary decomposition style
+	NLT Marker = 0xFF76 // Non-linearity point transformation
+	ATK Marker = 0xFF79 // Arbitrary transformation kernels
 )
 
 // Marker represents a JPEG 2000 marker code.
@@ -100,13 +106,29 @@ func (m Marker) String() string {
 		return "MCC"
 	case MCO:
 		return "MCO"
+	case DCO:
+		return "DCO"
+	case VMS:
+		return "VMS"
+	case DFS:
+		return "DFS"
+	case ADS:
+		return "ADS"
+	case NLT:
+		return "NLT"
+	case ATK:
+		return "ATK"
 	default:
 		return "UNKNOWN"
 	}
 }
 
 // HasLength returns true if this marker has a length field following it.
+// Codes 0xFF30 to 0xFF3F are reserved for markers without one.
 func (m Marker) HasLength() bool {
+	if m >= 0xFF30 && m <= 0xFF3F {
+		return false
+	}
 	switch m {
 	case SOC, SOD, EOC, EPH:
 		return false
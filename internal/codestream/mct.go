@@ -0,0 +1,239 @@
+package codestream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MCT array types (Imct bits 8-9).
+const (
+	MCTArrayDependency    uint8 = 0
+	MCTArrayDecorrelation uint8 = 1
+	MCTArrayOffset        uint8 = 2
+)
+
+// MCC component collection transform types (Xmcc bits 0-1).
+const (
+	MCCDependency    uint8 = 0
+	MCCDecorrelation uint8 = 1
+	MCCWavelet       uint8 = 3
+)
+
+// MCTArray holds an array from one or more MCT marker segments
+// (ISO/IEC 15444-2 A.3.7).
+type MCTArray struct {
+	// Index identifies the array for MCC marker segments.
+	Index uint8
+
+	// Type is MCTArrayDependency, MCTArrayDecorrelation or MCTArrayOffset.
+	Type uint8
+
+	// Values holds the array elements in row-major order.
+	Values []float64
+}
+
+// MCTStage holds a transform stage from an MCC marker segment
+// (ISO/IEC 15444-2 A.3.8).
+type MCTStage struct {
+	// Index identifies the stage for the MCO marker segment.
+	Index uint8
+
+	// Collections holds the component collections transformed by the
+	// stage.
+	Collections []MCTCollection
+}
+
+// MCTCollection describes the transform of one component collection.
+type MCTCollection struct {
+	// Type is MCCDependency, MCCDecorrelation or MCCWavelet.
+	Type uint8
+
+	// Inputs are the codestream components fed to the inverse transform
+	// and Outputs the components it reconstructs.
+	Inputs  []uint16
+	Outputs []uint16
+
+	// MatrixIndex and OffsetIndex select MCT arrays; 0 means none.
+	MatrixIndex uint8
+	OffsetIndex uint8
+
+	// Reversible reports whether the transform is reversible.
+	Reversible bool
+}
+
+// Array returns the MCT array with the given index, or nil.
+func (h *Header) Array(index uint8) *MCTArray {
+	for i := range h.MCTArrays {
+		if h.MCTArrays[i].Index == index {
+			return &h.MCTArrays[i]
+		}
+	}
+	return nil
+}
+
+// Stage returns the MCC stage with the given index, or nil.
+func (h *Header) Stage(index uint8) *MCTStage {
+	for i := range h.MCTStages {
+		if h.MCTStages[i].Index == index {
+			return &h.MCTStages[i]
+		}
+	}
+	return nil
+}
+
+// readSegmentBody reads the body of a marker segment after its length.
+func (p *Parser) readSegmentBody(name string, minLength int) ([]byte, error) {
+	length, err := p.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if int(length) < minLength {
+		return nil, fmt.Errorf("%s marker too short: %d bytes", name, length)
+	}
+	return p.readBytes(int(length) - 2)
+}
+
+// readMCT reads an MCT marker segment. Segments continuing an array
+// (Zmct > 0) append to the array with the same index.
+func (p *Parser) readMCT() error {
+	b, err := p.readSegmentBody("MCT", 6)
+	if err != nil {
+		return err
+	}
+
+	zmct := binary.BigEndian.Uint16(b)
+	imct := binary.BigEndian.Uint16(b[2:])
+	b = b[4:]
+	if zmct == 0 {
+		if len(b) < 2 {
+			return fmt.Errorf("MCT marker missing Ymct")
+		}
+		b = b[2:]
+	}
+
+	index := uint8(imct)
+	arrayType := uint8(imct>>8) & 0x03
+	if arrayType > MCTArrayOffset {
+		return fmt.Errorf("invalid MCT array type: %d", arrayType)
+	}
+
+	var size int
+	var read func([]byte) float64
+	switch (imct >> 10) & 0x03 {
+	case 0:
+		size, read = 2, func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) }
+	case 1:
+		size, read = 4, func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) }
+	case 2:
+		size, read = 4, func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }
+	case 3:
+		size, read = 8, func(b []byte) float64 { return math.Float64frombits(binary.BigEndian.Uint64(b)) }
+	}
+	if len(b)%size != 0 {
+		return fmt.Errorf("MCT marker: %d bytes is not a whole number of elements", len(b))
+	}
+
+	a := p.header.Array(index)
+	if a == nil || zmct == 0 {
+		p.header.MCTArrays = append(p.header.MCTArrays, MCTArray{Index: index, Type: arrayType})
+		a = &p.header.MCTArrays[len(p.header.MCTArrays)-1]
+	}
+	for ; len(b) > 0; b = b[size:] {
+		a.Values = append(a.Values, read(b))
+	}
+	return nil
+}
+
+// readMCC reads an MCC marker segment.
+func (p *Parser) readMCC() error {
+	b, err := p.readSegmentBody("MCC", 7)
+	if err != nil {
+		return err
+	}
+
+	zmcc := binary.BigEndian.Uint16(b)
+	stage := MCTStage{Index: b[2]}
+	b = b[3:]
+	if zmcc == 0 {
+		if len(b) < 2 {
+			return fmt.Errorf("MCC marker missing Ymcc")
+		}
+		b = b[2:]
+	}
+	if len(b) < 2 {
+		return fmt.Errorf("MCC marker missing Qmcc")
+	}
+	numCollections := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+
+	// components reads a component count followed by the component
+	// indices, one or two bytes each.
+	components := func() ([]uint16, error) {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("MCC marker truncated")
+		}
+		n := binary.BigEndian.Uint16(b)
+		b = b[2:]
+		size := 1
+		if n&0x8000 != 0 {
+			size = 2
+		}
+		n &= 0x7FFF
+		if len(b) < int(n)*size {
+			return nil, fmt.Errorf("MCC marker truncated")
+		}
+		c := make([]uint16, n)
+		for i := range c {
+			if size == 2 {
+				c[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				c[i] = uint16(b[i])
+			}
+		}
+		b = b[int(n)*size:]
+		return c, nil
+	}
+
+	for i := 0; i < numCollections; i++ {
+		if len(b) < 1 {
+			return fmt.Errorf("MCC marker truncated")
+		}
+		col := MCTCollection{Type: b[0] & 0x03}
+		b = b[1:]
+		if col.Inputs, err = components(); err != nil {
+			return err
+		}
+		if col.Outputs, err = components(); err != nil {
+			return err
+		}
+		if len(b) < 3 {
+			return fmt.Errorf("MCC marker truncated")
+		}
+		tmcc := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		b = b[3:]
+		if col.Type != MCCWavelet {
+			col.MatrixIndex = uint8(tmcc)
+			col.OffsetIndex = uint8(tmcc >> 8)
+			col.Reversible = tmcc&0x10000 != 0
+		}
+		stage.Collections = append(stage.Collections, col)
+	}
+
+	p.header.MCTStages = append(p.header.MCTStages, stage)
+	return nil
+}
+
+// readMCO reads an MCO marker segment.
+func (p *Parser) readMCO() error {
+	b, err := p.readSegmentBody("MCO", 3)
+	if err != nil {
+		return err
+	}
+	n := int(b[0])
+	if len(b) < 1+n {
+		return fmt.Errorf("MCO marker truncated")
+	}
+	p.header.MCTStageOrder = append([]uint8(nil), b[1:1+n]...)
+	return nil
+}
@@ -12,6 +12,19 @@ type Parser struct {
 	buf    []byte
 	header *Header
 	state  parserState
+
+	// offset is the number of codestream bytes consumed so far, and
+	// firstTilePart the offset of the first SOT marker. base is the
+	// position of the codestream in the reader passed to SeekToTile,
+	// recorded on the first call.
+	offset        int64
+	firstTilePart int64
+	base          int64
+	baseKnown     bool
+
+	// Tile-part header state
+	tilePart      *TilePartHeader // most recently read tile-part header
+	spareTilePart *TilePartHeader // cleared header reused by the next read
 }
 
 // parserState tracks the parser state machine.
@@ -32,11 +45,108 @@ func NewParser(r io.Reader) *Parser {
 	return &Parser{
 		r:      r,
 		buf:    make([]byte, 4096),
-		header: &Header{
-			ComponentCodingStyles: make(map[uint16]CodingStyleComponent),
-			ComponentQuantization: make(map[uint16]QuantizationComponent),
-		},
-		state: stateInit,
+		header: newHeader(),
+		state:  stateInit,
+	}
+}
+
+// newHeader returns an empty main header ready for parsing.
+func newHeader() *Header {
+	return &Header{
+		ComponentCodingStyles: make(map[uint16]CodingStyleComponent),
+		ComponentQuantization: make(map[uint16]QuantizationComponent),
+		ROIShifts:             make(map[uint16]uint8),
+	}
+}
+
+// Reset prepares the parser to read a new codestream from r, reusing its
+// internal buffers along with the Header and its maps and slices. The
+// Header and TilePartHeader previously returned are invalidated: the next
+// ReadHeader call overwrites them, so callers must copy out anything they
+// need to keep before calling Reset.
+func (p *Parser) Reset(r io.Reader) {
+	p.r = r
+	resetHeader(p.header)
+	p.state = stateInit
+	p.offset = 0
+	p.firstTilePart = 0
+	p.baseKnown = false
+	p.ClearTilePartState()
+}
+
+// resetHeader clears h for reuse, keeping its maps and the backing arrays
+// of its slices.
+func resetHeader(h *Header) {
+	clear(h.ComponentCodingStyles)
+	clear(h.ComponentQuantization)
+	clear(h.ROIShifts)
+	*h = Header{
+		ComponentInfo:           h.ComponentInfo[:0],
+		CodingStyle:             CodingStyleDefault{PrecinctSizes: h.CodingStyle.PrecinctSizes[:0]},
+		Quantization:            QuantizationDefault{StepSizes: h.Quantization.StepSizes[:0]},
+		ComponentCodingStyles:   h.ComponentCodingStyles,
+		ComponentQuantization:   h.ComponentQuantization,
+		ROIShifts:               h.ROIShifts,
+		MCTArrays:               h.MCTArrays[:0],
+		MCTStages:               h.MCTStages[:0],
+		MCTStageOrder:           h.MCTStageOrder[:0],
+		ProgressionOrderChanges: h.ProgressionOrderChanges[:0],
+		TileLengths:             h.TileLengths[:0],
+		PacketLengths:           h.PacketLengths[:0],
+		PackedPacketHeaders:     h.PackedPacketHeaders[:0],
+		Comments:                h.Comments[:0],
+		BinaryComments:          h.BinaryComments[:0],
+	}
+}
+
+// resize returns s with length n and zeroed elements, reusing its backing
+// array when it is large enough.
+func resize[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	s = s[:n]
+	clear(s)
+	return s
+}
+
+// ClearTilePartState discards the state accumulated while reading the most
+// recent tile-part header (component overrides, packed packet headers),
+// preserving the main header. Its storage is reused by the next
+// ReadTilePartHeader call, so the previously returned TilePartHeader must
+// not be used afterwards.
+func (p *Parser) ClearTilePartState() {
+	tph := p.tilePart
+	if tph == nil {
+		return
+	}
+	p.tilePart = nil
+
+	clear(tph.ComponentCodingStyles)
+	clear(tph.ComponentQuantization)
+	*tph = TilePartHeader{
+		ComponentCodingStyles: tph.ComponentCodingStyles,
+		ComponentQuantization: tph.ComponentQuantization,
+		PackedPacketHeaders:   tph.PackedPacketHeaders[:0],
+		PacketLengths:         tph.PacketLengths[:0],
+	}
+	p.spareTilePart = tph
+
+	if p.state == stateTilePartHeader || p.state == stateData {
+		p.state = stateMainHeader
+	}
+}
+
+// newTilePartHeader returns an empty tile-part header, reusing the one
+// released by ClearTilePartState if available.
+func (p *Parser) newTilePartHeader() *TilePartHeader {
+	if tph := p.spareTilePart; tph != nil {
+		p.spareTilePart = nil
+		return tph
+	}
+	return &TilePartHeader{
+		ComponentCodingStyles: make(map[uint16]CodingStyleComponent),
+		ComponentQuantization: make(map[uint16]QuantizationComponent),
 	}
 }
 
@@ -78,6 +188,10 @@ func (p *Parser) ReadHeader() (*Header, error) {
 			if err := p.readQCC(); err != nil {
 				return nil, fmt.Errorf("failed to read QCC marker: %w", err)
 			}
+		case RGN:
+			if err := p.readRGN(); err != nil {
+				return nil, fmt.Errorf("failed to read RGN marker: %w", err)
+			}
 		case POC:
 			if err := p.readPOC(); err != nil {
 				return nil, fmt.Errorf("failed to read POC marker: %w", err)
@@ -106,9 +220,22 @@ func (p *Parser) ReadHeader() (*Header, error) {
 			if err := p.readCAP(); err != nil {
 				return nil, fmt.Errorf("failed to read CAP marker: %w", err)
 			}
+		case MCT:
+			if err := p.readMCT(); err != nil {
+				return nil, fmt.Errorf("failed to read MCT marker: %w", err)
+			}
+		case MCC:
+			if err := p.readMCC(); err != nil {
+				return nil, fmt.Errorf("failed to read MCC marker: %w", err)
+			}
+		case MCO:
+			if err := p.readMCO(); err != nil {
+				return nil, fmt.Errorf("failed to read MCO marker: %w", err)
+			}
 		case SOT:
 			// Start of tile-part header - main header is complete
 			p.state = stateMainHeader
+			p.firstTilePart = p.offset - 2
 			p.header.CalculateDerivedValues()
 			if err := p.header.Validate(); err != nil {
 				return nil, fmt.Errorf("invalid header: %w", err)
@@ -116,9 +243,10 @@ func (p *Parser) ReadHeader() (*Header, error) {
 			return p.header, nil
 		default:
 			// Skip unknown markers
-			if err := p.skipMarkerSegment(); err != nil {
+			if err := p.skipUnknownMarker(marker); err != nil {
 				return nil, fmt.Errorf("failed to skip marker 0x%04X: %w", marker, err)
 			}
+			p.header.UnknownMarkers = append(p.header.UnknownMarkers, marker)
 		}
 	}
 }
@@ -140,6 +268,7 @@ func (p *Parser) readMarker() (Marker, error) {
 	if _, err := io.ReadFull(p.r, p.buf[:2]); err != nil {
 		return 0, err
 	}
+	p.offset += 2
 	return Marker(binary.BigEndian.Uint16(p.buf[:2])), nil
 }
 
@@ -148,6 +277,7 @@ func (p *Parser) readUint16() (uint16, error) {
 	if _, err := io.ReadFull(p.r, p.buf[:2]); err != nil {
 		return 0, err
 	}
+	p.offset += 2
 	return binary.BigEndian.Uint16(p.buf[:2]), nil
 }
 
@@ -156,6 +286,7 @@ func (p *Parser) readUint32() (uint32, error) {
 	if _, err := io.ReadFull(p.r, p.buf[:4]); err != nil {
 		return 0, err
 	}
+	p.offset += 4
 	return binary.BigEndian.Uint32(p.buf[:4]), nil
 }
 
@@ -164,6 +295,7 @@ func (p *Parser) readByte() (byte, error) {
 	if _, err := io.ReadFull(p.r, p.buf[:1]); err != nil {
 		return 0, err
 	}
+	p.offset++
 	return p.buf[0], nil
 }
 
@@ -173,22 +305,63 @@ func (p *Parser) readBytes(n int) ([]byte, error) {
 	if _, err := io.ReadFull(p.r, data); err != nil {
 		return nil, err
 	}
+	p.offset += int64(n)
 	return data, nil
 }
 
+// lenReader is implemented by readers that know how many unread bytes
+// they hold, such as *bytes.Reader.
+type lenReader interface {
+	Len() int
+}
+
+// readSegmentLength reads the length field of a marker segment and checks
+// it against minLength, the shortest valid segment. When the reader
+// knows how much input is left, a length claiming more bytes than that is
+// rejected before anything is read or allocated for the segment.
+func (p *Parser) readSegmentLength(minLength int) (int, error) {
+	length, err := p.readUint16()
+	if err != nil {
+		return 0, err
+	}
+	if int(length) < minLength {
+		return 0, fmt.Errorf("invalid marker segment length: %d", length)
+	}
+	if lr, ok := p.r.(lenReader); ok && int(length)-2 > lr.Len() {
+		return 0, fmt.Errorf("marker segment length %d exceeds the %d bytes remaining: %w",
+			length, lr.Len(), io.ErrUnexpectedEOF)
+	}
+	return int(length), nil
+}
+
 // skipMarkerSegment skips the current marker segment.
 func (p *Parser) skipMarkerSegment() error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(2)
 	if err != nil {
 		return err
 	}
-	if length < 2 {
-		return fmt.Errorf("invalid marker segment length: %d", length)
-	}
-	_, err = io.CopyN(io.Discard, p.r, int64(length-2))
+	n, err := io.CopyN(io.Discard, p.r, int64(length-2))
+	p.offset += n
 	return err
 }
 
+// skipUnknownMarker skips marker m, which the parser does not interpret.
+// Markers without a segment, such as the vendor delimiters in the range
+// reserved for them, are skipped on their own, and any other marker's
+// segment is skipped by its length. A code that is not a marker, or a
+// delimiter out of place, is an error.
+func (p *Parser) skipUnknownMarker(m Marker) error {
+	switch {
+	case m>>8 != 0xFF || m == 0xFF00 || m == 0xFFFF:
+		return fmt.Errorf("invalid marker 0x%04X", uint16(m))
+	case m.IsDelimiter():
+		return fmt.Errorf("unexpected %s marker", m)
+	case !m.HasLength():
+		return nil
+	}
+	return p.skipMarkerSegment()
+}
+
 // readSIZ reads the SIZ (image and tile size) marker segment.
 func (p *Parser) readSIZ() error {
 	if err := p.expectMarker(SIZ); err != nil {
@@ -260,7 +433,7 @@ func (p *Parser) readSIZ() error {
 	}
 
 	// Read component info
-	p.header.ComponentInfo = make([]ComponentInfo, p.header.NumComponents)
+	p.header.ComponentInfo = resize(p.header.ComponentInfo, int(p.header.NumComponents))
 	for i := range p.header.ComponentInfo {
 		ssiz, err := p.readByte()
 		if err != nil {
@@ -347,12 +520,15 @@ func (p *Parser) readCOD() error {
 		return err
 	}
 	p.header.CodingStyle.WaveletTransform = wavelet
+	if err := checkCodingStyle(numDecomp, cbWidth, cbHeight); err != nil {
+		return err
+	}
 
 	// Read precinct sizes if present
 	if scod&CodingStylePrecincts != 0 {
 		numPrecinct := int(length) - 12
 		if numPrecinct > 0 {
-			p.header.CodingStyle.PrecinctSizes = make([]PrecinctSize, numPrecinct)
+			p.header.CodingStyle.PrecinctSizes = resize(p.header.CodingStyle.PrecinctSizes, numPrecinct)
 			for i := 0; i < numPrecinct; i++ {
 				pp, err := p.readByte()
 				if err != nil {
@@ -369,6 +545,21 @@ func (p *Parser) readCOD() error {
 	return nil
 }
 
+// checkCodingStyle checks the SPcod or SPcoc fields that size the
+// decomposition and code-blocks against their ranges in ISO/IEC 15444-1
+// Table A.15: at most 32 decomposition levels, and code-block width and
+// height exponent fields of at most 8. The limit of 8 on their sum is not
+// enforced, since HTJ2K encoders write 128x128 code-blocks.
+func checkCodingStyle(numDecomp, cbWidth, cbHeight uint8) error {
+	if numDecomp > 32 {
+		return fmt.Errorf("invalid number of decomposition levels: %d", numDecomp)
+	}
+	if cbWidth > 8 || cbHeight > 8 {
+		return fmt.Errorf("invalid code-block size exponents: %d, %d", cbWidth, cbHeight)
+	}
+	return nil
+}
+
 // readCOC reads the COC (coding style component) marker segment.
 func (p *Parser) readCOC() error {
 	length, err := p.readUint16()
@@ -427,6 +618,9 @@ func (p *Parser) readCOC() error {
 		return err
 	}
 	coc.WaveletTransform = wavelet
+	if err := checkCodingStyle(numDecomp, cbWidth, cbHeight); err != nil {
+		return err
+	}
 
 	// Calculate remaining bytes for precinct sizes
 	baseLen := 7
@@ -457,7 +651,7 @@ func (p *Parser) readCOC() error {
 
 // readQCD reads the QCD (quantization default) marker segment.
 func (p *Parser) readQCD() error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(3)
 	if err != nil {
 		return err
 	}
@@ -470,14 +664,14 @@ func (p *Parser) readQCD() error {
 	p.header.Quantization.NumGuardBits = sqcd >> 5
 
 	// Read step sizes based on quantization style
-	remaining := int(length) - 3
+	remaining := length - 3
 	style := sqcd & 0x1F
 
 	switch style {
 	case QuantizationNone:
 		// No quantization: one exponent byte per subband
 		numBands := remaining
-		p.header.Quantization.StepSizes = make([]StepSize, numBands)
+		p.header.Quantization.StepSizes = resize(p.header.Quantization.StepSizes, numBands)
 		for i := 0; i < numBands; i++ {
 			exp, err := p.readByte()
 			if err != nil {
@@ -494,15 +688,15 @@ func (p *Parser) readQCD() error {
 		if err != nil {
 			return err
 		}
-		p.header.Quantization.StepSizes = []StepSize{{
+		p.header.Quantization.StepSizes = append(p.header.Quantization.StepSizes[:0], StepSize{
 			Mantissa: val & 0x07FF,
 			Exponent: uint8(val >> 11),
-		}}
+		})
 
 	case QuantizationScalarExpounded:
 		// Scalar expounded: step size per subband
 		numBands := remaining / 2
-		p.header.Quantization.StepSizes = make([]StepSize, numBands)
+		p.header.Quantization.StepSizes = resize(p.header.Quantization.StepSizes, numBands)
 		for i := 0; i < numBands; i++ {
 			val, err := p.readUint16()
 			if err != nil {
@@ -554,6 +748,9 @@ func (p *Parser) readQCC() error {
 	}
 
 	remaining := int(length) - headerBytes - 1
+	if remaining < 0 {
+		return fmt.Errorf("invalid QCC length: %d", length)
+	}
 	style := sqcc & 0x1F
 
 	switch style {
@@ -599,6 +796,54 @@ func (p *Parser) readQCC() error {
 	return nil
 }
 
+// readRGN reads the RGN marker. Only the implicit (max-shift) ROI style
+// is defined by Part 1.
+func (p *Parser) readRGN() error {
+	length, err := p.readUint16()
+	if err != nil {
+		return err
+	}
+	compSize := 1
+	if p.header.NumComponents >= 257 {
+		compSize = 2
+	}
+	if int(length) != 4+compSize {
+		return fmt.Errorf("invalid RGN marker length: %d", length)
+	}
+
+	var compIndex uint16
+	if compSize == 1 {
+		b, err := p.readByte()
+		if err != nil {
+			return err
+		}
+		compIndex = uint16(b)
+	} else {
+		compIndex, err = p.readUint16()
+		if err != nil {
+			return err
+		}
+	}
+	if compIndex >= p.header.NumComponents {
+		return fmt.Errorf("RGN component index %d out of range", compIndex)
+	}
+
+	style, err := p.readByte()
+	if err != nil {
+		return err
+	}
+	if style != 0 {
+		return fmt.Errorf("unsupported RGN ROI style: %d", style)
+	}
+	shift, err := p.readByte()
+	if err != nil {
+		return err
+	}
+
+	p.header.ROIShifts[compIndex] = shift
+	return nil
+}
+
 // readPOC reads the POC (progression order change) marker segment.
 func (p *Parser) readPOC() error {
 	length, err := p.readUint16()
@@ -750,7 +995,7 @@ func (p *Parser) readTLM() error {
 
 // readPLM reads the PLM (packet lengths, main header) marker segment.
 func (p *Parser) readPLM() error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(3)
 	if err != nil {
 		return err
 	}
@@ -761,12 +1006,15 @@ func (p *Parser) readPLM() error {
 	}
 
 	// Read packet lengths (variable length encoded)
-	remaining := int(length) - 3
+	remaining := length - 3
 	for remaining > 0 {
 		val, n, err := p.readVariableLength()
 		if err != nil {
 			return err
 		}
+		if n > remaining {
+			return fmt.Errorf("PLM packet length overruns the segment")
+		}
 		p.header.PacketLengths = append(p.header.PacketLengths, val)
 		remaining -= n
 	}
@@ -774,6 +1022,34 @@ func (p *Parser) readPLM() error {
 	return nil
 }
 
+// readPLT reads a PLT (packet lengths, tile-part header) marker segment,
+// appending its lengths to lengths.
+func (p *Parser) readPLT(lengths []uint32) ([]uint32, error) {
+	length, err := p.readSegmentLength(3)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip Zplt (index)
+	if _, err := p.readByte(); err != nil {
+		return nil, err
+	}
+
+	remaining := length - 3
+	for remaining > 0 {
+		val, n, err := p.readVariableLength()
+		if err != nil {
+			return nil, err
+		}
+		if n > remaining {
+			return nil, fmt.Errorf("PLT packet length overruns the segment")
+		}
+		lengths = append(lengths, val)
+		remaining -= n
+	}
+	return lengths, nil
+}
+
 // readVariableLength reads a variable-length encoded value.
 func (p *Parser) readVariableLength() (uint32, int, error) {
 	var value uint32
@@ -794,7 +1070,7 @@ func (p *Parser) readVariableLength() (uint32, int, error) {
 
 // readPPM reads the PPM (packed packet headers, main header) marker segment.
 func (p *Parser) readPPM() error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(3)
 	if err != nil {
 		return err
 	}
@@ -805,7 +1081,7 @@ func (p *Parser) readPPM() error {
 	}
 
 	// Read packed data
-	data, err := p.readBytes(int(length) - 3)
+	data, err := p.readBytes(length - 3)
 	if err != nil {
 		return err
 	}
@@ -816,13 +1092,36 @@ func (p *Parser) readPPM() error {
 
 // readCRG reads the CRG (component registration) marker segment.
 func (p *Parser) readCRG() error {
-	// We don't currently use CRG data, just skip it
-	return p.skipMarkerSegment()
+	length, err := p.readUint16()
+	if err != nil {
+		return err
+	}
+	if length < 2 || int(length) < 2+4*len(p.header.ComponentInfo) {
+		return fmt.Errorf("CRG marker too short for %d components: %d bytes", len(p.header.ComponentInfo), length)
+	}
+
+	// One Xcrg, Ycrg pair per component
+	for i := range p.header.ComponentInfo {
+		c := &p.header.ComponentInfo[i]
+		if c.RegistrationX, err = p.readUint16(); err != nil {
+			return err
+		}
+		if c.RegistrationY, err = p.readUint16(); err != nil {
+			return err
+		}
+	}
+
+	if extra := int(length) - 2 - 4*len(p.header.ComponentInfo); extra > 0 {
+		if _, err := p.readBytes(extra); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // readCOM reads the COM (comment) marker segment.
 func (p *Parser) readCOM() error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(4)
 	if err != nil {
 		return err
 	}
@@ -833,13 +1132,17 @@ func (p *Parser) readCOM() error {
 	}
 	p.header.CommentType = rcom
 
-	data, err := p.readBytes(int(length) - 4)
+	data, err := p.readBytes(length - 4)
 	if err != nil {
 		return err
 	}
 
-	if rcom == CommentLatin1 {
+	switch rcom {
+	case CommentLatin1:
 		p.header.Comment = string(data)
+		p.header.Comments = append(p.header.Comments, p.header.Comment)
+	case CommentBinary:
+		p.header.BinaryComments = append(p.header.BinaryComments, data)
 	}
 
 	return nil
@@ -879,6 +1182,11 @@ func (p *Parser) readCAP() error {
 				return err
 			}
 		}
+		if remaining%2 != 0 {
+			if _, err := p.readByte(); err != nil {
+				return err
+			}
+		}
 	}
 
 	p.header.Capabilities = cap
@@ -901,10 +1209,8 @@ func (p *Parser) ReadTilePartHeader() (*TilePartHeader, error) {
 		return nil, fmt.Errorf("invalid SOT length: %d", length)
 	}
 
-	tph := &TilePartHeader{
-		ComponentCodingStyles: make(map[uint16]CodingStyleComponent),
-		ComponentQuantization: make(map[uint16]QuantizationComponent),
-	}
+	tph := p.newTilePartHeader()
+	p.tilePart = tph
 
 	// Read tile index
 	tph.TileIndex, err = p.readUint16()
@@ -970,17 +1276,110 @@ func (p *Parser) ReadTilePartHeader() (*TilePartHeader, error) {
 				return nil, err
 			}
 			tph.PackedPacketHeaders = append(tph.PackedPacketHeaders, data...)
+		case PLT:
+			lengths, err := p.readPLT(tph.PacketLengths)
+			if err != nil {
+				return nil, err
+			}
+			tph.PacketLengths = lengths
 		case SOD:
 			p.state = stateData
 			return tph, nil
 		default:
-			if err := p.skipMarkerSegment(); err != nil {
-				return nil, err
+			if err := p.skipUnknownMarker(marker); err != nil {
+				return nil, fmt.Errorf("failed to skip marker 0x%04X: %w", marker, err)
 			}
 		}
 	}
 }
 
+// SeekToTile positions rs at the first tile-part of tile tileIndex, so
+// that the next ReadTilePartHeader call reads its header. rs must be the
+// reader the parser was created on, and ReadHeader must have been called.
+// The first call must be made before anything else is read from rs, as it
+// uses the position of rs to locate the start of the codestream; tile
+// data may be read directly from rs between later calls.
+//
+// When the main header has TLM markers, the offset is computed from the
+// tile-part lengths they list and reached with a single seek. Otherwise
+// the tile-part headers are read in turn, seeking past each tile-part's
+// data, until the tile is found.
+func (p *Parser) SeekToTile(rs io.ReadSeeker, tileIndex int) error {
+	if p.state != stateMainHeader && p.state != stateTilePartHeader && p.state != stateData {
+		return fmt.Errorf("main header not read")
+	}
+	numTiles := int(p.header.NumTilesX) * int(p.header.NumTilesY)
+	if tileIndex < 0 || tileIndex >= numTiles {
+		return fmt.Errorf("tile index %d out of range [0, %d)", tileIndex, numTiles)
+	}
+
+	if !p.baseKnown {
+		// The codestream starts p.offset bytes before the current position.
+		cur, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		p.base = cur - p.offset
+		p.baseKnown = true
+	}
+	start := p.base
+	pos := p.firstTilePart
+
+	if len(p.header.TileLengths) > 0 {
+		for _, tl := range p.header.TileLengths {
+			if int(tl.TileIndex) == tileIndex {
+				return p.seekTilePart(rs, start, pos)
+			}
+			pos += int64(tl.Length)
+		}
+		return fmt.Errorf("tile %d not listed in TLM", tileIndex)
+	}
+
+	for {
+		if err := p.seekTilePart(rs, start, pos); err != nil {
+			return fmt.Errorf("tile %d not found: %w", tileIndex, err)
+		}
+		// Lsot, Isot, Psot
+		if _, err := p.readUint16(); err != nil {
+			return err
+		}
+		isot, err := p.readUint16()
+		if err != nil {
+			return err
+		}
+		psot, err := p.readUint32()
+		if err != nil {
+			return err
+		}
+		if int(isot) == tileIndex {
+			return p.seekTilePart(rs, start, pos)
+		}
+		if psot == 0 {
+			// The last tile-part extends to EOC
+			return fmt.Errorf("tile %d not found", tileIndex)
+		}
+		if psot < 14 {
+			return fmt.Errorf("invalid tile-part length %d at offset %d", psot, pos)
+		}
+		pos += int64(psot)
+	}
+}
+
+// seekTilePart seeks rs to the tile-part at codestream offset pos, where
+// the codestream starts at start, and reads its SOT marker.
+func (p *Parser) seekTilePart(rs io.ReadSeeker, start, pos int64) error {
+	if _, err := rs.Seek(start+pos, io.SeekStart); err != nil {
+		return err
+	}
+	p.ClearTilePartState()
+	p.offset = pos
+	p.state = stateMainHeader
+	if err := p.expectMarker(SOT); err != nil {
+		return fmt.Errorf("at offset %d: %w", pos, err)
+	}
+	return nil
+}
+
 // readCODInto reads COD marker data into the provided struct.
 func (p *Parser) readCODInto(cod *CodingStyleDefault) error {
 	length, err := p.readUint16()
@@ -1033,6 +1432,9 @@ func (p *Parser) readCODInto(cod *CodingStyleDefault) error {
 	if err != nil {
 		return err
 	}
+	if err := checkCodingStyle(cod.NumDecompositions, cod.CodeBlockWidthExp, cod.CodeBlockHeightExp); err != nil {
+		return err
+	}
 
 	if scod&CodingStylePrecincts != 0 {
 		numPrecinct := int(length) - 12
@@ -1106,6 +1508,9 @@ func (p *Parser) readCOCInto(m map[uint16]CodingStyleComponent) error {
 	if err != nil {
 		return err
 	}
+	if err := checkCodingStyle(coc.NumDecompositions, coc.CodeBlockWidthExp, coc.CodeBlockHeightExp); err != nil {
+		return err
+	}
 
 	baseLen := 7
 	if p.header.NumComponents >= 257 {
@@ -1135,7 +1540,7 @@ func (p *Parser) readCOCInto(m map[uint16]CodingStyleComponent) error {
 
 // readQCDInto reads QCD marker data into the provided struct.
 func (p *Parser) readQCDInto(qcd *QuantizationDefault) error {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(3)
 	if err != nil {
 		return err
 	}
@@ -1147,7 +1552,7 @@ func (p *Parser) readQCDInto(qcd *QuantizationDefault) error {
 	qcd.QuantizationStyle = sqcd & 0x1F
 	qcd.NumGuardBits = sqcd >> 5
 
-	remaining := int(length) - 3
+	remaining := length - 3
 	style := sqcd & 0x1F
 
 	switch style {
@@ -1226,6 +1631,9 @@ func (p *Parser) readQCCInto(m map[uint16]QuantizationComponent) error {
 	}
 
 	remaining := int(length) - headerBytes - 1
+	if remaining < 0 {
+		return fmt.Errorf("invalid QCC length: %d", length)
+	}
 	style := sqcc & 0x1F
 
 	switch style {
@@ -1341,7 +1749,7 @@ func (p *Parser) readPOCEntries() ([]ProgressionOrderChange, error) {
 
 // readPPT reads the PPT (packed packet headers, tile-part) marker segment.
 func (p *Parser) readPPT() ([]byte, error) {
-	length, err := p.readUint16()
+	length, err := p.readSegmentLength(3)
 	if err != nil {
 		return nil, err
 	}
@@ -1351,5 +1759,5 @@ func (p *Parser) readPPT() ([]byte, error) {
 		return nil, err
 	}
 
-	return p.readBytes(int(length) - 3)
+	return p.readBytes(length - 3)
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"testing"
 )
 
@@ -68,6 +70,8 @@ func TestMarker_String(t *testing.T) {
 		{MCT, "MCT"},
 		{MCC, "MCC"},
 		{MCO, "MCO"},
+		{DCO, "DCO"},
+		{ATK, "ATK"},
 		{0x0000, "UNKNOWN"},
 	}
 
@@ -88,6 +92,8 @@ func TestMarker_HasLength(t *testing.T) {
 		{SOD, false},
 		{EOC, false},
 		{EPH, false},
+		{0xFF30, false},
+		{0xFF3F, false},
 		{SIZ, true},
 		{COD, true},
 		{QCD, true},
@@ -323,6 +329,26 @@ func TestHeader_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "offsets",
+			header:  offsetHeader(5, 4, 3, 1),
+			wantErr: false,
+		},
+		{
+			name:    "image offset outside grid",
+			header:  offsetHeader(100, 0, 0, 0),
+			wantErr: true,
+		},
+		{
+			name:    "tile offset past image offset",
+			header:  offsetHeader(5, 4, 6, 1),
+			wantErr: true,
+		},
+		{
+			name:    "first tile before image area",
+			header:  offsetHeader(50, 0, 10, 0),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -335,6 +361,23 @@ func TestHeader_Validate(t *testing.T) {
 	}
 }
 
+// offsetHeader returns a valid 100x100 header with 32x32 tiles and the
+// given image and tile offsets.
+func offsetHeader(xo, yo, xto, yto uint32) *Header {
+	return &Header{
+		ImageWidth:    100,
+		ImageHeight:   100,
+		ImageXOffset:  xo,
+		ImageYOffset:  yo,
+		TileWidth:     32,
+		TileHeight:    32,
+		TileXOffset:   xto,
+		TileYOffset:   yto,
+		NumComponents: 1,
+		ComponentInfo: []ComponentInfo{{BitDepth: 7, SubsamplingX: 1, SubsamplingY: 1}},
+	}
+}
+
 func TestHeader_CalculateDerivedValues(t *testing.T) {
 	h := &Header{
 		ImageWidth:  100,
@@ -858,6 +901,33 @@ func TestParser_ReadPPM(t *testing.T) {
 	}
 }
 
+func TestParser_ReadCAP(t *testing.T) {
+	buf := createBaseCodestream(1)
+	addCOD(buf, false)
+	addQCD(buf, QuantizationScalarDerived)
+
+	// CAP signalling Part 15, with its Ccap15 value
+	binary.Write(buf, binary.BigEndian, uint16(CAP))
+	binary.Write(buf, binary.BigEndian, uint16(8))          // Length
+	binary.Write(buf, binary.BigEndian, uint32(0x00020000)) // Pcap
+	binary.Write(buf, binary.BigEndian, uint16(0x0003))     // Ccap15
+
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+
+	parser := NewParser(bytes.NewReader(buf.Bytes()))
+	header, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+
+	if !header.Capabilities.IsHTJ2K() || !header.IsHTJ2K() {
+		t.Errorf("Pcap %#08x not reported as HTJ2K", header.Capabilities.Pcap)
+	}
+	if len(header.Capabilities.CCAPi) != 1 || header.Capabilities.CCAPi[0] != 3 {
+		t.Errorf("CCAPi = %v, want [3]", header.Capabilities.CCAPi)
+	}
+}
+
 func TestParser_ReadCOM(t *testing.T) {
 	buf := createBaseCodestream(1)
 	addCOD(buf, false)
@@ -912,6 +982,9 @@ func TestParser_ReadCOMBinary(t *testing.T) {
 	if header.CommentType != CommentBinary {
 		t.Errorf("CommentType = %d, want %d", header.CommentType, CommentBinary)
 	}
+	if len(header.BinaryComments) != 1 || !bytes.Equal(header.BinaryComments[0], []byte{0x00, 0x01, 0x02, 0x03}) {
+		t.Errorf("BinaryComments = %v, want [[0 1 2 3]]", header.BinaryComments)
+	}
 }
 
 func TestParser_ReadCRG(t *testing.T) {
@@ -919,11 +992,11 @@ func TestParser_ReadCRG(t *testing.T) {
 	addCOD(buf, false)
 	addQCD(buf, QuantizationScalarDerived)
 
-	// Add CRG marker (component registration - we skip it)
+	// Add CRG marker (component registration)
 	binary.Write(buf, binary.BigEndian, uint16(CRG))
-	binary.Write(buf, binary.BigEndian, uint16(6)) // Length
-	binary.Write(buf, binary.BigEndian, uint16(0)) // Xcrg
-	binary.Write(buf, binary.BigEndian, uint16(0)) // Ycrg
+	binary.Write(buf, binary.BigEndian, uint16(6))     // Length
+	binary.Write(buf, binary.BigEndian, uint16(32768)) // Xcrg
+	binary.Write(buf, binary.BigEndian, uint16(16384)) // Ycrg
 
 	binary.Write(buf, binary.BigEndian, uint16(SOT))
 
@@ -933,9 +1006,8 @@ func TestParser_ReadCRG(t *testing.T) {
 		t.Fatalf("ReadHeader() error: %v", err)
 	}
 
-	// CRG is skipped, just verify we can parse past it
-	if header == nil {
-		t.Error("Header should not be nil")
+	if c := header.ComponentInfo[0]; c.RegistrationX != 32768 || c.RegistrationY != 16384 {
+		t.Errorf("registration = (%d, %d), want (32768, 16384)", c.RegistrationX, c.RegistrationY)
 	}
 }
 
@@ -990,6 +1062,52 @@ func TestParser_ReadTilePartHeader(t *testing.T) {
 	}
 }
 
+func TestParser_ReadTilePartHeaderVendorMarkers(t *testing.T) {
+	// tilePart returns a codestream whose tile-part header holds the
+	// given bytes between SOT and SOD.
+	tilePart := func(markers ...byte) []byte {
+		data := createCodestreamWithTilePart()
+		sod := data[len(data)-2:]
+		return append(append(data[:len(data)-2:len(data)-2], markers...), sod...)
+	}
+
+	tests := []struct {
+		name    string
+		markers []byte
+		wantErr bool
+	}{
+		{"delimiter without segment", []byte{0xFF, 0x30}, false},
+		{"reserved range", []byte{0xFF, 0x3F, 0xFF, 0x35}, false},
+		{"unknown segment", []byte{0xFF, 0x6A, 0x00, 0x05, 0x01, 0x02, 0x03}, false},
+		{"mixed", []byte{0xFF, 0x31, 0xFF, 0x6A, 0x00, 0x02, 0xFF, 0x32}, false},
+		{"EOC", []byte{0xFF, 0xD9}, true},
+		{"not a marker", []byte{0x12, 0x34}, true},
+		{"stuffed byte", []byte{0xFF, 0x00}, true},
+		{"segment past end", []byte{0xFF, 0x6A, 0x10, 0x00}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewParser(bytes.NewReader(tilePart(tt.markers...)))
+			if _, err := parser.ReadHeader(); err != nil {
+				t.Fatalf("ReadHeader() error: %v", err)
+			}
+			tph, err := parser.ReadTilePartHeader()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("ReadTilePartHeader(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadTilePartHeader() error: %v", err)
+			}
+			if tph.TilePartLength != 1000 {
+				t.Errorf("TilePartLength = %d, want 1000", tph.TilePartLength)
+			}
+		})
+	}
+}
+
 func TestParser_ReadTilePartHeaderWithCOD(t *testing.T) {
 	buf := createBaseCodestream(3)
 	addCOD(buf, false)
@@ -1658,6 +1776,60 @@ func TestParser_skipMarkerSegment_InvalidLength(t *testing.T) {
 	}
 }
 
+// TestParser_AbsurdSegmentLengths feeds main header marker segments
+// whose length field disagrees with the data that follows. Every one must
+// fail cleanly, and lengths beyond the end of the input must be reported
+// as unexpected EOF rather than read.
+func TestParser_AbsurdSegmentLengths(t *testing.T) {
+	markers := []Marker{COM, PPM, PLM, 0xFF99}
+	lengths := []uint16{0, 1, 2, 3, 0x7FFF, 0xFFFE, 0xFFFF}
+	for _, m := range markers {
+		for _, length := range lengths {
+			buf := createBaseCodestream(1)
+			addCOD(buf, false)
+			addQCD(buf, QuantizationScalarDerived)
+			binary.Write(buf, binary.BigEndian, uint16(m))
+			binary.Write(buf, binary.BigEndian, length)
+			buf.Write([]byte{0x00, 0x00, 0x80, 0x80}) // a few bytes of payload
+
+			_, err := NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+			if err == nil {
+				t.Errorf("%v with length %d: expected error", m, length)
+				continue
+			}
+			if length > 6 && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%v with length %d: error %v, want io.ErrUnexpectedEOF", m, length, err)
+			}
+		}
+	}
+}
+
+func TestParser_CODOutOfRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int // of the byte within the COD segment
+		value  byte
+	}{
+		{"decomposition levels", 9, 33},
+		{"code-block width", 10, 9},
+		{"code-block height", 11, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := createBaseCodestream(1)
+			start := buf.Len()
+			addCOD(buf, false)
+			addQCD(buf, QuantizationScalarDerived)
+			binary.Write(buf, binary.BigEndian, uint16(SOT))
+			buf.Bytes()[start+tt.offset] = tt.value
+
+			if _, err := NewParser(bytes.NewReader(buf.Bytes())).ReadHeader(); err == nil {
+				t.Errorf("ReadHeader() with %s %d: expected error", tt.name, tt.value)
+			}
+		})
+	}
+}
+
 // Test Header.Validate edge cases
 func TestHeader_Validate_ZeroHeight(t *testing.T) {
 	h := &Header{
@@ -3428,3 +3600,467 @@ func TestParser_ReadTilePartHeader_SkipUnknown_Error(t *testing.T) {
 		t.Error("Expected error when skipping unknown marker in tile-part header")
 	}
 }
+
+func TestParser_Reset(t *testing.T) {
+	// The first codestream has TLM and tile-part state that must not leak
+	// into the second.
+	first := createTiledCodestream(true)
+	parser := NewParser(bytes.NewReader(first))
+	header, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.TileLengths) != 4 {
+		t.Fatalf("first header has %d TLM entries, want 4", len(header.TileLengths))
+	}
+	if _, err := parser.ReadTilePartHeader(); err != nil {
+		t.Fatalf("ReadTilePartHeader() error: %v", err)
+	}
+
+	parser.Reset(bytes.NewReader(createCodestreamWithTilePart()))
+	second, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() after Reset error: %v", err)
+	}
+
+	if second != header {
+		t.Error("Reset() did not reuse the Header")
+	}
+	if second.ImageWidth != 64 || second.NumComponents != 3 || len(second.ComponentInfo) != 3 {
+		t.Errorf("second header = %d wide with %d components (%d infos), want 64 wide with 3",
+			second.ImageWidth, second.NumComponents, len(second.ComponentInfo))
+	}
+	if second.NumTilesX != 1 || len(second.TileLengths) != 0 {
+		t.Errorf("second header kept state: %d tiles across, %d TLM entries", second.NumTilesX, len(second.TileLengths))
+	}
+
+	tph, err := parser.ReadTilePartHeader()
+	if err != nil {
+		t.Fatalf("ReadTilePartHeader() after Reset error: %v", err)
+	}
+	if tph.TilePartLength != 1000 {
+		t.Errorf("TilePartLength = %d, want 1000", tph.TilePartLength)
+	}
+}
+
+func TestParser_ResetMatchesNewParser(t *testing.T) {
+	streams := [][]byte{
+		createTiledCodestream(true),
+		createCodestreamWithTilePart(),
+		createMinimalCodestream(),
+		createTiledCodestream(false),
+	}
+
+	parser := NewParser(bytes.NewReader(nil))
+	for i, data := range streams {
+		parser.Reset(bytes.NewReader(data))
+		got, err := parser.ReadHeader()
+		if err != nil {
+			t.Fatalf("stream %d: ReadHeader() after Reset error: %v", i, err)
+		}
+		want, err := NewParser(bytes.NewReader(data)).ReadHeader()
+		if err != nil {
+			t.Fatalf("stream %d: ReadHeader() error: %v", i, err)
+		}
+		if fmt.Sprint(*got) != fmt.Sprint(*want) {
+			t.Errorf("stream %d: header after Reset = %+v, want %+v", i, *got, *want)
+		}
+	}
+}
+
+func TestParser_ClearTilePartState(t *testing.T) {
+	// Two tile-parts: the first carries a COC override and PPT data
+	buf := createBaseCodestream(3)
+	addCOD(buf, false)
+	addQCD(buf, QuantizationScalarDerived)
+
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+	binary.Write(buf, binary.BigEndian, uint16(10))
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	buf.WriteByte(0)
+	buf.WriteByte(2)
+	binary.Write(buf, binary.BigEndian, uint16(COC))
+	binary.Write(buf, binary.BigEndian, uint16(9))
+	buf.WriteByte(1) // Ccoc
+	buf.WriteByte(0) // Scoc
+	buf.WriteByte(3) // Decomposition levels
+	buf.WriteByte(4) // Code-block width
+	buf.WriteByte(4) // Code-block height
+	buf.WriteByte(0) // Code-block style
+	buf.WriteByte(1) // Wavelet transform
+	binary.Write(buf, binary.BigEndian, uint16(PPT))
+	binary.Write(buf, binary.BigEndian, uint16(5))
+	buf.WriteByte(0) // Zppt
+	buf.Write([]byte{0xAA, 0xBB})
+	binary.Write(buf, binary.BigEndian, uint16(SOD))
+
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+	binary.Write(buf, binary.BigEndian, uint16(10))
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	buf.WriteByte(1)
+	buf.WriteByte(2)
+	binary.Write(buf, binary.BigEndian, uint16(SOD))
+
+	data := buf.Bytes()
+	parser := NewParser(bytes.NewReader(data))
+	header, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+
+	tph, err := parser.ReadTilePartHeader()
+	if err != nil {
+		t.Fatalf("ReadTilePartHeader() error: %v", err)
+	}
+	if len(tph.ComponentCodingStyles) != 1 || len(tph.PackedPacketHeaders) != 2 {
+		t.Fatalf("first tile-part: %d COC, %d PPT bytes; want 1, 2",
+			len(tph.ComponentCodingStyles), len(tph.PackedPacketHeaders))
+	}
+
+	parser.ClearTilePartState()
+	if parser.Header() != header || header.ImageWidth != 64 {
+		t.Error("ClearTilePartState() modified the main header")
+	}
+
+	// Skip the SOT marker code preceding the next tile-part header
+	if _, err := parser.readMarker(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := parser.ReadTilePartHeader()
+	if err != nil {
+		t.Fatalf("second ReadTilePartHeader() error: %v", err)
+	}
+	if next != tph {
+		t.Error("ReadTilePartHeader() did not reuse the cleared tile-part header")
+	}
+	if next.TilePartIndex != 1 {
+		t.Errorf("TilePartIndex = %d, want 1", next.TilePartIndex)
+	}
+	if len(next.ComponentCodingStyles) != 0 || len(next.PackedPacketHeaders) != 0 || next.CodingStyle != nil {
+		t.Errorf("second tile-part inherited state: %d COC, %d PPT bytes",
+			len(next.ComponentCodingStyles), len(next.PackedPacketHeaders))
+	}
+}
+
+// parserSink keeps NewParser results from being optimised away.
+var parserSink *Parser
+
+func TestParser_ResetAllocations(t *testing.T) {
+	data := createMinimalCodestream()
+	r := bytes.NewReader(data)
+	parser := NewParser(r)
+
+	newAllocs := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		parserSink = NewParser(r)
+	})
+	resetAllocs := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		parser.Reset(r)
+	})
+	if resetAllocs >= newAllocs {
+		t.Errorf("Reset() allocations = %v, want fewer than NewParser() (%v)", resetAllocs, newAllocs)
+	}
+}
+
+// benchmarkTileParts is the number of tile-parts parsed per iteration.
+const benchmarkTileParts = 1000
+
+func BenchmarkParser_NewPerTilePart(b *testing.B) {
+	data := createCodestreamWithTilePart()
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkTileParts; j++ {
+			r.Reset(data)
+			p := NewParser(r)
+			if _, err := p.ReadHeader(); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := p.ReadTilePartHeader(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParser_ResetPerTilePart(b *testing.B) {
+	data := createCodestreamWithTilePart()
+	r := bytes.NewReader(data)
+	p := NewParser(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkTileParts; j++ {
+			r.Reset(data)
+			p.Reset(r)
+			if _, err := p.ReadHeader(); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := p.ReadTilePartHeader(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// addSegment appends marker m with its length and payload.
+func addSegment(buf *bytes.Buffer, m Marker, payload []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(m))
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+}
+
+func TestParser_ReadMCT(t *testing.T) {
+	buf := createBaseCodestream(6)
+	addCOD(buf, false)
+	addQCD(buf, QuantizationScalarDerived)
+
+	// 6x6 float32 decorrelation array 1, split over two MCT segments
+	var matrix []byte
+	for i := 0; i < 36; i++ {
+		matrix = binary.BigEndian.AppendUint32(matrix, math.Float32bits(float32(i)/4))
+	}
+	imct := uint16(2)<<10 | uint16(MCTArrayDecorrelation)<<8 | 1
+	first := binary.BigEndian.AppendUint16(nil, 0)
+	first = binary.BigEndian.AppendUint16(first, imct)
+	first = binary.BigEndian.AppendUint16(first, 1) // Ymct
+	addSegment(buf, MCT, append(first, matrix[:80]...))
+	second := binary.BigEndian.AppendUint16(nil, 1)
+	second = binary.BigEndian.AppendUint16(second, imct)
+	addSegment(buf, MCT, append(second, matrix[80:]...))
+
+	// int16 offset array 2
+	offsets := binary.BigEndian.AppendUint16(nil, 0)
+	offsets = binary.BigEndian.AppendUint16(offsets, uint16(MCTArrayOffset)<<8|2)
+	offsets = binary.BigEndian.AppendUint16(offsets, 0)
+	for i := 0; i < 6; i++ {
+		offsets = binary.BigEndian.AppendUint16(offsets, uint16(int16(i-3)))
+	}
+	addSegment(buf, MCT, offsets)
+
+	// MCC stage 7: one decorrelation collection over components 0-5
+	mcc := []byte{0, 0, 7, 0, 0, 0, 1, MCCDecorrelation, 0, 6, 0, 1, 2, 3, 4, 5, 0x80, 6}
+	for i := 0; i < 6; i++ {
+		mcc = binary.BigEndian.AppendUint16(mcc, uint16(5-i))
+	}
+	mcc = append(mcc, 0, 2, 1) // offsets 2, matrix 1, irreversible
+	addSegment(buf, MCC, mcc)
+	addSegment(buf, MCO, []byte{1, 7})
+
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+
+	header, err := NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+
+	if len(header.MCTArrays) != 2 {
+		t.Fatalf("got %d MCT arrays, want 2", len(header.MCTArrays))
+	}
+	m := header.Array(1)
+	if m == nil || m.Type != MCTArrayDecorrelation || len(m.Values) != 36 || m.Values[35] != 8.75 {
+		t.Errorf("array 1 = %+v, want 36 decorrelation values ending in 8.75", m)
+	}
+	o := header.Array(2)
+	if o == nil || o.Type != MCTArrayOffset || len(o.Values) != 6 || o.Values[0] != -3 {
+		t.Errorf("array 2 = %+v, want 6 offsets starting at -3", o)
+	}
+
+	s := header.Stage(7)
+	if s == nil || len(s.Collections) != 1 {
+		t.Fatalf("stage 7 = %+v, want one collection", s)
+	}
+	c := s.Collections[0]
+	if c.Type != MCCDecorrelation || c.MatrixIndex != 1 || c.OffsetIndex != 2 || c.Reversible {
+		t.Errorf("collection = %+v, want irreversible decorrelation with arrays 1 and 2", c)
+	}
+	if len(c.Inputs) != 6 || c.Inputs[5] != 5 || len(c.Outputs) != 6 || c.Outputs[0] != 5 {
+		t.Errorf("collection inputs %v outputs %v, want 0-5 and 5-0", c.Inputs, c.Outputs)
+	}
+	if len(header.MCTStageOrder) != 1 || header.MCTStageOrder[0] != 7 {
+		t.Errorf("MCTStageOrder = %v, want [7]", header.MCTStageOrder)
+	}
+}
+
+func TestParser_ReadRGN(t *testing.T) {
+	buf := createBaseCodestream(3)
+	addCOD(buf, false)
+	addQCD(buf, QuantizationScalarDerived)
+	addSegment(buf, RGN, []byte{2, 0, 7}) // component 2, implicit, shift 7
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+
+	header, err := NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.ROIShifts) != 1 || header.ROIShifts[2] != 7 {
+		t.Errorf("ROIShifts = %v, want map[2:7]", header.ROIShifts)
+	}
+
+	for _, payload := range [][]byte{{3, 0, 7}, {0, 1, 7}, {0, 0}} {
+		buf := createBaseCodestream(3)
+		addCOD(buf, false)
+		addQCD(buf, QuantizationScalarDerived)
+		addSegment(buf, RGN, payload)
+		binary.Write(buf, binary.BigEndian, uint16(SOT))
+		if _, err := NewParser(bytes.NewReader(buf.Bytes())).ReadHeader(); err == nil {
+			t.Errorf("ReadHeader() with RGN %v succeeded, want error", payload)
+		}
+	}
+}
+
+// createTiledCodestream builds a 64x64 codestream with four 32x32 tiles,
+// written in the order 2, 0, 3, 1. Each tile's data is filled with its
+// index and is 10*(index+1) bytes long. If withTLM is set the main header
+// lists the tile-part lengths.
+func createTiledCodestream(withTLM bool) []byte {
+	order := []int{2, 0, 3, 1}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(SOC))
+	binary.Write(&buf, binary.BigEndian, uint16(SIZ))
+	binary.Write(&buf, binary.BigEndian, uint16(41))
+	binary.Write(&buf, binary.BigEndian, uint16(0))  // Rsiz
+	binary.Write(&buf, binary.BigEndian, uint32(64)) // Xsiz
+	binary.Write(&buf, binary.BigEndian, uint32(64)) // Ysiz
+	binary.Write(&buf, binary.BigEndian, uint32(0))  // XOsiz
+	binary.Write(&buf, binary.BigEndian, uint32(0))  // YOsiz
+	binary.Write(&buf, binary.BigEndian, uint32(32)) // XTsiz
+	binary.Write(&buf, binary.BigEndian, uint32(32)) // YTsiz
+	binary.Write(&buf, binary.BigEndian, uint32(0))  // XTOsiz
+	binary.Write(&buf, binary.BigEndian, uint32(0))  // YTOsiz
+	binary.Write(&buf, binary.BigEndian, uint16(1))  // Csiz
+	buf.WriteByte(7)                                 // Ssiz
+	buf.WriteByte(1)                                 // XRsiz
+	buf.WriteByte(1)                                 // YRsiz
+	addCOD(&buf, false)
+	addQCD(&buf, QuantizationScalarDerived)
+
+	if withTLM {
+		// ST=2 (2-byte tile index), SP=1 (4-byte length)
+		binary.Write(&buf, binary.BigEndian, uint16(TLM))
+		binary.Write(&buf, binary.BigEndian, uint16(4+6*len(order)))
+		buf.WriteByte(0)    // Ztlm
+		buf.WriteByte(0x60) // Stlm
+		for _, tile := range order {
+			binary.Write(&buf, binary.BigEndian, uint16(tile))
+			binary.Write(&buf, binary.BigEndian, uint32(14+10*(tile+1)))
+		}
+	}
+
+	for _, tile := range order {
+		binary.Write(&buf, binary.BigEndian, uint16(SOT))
+		binary.Write(&buf, binary.BigEndian, uint16(10))
+		binary.Write(&buf, binary.BigEndian, uint16(tile))
+		binary.Write(&buf, binary.BigEndian, uint32(14+10*(tile+1)))
+		buf.WriteByte(0) // TPsot
+		buf.WriteByte(1) // TNsot
+		binary.Write(&buf, binary.BigEndian, uint16(SOD))
+		buf.Write(bytes.Repeat([]byte{byte(tile)}, 10*(tile+1)))
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(EOC))
+	return buf.Bytes()
+}
+
+func TestParser_SeekToTile(t *testing.T) {
+	for _, withTLM := range []bool{true, false} {
+		data := createTiledCodestream(withTLM)
+		// Put the codestream at a non-zero offset, as in a JP2 file
+		rs := bytes.NewReader(append(make([]byte, 40), data...))
+		rs.Seek(40, io.SeekStart)
+
+		parser := NewParser(rs)
+		if _, err := parser.ReadHeader(); err != nil {
+			t.Fatalf("ReadHeader() error: %v", err)
+		}
+
+		for _, tile := range []int{3, 1, 2, 0, 3} {
+			if err := parser.SeekToTile(rs, tile); err != nil {
+				t.Fatalf("TLM=%v: SeekToTile(%d) error: %v", withTLM, tile, err)
+			}
+			tph, err := parser.ReadTilePartHeader()
+			if err != nil {
+				t.Fatalf("TLM=%v: ReadTilePartHeader() error: %v", withTLM, err)
+			}
+			if int(tph.TileIndex) != tile || tph.TilePartLength != uint32(14+10*(tile+1)) {
+				t.Errorf("TLM=%v: tile %d: got tile %d, Psot %d", withTLM, tile, tph.TileIndex, tph.TilePartLength)
+			}
+			b, err := rs.ReadByte()
+			if err != nil || int(b) != tile {
+				t.Errorf("TLM=%v: tile %d: first data byte = %d, %v", withTLM, tile, b, err)
+			}
+		}
+
+		if err := parser.SeekToTile(rs, 4); err == nil {
+			t.Errorf("TLM=%v: SeekToTile(4): expected error", withTLM)
+		}
+	}
+}
+
+func TestParser_SeekToTile_Errors(t *testing.T) {
+	data := createTiledCodestream(false)
+	rs := bytes.NewReader(data)
+	parser := NewParser(rs)
+	if err := parser.SeekToTile(rs, 0); err == nil {
+		t.Error("SeekToTile before ReadHeader: expected error")
+	}
+
+	// Drop the last tile-part; the scan reaches EOC without finding it
+	missing := append([]byte{}, data[:len(data)-2-(14+20)]...)
+	missing = binary.BigEndian.AppendUint16(missing, uint16(EOC))
+	rs = bytes.NewReader(missing)
+	parser = NewParser(rs)
+	if _, err := parser.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if err := parser.SeekToTile(rs, 1); err == nil {
+		t.Error("SeekToTile for a missing tile: expected error")
+	}
+	if err := parser.SeekToTile(rs, 3); err != nil {
+		t.Errorf("SeekToTile(3) error: %v", err)
+	}
+}
+
+func TestParser_ReadTilePartHeaderWithPLT(t *testing.T) {
+	buf := createBaseCodestream(1)
+	addCOD(buf, false)
+	addQCD(buf, QuantizationScalarDerived)
+
+	binary.Write(buf, binary.BigEndian, uint16(SOT))
+	binary.Write(buf, binary.BigEndian, uint16(10))
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	buf.WriteByte(0)
+	buf.WriteByte(1)
+
+	// Two PLT segments: 5 and 200, then 20000
+	binary.Write(buf, binary.BigEndian, uint16(PLT))
+	binary.Write(buf, binary.BigEndian, uint16(6))
+	buf.Write([]byte{0, 0x05, 0x81, 0x48})
+	binary.Write(buf, binary.BigEndian, uint16(PLT))
+	binary.Write(buf, binary.BigEndian, uint16(6))
+	buf.Write([]byte{1, 0x81, 0x9C, 0x20})
+	binary.Write(buf, binary.BigEndian, uint16(SOD))
+
+	parser := NewParser(bytes.NewReader(buf.Bytes()))
+	if _, err := parser.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	tph, err := parser.ReadTilePartHeader()
+	if err != nil {
+		t.Fatalf("ReadTilePartHeader() error: %v", err)
+	}
+
+	want := []uint32{5, 200, 20000}
+	if len(tph.PacketLengths) != len(want) {
+		t.Fatalf("PacketLengths = %v, want %v", tph.PacketLengths, want)
+	}
+	for i := range want {
+		if tph.PacketLengths[i] != want[i] {
+			t.Errorf("PacketLengths = %v, want %v", tph.PacketLengths, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package dwt
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Reference one-level forward transforms written directly from ITU-T T.800
+// Annex F, independent of the lifting implementations under test. Signals
+// are extended with whole-sample symmetric extension (F.3.7) and outputs
+// are returned in the L...H... layout produced by Forward53 and Forward97.
+// When odd is set the signal starts at an odd coordinate i0, so its
+// low-pass samples are those at the odd indices of x.
+
+// extend returns x(i) under periodic symmetric extension.
+func extend(n, i int) int {
+	period := 2 * (n - 1)
+	i %= period
+	if i < 0 {
+		i += period
+	}
+	if i >= n {
+		i = period - i
+	}
+	return i
+}
+
+// floorDiv returns floor(a / b) for b > 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// refForward53 implements 1D_FILTR_5-3R (Equations F-9 and F-10).
+func refForward53(x []int32, odd bool) []int32 {
+	n := len(x)
+	if n < 2 {
+		if n == 1 && odd {
+			return []int32{2 * x[0]}
+		}
+		return append([]int32(nil), x...)
+	}
+	p := 0
+	if odd {
+		p = 1
+	}
+	xe := func(i int) int64 { return int64(x[extend(n, i)]) }
+	high := func(i int) int64 { // i a high-pass index
+		return xe(i) - floorDiv(xe(i-1)+xe(i+1), 2)
+	}
+
+	out := make([]int32, n)
+	numLow := (n + 1 - p) / 2
+	for k := 0; k < numLow; k++ {
+		i := 2*k + p
+		out[k] = int32(xe(i) + floorDiv(high(i-1)+high(i+1)+2, 4))
+	}
+	for k := 0; k < n-numLow; k++ {
+		out[numLow+k] = int32(high(2*k + 1 - p))
+	}
+	return out
+}
+
+// 9-7 analysis filter taps from T.800 Table F.4, indexed by |offset|.
+var (
+	refLowTaps97 = []float64{
+		0.602949018236360, 0.266864118442875, -0.078223266528990,
+		-0.016864118442875, 0.026748757410810,
+	}
+	refHighTaps97 = []float64{
+		1.115087052457000, -0.591271763114250, -0.057543526228500,
+		0.091271763114250,
+	}
+)
+
+// refForward97 applies the 9-7 analysis filter bank by direct convolution.
+func refForward97(x []float64, odd bool) []float64 {
+	n := len(x)
+	if n < 2 {
+		if n == 1 && odd {
+			return []float64{2 * x[0]}
+		}
+		return append([]float64(nil), x...)
+	}
+	p := 0
+	if odd {
+		p = 1
+	}
+	filter := func(center int, taps []float64) float64 {
+		sum := taps[0] * x[extend(n, center)]
+		for k := 1; k < len(taps); k++ {
+			sum += taps[k] * (x[extend(n, center-k)] + x[extend(n, center+k)])
+		}
+		return sum
+	}
+
+	out := make([]float64, n)
+	numLow := (n + 1 - p) / 2
+	for k := 0; k < numLow; k++ {
+		out[k] = filter(2*k+p, refLowTaps97)
+	}
+	for k := 0; k < n-numLow; k++ {
+		out[numLow+k] = filter(2*k+1-p, refHighTaps97)
+	}
+	return out
+}
+
+// conformanceVector is a named one-dimensional input signal.
+type conformanceVector struct {
+	name string
+	x    []int32
+}
+
+// conformanceVectors covers even and odd lengths, boundary handling and
+// the full 16-bit sample range.
+func conformanceVectors() []conformanceVector {
+	rng := rand.New(rand.NewSource(15444))
+	var vectors []conformanceVector
+	for _, n := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 15, 16, 17, 32, 33, 64, 127} {
+		ramp := make([]int32, n)
+		impulse := make([]int32, n)
+		alternating := make([]int32, n)
+		random := make([]int32, n)
+		for i := range ramp {
+			ramp[i] = int32(i*7 - 40)
+			if i%2 == 0 {
+				alternating[i] = 32767
+			} else {
+				alternating[i] = -32768
+			}
+			random[i] = int32(rng.Intn(65536) - 32768)
+		}
+		impulse[n/2] = 255
+		vectors = append(vectors,
+			conformanceVector{"ramp", ramp},
+			conformanceVector{"impulse", impulse},
+			conformanceVector{"alternating", alternating},
+			conformanceVector{"random", random},
+		)
+	}
+	return vectors
+}
+
+func TestForward53_Conformance(t *testing.T) {
+	for _, v := range conformanceVectors() {
+		for _, impl := range []struct {
+			name string
+			odd  bool
+			fn   func([]int32, int)
+		}{
+			{"Forward53", false, Forward53},
+			{"Forward53Fast", false, Forward53Fast},
+			{"forward53/odd", true, func(x []int32, n int) { forward53(x, n, true) }},
+		} {
+			want := refForward53(v.x, impl.odd)
+			got := append([]int32(nil), v.x...)
+			impl.fn(got, len(got))
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%s %s/%d: coefficient %d = %d, want %d",
+						impl.name, v.name, len(v.x), i, got[i], want[i])
+					break
+				}
+			}
+
+			inverse53(got, len(got), impl.odd)
+			for i := range v.x {
+				if got[i] != v.x[i] {
+					t.Errorf("%s %s/%d: inverse sample %d = %d, want %d",
+						impl.name, v.name, len(v.x), i, got[i], v.x[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestForward97_Conformance(t *testing.T) {
+	for _, v := range conformanceVectors() {
+		x := make([]float64, len(v.x))
+		peak := 1.0
+		for i, s := range v.x {
+			x[i] = float64(s)
+			peak = math.Max(peak, math.Abs(x[i]))
+		}
+
+		for _, odd := range []bool{false, true} {
+			want := refForward97(x, odd)
+
+			got := append([]float64(nil), x...)
+			forward97(got, len(got), odd)
+
+			// The tabulated taps carry 15 significant digits, so compare
+			// relative to the signal peak rather than bit-for-bit.
+			tol := 1e-12 * peak
+			for i := range want {
+				if math.Abs(got[i]-want[i]) > tol {
+					t.Errorf("forward97 %s/%d odd=%v: coefficient %d = %.15g, want %.15g",
+						v.name, len(v.x), odd, i, got[i], want[i])
+					break
+				}
+			}
+
+			got32 := make([]float32, len(got))
+			for i, c := range got {
+				got32[i] = float32(c)
+			}
+			inverse97(got, len(got), odd)
+			inverse97F32(got32, len(got32), odd)
+			for i := range x {
+				if math.Abs(got[i]-x[i]) > 1e-9*peak {
+					t.Errorf("inverse97 %s/%d odd=%v: sample %d = %.15g, want %g",
+						v.name, len(v.x), odd, i, got[i], x[i])
+					break
+				}
+				if math.Abs(float64(got32[i])-x[i]) > 1e-5*peak {
+					t.Errorf("inverse97F32 %s/%d odd=%v: sample %d = %g, want %g",
+						v.name, len(v.x), odd, i, got32[i], x[i])
+					break
+				}
+			}
+		}
+	}
+}
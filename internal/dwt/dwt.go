@@ -114,7 +114,7 @@ func Forward53(data []int32, length int) {
 	}
 
 	// Rearrange coefficients: L L L... H H H...
-	deinterleave(data, length)
+	deinterleave(data, length, false)
 }
 
 // Inverse53 performs the inverse 5-3 reversible wavelet transform.
@@ -125,7 +125,7 @@ func Inverse53(data []int32, length int) {
 	}
 
 	// Rearrange from L L L... H H H... to interleaved
-	interleave(data, length)
+	interleave(data, length, false)
 
 	// Reverse lifting steps
 	// Step 1: Undo low-pass update
@@ -206,7 +206,7 @@ func Forward97(data []float64, length int) {
 	}
 
 	// Rearrange coefficients
-	deinterleaveFloat(data, length)
+	deinterleaveFloat(data, length, false)
 }
 
 // Inverse97 performs the inverse 9-7 irreversible wavelet transform.
@@ -216,7 +216,7 @@ func Inverse97(data []float64, length int) {
 	}
 
 	// Rearrange from separated to interleaved
-	interleaveFloat(data, length)
+	interleaveFloat(data, length, false)
 
 	// Undo scaling
 	for i := 0; i < length; i += 2 {
@@ -261,21 +261,150 @@ func Inverse97(data []float64, length int) {
 	}
 }
 
+// neighbours returns the indices of the samples either side of sample i
+// of an n-sample signal, n >= 2, mirroring at the ends as whole-sample
+// symmetric extension does.
+func neighbours(i, n int) (l, r int) {
+	l, r = i-1, i+1
+	if i == 0 {
+		l = r
+	}
+	if i == n-1 {
+		r = l
+	}
+	return l, r
+}
+
+// forward53 performs the forward 5-3 transform of a signal whose first
+// sample lies at an odd coordinate when odd is set. Such a signal starts
+// with a high-pass sample, so its length/2 low-pass coefficients come
+// first, followed by (length+1)/2 high-pass ones. A single odd sample is
+// doubled, as Annex F specifies.
+func forward53(data []int32, length int, odd bool) {
+	if !odd {
+		Forward53(data, length)
+		return
+	}
+	if length < 2 {
+		if length == 1 {
+			data[0] *= 2
+		}
+		return
+	}
+	for i := 0; i < length; i += 2 {
+		l, r := neighbours(i, length)
+		data[i] -= (data[l] + data[r]) >> 1
+	}
+	for i := 1; i < length; i += 2 {
+		l, r := neighbours(i, length)
+		data[i] += (data[l] + data[r] + 2) >> 2
+	}
+	deinterleave(data, length, true)
+}
+
+// inverse53 is the inverse of forward53.
+func inverse53(data []int32, length int, odd bool) {
+	if !odd {
+		Inverse53(data, length)
+		return
+	}
+	if length < 2 {
+		if length == 1 {
+			data[0] /= 2
+		}
+		return
+	}
+	interleave(data, length, true)
+	for i := 1; i < length; i += 2 {
+		l, r := neighbours(i, length)
+		data[i] -= (data[l] + data[r] + 2) >> 2
+	}
+	for i := 0; i < length; i += 2 {
+		l, r := neighbours(i, length)
+		data[i] += (data[l] + data[r]) >> 1
+	}
+}
+
+// lift97 adds c*(data[i-1]+data[i+1]) to every other sample from first
+// on, mirroring the missing neighbours at the ends.
+func lift97(data []float64, length, first int, c float64) {
+	for i := first; i < length; i += 2 {
+		l, r := neighbours(i, length)
+		data[i] += c * (data[l] + data[r])
+	}
+}
+
+// forward97 performs the forward 9-7 transform of a signal whose first
+// sample lies at an odd coordinate when odd is set, with the layout
+// described at forward53.
+func forward97(data []float64, length int, odd bool) {
+	if !odd {
+		Forward97(data, length)
+		return
+	}
+	if length < 2 {
+		if length == 1 {
+			data[0] *= 2
+		}
+		return
+	}
+	lift97(data, length, 0, alpha97)
+	lift97(data, length, 1, beta97)
+	lift97(data, length, 0, gamma97)
+	lift97(data, length, 1, delta97)
+	for i := 0; i < length; i++ {
+		if i&1 != 0 {
+			data[i] *= k97Inv
+		} else {
+			data[i] *= k97
+		}
+	}
+	deinterleaveFloat(data, length, true)
+}
+
+// inverse97 is the inverse of forward97.
+func inverse97(data []float64, length int, odd bool) {
+	if !odd {
+		Inverse97(data, length)
+		return
+	}
+	if length < 2 {
+		if length == 1 {
+			data[0] /= 2
+		}
+		return
+	}
+	interleaveFloat(data, length, true)
+	for i := 0; i < length; i++ {
+		if i&1 != 0 {
+			data[i] *= k97
+		} else {
+			data[i] *= k97Inv
+		}
+	}
+	lift97(data, length, 1, -delta97)
+	lift97(data, length, 0, -gamma97)
+	lift97(data, length, 1, -beta97)
+	lift97(data, length, 0, -alpha97)
+}
+
 // deinterleave rearranges data from interleaved to separated (L...H...).
-func deinterleave(data []int32, length int) {
+// The low-pass samples are the even ones, or the odd ones if odd is set.
+func deinterleave(data []int32, length int, odd bool) {
 	if length < 2 {
 		return
 	}
 
 	temp := getIntBuf(length)
-	halfLen := (length + 1) / 2
+	lo, hi := parity(odd)
+	halfLen := (length + 1 - lo) / 2
 
-	// Copy even samples (low-pass) to first half
-	for i, j := 0, 0; i < length; i, j = i+2, j+1 {
+	// Copy low-pass samples to first half
+	for i, j := lo, 0; i < length; i, j = i+2, j+1 {
 		temp[j] = data[i]
 	}
-	// Copy odd samples (high-pass) to second half
-	for i, j := 1, halfLen; i < length; i, j = i+2, j+1 {
+	// Copy high-pass samples to second half
+	for i, j := hi, halfLen; i < length; i, j = i+2, j+1 {
 		temp[j] = data[i]
 	}
 
@@ -283,8 +412,9 @@ func deinterleave(data []int32, length int) {
 	putIntBuf(temp)
 }
 
-// interleave rearranges data from separated (L...H...) to interleaved.
-func interleave(data []int32, length int) {
+// interleave rearranges data from separated (L...H...) to interleaved,
+// the inverse of deinterleave.
+func interleave(data []int32, length int, odd bool) {
 	if length < 2 {
 		return
 	}
@@ -292,32 +422,34 @@ func interleave(data []int32, length int) {
 	temp := getIntBuf(length)
 	copy(temp[:length], data[:length])
 
-	halfLen := (length + 1) / 2
+	lo, hi := parity(odd)
+	halfLen := (length + 1 - lo) / 2
 
-	// Copy low-pass samples to even positions
-	for i, j := 0, 0; j < halfLen; i, j = i+2, j+1 {
+	// Copy low-pass samples to their positions
+	for i, j := lo, 0; j < halfLen; i, j = i+2, j+1 {
 		data[i] = temp[j]
 	}
-	// Copy high-pass samples to odd positions
-	for i, j := 1, halfLen; j < length; i, j = i+2, j+1 {
+	// Copy high-pass samples between them
+	for i, j := hi, halfLen; j < length; i, j = i+2, j+1 {
 		data[i] = temp[j]
 	}
 	putIntBuf(temp)
 }
 
 // deinterleaveFloat rearranges float64 data from interleaved to separated.
-func deinterleaveFloat(data []float64, length int) {
+func deinterleaveFloat(data []float64, length int, odd bool) {
 	if length < 2 {
 		return
 	}
 
 	temp := getFloatBuf(length)
-	halfLen := (length + 1) / 2
+	lo, hi := parity(odd)
+	halfLen := (length + 1 - lo) / 2
 
-	for i, j := 0, 0; i < length; i, j = i+2, j+1 {
+	for i, j := lo, 0; i < length; i, j = i+2, j+1 {
 		temp[j] = data[i]
 	}
-	for i, j := 1, halfLen; i < length; i, j = i+2, j+1 {
+	for i, j := hi, halfLen; i < length; i, j = i+2, j+1 {
 		temp[j] = data[i]
 	}
 
@@ -326,7 +458,7 @@ func deinterleaveFloat(data []float64, length int) {
 }
 
 // interleaveFloat rearranges float64 data from separated to interleaved.
-func interleaveFloat(data []float64, length int) {
+func interleaveFloat(data []float64, length int, odd bool) {
 	if length < 2 {
 		return
 	}
@@ -334,17 +466,27 @@ func interleaveFloat(data []float64, length int) {
 	temp := getFloatBuf(length)
 	copy(temp[:length], data[:length])
 
-	halfLen := (length + 1) / 2
+	lo, hi := parity(odd)
+	halfLen := (length + 1 - lo) / 2
 
-	for i, j := 0, 0; j < halfLen; i, j = i+2, j+1 {
+	for i, j := lo, 0; j < halfLen; i, j = i+2, j+1 {
 		data[i] = temp[j]
 	}
-	for i, j := 1, halfLen; j < length; i, j = i+2, j+1 {
+	for i, j := hi, halfLen; j < length; i, j = i+2, j+1 {
 		data[i] = temp[j]
 	}
 	putFloatBuf(temp)
 }
 
+// parity returns the index of the first low-pass and first high-pass
+// sample of a signal, which starts with a high-pass sample when odd is set.
+func parity(odd bool) (lo, hi int) {
+	if odd {
+		return 1, 0
+	}
+	return 0, 1
+}
+
 // putFloatBuf returns a buffer to the pool.
 func putFloatBuf(buf []float64) {
 	bp := &buf
@@ -354,16 +496,23 @@ func putFloatBuf(buf []float64) {
 // Forward2D53 performs a 2D forward 5-3 wavelet transform.
 // data is a row-major 2D array with the given dimensions.
 func Forward2D53(data []int32, width, height int) {
+	forward2D53(data, width, height, width, false, false)
+}
+
+// forward2D53 transforms the width x height block at the start of data,
+// whose rows are stride samples apart. oddX and oddY report whether the
+// block starts at an odd column and row of the reference grid.
+func forward2D53(data []int32, width, height, stride int, oddX, oddY bool) {
 	// Transform rows - unroll by 4 for better pipelining
 	y := 0
 	for ; y+4 <= height; y += 4 {
-		Forward53(data[y*width:(y+1)*width], width)
-		Forward53(data[(y+1)*width:(y+2)*width], width)
-		Forward53(data[(y+2)*width:(y+3)*width], width)
-		Forward53(data[(y+3)*width:(y+4)*width], width)
+		forward53(data[y*stride:y*stride+width], width, oddX)
+		forward53(data[(y+1)*stride:(y+1)*stride+width], width, oddX)
+		forward53(data[(y+2)*stride:(y+2)*stride+width], width, oddX)
+		forward53(data[(y+3)*stride:(y+3)*stride+width], width, oddX)
 	}
 	for ; y < height; y++ {
-		Forward53(data[y*width:(y+1)*width], width)
+		forward53(data[y*stride:y*stride+width], width, oddX)
 	}
 
 	// Transform columns using pooled buffer
@@ -373,20 +522,20 @@ func Forward2D53(data []int32, width, height int) {
 	for ; x+4 <= width; x += 4 {
 		// Extract 4 columns
 		for yy := 0; yy < height; yy++ {
-			rowStart := yy * width
+			rowStart := yy * stride
 			col[yy] = data[rowStart+x]
 			col[height+yy] = data[rowStart+x+1]
 			col[2*height+yy] = data[rowStart+x+2]
 			col[3*height+yy] = data[rowStart+x+3]
 		}
 		// Transform all 4
-		Forward53(col[:height], height)
-		Forward53(col[height:2*height], height)
-		Forward53(col[2*height:3*height], height)
-		Forward53(col[3*height:4*height], height)
+		forward53(col[:height], height, oddY)
+		forward53(col[height:2*height], height, oddY)
+		forward53(col[2*height:3*height], height, oddY)
+		forward53(col[3*height:4*height], height, oddY)
 		// Write back
 		for yy := 0; yy < height; yy++ {
-			rowStart := yy * width
+			rowStart := yy * stride
 			data[rowStart+x] = col[yy]
 			data[rowStart+x+1] = col[height+yy]
 			data[rowStart+x+2] = col[2*height+yy]
@@ -396,11 +545,11 @@ func Forward2D53(data []int32, width, height int) {
 	// Handle remaining columns
 	for ; x < width; x++ {
 		for yy := 0; yy < height; yy++ {
-			col[yy] = data[yy*width+x]
+			col[yy] = data[yy*stride+x]
 		}
-		Forward53(col[:height], height)
+		forward53(col[:height], height, oddY)
 		for yy := 0; yy < height; yy++ {
-			data[yy*width+x] = col[yy]
+			data[yy*stride+x] = col[yy]
 		}
 	}
 	putIntBuf(col)
@@ -408,43 +557,55 @@ func Forward2D53(data []int32, width, height int) {
 
 // Inverse2D53 performs a 2D inverse 5-3 wavelet transform.
 func Inverse2D53(data []int32, width, height int) {
+	inverse2D53(data, width, height, width, false, false)
+}
+
+// inverse2D53 is the strided form of Inverse2D53, for a block starting
+// at the reference grid parity given by oddX and oddY.
+func inverse2D53(data []int32, width, height, stride int, oddX, oddY bool) {
 	// Transform columns first (reverse order of forward)
 	col := getIntBuf(height)
 	for x := 0; x < width; x++ {
 		for y := 0; y < height; y++ {
-			col[y] = data[y*width+x]
+			col[y] = data[y*stride+x]
 		}
-		Inverse53(col, height)
+		inverse53(col, height, oddY)
 		for y := 0; y < height; y++ {
-			data[y*width+x] = col[y]
+			data[y*stride+x] = col[y]
 		}
 	}
 	putIntBuf(col)
 
 	// Transform rows
 	for y := 0; y < height; y++ {
-		row := data[y*width : (y+1)*width]
-		Inverse53(row, width)
+		row := data[y*stride : y*stride+width]
+		inverse53(row, width, oddX)
 	}
 }
 
 // Forward2D97 performs a 2D forward 9-7 wavelet transform.
 func Forward2D97(data []float64, width, height int) {
+	forward2D97(data, width, height, width, false, false)
+}
+
+// forward2D97 is the strided form of Forward2D97, for a block starting
+// at the reference grid parity given by oddX and oddY.
+func forward2D97(data []float64, width, height, stride int, oddX, oddY bool) {
 	// Transform rows
 	for y := 0; y < height; y++ {
-		row := data[y*width : (y+1)*width]
-		Forward97(row, width)
+		row := data[y*stride : y*stride+width]
+		forward97(row, width, oddX)
 	}
 
 	// Transform columns using pooled buffer
 	col := getFloatBuf(height)
 	for x := 0; x < width; x++ {
 		for y := 0; y < height; y++ {
-			col[y] = data[y*width+x]
+			col[y] = data[y*stride+x]
 		}
-		Forward97(col, height)
+		forward97(col, height, oddY)
 		for y := 0; y < height; y++ {
-			data[y*width+x] = col[y]
+			data[y*stride+x] = col[y]
 		}
 	}
 	putFloatBuf(col)
@@ -452,23 +613,29 @@ func Forward2D97(data []float64, width, height int) {
 
 // Inverse2D97 performs a 2D inverse 9-7 wavelet transform.
 func Inverse2D97(data []float64, width, height int) {
+	inverse2D97(data, width, height, width, false, false)
+}
+
+// inverse2D97 is the strided form of Inverse2D97, for a block starting
+// at the reference grid parity given by oddX and oddY.
+func inverse2D97(data []float64, width, height, stride int, oddX, oddY bool) {
 	// Transform columns first
 	col := getFloatBuf(height)
 	for x := 0; x < width; x++ {
 		for y := 0; y < height; y++ {
-			col[y] = data[y*width+x]
+			col[y] = data[y*stride+x]
 		}
-		Inverse97(col, height)
+		inverse97(col, height, oddY)
 		for y := 0; y < height; y++ {
-			data[y*width+x] = col[y]
+			data[y*stride+x] = col[y]
 		}
 	}
 	putFloatBuf(col)
 
 	// Transform rows
 	for y := 0; y < height; y++ {
-		row := data[y*width : (y+1)*width]
-		Inverse97(row, width)
+		row := data[y*stride : y*stride+width]
+		inverse97(row, width, oddX)
 	}
 }
 
@@ -519,55 +686,64 @@ func Dequantize(data []int32, stepSize float64) []float64 {
 	return result
 }
 
-// DecomposeMultiLevel performs multi-level 2D wavelet decomposition.
-// Returns coefficient data organized by resolution level.
-func DecomposeMultiLevel53(data []int32, width, height, levels int) {
-	w, h := width, height
-	for level := 0; level < levels; level++ {
-		Forward2D53(data, w, h)
-		w = (w + 1) / 2
-		h = (h + 1) / 2
+// DecomposeMultiLevel53 performs multi-level 2D wavelet decomposition of
+// the width x height region whose top-left sample sits at (x0, y0) on the
+// reference grid. The result uses the Mallat layout: each level
+// transforms the low-pass quadrant left by the previous one in place, so
+// rows stay width samples apart and the subbands of every level sit at
+// fixed offsets. The parity of each level's origin decides which samples
+// are low-pass, so the quadrants have the sizes of the tile-component's
+// resolution levels and bands.
+func DecomposeMultiLevel53(data []int32, x0, y0, width, height, levels int) {
+	for _, l := range levelDims(x0, y0, width, height, levels) {
+		forward2D53(data, l.w, l.h, width, l.x0&1 != 0, l.y0&1 != 0)
 	}
 }
 
-// ReconstructMultiLevel performs multi-level 2D wavelet reconstruction.
-func ReconstructMultiLevel53(data []int32, width, height, levels int) {
-	// Calculate dimensions at coarsest level
-	dims := make([]struct{ w, h int }, levels)
-	w, h := width, height
-	for level := 0; level < levels; level++ {
-		dims[level] = struct{ w, h int }{w, h}
-		w = (w + 1) / 2
-		h = (h + 1) / 2
-	}
-
+// ReconstructMultiLevel53 performs multi-level 2D wavelet reconstruction
+// of coefficients in the layout produced by DecomposeMultiLevel53.
+func ReconstructMultiLevel53(data []int32, x0, y0, width, height, levels int) {
+	dims := levelDims(x0, y0, width, height, levels)
 	// Reconstruct from coarsest to finest
 	for level := levels - 1; level >= 0; level-- {
-		Inverse2D53(data, dims[level].w, dims[level].h)
+		l := dims[level]
+		inverse2D53(data, l.w, l.h, width, l.x0&1 != 0, l.y0&1 != 0)
 	}
 }
 
-// DecomposeMultiLevel97 performs multi-level 2D 9-7 wavelet decomposition.
-func DecomposeMultiLevel97(data []float64, width, height, levels int) {
-	w, h := width, height
-	for level := 0; level < levels; level++ {
-		Forward2D97(data, w, h)
-		w = (w + 1) / 2
-		h = (h + 1) / 2
+// DecomposeMultiLevel97 performs multi-level 2D 9-7 wavelet decomposition
+// into the layout described at DecomposeMultiLevel53.
+func DecomposeMultiLevel97(data []float64, x0, y0, width, height, levels int) {
+	for _, l := range levelDims(x0, y0, width, height, levels) {
+		forward2D97(data, l.w, l.h, width, l.x0&1 != 0, l.y0&1 != 0)
 	}
 }
 
 // ReconstructMultiLevel97 performs multi-level 2D 9-7 wavelet reconstruction.
-func ReconstructMultiLevel97(data []float64, width, height, levels int) {
-	dims := make([]struct{ w, h int }, levels)
-	w, h := width, height
-	for level := 0; level < levels; level++ {
-		dims[level] = struct{ w, h int }{w, h}
-		w = (w + 1) / 2
-		h = (h + 1) / 2
-	}
-
+func ReconstructMultiLevel97(data []float64, x0, y0, width, height, levels int) {
+	dims := levelDims(x0, y0, width, height, levels)
 	for level := levels - 1; level >= 0; level-- {
-		Inverse2D97(data, dims[level].w, dims[level].h)
+		l := dims[level]
+		inverse2D97(data, l.w, l.h, width, l.x0&1 != 0, l.y0&1 != 0)
 	}
 }
+
+// region is the area transformed at one decomposition level: its origin
+// on the reference grid of that level and its size.
+type region struct {
+	x0, y0, w, h int
+}
+
+// levelDims returns the region transformed at each level, finest first.
+// Each level keeps the low-pass samples of the one before, which lie at
+// the even coordinates of its region.
+func levelDims(x0, y0, width, height, levels int) []region {
+	dims := make([]region, levels)
+	x1, y1 := x0+width, y0+height
+	for i := range dims {
+		dims[i] = region{x0, y0, x1 - x0, y1 - y0}
+		x0, y0 = (x0+1)>>1, (y0+1)>>1
+		x1, y1 = (x1+1)>>1, (y1+1)>>1
+	}
+	return dims
+}
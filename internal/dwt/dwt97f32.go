@@ -0,0 +1,179 @@
+package dwt
+
+import "sync"
+
+// The float32 9-7 path below is used by the decoder. Each lifting step is
+// a separate pass over contiguous memory with no calls inside the loop, so
+// the compiler can keep the loop bodies in registers and vectorize them.
+// The vertical transform lifts whole rows against their neighbours rather
+// than gathering one column at a time, which keeps every access sequential.
+
+var float32BufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]float32, 4096)
+		return &buf
+	},
+}
+
+// getFloat32Buf returns a buffer of at least size n from the pool.
+func getFloat32Buf(n int) []float32 {
+	bp := float32BufPool.Get().(*[]float32)
+	buf := *bp
+	if cap(buf) < n {
+		buf = make([]float32, n)
+		*bp = buf
+	}
+	return buf[:n]
+}
+
+// putFloat32Buf returns a buffer to the pool.
+func putFloat32Buf(buf []float32) {
+	bp := &buf
+	float32BufPool.Put(bp)
+}
+
+// liftF32 adds c*(x[i-1]+x[i+1]) to every other sample from first on,
+// mirroring the missing neighbour at the ends.
+func liftF32(x []float32, n, first int, c float32) {
+	i := first
+	if i == 0 {
+		x[0] += 2 * c * x[1]
+		i = 2
+	}
+	for ; i < n-1; i += 2 {
+		x[i] += c * (x[i-1] + x[i+1])
+	}
+	if i == n-1 {
+		x[n-1] += 2 * c * x[n-2]
+	}
+}
+
+// liftRowF32 adds c*(a[i]+b[i]) to every sample of dst.
+func liftRowF32(dst, a, b []float32, c float32) {
+	a = a[:len(dst)]
+	b = b[:len(dst)]
+	for i := range dst {
+		dst[i] += c * (a[i] + b[i])
+	}
+}
+
+// scaleRowF32 multiplies every sample of dst by k.
+func scaleRowF32(dst []float32, k float32) {
+	for i := range dst {
+		dst[i] *= k
+	}
+}
+
+// Inverse97F32 performs the inverse 9-7 irreversible wavelet transform on
+// float32 samples. It matches Inverse97 to within float32 precision.
+func Inverse97F32(data []float32, length int) {
+	inverse97F32(data, length, false)
+}
+
+// inverse97F32 performs the inverse 9-7 transform of a signal that starts
+// at an odd coordinate of the reference grid when odd is set, like
+// inverse97.
+func inverse97F32(data []float32, length int, odd bool) {
+	if length < 2 {
+		if length == 1 && odd {
+			data[0] /= 2
+		}
+		return
+	}
+	x := data[:length]
+	lo, hi := parity(odd)
+
+	// Rearrange from separated to interleaved
+	temp := getFloat32Buf(length)
+	copy(temp, x)
+	halfLen := (length + 1 - lo) / 2
+	for i, j := lo, 0; j < halfLen; i, j = i+2, j+1 {
+		x[i] = temp[j] * k97
+	}
+	for i, j := hi, halfLen; j < length; i, j = i+2, j+1 {
+		x[i] = temp[j] * k97Inv
+	}
+	putFloat32Buf(temp)
+
+	liftF32(x, length, lo, -delta97)
+	liftF32(x, length, hi, -gamma97)
+	liftF32(x, length, lo, -beta97)
+	liftF32(x, length, hi, -alpha97)
+}
+
+// inverseColumns97F32 performs the vertical inverse 9-7 transform of a
+// width x height block whose rows are stride samples apart, lifting whole
+// rows at a time. The first row is a high-pass one when odd is set.
+func inverseColumns97F32(data []float32, width, height, stride int, odd bool) {
+	row := func(y int) []float32 { return data[y*stride : y*stride+width] }
+	if height < 2 {
+		if height == 1 && odd {
+			scaleRowF32(row(0), 0.5)
+		}
+		return
+	}
+	lo, hi := parity(odd)
+
+	// Interleave the low-pass and high-pass rows, undoing the scaling
+	temp := getFloat32Buf(width * height)
+	for y := 0; y < height; y++ {
+		copy(temp[y*width:(y+1)*width], row(y))
+	}
+	halfH := (height + 1 - lo) / 2
+	for y := 0; y < height; y++ {
+		src, k := y/2, float32(k97)
+		if y&1 != lo {
+			src, k = halfH+y/2, k97Inv
+		}
+		dst := row(y)
+		copy(dst, temp[src*width:(src+1)*width])
+		scaleRowF32(dst, k)
+	}
+	putFloat32Buf(temp)
+
+	steps := [...]struct {
+		first int
+		c     float32
+	}{{lo, -delta97}, {hi, -gamma97}, {lo, -beta97}, {hi, -alpha97}}
+	for _, s := range steps {
+		for y := s.first; y < height; y += 2 {
+			switch {
+			case y == 0:
+				liftRowF32(row(0), row(1), row(1), s.c)
+			case y == height-1:
+				liftRowF32(row(y), row(y-1), row(y-1), s.c)
+			default:
+				liftRowF32(row(y), row(y-1), row(y+1), s.c)
+			}
+		}
+	}
+}
+
+// Inverse2D97F32 performs a 2D inverse 9-7 wavelet transform on float32
+// samples. It matches Inverse2D97 to within float32 precision.
+func Inverse2D97F32(data []float32, width, height int) {
+	inverse2D97F32(data, width, height, width, false, false)
+}
+
+// inverse2D97F32 is the strided form of Inverse2D97F32, for a block
+// starting at the reference grid parity given by oddX and oddY.
+func inverse2D97F32(data []float32, width, height, stride int, oddX, oddY bool) {
+	// Transform columns first
+	inverseColumns97F32(data, width, height, stride, oddY)
+
+	// Transform rows
+	for y := 0; y < height; y++ {
+		inverse97F32(data[y*stride:y*stride+width], width, oddX)
+	}
+}
+
+// ReconstructMultiLevel97F32 performs multi-level 2D 9-7 wavelet
+// reconstruction on float32 samples, of the region described at
+// DecomposeMultiLevel53.
+func ReconstructMultiLevel97F32(data []float32, x0, y0, width, height, levels int) {
+	dims := levelDims(x0, y0, width, height, levels)
+	for level := levels - 1; level >= 0; level-- {
+		l := dims[level]
+		inverse2D97F32(data, l.w, l.h, width, l.x0&1 != 0, l.y0&1 != 0)
+	}
+}
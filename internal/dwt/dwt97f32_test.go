@@ -0,0 +1,101 @@
+package dwt
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestInverse97F32_MatchesFloat64(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, length := range []int{1, 2, 3, 4, 7, 16, 33} {
+		ref := make([]float64, length)
+		data := make([]float32, length)
+		for i := range ref {
+			ref[i] = float64(rng.Intn(512) - 256)
+			data[i] = float32(ref[i])
+		}
+
+		Inverse97(ref, length)
+		Inverse97F32(data, length)
+
+		for i := range ref {
+			if math.Abs(float64(data[i])-ref[i]) > 1e-2 {
+				t.Errorf("length %d, position %d: got %v, want %v", length, i, data[i], ref[i])
+			}
+		}
+	}
+}
+
+func TestReconstructMultiLevel97F32_MatchesFloat64(t *testing.T) {
+	tests := []struct {
+		x0, y0, width, height, levels int
+	}{
+		{0, 0, 1, 1, 1},
+		{0, 0, 1, 9, 2},
+		{0, 0, 9, 1, 2},
+		{0, 0, 8, 8, 1},
+		{0, 0, 17, 11, 3},
+		{0, 0, 64, 48, 5},
+		{1, 1, 1, 1, 1},
+		{15, 15, 15, 15, 2},
+		{3, 0, 10, 9, 3},
+		{0, 7, 9, 10, 3},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		size := tt.width * tt.height
+		ref := make([]float64, size)
+		for i := range ref {
+			ref[i] = float64(rng.Intn(256))
+		}
+		DecomposeMultiLevel97(ref, tt.x0, tt.y0, tt.width, tt.height, tt.levels)
+		data := make([]float32, size)
+		for i, v := range ref {
+			data[i] = float32(v)
+		}
+
+		ReconstructMultiLevel97(ref, tt.x0, tt.y0, tt.width, tt.height, tt.levels)
+		ReconstructMultiLevel97F32(data, tt.x0, tt.y0, tt.width, tt.height, tt.levels)
+
+		for i := range ref {
+			if math.Abs(float64(data[i])-ref[i]) > 1e-2 {
+				t.Errorf("%dx%d+%d+%d/%d, position %d: got %v, want %v",
+					tt.width, tt.height, tt.x0, tt.y0, tt.levels, i, data[i], ref[i])
+				break
+			}
+		}
+	}
+}
+
+const benchTileSize = 2048
+
+func BenchmarkInverse2D97(b *testing.B) {
+	src := make([]float64, benchTileSize*benchTileSize)
+	for i := range src {
+		src[i] = float64(i % 251)
+	}
+	data := make([]float64, len(src))
+
+	b.Run("float64", func(b *testing.B) {
+		b.SetBytes(int64(len(src) * 8))
+		for i := 0; i < b.N; i++ {
+			copy(data, src)
+			Inverse2D97(data, benchTileSize, benchTileSize)
+		}
+	})
+
+	data32 := make([]float32, len(src))
+	src32 := make([]float32, len(src))
+	for i, v := range src {
+		src32[i] = float32(v)
+	}
+	b.Run("float32", func(b *testing.B) {
+		b.SetBytes(int64(len(src32) * 4))
+		for i := 0; i < b.N; i++ {
+			copy(data32, src32)
+			Inverse2D97F32(data32, benchTileSize, benchTileSize)
+		}
+	})
+}
@@ -33,7 +33,7 @@ func Forward53Fast(data []int32, length int) {
 	liftStep2_53_avx(data, length)
 
 	// Rearrange coefficients
-	deinterleave(data, length)
+	deinterleave(data, length, false)
 }
 
 // clearInt32SliceFast uses AVX to zero a slice efficiently.
@@ -33,7 +33,7 @@ func Forward53Fast(data []int32, length int) {
 	liftStep2_53_neon(data, length)
 
 	// Rearrange coefficients
-	deinterleave(data, length)
+	deinterleave(data, length, false)
 }
 
 // clearInt32SliceFast uses NEON to zero a slice efficiently.
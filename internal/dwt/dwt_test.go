@@ -2,6 +2,7 @@ package dwt
 
 import (
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -174,8 +175,8 @@ func TestMultiLevel53_Roundtrip(t *testing.T) {
 			data := make([]int32, size)
 			copy(data, original)
 
-			DecomposeMultiLevel53(data, tt.width, tt.height, tt.levels)
-			ReconstructMultiLevel53(data, tt.width, tt.height, tt.levels)
+			DecomposeMultiLevel53(data, 0, 0, tt.width, tt.height, tt.levels)
+			ReconstructMultiLevel53(data, 0, 0, tt.width, tt.height, tt.levels)
 
 			for i := range original {
 				if data[i] != original[i] {
@@ -186,13 +187,101 @@ func TestMultiLevel53_Roundtrip(t *testing.T) {
 	}
 }
 
+func TestMultiLevel53_MallatLayout(t *testing.T) {
+	// A constant 13x10 image decomposes into a constant 4x3 LL2 band in
+	// the top-left corner with every detail coefficient zero.
+	const width, height = 13, 10
+	data := make([]int32, width*height)
+	for i := range data {
+		data[i] = 7
+	}
+	DecomposeMultiLevel53(data, 0, 0, width, height, 2)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := int32(0)
+			if x < 4 && y < 3 {
+				want = 7
+			}
+			if got := data[y*width+x]; got != want {
+				t.Fatalf("coefficient (%d,%d) = %d; want %d", x, y, got, want)
+			}
+		}
+	}
+	ReconstructMultiLevel53(data, 0, 0, width, height, 2)
+	for i, v := range data {
+		if v != 7 {
+			t.Fatalf("sample %d = %d after reconstruction; want 7", i, v)
+		}
+	}
+}
+
+func TestMultiLevel53_OddOrigin(t *testing.T) {
+	// The second 15x15 tile of an image starts at (15, 15), so its first
+	// row and column are high-pass: LL1 is 7x7, LL2 (at origin 8) is 4x4.
+	const x0, y0, width, height = 15, 15, 15, 15
+	data := make([]int32, width*height)
+	for i := range data {
+		data[i] = 7
+	}
+	DecomposeMultiLevel53(data, x0, y0, width, height, 2)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := int32(0)
+			if x < 4 && y < 4 {
+				want = 7
+			}
+			if got := data[y*width+x]; got != want {
+				t.Fatalf("coefficient (%d,%d) = %d; want %d", x, y, got, want)
+			}
+		}
+	}
+
+	// One level matches the reference filter applied to rows then columns
+	for _, o := range []struct{ x0, y0, width, height int }{
+		{15, 15, 15, 15}, {1, 0, 6, 5}, {0, 3, 5, 6}, {3, 5, 1, 4},
+	} {
+		rng := rand.New(rand.NewSource(int64(o.x0*31 + o.y0)))
+		original := make([]int32, o.width*o.height)
+		for i := range original {
+			original[i] = int32(rng.Intn(512) - 256)
+		}
+		want := make([]int32, len(original))
+		for y := 0; y < o.height; y++ {
+			copy(want[y*o.width:], refForward53(original[y*o.width:(y+1)*o.width], o.x0&1 != 0))
+		}
+		col := make([]int32, o.height)
+		for x := 0; x < o.width; x++ {
+			for y := range col {
+				col[y] = want[y*o.width+x]
+			}
+			for y, v := range refForward53(col, o.y0&1 != 0) {
+				want[y*o.width+x] = v
+			}
+		}
+
+		data := append([]int32(nil), original...)
+		DecomposeMultiLevel53(data, o.x0, o.y0, o.width, o.height, 1)
+		for i := range want {
+			if data[i] != want[i] {
+				t.Fatalf("origin (%d,%d): coefficient %d = %d; want %d", o.x0, o.y0, i, data[i], want[i])
+			}
+		}
+		ReconstructMultiLevel53(data, o.x0, o.y0, o.width, o.height, 1)
+		for i := range original {
+			if data[i] != original[i] {
+				t.Fatalf("origin (%d,%d): sample %d = %d after reconstruction; want %d", o.x0, o.y0, i, data[i], original[i])
+			}
+		}
+	}
+}
+
 func TestDeinterleave_Interleave_Roundtrip(t *testing.T) {
 	data := []int32{0, 1, 2, 3, 4, 5, 6, 7}
 	original := make([]int32, len(data))
 	copy(original, data)
 
-	deinterleave(data, len(data))
-	interleave(data, len(data))
+	deinterleave(data, len(data), false)
+	interleave(data, len(data), false)
 
 	for i := range original {
 		if data[i] != original[i] {
@@ -296,8 +385,8 @@ func TestMultiLevel97_Roundtrip(t *testing.T) {
 			data := make([]float64, size)
 			copy(data, original)
 
-			DecomposeMultiLevel97(data, tt.width, tt.height, tt.levels)
-			ReconstructMultiLevel97(data, tt.width, tt.height, tt.levels)
+			DecomposeMultiLevel97(data, 0, 0, tt.width, tt.height, tt.levels)
+			ReconstructMultiLevel97(data, 0, 0, tt.width, tt.height, tt.levels)
 
 			for i := range original {
 				if math.Abs(data[i]-original[i]) > 1e-9 {
@@ -314,7 +403,7 @@ func TestDeinterleave_SmallLength(t *testing.T) {
 	original := make([]int32, len(data))
 	copy(original, data)
 
-	deinterleave(data, len(data))
+	deinterleave(data, len(data), false)
 
 	// Data should remain unchanged
 	for i := range original {
@@ -325,7 +414,7 @@ func TestDeinterleave_SmallLength(t *testing.T) {
 
 	// Test with length 0
 	emptyData := []int32{}
-	deinterleave(emptyData, 0)
+	deinterleave(emptyData, 0, false)
 }
 
 func TestInterleave_SmallLength(t *testing.T) {
@@ -334,7 +423,7 @@ func TestInterleave_SmallLength(t *testing.T) {
 	original := make([]int32, len(data))
 	copy(original, data)
 
-	interleave(data, len(data))
+	interleave(data, len(data), false)
 
 	// Data should remain unchanged
 	for i := range original {
@@ -345,7 +434,7 @@ func TestInterleave_SmallLength(t *testing.T) {
 
 	// Test with length 0
 	emptyData := []int32{}
-	interleave(emptyData, 0)
+	interleave(emptyData, 0, false)
 }
 
 func TestDeinterleaveFloat_SmallLength(t *testing.T) {
@@ -354,7 +443,7 @@ func TestDeinterleaveFloat_SmallLength(t *testing.T) {
 	original := make([]float64, len(data))
 	copy(original, data)
 
-	deinterleaveFloat(data, len(data))
+	deinterleaveFloat(data, len(data), false)
 
 	// Data should remain unchanged
 	for i := range original {
@@ -365,7 +454,7 @@ func TestDeinterleaveFloat_SmallLength(t *testing.T) {
 
 	// Test with length 0
 	emptyData := []float64{}
-	deinterleaveFloat(emptyData, 0)
+	deinterleaveFloat(emptyData, 0, false)
 }
 
 func TestInterleaveFloat_SmallLength(t *testing.T) {
@@ -374,7 +463,7 @@ func TestInterleaveFloat_SmallLength(t *testing.T) {
 	original := make([]float64, len(data))
 	copy(original, data)
 
-	interleaveFloat(data, len(data))
+	interleaveFloat(data, len(data), false)
 
 	// Data should remain unchanged
 	for i := range original {
@@ -385,7 +474,7 @@ func TestInterleaveFloat_SmallLength(t *testing.T) {
 
 	// Test with length 0
 	emptyData := []float64{}
-	interleaveFloat(emptyData, 0)
+	interleaveFloat(emptyData, 0, false)
 }
 
 func TestForward53Fast(t *testing.T) {
@@ -964,14 +964,17 @@ func TestGetSignContextParams(t *testing.T) {
 		expectCtx  uint8
 		expectXor  uint8
 	}{
-		{0, 0, 10, 0},   // CtxSC0
-		{1, 0, 12, 0},   // CtxSC2
-		{0, 1, 11, 0},   // CtxSC1
-		{1, 1, 14, 0},   // CtxSC4
-		{-1, 0, 12, 1},  // negative h -> xorbit
-		{0, -1, 11, 1},  // negative v, h=0 -> xorbit
-		{2, 0, 12, 0},   // h > 1 clamped to 1
-		{0, 2, 11, 0},   // v > 1 clamped to 1
+		{0, 0, CtxSC0, 0},
+		{1, 0, CtxSC3, 0},
+		{0, 1, CtxSC1, 0},
+		{1, 1, CtxSC4, 0},
+		{1, -1, CtxSC2, 0},
+		{-1, 0, CtxSC3, 1},  // negative h -> xorbit
+		{0, -1, CtxSC1, 1},  // negative v, h=0 -> xorbit
+		{-1, 1, CtxSC2, 1},  // negative h flips v too
+		{-1, -1, CtxSC4, 1},
+		{2, 0, CtxSC3, 0},   // h > 1 clamped to 1
+		{0, 2, CtxSC1, 0},   // v > 1 clamped to 1
 	}
 
 	for _, tt := range tests {
@@ -24,46 +24,8 @@ func init() {
 }
 
 func getSignContextParams(hc, vc int) (ctx uint8, xorbit uint8) {
-	// Normalize contributions
-	xorbit = 0
-	if hc < 0 {
-		xorbit = 1
-		hc = -hc
-	}
-	if hc == 0 && vc < 0 {
-		xorbit = 1
-		vc = -vc
-	}
-
-	// Clamp to 0-1
-	if hc > 1 {
-		hc = 1
-	}
-	if vc < 0 {
-		vc = -vc
-	}
-	if vc > 1 {
-		vc = 1
-	}
-
-	// Context from table (CtxSC0 + offset)
-	switch {
-	case hc == 1:
-		if vc == 1 {
-			ctx = 14 // CtxSC4
-		} else {
-			ctx = 12 // CtxSC2
-		}
-	case hc == 0:
-		if vc == 0 {
-			ctx = 10 // CtxSC0
-		} else {
-			ctx = 11 // CtxSC1
-		}
-	default:
-		ctx = 10 // CtxSC0
-	}
-	return
+	c, p := signContext(hc, vc)
+	return uint8(c), uint8(p)
 }
 
 // getSignContrib returns the sign contribution (-1, 0, +1) from a neighbor flag.
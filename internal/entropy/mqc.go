@@ -165,6 +165,12 @@ const (
 	NumContexts // Total number of contexts
 )
 
+// mqInitContexts holds the initial state index of every context
+// (ITU-T T.800 Table D.7): the uniform context starts in state 46, the
+// run-length context in state 3, the zero coding context with no
+// significant neighbors in state 4 and all others in state 0.
+var mqInitContexts = [NumContexts]uint8{CtxZC0: 8, CtxRL: 6, CtxUni: 92}
+
 // MQEncoder implements the MQ arithmetic encoder.
 type MQEncoder struct {
 	// Interval size (A register)
@@ -191,12 +197,7 @@ func NewMQEncoder() *MQEncoder {
 		bp:  0,
 	}
 	e.buf[0] = 0 // Initial byte (bp[-1] in OpenJPEG terms)
-	// Initialize all contexts to state 0 (MPS=0)
-	for i := range e.contexts {
-		e.contexts[i] = 0
-	}
-	// Set uniform context to state 92 (MPS=0)
-	e.contexts[CtxUni] = 92
+	e.contexts = mqInitContexts
 	return e
 }
 
@@ -213,10 +214,7 @@ func (e *MQEncoder) Reset() {
 	}
 	e.buf[0] = 0
 	e.bp = 0
-	for i := range e.contexts {
-		e.contexts[i] = 0
-	}
-	e.contexts[CtxUni] = 92
+	e.contexts = mqInitContexts
 }
 
 // Encode encodes a binary decision (0 or 1) for the given context.
@@ -331,6 +329,43 @@ func (e *MQEncoder) Flush() []byte {
 	return nil
 }
 
+// FlushPredictable terminates the codeword with the predictable
+// termination of ITU-T T.800 D.4.2 (ERTERM), which lets a decoder check
+// that it consumed exactly the bits the encoder produced, and returns
+// the compressed data.
+func (e *MQEncoder) FlushPredictable() []byte {
+	for k := 12 - int(e.CT); k > 0; k -= int(e.CT) {
+		e.C <<= e.CT
+		e.CT = 0
+		e.byteOut()
+	}
+
+	// The byte in progress is only kept if it is not 0xFF; pushing out
+	// another byte propagates any carry into it
+	end := e.bp
+	if e.buf[end] != 0xFF {
+		e.byteOut()
+		end++
+	}
+	if end > 1 {
+		return e.buf[1:end]
+	}
+	return nil
+}
+
+// Restart prepares the encoder for a new codeword segment after Flush,
+// keeping the context states.
+func (e *MQEncoder) Restart() {
+	contexts := e.contexts
+	e.Reset()
+	e.contexts = contexts
+}
+
+// ResetAllContexts resets all contexts to their initial states.
+func (e *MQEncoder) ResetAllContexts() {
+	e.contexts = mqInitContexts
+}
+
 // setbits sets remaining bits for flushing.
 func (e *MQEncoder) setbits() {
 	tempC := e.C + e.A
@@ -375,12 +410,7 @@ func NewMQDecoder(data []byte) *MQDecoder {
 		data: data,
 		bp:   -1,
 	}
-	// Initialize all contexts to state 0 (MPS=0)
-	for i := range d.contexts {
-		d.contexts[i] = 0
-	}
-	// Set uniform context to state 92 (MPS=0)
-	d.contexts[CtxUni] = 92
+	d.contexts = mqInitContexts
 
 	// Initialize C register (INITDEC procedure)
 	// C.3.5 Initialization of the decoder
@@ -498,19 +528,12 @@ func (d *MQDecoder) renormDec() {
 
 // ResetContext resets a specific context to its initial state.
 func (d *MQDecoder) ResetContext(ctx int) {
-	if ctx == CtxUni {
-		d.contexts[ctx] = 92
-	} else {
-		d.contexts[ctx] = 0
-	}
+	d.contexts[ctx] = mqInitContexts[ctx]
 }
 
 // ResetAllContexts resets all contexts to their initial states.
 func (d *MQDecoder) ResetAllContexts() {
-	for i := range d.contexts {
-		d.contexts[i] = 0
-	}
-	d.contexts[CtxUni] = 92
+	d.contexts = mqInitContexts
 }
 
 // RawDecoder implements raw (bypass) mode decoding.
@@ -591,10 +614,31 @@ func (r *RawEncoder) EncodeBit(bit int) {
 	}
 }
 
-// Flush flushes remaining bits and returns the data.
+// Flush terminates the raw codeword segment and returns the data. The
+// last byte is padded with alternating 0 and 1 bits; a final 0xFF byte
+// is dropped, since a decoder reads ones past the end of a segment.
 func (r *RawEncoder) Flush() []byte {
-	if r.ct < 8 {
+	return r.flush(false)
+}
+
+// FlushPredictable terminates the raw codeword segment like Flush, but
+// keeps a final 0xFF byte and pads after it, as predictable termination
+// (ERTERM) requires.
+func (r *RawEncoder) FlushPredictable() []byte {
+	return r.flush(true)
+}
+
+func (r *RawEncoder) flush(predictable bool) []byte {
+	afterFF := len(r.buf) > 0 && r.buf[len(r.buf)-1] == 0xFF
+	if r.ct < 7 || (r.ct == 7 && (predictable || !afterFF)) {
+		for bit := uint32(0); r.ct > 0; bit ^= 1 {
+			r.ct--
+			r.c += bit << r.ct
+		}
 		r.buf = append(r.buf, byte(r.c))
+		r.c, r.ct = 0, 8
+	} else if afterFF && !predictable {
+		r.buf = r.buf[:len(r.buf)-1]
 	}
 	return r.buf
 }
@@ -50,6 +50,7 @@ func (t *T1) Resize(width, height int) {
 func (t *T1) resize(width, height int) {
 	t.width = width
 	t.height = height
+	t.style = 0
 
 	dataSize := width * height
 	if cap(t.data) < dataSize {
@@ -106,6 +107,14 @@ type T1 struct {
 	mqEnc *MQEncoder
 	mqDec *MQDecoder
 
+	// Raw coder of the current pass when arithmetic coding is bypassed,
+	// otherwise nil
+	rawEnc *RawEncoder
+	rawDec *RawDecoder
+
+	// Code-block style flags selecting the coding modes
+	style uint8
+
 	// Band type (LL, HL, LH, HH)
 	bandType int
 
@@ -166,10 +175,7 @@ func (t *T1) resetMQInlined() {
 	}
 	t.mqBuf[0] = 0
 	t.mqBp = 0
-	for i := range t.mqContexts {
-		t.mqContexts[i] = 0
-	}
-	t.mqContexts[CtxUni] = 92
+	t.mqContexts = mqInitContexts
 }
 
 // mqEncodeInlined is an inlined MQ encode for maximum performance.
@@ -364,7 +370,8 @@ func (t *T1) getZCContext(x, y int, bandType int) int {
 	if f[idx-stride]&T1Sig != 0 {
 		packed |= 0x04 // N
 	}
-	if f[idx+stride]&T1Sig != 0 {
+	south := t.southMask(y)
+	if f[idx+stride]&south != 0 {
 		packed |= 0x08 // S
 	}
 	if f[idx-stride-1]&T1Sig != 0 {
@@ -373,10 +380,10 @@ func (t *T1) getZCContext(x, y int, bandType int) int {
 	if f[idx-stride+1]&T1Sig != 0 {
 		packed |= 0x20 // NE
 	}
-	if f[idx+stride-1]&T1Sig != 0 {
+	if f[idx+stride-1]&south != 0 {
 		packed |= 0x40 // SW
 	}
-	if f[idx+stride+1]&T1Sig != 0 {
+	if f[idx+stride+1]&south != 0 {
 		packed |= 0x80 // SE
 	}
 
@@ -415,7 +422,7 @@ func (t *T1) getSCContext(x, y int) (ctx int, pred int) {
 			vc++
 		}
 	}
-	if f[idx+stride]&T1Sig != 0 {
+	if f[idx+stride]&t.southMask(y) != 0 {
 		if f[idx+stride]&T1SignNeg != 0 {
 			vc--
 		} else {
@@ -423,54 +430,24 @@ func (t *T1) getSCContext(x, y int) (ctx int, pred int) {
 		}
 	}
 
-	// Determine context and prediction from contributions
-	pred = 0
-	if hc < 0 {
-		pred = 1
-		hc = -hc
-	}
-	if hc == 0 {
-		if vc < 0 {
-			pred = 1
-			vc = -vc
-		}
-	}
+	return getSCContextFast(hc, vc)
+}
 
-	// Map to context
-	ctx = CtxSC0
-	if hc == 1 {
-		if vc == 1 {
-			ctx = CtxSC4
-		} else if vc == 0 {
-			ctx = CtxSC2
-		} else {
-			ctx = CtxSC1
-		}
-	} else if hc == 0 {
-		if vc == 1 {
-			ctx = CtxSC1
-		} else if vc == 0 {
-			ctx = CtxSC0
-		}
-	} else if hc == 2 {
-		ctx = CtxSC3
+// southMask returns the flags that count as significant in the row below
+// y: T1Sig, or none when vertically causal contexts hide the next stripe
+// from the last row of a stripe.
+func (t *T1) southMask(y int) T1Flags {
+	if t.style&StyleCausal != 0 && y%4 == 3 {
+		return 0
 	}
-
-	return
+	return T1Sig
 }
 
 // getMRContext returns the magnitude refinement context.
 func (t *T1) getMRContext(x, y int) int {
-	idx := t.flagIndex(x, y)
-	stride := t.width + 2
-	f := t.flags
-
 	// Check if this is the first refinement
-	if f[idx]&T1Refine == 0 {
-		// Check if any neighbor is significant
-		hasNeighbor := (f[idx-1]|f[idx+1]|f[idx-stride]|f[idx+stride]|
-			f[idx-stride-1]|f[idx-stride+1]|f[idx+stride-1]|f[idx+stride+1])&T1Sig != 0
-		if hasNeighbor {
+	if !t.hasFlag(x, y, T1Refine) {
+		if t.hasSignificantNeighbor(x, y) {
 			return CtxMag1
 		}
 		return CtxMag0
@@ -518,34 +495,7 @@ func (t *T1) encodeSignInlined(x, y int) {
 		}
 	}
 
-	// Determine prediction
-	pred := 0
-	if hc < 0 {
-		pred = 1
-		hc = -hc
-	}
-	if hc == 0 && vc < 0 {
-		pred = 1
-		vc = -vc
-	}
-
-	// Map to context
-	ctx := CtxSC0
-	if hc == 1 {
-		if vc == 1 {
-			ctx = CtxSC4
-		} else if vc == 0 {
-			ctx = CtxSC2
-		} else {
-			ctx = CtxSC1
-		}
-	} else if hc == 0 {
-		if vc == 1 {
-			ctx = CtxSC1
-		}
-	} else if hc == 2 {
-		ctx = CtxSC3
-	}
+	ctx, pred := getSCContextFast(hc, vc)
 
 	sign := 0
 	if f[idx]&T1SignNeg != 0 {
@@ -564,76 +514,76 @@ func (t *T1) encodeSignificancePassInlined(bp int) {
 	height := t.height
 	bandOffset := t.bandType * 256
 
-	for y := 0; y < height; y++ {
-		rowIdx := (y + 1) * stride
-		dataRowIdx := y * width
-		isFirstRow := y == 0
-		isLastRow := y == height-1
-
+	for y0 := 0; y0 < height; y0 += 4 {
 		for x := 0; x < width; x++ {
-			i := rowIdx + x + 1
-			f := flags[i]
+			for y := y0; y < y0+4 && y < height; y++ {
+				i := (y+1)*stride + x + 1
+				dataRowIdx := y * width
+				isFirstRow := y == 0
+				isLastRow := y == height-1
+				f := flags[i]
 
-			if f&T1Sig != 0 {
-				continue
-			}
+				if f&T1Sig != 0 {
+					continue
+				}
 
-			neighbors := flags[i-1] | flags[i+1] | flags[i-stride] | flags[i+stride] |
-				flags[i-stride-1] | flags[i-stride+1] | flags[i+stride-1] | flags[i+stride+1]
-			if neighbors&T1Sig == 0 {
-				continue
-			}
+				neighbors := flags[i-1] | flags[i+1] | flags[i-stride] | flags[i+stride] |
+					flags[i-stride-1] | flags[i-stride+1] | flags[i+stride-1] | flags[i+stride+1]
+				if neighbors&T1Sig == 0 {
+					continue
+				}
 
-			sig := 0
-			if data[dataRowIdx+x]&bit != 0 {
-				sig = 1
-			}
+				sig := 0
+				if data[dataRowIdx+x]&bit != 0 {
+					sig = 1
+				}
 
-			var packed uint8
-			if flags[i-1]&T1Sig != 0 {
-				packed |= 0x01
-			}
-			if flags[i+1]&T1Sig != 0 {
-				packed |= 0x02
-			}
-			if flags[i-stride]&T1Sig != 0 {
-				packed |= 0x04
-			}
-			if flags[i+stride]&T1Sig != 0 {
-				packed |= 0x08
-			}
-			if flags[i-stride-1]&T1Sig != 0 {
-				packed |= 0x10
-			}
-			if flags[i-stride+1]&T1Sig != 0 {
-				packed |= 0x20
-			}
-			if flags[i+stride-1]&T1Sig != 0 {
-				packed |= 0x40
-			}
-			if flags[i+stride+1]&T1Sig != 0 {
-				packed |= 0x80
-			}
-			ctx := int(lutZCCtx[bandOffset+int(packed)])
-			t.mqEncodeInlined(ctx, sig)
-
-			if sig != 0 {
-				t.encodeSignInlined(x, y)
-				flags[i] |= T1Sig
-				if !isFirstRow {
-					flags[i-stride] |= T1SigS
+				var packed uint8
+				if flags[i-1]&T1Sig != 0 {
+					packed |= 0x01
 				}
-				if !isLastRow {
-					flags[i+stride] |= T1SigN
+				if flags[i+1]&T1Sig != 0 {
+					packed |= 0x02
 				}
-				if x > 0 {
-					flags[i-1] |= T1SigE
+				if flags[i-stride]&T1Sig != 0 {
+					packed |= 0x04
+				}
+				if flags[i+stride]&T1Sig != 0 {
+					packed |= 0x08
+				}
+				if flags[i-stride-1]&T1Sig != 0 {
+					packed |= 0x10
 				}
-				if x < width-1 {
-					flags[i+1] |= T1SigW
+				if flags[i-stride+1]&T1Sig != 0 {
+					packed |= 0x20
+				}
+				if flags[i+stride-1]&T1Sig != 0 {
+					packed |= 0x40
+				}
+				if flags[i+stride+1]&T1Sig != 0 {
+					packed |= 0x80
 				}
+				ctx := int(lutZCCtx[bandOffset+int(packed)])
+				t.mqEncodeInlined(ctx, sig)
+
+				if sig != 0 {
+					t.encodeSignInlined(x, y)
+					flags[i] |= T1Sig
+					if !isFirstRow {
+						flags[i-stride] |= T1SigS
+					}
+					if !isLastRow {
+						flags[i+stride] |= T1SigN
+					}
+					if x > 0 {
+						flags[i-1] |= T1SigE
+					}
+					if x < width-1 {
+						flags[i+1] |= T1SigW
+					}
+				}
+				flags[i] |= T1Visit
 			}
-			flags[i] |= T1Visit
 		}
 	}
 }
@@ -647,37 +597,38 @@ func (t *T1) encodeMagnitudeRefinementPassInlined(bp int) {
 	width := t.width
 	height := t.height
 
-	for y := 0; y < height; y++ {
-		rowIdx := (y + 1) * stride
-		dataRowIdx := y * width
+	for y0 := 0; y0 < height; y0 += 4 {
 		for x := 0; x < width; x++ {
-			idx := rowIdx + x + 1
-			f := flags[idx]
+			for y := y0; y < y0+4 && y < height; y++ {
+				idx := (y+1)*stride + x + 1
+				dataRowIdx := y * width
+				f := flags[idx]
 
-			if f&T1Sig == 0 || f&T1Visit != 0 {
-				continue
-			}
+				if f&T1Sig == 0 || f&T1Visit != 0 {
+					continue
+				}
 
-			refBit := 0
-			if data[dataRowIdx+x]&bit != 0 {
-				refBit = 1
-			}
+				refBit := 0
+				if data[dataRowIdx+x]&bit != 0 {
+					refBit = 1
+				}
 
-			var ctx int
-			if f&T1Refine == 0 {
-				neighbors := flags[idx-1] | flags[idx+1] | flags[idx-stride] | flags[idx+stride] |
-					flags[idx-stride-1] | flags[idx-stride+1] | flags[idx+stride-1] | flags[idx+stride+1]
-				if neighbors&T1Sig != 0 {
-					ctx = CtxMag1
+				var ctx int
+				if f&T1Refine == 0 {
+					neighbors := flags[idx-1] | flags[idx+1] | flags[idx-stride] | flags[idx+stride] |
+						flags[idx-stride-1] | flags[idx-stride+1] | flags[idx+stride-1] | flags[idx+stride+1]
+					if neighbors&T1Sig != 0 {
+						ctx = CtxMag1
+					} else {
+						ctx = CtxMag0
+					}
 				} else {
-					ctx = CtxMag0
+					ctx = CtxMag2
 				}
-			} else {
-				ctx = CtxMag2
-			}
 
-			t.mqEncodeInlined(ctx, refBit)
-			flags[idx] |= T1Refine
+				t.mqEncodeInlined(ctx, refBit)
+				flags[idx] |= T1Refine
+			}
 		}
 	}
 }
@@ -916,6 +867,10 @@ func (t *T1) encodeRunLengthInlined(x, y, bp int, bit int32, stride int, flags [
 // Encode encodes a code-block and returns the bit-stream.
 // Uses fully inlined MQ encoding for maximum performance.
 func (t *T1) Encode(bandType int) []byte {
+	if t.style != 0 {
+		data, _ := t.EncodeWithPasses(bandType)
+		return data
+	}
 	return t.EncodeFast5(bandType)
 }
 
@@ -949,137 +904,30 @@ func (t *T1) EncodeSafe(bandType int) []byte {
 // encodeSignificancePass encodes the significance propagation pass.
 func (t *T1) encodeSignificancePass(bp int) {
 	bit := int32(1) << bp
-	stride := t.width + 2
-	flags := t.flags
-	data := t.data
-	width := t.width
-	height := t.height
-	bandType := t.bandType
-	bandOffset := bandType * 256 // Pre-calculate for LUT
-
-	for y := 0; y < height; y++ {
-		rowIdx := (y + 1) * stride
-		dataRowIdx := y * width
-		isFirstRow := y == 0
-		isLastRow := y == height-1
-
-		// Process 4 coefficients at a time (unrolled)
-		x := 0
-		for ; x+4 <= width; x += 4 {
-			idx := rowIdx + x + 1
-
-			// Process 4 coefficients
-			for dx := 0; dx < 4; dx++ {
-				i := idx + dx
-				f := flags[i]
-
-				if f&T1Sig != 0 {
-					continue
-				}
 
-				// Check significant neighbors
-				neighbors := flags[i-1] | flags[i+1] | flags[i-stride] | flags[i+stride] |
-					flags[i-stride-1] | flags[i-stride+1] | flags[i+stride-1] | flags[i+stride+1]
-				if neighbors&T1Sig == 0 {
+	for y0 := 0; y0 < t.height; y0 += 4 {
+		for x := 0; x < t.width; x++ {
+			for y := y0; y < y0+4 && y < t.height; y++ {
+				if t.hasFlag(x, y, T1Sig) || !t.hasSignificantNeighbor(x, y) {
 					continue
 				}
 
-				// Encode significance bit
 				sig := 0
-				if data[dataRowIdx+x+dx]&bit != 0 {
+				if t.data[y*t.width+x]&bit != 0 {
 					sig = 1
 				}
 
-				// Inline LUT context lookup
-				var packed uint8
-				if flags[i-1]&T1Sig != 0 {
-					packed |= 0x01
-				}
-				if flags[i+1]&T1Sig != 0 {
-					packed |= 0x02
-				}
-				if flags[i-stride]&T1Sig != 0 {
-					packed |= 0x04
-				}
-				if flags[i+stride]&T1Sig != 0 {
-					packed |= 0x08
-				}
-				if flags[i-stride-1]&T1Sig != 0 {
-					packed |= 0x10
-				}
-				if flags[i-stride+1]&T1Sig != 0 {
-					packed |= 0x20
-				}
-				if flags[i+stride-1]&T1Sig != 0 {
-					packed |= 0x40
-				}
-				if flags[i+stride+1]&T1Sig != 0 {
-					packed |= 0x80
-				}
-				ctx := int(lutZCCtx[bandOffset+int(packed)])
-				t.mqEnc.Encode(ctx, sig)
+				ctx := t.getZCContext(x, y, t.bandType)
+				t.encodeBit(ctx, sig)
 
 				if sig != 0 {
-					t.encodeSign(x+dx, y)
-					flags[i] |= T1Sig
-					if !isFirstRow {
-						flags[i-stride] |= T1SigS
-					}
-					if !isLastRow {
-						flags[i+stride] |= T1SigN
-					}
-					if x+dx > 0 {
-						flags[i-1] |= T1SigE
-					}
-					if x+dx < width-1 {
-						flags[i+1] |= T1SigW
-					}
+					t.encodeSign(x, y)
+					t.setFlag(x, y, T1Sig)
+					t.updateNeighborFlags(x, y)
 				}
-				flags[i] |= T1Visit
+				t.setFlag(x, y, T1Visit)
 			}
 		}
-
-		// Handle remaining coefficients
-		for ; x < width; x++ {
-			idx := rowIdx + x + 1
-			f := flags[idx]
-
-			if f&T1Sig != 0 {
-				continue
-			}
-
-			neighbors := flags[idx-1] | flags[idx+1] | flags[idx-stride] | flags[idx+stride] |
-				flags[idx-stride-1] | flags[idx-stride+1] | flags[idx+stride-1] | flags[idx+stride+1]
-			if neighbors&T1Sig == 0 {
-				continue
-			}
-
-			sig := 0
-			if data[dataRowIdx+x]&bit != 0 {
-				sig = 1
-			}
-
-			ctx := t.getZCContext(x, y, bandType)
-			t.mqEnc.Encode(ctx, sig)
-
-			if sig != 0 {
-				t.encodeSign(x, y)
-				flags[idx] |= T1Sig
-				if !isFirstRow {
-					flags[idx-stride] |= T1SigS
-				}
-				if !isLastRow {
-					flags[idx+stride] |= T1SigN
-				}
-				if x > 0 {
-					flags[idx-1] |= T1SigE
-				}
-				if x < width-1 {
-					flags[idx+1] |= T1SigW
-				}
-			}
-			flags[idx] |= T1Visit
-		}
 	}
 }
 
@@ -1087,17 +935,40 @@ func (t *T1) encodeSignificancePass(bp int) {
 func (t *T1) hasSignificantNeighbor(x, y int) bool {
 	idx := t.flagIndex(x, y)
 	stride := t.width + 2
-	return (t.flags[idx-1]|t.flags[idx+1]|t.flags[idx-stride]|t.flags[idx+stride]|
-		t.flags[idx-stride-1]|t.flags[idx-stride+1]|t.flags[idx+stride-1]|t.flags[idx+stride+1])&T1Sig != 0
+	return (t.flags[idx-1]|t.flags[idx+1]|t.flags[idx-stride]|
+		t.flags[idx-stride-1]|t.flags[idx-stride+1])&T1Sig != 0 ||
+		(t.flags[idx+stride]|t.flags[idx+stride-1]|t.flags[idx+stride+1])&t.southMask(y) != 0
+}
+
+// encodeBit codes one decision, raw when arithmetic coding is bypassed.
+func (t *T1) encodeBit(ctx, bit int) {
+	if t.rawEnc != nil {
+		t.rawEnc.EncodeBit(bit)
+		return
+	}
+	t.mqEnc.Encode(ctx, bit)
+}
+
+// decodeBit decodes one decision, raw when arithmetic coding is bypassed.
+func (t *T1) decodeBit(ctx int) int {
+	if t.rawDec != nil {
+		return t.rawDec.DecodeBit()
+	}
+	return t.mqDec.Decode(ctx)
 }
 
-// encodeSign encodes the sign of a newly significant coefficient.
+// encodeSign encodes the sign of a newly significant coefficient. Raw
+// coded signs are sent as is, without sign prediction.
 func (t *T1) encodeSign(x, y int) {
-	ctx, pred := t.getSCContext(x, y)
 	sign := 0
 	if t.hasFlag(x, y, T1SignNeg) {
 		sign = 1
 	}
+	if t.rawEnc != nil {
+		t.rawEnc.EncodeBit(sign)
+		return
+	}
+	ctx, pred := t.getSCContext(x, y)
 	t.mqEnc.Encode(ctx, sign^pred)
 }
 
@@ -1110,41 +981,27 @@ func (t *T1) encodeMagnitudeRefinementPass(bp int) {
 	width := t.width
 	height := t.height
 
-	for y := 0; y < height; y++ {
-		rowIdx := (y + 1) * stride
-		dataRowIdx := y * width
+	for y0 := 0; y0 < height; y0 += 4 {
 		for x := 0; x < width; x++ {
-			idx := rowIdx + x + 1
-			f := flags[idx]
-
-			// Only process coefficients that are significant and not visited
-			if f&T1Sig == 0 || f&T1Visit != 0 {
-				continue
-			}
+			for y := y0; y < y0+4 && y < height; y++ {
+				idx := (y+1)*stride + x + 1
+				dataRowIdx := y * width
+				f := flags[idx]
 
-			// Encode refinement bit
-			refBit := 0
-			if data[dataRowIdx+x]&bit != 0 {
-				refBit = 1
-			}
+				// Only process coefficients that are significant and not visited
+				if f&T1Sig == 0 || f&T1Visit != 0 {
+					continue
+				}
 
-			// Get MR context (inlined)
-			var ctx int
-			if f&T1Refine == 0 {
-				// Check if any neighbor is significant
-				neighbors := flags[idx-1] | flags[idx+1] | flags[idx-stride] | flags[idx+stride] |
-					flags[idx-stride-1] | flags[idx-stride+1] | flags[idx+stride-1] | flags[idx+stride+1]
-				if neighbors&T1Sig != 0 {
-					ctx = CtxMag1
-				} else {
-					ctx = CtxMag0
+				// Encode refinement bit
+				refBit := 0
+				if data[dataRowIdx+x]&bit != 0 {
+					refBit = 1
 				}
-			} else {
-				ctx = CtxMag2
-			}
 
-			t.mqEnc.Encode(ctx, refBit)
-			flags[idx] |= T1Refine
+				t.encodeBit(t.getMRContext(x, y), refBit)
+				flags[idx] |= T1Refine
+			}
 		}
 	}
 }
@@ -1179,7 +1036,7 @@ func (t *T1) encodeCleanupPass(bp int) {
 				}
 
 				ctx := t.getZCContext(x, yy, t.bandType)
-				t.mqEnc.Encode(ctx, sig)
+				t.encodeBit(ctx, sig)
 
 				if sig != 0 {
 					t.encodeSign(x, yy)
@@ -1246,7 +1103,7 @@ func (t *T1) encodeRunLength(x, y, bp int, bit int32) int {
 			sig = 1
 		}
 		ctx := t.getZCContext(x, y+i, t.bandType)
-		t.mqEnc.Encode(ctx, sig)
+		t.encodeBit(ctx, sig)
 		if sig != 0 {
 			t.encodeSign(x, y+i)
 			t.setFlag(x, y+i, T1Sig)
@@ -1259,28 +1116,31 @@ func (t *T1) encodeRunLength(x, y, bp int, bit int32) int {
 
 // Decode decodes a code-block from the given bit-stream.
 func (t *T1) Decode(data []byte, numBPS int, bandType int) []int32 {
-	t.bandType = bandType
-	t.numBPS = numBPS
-	t.mqDec = NewMQDecoder(data)
+	return t.DecodePasses(data, numBPS, 3*numBPS-2, bandType)
+}
 
-	// Clear data and flags
-	for i := range t.data {
-		t.data[i] = 0
-	}
-	for i := range t.flags {
-		t.flags[i] = 0
-	}
+// DecodePasses decodes the first numPasses coding passes of a code-block.
+// The first pass is the cleanup pass of the most significant bit-plane;
+// each lower bit-plane then has a significance propagation, a magnitude
+// refinement and a cleanup pass. When the block is truncated before its
+// last bit-plane, non-zero coefficients are reconstructed at the midpoint
+// of their remaining uncertainty interval.
+func (t *T1) DecodePasses(data []byte, numBPS, numPasses int, bandType int) []int32 {
+	return t.DecodeSegments([][]byte{data}, numBPS, numPasses, bandType)
+}
 
-	// Decode each bit-plane
-	for bp := numBPS - 1; bp >= 0; bp-- {
-		t.decodeSignificancePass(bp)
-		t.decodeMagnitudeRefinementPass(bp)
-		t.decodeCleanupPass(bp)
+// reconstruct returns the signed coefficients after numPasses passes
+// that ended in bit-plane bp.
+func (t *T1) reconstruct(numPasses, bp int) []int32 {
+	half := int32(0)
+	if numPasses > 0 && bp > 0 {
+		half = 1 << (bp - 1)
 	}
-
-	// Apply signs
 	result := make([]int32, len(t.data))
 	for i, v := range t.data {
+		if v != 0 {
+			v |= half
+		}
 		if t.flags[t.flagIndex(i%t.width, i/t.width)]&T1SignNeg != 0 {
 			result[i] = -v
 		} else {
@@ -1295,33 +1155,40 @@ func (t *T1) Decode(data []byte, numBPS int, bandType int) []int32 {
 func (t *T1) decodeSignificancePass(bp int) {
 	bit := int32(1) << bp
 
-	for y := 0; y < t.height; y++ {
+	for y0 := 0; y0 < t.height; y0 += 4 {
 		for x := 0; x < t.width; x++ {
-			if t.hasFlag(x, y, T1Sig) {
-				continue
-			}
-			if !t.hasSignificantNeighbor(x, y) {
-				continue
-			}
+			for y := y0; y < y0+4 && y < t.height; y++ {
+				if t.hasFlag(x, y, T1Sig) {
+					continue
+				}
+				if !t.hasSignificantNeighbor(x, y) {
+					continue
+				}
 
-			ctx := t.getZCContext(x, y, t.bandType)
-			sig := t.mqDec.Decode(ctx)
+				ctx := t.getZCContext(x, y, t.bandType)
+				sig := t.decodeBit(ctx)
 
-			if sig != 0 {
-				t.data[y*t.width+x] = bit
-				t.decodeSign(x, y)
-				t.setFlag(x, y, T1Sig)
-				t.updateNeighborFlags(x, y)
+				if sig != 0 {
+					t.data[y*t.width+x] = bit
+					t.decodeSign(x, y)
+					t.setFlag(x, y, T1Sig)
+					t.updateNeighborFlags(x, y)
+				}
+				t.setFlag(x, y, T1Visit)
 			}
-			t.setFlag(x, y, T1Visit)
 		}
 	}
 }
 
 // decodeSign decodes the sign of a coefficient.
 func (t *T1) decodeSign(x, y int) {
-	ctx, pred := t.getSCContext(x, y)
-	sign := t.mqDec.Decode(ctx) ^ pred
+	var sign int
+	if t.rawDec != nil {
+		sign = t.rawDec.DecodeBit()
+	} else {
+		ctx, pred := t.getSCContext(x, y)
+		sign = t.mqDec.Decode(ctx) ^ pred
+	}
 	if sign != 0 {
 		t.setFlag(x, y, T1SignNeg)
 	}
@@ -1331,17 +1198,19 @@ func (t *T1) decodeSign(x, y int) {
 func (t *T1) decodeMagnitudeRefinementPass(bp int) {
 	bit := int32(1) << bp
 
-	for y := 0; y < t.height; y++ {
+	for y0 := 0; y0 < t.height; y0 += 4 {
 		for x := 0; x < t.width; x++ {
-			if !t.hasFlag(x, y, T1Sig) || t.hasFlag(x, y, T1Visit) {
-				continue
-			}
+			for y := y0; y < y0+4 && y < t.height; y++ {
+				if !t.hasFlag(x, y, T1Sig) || t.hasFlag(x, y, T1Visit) {
+					continue
+				}
 
-			ctx := t.getMRContext(x, y)
-			if t.mqDec.Decode(ctx) != 0 {
-				t.data[y*t.width+x] |= bit
+				ctx := t.getMRContext(x, y)
+				if t.decodeBit(ctx) != 0 {
+					t.data[y*t.width+x] |= bit
+				}
+				t.setFlag(x, y, T1Refine)
 			}
-			t.setFlag(x, y, T1Refine)
 		}
 	}
 }
@@ -54,55 +54,43 @@ func init() {
 				h, v = v, h
 				fallthrough
 			case BandLL, BandLH: // LL/LH bands use same rules
-				if h == 2 {
+				switch {
+				case h == 2:
 					ctx = 8
-				} else if h == 1 {
-					if v >= 1 {
-						ctx = 7
-					} else if d >= 1 {
-						ctx = 6
-					} else {
-						ctx = 5
-					}
-				} else if v == 2 {
+				case h == 1 && v >= 1:
+					ctx = 7
+				case h == 1 && d >= 1:
+					ctx = 6
+				case h == 1:
+					ctx = 5
+				case v == 2:
 					ctx = 4
-				} else if v == 1 {
-					if d >= 1 {
-						ctx = 3
-					} else {
-						ctx = 2
-					}
-				} else if d >= 2 {
+				case v == 1:
+					ctx = 3
+				case d >= 2:
+					ctx = 2
+				case d == 1:
 					ctx = 1
-				} else {
-					ctx = 0
 				}
 			case BandHH: // HH band
 				hv := h + v
-				if hv >= 3 {
+				switch {
+				case d >= 3:
 					ctx = 8
-				} else if hv == 2 {
-					if d >= 2 {
-						ctx = 7
-					} else if d >= 1 {
-						ctx = 6
-					} else {
-						ctx = 5
-					}
-				} else if hv == 1 {
-					if d >= 2 {
-						ctx = 4
-					} else {
-						ctx = 3
-					}
-				} else {
-					if d >= 2 {
-						ctx = 2
-					} else if d >= 1 {
-						ctx = 1
-					} else {
-						ctx = 0
-					}
+				case d == 2 && hv >= 1:
+					ctx = 7
+				case d == 2:
+					ctx = 6
+				case d == 1 && hv >= 2:
+					ctx = 5
+				case d == 1 && hv == 1:
+					ctx = 4
+				case d == 1:
+					ctx = 3
+				case hv >= 2:
+					ctx = 2
+				case hv == 1:
+					ctx = 1
 				}
 			}
 			lutZCCtx[bandType*256+packed] = uint8(ctx)
@@ -115,37 +103,7 @@ func init() {
 		for vc := -2; vc <= 2; vc++ {
 			idx := (hc+2)*5 + (vc + 2)
 
-			h := hc
-			v := vc
-			pred := 0
-			if h < 0 {
-				pred = 1
-				h = -h
-			}
-			if h == 0 && v < 0 {
-				pred = 1
-				v = -v
-			}
-
-			var ctx int
-			if h == 1 {
-				if v == 1 {
-					ctx = CtxSC4
-				} else if v == 0 {
-					ctx = CtxSC2
-				} else {
-					ctx = CtxSC1
-				}
-			} else if h == 0 {
-				if v == 1 {
-					ctx = CtxSC1
-				} else if v == 0 {
-					ctx = CtxSC0
-				}
-			} else if h == 2 {
-				ctx = CtxSC3
-			}
-
+			ctx, pred := signContext(hc, vc)
 			lutSCCtx[idx] = uint8((ctx << 1) | pred)
 		}
 	}
@@ -196,40 +154,39 @@ func init() {
 			}
 		}
 
-		// Compute prediction
-		pred := 0
-		if hc < 0 {
-			pred = 1
-			hc = -hc
-		}
-		if hc == 0 && vc < 0 {
-			pred = 1
-			vc = -vc
-		}
-
-		// Compute context (0-4)
-		ctx := uint8(0) // CtxSC0 relative
-		if hc == 1 {
-			if vc == 1 {
-				ctx = 4 // CtxSC4
-			} else if vc == 0 {
-				ctx = 2 // CtxSC2
-			} else {
-				ctx = 1 // CtxSC1
-			}
-		} else if hc == 0 {
-			if vc == 1 {
-				ctx = 1 // CtxSC1
-			}
-		} else if hc == 2 {
-			ctx = 3 // CtxSC3
-		}
+		ctx, pred := signContext(hc, vc)
+		ctx -= CtxSC0
 
-		lutSignCtx[i] = ctx
+		lutSignCtx[i] = uint8(ctx)
 		lutSignPred[i] = uint8(pred)
 	}
 }
 
+// signContext maps the horizontal and vertical sign contributions of a
+// coefficient's neighbors to its sign coding context and XOR prediction bit
+// (ITU-T T.800 Table D.3). Contributions are clamped to [-1, 1].
+func signContext(hc, vc int) (ctx int, pred int) {
+	hc = max(-1, min(hc, 1))
+	vc = max(-1, min(vc, 1))
+	if hc < 0 || (hc == 0 && vc < 0) {
+		pred = 1
+		hc, vc = -hc, -vc
+	}
+	switch {
+	case hc == 0 && vc == 0:
+		ctx = CtxSC0
+	case hc == 0:
+		ctx = CtxSC1
+	case vc < 0:
+		ctx = CtxSC2
+	case vc == 0:
+		ctx = CtxSC3
+	default:
+		ctx = CtxSC4
+	}
+	return ctx, pred
+}
+
 // getZCContextFast returns ZC context using packed flags and LUT.
 // This is an inline-friendly version for hot paths.
 func getZCContextFast(packed uint8, bandType int) int {
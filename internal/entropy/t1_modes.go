@@ -0,0 +1,236 @@
+package entropy
+
+// Code-block coding modes
+//
+// The code-block style (Scb) of the COD and COC markers selects optional
+// coding modes (ITU-T T.800 Table A.19 and D.6):
+//
+//   - Selective arithmetic coding bypass: after the first four bit-planes
+//     the significance propagation and magnitude refinement passes are
+//     sent as raw bits, and only cleanup passes stay arithmetic coded.
+//   - Reset: context probabilities return to their initial states after
+//     every coding pass.
+//   - Termination on each pass: every pass ends its codeword segment.
+//   - Vertically causal contexts: the last row of a stripe ignores the
+//     significance of the stripe below it.
+//   - Predictable termination: segments are flushed so a decoder can
+//     check that it consumed exactly the coded bits.
+//   - Segmentation symbols: every cleanup pass ends with the symbols
+//     1010 in the uniform context.
+//
+// A codeword segment holds the bytes of consecutive coding passes up to
+// a terminated one; a decoder restarts its arithmetic or raw decoder at
+// each segment, keeping the context states.
+
+// Code-block style flags, with the bit values of the Scb field.
+const (
+	StyleBypass                 = 0x01
+	StyleReset                  = 0x02
+	StyleTermAll                = 0x04
+	StyleCausal                 = 0x08
+	StylePredictableTermination = 0x10
+	StyleSegmentationSymbols    = 0x20
+)
+
+// bypassPasses is the number of leading coding passes, those of the
+// first four bit-planes, that stay arithmetic coded in bypass mode.
+const bypassPasses = 10
+
+// SetStyle selects the coding modes, a combination of the Style flags,
+// for the following encodes and decodes. Resize clears them.
+func (t *T1) SetStyle(style uint8) {
+	t.style = style
+}
+
+// IsTerminatedPass reports whether coding pass pass, counted from the
+// first cleanup pass, ends a codeword segment under style. The last pass
+// of a code-block always ends one too.
+func IsTerminatedPass(pass int, style uint8) bool {
+	if style&StyleTermAll != 0 {
+		return true
+	}
+	if style&StyleBypass != 0 {
+		// The MQ segment of the first four bit-planes, then each raw
+		// pair of passes and each cleanup pass
+		return pass == bypassPasses-1 || (pass >= bypassPasses && passType(pass) != PassSignificance)
+	}
+	return false
+}
+
+// isRawPass reports whether coding pass pass is sent as raw bits.
+func isRawPass(pass int, style uint8) bool {
+	return style&StyleBypass != 0 && pass >= bypassPasses && passType(pass) != PassCleanup
+}
+
+// passType returns the PassSignificance, PassRefinement or PassCleanup
+// type of coding pass pass.
+func passType(pass int) int {
+	return (pass + 2) % 3
+}
+
+// encodeStyled implements EncodeWithPasses for code-blocks with coding
+// modes, one coding pass at a time. t.numBPS must be set.
+func (t *T1) encodeStyled() ([]byte, []PassInfo) {
+	t.mqEnc.Reset()
+	t.rawEnc = nil
+
+	n := t.width * t.height
+	sigBefore := make([]bool, n)
+	sigAfterSPP := make([]bool, n)
+	numPasses := 3*t.numBPS - 2
+	passes := make([]PassInfo, 0, numPasses)
+
+	var data []byte
+	for pass := 0; pass < numPasses; pass++ {
+		bp := t.numBPS - 1 - (pass+2)/3
+		if isRawPass(pass, t.style) {
+			if t.rawEnc == nil {
+				t.rawEnc = NewRawEncoder()
+			}
+		} else {
+			t.rawEnc = nil
+		}
+
+		var distortion float64
+		switch passType(pass) {
+		case PassSignificance:
+			t.snapshotSignificance(sigBefore)
+			t.encodeSignificancePass(bp)
+			t.snapshotSignificance(sigAfterSPP)
+			distortion = t.significanceGain(sigBefore, sigAfterSPP, bp)
+		case PassRefinement:
+			t.encodeMagnitudeRefinementPass(bp)
+			distortion = t.refinementGain(sigBefore, bp)
+		case PassCleanup:
+			if pass == 0 {
+				t.snapshotSignificance(sigAfterSPP)
+			}
+			t.encodeCleanupPass(bp)
+			if t.style&StyleSegmentationSymbols != 0 {
+				for _, bit := range []int{1, 0, 1, 0} {
+					t.mqEnc.Encode(CtxUni, bit)
+				}
+			}
+			distortion = t.significanceGain(sigAfterSPP, nil, bp)
+		}
+		if t.style&StyleReset != 0 {
+			t.mqEnc.ResetAllContexts()
+		}
+
+		length := len(data)
+		switch {
+		case IsTerminatedPass(pass, t.style) || pass == numPasses-1:
+			data = append(data, t.terminate()...)
+			length = len(data)
+		case t.rawEnc != nil:
+			length += len(t.rawEnc.buf) + 1
+		default:
+			length += t.mqEnc.bp + mqRateCorrection
+		}
+		passes = append(passes, PassInfo{
+			Type:             passType(pass),
+			CumulativeLength: length,
+			Distortion:       distortion,
+		})
+	}
+	t.rawEnc = nil
+
+	// Terminated passes have exact lengths; keep the estimates of the
+	// others below the length of the pass after them, which also makes
+	// the lengths monotonic
+	for i := len(passes) - 2; i >= 0; i-- {
+		passes[i].CumulativeLength = min(passes[i].CumulativeLength, passes[i+1].CumulativeLength)
+	}
+
+	return data, passes
+}
+
+// terminate flushes the coder of the current pass, ending its codeword
+// segment, and readies it for the next one.
+func (t *T1) terminate() []byte {
+	predictable := t.style&StylePredictableTermination != 0
+	if t.rawEnc != nil {
+		var seg []byte
+		if predictable {
+			seg = t.rawEnc.FlushPredictable()
+		} else {
+			seg = t.rawEnc.Flush()
+		}
+		t.rawEnc = nil
+		return seg
+	}
+
+	var seg []byte
+	if predictable {
+		seg = t.mqEnc.FlushPredictable()
+	} else {
+		seg = t.mqEnc.Flush()
+	}
+	seg = append([]byte(nil), seg...)
+	t.mqEnc.Restart()
+	return seg
+}
+
+// DecodeSegments decodes the first numPasses coding passes of a
+// code-block coded with the modes set by SetStyle. segments holds the
+// codeword segments in order, split after each pass IsTerminatedPass
+// reports; the last one may end early. Coefficients are reconstructed
+// as by DecodePasses.
+func (t *T1) DecodeSegments(segments [][]byte, numBPS, numPasses int, bandType int) []int32 {
+	t.bandType = bandType
+	t.numBPS = numBPS
+
+	for i := range t.data {
+		t.data[i] = 0
+	}
+	for i := range t.flags {
+		t.flags[i] = 0
+	}
+
+	numPasses = min(numPasses, 3*numBPS-2)
+	contexts := mqInitContexts
+	t.mqDec = nil
+	seg := 0
+	bp := numBPS - 1
+	for pass := 0; pass < numPasses; pass++ {
+		// Start each codeword segment with a fresh decoder
+		if pass == 0 || IsTerminatedPass(pass-1, t.style) {
+			var data []byte
+			if seg < len(segments) {
+				data = segments[seg]
+			}
+			seg++
+			if t.mqDec != nil {
+				contexts = t.mqDec.contexts
+			}
+			t.rawDec = nil
+			if isRawPass(pass, t.style) {
+				t.rawDec = NewRawDecoder(data)
+			} else {
+				t.mqDec = NewMQDecoder(data)
+				t.mqDec.contexts = contexts
+			}
+		}
+
+		switch passType(pass) {
+		case PassSignificance:
+			bp--
+			t.decodeSignificancePass(bp)
+		case PassRefinement:
+			t.decodeMagnitudeRefinementPass(bp)
+		case PassCleanup:
+			t.decodeCleanupPass(bp)
+			if t.style&StyleSegmentationSymbols != 0 {
+				for i := 0; i < 4; i++ {
+					t.mqDec.Decode(CtxUni)
+				}
+			}
+		}
+		if t.style&StyleReset != 0 && t.rawDec == nil {
+			t.mqDec.ResetAllContexts()
+		}
+	}
+	t.rawDec = nil
+
+	return t.reconstruct(numPasses, bp)
+}
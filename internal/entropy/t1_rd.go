@@ -0,0 +1,162 @@
+package entropy
+
+import "math"
+
+// Coding pass types reported by EncodeWithPasses.
+const (
+	PassSignificance = iota
+	PassRefinement
+	PassCleanup
+)
+
+// PassInfo describes one coding pass produced by EncodeWithPasses.
+type PassInfo struct {
+	// Type is PassSignificance, PassRefinement or PassCleanup.
+	Type int
+
+	// CumulativeLength is the estimated number of codeword bytes needed
+	// to decode every pass up to and including this one.
+	CumulativeLength int
+
+	// Distortion is the reduction in squared error of the code-block
+	// coefficients achieved by this pass.
+	Distortion float64
+}
+
+// mqRateCorrection is added to the bytes emitted so far to estimate the
+// truncation length of an unterminated pass, accounting for the bits
+// still held in the MQ coder registers.
+const mqRateCorrection = 3
+
+// EncodeWithPasses encodes a code-block like Encode and additionally
+// reports the rate and distortion reduction of every coding pass, as
+// needed for rate-distortion optimised layer formation. It is slower
+// than Encode because significance is tracked between passes.
+func (t *T1) EncodeWithPasses(bandType int) ([]byte, []PassInfo) {
+	t.bandType = bandType
+	t.resetMQInlined()
+
+	maxVal := int32(0)
+	for _, v := range t.data {
+		if v > maxVal {
+			maxVal = v
+		}
+	}
+	if maxVal == 0 {
+		return nil, nil
+	}
+	t.numBPS = int(math.Ceil(math.Log2(float64(maxVal + 1))))
+	if t.style != 0 {
+		return t.encodeStyled()
+	}
+
+	n := t.width * t.height
+	sigBefore := make([]bool, n)
+	sigAfterSPP := make([]bool, n)
+	passes := make([]PassInfo, 0, 3*t.numBPS-2)
+
+	record := func(passType int, distortion float64) {
+		passes = append(passes, PassInfo{
+			Type:             passType,
+			CumulativeLength: t.mqBp + mqRateCorrection,
+			Distortion:       distortion,
+		})
+	}
+
+	for bp := t.numBPS - 1; bp >= 0; bp-- {
+		t.snapshotSignificance(sigBefore)
+
+		// The most significant bit-plane has only a cleanup pass
+		if bp == t.numBPS-1 {
+			copy(sigAfterSPP, sigBefore)
+		} else {
+			t.encodeSignificancePassInlined(bp)
+			t.snapshotSignificance(sigAfterSPP)
+			record(PassSignificance, t.significanceGain(sigBefore, sigAfterSPP, bp))
+
+			t.encodeMagnitudeRefinementPassInlined(bp)
+			record(PassRefinement, t.refinementGain(sigBefore, bp))
+		}
+
+		t.encodeCleanupPassInlined(bp)
+		record(PassCleanup, t.significanceGain(sigAfterSPP, nil, bp))
+	}
+
+	data := t.mqFlushInlined()
+
+	// Clamp the estimates to the flushed codeword and keep them monotonic
+	prev := 0
+	for i := range passes {
+		l := passes[i].CumulativeLength
+		if l > len(data) || i == len(passes)-1 {
+			l = len(data)
+		}
+		if l < prev {
+			l = prev
+		}
+		passes[i].CumulativeLength = l
+		prev = l
+	}
+
+	return data, passes
+}
+
+// snapshotSignificance records which coefficients are significant.
+func (t *T1) snapshotSignificance(sig []bool) {
+	stride := t.width + 2
+	for y := 0; y < t.height; y++ {
+		row := (y+1)*stride + 1
+		for x := 0; x < t.width; x++ {
+			sig[y*t.width+x] = t.flags[row+x]&T1Sig != 0
+		}
+	}
+}
+
+// significanceGain returns the distortion reduction from coefficients
+// that became significant at bit-plane bp: significant now (or in after,
+// when non-nil) but not in before.
+func (t *T1) significanceGain(before, after []bool, bp int) float64 {
+	stride := t.width + 2
+	gain := 0.0
+	for y := 0; y < t.height; y++ {
+		row := (y+1)*stride + 1
+		for x := 0; x < t.width; x++ {
+			i := y*t.width + x
+			now := t.flags[row+x]&T1Sig != 0
+			if after != nil {
+				now = after[i]
+			}
+			if now && !before[i] {
+				v := float64(t.data[i])
+				e := v - reconstruction(t.data[i], bp)
+				gain += v*v - e*e
+			}
+		}
+	}
+	return gain
+}
+
+// refinementGain returns the distortion reduction from refining the
+// coefficients that were significant before bit-plane bp.
+func (t *T1) refinementGain(before []bool, bp int) float64 {
+	gain := 0.0
+	for i, sig := range before {
+		if !sig {
+			continue
+		}
+		v := float64(t.data[i])
+		e0 := v - reconstruction(t.data[i], bp+1)
+		e1 := v - reconstruction(t.data[i], bp)
+		gain += e0*e0 - e1*e1
+	}
+	return gain
+}
+
+// reconstruction returns the decoder's midpoint reconstruction of
+// magnitude v once bit-planes down to bp are known.
+func reconstruction(v int32, bp int) float64 {
+	if bp == 0 {
+		return float64(v)
+	}
+	return float64((v>>bp)<<bp) + float64(int32(1)<<(bp-1))
+}
@@ -1,6 +1,8 @@
 package entropy
 
 import (
+	"bytes"
+	"math"
 	"testing"
 )
 
@@ -250,3 +252,168 @@ func BenchmarkT1_Decode(b *testing.B) {
 		t1.Decode(encoded, 10, BandLL)
 	}
 }
+
+// rdTestBlock returns a 32x32 block of signed coefficients.
+func rdTestBlock() []int32 {
+	data := make([]int32, 32*32)
+	for i := range data {
+		v := int32((i*37)%251) - 125
+		if i%7 == 0 {
+			v = 0
+		}
+		data[i] = v
+	}
+	return data
+}
+
+func TestT1_EncodeWithPasses(t *testing.T) {
+	data := rdTestBlock()
+
+	ref := NewT1(32, 32)
+	ref.SetData(data)
+	want := ref.EncodeSafe(BandHL)
+
+	t1 := NewT1(32, 32)
+	t1.SetData(data)
+	got, passes := t1.EncodeWithPasses(BandHL)
+
+	if !bytes.Equal(got, want) {
+		t.Fatal("EncodeWithPasses() codeword differs from EncodeSafe()")
+	}
+	if len(passes) != 3*t1.numBPS-2 {
+		t.Fatalf("got %d passes, want %d", len(passes), 3*t1.numBPS-2)
+	}
+
+	energy := 0.0
+	for _, v := range data {
+		energy += float64(v) * float64(v)
+	}
+	total := 0.0
+	prev := 0
+	for i, p := range passes {
+		// The first pass is a cleanup pass, then the cycle repeats
+		if want := (i + 2) % 3; p.Type != want {
+			t.Errorf("pass %d type = %d, want %d", i, p.Type, want)
+		}
+		if p.CumulativeLength < prev {
+			t.Errorf("pass %d cumulative length %d < previous %d", i, p.CumulativeLength, prev)
+		}
+		if p.Distortion < 0 {
+			t.Errorf("pass %d distortion = %v, want >= 0", i, p.Distortion)
+		}
+		prev = p.CumulativeLength
+		total += p.Distortion
+	}
+	if prev != len(got) {
+		t.Errorf("final cumulative length = %d, want %d", prev, len(got))
+	}
+	// Decoding every pass is lossless, so all energy is removed
+	if math.Abs(total-energy) > 1e-6*energy {
+		t.Errorf("total distortion reduction = %v, want %v", total, energy)
+	}
+}
+
+func TestT1_EncodeWithPassesZero(t *testing.T) {
+	t1 := NewT1(8, 8)
+	t1.SetData(make([]int32, 64))
+	data, passes := t1.EncodeWithPasses(BandLL)
+	if data != nil || passes != nil {
+		t.Errorf("EncodeWithPasses(zero block) = %v, %v; want nil, nil", data, passes)
+	}
+}
+
+func BenchmarkT1_EncodeWithPasses64x64(b *testing.B) {
+	data := make([]int32, 64*64)
+	for i := range data {
+		data[i] = int32((i*37)%251) - 125
+	}
+	t1 := NewT1(64, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		t1.Resize(64, 64)
+		t1.SetData(data)
+		t1.EncodeWithPasses(BandHL)
+	}
+}
+
+func TestT1_CodingModesRoundtrip(t *testing.T) {
+	data := rdTestBlock()
+	styles := []struct {
+		name  string
+		style uint8
+	}{
+		{"bypass", StyleBypass},
+		{"reset", StyleReset},
+		{"termall", StyleTermAll},
+		{"causal", StyleCausal},
+		{"pterm", StylePredictableTermination | StyleTermAll},
+		{"segmark", StyleSegmentationSymbols},
+		{"bypass_pterm", StyleBypass | StylePredictableTermination},
+		{"all", 0x3F},
+	}
+
+	for _, tt := range styles {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewT1(32, 32)
+			enc.SetStyle(tt.style)
+			enc.SetData(data)
+			codeword, passes := enc.EncodeWithPasses(BandHH)
+			if len(passes) != 3*enc.numBPS-2 {
+				t.Fatalf("got %d passes, want %d", len(passes), 3*enc.numBPS-2)
+			}
+
+			// Split the codeword after every terminated pass
+			var segments [][]byte
+			start := 0
+			for i, p := range passes {
+				if IsTerminatedPass(i, tt.style) || i == len(passes)-1 {
+					segments = append(segments, codeword[start:p.CumulativeLength])
+					start = p.CumulativeLength
+				}
+			}
+			if start != len(codeword) {
+				t.Fatalf("segments cover %d of %d bytes", start, len(codeword))
+			}
+
+			dec := NewT1(32, 32)
+			dec.SetStyle(tt.style)
+			got := dec.DecodeSegments(segments, enc.numBPS, len(passes), BandHH)
+			for i := range data {
+				if got[i] != data[i] {
+					t.Fatalf("coefficient %d = %d, want %d", i, got[i], data[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRawEncoderFlush(t *testing.T) {
+	// Eight ones make a 0xFF byte, which a plain flush drops and a
+	// predictable one keeps, padding after it
+	for _, predictable := range []bool{false, true} {
+		enc := NewRawEncoder()
+		for i := 0; i < 8; i++ {
+			enc.EncodeBit(1)
+		}
+		var got []byte
+		if predictable {
+			got = enc.FlushPredictable()
+		} else {
+			got = enc.Flush()
+		}
+		want := []byte{}
+		if predictable {
+			want = []byte{0xFF, 0x2A}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("predictable=%v: Flush() = %X, want %X", predictable, got, want)
+		}
+
+		dec := NewRawDecoder(got)
+		for i := 0; i < 8; i++ {
+			if dec.DecodeBit() != 1 {
+				t.Errorf("predictable=%v: bit %d decoded as 0", predictable, i)
+			}
+		}
+	}
+}
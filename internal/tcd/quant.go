@@ -0,0 +1,103 @@
+package tcd
+
+import (
+	"math"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+)
+
+// Quantization
+//
+// Each subband has a quantization step size Δb and a number of magnitude
+// bit-planes Mb, both signalled in the QCD or QCC marker (ITU-T T.800
+// Annex E). A step size is coded as an exponent εb and an 11-bit mantissa
+// μb relative to the nominal dynamic range Rb of the subband:
+//
+//	Δb = 2^(Rb-εb) * (1 + μb/2^11)
+//	Mb = G + εb - 1
+//
+// where G is the number of guard bits. Reversible coding signals only εb
+// and uses Δb = 1.
+
+// BandGain returns log2 of the nominal gain of a subband type: 0 for LL,
+// 1 for HL and LH, and 2 for HH (Table E.1).
+func BandGain(t SubbandType) int {
+	switch t {
+	case SubbandHL, SubbandLH:
+		return 1
+	case SubbandHH:
+		return 2
+	}
+	return 0
+}
+
+// bandIndex returns the position of a subband in the SPqcd step size
+// list: the LL band first, then HL, LH and HH of each resolution level.
+func bandIndex(r int, t SubbandType) int {
+	if r == 0 {
+		return 0
+	}
+	return 1 + 3*(r-1) + int(t-SubbandHL)
+}
+
+// bandQuantization returns the step size Δb and the number of magnitude
+// bit-planes Mb of the band of type t at resolution level r of component
+// c. numDecomp is the component's number of decomposition levels.
+func bandQuantization(h *codestream.Header, c, numDecomp, r int, t SubbandType) (step float64, mb int) {
+	q := h.ComponentQuantizationStyle(c)
+	if len(q.StepSizes) == 0 {
+		return 1, 0
+	}
+
+	var s codestream.StepSize
+	switch q.Style() {
+	case codestream.QuantizationScalarDerived:
+		// Only the LL step is signalled; the others follow from the
+		// decomposition level of the band (equation E-5)
+		nb := numDecomp - r + 1
+		if r == 0 {
+			nb = numDecomp
+		}
+		s = q.StepSizes[0]
+		s.Exponent = uint8(max(int(s.Exponent)-numDecomp+nb, 0))
+	default:
+		i := bandIndex(r, t)
+		if i >= len(q.StepSizes) {
+			i = len(q.StepSizes) - 1
+		}
+		s = q.StepSizes[i]
+	}
+
+	mb = int(q.NumGuardBits) + int(s.Exponent) - 1
+	if q.Style() == codestream.QuantizationNone {
+		return 1, mb
+	}
+
+	return stepSizeValue(s, h.ComponentInfo[c].Precision()+BandGain(t)), mb
+}
+
+// EncodeStepSize returns the exponent and mantissa that code step size
+// step for a subband of nominal dynamic range rb, the inverse of the
+// computation in stepSizeValue. Steps beyond the representable range
+// are clamped to it.
+func EncodeStepSize(step float64, rb int) codestream.StepSize {
+	frac, exp := math.Frexp(step) // step = frac * 2^exp, frac in [0.5, 1)
+	e := rb - (exp - 1)
+	m := int(math.Round((2*frac - 1) * 2048))
+	if m == 2048 {
+		m, e = 0, e-1
+	}
+	switch {
+	case e < 0:
+		return codestream.StepSize{Exponent: 0, Mantissa: 0x7FF}
+	case e > 31:
+		return codestream.StepSize{Exponent: 31, Mantissa: 0}
+	}
+	return codestream.StepSize{Exponent: uint8(e), Mantissa: uint16(m)}
+}
+
+// stepSizeValue returns the step size coded by s for a subband of nominal
+// dynamic range rb.
+func stepSizeValue(s codestream.StepSize, rb int) float64 {
+	return math.Ldexp(1+float64(s.Mantissa)/2048, rb-int(s.Exponent))
+}
@@ -0,0 +1,254 @@
+package tcd
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+// Rate allocation
+//
+// Each code-block's coding passes form an operational rate-distortion
+// curve. Only passes on the lower convex hull of that curve are useful
+// truncation points; their slopes (distortion reduction per byte) are
+// strictly decreasing within a block. PCRD-opt (ISO/IEC 15444-1 Annex J.14)
+// assigns hull segments from all code-blocks to quality layers in order of
+// decreasing slope, so each layer spends its byte budget where it removes
+// the most distortion.
+
+// PassSlope returns the distortion reduction per byte of a single coding
+// pass. Unlike CodingPass.Slope it ignores the convex hull, so it is not
+// monotonic across a code-block's passes. Zero-length passes that reduce
+// distortion have infinite slope.
+func PassSlope(pass CodingPass) float64 {
+	if pass.Distortion <= 0 {
+		return 0
+	}
+	if pass.Length <= 0 {
+		return math.Inf(1)
+	}
+	return pass.Distortion / float64(pass.Length)
+}
+
+// ComputeSlopes computes the convex-hull rate-distortion slopes of a
+// code-block's coding passes. Passes must have Length, CumulativeLength
+// and Distortion set. Passes that are not hull truncation points get a
+// slope of zero.
+func ComputeSlopes(cb *CodeBlock) {
+	// Hull of (rate, cumulative distortion reduction) points, starting at
+	// the origin (nothing included)
+	hull := make([]int, 0, len(cb.Passes))
+	rate := func(i int) float64 {
+		if i < 0 {
+			return 0
+		}
+		return float64(cb.Passes[i].CumulativeLength)
+	}
+	gain := make([]float64, len(cb.Passes))
+	total := 0.0
+	for i := range cb.Passes {
+		total += cb.Passes[i].Distortion
+		gain[i] = total
+		cb.Passes[i].Slope = 0
+	}
+	dist := func(i int) float64 {
+		if i < 0 {
+			return 0
+		}
+		return gain[i]
+	}
+	slope := func(from, to int) float64 {
+		dr := rate(to) - rate(from)
+		dd := dist(to) - dist(from)
+		if dd <= 0 {
+			return 0
+		}
+		if dr <= 0 {
+			return math.Inf(1)
+		}
+		return dd / dr
+	}
+
+	for i := range cb.Passes {
+		prev := -1
+		if len(hull) > 0 {
+			prev = hull[len(hull)-1]
+		}
+		s := slope(prev, i)
+		if s <= 0 {
+			continue
+		}
+		// Drop earlier points whose slope is not steeper than the new one
+		for len(hull) > 0 {
+			last := hull[len(hull)-1]
+			before := -1
+			if len(hull) > 1 {
+				before = hull[len(hull)-2]
+			}
+			if slope(before, last) > slope(last, i) {
+				break
+			}
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, i)
+	}
+
+	prev := -1
+	for _, i := range hull {
+		cb.Passes[i].Slope = slope(prev, i)
+		prev = i
+	}
+}
+
+// hullSegment is the run of passes between two hull truncation points.
+type hullSegment struct {
+	block  int
+	passes int // Cumulative passes included after this segment
+	bytes  int
+	slope  float64
+}
+
+// AllocateLayersPCRD assigns coding passes to quality layers with
+// PCRD-opt. budgets holds the cumulative byte budget of each layer and
+// must be non-decreasing. ComputeSlopes must have been called on every
+// block. The result is stored in each block's LayerPasses and
+// IncludedInLayers.
+func AllocateLayersPCRD(blocks []*CodeBlock, budgets []int) {
+	numPasses := 0
+	for _, cb := range blocks {
+		numPasses += len(cb.Passes)
+	}
+	segments := make([]hullSegment, 0, numPasses)
+	for b, cb := range blocks {
+		prevLen := 0
+		for i, p := range cb.Passes {
+			if p.Slope <= 0 {
+				continue
+			}
+			segments = append(segments, hullSegment{
+				block:  b,
+				passes: i + 1,
+				bytes:  p.CumulativeLength - prevLen,
+				slope:  p.Slope,
+			})
+			prevLen = p.CumulativeLength
+		}
+	}
+	// Hull slopes decrease within a block; breaking ties by position keeps
+	// each block's segments in coding order.
+	slices.SortFunc(segments, func(a, b hullSegment) int {
+		if c := cmp.Compare(b.slope, a.slope); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.block, b.block); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.passes, b.passes)
+	})
+
+	included := make([]int, len(blocks))
+	for _, cb := range blocks {
+		cb.LayerPasses = make([]int, len(budgets))
+	}
+
+	next, spent := 0, 0
+	for layer, budget := range budgets {
+		for next < len(segments) && spent+segments[next].bytes <= budget {
+			seg := segments[next]
+			included[seg.block] = seg.passes
+			spent += seg.bytes
+			next++
+		}
+		for b, cb := range blocks {
+			cb.LayerPasses[layer] = included[b]
+		}
+	}
+
+	setIncludedInLayers(blocks, len(budgets))
+}
+
+// AllocateLayersGeometric assigns coding passes to quality layers by
+// giving every code-block the same fraction of its own data as the layer
+// budget is of the total. It ignores rate-distortion information and is
+// kept as a baseline for PCRD-opt.
+func AllocateLayersGeometric(blocks []*CodeBlock, budgets []int) {
+	total := 0
+	for _, cb := range blocks {
+		if n := len(cb.Passes); n > 0 {
+			total += cb.Passes[n-1].CumulativeLength
+		}
+	}
+
+	for _, cb := range blocks {
+		cb.LayerPasses = make([]int, len(budgets))
+		if len(cb.Passes) == 0 || total == 0 {
+			continue
+		}
+		blockLen := cb.Passes[len(cb.Passes)-1].CumulativeLength
+		for layer, budget := range budgets {
+			limit := float64(blockLen) * float64(budget) / float64(total)
+			n := 0
+			for n < len(cb.Passes) && float64(cb.Passes[n].CumulativeLength) <= limit {
+				n++
+			}
+			cb.LayerPasses[layer] = n
+		}
+	}
+
+	setIncludedInLayers(blocks, len(budgets))
+}
+
+// setIncludedInLayers records the first layer contributing to each block.
+func setIncludedInLayers(blocks []*CodeBlock, numLayers int) {
+	for _, cb := range blocks {
+		cb.IncludedInLayers = numLayers
+		for layer, n := range cb.LayerPasses {
+			if n > 0 {
+				cb.IncludedInLayers = layer
+				break
+			}
+		}
+	}
+}
+
+// layerContribution returns the number of new coding passes and the byte
+// range of cb.Data a block contributes to a layer.
+func layerContribution(cb *CodeBlock, layer int) (numPasses, start, end int) {
+	if cb.LayerPasses == nil {
+		// No rate allocation: the whole block is sent in the layer it is
+		// included in.
+		if cb.IncludedInLayers == layer && len(cb.Data) > 0 {
+			return len(cb.Passes), 0, len(cb.Data)
+		}
+		return 0, 0, 0
+	}
+	if layer >= len(cb.LayerPasses) {
+		return 0, 0, 0
+	}
+
+	prev := 0
+	if layer > 0 {
+		prev = cb.LayerPasses[layer-1]
+	}
+	cur := cb.LayerPasses[layer]
+	if cur <= prev {
+		return 0, 0, 0
+	}
+	if prev > 0 {
+		start = cb.Passes[prev-1].CumulativeLength
+	}
+	end = cb.Passes[cur-1].CumulativeLength
+	if end > len(cb.Data) {
+		end = len(cb.Data)
+	}
+	return cur - prev, start, end
+}
+
+// firstNewPass returns the index of the first coding pass cb contributes
+// to layer.
+func firstNewPass(cb *CodeBlock, layer int) int {
+	if cb.LayerPasses == nil || layer == 0 || layer > len(cb.LayerPasses) {
+		return 0
+	}
+	return cb.LayerPasses[layer-1]
+}
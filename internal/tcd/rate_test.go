@@ -0,0 +1,222 @@
+package tcd
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// newRDBlock creates a code-block whose passes have the given lengths and
+// distortion reductions.
+func newRDBlock(lengths []int, distortions []float64) *CodeBlock {
+	cb := &CodeBlock{Passes: make([]CodingPass, len(lengths))}
+	cum := 0
+	for i, l := range lengths {
+		cum += l
+		cb.Passes[i] = CodingPass{Length: l, CumulativeLength: cum, Distortion: distortions[i]}
+	}
+	cb.Data = make([]byte, cum)
+	for i := range cb.Data {
+		cb.Data[i] = byte(i)
+	}
+	return cb
+}
+
+// randomRDBlocks creates code-blocks with decaying distortion per pass
+// and widely varying importance, as produced by real subbands.
+func randomRDBlocks(n int) []*CodeBlock {
+	rng := rand.New(rand.NewSource(1))
+	blocks := make([]*CodeBlock, n)
+	for b := range blocks {
+		numPasses := 4 + rng.Intn(20)
+		energy := math.Pow(10, rng.Float64()*4)
+		lengths := make([]int, numPasses)
+		distortions := make([]float64, numPasses)
+		for i := range lengths {
+			lengths[i] = 5 + rng.Intn(60)
+			distortions[i] = energy * math.Pow(0.6, float64(i)) * (0.5 + rng.Float64())
+		}
+		blocks[b] = newRDBlock(lengths, distortions)
+	}
+	return blocks
+}
+
+// remainingDistortion returns the distortion left after decoding the
+// passes included through a layer.
+func remainingDistortion(blocks []*CodeBlock, layer int) float64 {
+	d := 0.0
+	for _, cb := range blocks {
+		for i, p := range cb.Passes {
+			if i >= cb.LayerPasses[layer] {
+				d += p.Distortion
+			}
+		}
+	}
+	return d
+}
+
+// layerBytes returns the bytes included through a layer.
+func layerBytes(blocks []*CodeBlock, layer int) int {
+	n := 0
+	for _, cb := range blocks {
+		if k := cb.LayerPasses[layer]; k > 0 {
+			n += cb.Passes[k-1].CumulativeLength
+		}
+	}
+	return n
+}
+
+func TestComputeSlopes(t *testing.T) {
+	// Pass 1 is below the hull: pass 2 gains more per byte from pass 0
+	cb := newRDBlock([]int{10, 10, 10, 10}, []float64{100, 5, 60, 10})
+	ComputeSlopes(cb)
+
+	want := []float64{10, 0, 65.0 / 20, 1}
+	for i, p := range cb.Passes {
+		if math.Abs(p.Slope-want[i]) > 1e-9 {
+			t.Errorf("pass %d slope = %v, want %v", i, p.Slope, want[i])
+		}
+	}
+}
+
+func TestComputeSlopes_NoGain(t *testing.T) {
+	cb := newRDBlock([]int{4, 4}, []float64{0, 0})
+	ComputeSlopes(cb)
+	for i, p := range cb.Passes {
+		if p.Slope != 0 {
+			t.Errorf("pass %d slope = %v, want 0", i, p.Slope)
+		}
+	}
+}
+
+func TestAllocateLayersPCRD(t *testing.T) {
+	blocks := randomRDBlocks(64)
+	for _, cb := range blocks {
+		ComputeSlopes(cb)
+	}
+	budgets := []int{500, 2000, 8000}
+	AllocateLayersPCRD(blocks, budgets)
+
+	for layer, budget := range budgets {
+		if got := layerBytes(blocks, layer); got > budget {
+			t.Errorf("layer %d uses %d bytes, budget %d", layer, got, budget)
+		}
+	}
+	for i, cb := range blocks {
+		for layer := 1; layer < len(budgets); layer++ {
+			if cb.LayerPasses[layer] < cb.LayerPasses[layer-1] {
+				t.Fatalf("block %d: layer passes not cumulative: %v", i, cb.LayerPasses)
+			}
+		}
+		if cb.LayerPasses[0] > 0 && cb.IncludedInLayers != 0 {
+			t.Errorf("block %d: IncludedInLayers = %d, want 0", i, cb.IncludedInLayers)
+		}
+	}
+}
+
+func TestAllocateLayersPCRD_BeatsGeometric(t *testing.T) {
+	const numBlocks = 64
+	budgets := []int{500, 1500, 4000, 10000}
+
+	pcrd := randomRDBlocks(numBlocks)
+	for _, cb := range pcrd {
+		ComputeSlopes(cb)
+	}
+	AllocateLayersPCRD(pcrd, budgets)
+
+	naive := randomRDBlocks(numBlocks)
+	AllocateLayersGeometric(naive, budgets)
+
+	// Pick the peak so the fully coded image is at a fixed PSNR
+	total := remainingDistortion(pcrd, 0) + 1
+	psnr := func(d float64) float64 {
+		return 10 * math.Log10(total*1e4/(d+1))
+	}
+
+	for layer := range budgets {
+		p := psnr(remainingDistortion(pcrd, layer))
+		g := psnr(remainingDistortion(naive, layer))
+		t.Logf("layer %d: PCRD-opt %.2f dB (%d bytes), geometric %.2f dB (%d bytes)",
+			layer, p, layerBytes(pcrd, layer), g, layerBytes(naive, layer))
+		if p <= g {
+			t.Errorf("layer %d: PCRD-opt PSNR %.2f dB not better than geometric %.2f dB", layer, p, g)
+		}
+	}
+}
+
+func TestEncodePacket_LayerPasses(t *testing.T) {
+	cb := newRDBlock([]int{3, 4, 5}, []float64{9, 4, 1})
+	cb.LayerPasses = []int{1, 3}
+	cb.IncludedInLayers = 0
+
+	precinct := &Precinct{
+		CodeBlocks: [][]*CodeBlock{{cb}},
+	}
+
+	for layer, want := range [][]byte{cb.Data[:3], cb.Data[3:12]} {
+		var buf bytes.Buffer
+		if err := NewPacketEncoder(&buf).EncodePacket(precinct, layer, false, false); err != nil {
+			t.Fatalf("EncodePacket(layer %d) error: %v", layer, err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), want) {
+			t.Errorf("layer %d body = %x, want suffix %x", layer, buf.Bytes(), want)
+		}
+	}
+}
+
+func TestPassSlope(t *testing.T) {
+	tests := []struct {
+		pass CodingPass
+		want float64
+	}{
+		{CodingPass{Length: 4, Distortion: 10}, 2.5},
+		{CodingPass{Length: 4, Distortion: 0}, 0},
+		{CodingPass{Length: 0, Distortion: 1}, math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := PassSlope(tt.pass); got != tt.want {
+			t.Errorf("PassSlope(%+v) = %v, want %v", tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeCodeBlock_Passes(t *testing.T) {
+	enc := NewTileEncoder(createTestHeader())
+	cb := &CodeBlock{X1: 16, Y1: 16}
+	data := make([]int32, 16*16)
+	for i := range data {
+		data[i] = int32(i%29) - 14
+	}
+	enc.EncodeCodeBlock(cb, data, SubbandHH)
+
+	if len(cb.Passes) == 0 {
+		t.Fatal("EncodeCodeBlock() recorded no passes")
+	}
+	last := cb.Passes[len(cb.Passes)-1]
+	if last.CumulativeLength != len(cb.Data) {
+		t.Errorf("last pass cumulative length = %d, want %d", last.CumulativeLength, len(cb.Data))
+	}
+	hull := 0
+	for _, p := range cb.Passes {
+		if p.Slope > 0 {
+			hull++
+		}
+	}
+	if hull == 0 {
+		t.Error("no passes on the rate-distortion hull")
+	}
+}
+
+func BenchmarkAllocateLayersPCRD(b *testing.B) {
+	blocks := randomRDBlocks(4096)
+	for _, cb := range blocks {
+		ComputeSlopes(cb)
+	}
+	budgets := []int{20000, 80000, 320000, 1280000}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		AllocateLayersPCRD(blocks, budgets)
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/mrjoshuak/go-jpeg2000/internal/bio"
 	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+	"github.com/mrjoshuak/go-jpeg2000/internal/entropy"
 )
 
 // PacketIterator iterates over packets in progression order.
@@ -84,6 +85,9 @@ func (pi *PacketIterator) Next() (Packet, bool) {
 }
 
 func (pi *PacketIterator) hasMore() bool {
+	if pi.layStart >= pi.layEnd || pi.resStart >= pi.resEnd || pi.compStart >= pi.compEnd {
+		return false
+	}
 	switch pi.order {
 	case codestream.LRCP:
 		return pi.layer < pi.layEnd
@@ -113,6 +117,30 @@ func (pi *PacketIterator) maxPrecincts() int {
 	return max
 }
 
+// resolutionPrecincts returns the largest number of precincts any
+// component has at resolution r, which bounds the precinct loop of RPCL.
+func (pi *PacketIterator) resolutionPrecincts(r int) int {
+	n := 1
+	for c := pi.compStart; c < pi.compEnd && c < len(pi.precincts); c++ {
+		if len(pi.precincts[c]) > r {
+			n = max(n, pi.precincts[c][r][0])
+		}
+	}
+	return n
+}
+
+// componentPrecincts returns the largest number of precincts any
+// resolution of component c has, which bounds the precinct loop of CPRL.
+func (pi *PacketIterator) componentPrecincts(c int) int {
+	n := 1
+	if c < len(pi.precincts) {
+		for r := pi.resStart; r < pi.resEnd && r < len(pi.precincts[c]); r++ {
+			n = max(n, pi.precincts[c][r][0])
+		}
+	}
+	return n
+}
+
 func (pi *PacketIterator) advance() {
 	switch pi.order {
 	case codestream.LRCP:
@@ -176,11 +204,7 @@ func (pi *PacketIterator) advanceRPCL() {
 		if pi.component >= pi.compEnd {
 			pi.component = pi.compStart
 			pi.precinct++
-			numPrec := 1
-			if len(pi.precincts) > pi.component && len(pi.precincts[pi.component]) > pi.resolution {
-				numPrec = pi.precincts[pi.component][pi.resolution][0]
-			}
-			if pi.precinct >= numPrec {
+			if pi.precinct >= pi.resolutionPrecincts(pi.resolution) {
 				pi.precinct = 0
 				pi.resolution++
 			}
@@ -212,11 +236,7 @@ func (pi *PacketIterator) advanceCPRL() {
 		if pi.resolution >= pi.resEnd {
 			pi.resolution = pi.resStart
 			pi.precinct++
-			numPrec := 1
-			if len(pi.precincts) > pi.component && len(pi.precincts[pi.component]) > pi.resolution {
-				numPrec = pi.precincts[pi.component][pi.resolution][0]
-			}
-			if pi.precinct >= numPrec {
+			if pi.precinct >= pi.componentPrecincts(pi.component) {
 				pi.precinct = 0
 				pi.component++
 			}
@@ -232,10 +252,55 @@ func (pi *PacketIterator) Reset() {
 	pi.precinct = 0
 }
 
+// SetBounds restricts the iterator to layers [0, layEnd), resolutions
+// [resStart, resEnd) and components [compStart, compEnd), as a progression
+// of a POC marker segment does, and resets it. Ends beyond the image are
+// clamped.
+func (pi *PacketIterator) SetBounds(resStart, resEnd, compStart, compEnd, layEnd int) {
+	pi.resStart, pi.resEnd = resStart, min(resEnd, pi.numResolutions)
+	pi.compStart, pi.compEnd = compStart, min(compEnd, pi.numComponents)
+	pi.layStart, pi.layEnd = 0, min(layEnd, pi.numLayers)
+	pi.Reset()
+}
+
+// PacketSequence visits packets through a sequence of progressions, as
+// the entries of POC marker segments describe. A packet already visited
+// by an earlier progression is skipped.
+type PacketSequence struct {
+	iterators []*PacketIterator
+	seen      map[Packet]bool
+}
+
+// NewPacketSequence creates a packet sequence running iterators in turn.
+func NewPacketSequence(iterators ...*PacketIterator) *PacketSequence {
+	return &PacketSequence{
+		iterators: iterators,
+		seen:      make(map[Packet]bool),
+	}
+}
+
+// Next returns the next packet not yet visited.
+// Returns false when every progression is exhausted.
+func (s *PacketSequence) Next() (Packet, bool) {
+	for len(s.iterators) > 0 {
+		p, ok := s.iterators[0].Next()
+		if !ok {
+			s.iterators = s.iterators[1:]
+			continue
+		}
+		if !s.seen[p] {
+			s.seen[p] = true
+			return p, true
+		}
+	}
+	return Packet{}, false
+}
+
 // PacketEncoder encodes packets to a bit stream.
 type PacketEncoder struct {
 	w   io.Writer
 	bio *bio.ByteStuffingWriter
+	seq int // Sequence number of the next packet, for SOP markers
 }
 
 // NewPacketEncoder creates a new packet encoder.
@@ -246,7 +311,9 @@ func NewPacketEncoder(w io.Writer) *PacketEncoder {
 	}
 }
 
-// EncodePacket encodes a single packet.
+// EncodePacket encodes a single packet. The packets of a precinct must be
+// encoded in layer order, starting with layer 0, since a packet header
+// only codes what changed since the previous layer.
 func (e *PacketEncoder) EncodePacket(
 	precinct *Precinct,
 	layer int,
@@ -256,11 +323,16 @@ func (e *PacketEncoder) EncodePacket(
 	// Write SOP marker if enabled
 	if enableSOP {
 		sop := []byte{0xFF, 0x91, 0x00, 0x04, 0x00, 0x00}
-		binary.BigEndian.PutUint16(sop[4:], uint16(layer))
+		binary.BigEndian.PutUint16(sop[4:], uint16(e.seq))
 		if _, err := e.w.Write(sop); err != nil {
 			return err
 		}
 	}
+	e.seq++
+
+	if layer == 0 || len(precinct.InclusionTrees) < len(precinct.CodeBlocks) {
+		startPrecinctEncoding(precinct)
+	}
 
 	// Encode packet header
 	if err := e.encodePacketHeader(precinct, layer); err != nil {
@@ -278,8 +350,8 @@ func (e *PacketEncoder) EncodePacket(
 	// Write packet body (code-block data)
 	for _, bandCBs := range precinct.CodeBlocks {
 		for _, cb := range bandCBs {
-			if cb.IncludedInLayers <= layer && len(cb.Data) > 0 {
-				if _, err := e.w.Write(cb.Data); err != nil {
+			if _, start, end := layerContribution(cb, layer); end > start {
+				if _, err := e.w.Write(cb.Data[start:end]); err != nil {
 					return err
 				}
 			}
@@ -289,13 +361,50 @@ func (e *PacketEncoder) EncodePacket(
 	return nil
 }
 
-// encodePacketHeader encodes the packet header.
+// startPrecinctEncoding loads the precinct's tag trees with the first
+// layer and the number of zero bit-planes of each code-block, and resets
+// the per-block header state.
+func startPrecinctEncoding(precinct *Precinct) {
+	precinct.ensureTagTrees()
+	for b, bandCBs := range precinct.CodeBlocks {
+		incl, imsb := precinct.InclusionTrees[b], precinct.IMSBTrees[b]
+		for i, cb := range bandCBs {
+			x, y := cbGridPos(i, incl.Width())
+			incl.SetValue(x, y, firstLayer(cb))
+			imsb.SetValue(x, y, cb.ZeroBitPlanes)
+			cb.lblock = 0
+		}
+		incl.Propagate()
+		incl.Reset()
+		imsb.Propagate()
+		imsb.Reset()
+	}
+}
+
+// firstLayer returns the first layer cb contributes coding passes to, or
+// MaxInt if it never does.
+func firstLayer(cb *CodeBlock) int {
+	if cb.LayerPasses == nil {
+		if len(cb.Passes) > 0 && len(cb.Data) > 0 {
+			return cb.IncludedInLayers
+		}
+		return int(^uint(0) >> 1)
+	}
+	for layer, n := range cb.LayerPasses {
+		if n > 0 {
+			return layer
+		}
+	}
+	return int(^uint(0) >> 1)
+}
+
+// encodePacketHeader encodes the packet header (ITU-T T.800 B.10).
 func (e *PacketEncoder) encodePacketHeader(precinct *Precinct, layer int) error {
 	// Check if packet is empty
 	hasData := false
 	for _, bandCBs := range precinct.CodeBlocks {
 		for _, cb := range bandCBs {
-			if cb.IncludedInLayers <= layer && len(cb.Data) > 0 {
+			if n, _, _ := layerContribution(cb, layer); n > 0 {
 				hasData = true
 				break
 			}
@@ -320,22 +429,24 @@ func (e *PacketEncoder) encodePacketHeader(precinct *Precinct, layer int) error
 	// Encode inclusion and length for each code-block
 	for bandIdx, bandCBs := range precinct.CodeBlocks {
 		for cbIdx, cb := range bandCBs {
-			// Inclusion
-			included := cb.IncludedInLayers <= layer && len(cb.Data) > 0
-
-			if layer == 0 {
-				// First layer - use tag tree
-				e.encodeTagTreeValue(precinct.InclusionTree, cbIdx%precinct.InclusionTree.width, cbIdx/precinct.InclusionTree.width, cb.IncludedInLayers)
+			numPasses, start, end := layerContribution(cb, layer)
+			included := numPasses > 0
+
+			// Inclusion: a tag tree until the block is first included,
+			// then a single bit
+			if cb.lblock == 0 {
+				tree := precinct.InclusionTrees[bandIdx]
+				x, y := cbGridPos(cbIdx, tree.Width())
+				if err := tree.Encode(e.bio, x, y, layer+1); err != nil {
+					return err
+				}
 			} else {
-				// Subsequent layers - single bit
+				bit := 0
 				if included {
-					if err := e.bio.WriteBit(1); err != nil {
-						return err
-					}
-				} else {
-					if err := e.bio.WriteBit(0); err != nil {
-						return err
-					}
+					bit = 1
+				}
+				if err := e.bio.WriteBit(bit); err != nil {
+					return err
 				}
 			}
 
@@ -343,19 +454,35 @@ func (e *PacketEncoder) encodePacketHeader(precinct *Precinct, layer int) error
 				continue
 			}
 
-			// Zero bit-planes (IMSB)
-			if cb.IncludedInLayers == layer {
-				e.encodeTagTreeValue(precinct.IMSBTree, cbIdx%precinct.IMSBTree.width, cbIdx/precinct.IMSBTree.width, cb.ZeroBitPlanes)
+			// Zero bit-planes (IMSB), on first inclusion
+			if cb.lblock == 0 {
+				tree := precinct.IMSBTrees[bandIdx]
+				x, y := cbGridPos(cbIdx, tree.Width())
+				if err := tree.EncodeValue(e.bio, x, y); err != nil {
+					return err
+				}
+				cb.lblock = 3
 			}
 
 			// Number of coding passes
-			numPasses := len(cb.Passes)
 			if err := e.encodeNumPasses(numPasses); err != nil {
 				return err
 			}
 
-			// Length of code-block data
-			if err := e.encodeLength(len(cb.Data), bandIdx, cbIdx); err != nil {
+			// Lengths of its codeword segments
+			first := firstNewPass(cb, layer)
+			passes := segmentPasses(cb, first, numPasses)
+			lengths := make([]int, len(passes))
+			for i, n := range passes {
+				first += n
+				segEnd := end
+				if i < len(passes)-1 {
+					segEnd = min(cb.Passes[first-1].CumulativeLength, end)
+				}
+				lengths[i] = segEnd - start
+				start = segEnd
+			}
+			if err := e.encodeLengths(cb, passes, lengths); err != nil {
 				return err
 			}
 		}
@@ -364,18 +491,7 @@ func (e *PacketEncoder) encodePacketHeader(precinct *Precinct, layer int) error
 	return e.bio.Flush()
 }
 
-// encodeTagTreeValue encodes a value using the tag tree.
-func (e *PacketEncoder) encodeTagTreeValue(tree *TagTree, x, y, value int) error {
-	// Simplified tag tree encoding
-	for i := 0; i < value; i++ {
-		if err := e.bio.WriteBit(0); err != nil {
-			return err
-		}
-	}
-	return e.bio.WriteBit(1)
-}
-
-// encodeNumPasses encodes the number of coding passes.
+// encodeNumPasses encodes the number of coding passes (Table B.4).
 func (e *PacketEncoder) encodeNumPasses(n int) error {
 	if n == 1 {
 		return e.bio.WriteBit(0)
@@ -404,36 +520,68 @@ func (e *PacketEncoder) encodeNumPasses(n int) error {
 	return e.bio.WriteBits(uint32(n-37), 7)
 }
 
-// encodeLength encodes the code-block data length.
-func (e *PacketEncoder) encodeLength(length, bandIdx, cbIdx int) error {
-	// Use variable length encoding
-	// Number of bits needed
-	if length == 0 {
-		return e.bio.WriteBits(0, 3)
+// segmentPasses splits a code-block's contribution of numPasses passes
+// from pass first into codeword segments, ending one after each pass
+// that terminates the arithmetic coder under the block's style, and
+// returns the number of passes in each.
+func segmentPasses(cb *CodeBlock, first, numPasses int) []int {
+	var passes []int
+	n := 0
+	for i := first; i < first+numPasses; i++ {
+		n++
+		if i == first+numPasses-1 || entropy.IsTerminatedPass(i, cb.Style) {
+			passes = append(passes, n)
+			n = 0
+		}
 	}
+	return passes
+}
 
-	bits := 0
-	temp := length
-	for temp > 0 {
-		bits++
-		temp >>= 1
+// encodeLengths encodes the lengths of the codeword segments of a
+// code-block's contribution, the segments holding passes[i] passes and
+// lengths[i] bytes (B.10.7). Lblock is first raised, in unary, until
+// Lblock + floor(log2(passes[i])) bits can hold every length.
+func (e *PacketEncoder) encodeLengths(cb *CodeBlock, passes, lengths []int) error {
+	for i, length := range lengths {
+		for length>>(cb.lblock+floorLog2(passes[i])) != 0 {
+			if err := e.bio.WriteBit(1); err != nil {
+				return err
+			}
+			cb.lblock++
+		}
 	}
-
-	// Encode number of bits
-	if err := e.bio.WriteBits(uint32(bits), 3); err != nil {
+	if err := e.bio.WriteBit(0); err != nil {
 		return err
 	}
+	for i, length := range lengths {
+		if err := e.bio.WriteBits(uint32(length), uint(cb.lblock+floorLog2(passes[i]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Encode length
-	return e.bio.WriteBits(uint32(length), uint(bits))
+// floorLog2 returns floor(log2(n)) for positive n.
+func floorLog2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
 }
 
 // PacketDecoder decodes packets from a bit stream.
 type PacketDecoder struct {
-	r   io.Reader
 	bio *bio.ByteStuffingReader
 	buf []byte
 	pos int
+
+	// Packed packet headers (PPM/PPT), read in place of the headers in
+	// buf when packed is set
+	headers   []byte
+	headerPos int
+	packed    bool
 }
 
 // NewPacketDecoder creates a new packet decoder.
@@ -444,6 +592,16 @@ func NewPacketDecoder(data []byte) *PacketDecoder {
 	}
 }
 
+// NewPackedPacketDecoder creates a packet decoder for packets whose
+// headers were moved into PPM or PPT marker segments: headers holds the
+// packet headers in order and data the packet bodies.
+func NewPackedPacketDecoder(headers, data []byte) *PacketDecoder {
+	d := NewPacketDecoder(data)
+	d.headers = headers
+	d.packed = true
+	return d
+}
+
 // byteReaderAt implements io.Reader for a byte slice.
 type byteReaderAt struct {
 	data []byte
@@ -459,7 +617,13 @@ func (r *byteReaderAt) Read(p []byte) (int, error) {
 	return n, nil
 }
 
-// DecodePacket decodes a single packet.
+// DecodePacket decodes a single packet, appending the data it carries to
+// each included code-block's Data, along with one CodingPass per new
+// coding pass. The packets of a precinct must be decoded in layer order,
+// starting with layer 0.
+//
+// If the packet body is cut short, the code-blocks receive whatever data
+// is present and io.ErrUnexpectedEOF is returned.
 func (d *PacketDecoder) DecodePacket(
 	precinct *Precinct,
 	layer int,
@@ -473,69 +637,149 @@ func (d *PacketDecoder) DecodePacket(
 		}
 	}
 
+	if layer == 0 || len(precinct.InclusionTrees) < len(precinct.CodeBlocks) {
+		startPrecinctDecoding(precinct)
+	}
+
 	// Decode packet header
-	if err := d.decodePacketHeader(precinct, layer); err != nil {
+	segments, err := d.decodePacketHeader(precinct, layer)
+	if err != nil {
 		return err
 	}
 
-	// Check for EPH marker
+	// Check for EPH marker, which follows the header wherever it is
 	if ephEnabled {
-		if d.pos+2 <= len(d.buf) && d.buf[d.pos] == 0xFF && d.buf[d.pos+1] == 0x92 {
-			d.pos += 2
+		buf, pos := d.headerSource()
+		if *pos+2 <= len(buf) && buf[*pos] == 0xFF && buf[*pos+1] == 0x92 {
+			*pos += 2
 		}
 	}
 
-	// Read packet body (code-block data)
-	for _, bandCBs := range precinct.CodeBlocks {
-		for _, cb := range bandCBs {
-			if cb.IncludedInLayers == layer && len(cb.Data) > 0 {
-				dataLen := len(cb.Data)
-				if d.pos+dataLen > len(d.buf) {
-					return fmt.Errorf("unexpected end of packet data")
-				}
-				copy(cb.Data, d.buf[d.pos:d.pos+dataLen])
-				d.pos += dataLen
-			}
+	// Read packet body (code-block data), recording where each codeword
+	// segment ends
+	for _, seg := range segments {
+		end := d.pos + seg.length
+		if end > len(d.buf) {
+			seg.cb.Data = append(seg.cb.Data, d.buf[d.pos:]...)
+			seg.cb.Passes[seg.pass].CumulativeLength = len(seg.cb.Data)
+			d.pos = len(d.buf)
+			return io.ErrUnexpectedEOF
 		}
+		seg.cb.Data = append(seg.cb.Data, d.buf[d.pos:end]...)
+		seg.cb.Passes[seg.pass].CumulativeLength = len(seg.cb.Data)
+		d.pos = end
 	}
 
 	return nil
 }
 
-// decodePacketHeader decodes the packet header.
-func (d *PacketDecoder) decodePacketHeader(precinct *Precinct, layer int) error {
+// startPrecinctDecoding clears the precinct's tag trees and code-blocks
+// before its first packet.
+func startPrecinctDecoding(precinct *Precinct) {
+	precinct.ensureTagTrees()
+	for b, bandCBs := range precinct.CodeBlocks {
+		precinct.InclusionTrees[b].Clear()
+		precinct.IMSBTrees[b].Clear()
+		for _, cb := range bandCBs {
+			cb.Data = nil
+			cb.Passes = nil
+			cb.ZeroBitPlanes = 0
+			cb.lblock = 0
+		}
+	}
+}
+
+// ensureTagTrees gives every band of the precinct its tag trees. Bands
+// built without them get trees over a single row of code-blocks.
+func (p *Precinct) ensureTagTrees() {
+	for len(p.InclusionTrees) < len(p.CodeBlocks) {
+		p.InclusionTrees = append(p.InclusionTrees, nil)
+	}
+	for len(p.IMSBTrees) < len(p.CodeBlocks) {
+		p.IMSBTrees = append(p.IMSBTrees, nil)
+	}
+	for b, bandCBs := range p.CodeBlocks {
+		if p.InclusionTrees[b] == nil {
+			p.InclusionTrees[b] = NewTagTree(max(len(bandCBs), 1), 1)
+		}
+		if p.IMSBTrees[b] == nil {
+			p.IMSBTrees[b] = NewTagTree(max(len(bandCBs), 1), 1)
+		}
+	}
+}
+
+// codeBlockSegment is a codeword segment, or the part of one, that a
+// packet body carries for a code-block.
+type codeBlockSegment struct {
+	cb     *CodeBlock
+	length int
+	pass   int // index of the segment's last pass in cb.Passes
+}
+
+// headerSource returns the buffer packet headers are read from and a
+// pointer to the read position in it.
+func (d *PacketDecoder) headerSource() ([]byte, *int) {
+	if d.packed {
+		return d.headers, &d.headerPos
+	}
+	return d.buf, &d.pos
+}
+
+// decodePacketHeader decodes the packet header and returns the body
+// segments it announces, in order.
+func (d *PacketDecoder) decodePacketHeader(precinct *Precinct, layer int) ([]codeBlockSegment, error) {
+	buf, pos := d.headerSource()
+	src := &byteReaderAt{data: buf, pos: *pos}
+	d.bio = bio.NewByteStuffingReader(src)
+
 	// Read packet presence bit
 	present, err := d.bio.ReadBit()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if present == 0 {
-		return nil // Empty packet
+
+	var segments []codeBlockSegment
+	if present == 1 {
+		segments, err = d.decodeCodeBlockHeaders(precinct, layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The header ends on a byte boundary; a final 0xFF is followed by a
+	// stuffed byte that belongs to the header too
+	*pos = src.pos
+	if *pos > 0 && buf[*pos-1] == 0xFF {
+		*pos++
 	}
+	return segments, nil
+}
 
-	// Decode inclusion and length for each code-block
+// decodeCodeBlockHeaders decodes the inclusion, zero bit-plane, pass
+// count and length information of each code-block in a non-empty packet.
+func (d *PacketDecoder) decodeCodeBlockHeaders(precinct *Precinct, layer int) ([]codeBlockSegment, error) {
+	var segments []codeBlockSegment
 	for bandIdx, bandCBs := range precinct.CodeBlocks {
 		for cbIdx, cb := range bandCBs {
+			firstInclusion := cb.lblock == 0
 			var included bool
 
-			if layer == 0 {
-				// First layer - use tag tree
-				val, err := d.decodeTagTreeValue(precinct.InclusionTree, cbIdx%precinct.InclusionTree.width, cbIdx/precinct.InclusionTree.width)
+			if firstInclusion {
+				// Not yet included - use tag tree
+				tree := precinct.InclusionTrees[bandIdx]
+				x, y := cbGridPos(cbIdx, tree.Width())
+				ok, err := tree.Decode(d.bio, x, y, layer+1)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				included = val == layer
-				cb.IncludedInLayers = val
+				included = ok
 			} else {
-				// Subsequent layers - single bit
+				// Previously included - single bit
 				bit, err := d.bio.ReadBit()
 				if err != nil {
-					return err
+					return nil, err
 				}
 				included = bit == 1
-				if included {
-					cb.IncludedInLayers = layer
-				}
 			}
 
 			if !included {
@@ -543,49 +787,45 @@ func (d *PacketDecoder) decodePacketHeader(precinct *Precinct, layer int) error
 			}
 
 			// Zero bit-planes (IMSB)
-			if cb.IncludedInLayers == layer {
-				val, err := d.decodeTagTreeValue(precinct.IMSBTree, cbIdx%precinct.IMSBTree.width, cbIdx/precinct.IMSBTree.width)
+			if firstInclusion {
+				tree := precinct.IMSBTrees[bandIdx]
+				x, y := cbGridPos(cbIdx, tree.Width())
+				zbp, err := tree.DecodeValue(d.bio, x, y)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				cb.ZeroBitPlanes = val
+				cb.ZeroBitPlanes = zbp
+				cb.IncludedInLayers = layer
+				cb.lblock = 3
 			}
 
 			// Number of coding passes
 			numPasses, err := d.decodeNumPasses()
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			// Length of code-block data
-			length, err := d.decodeLength(bandIdx, cbIdx)
+			// Lengths of its codeword segments
+			first := len(cb.Passes)
+			passes := segmentPasses(cb, first, numPasses)
+			lengths, err := d.decodeLengths(cb, passes)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			cb.Passes = make([]CodingPass, numPasses)
-			cb.Data = make([]byte, length)
-		}
-	}
-
-	return nil
-}
-
-// decodeTagTreeValue decodes a value from the tag tree.
-func (d *PacketDecoder) decodeTagTreeValue(tree *TagTree, x, y int) (int, error) {
-	// Simplified tag tree decoding
-	value := 0
-	for {
-		bit, err := d.bio.ReadBit()
-		if err != nil {
-			return 0, err
-		}
-		if bit == 1 {
-			break
+			for i := first; i < first+numPasses; i++ {
+				cb.Passes = append(cb.Passes, CodingPass{
+					Type:       (i + 2) % 3,
+					Terminated: entropy.IsTerminatedPass(i, cb.Style),
+				})
+			}
+			for i, length := range lengths {
+				first += passes[i]
+				segments = append(segments, codeBlockSegment{cb: cb, length: length, pass: first - 1})
+			}
 		}
-		value++
 	}
-	return value, nil
+	return segments, nil
 }
 
 // decodeNumPasses decodes the number of coding passes.
@@ -629,24 +869,74 @@ func (d *PacketDecoder) decodeNumPasses() (int, error) {
 	return int(val) + 37, nil
 }
 
-// decodeLength decodes the code-block data length.
-func (d *PacketDecoder) decodeLength(bandIdx, cbIdx int) (int, error) {
-	numBits, err := d.bio.ReadBits(3)
-	if err != nil {
-		return 0, err
-	}
-	if numBits == 0 {
-		return 0, nil
+// decodeLengths decodes the lengths of the codeword segments of a
+// code-block's contribution, the segments holding passes[i] passes,
+// updating its Lblock.
+func (d *PacketDecoder) decodeLengths(cb *CodeBlock, passes []int) ([]int, error) {
+	for {
+		bit, err := d.bio.ReadBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit == 0 {
+			break
+		}
+		cb.lblock++
 	}
 
-	length, err := d.bio.ReadBits(uint(numBits))
-	if err != nil {
-		return 0, err
+	lengths := make([]int, len(passes))
+	for i, n := range passes {
+		bits := cb.lblock + floorLog2(n)
+		if bits > 32 {
+			return nil, fmt.Errorf("code-block length of %d bits", bits)
+		}
+		length, err := d.bio.ReadBits(uint(bits))
+		if err != nil {
+			return nil, err
+		}
+		lengths[i] = int(length)
 	}
-	return int(length), nil
+	return lengths, nil
 }
 
 // Position returns the current position in the data.
 func (d *PacketDecoder) Position() int {
 	return d.pos
 }
+
+// HeaderPosition returns the current position in the packed packet
+// headers, or in the data when the packets carry their own headers.
+func (d *PacketDecoder) HeaderPosition() int {
+	_, pos := d.headerSource()
+	return *pos
+}
+
+// SOP reports the packet sequence number of the SOP marker segment at the
+// current position, if there is one.
+func (d *PacketDecoder) SOP() (seq int, ok bool) {
+	return sopAt(d.buf, d.pos)
+}
+
+// ResyncSOP moves to the first SOP marker segment at or after from and
+// returns its packet sequence number. If there is none it moves to the
+// end of the data and returns false. Packet bodies cannot contain the
+// SOP marker, so this finds the start of a later packet after a damaged
+// one.
+func (d *PacketDecoder) ResyncSOP(from int) (seq int, ok bool) {
+	for p := max(from, 0); p+6 <= len(d.buf); p++ {
+		if seq, ok := sopAt(d.buf, p); ok {
+			d.pos = p
+			return seq, true
+		}
+	}
+	d.pos = len(d.buf)
+	return 0, false
+}
+
+// sopAt reports the sequence number of an SOP marker segment at buf[p:].
+func sopAt(buf []byte, p int) (seq int, ok bool) {
+	if p < 0 || p+6 > len(buf) || buf[p] != 0xFF || buf[p+1] != 0x91 || buf[p+2] != 0x00 || buf[p+3] != 0x04 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(buf[p+4:])), true
+}
@@ -384,16 +384,13 @@ func TestPacketDecoderPosition(t *testing.T) {
 
 // createTestPrecinct creates a precinct for encoding/decoding tests.
 func createTestPrecinct() *Precinct {
-	tree := NewTagTree(2, 2)
 	return &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            64,
-		Y1:            64,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(2, 2),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         64,
+		Y1:         64,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 }
 
@@ -470,10 +467,18 @@ func TestEncodePacketWithSOP(t *testing.T) {
 	if data[2] != 0x00 || data[3] != 0x04 {
 		t.Errorf("SOP length = %02X%02X; want 0004", data[2], data[3])
 	}
-	// Layer number in bytes 4-5
-	layerNum := int(data[4])<<8 | int(data[5])
-	if layerNum != 5 {
-		t.Errorf("SOP layer number = %d; want 5", layerNum)
+	// Packet sequence number in bytes 4-5, counting from zero
+	if seq := int(data[4])<<8 | int(data[5]); seq != 0 {
+		t.Errorf("SOP sequence number = %d; want 0", seq)
+	}
+
+	buf.Reset()
+	if err := enc.EncodePacket(precinct, 6, true, false); err != nil {
+		t.Fatalf("EncodePacket error: %v", err)
+	}
+	data = buf.Bytes()
+	if seq := int(data[4])<<8 | int(data[5]); seq != 1 {
+		t.Errorf("second SOP sequence number = %d; want 1", seq)
 	}
 }
 
@@ -557,31 +562,33 @@ func TestEncodeNumPasses(t *testing.T) {
 	}
 }
 
-// TestEncodeLength tests encoding code block lengths.
-// Note: The encoding uses 3 bits for bit count, so max is 7 bits = 127.
+// TestEncodeLength tests encoding code block lengths, which raises Lblock
+// as needed.
 func TestEncodeLength(t *testing.T) {
 	tests := []struct {
-		length int
-		desc   string
+		length, numPasses int
+		wantLblock        int
 	}{
-		{0, "zero length"},
-		{1, "one byte"},
-		{10, "ten bytes"},
-		{100, "hundred bytes"},
-		{63, "6 bits"},
-		{127, "max valid (7 bits)"},
+		{0, 1, 3},
+		{7, 1, 3},
+		{8, 1, 4},
+		{15, 2, 3},
+		{100, 1, 7},
+		{100, 9, 4},
+		{70000, 1, 17},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			var buf bytes.Buffer
-			enc := NewPacketEncoder(&buf)
+		var buf bytes.Buffer
+		enc := NewPacketEncoder(&buf)
+		cb := &CodeBlock{lblock: 3}
 
-			err := enc.encodeLength(tt.length, 0, 0)
-			if err != nil {
-				t.Errorf("encodeLength(%d) error: %v", tt.length, err)
-			}
-		})
+		if err := enc.encodeLengths(cb, []int{tt.numPasses}, []int{tt.length}); err != nil {
+			t.Errorf("encodeLengths(%d, %d) error: %v", tt.length, tt.numPasses, err)
+		}
+		if cb.lblock != tt.wantLblock {
+			t.Errorf("encodeLengths(%d, %d): Lblock = %d; want %d", tt.length, tt.numPasses, cb.lblock, tt.wantLblock)
+		}
 	}
 }
 
@@ -628,40 +635,36 @@ func TestDecodeNumPasses(t *testing.T) {
 }
 
 // TestDecodeLength tests decoding code block lengths.
-// Note: The encoding uses 3 bits for bit count, so max is 7 bits = 127.
 func TestDecodeLength(t *testing.T) {
 	tests := []struct {
-		length int
-		desc   string
+		length, numPasses int
 	}{
-		{0, "zero length"},
-		{1, "one byte"},
-		{10, "ten bytes"},
-		{100, "hundred bytes"},
-		{127, "max valid (7 bits)"}, // Max value with 3-bit length encoding
+		{0, 1},
+		{1, 1},
+		{10, 3},
+		{100, 1},
+		{127, 7},
+		{70000, 20},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			// Encode
-			var buf bytes.Buffer
-			enc := NewPacketEncoder(&buf)
-			err := enc.encodeLength(tt.length, 0, 0)
-			if err != nil {
-				t.Fatalf("Encode error: %v", err)
-			}
-			enc.bio.Flush()
+		// Encode
+		var buf bytes.Buffer
+		enc := NewPacketEncoder(&buf)
+		if err := enc.encodeLengths(&CodeBlock{lblock: 3}, []int{tt.numPasses}, []int{tt.length}); err != nil {
+			t.Fatalf("Encode error: %v", err)
+		}
+		enc.bio.Flush()
 
-			// Decode
-			dec := NewPacketDecoder(buf.Bytes())
-			decoded, err := dec.decodeLength(0, 0)
-			if err != nil {
-				t.Fatalf("Decode error: %v", err)
-			}
-			if decoded != tt.length {
-				t.Errorf("Decoded %d; want %d", decoded, tt.length)
-			}
-		})
+		// Decode
+		dec := NewPacketDecoder(buf.Bytes())
+		decoded, err := dec.decodeLengths(&CodeBlock{lblock: 3}, []int{tt.numPasses})
+		if err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		if decoded[0] != tt.length {
+			t.Errorf("Decoded %d; want %d", decoded[0], tt.length)
+		}
 	}
 }
 
@@ -688,6 +691,30 @@ func TestDecodePacketWithSOP(t *testing.T) {
 	}
 }
 
+// TestPacketDecoderResyncSOP tests finding the next SOP marker after a
+// damaged packet.
+func TestPacketDecoderResyncSOP(t *testing.T) {
+	data := []byte{
+		0xFF, 0x91, 0x00, 0x04, 0x00, 0x07, // SOP, packet 7
+		0x12, 0x34, 0xFF, 0x91, 0x00, // damaged body with a short SOP
+		0xFF, 0x91, 0x00, 0x04, 0x01, 0x02, // SOP, packet 258
+		0x00,
+	}
+	dec := NewPacketDecoder(data)
+	if seq, ok := dec.SOP(); !ok || seq != 7 {
+		t.Errorf("SOP() = %d, %v; want 7, true", seq, ok)
+	}
+	if seq, ok := dec.ResyncSOP(1); !ok || seq != 258 || dec.Position() != 11 {
+		t.Errorf("ResyncSOP(1) = %d, %v at %d; want 258, true at 11", seq, ok, dec.Position())
+	}
+	if _, ok := dec.ResyncSOP(12); ok || dec.Position() != len(data) {
+		t.Errorf("ResyncSOP(12) found a marker or stopped at %d; want none at %d", dec.Position(), len(data))
+	}
+	if _, ok := dec.SOP(); ok {
+		t.Error("SOP() at end of data = true")
+	}
+}
+
 // TestDecodePacketWithEPH tests decoding with EPH marker present.
 func TestDecodePacketWithEPH(t *testing.T) {
 	// Create data with minimal packet and EPH marker
@@ -706,44 +733,6 @@ func TestDecodePacketWithEPH(t *testing.T) {
 	}
 }
 
-// TestDecodeTagTreeValue tests tag tree decoding.
-func TestDecodeTagTreeValue(t *testing.T) {
-	tree := NewTagTree(2, 2)
-
-	tests := []struct {
-		value int
-		desc  string
-	}{
-		{0, "value 0"},
-		{1, "value 1"},
-		{5, "value 5"},
-		{10, "value 10"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			// Encode: value zeros followed by a one
-			var buf bytes.Buffer
-			enc := NewPacketEncoder(&buf)
-			err := enc.encodeTagTreeValue(tree, 0, 0, tt.value)
-			if err != nil {
-				t.Fatalf("Encode error: %v", err)
-			}
-			enc.bio.Flush()
-
-			// Decode
-			dec := NewPacketDecoder(buf.Bytes())
-			decoded, err := dec.decodeTagTreeValue(tree, 0, 0)
-			if err != nil {
-				t.Fatalf("Decode error: %v", err)
-			}
-			if decoded != tt.value {
-				t.Errorf("Decoded %d; want %d", decoded, tt.value)
-			}
-		})
-	}
-}
-
 // TestEncodeDecodePacketRoundTrip tests full packet encode/decode cycle.
 func TestEncodeDecodePacketRoundTrip(t *testing.T) {
 	// Create encoder and precinct with data
@@ -778,6 +767,137 @@ func TestEncodeDecodePacketRoundTrip(t *testing.T) {
 	if err != nil {
 		t.Fatalf("DecodePacket error: %v", err)
 	}
+
+	cb := decodePrecinct.CodeBlocks[0][0]
+	if !bytes.Equal(cb.Data, []byte{0xDE, 0xAD, 0xBE, 0xEF}) {
+		t.Errorf("decoded data % X; want DE AD BE EF", cb.Data)
+	}
+	if cb.ZeroBitPlanes != 1 || len(cb.Passes) != 1 {
+		t.Errorf("decoded %d zero bit-planes and %d passes; want 1 and 1", cb.ZeroBitPlanes, len(cb.Passes))
+	}
+	if dec.Position() != buf.Len() {
+		t.Errorf("decoder stopped at %d of %d bytes", dec.Position(), buf.Len())
+	}
+}
+
+// TestDecodePackedPacket decodes a packet whose header, with its EPH
+// marker, was moved out of the packet data as in PPM and PPT segments.
+func TestDecodePackedPacket(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewPacketEncoder(&buf)
+
+	precinct := createTestPrecinct()
+	precinct.CodeBlocks[0] = []*CodeBlock{
+		{
+			Index:            0,
+			Data:             []byte{0xDE, 0xAD, 0xBE, 0xEF},
+			IncludedInLayers: 0,
+			ZeroBitPlanes:    1,
+			Passes:           []CodingPass{{Type: PassCleanup}},
+		},
+	}
+	if err := enc.EncodePacket(precinct, 0, false, true); err != nil {
+		t.Fatalf("EncodePacket error: %v", err)
+	}
+
+	// The body is the four data bytes at the end of the packet
+	packet := buf.Bytes()
+	headers := append(packet[:len(packet)-4:len(packet)-4], 0x00) // and an empty packet
+	body := packet[len(packet)-4:]
+
+	dec := NewPackedPacketDecoder(headers, body)
+	decodePrecinct := createTestPrecinct()
+	decodePrecinct.CodeBlocks[0] = []*CodeBlock{
+		{Index: 0},
+	}
+	for layer := 0; layer < 2; layer++ {
+		if err := dec.DecodePacket(decodePrecinct, layer, false, true); err != nil {
+			t.Fatalf("DecodePacket(layer %d) error: %v", layer, err)
+		}
+	}
+
+	cb := decodePrecinct.CodeBlocks[0][0]
+	if !bytes.Equal(cb.Data, []byte{0xDE, 0xAD, 0xBE, 0xEF}) {
+		t.Errorf("decoded data % X; want DE AD BE EF", cb.Data)
+	}
+	if dec.Position() != len(body) {
+		t.Errorf("decoder stopped at %d of %d body bytes", dec.Position(), len(body))
+	}
+}
+
+// TestEncodeDecodePacketLayers round-trips the packets of a precinct with
+// a 3x2 grid of code-blocks spread over three layers: blocks join in
+// different layers, one is never included, and one sends a long segment.
+func TestEncodeDecodePacketLayers(t *testing.T) {
+	const numLayers = 3
+	layerPasses := [][]int{
+		{1, 4, 7},
+		{0, 0, 3},
+		{0, 0, 0},
+		{2, 2, 10},
+		{0, 5, 5},
+		{13, 13, 13},
+	}
+	newPrecinct := func() *Precinct {
+		p := &Precinct{
+			CodeBlocks:     make([][]*CodeBlock, 1),
+			InclusionTrees: []*TagTree{NewTagTree(3, 2)},
+			IMSBTrees:      []*TagTree{NewTagTree(3, 2)},
+		}
+		for i := range layerPasses {
+			p.CodeBlocks[0] = append(p.CodeBlocks[0], &CodeBlock{Index: i})
+		}
+		return p
+	}
+
+	enc := newPrecinct()
+	for i, cb := range enc.CodeBlocks[0] {
+		cb.LayerPasses = layerPasses[i]
+		cb.ZeroBitPlanes = i * 3
+		total := cb.LayerPasses[numLayers-1]
+		for p := 0; p < total; p++ {
+			length := 1 + (i+p)%5
+			if i == 5 {
+				length = 300
+			}
+			for n := 0; n < length; n++ {
+				cb.Data = append(cb.Data, byte(i<<4|n&0x0F))
+			}
+			cb.Passes = append(cb.Passes, CodingPass{CumulativeLength: len(cb.Data)})
+		}
+	}
+
+	var buf bytes.Buffer
+	pe := NewPacketEncoder(&buf)
+	for layer := 0; layer < numLayers; layer++ {
+		if err := pe.EncodePacket(enc, layer, false, true); err != nil {
+			t.Fatalf("EncodePacket(layer %d) error: %v", layer, err)
+		}
+	}
+
+	dec := newPrecinct()
+	pd := NewPacketDecoder(buf.Bytes())
+	for layer := 0; layer < numLayers; layer++ {
+		if err := pd.DecodePacket(dec, layer, false, true); err != nil {
+			t.Fatalf("DecodePacket(layer %d) error: %v", layer, err)
+		}
+	}
+	if pd.Position() != buf.Len() {
+		t.Errorf("decoder stopped at %d of %d bytes", pd.Position(), buf.Len())
+	}
+
+	for i, want := range enc.CodeBlocks[0] {
+		got := dec.CodeBlocks[0][i]
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("block %d: decoded %d bytes; want %d", i, len(got.Data), len(want.Data))
+		}
+		if len(got.Passes) != len(want.Passes) {
+			t.Errorf("block %d: decoded %d passes; want %d", i, len(got.Passes), len(want.Passes))
+		}
+		if len(want.Passes) > 0 && got.ZeroBitPlanes != want.ZeroBitPlanes {
+			t.Errorf("block %d: decoded %d zero bit-planes; want %d", i, got.ZeroBitPlanes, want.ZeroBitPlanes)
+		}
+	}
 }
 
 // TestPacketIteratorEmptyPrecincts tests with empty precinct configuration.
@@ -850,16 +970,13 @@ func TestEncodePacketMultipleBands(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(2, 2)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            64,
-		Y1:            64,
-		CodeBlocks:    make([][]*CodeBlock, 3), // 3 bands (HL, LH, HH)
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(2, 2),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         64,
+		Y1:         64,
+		CodeBlocks: make([][]*CodeBlock, 3), // 3 bands (HL, LH, HH)
 	}
 
 	for band := 0; band < 3; band++ {
@@ -1005,14 +1122,14 @@ func BenchmarkDecodeNumPasses(b *testing.B) {
 func BenchmarkDecodeLength(b *testing.B) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
-	enc.encodeLength(1000, 0, 0)
+	enc.encodeLengths(&CodeBlock{lblock: 3}, []int{1}, []int{1000})
 	enc.bio.Flush()
 	data := buf.Bytes()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		dec := NewPacketDecoder(data)
-		dec.decodeLength(0, 0)
+		dec.decodeLengths(&CodeBlock{lblock: 3}, []int{1})
 	}
 }
 
@@ -1056,16 +1173,13 @@ func TestDecodePacketHeaderNonZeroLayer(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1100,16 +1214,13 @@ func TestDecodePacketBodyWithData(t *testing.T) {
 	}
 
 	dec := NewPacketDecoder(data)
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1128,18 +1239,15 @@ func TestDecodePacketBodyWithData(t *testing.T) {
 
 // TestEncodePacketHeaderMultipleLayers tests encoding across multiple layers.
 func TestEncodePacketHeaderMultipleLayers(t *testing.T) {
-	tree := NewTagTree(2, 2)
 
 	// First layer - code block first included
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            32,
-		Y1:            32,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(2, 2),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         32,
+		Y1:         32,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 
 	precinct.CodeBlocks[0] = []*CodeBlock{
@@ -1226,6 +1334,74 @@ func TestPacketIteratorWithVariablePrecincts(t *testing.T) {
 	}
 }
 
+// TestPacketIteratorVariablePrecinctsAllOrders tests that every order
+// visits every packet when precinct counts vary by resolution and
+// component.
+func TestPacketIteratorVariablePrecinctsAllOrders(t *testing.T) {
+	precincts := [][][]int{
+		{{1}, {2}, {4}},
+		{{1}, {1}, {2}},
+	}
+	want := (1 + 2 + 4 + 1 + 1 + 2) * 2
+
+	orders := []codestream.ProgressionOrder{
+		codestream.LRCP,
+		codestream.RLCP,
+		codestream.RPCL,
+		codestream.PCRL,
+		codestream.CPRL,
+	}
+
+	for _, order := range orders {
+		pi := NewPacketIterator(2, 3, 2, precincts, order)
+
+		seen := make(map[Packet]bool)
+		for p, ok := pi.Next(); ok; p, ok = pi.Next() {
+			if p.Precinct >= precincts[p.Component][p.Resolution][0] {
+				continue // No such precinct
+			}
+			if seen[p] {
+				t.Errorf("Order %d: packet %+v visited twice", order, p)
+			}
+			seen[p] = true
+		}
+		if len(seen) != want {
+			t.Errorf("Order %d: visited %d packets; want %d", order, len(seen), want)
+		}
+	}
+}
+
+// TestPacketSequence tests switching progressions as POC entries do.
+func TestPacketSequence(t *testing.T) {
+	precincts := createTestPrecincts(1, 2, 1)
+
+	// Both layers of the lowest resolution first, then the rest layer by
+	// layer
+	first := NewPacketIterator(1, 2, 2, precincts, codestream.RLCP)
+	first.SetBounds(0, 1, 0, 1, 2)
+	rest := NewPacketIterator(1, 2, 2, precincts, codestream.LRCP)
+	seq := NewPacketSequence(first, rest)
+
+	want := []Packet{
+		{Layer: 0, Resolution: 0},
+		{Layer: 1, Resolution: 0},
+		{Layer: 0, Resolution: 1},
+		{Layer: 1, Resolution: 1},
+	}
+	for i, w := range want {
+		p, ok := seq.Next()
+		if !ok {
+			t.Fatalf("Packet %d: Next() returned false, expected more packets", i)
+		}
+		if p != w {
+			t.Errorf("Packet %d: got %+v; want %+v", i, p, w)
+		}
+	}
+	if p, ok := seq.Next(); ok {
+		t.Errorf("Next() = %+v after the last packet", p)
+	}
+}
+
 // TestHasMoreAllOrders tests hasMore for all progression orders.
 func TestHasMoreAllOrders(t *testing.T) {
 	precincts := createTestPrecincts(2, 2, 2)
@@ -1260,16 +1436,13 @@ func TestEncodePacketNotIncludedYet(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1317,16 +1490,13 @@ func TestDecodePacketEmptyPresent(t *testing.T) {
 	data := []byte{0x00} // All zeros, presence bit is 0
 
 	dec := NewPacketDecoder(data)
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{}
 
@@ -1356,16 +1526,13 @@ func TestDecodePacketNonZeroLayerInclusion(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1390,16 +1557,13 @@ func TestDecodePacketWithCodeBlockInclusion(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1425,16 +1589,13 @@ func TestEncodePacketMultiplePasses(t *testing.T) {
 		var buf bytes.Buffer
 		enc := NewPacketEncoder(&buf)
 
-		tree := NewTagTree(1, 1)
 		precinct := &Precinct{
-			Index:         0,
-			X0:            0,
-			Y0:            0,
-			X1:            16,
-			Y1:            16,
-			CodeBlocks:    make([][]*CodeBlock, 1),
-			InclusionTree: tree,
-			IMSBTree:      NewTagTree(1, 1),
+			Index:      0,
+			X0:         0,
+			Y0:         0,
+			X1:         16,
+			Y1:         16,
+			CodeBlocks: make([][]*CodeBlock, 1),
 		}
 
 		passes := make([]CodingPass, numPasses)
@@ -1459,19 +1620,6 @@ func TestEncodePacketMultiplePasses(t *testing.T) {
 	}
 }
 
-// TestEncodeTagTreeValueZero tests tag tree encoding with value 0.
-func TestEncodeTagTreeValueZero(t *testing.T) {
-	var buf bytes.Buffer
-	enc := NewPacketEncoder(&buf)
-	tree := NewTagTree(2, 2)
-
-	// Value 0 should encode as just "1"
-	err := enc.encodeTagTreeValue(tree, 0, 0, 0)
-	if err != nil {
-		t.Fatalf("encodeTagTreeValue(0) error: %v", err)
-	}
-}
-
 // TestDecodePacketDataCopy tests that packet body data is properly copied.
 func TestDecodePacketDataCopy(t *testing.T) {
 	// Create a packet with body data
@@ -1480,16 +1628,13 @@ func TestDecodePacketDataCopy(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1531,16 +1676,16 @@ func TestPacketIteratorBoundsEdgeCases(t *testing.T) {
 func TestDecodeLengthZero(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
-	enc.encodeLength(0, 0, 0)
+	enc.encodeLengths(&CodeBlock{lblock: 3}, []int{1}, []int{0})
 	enc.bio.Flush()
 
 	dec := NewPacketDecoder(buf.Bytes())
-	length, err := dec.decodeLength(0, 0)
+	lengths, err := dec.decodeLengths(&CodeBlock{lblock: 3}, []int{1})
 	if err != nil {
-		t.Fatalf("decodeLength error: %v", err)
+		t.Fatalf("decodeLengths error: %v", err)
 	}
-	if length != 0 {
-		t.Errorf("Decoded length = %d; want 0", length)
+	if lengths[0] != 0 {
+		t.Errorf("Decoded length = %d; want 0", lengths[0])
 	}
 }
 
@@ -1549,16 +1694,13 @@ func TestEncodePacketNoCodeBlocks(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 0), // No bands
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 0), // No bands
 	}
 
 	err := enc.EncodePacket(precinct, 0, false, false)
@@ -1618,16 +1760,13 @@ func TestDecodePacketHeaderAtLayerOne(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	precinct.CodeBlocks[0] = []*CodeBlock{
 		{
@@ -1648,14 +1787,12 @@ func TestDecodePacketHeaderAtLayerOne(t *testing.T) {
 	// Decode the encoded packet
 	dec := NewPacketDecoder(buf.Bytes())
 	decodePrecinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: NewTagTree(1, 1),
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	decodePrecinct.CodeBlocks[0] = []*CodeBlock{
 		{Index: 0}, // Empty CB, will be populated by decode
@@ -1673,16 +1810,13 @@ func TestDecodePacketWithCodeBlockDataBody(t *testing.T) {
 	var buf bytes.Buffer
 	enc := NewPacketEncoder(&buf)
 
-	tree := NewTagTree(1, 1)
 	precinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: tree,
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	cbData := []byte{0x12, 0x34, 0x56, 0x78}
 	precinct.CodeBlocks[0] = []*CodeBlock{
@@ -1703,14 +1837,12 @@ func TestDecodePacketWithCodeBlockDataBody(t *testing.T) {
 	// Now decode
 	dec := NewPacketDecoder(buf.Bytes())
 	decodePrecinct := &Precinct{
-		Index:         0,
-		X0:            0,
-		Y0:            0,
-		X1:            16,
-		Y1:            16,
-		CodeBlocks:    make([][]*CodeBlock, 1),
-		InclusionTree: NewTagTree(1, 1),
-		IMSBTree:      NewTagTree(1, 1),
+		Index:      0,
+		X0:         0,
+		Y0:         0,
+		X1:         16,
+		Y1:         16,
+		CodeBlocks: make([][]*CodeBlock, 1),
 	}
 	decodePrecinct.CodeBlocks[0] = []*CodeBlock{
 		{
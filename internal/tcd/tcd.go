@@ -9,9 +9,16 @@
 package tcd
 
 import (
+	"fmt"
+	"math"
+	"math/bits"
+	"runtime"
+	"sync"
+
 	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
 	"github.com/mrjoshuak/go-jpeg2000/internal/dwt"
 	"github.com/mrjoshuak/go-jpeg2000/internal/entropy"
+	"github.com/mrjoshuak/go-jpeg2000/tagtree"
 )
 
 // Tile represents a single tile in the image.
@@ -26,6 +33,78 @@ type Tile struct {
 	Components []*TileComponent
 }
 
+// SubbandType identifies a wavelet subband (LL, HL, LH, HH).
+type SubbandType int
+
+// Subband types, in the order they appear within a resolution level.
+// The values match the entropy package band constants.
+const (
+	SubbandLL SubbandType = entropy.BandLL
+	SubbandHL SubbandType = entropy.BandHL
+	SubbandLH SubbandType = entropy.BandLH
+	SubbandHH SubbandType = entropy.BandHH
+)
+
+// String returns the subband name, e.g. "HL".
+func (s SubbandType) String() string {
+	switch s {
+	case SubbandLL:
+		return "LL"
+	case SubbandHL:
+		return "HL"
+	case SubbandLH:
+		return "LH"
+	case SubbandHH:
+		return "HH"
+	}
+	return fmt.Sprintf("SubbandType(%d)", int(s))
+}
+
+// SubbandInfo describes the placement of a subband within a
+// tile-component's coefficient buffer.
+type SubbandInfo struct {
+	// Subband type
+	Type SubbandType
+
+	// Resolution level the subband belongs to (0 = lowest, LL only)
+	ResolutionLevel int
+
+	// Subband dimensions
+	W, H int
+
+	// Position of the subband in the in-place (Mallat) coefficient layout
+	OffsetX, OffsetY int
+}
+
+// IntraTileOrder returns the subbands of the given component in the order
+// defined by ISO/IEC 15444-1 §B.5: the LL band of the lowest resolution
+// first, followed by HL, LH and HH for each resolution from lowest to
+// highest. The sizes are those of the component's bands, and the offsets
+// those given by BandOffset. Returns nil if the component index is out of
+// range.
+func (t *Tile) IntraTileOrder(component int) []SubbandInfo {
+	if component < 0 || component >= len(t.Components) || t.Components[component] == nil {
+		return nil
+	}
+	tc := t.Components[component]
+
+	var order []SubbandInfo
+	for r, res := range tc.Resolutions {
+		for _, band := range res.Bands {
+			ox, oy := BandOffset(tc, r, band.Type)
+			order = append(order, SubbandInfo{
+				Type:            band.Type,
+				ResolutionLevel: r,
+				W:               band.X1 - band.X0,
+				H:               band.Y1 - band.Y0,
+				OffsetX:         ox,
+				OffsetY:         oy,
+			})
+		}
+	}
+	return order
+}
+
 // TileComponent represents a single component within a tile.
 type TileComponent struct {
 	// Component index
@@ -40,7 +119,7 @@ type TileComponent struct {
 	// Coefficient data
 	Data []int32
 
-	// Floating point data for 9-7 transform
+	// Floating point data for the 9-7 transform
 	DataFloat []float64
 }
 
@@ -68,7 +147,7 @@ type Resolution struct {
 // Band represents a subband within a resolution level.
 type Band struct {
 	// Band type (LL, HL, LH, HH)
-	Type int
+	Type SubbandType
 
 	// Band bounds
 	X0, Y0, X1, Y1 int
@@ -76,11 +155,51 @@ type Band struct {
 	// Quantization step size
 	StepSize float64
 
+	// Number of magnitude bit-planes the quantization allows (Mb),
+	// including guard bits
+	MaxBitPlanes int
+
 	// Code-blocks
 	CodeBlocks []*CodeBlock
 
 	// Code-block grid dimensions
 	CodeBlocksX, CodeBlocksY int
+
+	// Code-block size exponents: code-blocks are 2^xcb x 2^ycb cells of
+	// a grid anchored at the origin of the band's coordinates
+	xcb, ycb int
+}
+
+// CodeBlockIndices returns the indices into b.CodeBlocks of the
+// code-blocks that intersect the area [x0,x1) x [y0,y1) of the band, in
+// raster order. The area is in the band's absolute coordinates, like the
+// band bounds, and is clipped to the band.
+func (b *Band) CodeBlockIndices(x0, y0, x1, y1 int) []int {
+	cx0, cy0, cx1, cy1 := b.codeBlockRange(x0, y0, x1, y1)
+	if cx1 <= cx0 || cy1 <= cy0 {
+		return nil
+	}
+	indices := make([]int, 0, (cx1-cx0)*(cy1-cy0))
+	for y := cy0; y < cy1; y++ {
+		for x := cx0; x < cx1; x++ {
+			indices = append(indices, cbGridIndex(x, y, b.CodeBlocksX))
+		}
+	}
+	return indices
+}
+
+// codeBlockRange returns the range [cx0,cx1) x [cy0,cy1) of the band's
+// code-block grid, counted from its first code-block, that intersects
+// the area [x0,x1) x [y0,y1); the range is empty if the area misses the
+// band.
+func (b *Band) codeBlockRange(x0, y0, x1, y1 int) (cx0, cy0, cx1, cy1 int) {
+	x0, y0 = max(x0, b.X0), max(y0, b.Y0)
+	x1, y1 = min(x1, b.X1), min(y1, b.Y1)
+	if x1 <= x0 || y1 <= y0 {
+		return 0, 0, 0, 0
+	}
+	bx, by := b.X0>>b.xcb, b.Y0>>b.ycb
+	return x0>>b.xcb - bx, y0>>b.ycb - by, ceilDiv(x1, 1<<b.xcb) - bx, ceilDiv(y1, 1<<b.ycb) - by
 }
 
 // Precinct represents a precinct for packet organization.
@@ -91,12 +210,34 @@ type Precinct struct {
 	// Bounds
 	X0, Y0, X1, Y1 int
 
-	// Code-blocks in this precinct, per band
+	// Code-blocks in this precinct, per band of the resolution level
+	// (see BandType)
 	CodeBlocks [][]*CodeBlock
 
-	// Tag trees for inclusion and IMSB
-	InclusionTree *TagTree
-	IMSBTree      *TagTree
+	// Inclusion and zero bit-plane tag trees, per band, over the grid of
+	// code-blocks in CodeBlocks (nil for a band with no code-blocks)
+	InclusionTrees []*TagTree
+	IMSBTrees      []*TagTree
+}
+
+// BandType returns the subband type of CodeBlocks[bandIdx]. The lowest
+// resolution level holds only the LL band; every other level holds HL, LH
+// and HH in that order.
+func (p *Precinct) BandType(bandIdx int) SubbandType {
+	if len(p.CodeBlocks) == 1 {
+		return SubbandLL
+	}
+	return SubbandHL + SubbandType(bandIdx)
+}
+
+// cbGridIndex returns the flat raster index of grid cell (x, y).
+func cbGridIndex(x, y, gridW int) int {
+	return y*gridW + x
+}
+
+// cbGridPos returns the grid cell (x, y) of a flat raster index.
+func cbGridPos(index, gridW int) (x, y int) {
+	return index % gridW, index / gridW
 }
 
 // CodeBlock represents a code-block for entropy coding.
@@ -122,8 +263,45 @@ type CodeBlock struct {
 	// Included in previous layers
 	IncludedInLayers int
 
+	// Cumulative number of coding passes included through each layer,
+	// set by rate allocation. Nil means the whole block is one unit.
+	LayerPasses []int
+
 	// Decoded coefficient data
 	Coefficients []int32
+
+	// Code-block style (COD/COC Scb), selecting the coding modes
+	Style uint8
+
+	// Lblock state of the packet header length coding; zero until the
+	// block is first included in a packet
+	lblock int
+}
+
+// NumSignificantSamples returns the number of non-zero quantized
+// coefficients within the code-block's spatial extent.
+func (cb *CodeBlock) NumSignificantSamples() int {
+	n := (cb.X1 - cb.X0) * (cb.Y1 - cb.Y0)
+	if n > len(cb.Coefficients) {
+		n = len(cb.Coefficients)
+	}
+	count := 0
+	for _, v := range cb.Coefficients[:max(n, 0)] {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// SparsityRatio returns the fraction of the code-block's samples that are
+// significant, in [0, 1]. An empty code-block has ratio 0.
+func (cb *CodeBlock) SparsityRatio() float64 {
+	total := (cb.X1 - cb.X0) * (cb.Y1 - cb.Y0)
+	if total <= 0 {
+		return 0
+	}
+	return float64(cb.NumSignificantSamples()) / float64(total)
 }
 
 // CodingPass represents a single coding pass.
@@ -137,6 +315,9 @@ type CodingPass struct {
 	// Cumulative length
 	CumulativeLength int
 
+	// Distortion reduction achieved by this pass
+	Distortion float64
+
 	// Rate-distortion slope
 	Slope float64
 
@@ -151,64 +332,13 @@ const (
 	PassCleanup
 )
 
-// TagTree implements a tag tree for incremental coding.
-type TagTree struct {
-	width  int
-	height int
-	levels int
-	nodes  [][]tagNode
-}
-
-type tagNode struct {
-	value    int
-	low      int
-	known    bool
-}
+// TagTree is the tag tree of packet headers, shared with the public
+// tagtree package.
+type TagTree = tagtree.TagTree
 
 // NewTagTree creates a new tag tree.
 func NewTagTree(width, height int) *TagTree {
-	t := &TagTree{
-		width:  width,
-		height: height,
-	}
-
-	// Calculate number of levels
-	w, h := width, height
-	for w > 1 || h > 1 {
-		t.levels++
-		w = (w + 1) / 2
-		h = (h + 1) / 2
-	}
-	t.levels++
-
-	// Allocate nodes
-	t.nodes = make([][]tagNode, t.levels)
-	w, h = width, height
-	for level := 0; level < t.levels; level++ {
-		t.nodes[level] = make([]tagNode, w*h)
-		for i := range t.nodes[level] {
-			t.nodes[level][i].value = int(^uint(0) >> 1) // MaxInt
-		}
-		w = (w + 1) / 2
-		h = (h + 1) / 2
-	}
-
-	return t
-}
-
-// SetValue sets the value at a leaf node.
-func (t *TagTree) SetValue(x, y, value int) {
-	t.nodes[0][y*t.width+x].value = value
-}
-
-// Reset resets the tree for a new encoding/decoding session.
-func (t *TagTree) Reset() {
-	for level := range t.nodes {
-		for i := range t.nodes[level] {
-			t.nodes[level][i].low = 0
-			t.nodes[level][i].known = false
-		}
-	}
+	return tagtree.NewTagTree(width, height)
 }
 
 // TileDecoder decodes a single tile.
@@ -217,6 +347,19 @@ type TileDecoder struct {
 	tileHeader *codestream.TilePartHeader
 	tile       *Tile
 	htj2k      bool // True if using High-Throughput mode
+	reduce     int  // Number of highest resolution levels to discard
+
+	// reuse makes tiles share the sample buffers below, one per
+	// component, instead of allocating their own.
+	reuse        bool
+	buffers      [][]int32
+	floatBuffers [][]float64
+	dwtBuffers   [][]float32
+
+	// resilient makes DecodeComponent skip code-blocks whose headers are
+	// inconsistent instead of failing; damaged counts them per tile.
+	resilient bool
+	damaged   int
 }
 
 // NewTileDecoder creates a new tile decoder.
@@ -227,11 +370,47 @@ func NewTileDecoder(header *codestream.Header) *TileDecoder {
 	}
 }
 
+// SetHeader points the decoder at the codestream described by header, so
+// that one decoder, and the buffers it reuses, can serve a sequence of
+// codestreams.
+func (d *TileDecoder) SetHeader(header *codestream.Header) {
+	d.header = header
+	d.htj2k = header.IsHTJ2K()
+	d.tile = nil
+}
+
+// ReuseBuffers sets whether InitTile and DecodeComponent reuse the sample
+// buffers of the previous tile instead of allocating new ones. The Data
+// and DataFloat of a tile are then only valid until the next InitTile.
+func (d *TileDecoder) ReuseBuffers(reuse bool) {
+	d.reuse = reuse
+}
+
+// SetResilient sets whether DecodeComponent skips code-blocks it cannot
+// decode, leaving their coefficients at zero, rather than returning an
+// error. DamagedBlocks reports how many were skipped.
+func (d *TileDecoder) SetResilient(resilient bool) {
+	d.resilient = resilient
+}
+
+// DamagedBlocks returns the number of code-blocks of the current tile that
+// DecodeComponent skipped under SetResilient.
+func (d *TileDecoder) DamagedBlocks() int {
+	return d.damaged
+}
+
 // SetHTJ2K sets whether this decoder uses High-Throughput mode.
 func (d *TileDecoder) SetHTJ2K(htj2k bool) {
 	d.htj2k = htj2k
 }
 
+// SetReduce sets the number of highest resolution levels to discard.
+// DecodeComponent then skips their code-blocks and ApplyInverseDWT stops
+// that many levels early, leaving the image at 1/2^reduce scale.
+func (d *TileDecoder) SetReduce(reduce int) {
+	d.reduce = reduce
+}
+
 // Tile returns the current tile being decoded.
 func (d *TileDecoder) Tile() *Tile {
 	return d.tile
@@ -239,8 +418,43 @@ func (d *TileDecoder) Tile() *Tile {
 
 // InitTile initializes a tile for decoding.
 func (d *TileDecoder) InitTile(tileIndex int) {
-	h := d.header
+	d.tile = newTile(d.header, tileIndex)
+	d.damaged = 0
+	if d.reuse {
+		// Components are inverse transformed concurrently, so every
+		// component's buffers exist before any is handed out
+		for n := len(d.tile.Components); len(d.buffers) < n; {
+			d.buffers = append(d.buffers, nil)
+			d.floatBuffers = append(d.floatBuffers, nil)
+			d.dwtBuffers = append(d.dwtBuffers, nil)
+		}
+	}
+	for c, tc := range d.tile.Components {
+		n := (tc.X1 - tc.X0) * (tc.Y1 - tc.Y0)
+		if !d.reuse {
+			tc.Data = make([]int32, n)
+			continue
+		}
+		d.buffers[c] = reuseBuffer(d.buffers[c], n)
+		tc.Data = d.buffers[c]
+	}
+}
+
+// reuseBuffer returns buf resized to n zeroed values, reallocating only
+// when it is too small.
+func reuseBuffer[T int32 | float32 | float64](buf []T, n int) []T {
+	if cap(buf) < n {
+		return make([]T, n)
+	}
+	buf = buf[:n]
+	clear(buf)
+	return buf
+}
 
+// newTile builds tile tileIndex of the image described by h, with the
+// resolutions, bands, precincts and code-blocks of each component laid
+// out on the reference grid as ITU-T T.800 Annex B describes.
+func newTile(h *codestream.Header, tileIndex int) *Tile {
 	// Calculate tile bounds
 	tileX := tileIndex % int(h.NumTilesX)
 	tileY := tileIndex / int(h.NumTilesX)
@@ -250,7 +464,7 @@ func (d *TileDecoder) InitTile(tileIndex int) {
 	x1 := min(int(h.TileXOffset)+(tileX+1)*int(h.TileWidth), int(h.ImageWidth))
 	y1 := min(int(h.TileYOffset)+(tileY+1)*int(h.TileHeight), int(h.ImageHeight))
 
-	d.tile = &Tile{
+	tile := &Tile{
 		Index:      tileIndex,
 		X0:         x0,
 		Y0:         y0,
@@ -259,129 +473,166 @@ func (d *TileDecoder) InitTile(tileIndex int) {
 		Components: make([]*TileComponent, h.NumComponents),
 	}
 
-	// Initialize components
-	for c := 0; c < int(h.NumComponents); c++ {
+	for c := range tile.Components {
 		comp := h.ComponentInfo[c]
 
 		// Apply subsampling
-		cx0 := ceilDiv(x0, int(comp.SubsamplingX))
-		cy0 := ceilDiv(y0, int(comp.SubsamplingY))
-		cx1 := ceilDiv(x1, int(comp.SubsamplingX))
-		cy1 := ceilDiv(y1, int(comp.SubsamplingY))
-
 		tc := &TileComponent{
 			Index: c,
-			X0:    cx0,
-			Y0:    cy0,
-			X1:    cx1,
-			Y1:    cy1,
+			X0:    ceilDiv(x0, int(comp.SubsamplingX)),
+			Y0:    ceilDiv(y0, int(comp.SubsamplingY)),
+			X1:    ceilDiv(x1, int(comp.SubsamplingX)),
+			Y1:    ceilDiv(y1, int(comp.SubsamplingY)),
 		}
 
-		// Allocate data
-		width := cx1 - cx0
-		height := cy1 - cy0
-		tc.Data = make([]int32, width*height)
-
-		// Initialize resolutions
-		numRes := int(h.CodingStyle.NumDecompositions) + 1
-		tc.Resolutions = make([]*Resolution, numRes)
-
-		for r := 0; r < numRes; r++ {
-			d.initResolution(tc, r)
+		style := h.ComponentCodingStyle(c)
+		tc.Resolutions = make([]*Resolution, int(style.NumDecompositions)+1)
+		for r := range tc.Resolutions {
+			tc.Resolutions[r] = newResolution(h, tc, style, r)
 		}
 
-		d.tile.Components[c] = tc
+		tile.Components[c] = tc
 	}
+
+	return tile
 }
 
-// initResolution initializes a resolution level.
-func (d *TileDecoder) initResolution(tc *TileComponent, resLevel int) {
-	h := d.header.CodingStyle
+// newResolution builds resolution level r of tc.
+func newResolution(h *codestream.Header, tc *TileComponent, style codestream.CodingStyleComponent, r int) *Resolution {
+	numDecomp := int(style.NumDecompositions)
 
 	// Calculate resolution bounds
-	scale := 1 << (int(h.NumDecompositions) - resLevel)
-	rx0 := ceilDiv(tc.X0, scale)
-	ry0 := ceilDiv(tc.Y0, scale)
-	rx1 := ceilDiv(tc.X1, scale)
-	ry1 := ceilDiv(tc.Y1, scale)
-
+	scale := 1 << (numDecomp - r)
 	res := &Resolution{
-		Level: resLevel,
-		X0:    rx0,
-		Y0:    ry0,
-		X1:    rx1,
-		Y1:    ry1,
+		Level: r,
+		X0:    ceilDiv(tc.X0, scale),
+		Y0:    ceilDiv(tc.Y0, scale),
+		X1:    ceilDiv(tc.X1, scale),
+		Y1:    ceilDiv(tc.Y1, scale),
 	}
 
-	// Initialize bands
-	if resLevel == 0 {
-		res.NumBands = 1
-		res.Bands = []*Band{d.initBand(res, entropy.BandLL)}
-	} else {
-		res.NumBands = 3
-		res.Bands = []*Band{
-			d.initBand(res, entropy.BandHL),
-			d.initBand(res, entropy.BandLH),
-			d.initBand(res, entropy.BandHH),
+	// Precinct partition; without explicit sizes a single 2^15 precinct
+	// covers the resolution
+	ppx, ppy := 15, 15
+	if style.CodingStyle&codestream.CodingStylePrecincts != 0 && r < len(style.PrecinctSizes) {
+		ppx = int(style.PrecinctSizes[r].WidthExp)
+		ppy = int(style.PrecinctSizes[r].HeightExp)
+	}
+	if res.X1 > res.X0 && res.Y1 > res.Y0 {
+		res.PrecinctsX = ceilDiv(res.X1, 1<<ppx) - res.X0>>ppx
+		res.PrecinctsY = ceilDiv(res.Y1, 1<<ppy) - res.Y0>>ppy
+	}
+
+	// Initialize bands. Above the lowest resolution a precinct maps onto
+	// half-size areas of the HL, LH and HH bands, and code-blocks never
+	// straddle precincts.
+	types := []SubbandType{SubbandLL}
+	bppx, bppy := ppx, ppy
+	if r > 0 {
+		types = []SubbandType{SubbandHL, SubbandLH, SubbandHH}
+		bppx, bppy = max(ppx-1, 0), max(ppy-1, 0)
+	}
+	xcb := min(int(style.CodeBlockWidthExp)+2, bppx)
+	ycb := min(int(style.CodeBlockHeightExp)+2, bppy)
+
+	res.NumBands = len(types)
+	res.Bands = make([]*Band, len(types))
+	for i, typ := range types {
+		res.Bands[i] = newBand(tc, numDecomp, r, typ, xcb, ycb, style.CodeBlockStyle)
+		res.Bands[i].StepSize, res.Bands[i].MaxBitPlanes = bandQuantization(h, tc.Index, numDecomp, r, typ)
+	}
+
+	// Initialize precincts with the code-blocks of each band they cover
+	res.Precincts = make([]*Precinct, res.PrecinctsX*res.PrecinctsY)
+	for p := range res.Precincts {
+		gx := res.X0>>ppx + p%res.PrecinctsX
+		gy := res.Y0>>ppy + p/res.PrecinctsX
+		prec := &Precinct{
+			Index:          p,
+			X0:             max(gx<<ppx, res.X0),
+			Y0:             max(gy<<ppy, res.Y0),
+			X1:             min((gx+1)<<ppx, res.X1),
+			Y1:             min((gy+1)<<ppy, res.Y1),
+			CodeBlocks:     make([][]*CodeBlock, len(res.Bands)),
+			InclusionTrees: make([]*TagTree, len(res.Bands)),
+			IMSBTrees:      make([]*TagTree, len(res.Bands)),
+		}
+
+		for b, band := range res.Bands {
+			// The precinct's area of the band
+			px0, py0, px1, py1 := gx<<bppx, gy<<bppy, (gx+1)<<bppx, (gy+1)<<bppy
+			indices := band.CodeBlockIndices(px0, py0, px1, py1)
+			if len(indices) == 0 {
+				continue
+			}
+
+			cbs := make([]*CodeBlock, len(indices))
+			for i, idx := range indices {
+				cbs[i] = band.CodeBlocks[idx]
+			}
+			cx0, cy0, cx1, cy1 := band.codeBlockRange(px0, py0, px1, py1)
+			prec.CodeBlocks[b] = cbs
+			prec.InclusionTrees[b] = NewTagTree(cx1-cx0, cy1-cy0)
+			prec.IMSBTrees[b] = NewTagTree(cx1-cx0, cy1-cy0)
 		}
+
+		res.Precincts[p] = prec
 	}
 
-	tc.Resolutions[resLevel] = res
+	return res
 }
 
-// initBand initializes a band.
-func (d *TileDecoder) initBand(res *Resolution, bandType int) *Band {
-	h := d.header.CodingStyle
-
+// newBand builds the band of the given type at resolution level r of tc,
+// divided into 2^xcb x 2^ycb code-blocks coded with style cbStyle.
+func newBand(tc *TileComponent, numDecomp, r int, bandType SubbandType, xcb, ycb int, cbStyle uint8) *Band {
 	band := &Band{
 		Type: bandType,
+		xcb:  xcb,
+		ycb:  ycb,
 	}
 
-	// Calculate band bounds based on type
+	// Band bounds (equation B-15): the decomposition level nb and the
+	// band's offset in each direction
+	nb := numDecomp - r + 1
+	if r == 0 {
+		nb = numDecomp
+	}
+	xob, yob := 0, 0
 	switch bandType {
-	case entropy.BandLL:
-		band.X0 = res.X0
-		band.Y0 = res.Y0
-		band.X1 = res.X1
-		band.Y1 = res.Y1
-	case entropy.BandHL:
-		band.X0 = res.X0
-		band.Y0 = res.Y0
-		band.X1 = res.X1
-		band.Y1 = (res.Y0 + res.Y1) / 2
-	case entropy.BandLH:
-		band.X0 = res.X0
-		band.Y0 = res.Y0
-		band.X1 = (res.X0 + res.X1) / 2
-		band.Y1 = res.Y1
-	case entropy.BandHH:
-		band.X0 = (res.X0 + res.X1) / 2
-		band.Y0 = (res.Y0 + res.Y1) / 2
-		band.X1 = res.X1
-		band.Y1 = res.Y1
-	}
-
-	// Calculate code-block grid
-	cbWidth := 1 << (h.CodeBlockWidthExp + 2)
-	cbHeight := 1 << (h.CodeBlockHeightExp + 2)
-
-	band.CodeBlocksX = ceilDiv(band.X1-band.X0, cbWidth)
-	band.CodeBlocksY = ceilDiv(band.Y1-band.Y0, cbHeight)
+	case SubbandHL:
+		xob = 1
+	case SubbandLH:
+		yob = 1
+	case SubbandHH:
+		xob, yob = 1, 1
+	}
+	band.X0 = bandCoord(tc.X0, nb, xob)
+	band.Y0 = bandCoord(tc.Y0, nb, yob)
+	band.X1 = bandCoord(tc.X1, nb, xob)
+	band.Y1 = bandCoord(tc.Y1, nb, yob)
+
+	// Code-blocks are anchored on the band's coordinate origin, so those
+	// on the band edges may be partial
+	if band.X1 > band.X0 && band.Y1 > band.Y0 {
+		band.CodeBlocksX = ceilDiv(band.X1, 1<<xcb) - band.X0>>xcb
+		band.CodeBlocksY = ceilDiv(band.Y1, 1<<ycb) - band.Y0>>ycb
+	}
 
 	// Initialize code-blocks
 	numCB := band.CodeBlocksX * band.CodeBlocksY
 	band.CodeBlocks = make([]*CodeBlock, numCB)
 
 	for i := 0; i < numCB; i++ {
-		cbX := i % band.CodeBlocksX
-		cbY := i / band.CodeBlocksX
+		cbX, cbY := cbGridPos(i, band.CodeBlocksX)
+		gx, gy := band.X0>>xcb+cbX, band.Y0>>ycb+cbY
 
 		cb := &CodeBlock{
 			Index: i,
-			X0:    band.X0 + cbX*cbWidth,
-			Y0:    band.Y0 + cbY*cbHeight,
-			X1:    min(band.X0+(cbX+1)*cbWidth, band.X1),
-			Y1:    min(band.Y0+(cbY+1)*cbHeight, band.Y1),
+			X0:    max(gx<<xcb, band.X0),
+			Y0:    max(gy<<ycb, band.Y0),
+			X1:    min((gx+1)<<xcb, band.X1),
+			Y1:    min((gy+1)<<ycb, band.Y1),
+			Style: cbStyle,
 		}
 		band.CodeBlocks[i] = cb
 	}
@@ -389,8 +640,19 @@ func (d *TileDecoder) initBand(res *Resolution, bandType int) *Band {
 	return band
 }
 
-// DecodeCodeBlock decodes a single code-block.
-func (d *TileDecoder) DecodeCodeBlock(cb *CodeBlock, bandType int) error {
+// bandCoord maps tile-component coordinate c onto a band of decomposition
+// level nb whose origin is offset by o (0 or 1) in that direction.
+func bandCoord(c, nb, o int) int {
+	if o == 0 {
+		return ceilDiv(c, 1<<nb)
+	}
+	return ceilDiv(c-1<<(nb-1), 1<<nb)
+}
+
+// DecodeCodeBlock decodes a single code-block. The block's Passes, when
+// set, give the number of coding passes to decode from TotalBitPlanes
+// bit-planes; otherwise every pass is decoded.
+func (d *TileDecoder) DecodeCodeBlock(cb *CodeBlock, bandType SubbandType) error {
 	if len(cb.Data) == 0 {
 		return nil
 	}
@@ -401,46 +663,267 @@ func (d *TileDecoder) DecodeCodeBlock(cb *CodeBlock, bandType int) error {
 	if d.htj2k {
 		// Use HTJ2K decoder
 		htDec := entropy.GetHTDecoder(width, height)
-		cb.Coefficients = htDec.Decode(cb.Data, cb.TotalBitPlanes, bandType)
+		cb.Coefficients = append([]int32(nil), htDec.Decode(cb.Data, cb.TotalBitPlanes, int(bandType))...)
 		entropy.PutHTDecoder(htDec)
 	} else {
 		// Use standard EBCOT decoder
 		t1 := entropy.NewT1(width, height)
-		cb.Coefficients = t1.Decode(cb.Data, cb.TotalBitPlanes, bandType)
+		t1.SetStyle(cb.Style)
+		numPasses := 3*cb.TotalBitPlanes - 2
+		if len(cb.Passes) > 0 {
+			numPasses = len(cb.Passes)
+		}
+		cb.Coefficients = t1.DecodeSegments(codewordSegments(cb, numPasses), cb.TotalBitPlanes, numPasses, int(bandType))
+	}
+
+	return nil
+}
+
+// codewordSegments splits the data of the first numPasses coding passes
+// of cb into its codeword segments, using the cumulative length recorded
+// for each pass that ends one.
+func codewordSegments(cb *CodeBlock, numPasses int) [][]byte {
+	var segments [][]byte
+	start := 0
+	for i := 0; i < numPasses && i < len(cb.Passes); i++ {
+		if entropy.IsTerminatedPass(i, cb.Style) {
+			end := min(max(cb.Passes[i].CumulativeLength, start), len(cb.Data))
+			segments = append(segments, cb.Data[start:end])
+			start = end
+		}
+	}
+	return append(segments, cb.Data[start:])
+}
+
+// DecodeComponent entropy decodes the code-blocks of tc that packets have
+// filled in, undoes any ROI shift and dequantizes the coefficients into
+// the component's buffers: Data for the reversible wavelet, rounded to
+// integers if it was quantized, and DataFloat for the irreversible one.
+// Coefficients are laid out as the dwt package
+// expects, each band at its place in the Mallat layout of the
+// full-resolution component. Resolution levels discarded by SetReduce are
+// skipped.
+func (d *TileDecoder) DecodeComponent(tc *TileComponent) error {
+	numLevels, reversible := d.componentWavelet(tc.Index)
+	roiShift := int(d.header.ROIShifts[uint16(tc.Index)])
+	stride := tc.X1 - tc.X0
+	if !reversible {
+		tc.DataFloat = d.floatBuffer(tc.Index, len(tc.Data))
+	}
+
+	numRes := min(numLevels+1, len(tc.Resolutions)) - min(d.reduce, numLevels)
+	for r := 0; r < numRes; r++ {
+		res := tc.Resolutions[r]
+		for _, band := range res.Bands {
+			ox, oy := BandOffset(tc, r, band.Type)
+			for _, cb := range band.CodeBlocks {
+				if len(cb.Passes) == 0 || len(cb.Data) == 0 {
+					continue
+				}
+				cb.TotalBitPlanes = band.MaxBitPlanes + roiShift - cb.ZeroBitPlanes
+				if cb.TotalBitPlanes <= 0 || cb.TotalBitPlanes > 31 {
+					if d.resilient {
+						d.damaged++
+						continue
+					}
+					return fmt.Errorf("code-block with %d bit-planes", cb.TotalBitPlanes)
+				}
+				if err := d.DecodeCodeBlock(cb, band.Type); err != nil {
+					return err
+				}
+				d.ApplyROIShift(cb, tc.Index)
+
+				// A fully decoded block is reconstructed at the
+				// midpoint of each coefficient's quantization interval
+				half := 0.0
+				if len(cb.Passes) >= 3*cb.TotalBitPlanes-2 {
+					half = 0.5
+				}
+
+				w := cb.X1 - cb.X0
+				for y := cb.Y0; y < cb.Y1; y++ {
+					row := (oy+y-band.Y0)*stride + ox - band.X0
+					src := cb.Coefficients[(y-cb.Y0)*w : (y-cb.Y0+1)*w]
+					if reversible && band.StepSize == 1 {
+						copy(tc.Data[row+cb.X0:], src)
+						continue
+					}
+					if reversible {
+						for i, v := range src {
+							switch {
+							case v > 0:
+								tc.Data[row+cb.X0+i] = int32(math.Round((float64(v) + half) * band.StepSize))
+							case v < 0:
+								tc.Data[row+cb.X0+i] = int32(math.Round((float64(v) - half) * band.StepSize))
+							default:
+								tc.Data[row+cb.X0+i] = 0
+							}
+						}
+						continue
+					}
+					for i, v := range src {
+						switch {
+						case v > 0:
+							tc.DataFloat[row+cb.X0+i] = (float64(v) + half) * band.StepSize
+						case v < 0:
+							tc.DataFloat[row+cb.X0+i] = (float64(v) - half) * band.StepSize
+						}
+					}
+				}
+			}
+		}
 	}
 
 	return nil
 }
 
-// ApplyInverseDWT applies the inverse wavelet transform.
+// floatBuffer returns n zeroed float coefficients for component c, from
+// the reused buffers if ReuseBuffers is set.
+func (d *TileDecoder) floatBuffer(c, n int) []float64 {
+	if !d.reuse {
+		return make([]float64, n)
+	}
+	d.floatBuffers[c] = reuseBuffer(d.floatBuffers[c], n)
+	return d.floatBuffers[c]
+}
+
+// BandOffset returns the position of the band of type t at resolution
+// level r within the Mallat layout of tc: the high-pass bands sit beside
+// and below the image of resolution r-1.
+func BandOffset(tc *TileComponent, r int, t SubbandType) (x, y int) {
+	if r == 0 {
+		return 0, 0
+	}
+	low := tc.Resolutions[r-1]
+	if t == SubbandHL || t == SubbandHH {
+		x = low.X1 - low.X0
+	}
+	if t == SubbandLH || t == SubbandHH {
+		y = low.Y1 - low.Y0
+	}
+	return x, y
+}
+
+// ApplyROIShift undoes the max-shift region-of-interest scaling signalled
+// by an RGN marker for the given component. Coefficients whose magnitude
+// reaches 2^s belong to the region of interest and are shifted back down
+// by s; background coefficients are left as decoded.
+func (d *TileDecoder) ApplyROIShift(cb *CodeBlock, component int) {
+	shift := int(d.header.ROIShifts[uint16(component)])
+	if shift == 0 {
+		return
+	}
+	threshold := int32(1) << shift
+	for i, v := range cb.Coefficients {
+		switch {
+		case v >= threshold:
+			cb.Coefficients[i] = v >> shift
+		case v <= -threshold:
+			cb.Coefficients[i] = -(-v >> shift)
+		}
+	}
+}
+
+// ApplyInverseDWT applies the inverse wavelet transform to one component,
+// using the wavelet and decomposition levels of its coding style. The 9-7
+// wavelet reads DataFloat when DecodeComponent has filled it in and Data
+// otherwise. Data is left holding the reconstructed samples; when
+// SetReduce discards resolution levels it is shortened to the samples of
+// the highest resolution level kept, whose bounds give its size.
 func (d *TileDecoder) ApplyInverseDWT(tc *TileComponent) {
-	h := d.header.CodingStyle
-	numLevels := int(h.NumDecompositions)
+	numLevels, reversible := d.componentWavelet(tc.Index)
+	numLevels = min(numLevels, len(tc.Resolutions)-1)
+	reduce := min(d.reduce, numLevels)
+	levels := numLevels - reduce
 
-	width := tc.X1 - tc.X0
-	height := tc.Y1 - tc.Y0
+	res := tc.Resolutions[levels]
+	width := res.X1 - res.X0
+	height := res.Y1 - res.Y0
+	stride := tc.X1 - tc.X0
 
-	if h.WaveletTransform == 1 {
+	if reversible {
 		// 5-3 reversible
-		dwt.ReconstructMultiLevel53(tc.Data, width, height, numLevels)
+		data := tc.Data
+		if reduce > 0 {
+			data = make([]int32, width*height)
+			for y := 0; y < height; y++ {
+				copy(data[y*width:(y+1)*width], tc.Data[y*stride:])
+			}
+		}
+		dwt.ReconstructMultiLevel53(data, res.X0, res.Y0, width, height, levels)
+		tc.Data = data
 	} else {
 		// 9-7 irreversible
-		tc.DataFloat = make([]float64, len(tc.Data))
-		for i, v := range tc.Data {
-			tc.DataFloat[i] = float64(v)
+		var data []float32
+		if d.reuse {
+			d.dwtBuffers[tc.Index] = reuseBuffer(d.dwtBuffers[tc.Index], width*height)
+			data = d.dwtBuffers[tc.Index]
+		} else {
+			data = make([]float32, width*height)
 		}
-		dwt.ReconstructMultiLevel97(tc.DataFloat, width, height, numLevels)
-		for i, v := range tc.DataFloat {
-			tc.Data[i] = int32(v + 0.5)
+		for y := 0; y < height; y++ {
+			row := data[y*width : (y+1)*width]
+			if tc.DataFloat != nil {
+				for x, v := range tc.DataFloat[y*stride : y*stride+width] {
+					row[x] = float32(v)
+				}
+			} else {
+				for x, v := range tc.Data[y*stride : y*stride+width] {
+					row[x] = float32(v)
+				}
+			}
+		}
+		dwt.ReconstructMultiLevel97F32(data, res.X0, res.Y0, width, height, levels)
+		tc.Data = tc.Data[:width*height]
+		for i, v := range data {
+			tc.Data[i] = int32(math.Floor(float64(v) + 0.5))
 		}
 	}
 }
 
+// ApplyInverseDWTTile applies the inverse DWT to every component of tile,
+// running up to GOMAXPROCS components at once. Each component has its own
+// coefficient buffers, so the goroutines share no data.
+func (d *TileDecoder) ApplyInverseDWTTile(tile *Tile) {
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for _, tc := range tile.Components {
+		if tc == nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tc *TileComponent) {
+			defer wg.Done()
+			d.ApplyInverseDWT(tc)
+			<-sem
+		}(tc)
+	}
+	wg.Wait()
+}
+
+// componentWavelet returns the number of decomposition levels of
+// component c and whether it uses the reversible 5-3 wavelet, taking a
+// COC marker over the COD defaults.
+func (d *TileDecoder) componentWavelet(c int) (numLevels int, reversible bool) {
+	return componentWavelet(d.header, c)
+}
+
+// componentWavelet returns the number of decomposition levels of
+// component c and whether it uses the reversible 5-3 wavelet.
+func componentWavelet(h *codestream.Header, c int) (numLevels int, reversible bool) {
+	style := h.ComponentCodingStyle(c)
+	return int(style.NumDecompositions), style.WaveletTransform == 1
+}
+
 // TileEncoder encodes a single tile.
 type TileEncoder struct {
 	header *codestream.Header
 	tile   *Tile
 	htj2k  bool // True if using High-Throughput mode
+
+	// Code-blocks whose SparsityRatio is below this are not coded
+	sparsityThreshold float64
 }
 
 // NewTileEncoder creates a new tile encoder.
@@ -456,72 +939,49 @@ func (e *TileEncoder) SetHTJ2K(htj2k bool) {
 	e.htj2k = htj2k
 }
 
-// InitTile initializes a tile for encoding.
-func (e *TileEncoder) InitTile(tileIndex int, componentData [][]int32) {
-	h := e.header
-
-	// Calculate tile bounds (same as decoder)
-	tileX := tileIndex % int(h.NumTilesX)
-	tileY := tileIndex / int(h.NumTilesX)
-
-	x0 := max(int(h.TileXOffset)+tileX*int(h.TileWidth), int(h.ImageXOffset))
-	y0 := max(int(h.TileYOffset)+tileY*int(h.TileHeight), int(h.ImageYOffset))
-	x1 := min(int(h.TileXOffset)+(tileX+1)*int(h.TileWidth), int(h.ImageWidth))
-	y1 := min(int(h.TileYOffset)+(tileY+1)*int(h.TileHeight), int(h.ImageHeight))
-
-	e.tile = &Tile{
-		Index:      tileIndex,
-		X0:         x0,
-		Y0:         y0,
-		X1:         x1,
-		Y1:         y1,
-		Components: make([]*TileComponent, h.NumComponents),
-	}
-
-	// Initialize components with provided data
-	for c := 0; c < int(h.NumComponents); c++ {
-		comp := h.ComponentInfo[c]
+// SetSparsityThreshold sets the SparsityRatio below which code-blocks are
+// emitted with no coding passes. Zero, the default, codes every block.
+// Skipping blocks discards their coefficients, so this is only suitable
+// for lossy coding.
+func (e *TileEncoder) SetSparsityThreshold(threshold float64) {
+	e.sparsityThreshold = threshold
+}
 
-		cx0 := ceilDiv(x0, int(comp.SubsamplingX))
-		cy0 := ceilDiv(y0, int(comp.SubsamplingY))
-		cx1 := ceilDiv(x1, int(comp.SubsamplingX))
-		cy1 := ceilDiv(y1, int(comp.SubsamplingY))
+// Tile returns the current tile being encoded.
+func (e *TileEncoder) Tile() *Tile {
+	return e.tile
+}
 
-		tc := &TileComponent{
-			Index: c,
-			X0:    cx0,
-			Y0:    cy0,
-			X1:    cx1,
-			Y1:    cy1,
-			Data:  componentData[c],
+// InitTile initializes a tile for encoding, with the samples of each
+// component taken from componentData.
+func (e *TileEncoder) InitTile(tileIndex int, componentData [][]int32) {
+	e.tile = newTile(e.header, tileIndex)
+	for c, tc := range e.tile.Components {
+		if c < len(componentData) {
+			tc.Data = componentData[c]
 		}
-
-		// Initialize resolutions (similar to decoder)
-		numRes := int(h.CodingStyle.NumDecompositions) + 1
-		tc.Resolutions = make([]*Resolution, numRes)
-
-		e.tile.Components[c] = tc
 	}
 }
 
-// ApplyForwardDWT applies the forward wavelet transform.
+// ApplyForwardDWT applies the forward wavelet transform, using the wavelet
+// and decomposition levels of the component's coding style. The 9-7
+// coefficients are kept in DataFloat and rounded into Data.
 func (e *TileEncoder) ApplyForwardDWT(tc *TileComponent) {
-	h := e.header.CodingStyle
-	numLevels := int(h.NumDecompositions)
+	numLevels, reversible := componentWavelet(e.header, tc.Index)
 
 	width := tc.X1 - tc.X0
 	height := tc.Y1 - tc.Y0
 
-	if h.WaveletTransform == 1 {
+	if reversible {
 		// 5-3 reversible
-		dwt.DecomposeMultiLevel53(tc.Data, width, height, numLevels)
+		dwt.DecomposeMultiLevel53(tc.Data, tc.X0, tc.Y0, width, height, numLevels)
 	} else {
 		// 9-7 irreversible
 		tc.DataFloat = make([]float64, len(tc.Data))
 		for i, v := range tc.Data {
 			tc.DataFloat[i] = float64(v)
 		}
-		dwt.DecomposeMultiLevel97(tc.DataFloat, width, height, numLevels)
+		dwt.DecomposeMultiLevel97(tc.DataFloat, tc.X0, tc.Y0, width, height, numLevels)
 		// Quantize back to integers
 		for i, v := range tc.DataFloat {
 			if v >= 0 {
@@ -533,22 +993,99 @@ func (e *TileEncoder) ApplyForwardDWT(tc *TileComponent) {
 	}
 }
 
+// Quantize replaces the wavelet coefficients in Data with their
+// quantization indices. The 9-7 coefficients in DataFloat are divided by
+// the step size of their band and truncated towards zero (a deadzone
+// quantizer); 5-3 coefficients are treated alike when their band has a
+// step size other than 1, and are otherwise kept as they are. Magnitudes
+// are clamped to the band's MaxBitPlanes so that every code-block fits
+// the bit depth signalled for it.
+func (e *TileEncoder) Quantize(tc *TileComponent) {
+	_, reversible := componentWavelet(e.header, tc.Index)
+	stride := tc.X1 - tc.X0
+
+	for r, res := range tc.Resolutions {
+		for _, band := range res.Bands {
+			ox, oy := BandOffset(tc, r, band.Type)
+			limit := int32(math.MaxInt32)
+			if band.MaxBitPlanes < 31 {
+				limit = int32(1)<<max(band.MaxBitPlanes, 0) - 1
+			}
+			for y := 0; y < band.Y1-band.Y0; y++ {
+				row := (oy+y)*stride + ox
+				for i := row; i < row+band.X1-band.X0; i++ {
+					q := tc.Data[i]
+					switch {
+					case !reversible && tc.DataFloat != nil:
+						q = int32(tc.DataFloat[i] / band.StepSize)
+					case reversible && band.StepSize != 1:
+						q = int32(float64(q) / band.StepSize)
+					}
+					switch {
+					case q > limit:
+						q = limit
+					case q < -limit:
+						q = -limit
+					}
+					tc.Data[i] = q
+				}
+			}
+		}
+	}
+}
+
 // EncodeCodeBlock encodes a single code-block.
-func (e *TileEncoder) EncodeCodeBlock(cb *CodeBlock, data []int32, bandType int) {
+func (e *TileEncoder) EncodeCodeBlock(cb *CodeBlock, data []int32, bandType SubbandType) {
 	width := cb.X1 - cb.X0
 	height := cb.Y1 - cb.Y0
 
+	cb.Coefficients = data
+	if e.sparsityThreshold > 0 && cb.SparsityRatio() < e.sparsityThreshold {
+		cb.Data = nil
+		cb.Passes = nil
+		return
+	}
+
 	if e.htj2k {
-		// Use HTJ2K encoder
+		// Use HTJ2K encoder; the block is a single cleanup pass
 		htEnc := entropy.GetHTEncoder(width, height)
 		htEnc.SetData(data)
-		cb.Data = htEnc.Encode(bandType)
+		cb.Data = htEnc.Encode(int(bandType))
 		entropy.PutHTEncoder(htEnc)
+		cb.Passes = nil
+		cb.TotalBitPlanes = 0
+		if len(cb.Data) > 0 {
+			for _, v := range data {
+				if v < 0 {
+					v = -v
+				}
+				cb.TotalBitPlanes = max(cb.TotalBitPlanes, bits.Len32(uint32(v)))
+			}
+			cb.Passes = []CodingPass{{Type: PassCleanup, Length: len(cb.Data), CumulativeLength: len(cb.Data)}}
+		}
 	} else {
-		// Use standard EBCOT encoder
+		// Use standard EBCOT encoder, recording per-pass rate and
+		// distortion for rate allocation
 		t1 := entropy.NewT1(width, height)
+		t1.SetStyle(cb.Style)
 		t1.SetData(data)
-		cb.Data = t1.Encode(bandType)
+		var passes []entropy.PassInfo
+		cb.Data, passes = t1.EncodeWithPasses(int(bandType))
+
+		cb.Passes = make([]CodingPass, len(passes))
+		prev := 0
+		for i, p := range passes {
+			cb.Passes[i] = CodingPass{
+				Type:             p.Type,
+				Length:           p.CumulativeLength - prev,
+				CumulativeLength: p.CumulativeLength,
+				Distortion:       p.Distortion,
+				Terminated:       entropy.IsTerminatedPass(i, cb.Style) || i == len(passes)-1,
+			}
+			prev = p.CumulativeLength
+		}
+		cb.TotalBitPlanes = (len(passes) + 2) / 3
+		ComputeSlopes(cb)
 	}
 }
 
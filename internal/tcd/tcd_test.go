@@ -1,9 +1,12 @@
 package tcd
 
 import (
+	"math"
+	"reflect"
 	"testing"
 
 	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+	"github.com/mrjoshuak/go-jpeg2000/internal/dwt"
 	"github.com/mrjoshuak/go-jpeg2000/internal/entropy"
 )
 
@@ -77,100 +80,6 @@ func TestMax(t *testing.T) {
 	}
 }
 
-// TestNewTagTree tests TagTree creation.
-func TestNewTagTree(t *testing.T) {
-	tests := []struct {
-		width, height int
-		expectLevels  int
-	}{
-		{1, 1, 1},   // Single node, 1 level
-		{2, 2, 2},   // 2x2, needs 2 levels (4->1)
-		{4, 4, 3},   // 4x4, needs 3 levels (16->4->1)
-		{8, 8, 4},   // 8x8, needs 4 levels
-		{3, 3, 3},   // 3x3, needs 3 levels (9->4->1)
-		{5, 7, 4},   // 5x7, needs 4 levels
-		{16, 16, 5}, // 16x16, needs 5 levels
-	}
-
-	for _, tt := range tests {
-		tree := NewTagTree(tt.width, tt.height)
-		if tree == nil {
-			t.Errorf("NewTagTree(%d, %d) returned nil", tt.width, tt.height)
-			continue
-		}
-		if tree.width != tt.width {
-			t.Errorf("NewTagTree(%d, %d).width = %d; want %d", tt.width, tt.height, tree.width, tt.width)
-		}
-		if tree.height != tt.height {
-			t.Errorf("NewTagTree(%d, %d).height = %d; want %d", tt.width, tt.height, tree.height, tt.height)
-		}
-		if tree.levels != tt.expectLevels {
-			t.Errorf("NewTagTree(%d, %d).levels = %d; want %d", tt.width, tt.height, tree.levels, tt.expectLevels)
-		}
-		// Verify nodes are allocated
-		if len(tree.nodes) != tt.expectLevels {
-			t.Errorf("NewTagTree(%d, %d) has %d node levels; want %d", tt.width, tt.height, len(tree.nodes), tt.expectLevels)
-		}
-	}
-}
-
-// TestTagTreeSetValue tests setting values in the tag tree.
-func TestTagTreeSetValue(t *testing.T) {
-	tree := NewTagTree(4, 4)
-
-	// Set some values
-	tree.SetValue(0, 0, 5)
-	tree.SetValue(1, 0, 3)
-	tree.SetValue(0, 1, 7)
-	tree.SetValue(3, 3, 2)
-
-	// Verify values are set correctly
-	if tree.nodes[0][0].value != 5 {
-		t.Errorf("SetValue(0, 0, 5) failed; got %d", tree.nodes[0][0].value)
-	}
-	if tree.nodes[0][1].value != 3 {
-		t.Errorf("SetValue(1, 0, 3) failed; got %d", tree.nodes[0][1].value)
-	}
-	if tree.nodes[0][4].value != 7 { // y=1 means index=4 for width=4
-		t.Errorf("SetValue(0, 1, 7) failed; got %d", tree.nodes[0][4].value)
-	}
-	if tree.nodes[0][15].value != 2 { // x=3, y=3 means index=15
-		t.Errorf("SetValue(3, 3, 2) failed; got %d", tree.nodes[0][15].value)
-	}
-}
-
-// TestTagTreeReset tests resetting the tag tree state.
-func TestTagTreeReset(t *testing.T) {
-	tree := NewTagTree(4, 4)
-
-	// Set some values and states
-	tree.SetValue(0, 0, 5)
-	tree.SetValue(1, 0, 3)
-
-	// Manually set some state
-	tree.nodes[0][0].low = 2
-	tree.nodes[0][0].known = true
-	tree.nodes[1][0].low = 1
-	tree.nodes[1][0].known = true
-
-	// Reset
-	tree.Reset()
-
-	// Verify values are preserved but state is reset
-	if tree.nodes[0][0].value != 5 {
-		t.Errorf("Reset cleared value; got %d, want 5", tree.nodes[0][0].value)
-	}
-	if tree.nodes[0][0].low != 0 {
-		t.Errorf("Reset didn't clear low; got %d, want 0", tree.nodes[0][0].low)
-	}
-	if tree.nodes[0][0].known != false {
-		t.Errorf("Reset didn't clear known; got %v, want false", tree.nodes[0][0].known)
-	}
-	if tree.nodes[1][0].low != 0 {
-		t.Errorf("Reset didn't clear level 1 low; got %d, want 0", tree.nodes[1][0].low)
-	}
-}
-
 // createTestHeader creates a minimal header for testing.
 func createTestHeader() *codestream.Header {
 	return &codestream.Header{
@@ -443,12 +352,22 @@ func TestApplyInverseDWT97(t *testing.T) {
 		comp.Data[i] = int32(i % 256)
 	}
 
+	width := comp.X1 - comp.X0
+	height := comp.Y1 - comp.Y0
+	want := make([]float64, len(comp.Data))
+	for i, v := range comp.Data {
+		want[i] = float64(v)
+	}
+	dwt.ReconstructMultiLevel97(want, 0, 0, width, height, 1)
+
 	// Apply inverse DWT
 	decoder.ApplyInverseDWT(comp)
 
-	// Verify DataFloat was created for 9-7
-	if comp.DataFloat == nil {
-		t.Error("ApplyInverseDWT with 9-7 didn't create DataFloat")
+	// The float32 decoder path must agree with the float64 reference
+	for i, v := range comp.Data {
+		if d := v - int32(want[i]+0.5); d < -1 || d > 1 {
+			t.Fatalf("sample %d = %d, want %d", i, v, int32(want[i]+0.5))
+		}
 	}
 }
 
@@ -553,6 +472,68 @@ func TestApplyForwardDWT97(t *testing.T) {
 	}
 }
 
+// TestDWTOddTileOrigin checks that the wavelet of a tile starting at an
+// odd position lays its bands out where the tile-component's resolution
+// levels put them, and that the inverse undoes it.
+func TestDWTOddTileOrigin(t *testing.T) {
+	for _, wavelet := range []uint8{1, 0} {
+		header := createTestHeader()
+		header.ImageWidth, header.ImageHeight = 30, 30
+		header.TileWidth, header.TileHeight = 15, 15
+		header.NumTilesX, header.NumTilesY = 2, 2
+		header.CodingStyle.NumDecompositions = 1
+		header.CodingStyle.WaveletTransform = wavelet
+
+		// Columns at even reference grid positions are 100, the rest 0.
+		// The tile starts at x=15, so its first column is a high-pass one.
+		original := make([]int32, 15*15)
+		for i := range original {
+			if (15+i%15)%2 == 0 {
+				original[i] = 100
+			}
+		}
+		encoder := NewTileEncoder(header)
+		encoder.InitTile(3, [][]int32{append([]int32(nil), original...)})
+		tc := encoder.tile.Components[0]
+		if tc.X0 != 15 || tc.Y0 != 15 {
+			t.Fatalf("tile 3 origin = (%d,%d); want (15,15)", tc.X0, tc.Y0)
+		}
+		encoder.ApplyForwardDWT(tc)
+
+		// Each row lifts to high-pass 0-floor((100+100)/2) = -100 and
+		// low-pass 100+floor((-100-100+2)/4) = 50; the columns are
+		// constant, so LH and HH are zero.
+		if wavelet == 1 {
+			want := map[SubbandType]int32{SubbandLL: 50, SubbandHL: -100}
+			for r, res := range tc.Resolutions {
+				for _, band := range res.Bands {
+					ox, oy := BandOffset(tc, r, band.Type)
+					for y := oy; y < oy+band.Y1-band.Y0; y++ {
+						for x := ox; x < ox+band.X1-band.X0; x++ {
+							if v := tc.Data[y*15+x]; v != want[band.Type] {
+								t.Fatalf("%v band of resolution %d has %d at (%d,%d); want %d",
+									band.Type, r, v, x, y, want[band.Type])
+							}
+						}
+					}
+				}
+			}
+		}
+
+		decoder := NewTileDecoder(header)
+		decoder.InitTile(3)
+		out := decoder.Tile().Components[0]
+		out.Data = tc.Data
+		out.DataFloat = tc.DataFloat
+		decoder.ApplyInverseDWT(out)
+		for i, v := range out.Data {
+			if v != original[i] {
+				t.Fatalf("wavelet %d: sample %d = %d after inverse; want %d", wavelet, i, v, original[i])
+			}
+		}
+	}
+}
+
 // TestEncodeCodeBlock tests encoding a code block.
 func TestEncodeCodeBlock(t *testing.T) {
 	header := createTestHeader()
@@ -614,6 +595,75 @@ func TestBandTypes(t *testing.T) {
 	}
 }
 
+// TestIntraTileOrder tests subband enumeration order and geometry.
+func TestIntraTileOrder(t *testing.T) {
+	for _, numDecomp := range []int{0, 1, 2, 5} {
+		header := createTestHeader()
+		header.ImageWidth = 37
+		header.ImageHeight = 23
+		header.TileWidth = 37
+		header.TileHeight = 23
+		header.CodingStyle.NumDecompositions = uint8(numDecomp)
+
+		decoder := NewTileDecoder(header)
+		decoder.InitTile(0)
+
+		order := decoder.Tile().IntraTileOrder(0)
+		if len(order) != 1+3*numDecomp {
+			t.Fatalf("numDecomp=%d: got %d subbands; want %d", numDecomp, len(order), 1+3*numDecomp)
+		}
+
+		// LL must come first, at resolution 0
+		if order[0].Type != SubbandLL || order[0].ResolutionLevel != 0 {
+			t.Errorf("numDecomp=%d: first subband = %+v; want LL at resolution 0", numDecomp, order[0])
+		}
+
+		expected := []SubbandType{SubbandHL, SubbandLH, SubbandHH}
+		area := order[0].W * order[0].H
+		for i, sb := range order[1:] {
+			if sb.Type != expected[i%3] {
+				t.Errorf("numDecomp=%d: subband %d type = %v; want %v", numDecomp, i+1, sb.Type, expected[i%3])
+			}
+			if sb.ResolutionLevel != i/3+1 {
+				t.Errorf("numDecomp=%d: subband %d resolution = %d; want %d", numDecomp, i+1, sb.ResolutionLevel, i/3+1)
+			}
+			area += sb.W * sb.H
+		}
+
+		// Subbands must exactly tile the coefficient buffer
+		if area != 37*23 {
+			t.Errorf("numDecomp=%d: total subband area = %d; want %d", numDecomp, area, 37*23)
+		}
+	}
+
+	// The tile at (37, 23) starts at an odd column and row, so its first
+	// decomposition keeps floor(37/2) low-pass columns and 11 rows
+	header := createTestHeader()
+	header.ImageWidth, header.ImageHeight = 74, 46
+	header.TileWidth, header.TileHeight = 37, 23
+	header.NumTilesX, header.NumTilesY = 2, 2
+	header.CodingStyle.NumDecompositions = 1
+	decoder := NewTileDecoder(header)
+	decoder.InitTile(3)
+	order := decoder.Tile().IntraTileOrder(0)
+	want := []SubbandInfo{
+		{Type: SubbandLL, ResolutionLevel: 0, W: 18, H: 11},
+		{Type: SubbandHL, ResolutionLevel: 1, W: 19, H: 11, OffsetX: 18},
+		{Type: SubbandLH, ResolutionLevel: 1, W: 18, H: 12, OffsetY: 11},
+		{Type: SubbandHH, ResolutionLevel: 1, W: 19, H: 12, OffsetX: 18, OffsetY: 11},
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("odd origin: IntraTileOrder(0) = %+v; want %+v", order, want)
+	}
+
+	// Out of range component
+	decoder = NewTileDecoder(createTestHeader())
+	decoder.InitTile(0)
+	if order := decoder.Tile().IntraTileOrder(1); order != nil {
+		t.Errorf("IntraTileOrder(1) = %v; want nil", order)
+	}
+}
+
 // TestCodeBlockGridCalculation tests code block grid setup.
 func TestCodeBlockGridCalculation(t *testing.T) {
 	header := createTestHeader()
@@ -716,33 +766,6 @@ func TestCodingPassStructure(t *testing.T) {
 	}
 }
 
-// TestTagTreeEdgeCases tests edge cases for tag trees.
-func TestTagTreeEdgeCases(t *testing.T) {
-	// Very small tree
-	tree1x1 := NewTagTree(1, 1)
-	if tree1x1.levels != 1 {
-		t.Errorf("1x1 tree has %d levels; want 1", tree1x1.levels)
-	}
-	tree1x1.SetValue(0, 0, 42)
-	if tree1x1.nodes[0][0].value != 42 {
-		t.Errorf("1x1 tree SetValue failed")
-	}
-	tree1x1.Reset()
-	if tree1x1.nodes[0][0].value != 42 {
-		t.Error("Reset shouldn't clear values")
-	}
-
-	// Asymmetric tree
-	tree2x4 := NewTagTree(2, 4)
-	if tree2x4.width != 2 || tree2x4.height != 4 {
-		t.Errorf("2x4 tree has wrong dimensions")
-	}
-	tree2x4.SetValue(0, 3, 99)
-	if tree2x4.nodes[0][6].value != 99 { // index = 3*2 + 0 = 6
-		t.Errorf("2x4 tree SetValue at (0,3) failed")
-	}
-}
-
 // TestDecodeMultipleCodeBlocks tests decoding multiple code blocks sequentially.
 func TestDecodeMultipleCodeBlocks(t *testing.T) {
 	header := createTestHeader()
@@ -764,36 +787,6 @@ func TestDecodeMultipleCodeBlocks(t *testing.T) {
 	}
 }
 
-// BenchmarkNewTagTree benchmarks tag tree creation.
-func BenchmarkNewTagTree(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		NewTagTree(64, 64)
-	}
-}
-
-// BenchmarkTagTreeSetValue benchmarks setting values in tag tree.
-func BenchmarkTagTreeSetValue(b *testing.B) {
-	tree := NewTagTree(64, 64)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		tree.SetValue(i%64, i%64, i)
-	}
-}
-
-// BenchmarkTagTreeReset benchmarks resetting tag tree.
-func BenchmarkTagTreeReset(b *testing.B) {
-	tree := NewTagTree(64, 64)
-	for x := 0; x < 64; x++ {
-		for y := 0; y < 64; y++ {
-			tree.SetValue(x, y, x+y)
-		}
-	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		tree.Reset()
-	}
-}
-
 // BenchmarkTileDecoderInitTile benchmarks tile initialization.
 func BenchmarkTileDecoderInitTile(b *testing.B) {
 	header := createTestHeader()
@@ -823,3 +816,272 @@ func BenchmarkApplyInverseDWT53(b *testing.B) {
 		decoder.ApplyInverseDWT(comp)
 	}
 }
+
+// TestBandCodeBlockIndices tests code-block lookup by area on a band
+// whose origin is not aligned to the code-block grid.
+func TestBandCodeBlockIndices(t *testing.T) {
+	// 16x16 code-blocks; the band starts in the second grid column, so
+	// its 4x3 code-blocks cover grid columns 1-4 and rows 0-2
+	band := &Band{X0: 20, Y0: 5, X1: 70, Y1: 40, CodeBlocksX: 4, CodeBlocksY: 3, xcb: 4, ycb: 4}
+
+	tests := []struct {
+		name           string
+		x0, y0, x1, y1 int
+		expected       []int
+	}{
+		{"whole band", 0, 0, 128, 128, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"single code-block", 32, 16, 48, 32, []int{5}},
+		{"clipped to band", 0, 0, 50, 10, []int{0, 1, 2}},
+		{"grid cell before band", 0, 0, 16, 40, nil},
+		{"outside band", 80, 0, 128, 40, nil},
+	}
+
+	for _, tt := range tests {
+		got := band.CodeBlockIndices(tt.x0, tt.y0, tt.x1, tt.y1)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: CodeBlockIndices() = %v; want %v", tt.name, got, tt.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("%s: CodeBlockIndices() = %v; want %v", tt.name, got, tt.expected)
+				break
+			}
+		}
+	}
+}
+
+// TestPrecinctCodeBlocks tests that the precincts of each resolution
+// level hold every code-block of its bands exactly once, for a tile whose
+// origin is not aligned to the precinct or code-block grids.
+func TestPrecinctCodeBlocks(t *testing.T) {
+	header := createTestHeader()
+	header.ImageXOffset = 10
+	header.ImageYOffset = 6
+	header.ImageWidth = 110
+	header.ImageHeight = 90
+	header.TileWidth = 110
+	header.TileHeight = 90
+	header.CodingStyle.CodingStyle = codestream.CodingStylePrecincts
+	header.CodingStyle.PrecinctSizes = []codestream.PrecinctSize{
+		{WidthExp: 4, HeightExp: 4}, {WidthExp: 5, HeightExp: 5}, {WidthExp: 5, HeightExp: 5},
+	}
+
+	decoder := NewTileDecoder(header)
+	decoder.InitTile(0)
+
+	for r, res := range decoder.Tile().Components[0].Resolutions {
+		for b, band := range res.Bands {
+			seen := make(map[*CodeBlock]int)
+			for _, prec := range res.Precincts {
+				cbs := prec.CodeBlocks[b]
+				if tree := prec.InclusionTrees[b]; tree != nil && tree.Width()*tree.Height() != len(cbs) {
+					t.Errorf("res %d band %d precinct %d: tag tree %dx%d for %d code-blocks",
+						r, b, prec.Index, tree.Width(), tree.Height(), len(cbs))
+				}
+				for _, cb := range cbs {
+					seen[cb]++
+				}
+			}
+			for i, cb := range band.CodeBlocks {
+				if seen[cb] != 1 {
+					t.Errorf("res %d band %d: code-block %d in %d precincts; want 1", r, b, i, seen[cb])
+				}
+			}
+			if len(seen) != len(band.CodeBlocks) {
+				t.Errorf("res %d band %d: precincts hold %d code-blocks; band has %d",
+					r, b, len(seen), len(band.CodeBlocks))
+			}
+		}
+	}
+}
+
+// TestSubbandTypeString tests subband type names.
+func TestSubbandTypeString(t *testing.T) {
+	tests := []struct {
+		band SubbandType
+		want string
+	}{
+		{SubbandLL, "LL"},
+		{SubbandHL, "HL"},
+		{SubbandLH, "LH"},
+		{SubbandHH, "HH"},
+		{SubbandType(7), "SubbandType(7)"},
+	}
+	for _, tt := range tests {
+		if got := tt.band.String(); got != tt.want {
+			t.Errorf("SubbandType(%d).String() = %q; want %q", int(tt.band), got, tt.want)
+		}
+	}
+}
+
+// TestSubbandTypeOrder tests that subband types follow the band order of
+// ISO/IEC 15444-1 §B.5 and match the entropy coder constants.
+func TestSubbandTypeOrder(t *testing.T) {
+	if SubbandLL != entropy.BandLL || SubbandHL != entropy.BandHL ||
+		SubbandLH != entropy.BandLH || SubbandHH != entropy.BandHH {
+		t.Error("subband constants do not match entropy band constants")
+	}
+
+	header := createTestHeader()
+	decoder := NewTileDecoder(header)
+	decoder.InitTile(0)
+	comp := decoder.Tile().Components[0]
+
+	for r, res := range comp.Resolutions {
+		precinct := &Precinct{CodeBlocks: make([][]*CodeBlock, len(res.Bands))}
+		for i, band := range res.Bands {
+			if got := precinct.BandType(i); got != band.Type {
+				t.Errorf("resolution %d: BandType(%d) = %v; want %v", r, i, got, band.Type)
+			}
+		}
+	}
+}
+
+// TestCodeBlockSparsity tests significant sample counting.
+func TestCodeBlockSparsity(t *testing.T) {
+	tests := []struct {
+		name      string
+		cb        *CodeBlock
+		wantCount int
+		wantRatio float64
+	}{
+		{"empty", &CodeBlock{}, 0, 0},
+		{"all zero", &CodeBlock{X1: 4, Y1: 4, Coefficients: make([]int32, 16)}, 0, 0},
+		{"quarter", &CodeBlock{X1: 4, Y1: 2, Coefficients: []int32{1, 0, 0, 0, 0, -3, 0, 0}}, 2, 0.25},
+		{"dense", &CodeBlock{X0: 2, Y0: 2, X1: 4, Y1: 4, Coefficients: []int32{5, -1, 2, 7}}, 4, 1},
+		// Only the spatial extent is counted
+		{"extra coefficients", &CodeBlock{X1: 2, Y1: 1, Coefficients: []int32{0, 1, 1, 1}}, 1, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cb.NumSignificantSamples(); got != tt.wantCount {
+				t.Errorf("NumSignificantSamples() = %d; want %d", got, tt.wantCount)
+			}
+			if got := tt.cb.SparsityRatio(); got != tt.wantRatio {
+				t.Errorf("SparsityRatio() = %v; want %v", got, tt.wantRatio)
+			}
+		})
+	}
+}
+
+// TestEncodeCodeBlockSparsityThreshold tests that sparse blocks are skipped.
+func TestEncodeCodeBlockSparsityThreshold(t *testing.T) {
+	sparse := make([]int32, 16*16)
+	sparse[0] = 100
+	sparse[200] = -50
+
+	enc := NewTileEncoder(createTestHeader())
+
+	cb := &CodeBlock{X1: 16, Y1: 16}
+	enc.EncodeCodeBlock(cb, sparse, SubbandHL)
+	if len(cb.Data) == 0 {
+		t.Fatal("block with default threshold was not coded")
+	}
+
+	enc.SetSparsityThreshold(0.05)
+	cb = &CodeBlock{X1: 16, Y1: 16}
+	enc.EncodeCodeBlock(cb, sparse, SubbandHL)
+	if len(cb.Data) != 0 || len(cb.Passes) != 0 {
+		t.Errorf("sparse block coded with %d bytes, %d passes; want none", len(cb.Data), len(cb.Passes))
+	}
+}
+
+func benchmarkEncodeCodeBlock(b *testing.B, data []int32, threshold float64) {
+	enc := NewTileEncoder(createTestHeader())
+	enc.SetSparsityThreshold(threshold)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cb := &CodeBlock{X1: 64, Y1: 64}
+		enc.EncodeCodeBlock(cb, data, SubbandHH)
+	}
+}
+
+func BenchmarkEncodeCodeBlock_AllZero(b *testing.B) {
+	benchmarkEncodeCodeBlock(b, make([]int32, 64*64), 0)
+}
+
+func BenchmarkEncodeCodeBlock_AllZeroSkipped(b *testing.B) {
+	benchmarkEncodeCodeBlock(b, make([]int32, 64*64), 0.01)
+}
+
+func BenchmarkEncodeCodeBlock_Dense(b *testing.B) {
+	data := make([]int32, 64*64)
+	for i := range data {
+		data[i] = int32(i%61) - 30
+		if data[i] == 0 {
+			data[i] = 1
+		}
+	}
+	benchmarkEncodeCodeBlock(b, data, 0.01)
+}
+
+func TestApplyROIShift(t *testing.T) {
+	header := createTestHeader()
+	header.ROIShifts = map[uint16]uint8{1: 4}
+	decoder := NewTileDecoder(header)
+
+	coeffs := []int32{0, 5, -15, 16, -16, 40, -200}
+	cb := &CodeBlock{Coefficients: append([]int32(nil), coeffs...)}
+	decoder.ApplyROIShift(cb, 0)
+	for i, v := range cb.Coefficients {
+		if v != coeffs[i] {
+			t.Fatalf("component without ROI: coefficient %d = %d, want %d", i, v, coeffs[i])
+		}
+	}
+
+	// Background coefficients stay; ROI coefficients lose the 2^4 scaling
+	want := []int32{0, 5, -15, 1, -1, 2, -12}
+	decoder.ApplyROIShift(cb, 1)
+	for i, v := range cb.Coefficients {
+		if v != want[i] {
+			t.Errorf("coefficient %d = %d, want %d", i, v, want[i])
+		}
+	}
+}
+
+func TestApplyInverseDWTTile(t *testing.T) {
+	// Three components: COD selects the 9-7 wavelet with 2 levels and a
+	// COC gives component 1 the 5-3 wavelet with 3 levels
+	header := createTestHeader()
+	header.NumComponents = 3
+	header.ComponentInfo = append(header.ComponentInfo, header.ComponentInfo[0], header.ComponentInfo[0])
+	header.CodingStyle.WaveletTransform = 0
+	header.ComponentCodingStyles = map[uint16]codestream.CodingStyleComponent{
+		1: {ComponentIndex: 1, NumDecompositions: 3, WaveletTransform: 1},
+	}
+	decoder := NewTileDecoder(header)
+	decoder.InitTile(0)
+	tile := decoder.Tile()
+
+	for c, tc := range tile.Components {
+		for i := range tc.Data {
+			tc.Data[i] = int32((i*7+c*13)%61 - 30)
+		}
+	}
+	want := make([][]int32, len(tile.Components))
+	for c, tc := range tile.Components {
+		want[c] = append([]int32(nil), tc.Data...)
+	}
+	dwt.ReconstructMultiLevel53(want[1], 0, 0, 64, 64, 3)
+	for _, c := range []int{0, 2} {
+		f := make([]float64, len(want[c]))
+		for i, v := range want[c] {
+			f[i] = float64(v)
+		}
+		dwt.ReconstructMultiLevel97(f, 0, 0, 64, 64, 2)
+		for i, v := range f {
+			want[c][i] = int32(math.Floor(v + 0.5))
+		}
+	}
+
+	decoder.ApplyInverseDWTTile(tile)
+	for c, tc := range tile.Components {
+		for i, v := range tc.Data {
+			if v != want[c][i] {
+				t.Errorf("component %d: sample %d = %d, want %d", c, i, v, want[c][i])
+				break
+			}
+		}
+	}
+}
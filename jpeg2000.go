@@ -22,8 +22,14 @@
 package jpeg2000
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"strconv"
 )
 
 // Format constants for JPEG 2000 file formats.
@@ -32,7 +38,9 @@ const (
 	FormatJ2K Format = iota
 	// FormatJP2 is the standard JP2 file format with metadata boxes.
 	FormatJP2
-	// FormatJPX is the extended JP2 format (Part 2).
+	// FormatJPX is the extended JP2 format (Part 2). Encode writes a
+	// single Part 1 codestream in a JPX file that JP2 readers can also
+	// read; Decode reads such files like JP2 ones.
 	FormatJPX
 )
 
@@ -79,11 +87,137 @@ const (
 	ProfileIMF4K Profile = 0x0500
 	// ProfileIMF8K is 8K Interoperable Master Format profile.
 	ProfileIMF8K Profile = 0x0600
+	// ProfileIMF2KR is the reversible 2K Interoperable Master Format
+	// profile.
+	ProfileIMF2KR Profile = 0x0700
+	// ProfileIMF4KR is the reversible 4K Interoperable Master Format
+	// profile.
+	ProfileIMF4KR Profile = 0x0800
+	// ProfileIMF8KR is the reversible 8K Interoperable Master Format
+	// profile.
+	ProfileIMF8KR Profile = 0x0900
 )
 
+// IMFProfile returns the IMF profile base, one of ProfileIMF2K to
+// ProfileIMF8KR, with the given main level (0-11) and sublevel (0-9) in
+// its low byte. Level 0 leaves the sample rate or bit rate unspecified.
+func IMFProfile(base Profile, mainLevel, subLevel int) Profile {
+	return base&0xFF00 | Profile(subLevel&0xF)<<4 | Profile(mainLevel&0xF)
+}
+
 // Profile represents a JPEG 2000 profile (RSIZ parameter).
 type Profile uint16
 
+// isCinema reports whether p is one of the non-scalable Digital Cinema
+// profiles that carry DCI timing metadata.
+func (p Profile) isCinema() bool {
+	return p == ProfileCinema2K || p == ProfileCinema4K
+}
+
+// isIMF reports whether p is one of the Interoperable Master Format
+// profiles, at any level.
+func (p Profile) isIMF() bool {
+	return p&0xFF00 >= ProfileIMF2K && p&0xFF00 <= ProfileIMF8KR
+}
+
+// imfReversible reports whether the IMF profile p requires the 5-3
+// reversible wavelet rather than the 9-7 irreversible one.
+func (p Profile) imfReversible() bool {
+	return p&0xFF00 >= ProfileIMF2KR
+}
+
+// imfLevels returns the main level and sublevel of the IMF profile p.
+func (p Profile) imfLevels() (mainLevel, subLevel int) {
+	return int(p & 0xF), int(p >> 4 & 0xF)
+}
+
+// Rational is a fraction Num/Den, such as a frame rate.
+type Rational struct {
+	Num, Den int
+}
+
+// String returns r in "Num/Den" form.
+func (r Rational) String() string {
+	return strconv.Itoa(r.Num) + "/" + strconv.Itoa(r.Den)
+}
+
+// OptionsConstraints describes the encoding limits a profile imposes.
+// A zero numeric limit or a nil AllowedProgressionOrders means the profile
+// does not restrict that parameter.
+type OptionsConstraints struct {
+	// MaxWidth and MaxHeight bound the image dimensions.
+	MaxWidth, MaxHeight int
+
+	// MaxTileWidth and MaxTileHeight bound the tile dimensions.
+	MaxTileWidth, MaxTileHeight int
+
+	// MaxCodeBlockArea bounds the code-block width times height.
+	MaxCodeBlockArea int
+
+	// MaxDecompositions bounds the number of wavelet decomposition levels
+	// (NumResolutions - 1).
+	MaxDecompositions int
+
+	// AllowedProgressionOrders lists the permitted progression orders.
+	AllowedProgressionOrders []ProgressionOrder
+
+	// MaxBitDepth bounds the component precision.
+	MaxBitDepth int
+}
+
+// Constraints returns the encoding limits of the profile, as given in
+// ISO/IEC 15444-1 Annex A.10. Profiles without tabulated limits here,
+// including ProfileNone, return the zero value (no limits).
+func (p Profile) Constraints() OptionsConstraints {
+	switch {
+	case p == ProfileCinema2K:
+		return OptionsConstraints{
+			MaxWidth:                 2048,
+			MaxHeight:                1080,
+			MaxTileWidth:             2048,
+			MaxTileHeight:            1080,
+			MaxCodeBlockArea:         32 * 32,
+			MaxDecompositions:        5,
+			AllowedProgressionOrders: []ProgressionOrder{CPRL},
+			MaxBitDepth:              12,
+		}
+	case p == ProfileCinema4K:
+		return OptionsConstraints{
+			MaxWidth:                 4096,
+			MaxHeight:                2160,
+			MaxTileWidth:             4096,
+			MaxTileHeight:            2160,
+			MaxCodeBlockArea:         32 * 32,
+			MaxDecompositions:        6,
+			AllowedProgressionOrders: []ProgressionOrder{CPRL},
+			MaxBitDepth:              12,
+		}
+	case p.isIMF():
+		// 0 for 2K, 1 for 4K and 2 for 8K, with or without the R
+		size := int(p>>8-4) % 3
+		scale := 1 << size
+		return OptionsConstraints{
+			MaxWidth:          2048 * scale,
+			MaxHeight:         1556 * scale,
+			MaxTileWidth:      2048 * scale,
+			MaxTileHeight:     1556 * scale,
+			MaxCodeBlockArea:  64 * 64,
+			MaxDecompositions: 5 + size,
+			MaxBitDepth:       16,
+		}
+	case p&0xFF00 == ProfileBroadcastSingle:
+		// The low byte carries the main level, which bounds the sample
+		// rate rather than the dimensions.
+		return OptionsConstraints{
+			MaxCodeBlockArea:         64 * 64,
+			MaxDecompositions:        5,
+			AllowedProgressionOrders: []ProgressionOrder{CPRL},
+			MaxBitDepth:              12,
+		}
+	}
+	return OptionsConstraints{}
+}
+
 // ProgressionOrder defines the order in which packets are encoded/decoded.
 type ProgressionOrder int
 
@@ -118,6 +252,19 @@ func (p ProgressionOrder) String() string {
 	}
 }
 
+// ProgressionOrderChange switches the progression order for part of a
+// tile's packets, as an entry of a POC marker segment does. The changes
+// of Options.ProgressionOrderChanges apply in turn, each covering the
+// packets of layers [0, LayerEnd), resolution levels [ResolutionStart,
+// ResolutionEnd) and components [ComponentStart, ComponentEnd) that an
+// earlier change has not.
+type ProgressionOrderChange struct {
+	ResolutionStart, ResolutionEnd int
+	ComponentStart, ComponentEnd   int
+	LayerEnd                       int
+	ProgressionOrder               ProgressionOrder
+}
+
 // ColorSpace represents the color space of an image.
 // Values 0-5 match the OpenJPEG OPJ_COLOR_SPACE enum for compatibility.
 // Additional colorspaces from ISO/IEC 15444-1 are assigned values 6+.
@@ -199,16 +346,96 @@ const (
 
 // Config holds the decoding configuration.
 type Config struct {
-	// DecodeArea specifies a region to decode (nil for full image).
+	// DecodeArea specifies a region to decode (nil for full image), in
+	// the full-resolution coordinates of the image returned by Decode.
+	// It is clamped to the image bounds; only the tiles it overlaps are
+	// decoded and the returned image covers exactly the clamped area.
 	DecodeArea *image.Rectangle
 
 	// ReduceResolution specifies the number of resolution levels to skip.
-	// 0 means full resolution, 1 means half resolution, etc.
+	// 0 means full resolution, 1 means half resolution, etc.; each
+	// dimension becomes ceil(dim / 2^ReduceResolution). It may not exceed
+	// the number of decomposition levels of any component.
 	ReduceResolution int
 
 	// QualityLayers specifies the number of quality layers to decode.
-	// 0 means all layers.
+	// 0 means all layers; values above the number of layers in the
+	// codestream are treated as 0. Image dimensions do not depend on it.
 	QualityLayers int
+
+	// MaxWorkers bounds the number of tiles decoded concurrently. 0 means
+	// runtime.GOMAXPROCS(0).
+	MaxWorkers int
+
+	// LuminanceOnly decodes only the first component of a colour image
+	// whose first component is luminance, because a multiple component
+	// transform was applied or the colour space is a YCbCr-family one,
+	// and returns it as a grayscale image. The other components are not
+	// entropy decoded or inverse transformed. It is ignored for other
+	// images.
+	LuminanceOnly bool
+
+	// TileCache optionally caches decoded tiles across Decode calls.
+	// Tiles are keyed by tile index, quality layers and resolution
+	// reduction, so a cache must only be shared between decodes of the
+	// same file. Unless MaxWorkers is 1 it is called from several
+	// goroutines at once.
+	TileCache TileCache
+
+	// ComputeLayerBoundaries makes DecodeMetadataConfig fill
+	// Metadata.LayerBoundaries. Packets are located from PLT or SOP
+	// markers; codestreams with neither return an error.
+	ComputeLayerBoundaries bool
+
+	// OutputModel, if set, selects the type of the decoded image instead
+	// of the component count and precision: color.GrayModel,
+	// Gray16Model, RGBAModel, RGBA64Model, NRGBAModel or NRGBA64Model.
+	// Samples are scaled to 16 bits and converted: color images to gray
+	// by luma, dropping any alpha, gray to RGB by replication, with an
+	// opaque alpha where the image has none, and to 8 bits by discarding
+	// the low byte. Other models are rejected with an
+	// UnsupportedFeatureError.
+	OutputModel color.Model
+
+	// ErrorResilient recovers from damaged packets instead of stopping
+	// at the first one. In tiles that use SOP markers, a packet that
+	// cannot be parsed or that does not end at the next SOP marker is
+	// discarded, decoding resumes at the following SOP marker, and the
+	// precinct it belonged to keeps the data of its earlier packets.
+	// Code-blocks whose headers are inconsistent are left empty instead
+	// of failing the decode. CollectStats reports how many were
+	// recovered. A codestream cut short decodes from the packets present
+	// rather than failing with ErrTruncated.
+	ErrorResilient bool
+
+	// CollectStats, when non-nil, is filled with statistics about the
+	// decode.
+	CollectStats *DecodeStats
+
+	// Debug, if set, receives a trace of the packets decoded from each
+	// tile as JSON lines, one per packet, in tile order once the tiles
+	// are decoded. Each line counts the code-blocks the packet includes
+	// and the codestream bytes it takes; a packet that fails to decode
+	// has an "error" field. Tiles taken from TileCache are not traced.
+	Debug io.Writer
+}
+
+// DecodeStats reports on a decode, for Config.CollectStats.
+type DecodeStats struct {
+	// RecoveredErrors is the number of damaged packets and code-blocks
+	// that an ErrorResilient decode skipped.
+	RecoveredErrors int
+}
+
+// TileCache stores decoded tiles so that repeated decodes of the same
+// image can skip tile decoding. Implementations shared between goroutines
+// must be safe for concurrent use.
+type TileCache interface {
+	// Get returns the tile stored under key, if any.
+	Get(key string) (image.Image, bool)
+
+	// Set stores a decoded tile under key.
+	Set(key string, img image.Image)
 }
 
 // Options holds the encoding options.
@@ -217,21 +444,57 @@ type Options struct {
 	Format Format
 
 	// Profile specifies the JPEG 2000 profile to use.
+	//
+	// ProfileCinema2K and ProfileCinema4K produce a DCI compliant
+	// codestream: they override the tiling, wavelet, progression order,
+	// decomposition levels, code-block and precinct sizes and layers with
+	// the values the profile requires, and Precision defaults to 12. The
+	// quantization step is raised as needed to keep the frame within the
+	// DCI limits of 250 Mbit/s in total and 200 Mbit/s per component at
+	// FrameRate (24 fps if unset). Images larger than the 2048x1080 or
+	// 4096x2160 container are rejected.
+	//
+	// The IMF profiles, built with IMFProfile, likewise encode a single
+	// tile with fixed precincts and plain 32x32 or 64x64 code-blocks,
+	// capping the decomposition levels at 5, 6 or 7. The R variants use
+	// the 5-3 reversible wavelet and the others the 9-7 one, whatever
+	// Lossless says. Images must fit 2048x1556, 4096x3112 or 8192x6224 and
+	// have at most three components. With FrameRate set, the sample rate
+	// is checked against the main level and the quantization step raised
+	// to keep to the bit rate of the sublevel.
 	Profile Profile
 
 	// Lossless specifies whether to use lossless compression.
 	// If true, the 5-3 reversible wavelet transform is used.
-	// If false, the 9-7 irreversible wavelet transform is used.
+	// If false, the 9-7 irreversible wavelet transform is used unless
+	// Wavelet selects the 5-3 one.
 	Lossless bool
 
+	// ForceReversible forces the 5-3 reversible wavelet, reversible
+	// colour transform and no quantization even when Lossless is false.
+	// Use it when archival requirements demand reversible coding
+	// regardless of how the rest of the options were chosen.
+	ForceReversible bool
+
+	// Wavelet selects the wavelet transform independently of Lossless.
+	// WaveletReversible53 with Lossless false gives lossy integer 5-3
+	// coding with scalar quantization; WaveletIrreversible97 gives 9-7
+	// coding, near-lossless at fine steps, and cannot be combined with
+	// Lossless or ForceReversible. The RCT or ICT follows the wavelet.
+	// The zero value, WaveletAuto, picks the 5-3 wavelet for lossless
+	// coding and the 9-7 one otherwise.
+	Wavelet Wavelet
+
 	// Quality specifies the compression quality (1-100).
 	// Only used when Lossless is false.
 	// Higher values mean better quality but larger files.
 	Quality int
 
-	// CompressionRatio specifies the target compression ratio.
-	// Only used when Lossless is false and Quality is 0.
-	// For example, 20 means 20:1 compression.
+	// CompressionRatio specifies the target compression ratio for lossy
+	// encoding, e.g. 20 for 20:1 against the uncompressed sample data. The
+	// quantization step is chosen so the output fits that budget. It
+	// takes precedence over Quality and is ignored for reversible
+	// encoding.
 	CompressionRatio float64
 
 	// NumResolutions specifies the number of resolution levels.
@@ -242,14 +505,24 @@ type Options struct {
 	// Default is (6, 6) for 64x64 code blocks.
 	CodeBlockSize image.Point
 
-	// PrecinctSize specifies the precinct dimensions per resolution level.
-	// If nil, default sizes are used.
+	// PrecinctSize specifies the precinct dimensions (log2) per resolution
+	// level, lowest resolution first. The last entry is repeated for any
+	// remaining levels. If nil, the maximal precinct size (2^15) is used.
 	PrecinctSize []image.Point
 
 	// ProgressionOrder specifies the packet ordering.
 	ProgressionOrder ProgressionOrder
 
-	// NumLayers specifies the number of quality layers.
+	// ProgressionOrderChanges, if set, are written to a POC marker and
+	// order the packets of every tile in their place. Packets none of
+	// them covers follow in ProgressionOrder.
+	ProgressionOrderChanges []ProgressionOrderChange
+
+	// NumLayers specifies the number of quality layers. The coding passes
+	// of each tile are assigned to layers by rate-distortion optimisation,
+	// each layer roughly doubling the rate of the one before, so decoding
+	// with Config.QualityLayers = 1, 2, ... gives steadily better images.
+	// Decoding every layer gives the same image as a single layer.
 	NumLayers int
 
 	// TileSize specifies the tile dimensions.
@@ -271,6 +544,23 @@ type Options struct {
 	// Comment specifies an optional comment string.
 	Comment string
 
+	// Comments specifies further comment strings, each written as its own
+	// COM marker after Comment. Passing Metadata.Comments here preserves
+	// the comments of a decoded image when transcoding.
+	Comments []string
+
+	// BinaryComments specifies binary payloads to write as COM markers
+	// with the binary registration value, after the text comments.
+	BinaryComments [][]byte
+
+	// FrameRate is the frame rate of the sequence the image belongs to.
+	// With ProfileCinema2K or ProfileCinema4K and a non-zero Den, it is
+	// written to a DCI timing COM marker alongside CinemaFrameCount.
+	FrameRate Rational
+
+	// CinemaFrameCount is the number of frames in the cinema sequence.
+	CinemaFrameCount int
+
 	// EnableSOP enables Start of Packet markers.
 	EnableSOP bool
 
@@ -283,11 +573,27 @@ type Options struct {
 	// precision scaling in the decoder.
 	Precision int
 
+	// ComponentPrecision overrides the bit depth of individual components:
+	// entry c, if positive, is the precision of component c, so an RGBA
+	// image can carry 8-bit colour and a 1-bit alpha mask. Components
+	// without an entry use Precision, or the input precision if that is
+	// 0. Valid values are 1-16; samples are rescaled as for Precision.
+	ComponentPrecision []int
+
+	// Signed marks every component as signed. Source samples are read as
+	// two's complement: 8-bit channels as int8 and 16-bit channels as
+	// int16, the same layout Decode produces for signed components. They
+	// are coded without a DC level shift. With Precision set, samples
+	// must already lie in the signed Precision-bit range; they are not
+	// rescaled.
+	Signed bool
+
 	// HighThroughput enables HTJ2K (High-Throughput JPEG 2000) mode.
 	// When enabled, the FBCS (Fast Block Coding Stream) entropy coder
 	// is used instead of the standard MQ arithmetic coder.
 	// This provides significantly higher encoding/decoding throughput
-	// at a modest cost in compression efficiency.
+	// at a modest cost in compression efficiency. This package cannot
+	// decode the result: Decode returns ErrUnsupportedHTJ2K.
 	HighThroughput bool
 
 	// HTBlockWidth specifies the code block width for HTJ2K mode.
@@ -299,8 +605,152 @@ type Options struct {
 	// Valid values are 32 and 128. Default is 128.
 	// Only used when HighThroughput is true.
 	HTBlockHeight int
+
+	// MCT controls the multiple component transform (RCT for reversible
+	// coding, ICT otherwise) applied to the first three components:
+	// MCTAuto applies it to RGB-like colour spaces, MCTNone disables it,
+	// and MCTForce applies it whenever there are at least three components.
+	// MCTNone clears the COD flag so that every component is coded on its
+	// own, which suits bands that are not correlated like RGB, such as
+	// false colour or multispectral data. The zero value is MCTAuto, so Options that leave MCT unset keep
+	// transforming RGB images as they did before the field existed.
+	MCT int
+
+	// NoMCT is shorthand for MCT: MCTNone, and takes precedence over MCT
+	// when set.
+	//
+	// Deprecated: Set MCT to MCTNone instead.
+	NoMCT bool
+
+	// SparsityThreshold skips entropy coding of code-blocks whose fraction
+	// of non-zero quantized coefficients is below this value; such blocks
+	// decode as all zero. The default 0 codes every block. Only meaningful
+	// for lossy encoding.
+	SparsityThreshold float64
+
+	// CodeBlockStyle selects the optional code-block coding modes that
+	// trade compression efficiency for error resilience or parallelism.
+	// The zero value disables all of them.
+	CodeBlockStyle CodeBlockStyle
+
+	// WriteTLM writes a TLM (tile-part lengths) marker in the main header
+	// to support random tile access. The tile-parts are buffered until
+	// all of them are encoded, and the marker is filled in with their
+	// lengths before anything is written, so any io.Writer may be used.
+	WriteTLM bool
+
+	// EmitPLT writes PLT (packet lengths) marker segments in each
+	// tile-part header, listing the byte length of every packet so that
+	// readers can locate packets without parsing their headers.
+	EmitPLT bool
+
+	// CollectStats, when non-nil, is filled with per-subband statistics
+	// by Encode. Any previous contents are replaced.
+	CollectStats *EncodeStats
+
+	// experimentalOptions adds research-only fields such as SubbandGain
+	// when building with the experiment tag.
+	experimentalOptions
+}
+
+// EncodeStats reports where the encoded bytes went, for encoder tuning.
+type EncodeStats struct {
+	// SubbandBytes holds the entropy-coded bytes of each subband, indexed
+	// by component, resolution and band. Resolution 0 has the single LL
+	// band; higher resolutions hold HL, LH and HH in that order.
+	SubbandBytes [][][]int64
+
+	// CodeBlockCount is the number of code-blocks that were entropy coded.
+	CodeBlockCount int
+
+	// MeanSparsity is the mean fraction of non-zero coefficients over the
+	// coded code-blocks.
+	MeanSparsity float64
+}
+
+// Wavelet selects the discrete wavelet transform for Options.Wavelet.
+type Wavelet int
+
+const (
+	// WaveletAuto follows Options.Lossless and ForceReversible.
+	WaveletAuto Wavelet = iota
+	// WaveletReversible53 is the 5-3 reversible integer wavelet.
+	WaveletReversible53
+	// WaveletIrreversible97 is the 9-7 irreversible wavelet.
+	WaveletIrreversible97
+)
+
+// Multiple component transform modes for Options.MCT.
+const (
+	MCTAuto  = 0
+	MCTNone  = 1
+	MCTForce = 2
+)
+
+// CodeBlockStyle holds the optional code-block coding modes signalled in
+// the Scb field of the COD marker (ISO/IEC 15444-1 Table A.19).
+type CodeBlockStyle struct {
+	// Selective enables selective arithmetic coding bypass (BYPASS).
+	Selective bool
+
+	// ResetOnBoundaries resets context probabilities at the start of
+	// each coding pass (RESET).
+	ResetOnBoundaries bool
+
+	// TerminateOnPass terminates the arithmetic coder after every
+	// coding pass (RESTART).
+	TerminateOnPass bool
+
+	// Causal uses vertically causal context formation (CAUSAL).
+	Causal bool
+
+	// PredictableTermination uses predictable termination so decoders
+	// can detect corrupted passes (ERTERM).
+	PredictableTermination bool
+
+	// SegmentationSymbols appends a segmentation symbol to each cleanup
+	// pass (SEGMARK).
+	SegmentationSymbols bool
+}
+
+// ErrInvalidSignature is returned when the input is not a JPEG 2000 file:
+// it starts with neither the JP2 signature box nor the SOC marker of a
+// raw codestream, or its signature box or codestream is malformed.
+var ErrInvalidSignature = errors.New("jpeg2000: not a JPEG 2000 file")
+
+// ErrTruncated is returned when the input ends before the file structure
+// or headers are complete, inside the data of a tile-part, or before the
+// EOC marker, so reading more of it may succeed. With
+// Config.ErrorResilient, tile data cut short is not an error: the packets
+// present are decoded.
+var ErrTruncated = errors.New("jpeg2000: truncated data")
+
+// ErrUnsupportedFeature matches, with errors.Is, any
+// *UnsupportedFeatureError.
+var ErrUnsupportedFeature = errors.New("jpeg2000: unsupported feature")
+
+// UnsupportedFeatureError is returned when the input uses a feature this
+// package cannot decode.
+type UnsupportedFeatureError struct {
+	// Feature names the unsupported feature.
+	Feature string
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return "jpeg2000: unsupported feature: " + e.Feature
+}
+
+// Is reports whether target is ErrUnsupportedFeature.
+func (e *UnsupportedFeatureError) Is(target error) bool {
+	return target == ErrUnsupportedFeature
 }
 
+// ErrUnsupportedHTJ2K is returned when decoding the pixels of a
+// High-Throughput JPEG 2000 (Part 15) codestream, whose block coder is
+// not supported. DecodeMetadata still reads such files and reports them
+// with Metadata.IsHTJ2K. It is an *UnsupportedFeatureError.
+var ErrUnsupportedHTJ2K error = &UnsupportedFeatureError{Feature: "HTJ2K (Part 15) block coding"}
+
 // DefaultOptions returns the default encoding options.
 func DefaultOptions() *Options {
 	return &Options{
@@ -308,6 +758,7 @@ func DefaultOptions() *Options {
 		Profile:          ProfileNone,
 		Lossless:         false,
 		Quality:          75,
+		MCT:              MCTAuto,
 		NumResolutions:   6,
 		CodeBlockSize:    image.Point{6, 6}, // 64x64
 		ProgressionOrder: LRCP,
@@ -326,19 +777,228 @@ func DecodeConfig(r io.Reader, cfg *Config) (image.Image, error) {
 	return d.decode(cfg)
 }
 
+// DecodeInto decodes a JPEG 2000 image from r into dst, whose bounds must
+// equal those of the image Decode would return. When the image decodes to
+// 8-bit RGB or RGBA, dst is filled directly and no output image is
+// allocated; other images are converted into it. Every pixel of dst is
+// overwritten.
+func DecodeInto(dst *image.RGBA, r io.Reader) error {
+	return newDecoder(r).decodeInto(dst, nil)
+}
+
+// DecodeIntoGray is like DecodeInto for an 8-bit grayscale destination,
+// filled directly for images of up to 8 bits with one component.
+func DecodeIntoGray(dst *image.Gray, r io.Reader) error {
+	return newDecoder(r).decodeInto(dst, nil)
+}
+
+// DecodeIntoGray16 is like DecodeInto for a 16-bit grayscale destination,
+// filled directly for images of 9 to 16 bits with one component.
+func DecodeIntoGray16(dst *image.Gray16, r io.Reader) error {
+	return newDecoder(r).decodeInto(dst, nil)
+}
+
+// DecodeIntoRGBA64 is like DecodeInto for a 16-bit RGBA destination,
+// filled directly for RGB and RGBA images of 9 to 16 bits.
+func DecodeIntoRGBA64(dst *image.RGBA64, r io.Reader) error {
+	return newDecoder(r).decodeInto(dst, nil)
+}
+
+// DecodeThumbnail decodes a preview of the image from r, discarding as
+// many resolution levels as it can while the long edge of the result
+// stays at least maxDim pixels. An image smaller than maxDim is decoded
+// at full resolution, and when even the lowest resolution level is at
+// least maxDim, that level is decoded.
+func DecodeThumbnail(r io.ReadSeeker, maxDim int) (image.Image, error) {
+	d := newDecoder(r)
+	if err := d.readFormat(); err != nil {
+		return nil, fmt.Errorf("reading format: %w", err)
+	}
+	if err := d.parseCodestream(); err != nil {
+		return nil, fmt.Errorf("parsing codestream: %w", err)
+	}
+	img, err := d.decodeTiles(&Config{ReduceResolution: d.thumbnailReduction(maxDim)})
+	if err != nil {
+		return nil, fmt.Errorf("decoding tiles: %w", err)
+	}
+	return img, nil
+}
+
+// DecodeWithProfile decodes a JPEG 2000 image like Decode and also returns
+// the ICC profile carried by the JP2 colour specification box, for the
+// restricted and any-ICC methods. The profile is nil when the file has
+// none, including raw J2K codestreams.
+func DecodeWithProfile(r io.Reader) (image.Image, []byte, error) {
+	d := newDecoder(r)
+	img, err := d.decode(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, d.iccProfile(), nil
+}
+
+// DecodeTiles decodes a JPEG 2000 image one tile at a time, calling fn for
+// each tile in raster order with its tile grid position. Each tile image
+// covers the part of the tile inside the image area, in the same
+// coordinates as the image returned by Decode. Only one tile's samples
+// are held in memory at a time, so fn should copy out anything it needs
+// to keep. If fn returns an error, decoding stops and that error is
+// returned.
+func DecodeTiles(r io.ReadSeeker, fn func(tile image.Image, tileX, tileY int) error) error {
+	d := newDecoder(r)
+	return d.eachTile(fn)
+}
+
+// DecodeComponents decodes a JPEG 2000 image from r and returns the
+// reconstructed samples of each component rather than an image. The
+// inverse component transform and DC level shift are applied, so each
+// plane holds values in its component's own range as given by
+// Metadata.BitsPerComponent and Metadata.Signed, but samples are neither
+// clamped nor scaled, palettes are not expanded and no colour space
+// conversion is done. Planes cover the decoded area on the reference grid
+// in raster order, with subsampled components upsampled as for Decode.
+// cfg selects the area, resolution and layers as for DecodeConfig and may
+// be nil.
+func DecodeComponents(r io.Reader, cfg *Config) ([][]int32, *Metadata, error) {
+	d := newDecoder(r)
+	return d.decodeComponents(cfg)
+}
+
 // Encode writes the image m to w in JPEG 2000 format with the given options.
+//
+// An *image.YCbCr encoded lossily with the multiple component transform
+// is coded from its planes without a round trip through RGB: its JFIF
+// YCbCr is the output of the irreversible colour transform. Subsampled
+// chroma planes are written as components with matching XRsiz and YRsiz.
 func Encode(w io.Writer, m image.Image, o *Options) error {
+	_, err := EncodeCount(w, m, o)
+	return err
+}
+
+// EncodeCount is like Encode but also returns the number of bytes written
+// to w, which on success is the size of the encoded file.
+func EncodeCount(w io.Writer, m image.Image, o *Options) (int64, error) {
+	if o == nil {
+		o = DefaultOptions()
+	}
+	cw := &countingWriter{w: w}
+	e := newEncoder(cw, m, o)
+	err := e.encode()
+	return cw.n, err
+}
+
+// ExportCodestream encodes m and returns the raw J2K codestream, without a
+// JP2 container, regardless of o.Format. The caller's options are not
+// modified. A nil o uses DefaultOptions.
+func ExportCodestream(m image.Image, o *Options) ([]byte, error) {
+	if o == nil {
+		o = DefaultOptions()
+	}
+	opts := *o
+	opts.Format = FormatJ2K
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeMultiFrame writes frames to w as a sequence of independent J2K
+// codestreams, each preceded by its length as a 4-byte big-endian
+// integer, the framing used by MXF and IMF essence. It returns the offset
+// of each frame's length prefix relative to the start of the output, for
+// use with DecodeFrame. o applies to every frame; o.Format is ignored.
+func EncodeMultiFrame(w io.Writer, frames []image.Image, o *Options) ([]int64, error) {
+	offsets := make([]int64, 0, len(frames))
+	var pos int64
+	for i, frame := range frames {
+		data, err := ExportCodestream(frame, o)
+		if err != nil {
+			return offsets, fmt.Errorf("encoding frame %d: %w", i, err)
+		}
+
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+		if _, err := w.Write(prefix[:]); err != nil {
+			return offsets, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return offsets, err
+		}
+
+		offsets = append(offsets, pos)
+		pos += int64(len(prefix) + len(data))
+	}
+	return offsets, nil
+}
+
+// DecodeFrame decodes frame frameIndex of a sequence written by
+// EncodeMultiFrame, seeking directly to it using the offsets that
+// EncodeMultiFrame returned.
+func DecodeFrame(r io.ReadSeeker, frameIndex int, offsets []int64, cfg *Config) (image.Image, error) {
+	if frameIndex < 0 || frameIndex >= len(offsets) {
+		return nil, fmt.Errorf("jpeg2000: frame %d out of range [0, %d)", frameIndex, len(offsets))
+	}
+	if _, err := r.Seek(offsets[frameIndex], io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading frame %d length: %w", frameIndex, err)
+	}
+	n := int64(binary.BigEndian.Uint32(prefix[:]))
+	return DecodeConfig(io.LimitReader(r, n), cfg)
+}
+
+// CompressedSize estimates the number of bytes Encode would write for m
+// with options o, without producing any output. The transforms run in
+// full but only a sample of the code-blocks is entropy coded, so the
+// result is approximate for large images; encode to a counting writer
+// when the exact size is required. A nil o uses DefaultOptions.
+func CompressedSize(m image.Image, o *Options) (int, error) {
 	if o == nil {
 		o = DefaultOptions()
 	}
-	e := newEncoder(w, m, o)
-	return e.encode()
+	e := newEncoder(nil, m, o)
+	return e.estimateSize()
+}
+
+// DecodeImageConfig returns the dimensions of the image and the color
+// model of the image Decode returns for it, without decoding pixels. It
+// backs image.DecodeConfig for the registered formats.
+func DecodeImageConfig(r io.Reader) (image.Config, error) {
+	d := newDecoder(r)
+	if err := d.readFormat(); err != nil {
+		return image.Config{}, err
+	}
+	if err := d.parseCodestream(); err != nil {
+		return image.Config{}, err
+	}
+
+	model, err := d.colorModel()
+	if err != nil {
+		return image.Config{}, err
+	}
+	h := d.header
+	return image.Config{
+		ColorModel: model,
+		Width:      int(h.ImageWidth - h.ImageXOffset),
+		Height:     int(h.ImageHeight - h.ImageYOffset),
+	}, nil
 }
 
 // DecodeMetadata reads only the header information without decoding the image.
 func DecodeMetadata(r io.Reader) (*Metadata, error) {
+	return DecodeMetadataConfig(r, nil)
+}
+
+// DecodeMetadataConfig reads the header information like DecodeMetadata,
+// additionally computing the values requested by cfg.
+func DecodeMetadataConfig(r io.Reader, cfg *Config) (*Metadata, error) {
 	d := newDecoder(r)
-	return d.readMetadata()
+	return d.readMetadata(cfg)
 }
 
 // Metadata contains image metadata extracted from the JPEG 2000 file.
@@ -361,16 +1021,33 @@ type Metadata struct {
 	// Signed indicates whether each component uses signed values.
 	Signed []bool
 
+	// SubsamplingX and SubsamplingY are the horizontal and vertical
+	// subsampling factors (XRsiz and YRsiz) of each component.
+	SubsamplingX []int
+	SubsamplingY []int
+
 	// ColorSpace is the detected color space.
 	ColorSpace ColorSpace
 
 	// Profile is the JPEG 2000 profile.
 	Profile Profile
 
-	// NumResolutions is the number of resolution levels.
+	// IsHTJ2K reports whether the codestream uses the High-Throughput
+	// block coder, as signalled by the CAP marker or the code-block
+	// style. Decoding its pixels returns ErrUnsupportedHTJ2K.
+	IsHTJ2K bool
+
+	// NumResolutions is the number of resolution levels, from the COD
+	// marker or the smallest of any COC overrides, so that
+	// Config.ReduceResolution may be up to NumResolutions-1.
 	NumResolutions int
 
-	// NumQualityLayers is the number of quality layers.
+	// WaveletTransform is the wavelet filter signalled in the COD marker:
+	// 0 for 9-7 irreversible, 1 for 5-3 reversible.
+	WaveletTransform int
+
+	// NumQualityLayers is the number of quality layers signalled in the
+	// COD marker, the largest useful Config.QualityLayers.
 	NumQualityLayers int
 
 	// TileWidth is the tile width.
@@ -385,11 +1062,44 @@ type Metadata struct {
 	// NumTilesY is the number of tiles vertically.
 	NumTilesY int
 
+	// ColorSpaceMethod is the METH value of the JP2 colour specification
+	// box: 1 when ColorSpace comes from an enumerated value, 2 or 3 when
+	// a restricted or general ICC profile in ICCProfile governs colour
+	// (ColorSpace is then ColorSpaceUnspecified). It is 0 for raw
+	// codestreams.
+	ColorSpaceMethod int
+
 	// ICCProfile is the embedded ICC color profile, if any.
 	ICCProfile []byte
 
-	// Comment is the embedded comment string, if any.
+	// ParsedICC holds the decoded header and common tags of ICCProfile.
+	// It is nil when there is no profile or it could not be parsed.
+	ParsedICC *ParsedICCProfile
+
+	// Comment is the embedded comment string, if any. If there are
+	// several, it is the last one.
 	Comment string
+
+	// Comments holds every text comment in the main header, in order,
+	// including the DCI timing comment of cinema profiles.
+	Comments []string
+
+	// BinaryComments holds the raw payload of every binary COM marker in
+	// the main header, in order.
+	BinaryComments [][]byte
+
+	// CinemaFrameRate and CinemaFrameCount hold the DCI timing metadata
+	// written by Encode for cinema profiles. They are zero when the
+	// codestream carries no timing COM marker.
+	CinemaFrameRate  Rational
+	CinemaFrameCount int
+
+	// LayerBoundaries holds, for each quality layer l, the number of
+	// codestream bytes (counted from the SOC marker) that contain every
+	// packet of layers 0 through l; a prefix of that length decodes with
+	// Config.ErrorResilient. The final entry is the codestream length. It
+	// is only set when Config.ComputeLayerBoundaries is true.
+	LayerBoundaries []int64
 }
 
 // init registers the JPEG 2000 format with the image package.
@@ -400,16 +1110,7 @@ func init() {
 		func(r io.Reader) (image.Image, error) {
 			return Decode(r)
 		},
-		func(r io.Reader) (image.Config, error) {
-			m, err := DecodeMetadata(r)
-			if err != nil {
-				return image.Config{}, err
-			}
-			return image.Config{
-				Width:  m.Width,
-				Height: m.Height,
-			}, nil
-		})
+		DecodeImageConfig)
 
 	// Register J2K format (raw codestream)
 	image.RegisterFormat("j2k",
@@ -417,14 +1118,5 @@ func init() {
 		func(r io.Reader) (image.Image, error) {
 			return Decode(r)
 		},
-		func(r io.Reader) (image.Config, error) {
-			m, err := DecodeMetadata(r)
-			if err != nil {
-				return image.Config{}, err
-			}
-			return image.Config{
-				Width:  m.Width,
-				Height: m.Height,
-			}, nil
-		})
+		DecodeImageConfig)
 }
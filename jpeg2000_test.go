@@ -2,9 +2,22 @@ package jpeg2000
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"slices"
 	"testing"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/box"
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
 )
 
 func TestDefaultOptions(t *testing.T) {
@@ -164,6 +177,80 @@ func TestEncode_JP2Format(t *testing.T) {
 	}
 }
 
+func TestEncode_JPXFormat(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+
+	var jpx, jp2 bytes.Buffer
+	if err := Encode(&jpx, img, &Options{Format: FormatJPX, Lossless: true}); err != nil {
+		t.Fatalf("Encode() JPX error: %v", err)
+	}
+	if err := Encode(&jp2, img, &Options{Format: FormatJP2, Lossless: true}); err != nil {
+		t.Fatalf("Encode() JP2 error: %v", err)
+	}
+	data := jpx.Bytes()
+
+	// Signature, then ftyp with the JPX brand, then rreq
+	r := box.NewReader(bytes.NewReader(data))
+	var types []box.Type
+	for {
+		b, err := r.ReadBox()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadBox() error: %v", err)
+		}
+		types = append(types, b.Type)
+		if b.Type == box.TypeFileType {
+			var ftyp box.FileTypeBox
+			if err := ftyp.Parse(b.Contents); err != nil {
+				t.Fatal(err)
+			}
+			if ftyp.Brand != box.BrandJPX || !slices.Contains(ftyp.Compatibility, box.BrandJPXBaseline) {
+				t.Errorf("ftyp brand %v compatible with %v, want jpx and jpxb", ftyp.Brand, ftyp.Compatibility)
+			}
+		}
+	}
+	want := []box.Type{box.TypeJP2Signature, box.TypeFileType, box.TypeReaderReq, box.TypeJP2Header, box.TypeContCodestream}
+	if !slices.Equal(types, want) {
+		t.Errorf("boxes %v, want %v", types, want)
+	}
+
+	if issues := Validate(bytes.NewReader(data)); len(issues) > 0 {
+		t.Errorf("Validate() = %v", issues)
+	}
+	m, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.Format != FormatJPX {
+		t.Errorf("Metadata.Format = %v, want JPX", m.Format)
+	}
+
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	ref, err := Decode(bytes.NewReader(jp2.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() JP2 error: %v", err)
+	}
+	if !reflect.DeepEqual(got, ref) {
+		t.Error("JPX and JP2 files decode to different images")
+	}
+
+	// Without the reader requirements box the file is not valid JPX
+	i := bytes.Index(data, []byte("rreq")) - 4
+	n := int(binary.BigEndian.Uint32(data[i:]))
+	stripped := append(data[:i:i], data[i+n:]...)
+	if issues := Validate(bytes.NewReader(stripped)); len(issues) == 0 {
+		t.Error("Validate() of JPX without rreq reported no issues")
+	}
+}
+
 func TestEncode_WithComment(t *testing.T) {
 	img := image.NewGray(image.Rect(0, 0, 8, 8))
 
@@ -227,6 +314,50 @@ func TestEncodeNilOptions(t *testing.T) {
 	}
 }
 
+func TestEncodeCount(t *testing.T) {
+	img := codingModesImage()
+
+	for _, opts := range []*Options{
+		nil,
+		{Format: FormatJ2K, Lossless: true},
+		{Format: FormatJP2, Quality: 50},
+	} {
+		var buf bytes.Buffer
+		n, err := EncodeCount(&buf, img, opts)
+		if err != nil {
+			t.Fatalf("EncodeCount(%+v) error: %v", opts, err)
+		}
+		if n != int64(buf.Len()) {
+			t.Errorf("EncodeCount(%+v) = %d, wrote %d bytes", opts, n, buf.Len())
+		}
+	}
+
+	// A failing writer stops the count at what it accepted
+	w := &limitedWriter{limit: 100}
+	n, err := EncodeCount(w, img, &Options{Format: FormatJ2K, Lossless: true})
+	if err == nil {
+		t.Fatal("EncodeCount() to a failing writer succeeded")
+	}
+	if n != int64(w.n) {
+		t.Errorf("EncodeCount() = %d after a failed write, writer accepted %d bytes", n, w.n)
+	}
+}
+
+// limitedWriter accepts up to limit bytes and then fails.
+type limitedWriter struct {
+	limit, n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		k := w.limit - w.n
+		w.n = w.limit
+		return k, errors.New("write limit reached")
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
 func TestMetadata(t *testing.T) {
 	m := &Metadata{
 		Format:           FormatJP2,
@@ -546,6 +677,50 @@ func TestDecodeMetadata_JP2(t *testing.T) {
 	}
 }
 
+func TestDecodeMetadata_ResolutionsAndLayers(t *testing.T) {
+	img := codingModesImage()
+	for _, format := range []Format{FormatJ2K, FormatJP2} {
+		var buf bytes.Buffer
+		opts := &Options{Format: format, Lossless: true, NumResolutions: 4, NumLayers: 3}
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode(%s) error: %v", format, err)
+		}
+
+		meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeMetadata(%s) error: %v", format, err)
+		}
+		if meta.NumResolutions != 4 || meta.NumQualityLayers != 3 {
+			t.Errorf("%s: NumResolutions, NumQualityLayers = %d, %d; want 4, 3",
+				format, meta.NumResolutions, meta.NumQualityLayers)
+		}
+
+		// Both are the largest values Config accepts
+		cfg := &Config{ReduceResolution: meta.NumResolutions - 1, QualityLayers: meta.NumQualityLayers}
+		if _, err := DecodeConfig(bytes.NewReader(buf.Bytes()), cfg); err != nil {
+			t.Errorf("%s: DecodeConfig(%+v) error: %v", format, *cfg, err)
+		}
+	}
+
+	// A COC with fewer decomposition levels for component 0 lowers the
+	// number every component has
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 4}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+	pos, end := mainHeaderSegment(t, data, codestream.COD)
+	coc := []byte{0xFF, 0x53, 0, 9, 0, 0, 1, data[pos+10], data[pos+11], data[pos+12], data[pos+13]}
+	data = append(append(append([]byte(nil), data[:end]...), coc...), data[end:]...)
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() with COC error: %v", err)
+	}
+	if meta.NumResolutions != 2 {
+		t.Errorf("NumResolutions with COC = %d, want 2", meta.NumResolutions)
+	}
+}
+
 // Test image.Decode and image.DecodeConfig via init() registration
 func TestImageDecode_JP2Registration(t *testing.T) {
 	// Create and encode a JP2 image
@@ -736,7 +911,7 @@ func TestEncode_NRGBA(t *testing.T) {
 
 // Test generic image type (non-standard)
 func TestEncode_GenericImage(t *testing.T) {
-	// Use image.YCbCr as a generic image type that falls through to default
+	// Lossless image.YCbCr input falls through to the generic RGB path
 	img := image.NewYCbCr(image.Rect(0, 0, 8, 8), image.YCbCrSubsampleRatio444)
 
 	var buf bytes.Buffer
@@ -870,6 +1045,124 @@ func TestEncode_WithSOPEPH(t *testing.T) {
 	}
 }
 
+func TestEncodeDecode_SOPEPH(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 70, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 70; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 3), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"tiled layers", Options{Format: FormatJ2K, Lossless: true, NumLayers: 3, TileSize: image.Pt(32, 32)}},
+		{"precincts", Options{Format: FormatJP2, Quality: 70, NumLayers: 4, ProgressionOrder: RPCL,
+			PrecinctSize: []image.Point{{4, 4}, {5, 5}}}},
+		{"lossless", Options{Format: FormatJ2K, Lossless: true}},
+	}
+	for _, tt := range tests {
+		for _, markers := range []struct{ sop, eph bool }{{true, false}, {false, true}, {true, true}} {
+			name := fmt.Sprintf("%s/SOP=%v,EPH=%v", tt.name, markers.sop, markers.eph)
+			t.Run(name, func(t *testing.T) {
+				plainOpts := tt.opts
+				var plain bytes.Buffer
+				if err := Encode(&plain, img, &plainOpts); err != nil {
+					t.Fatalf("Encode() error: %v", err)
+				}
+				opts := tt.opts
+				opts.EnableSOP, opts.EnableEPH = markers.sop, markers.eph
+				var buf bytes.Buffer
+				if err := Encode(&buf, img, &opts); err != nil {
+					t.Fatalf("Encode() error: %v", err)
+				}
+				if buf.Len() <= plain.Len() {
+					t.Errorf("Encode() with markers = %d bytes, want more than %d", buf.Len(), plain.Len())
+				}
+
+				got, err := Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("Decode() error: %v", err)
+				}
+				want, err := Decode(bytes.NewReader(plain.Bytes()))
+				if err != nil {
+					t.Fatalf("Decode() error: %v", err)
+				}
+				b := want.Bounds()
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						if got.At(x, y) != want.At(x, y) {
+							t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got.At(x, y), want.At(x, y))
+						}
+					}
+				}
+				if opts.Lossless {
+					if psnr, _ := PSNR(img, got); !math.IsInf(psnr, 1) {
+						t.Errorf("lossless PSNR = %v, want +Inf", psnr)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeConfig_ErrorResilient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x*3 + y), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, EnableSOP: true, NumLayers: 3, NumResolutions: 4, MCT: MCTNone}
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// An intact codestream decodes exactly, with nothing to recover
+	var stats DecodeStats
+	got, err := DecodeConfig(bytes.NewReader(data), &Config{ErrorResilient: true, CollectStats: &stats})
+	if err != nil {
+		t.Fatalf("DecodeConfig() error: %v", err)
+	}
+	if psnr, _ := PSNR(img, got); !math.IsInf(psnr, 1) || stats.RecoveredErrors != 0 {
+		t.Errorf("intact decode: PSNR = %v, RecoveredErrors = %d; want +Inf, 0", psnr, stats.RecoveredErrors)
+	}
+
+	var sops []int
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == 0xFF && data[i+1] == 0x91 {
+			sops = append(sops, i)
+		}
+	}
+	for _, k := range []int{5, len(sops) / 2, len(sops) - 3} {
+		// Overwrite the header of packet k
+		bad := bytes.Clone(data)
+		copy(bad[sops[k]+6:], []byte{0x12, 0x34, 0x56, 0x78})
+
+		plain, err := Decode(bytes.NewReader(bad))
+		if err != nil {
+			t.Fatalf("packet %d: Decode() error: %v", k, err)
+		}
+		plainPSNR, _ := PSNR(img, plain)
+
+		stats = DecodeStats{}
+		got, err := DecodeConfig(bytes.NewReader(bad), &Config{ErrorResilient: true, CollectStats: &stats})
+		if err != nil {
+			t.Fatalf("packet %d: resilient DecodeConfig() error: %v", k, err)
+		}
+		psnr, _ := PSNR(img, got)
+		if stats.RecoveredErrors == 0 {
+			t.Errorf("packet %d: RecoveredErrors = 0, want at least 1", k)
+		}
+		if psnr < 35 || psnr <= plainPSNR {
+			t.Errorf("packet %d: resilient PSNR = %.1f dB, want at least 35 and above %.1f dB without", k, psnr, plainPSNR)
+		}
+	}
+}
+
 func TestEncode_WithDifferentProgressionOrders(t *testing.T) {
 	orders := []ProgressionOrder{LRCP, RLCP, RPCL, PCRL, CPRL}
 
@@ -890,6 +1183,360 @@ func TestEncode_WithDifferentProgressionOrders(t *testing.T) {
 	}
 }
 
+func TestRoundtrip_ProgressionOrders(t *testing.T) {
+	// Several layers, components, tiles and precincts per resolution, so
+	// that every order interleaves packets differently
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(x*y + y), uint8(x ^ y*5), 255})
+		}
+	}
+
+	for _, order := range []ProgressionOrder{LRCP, RLCP, RPCL, PCRL, CPRL} {
+		t.Run(order.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &Options{
+				Format:           FormatJ2K,
+				Lossless:         true,
+				NumResolutions:   3,
+				NumLayers:        3,
+				TileSize:         image.Pt(32, 32),
+				CodeBlockSize:    image.Pt(3, 3),
+				PrecinctSize:     []image.Point{{3, 3}, {4, 4}},
+				ProgressionOrder: order,
+			}
+			if err := Encode(&buf, img, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeHeader() error: %v", err)
+			}
+			if h.ProgressionOrder != order {
+				t.Fatalf("COD progression order = %s, want %s", h.ProgressionOrder, order)
+			}
+
+			data := buf.Bytes()
+			decoded, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if mse, err := MSE(decoded, img); err != nil || mse != 0 {
+				t.Errorf("MSE = %v, %v; want 0", mse, err)
+			}
+
+			// The same packets with the order signalled only by a COD in
+			// each tile-part header, which overrides the main header's
+			other := LRCP
+			if order == LRCP {
+				other = RLCP
+			}
+			decoded, err = Decode(bytes.NewReader(withTileCOD(t, data, other)))
+			if err != nil {
+				t.Fatalf("Decode() with tile COD error: %v", err)
+			}
+			if mse, err := MSE(decoded, img); err != nil || mse != 0 {
+				t.Errorf("MSE with tile COD = %v, %v; want 0", mse, err)
+			}
+		})
+	}
+}
+
+// withTileCOD copies the main header COD of the codestream data into each
+// tile-part header, then rewrites the main header's progression order to
+// order.
+func withTileCOD(t *testing.T, data []byte, order ProgressionOrder) []byte {
+	t.Helper()
+	pos, end := mainHeaderSegment(t, data, codestream.COD)
+	cod := data[pos:end]
+	out := insertInTileParts(data, func(int) []byte { return cod })
+	out[pos+5] = byte(order)
+	return out
+}
+
+// withTilePOC moves the main header POC of the codestream data into each
+// tile-part header.
+func withTilePOC(t *testing.T, data []byte) []byte {
+	t.Helper()
+	pos, end := mainHeaderSegment(t, data, codestream.POC)
+	poc := append([]byte(nil), data[pos:end]...)
+	data = append(append([]byte(nil), data[:pos]...), data[end:]...)
+	return insertInTileParts(data, func(int) []byte { return poc })
+}
+
+// mainHeaderSegment returns the offsets of the marker segment m in the main
+// header of the codestream data.
+func mainHeaderSegment(t *testing.T, data []byte, m codestream.Marker) (start, end int) {
+	t.Helper()
+	pos := 2
+	for {
+		marker := codestream.Marker(binary.BigEndian.Uint16(data[pos:]))
+		if marker == codestream.SOT {
+			t.Fatalf("no %s in the main header", m)
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == m {
+			return pos, pos + 2 + n
+		}
+		pos += 2 + n
+	}
+}
+
+// insertInTileParts returns a copy of the codestream data with the marker
+// segments seg returns for each tile index added to the headers of the
+// tile's tile-parts.
+func insertInTileParts(data []byte, segs func(tile int) []byte) []byte {
+	pos := 2
+	for codestream.Marker(binary.BigEndian.Uint16(data[pos:])) != codestream.SOT {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	out := append([]byte(nil), data[:pos]...)
+
+	for codestream.Marker(binary.BigEndian.Uint16(data[pos:])) == codestream.SOT {
+		psot := int(binary.BigEndian.Uint32(data[pos+6:]))
+		seg := segs(int(binary.BigEndian.Uint16(data[pos+4:])))
+		sot := append([]byte(nil), data[pos:pos+12]...)
+		binary.BigEndian.PutUint32(sot[6:], uint32(psot+len(seg)))
+		out = append(out, sot...)
+		out = append(out, seg...)
+		out = append(out, data[pos+12:pos+psot]...)
+		pos += psot
+	}
+	return append(out, data[pos:]...)
+}
+
+// tilePartSpan returns the [start, end) offsets of the first tile-part of
+// tile in the codestream data.
+func tilePartSpan(t *testing.T, data []byte, tile int) (start, end int) {
+	t.Helper()
+	pos := 2
+	for codestream.Marker(binary.BigEndian.Uint16(data[pos:])) != codestream.SOT {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	for codestream.Marker(binary.BigEndian.Uint16(data[pos:])) == codestream.SOT {
+		psot := int(binary.BigEndian.Uint32(data[pos+6:]))
+		if int(binary.BigEndian.Uint16(data[pos+4:])) == tile {
+			return pos, pos + psot
+		}
+		pos += psot
+	}
+	t.Fatalf("no tile-part of tile %d", tile)
+	return 0, 0
+}
+
+func TestDecode_TilePartCodingStyle(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x*7 + y*y)})
+		}
+	}
+	encode := func(levels int) []byte {
+		var buf bytes.Buffer
+		opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: levels + 1, TileSize: image.Pt(32, 32)}
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	// Tile 1 coded with 5 decomposition levels, signalled by a COD and
+	// QCD in its tile-part header, against 2 in the main header
+	data, five := encode(2), encode(5)
+	codPos, codEnd := mainHeaderSegment(t, five, codestream.COD)
+	qcdPos, qcdEnd := mainHeaderSegment(t, five, codestream.QCD)
+	override := append(append([]byte(nil), five[codPos:codEnd]...), five[qcdPos:qcdEnd]...)
+	five = insertInTileParts(five, func(tile int) []byte {
+		if tile == 1 {
+			return override
+		}
+		return nil
+	})
+	start, end := tilePartSpan(t, data, 1)
+	fiveStart, fiveEnd := tilePartSpan(t, five, 1)
+	data = append(append(append([]byte(nil), data[:start]...), five[fiveStart:fiveEnd]...), data[end:]...)
+
+	tiles, err := DecodeTileMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeTileMetadata() error: %v", err)
+	}
+	if n := tiles[1].Components[0].NumResolutions; n != 6 {
+		t.Fatalf("tile 1 NumResolutions = %d, want 6", n)
+	}
+
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	gray, ok := got.(*image.Gray)
+	if !ok {
+		t.Fatalf("Decode() returned %T, want *image.Gray", got)
+	}
+	wrong := 0
+	for i := range img.Pix {
+		if gray.Pix[i] != img.Pix[i] {
+			wrong++
+		}
+	}
+	if wrong > 0 {
+		t.Errorf("%d of %d pixels differ from the original", wrong, len(img.Pix))
+	}
+}
+
+func TestDecodeTileMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{
+		Format:         FormatJ2K,
+		Lossless:       true,
+		NumResolutions: 3,
+		NumLayers:      2,
+		TileSize:       image.Pt(16, 16),
+		CodeBlockSize:  image.Pt(5, 5),
+	}
+	if err := Encode(&buf, codingModesImage(), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// A main header COC with 4x4 code-blocks; tile 1 restores the COD
+	// with 16x16 code-blocks, the 9-7 wavelet, RPCL and 5 layers, and
+	// tile 3 has a COC with one decomposition level and 8x8 code-blocks
+	pos, end := mainHeaderSegment(t, data, codestream.COD)
+	cod := append([]byte(nil), data[pos:end]...)
+	cod[5], cod[7], cod[10], cod[11], cod[13] = byte(RPCL), 5, 2, 2, 0
+	mainCOC := []byte{0xFF, 0x53, 0, 9, 0, 0, 2, 0, 0, 0, 1}
+	tileCOC := []byte{0xFF, 0x53, 0, 9, 0, 0, 1, 1, 1, 0, 1}
+	data = append(append(append([]byte(nil), data[:end]...), mainCOC...), data[end:]...)
+	data = insertInTileParts(data, func(tile int) []byte {
+		switch tile {
+		case 1:
+			return cod
+		case 3:
+			return tileCOC
+		}
+		return nil
+	})
+
+	tiles, err := DecodeTileMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeTileMetadata() error: %v", err)
+	}
+	if len(tiles) != 4 {
+		t.Fatalf("len(tiles) = %d, want 4", len(tiles))
+	}
+
+	tests := []struct {
+		order      ProgressionOrder
+		layers     int
+		reversible bool
+		resolution int
+		codeBlock  int
+	}{
+		{LRCP, 2, true, 3, 4},
+		{RPCL, 5, false, 3, 16},
+		{LRCP, 2, true, 3, 4},
+		{LRCP, 2, true, 2, 8},
+	}
+	for i, want := range tests {
+		tm := tiles[i]
+		if tm.Index != i || tm.NumTileParts != 1 {
+			t.Errorf("tile %d: Index, NumTileParts = %d, %d; want %d, 1", i, tm.Index, tm.NumTileParts, i)
+		}
+		if wantBounds := image.Rect(i%2*16, i/2*16, i%2*16+16, i/2*16+16); tm.Bounds != wantBounds {
+			t.Errorf("tile %d: Bounds = %v, want %v", i, tm.Bounds, wantBounds)
+		}
+		if tm.ProgressionOrder != want.order || tm.NumLayers != want.layers {
+			t.Errorf("tile %d: ProgressionOrder, NumLayers = %s, %d; want %s, %d",
+				i, tm.ProgressionOrder, tm.NumLayers, want.order, want.layers)
+		}
+		c := tm.Components[0]
+		if c.Reversible != want.reversible || c.NumResolutions != want.resolution ||
+			c.CodeBlockWidth != want.codeBlock || c.CodeBlockHeight != want.codeBlock {
+			t.Errorf("tile %d: Reversible, NumResolutions, code-block = %v, %d, %dx%d; want %v, %d, %dx%d",
+				i, c.Reversible, c.NumResolutions, c.CodeBlockWidth, c.CodeBlockHeight,
+				want.reversible, want.resolution, want.codeBlock, want.codeBlock)
+		}
+	}
+
+	// The codestream of a JP2 file is read from its jp2c box
+	buf.Reset()
+	opts.Format = FormatJP2
+	if err := Encode(&buf, codingModesImage(), opts); err != nil {
+		t.Fatalf("Encode(JP2) error: %v", err)
+	}
+	tiles, err = DecodeTileMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(tiles) != 4 || tiles[3].Components[0].CodeBlockWidth != 32 {
+		t.Errorf("DecodeTileMetadata(JP2) = %d tiles, %v; want 4 tiles with 32x32 code-blocks", len(tiles), err)
+	}
+}
+
+func TestRoundtrip_ProgressionOrderChanges(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(x*y + y), uint8(x ^ y*5), 255})
+		}
+	}
+
+	// The two lowest resolutions resolution-first, then the first two
+	// layers of the first two components component-first; the rest
+	// follows layer-first
+	changes := []ProgressionOrderChange{
+		{ResolutionStart: 0, ResolutionEnd: 2, ComponentStart: 0, ComponentEnd: 3, LayerEnd: 3, ProgressionOrder: RLCP},
+		{ResolutionStart: 0, ResolutionEnd: 3, ComponentStart: 0, ComponentEnd: 2, LayerEnd: 2, ProgressionOrder: CPRL},
+	}
+	var buf bytes.Buffer
+	opts := &Options{
+		Format:                  FormatJ2K,
+		Lossless:                true,
+		NumResolutions:          3,
+		NumLayers:               3,
+		TileSize:                image.Pt(32, 32),
+		CodeBlockSize:           image.Pt(3, 3),
+		PrecinctSize:            []image.Point{{3, 3}, {4, 4}},
+		ProgressionOrder:        LRCP,
+		ProgressionOrderChanges: changes,
+	}
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	header, err := codestream.NewParser(bytes.NewReader(data)).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.ProgressionOrderChanges) != len(changes) {
+		t.Fatalf("POC entries = %d, want %d", len(header.ProgressionOrderChanges), len(changes))
+	}
+	if poc := header.ProgressionOrderChanges[1]; poc.ComponentEnd != 2 || poc.LayerEnd != 2 ||
+		codestream.ProgressionOrder(poc.ProgressionOrder) != codestream.CPRL {
+		t.Errorf("POC entry 1 = %+v", poc)
+	}
+
+	for name, data := range map[string][]byte{
+		"main header": data,
+		"tile-parts":  withTilePOC(t, data),
+	} {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if mse, err := MSE(decoded, img); err != nil || mse != 0 {
+				t.Errorf("MSE = %v, %v; want 0", mse, err)
+			}
+		})
+	}
+
+	opts.ProgressionOrderChanges = []ProgressionOrderChange{{ResolutionStart: 1, ResolutionEnd: 1, ComponentEnd: 1, LayerEnd: 1}}
+	if err := Encode(io.Discard, img, opts); err == nil {
+		t.Error("Encode() with an empty resolution range succeeded, want an error")
+	}
+}
+
 func TestEncode_WithNumResolutions(t *testing.T) {
 	img := image.NewGray(image.Rect(0, 0, 64, 64))
 
@@ -972,7 +1619,7 @@ func TestEncode_UnsupportedFormat(t *testing.T) {
 
 	var buf bytes.Buffer
 	opts := DefaultOptions()
-	opts.Format = FormatJPX // JPX not fully supported
+	opts.Format = Format(99)
 
 	err := Encode(&buf, img, opts)
 	if err == nil {
@@ -1620,25 +2267,124 @@ func TestDecodeConfig_MultipleReductions(t *testing.T) {
 	}
 }
 
-// Test Gray with non-8-bit precision scaling
-func TestDecode_GrayPrecisionScaling(t *testing.T) {
-	// Create 8-bit gray image with varied values
-	original := image.NewGray(image.Rect(0, 0, 8, 8))
-	for y := 0; y < 8; y++ {
-		for x := 0; x < 8; x++ {
-			// Vary the value to test scaling
-			original.SetGray(x, y, color.Gray{Y: uint8(x*32 + y)})
+// Test reduced resolution levels of a JP2 file, whose codestream is read
+// from the jp2c box
+func TestDecodeConfig_JP2Reductions(t *testing.T) {
+	// Odd dimensions, so each level rounds up
+	original := image.NewRGBA(image.Rect(0, 0, 45, 27))
+	for y := 0; y < 27; y++ {
+		for x := 0; x < 45; x++ {
+			original.SetRGBA(x, y, color.RGBA{uint8(x * 5), uint8(y * 9), uint8(x * y), 255})
 		}
 	}
 
-	var buf bytes.Buffer
-	opts := DefaultOptions()
-	opts.Format = FormatJ2K
-	opts.Lossless = true
-
-	if err := Encode(&buf, original, opts); err != nil {
-		t.Fatalf("Encode() error: %v", err)
-	}
+	encoded := make(map[Format][]byte)
+	for _, format := range []Format{FormatJP2, FormatJ2K} {
+		var buf bytes.Buffer
+		opts := DefaultOptions()
+		opts.Format = format
+		opts.Lossless = true
+		opts.NumResolutions = 4
+		if err := Encode(&buf, original, opts); err != nil {
+			t.Fatalf("Encode(%s) error: %v", format, err)
+		}
+		encoded[format] = buf.Bytes()
+	}
+
+	for level := 0; level < 4; level++ {
+		cfg := &Config{ReduceResolution: level}
+		decoded, err := DecodeConfig(bytes.NewReader(encoded[FormatJP2]), cfg)
+		if err != nil {
+			t.Fatalf("DecodeConfig() with reduction %d error: %v", level, err)
+		}
+
+		// ceil(dim / 2^level)
+		scale := 1 << level
+		wantW, wantH := (45+scale-1)/scale, (27+scale-1)/scale
+		bounds := decoded.Bounds()
+		if bounds.Dx() != wantW || bounds.Dy() != wantH {
+			t.Errorf("Reduction %d: dimensions = %dx%d, want %dx%d",
+				level, bounds.Dx(), bounds.Dy(), wantW, wantH)
+		}
+
+		// The same pixels as the raw codestream at that level
+		j2k, err := DecodeConfig(bytes.NewReader(encoded[FormatJ2K]), cfg)
+		if err != nil {
+			t.Fatalf("DecodeConfig(J2K) with reduction %d error: %v", level, err)
+		}
+		if mse, err := MSE(decoded, j2k); err != nil || mse != 0 {
+			t.Errorf("Reduction %d: MSE against J2K = %v, %v; want 0", level, mse, err)
+		}
+	}
+
+	// Only 3 decomposition levels can be discarded
+	for _, level := range []int{-1, 4} {
+		if _, err := DecodeConfig(bytes.NewReader(encoded[FormatJP2]), &Config{ReduceResolution: level}); err == nil {
+			t.Errorf("DecodeConfig() with reduction %d succeeded, want an error", level)
+		}
+	}
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	original := image.NewGray(image.Rect(0, 0, 100, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 100; x++ {
+			original.SetGray(x, y, color.Gray{Y: uint8(x*2 + y)})
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Lossless = true
+	opts.NumResolutions = 5 // long edges 100, 50, 25, 13 and 7
+	if err := Encode(&buf, original, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	tests := []struct {
+		maxDim int
+		want   image.Point
+	}{
+		{200, image.Pt(100, 60)},
+		{100, image.Pt(100, 60)},
+		{99, image.Pt(100, 60)},
+		{50, image.Pt(50, 30)},
+		{30, image.Pt(50, 30)},
+		{13, image.Pt(13, 8)},
+		{8, image.Pt(13, 8)},
+		{7, image.Pt(7, 4)},
+		{1, image.Pt(7, 4)},
+	}
+	for _, tt := range tests {
+		thumb, err := DecodeThumbnail(bytes.NewReader(buf.Bytes()), tt.maxDim)
+		if err != nil {
+			t.Fatalf("DecodeThumbnail(%d) error: %v", tt.maxDim, err)
+		}
+		if got := thumb.Bounds().Size(); got != tt.want {
+			t.Errorf("DecodeThumbnail(%d) size = %v, want %v", tt.maxDim, got, tt.want)
+		}
+	}
+}
+
+// Test Gray with non-8-bit precision scaling
+func TestDecode_GrayPrecisionScaling(t *testing.T) {
+	// Create 8-bit gray image with varied values
+	original := image.NewGray(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			// Vary the value to test scaling
+			original.SetGray(x, y, color.Gray{Y: uint8(x*32 + y)})
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Lossless = true
+
+	if err := Encode(&buf, original, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
 
 	decoded, err := Decode(bytes.NewReader(buf.Bytes()))
 	if err != nil {
@@ -2041,11 +2787,93 @@ func TestDecodeMetadata_WithComment(t *testing.T) {
 		t.Fatalf("DecodeMetadata() error: %v", err)
 	}
 
-	// The comment may or may not be preserved depending on implementation
-	// Just verify metadata is valid
 	if meta.Width != 8 || meta.Height != 8 {
 		t.Errorf("Dimensions = %dx%d, want 8x8", meta.Width, meta.Height)
 	}
+	if meta.Comment != opts.Comment {
+		t.Errorf("Comment = %q, want %q", meta.Comment, opts.Comment)
+	}
+}
+
+func TestDecodeMetadata_BinaryComments(t *testing.T) {
+	payloads := [][]byte{
+		{0x00, 0xFF, 0x90, 0xFF, 0xD9, 0x7F},
+		{},
+		[]byte(`{"vendor":"x"}`),
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Comment = "text"
+	opts.BinaryComments = payloads
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if meta.Comment != "text" {
+		t.Errorf("Comment = %q, want %q", meta.Comment, "text")
+	}
+	if len(meta.BinaryComments) != len(payloads) {
+		t.Fatalf("BinaryComments = %q, want %q", meta.BinaryComments, payloads)
+	}
+	for i, want := range payloads {
+		if !bytes.Equal(meta.BinaryComments[i], want) {
+			t.Errorf("BinaryComments[%d] = % X, want % X", i, meta.BinaryComments[i], want)
+		}
+	}
+}
+
+func TestEncode_Comments(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for _, format := range []Format{FormatJ2K, FormatJP2} {
+		var buf bytes.Buffer
+		opts := DefaultOptions()
+		opts.Format = format
+		opts.Comment = "first"
+		opts.Comments = []string{"second", "caf\xe9"}
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("%s: Encode() error: %v", format, err)
+		}
+
+		meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: DecodeMetadata() error: %v", format, err)
+		}
+		want := []string{"first", "second", "caf\xe9"}
+		if len(meta.Comments) != len(want) {
+			t.Fatalf("%s: Comments = %q, want %q", format, meta.Comments, want)
+		}
+		for i := range want {
+			if meta.Comments[i] != want[i] {
+				t.Errorf("%s: Comments = %q, want %q", format, meta.Comments, want)
+				break
+			}
+		}
+		if meta.Comment != "caf\xe9" {
+			t.Errorf("%s: Comment = %q, want the last comment", format, meta.Comment)
+		}
+
+		// Re-encoding with the decoded comments preserves all of them
+		var out bytes.Buffer
+		opts = DefaultOptions()
+		opts.Format = format
+		opts.Comments = meta.Comments
+		if err := Encode(&out, img, opts); err != nil {
+			t.Fatalf("%s: re-Encode() error: %v", format, err)
+		}
+		again, err := DecodeMetadata(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: DecodeMetadata() error: %v", format, err)
+		}
+		if len(again.Comments) != len(want) || again.Comments[1] != "second" {
+			t.Errorf("%s: after transcoding Comments = %q, want %q", format, again.Comments, want)
+		}
+	}
 }
 
 // Test metadata bits per component and signed fields
@@ -2699,6 +3527,78 @@ func TestEncode_CustomPrecision10BitFrom16Bit(t *testing.T) {
 	}
 }
 
+func TestEncode_ComponentPrecision(t *testing.T) {
+	// 8-bit colour with a 1-bit alpha mask
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < 256; i++ {
+		a := uint8(0)
+		if i%3 == 0 {
+			a = 255
+		}
+		img.SetNRGBA(i%16, i/16, color.NRGBA{uint8(i), uint8(255 - i), uint8(i * 5), a})
+	}
+
+	for _, opts := range []*Options{
+		{Format: FormatJ2K, Lossless: true, ComponentPrecision: []int{0, 0, 0, 1}},
+		{Format: FormatJP2, Lossless: true, ComponentPrecision: []int{8, 8, 8, 1}},
+		{Format: FormatJP2, Quality: 80, ComponentPrecision: []int{0, 0, 0, 1}},
+		{Format: FormatJ2K, Lossless: true, Precision: 6, ComponentPrecision: []int{0, 4}},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode(%+v) error: %v", opts, err)
+		}
+
+		want := []int{8, 8, 8, 8}
+		if opts.Precision != 0 {
+			want = []int{6, 6, 6, 6}
+		}
+		for c, p := range opts.ComponentPrecision {
+			if p != 0 {
+				want[c] = p
+			}
+		}
+		meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeMetadata() error: %v", err)
+		}
+		if !slices.Equal(meta.BitsPerComponent, want) {
+			t.Errorf("BitsPerComponent = %v, want %v", meta.BitsPerComponent, want)
+		}
+		if issues := Validate(bytes.NewReader(buf.Bytes())); len(issues) > 0 {
+			t.Errorf("Validate() = %v", issues)
+		}
+
+		planes, _, err := DecodeComponents(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatalf("DecodeComponents() error: %v", err)
+		}
+		if !opts.Lossless {
+			continue
+		}
+		// Samples are rescaled to Precision, then to the component's own
+		scale := func(v int32, from, to int) int32 { return v * (1<<to - 1) / (1<<from - 1) }
+		base := 8
+		if opts.Precision != 0 {
+			base = opts.Precision
+		}
+		for i := 0; i < 256; i++ {
+			c := img.NRGBAAt(i%16, i/16)
+			for k, v := range []uint8{c.R, c.G, c.B, c.A} {
+				w := scale(scale(int32(v), 8, base), base, want[k])
+				if got := planes[k][i]; got != w {
+					t.Fatalf("component %d sample %d = %d, want %d", k, i, got, w)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{ComponentPrecision: []int{17}}); err == nil {
+		t.Error("Encode() with a 17-bit component succeeded")
+	}
+}
+
 // Test NRGBA64 roundtrip exercises 16-bit RGBA decode path (4 components, precision > 8)
 func TestDecode_NRGBA64Roundtrip(t *testing.T) {
 	// Create 16-bit RGBA image with alpha
@@ -2755,3 +3655,3495 @@ func TestDecode_NRGBA64Roundtrip(t *testing.T) {
 		}
 	}
 }
+
+// mapTileCache is a simple TileCache that records hits and misses.
+type mapTileCache struct {
+	tiles  map[string]image.Image
+	hits   int
+	misses int
+}
+
+func (c *mapTileCache) Get(key string) (image.Image, bool) {
+	img, ok := c.tiles[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return img, ok
+}
+
+func (c *mapTileCache) Set(key string, img image.Image) {
+	c.tiles[key] = img
+}
+
+func TestDecodeConfig_TileCache(t *testing.T) {
+	original := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			original.SetGray(x, y, color.Gray{Y: uint8(x*8 + y)})
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Lossless = true
+	if err := Encode(&buf, original, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	cache := &mapTileCache{tiles: make(map[string]image.Image)}
+	cfg := &Config{TileCache: cache}
+
+	first, err := DecodeConfig(bytes.NewReader(buf.Bytes()), cfg)
+	if err != nil {
+		t.Fatalf("first DecodeConfig() error: %v", err)
+	}
+	if cache.hits != 0 || cache.misses != 1 || len(cache.tiles) != 1 {
+		t.Fatalf("after first decode: hits=%d misses=%d entries=%d; want 0, 1, 1",
+			cache.hits, cache.misses, len(cache.tiles))
+	}
+
+	second, err := DecodeConfig(bytes.NewReader(buf.Bytes()), cfg)
+	if err != nil {
+		t.Fatalf("second DecodeConfig() error: %v", err)
+	}
+	if cache.hits != 1 {
+		t.Errorf("after second decode: hits=%d; want 1", cache.hits)
+	}
+
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if first.At(x, y) != second.At(x, y) {
+				t.Fatalf("At(%d,%d): cached decode = %v, want %v", x, y, second.At(x, y), first.At(x, y))
+			}
+		}
+	}
+
+	// A different reduction level must not reuse the cached tile
+	cfg.ReduceResolution = 1
+	if _, err := DecodeConfig(bytes.NewReader(buf.Bytes()), cfg); err != nil {
+		t.Fatalf("reduced DecodeConfig() error: %v", err)
+	}
+	if cache.hits != 1 || len(cache.tiles) != 2 {
+		t.Errorf("after reduced decode: hits=%d entries=%d; want 1, 2", cache.hits, len(cache.tiles))
+	}
+}
+
+func TestDecode_JP2ZeroLengthCodestreamBox(t *testing.T) {
+	original := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			original.SetGray(x, y, color.Gray{Y: uint8(x*16 + y)})
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJP2
+	opts.Lossless = true
+	if err := Encode(&buf, original, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	want, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() of the length-terminated file error: %v", err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	// Locate the jp2c box and set its length to 0 (extends to EOF)
+	found := false
+	for pos := 0; pos+8 <= len(data); {
+		length := int(data[pos])<<24 | int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		if string(data[pos+4:pos+8]) == "jp2c" {
+			data[pos], data[pos+1], data[pos+2], data[pos+3] = 0, 0, 0, 0
+			found = true
+			break
+		}
+		pos += length
+	}
+	if !found {
+		t.Fatal("jp2c box not found in encoded output")
+	}
+
+	decoded, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 16 || b.Dy() != 16 {
+		t.Errorf("dimensions = %dx%d, want 16x16", b.Dx(), b.Dy())
+	}
+	if mse, err := MSE(decoded, want); err != nil || mse != 0 {
+		t.Errorf("MSE against the length-terminated decode = %v, %v; want 0", mse, err)
+	}
+
+	m, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.Format != FormatJP2 {
+		t.Errorf("Format = %v, want JP2", m.Format)
+	}
+}
+
+func TestDecode_JP2ExtendedLengthBoxes(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJP2, Lossless: true}
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Rewrite the jp2c box with an XLBox length and put an XL uuid box
+	// in front of it
+	var out []byte
+	for pos := 0; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if string(data[pos+4:pos+8]) != "jp2c" {
+			out = append(out, data[pos:pos+length]...)
+			pos += length
+			continue
+		}
+		out = append(out, 0, 0, 0, 1, 'u', 'u', 'i', 'd')
+		out = binary.BigEndian.AppendUint64(out, 16+20)
+		out = append(out, make([]byte, 20)...)
+
+		contents := data[pos+8 : pos+length]
+		out = append(out, 0, 0, 0, 1, 'j', 'p', '2', 'c')
+		out = binary.BigEndian.AppendUint64(out, uint64(16+len(contents)))
+		out = append(out, contents...)
+		break
+	}
+
+	img, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 16, 16) {
+		t.Errorf("Bounds() = %v, want 16x16", img.Bounds())
+	}
+	if issues := Validate(bytes.NewReader(out)); len(issues) != 0 {
+		t.Errorf("Validate() = %v", issues)
+	}
+	if err := ValidateStructure(bytes.NewReader(out)); err != nil {
+		t.Errorf("ValidateStructure() error: %v", err)
+	}
+}
+
+func TestEncode_WriteTLM(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x + y*8)})
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "tlm-*.j2k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Lossless = true
+	opts.WriteTLM = true
+	if err := Encode(f, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser := codestream.NewParser(bytes.NewReader(data))
+	header, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.TileLengths) != 1 {
+		t.Fatalf("TLM entries = %d, want 1", len(header.TileLengths))
+	}
+	tl := header.TileLengths[0]
+	if tl.TileIndex != 0 {
+		t.Errorf("TLM tile index = %d, want 0", tl.TileIndex)
+	}
+
+	// The tile-part length must span from its SOT marker to the EOC marker
+	sot := bytes.Index(data, []byte{0xFF, 0x90, 0x00, 0x0A})
+	if sot < 0 {
+		t.Fatal("SOT marker not found")
+	}
+	if want := uint32(len(data) - 2 - sot); tl.Length != want {
+		t.Errorf("TLM tile-part length = %d, want %d", tl.Length, want)
+	}
+
+	if _, err := Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("Decode() error: %v", err)
+	}
+}
+
+func TestEncode_WriteTLMManyTileParts(t *testing.T) {
+	// 11000 one-pixel tiles need more entries than one TLM segment holds
+	img := image.NewGray(image.Rect(0, 0, 110, 100))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 1, TileSize: image.Pt(1, 1), WriteTLM: true}
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Two segments, numbered in order
+	var ztlm []byte
+	for pos := 2; binary.BigEndian.Uint16(data[pos:]) != uint16(codestream.SOT); {
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if binary.BigEndian.Uint16(data[pos:]) == uint16(codestream.TLM) {
+			ztlm = append(ztlm, data[pos+4])
+		}
+		pos += 2 + n
+	}
+	if !bytes.Equal(ztlm, []byte{0, 1}) {
+		t.Errorf("TLM segments with Ztlm %v, want [0 1]", ztlm)
+	}
+
+	header, err := codestream.NewParser(bytes.NewReader(data)).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.TileLengths) != 11000 {
+		t.Fatalf("TLM entries = %d, want 11000", len(header.TileLengths))
+	}
+	for i, tl := range header.TileLengths {
+		if int(tl.TileIndex) != i {
+			t.Fatalf("TLM entry %d has tile index %d", i, tl.TileIndex)
+		}
+	}
+
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if psnr, _ := PSNR(img, got); !math.IsInf(psnr, 1) {
+		t.Errorf("PSNR = %v, want +Inf", psnr)
+	}
+}
+
+func TestEncode_EmitPLT(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x * y), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.NumResolutions = 4
+	opts.EmitPLT = true
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	rs := bytes.NewReader(data)
+	parser := codestream.NewParser(rs)
+	if _, err := parser.ReadHeader(); err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	tph, err := parser.ReadTilePartHeader()
+	if err != nil {
+		t.Fatalf("ReadTilePartHeader() error: %v", err)
+	}
+
+	// One packet per component and resolution
+	if got, want := len(tph.PacketLengths), 3*4; got != want {
+		t.Fatalf("%d packet lengths, want %d", got, want)
+	}
+
+	// The packets fill the tile-part from SOD to EOC
+	var total int64
+	for _, l := range tph.PacketLengths {
+		total += int64(l)
+	}
+	sod := rs.Size() - int64(rs.Len())
+	if want := int64(len(data)) - 2 - sod; total != want {
+		t.Errorf("packet lengths sum to %d, want %d", total, want)
+	}
+
+	if err := ValidateStructure(bytes.NewReader(data)); err != nil {
+		t.Errorf("ValidateStructure() error: %v", err)
+	}
+	if _, err := Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("Decode() error: %v", err)
+	}
+}
+
+func TestGeneratePLT(t *testing.T) {
+	lengths := []int{0, 127, 128, 20000, 1 << 28}
+	plt := generatePLT(lengths)
+	want := []byte{0xFF, 0x58, 0x00, 0x0F, 0x00,
+		0x00, 0x7F, 0x81, 0x00, 0x81, 0x9C, 0x20, 0x81, 0x80, 0x80, 0x80, 0x00}
+	if !bytes.Equal(plt, want) {
+		t.Errorf("generatePLT() = % X, want % X", plt, want)
+	}
+
+	// Lengths that overflow one segment continue in the next
+	many := make([]int, 40000)
+	for i := range many {
+		many[i] = 300 // two bytes each
+	}
+	plt = generatePLT(many)
+	var got []int
+	v := 0
+	for pos := 0; pos < len(plt); {
+		if binary.BigEndian.Uint16(plt[pos:]) != uint16(codestream.PLT) {
+			t.Fatalf("no PLT marker at offset %d", pos)
+		}
+		n := int(binary.BigEndian.Uint16(plt[pos+2:]))
+		if zplt := int(plt[pos+4]); pos == 0 && zplt != 0 || pos > 0 && zplt != 1 {
+			t.Errorf("Zplt = %d at offset %d", zplt, pos)
+		}
+		// Iplt: seven bits per byte, high bit set on all but the last
+		for _, c := range plt[pos+5 : pos+2+n] {
+			v = v<<7 | int(c&0x7F)
+			if c&0x80 == 0 {
+				got = append(got, v)
+				v = 0
+			}
+		}
+		pos += 2 + n
+	}
+	if len(got) != len(many) {
+		t.Errorf("decoded %d lengths, want %d", len(got), len(many))
+	}
+}
+
+func TestEncode_WriteTLMNonSeekable(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 48, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 48; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 5), uint8(y * 6), uint8(x ^ y), 255})
+		}
+	}
+
+	// A bytes.Buffer does not implement io.Seeker
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.WriteTLM = true
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	rs := bytes.NewReader(buf.Bytes())
+	parser := codestream.NewParser(rs)
+	header, err := parser.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if len(header.TileLengths) == 0 {
+		t.Fatal("no TLM entries")
+	}
+
+	// Every TLM entry must match the Psot of the tile-part it describes
+	for i, tl := range header.TileLengths {
+		if err := parser.SeekToTile(rs, int(tl.TileIndex)); err != nil {
+			t.Fatalf("SeekToTile(%d) error: %v", tl.TileIndex, err)
+		}
+		tph, err := parser.ReadTilePartHeader()
+		if err != nil {
+			t.Fatalf("ReadTilePartHeader() error: %v", err)
+		}
+		if tph.TileIndex != tl.TileIndex || tph.TilePartLength != tl.Length {
+			t.Errorf("TLM entry %d = tile %d, length %d; SOT has tile %d, Psot %d",
+				i, tl.TileIndex, tl.Length, tph.TileIndex, tph.TilePartLength)
+		}
+	}
+}
+
+func TestEncode_ForceReversible(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 8), 128, 255})
+		}
+	}
+
+	tests := []struct {
+		name            string
+		forceReversible bool
+		wantWavelet     int
+	}{
+		{"irreversible", false, 0},
+		{"forced", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &Options{
+				Format:          FormatJ2K,
+				Lossless:        false,
+				Quality:         50,
+				NumResolutions:  3,
+				ForceReversible: tt.forceReversible,
+			}
+			if err := Encode(&buf, img, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			m, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeMetadata() error: %v", err)
+			}
+			if m.WaveletTransform != tt.wantWavelet {
+				t.Errorf("WaveletTransform = %d, want %d", m.WaveletTransform, tt.wantWavelet)
+			}
+		})
+	}
+}
+
+func TestEncode_CodeBlockStyle(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+
+	tests := []struct {
+		name  string
+		style CodeBlockStyle
+		want  uint8
+	}{
+		{"none", CodeBlockStyle{}, 0},
+		{"segmentation symbols", CodeBlockStyle{SegmentationSymbols: true}, codestream.CodeBlockSegmentationSymbols},
+		{"all", CodeBlockStyle{
+			Selective:              true,
+			ResetOnBoundaries:      true,
+			TerminateOnPass:        true,
+			Causal:                 true,
+			PredictableTermination: true,
+			SegmentationSymbols:    true,
+		}, 0x3F},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2, CodeBlockStyle: tt.style}
+			if err := Encode(&buf, img, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+			if err != nil {
+				t.Fatalf("ReadHeader() error: %v", err)
+			}
+			if got := h.CodingStyle.CodeBlockStyle; got != tt.want {
+				t.Errorf("Scb = %#02x, want %#02x", got, tt.want)
+			}
+		})
+	}
+}
+
+// codingModesImage returns a gray image busy enough to need more than the
+// four bit-planes that bypass mode keeps arithmetic coded.
+func codingModesImage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x*37 + y*101 + x*y)})
+		}
+	}
+	return img
+}
+
+func TestDecode_BypassFixture(t *testing.T) {
+	// testdata/bypass.j2k holds codingModesImage, coded losslessly with
+	// selective arithmetic coding bypass
+	data, err := os.ReadFile("testdata/bypass.j2k")
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+
+	h, err := codestream.NewParser(bytes.NewReader(data)).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if h.CodingStyle.CodeBlockStyle&codestream.CodeBlockBypass == 0 {
+		t.Fatalf("Scb = %#02x, want the bypass flag", h.CodingStyle.CodeBlockStyle)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	want := codingModesImage()
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if got := color.GrayModel.Convert(img.At(x, y)).(color.Gray); got != want.GrayAt(x, y) {
+				t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got.Y, want.GrayAt(x, y).Y)
+			}
+		}
+	}
+}
+
+func TestDecode_PackedPacketHeaders(t *testing.T) {
+	// The fixtures hold codingModesImage in 2x2 tiles with two quality
+	// layers, coded losslessly, with the packet headers moved into PPM
+	// marker segments in the main header (without SOP or EPH markers) or
+	// into PPT marker segments in each tile-part header (with both)
+	for _, name := range []string{"ppm.j2k", "ppt.j2k"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/" + name)
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+
+			img, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			want := codingModesImage()
+			for y := 0; y < 32; y++ {
+				for x := 0; x < 32; x++ {
+					if got := color.GrayModel.Convert(img.At(x, y)).(color.Gray); got != want.GrayAt(x, y) {
+						t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got.Y, want.GrayAt(x, y).Y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecode_HTJ2KUnsupported(t *testing.T) {
+	img := codingModesImage()
+	var ht bytes.Buffer
+	if err := Encode(&ht, img, &Options{Format: FormatJP2, Lossless: true, HighThroughput: true}); err != nil {
+		t.Fatalf("Encode(HighThroughput) error: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := Encode(&plain, img, &Options{Format: FormatJP2, Lossless: true}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	m, err := DecodeMetadata(bytes.NewReader(ht.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if !m.IsHTJ2K {
+		t.Error("IsHTJ2K = false for an HTJ2K file")
+	}
+	if m, err := DecodeMetadata(bytes.NewReader(plain.Bytes())); err != nil || m.IsHTJ2K {
+		t.Errorf("DecodeMetadata() of a Part 1 file = IsHTJ2K %v, error %v; want false, nil", m != nil && m.IsHTJ2K, err)
+	}
+
+	if _, err := Decode(bytes.NewReader(ht.Bytes())); !errors.Is(err, ErrUnsupportedHTJ2K) {
+		t.Errorf("Decode() error = %v, want ErrUnsupportedHTJ2K", err)
+	}
+	err = DecodeTiles(bytes.NewReader(ht.Bytes()), func(image.Image, int, int) error { return nil })
+	if !errors.Is(err, ErrUnsupportedHTJ2K) {
+		t.Errorf("DecodeTiles() error = %v, want ErrUnsupportedHTJ2K", err)
+	}
+	var feature *UnsupportedFeatureError
+	if !errors.Is(err, ErrUnsupportedFeature) || !errors.As(err, &feature) || feature.Feature == "" {
+		t.Errorf("DecodeTiles() error = %v, want an UnsupportedFeatureError", err)
+	}
+}
+
+func TestDecode_ErrorTypes(t *testing.T) {
+	img := codingModesImage()
+	var j2k, jp2 bytes.Buffer
+	if err := Encode(&j2k, img, &Options{Format: FormatJ2K, Lossless: true}); err != nil {
+		t.Fatalf("Encode(J2K) error: %v", err)
+	}
+	if err := Encode(&jp2, img, &Options{Format: FormatJP2, Lossless: true}); err != nil {
+		t.Fatalf("Encode(JP2) error: %v", err)
+	}
+
+	badSignature := append([]byte(nil), jp2.Bytes()...)
+	badSignature[11] = 0x0B // corrupt the signature box contents
+
+	badCodestream := append([]byte(nil), jp2.Bytes()...)
+	i := bytes.Index(badCodestream, []byte("jp2c"))
+	badCodestream[i+4] = 0x00 // SOC of the contiguous codestream box
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"PNG", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ErrInvalidSignature},
+		{"short text", []byte("GIF"), ErrInvalidSignature},
+		{"JP2 signature box", badSignature, ErrInvalidSignature},
+		{"JP2 codestream SOC", badCodestream, ErrInvalidSignature},
+		{"empty", nil, ErrTruncated},
+		{"J2K SOC only", j2k.Bytes()[:2], ErrTruncated},
+		{"J2K main header", j2k.Bytes()[:30], ErrTruncated},
+		{"JP2 signature only", jp2.Bytes()[:6], ErrTruncated},
+		{"JP2 boxes", jp2.Bytes()[:40], ErrTruncated},
+		{"JP2 codestream header", jp2.Bytes()[:i+30], ErrTruncated},
+	}
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(tt.data))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Decode() error = %v, want %v", tt.name, err, tt.want)
+		}
+		for _, other := range []error{ErrInvalidSignature, ErrTruncated, ErrUnsupportedFeature} {
+			if other != tt.want && errors.Is(err, other) {
+				t.Errorf("%s: Decode() error = %v, which is also %v", tt.name, err, other)
+			}
+		}
+		if _, err := DecodeHeader(bytes.NewReader(tt.data)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: DecodeHeader() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecode_TruncatedTileData(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x*y + x ^ y)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Format: FormatJ2K, Lossless: true}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// The tile-part's Psot runs past the end of the data, or only the
+	// EOC marker is missing
+	for _, n := range []int{len(data) * 30 / 100, len(data) * 60 / 100, len(data) * 90 / 100, len(data) * 99 / 100, len(data) - 2} {
+		if _, err := Decode(bytes.NewReader(data[:n])); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d of %d bytes: Decode() error = %v, want ErrTruncated", n, len(data), err)
+		}
+		if _, err := DecodeConfig(bytes.NewReader(data[:n]), &Config{ErrorResilient: true}); err != nil {
+			t.Errorf("%d of %d bytes: resilient DecodeConfig() error: %v", n, len(data), err)
+		}
+	}
+
+	// Psot 0, so the tile-part runs to the EOC marker, and packet data
+	// ending in the middle of a packet
+	sot := bytes.Index(data, []byte{0xFF, 0x90})
+	open := bytes.Clone(data)
+	binary.BigEndian.PutUint32(open[sot+6:], 0)
+	if _, err := Decode(bytes.NewReader(open)); err != nil {
+		t.Fatalf("Psot 0: Decode() error: %v", err)
+	}
+	cut := append(bytes.Clone(open[:len(open)*60/100]), 0xFF, 0xD9)
+	if _, err := Decode(bytes.NewReader(cut)); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Psot 0, cut packet: Decode() error = %v, want ErrTruncated", err)
+	}
+	if _, err := DecodeConfig(bytes.NewReader(cut), &Config{ErrorResilient: true}); err != nil {
+		t.Errorf("Psot 0, cut packet: resilient DecodeConfig() error: %v", err)
+	}
+}
+
+// encode420 returns a lossless three-component J2K codestream with y at
+// full resolution and cb and cr subsampled by two in both directions,
+// carrying a CRG marker with the given Xcrg, Ycrg pairs. Each component
+// is coded on its own in CPRL order, so the codestreams can be spliced:
+// the packets of a single tile are then grouped by component.
+func encode420(t *testing.T, y, cb, cr *image.Gray, reg [3][2]uint16) []byte {
+	t.Helper()
+
+	var main, body []byte
+	for c, img := range []*image.Gray{y, cb, cr} {
+		var buf bytes.Buffer
+		opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 3, ProgressionOrder: CPRL}
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode(component %d) error: %v", c, err)
+		}
+		data := buf.Bytes()
+
+		pos := 2
+		for codestream.Marker(binary.BigEndian.Uint16(data[pos:])) != codestream.SOT {
+			n := int(binary.BigEndian.Uint16(data[pos+2:]))
+			m := codestream.Marker(binary.BigEndian.Uint16(data[pos:]))
+			if c == 0 && m == codestream.SIZ {
+				// The image and tile sizes of y, with three components
+				main = append(main, 0xFF, 0x51)
+				main = binary.BigEndian.AppendUint16(main, 38+3*3)
+				main = append(main, data[pos+4:pos+38]...)
+				main = binary.BigEndian.AppendUint16(main, 3)
+				main = append(main, 7, 1, 1, 7, 2, 2, 7, 2, 2)
+			} else if c == 0 {
+				main = append(main, data[pos:pos+2+n]...)
+			}
+			pos += 2 + n
+		}
+		sod := bytes.Index(data[pos:], []byte{0xFF, 0x93})
+		body = append(body, data[pos+sod+2:len(data)-2]...)
+	}
+
+	out := []byte{0xFF, 0x4F}
+	out = append(out, main...)
+	out = append(out, 0xFF, 0x63)
+	out = binary.BigEndian.AppendUint16(out, 2+4*3)
+	for _, r := range reg {
+		out = binary.BigEndian.AppendUint16(out, r[0])
+		out = binary.BigEndian.AppendUint16(out, r[1])
+	}
+	out = append(out, 0xFF, 0x90, 0x00, 0x0A, 0x00, 0x00)
+	out = binary.BigEndian.AppendUint32(out, uint32(12+2+len(body)))
+	out = append(out, 0x00, 0x01, 0xFF, 0x93)
+	out = append(out, body...)
+	return append(out, 0xFF, 0xD9)
+}
+
+func TestDecode_ComponentRegistration(t *testing.T) {
+	const w, h = 16, 12
+	y := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range y.Pix {
+		y.Pix[i] = uint8(i * 7)
+	}
+	// Chroma ramps: cb across, cr down
+	cb := image.NewGray(image.Rect(0, 0, w/2, h/2))
+	cr := image.NewGray(image.Rect(0, 0, w/2, h/2))
+	for j := 0; j < h/2; j++ {
+		for i := 0; i < w/2; i++ {
+			cb.SetGray(i, j, color.Gray{Y: uint8(20 + 24*i)})
+			cr.SetGray(i, j, color.Gray{Y: uint8(30 + 36*j)})
+		}
+	}
+
+	// interp returns the chroma ramp value at sample position u, linear
+	// between samples and clamped to the first and last
+	interp := func(u float64, base, step, n int) int {
+		u = math.Max(0, math.Min(u, float64(n-1)))
+		return int(math.Round(float64(base) + float64(step)*u))
+	}
+
+	tests := []struct {
+		name string
+		reg  [3][2]uint16
+		off  float64 // chroma offset, in chroma samples
+	}{
+		{"co-sited", [3][2]uint16{}, 0},
+		{"centred", [3][2]uint16{{0, 0}, {32768, 32768}, {32768, 32768}}, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encode420(t, y, cb, cr, tt.reg)
+
+			h2, err := DecodeHeader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("DecodeHeader() error: %v", err)
+			}
+			if c := h2.Components[1]; c.SubsamplingX != 2 || c.SubsamplingY != 2 {
+				t.Fatalf("chroma subsampling = %dx%d, want 2x2", c.SubsamplingX, c.SubsamplingY)
+			}
+			if c := h2.Components[2]; c.RegistrationX != int(tt.reg[2][0]) || c.RegistrationY != int(tt.reg[2][1]) {
+				t.Errorf("chroma registration = (%d, %d), want %v", c.RegistrationX, c.RegistrationY, tt.reg[2])
+			}
+
+			img, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if img.Bounds() != y.Bounds() {
+				t.Fatalf("bounds = %v, want %v", img.Bounds(), y.Bounds())
+			}
+			rgba := img.(*image.RGBA)
+			for py := 0; py < h; py++ {
+				for px := 0; px < w; px++ {
+					got := rgba.RGBAAt(px, py)
+					wantG := interp(float64(px)/2-tt.off, 20, 24, w/2)
+					wantB := interp(float64(py)/2-tt.off, 30, 36, h/2)
+					if got.R != y.GrayAt(px, py).Y || abs(int32(got.G)-int32(wantG)) > 1 || abs(int32(got.B)-int32(wantB)) > 1 {
+						t.Fatalf("pixel (%d,%d) = %v, want (%d, %d, %d)", px, py, got, y.GrayAt(px, py).Y, wantG, wantB)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRoundtrip_CodeBlockStyle(t *testing.T) {
+	img := codingModesImage()
+
+	tests := []struct {
+		name  string
+		style CodeBlockStyle
+	}{
+		{"bypass", CodeBlockStyle{Selective: true}},
+		{"reset", CodeBlockStyle{ResetOnBoundaries: true}},
+		{"terminate", CodeBlockStyle{TerminateOnPass: true}},
+		{"causal", CodeBlockStyle{Causal: true}},
+		{"predictable", CodeBlockStyle{Selective: true, PredictableTermination: true}},
+		{"segmentation symbols", CodeBlockStyle{SegmentationSymbols: true}},
+		{"all", CodeBlockStyle{
+			Selective:              true,
+			ResetOnBoundaries:      true,
+			TerminateOnPass:        true,
+			Causal:                 true,
+			PredictableTermination: true,
+			SegmentationSymbols:    true,
+		}},
+	}
+	for _, tt := range tests {
+		for _, layers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s/%d layers", tt.name, layers), func(t *testing.T) {
+				var buf bytes.Buffer
+				opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 3, NumLayers: layers, CodeBlockStyle: tt.style}
+				if err := Encode(&buf, img, opts); err != nil {
+					t.Fatalf("Encode() error: %v", err)
+				}
+				decoded, err := Decode(&buf)
+				if err != nil {
+					t.Fatalf("Decode() error: %v", err)
+				}
+				for y := 0; y < 32; y++ {
+					for x := 0; x < 32; x++ {
+						if got := color.GrayModel.Convert(decoded.At(x, y)).(color.Gray); got != img.GrayAt(x, y) {
+							t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got.Y, img.GrayAt(x, y).Y)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncode_MCT(t *testing.T) {
+	rgb := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	gray := image.NewGray(image.Rect(0, 0, 16, 16))
+
+	tests := []struct {
+		name       string
+		img        image.Image
+		mct        int
+		colorSpace ColorSpace
+		want       uint8
+	}{
+		{"unset", rgb, 0, ColorSpaceUnspecified, 1},
+		{"none", rgb, MCTNone, ColorSpaceSRGB, 0},
+		{"auto sRGB", rgb, MCTAuto, ColorSpaceSRGB, 1},
+		{"auto sYCC", rgb, MCTAuto, ColorSpaceSYCC, 0},
+		{"force sYCC", rgb, MCTForce, ColorSpaceSYCC, 1},
+		{"force gray", gray, MCTForce, ColorSpaceGray, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &Options{
+				Format:         FormatJ2K,
+				Lossless:       true,
+				NumResolutions: 2,
+				MCT:            tt.mct,
+				ColorSpace:     tt.colorSpace,
+			}
+			if err := Encode(&buf, tt.img, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+			if err != nil {
+				t.Fatalf("ReadHeader() error: %v", err)
+			}
+			if got := h.CodingStyle.MultipleComponentXf; got != tt.want {
+				t.Errorf("COD MultipleComponentTransform = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncode_NoMCT(t *testing.T) {
+	// Three uncorrelated bands
+	src := image.NewRGBA(image.Rect(0, 0, 24, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 24; x++ {
+			src.SetRGBA(x, y, color.RGBA{uint8(x * 10), uint8(y*y + 7), uint8((x * y) ^ 0x55), 255})
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Lossless = true
+	opts.MCT = MCTForce
+	opts.NoMCT = true
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// NoMCT is shorthand for MCTNone
+	opts.MCT, opts.NoMCT = MCTNone, false
+	var none bytes.Buffer
+	if err := Encode(&none, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), none.Bytes()) {
+		t.Error("NoMCT and MCT: MCTNone encode differently")
+	}
+
+	h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if got := h.CodingStyle.MultipleComponentXf; got != 0 {
+		t.Errorf("COD MultipleComponentTransform = %d, want 0", got)
+	}
+
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 24; x++ {
+			r0, g0, b0, _ := img.At(x, y).RGBA()
+			r1, g1, b1, _ := src.At(x, y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, img.At(x, y), src.At(x, y))
+			}
+		}
+	}
+}
+
+func TestEncode_SparsityThreshold(t *testing.T) {
+	// A flat image with one bright pixel leaves most high-pass blocks sparse
+	img := image.NewGray(image.Rect(0, 0, 128, 128))
+	for i := range img.Pix {
+		img.Pix[i] = 128
+	}
+	img.Pix[64*128+64] = 255
+
+	encode := func(threshold float64) int {
+		var buf bytes.Buffer
+		opts := &Options{
+			Format:            FormatJ2K,
+			Quality:           50,
+			NumResolutions:    3,
+			CodeBlockSize:     image.Point{4, 4},
+			SparsityThreshold: threshold,
+		}
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Len()
+	}
+
+	full := encode(0)
+	skipped := encode(0.5)
+	if skipped >= full {
+		t.Errorf("SparsityThreshold=0.5 output %d bytes, want fewer than %d", skipped, full)
+	}
+}
+
+func TestProfile_Constraints(t *testing.T) {
+	if c := ProfileNone.Constraints(); c.MaxWidth != 0 || c.MaxDecompositions != 0 || c.AllowedProgressionOrders != nil {
+		t.Errorf("ProfileNone.Constraints() = %+v, want no limits", c)
+	}
+
+	tests := []struct {
+		profile       Profile
+		maxWidth      int
+		maxCodeBlock  int
+		maxDecomp     int
+		maxBitDepth   int
+		progressionOK ProgressionOrder
+	}{
+		{ProfileCinema2K, 2048, 1024, 5, 12, CPRL},
+		{ProfileCinema4K, 4096, 1024, 6, 12, CPRL},
+		{ProfileBroadcastSingle, 0, 4096, 5, 12, CPRL},
+		{ProfileBroadcastSingle | 0x0003, 0, 4096, 5, 12, CPRL},
+	}
+	for _, tt := range tests {
+		c := tt.profile.Constraints()
+		if c.MaxWidth != tt.maxWidth || c.MaxCodeBlockArea != tt.maxCodeBlock ||
+			c.MaxDecompositions != tt.maxDecomp || c.MaxBitDepth != tt.maxBitDepth {
+			t.Errorf("Profile(%#04x).Constraints() = %+v", uint16(tt.profile), c)
+		}
+		if len(c.AllowedProgressionOrders) != 1 || c.AllowedProgressionOrders[0] != tt.progressionOK {
+			t.Errorf("Profile(%#04x) progression orders = %v, want [%v]",
+				uint16(tt.profile), c.AllowedProgressionOrders, tt.progressionOK)
+		}
+	}
+}
+
+func TestDecode_ImageOffset(t *testing.T) {
+	const w, h = 16, 12
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// Move the image area to (5, 3) on the reference grid, keeping one tile
+	data := buf.Bytes()
+	siz := data[4:]
+	binary.BigEndian.PutUint32(siz[4:], w+5)  // Xsiz
+	binary.BigEndian.PutUint32(siz[8:], h+3)  // Ysiz
+	binary.BigEndian.PutUint32(siz[12:], 5)   // XOsiz
+	binary.BigEndian.PutUint32(siz[16:], 3)   // YOsiz
+	binary.BigEndian.PutUint32(siz[20:], w+5) // XTsiz
+	binary.BigEndian.PutUint32(siz[24:], h+3) // YTsiz
+
+	m, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.Width != w || m.Height != h {
+		t.Errorf("Metadata size = %dx%d, want %dx%d", m.Width, m.Height, w, h)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if want := image.Rect(5, 3, 5+w, 3+h); img.Bounds() != want {
+		t.Errorf("Bounds() = %v, want %v", img.Bounds(), want)
+	}
+
+	img, err = DecodeConfig(bytes.NewReader(data), &Config{ReduceResolution: 1})
+	if err != nil {
+		t.Fatalf("DecodeConfig() error: %v", err)
+	}
+	if want := image.Rect(3, 2, 3+w/2, 2+h/2); img.Bounds() != want {
+		t.Errorf("reduced Bounds() = %v, want %v", img.Bounds(), want)
+	}
+}
+
+func TestDecode_TileOffsets(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2, TileSize: image.Pt(8, 8)}
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// Put the 16x16 image area at (5, 4) and the 8x8 tile grid at (3, 1),
+	// so the edge tiles are partial: columns start at 3, 11 and 19, rows
+	// at 1, 9 and 17.
+	data := buf.Bytes()
+	siz := data[4:]
+	binary.BigEndian.PutUint32(siz[4:], 21) // Xsiz
+	binary.BigEndian.PutUint32(siz[8:], 20) // Ysiz
+	binary.BigEndian.PutUint32(siz[12:], 5) // XOsiz
+	binary.BigEndian.PutUint32(siz[16:], 4) // YOsiz
+	binary.BigEndian.PutUint32(siz[28:], 3) // XTOsiz
+	binary.BigEndian.PutUint32(siz[32:], 1) // YTOsiz
+
+	h, err := DecodeHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeHeader() error: %v", err)
+	}
+	if h.NumTilesX != 3 || h.NumTilesY != 3 {
+		t.Errorf("tiles = %dx%d, want 3x3", h.NumTilesX, h.NumTilesY)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if want := image.Rect(5, 4, 21, 20); img.Bounds() != want {
+		t.Errorf("Bounds() = %v, want %v", img.Bounds(), want)
+	}
+
+	want := map[image.Point]image.Rectangle{
+		{0, 0}: image.Rect(5, 4, 11, 9),
+		{1, 1}: image.Rect(11, 9, 19, 17),
+		{2, 2}: image.Rect(19, 17, 21, 20),
+	}
+	var covered int
+	err = DecodeTiles(bytes.NewReader(data), func(tile image.Image, tx, ty int) error {
+		covered += tile.Bounds().Dx() * tile.Bounds().Dy()
+		if r, ok := want[image.Pt(tx, ty)]; ok && tile.Bounds() != r {
+			t.Errorf("tile (%d, %d) Bounds() = %v, want %v", tx, ty, tile.Bounds(), r)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeTiles() error: %v", err)
+	}
+	if covered != 16*16 {
+		t.Errorf("tiles cover %d samples, want %d", covered, 16*16)
+	}
+
+	// A tile grid starting after the image area is rejected
+	binary.BigEndian.PutUint32(siz[28:], 6) // XTOsiz
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("Decode() with XTOsiz > XOsiz: expected error")
+	}
+}
+
+func TestExportCodestream(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	opts := DefaultOptions()
+
+	data, err := ExportCodestream(img, opts)
+	if err != nil {
+		t.Fatalf("ExportCodestream() error: %v", err)
+	}
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0x4F {
+		t.Error("ExportCodestream output should start with SOC marker")
+	}
+	if opts.Format != FormatJP2 {
+		t.Errorf("ExportCodestream modified opts.Format to %v", opts.Format)
+	}
+
+	if _, err := ExportCodestream(img, nil); err != nil {
+		t.Errorf("ExportCodestream(nil options) error: %v", err)
+	}
+}
+
+func TestCompressedSize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 200; x++ {
+			v := uint8((x*x + y*3) >> 4)
+			img.Set(x, y, color.RGBA{v, uint8(x + y), uint8(x ^ y), 255})
+		}
+	}
+
+	tests := []struct {
+		name     string
+		lossless bool
+		format   Format
+	}{
+		{"lossless J2K", true, FormatJ2K},
+		{"lossy J2K", false, FormatJ2K},
+		{"lossless JP2", true, FormatJP2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Lossless = tt.lossless
+			opts.Format = tt.format
+
+			var buf bytes.Buffer
+			if err := Encode(&buf, img, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			est, err := CompressedSize(img, opts)
+			if err != nil {
+				t.Fatalf("CompressedSize() error: %v", err)
+			}
+
+			actual := buf.Len()
+			if diff := float64(est-actual) / float64(actual); diff < -0.2 || diff > 0.2 {
+				t.Errorf("CompressedSize() = %d, actual %d (%.1f%% off)", est, actual, diff*100)
+			}
+		})
+	}
+}
+
+func TestCompressedSize_SmallImageExact(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+
+	opts := DefaultOptions()
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	est, err := CompressedSize(img, opts)
+	if err != nil {
+		t.Fatalf("CompressedSize() error: %v", err)
+	}
+	if est != buf.Len() {
+		t.Errorf("CompressedSize() = %d, want exact size %d", est, buf.Len())
+	}
+}
+
+func TestEncode_CinemaFrameRate(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+
+	opts := DefaultOptions()
+	opts.Profile = ProfileCinema2K
+	opts.FrameRate = Rational{Num: 24, Den: 1}
+	opts.CinemaFrameCount = 1440
+	opts.Comment = "reel 1"
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	m, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.CinemaFrameRate != (Rational{24, 1}) {
+		t.Errorf("CinemaFrameRate = %v, want 24/1", m.CinemaFrameRate)
+	}
+	if m.CinemaFrameCount != 1440 {
+		t.Errorf("CinemaFrameCount = %d, want 1440", m.CinemaFrameCount)
+	}
+	if m.Comment != "reel 1" {
+		t.Errorf("Comment = %q, want %q", m.Comment, "reel 1")
+	}
+
+	// Timing metadata is only written for cinema profiles
+	opts.Profile = ProfileNone
+	buf.Reset()
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	m, err = DecodeMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.CinemaFrameRate != (Rational{}) {
+		t.Errorf("CinemaFrameRate = %v for ProfileNone, want zero", m.CinemaFrameRate)
+	}
+}
+
+func TestEncode_CinemaProfile(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 2), uint8(y * 3), uint8(x + y), 255})
+		}
+	}
+
+	tests := []struct {
+		profile   Profile
+		numDecomp uint8
+	}{
+		{ProfileCinema2K, 5},
+		{ProfileCinema4K, 6},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Format = FormatJ2K
+		opts.Profile = tt.profile
+		opts.Lossless = true
+		opts.TileSize = image.Point{X: 32, Y: 32}
+		opts.ProgressionOrder = LRCP
+		opts.NumLayers = 3
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode(%#x) error: %v", tt.profile, err)
+		}
+
+		// The caller's options are left as they were
+		if !opts.Lossless || opts.TileSize.X != 32 || opts.ProgressionOrder != LRCP || opts.Precision != 0 {
+			t.Errorf("Encode(%#x) modified the options: %+v", tt.profile, opts)
+		}
+
+		h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+		if err != nil {
+			t.Fatalf("ReadHeader() error: %v", err)
+		}
+		cod := h.CodingStyle
+		if h.Profile != uint16(tt.profile) {
+			t.Errorf("Rsiz = %#x, want %#x", h.Profile, tt.profile)
+		}
+		if h.TileWidth != 96 || h.TileHeight != 64 {
+			t.Errorf("tile size = %dx%d, want 96x64", h.TileWidth, h.TileHeight)
+		}
+		if cod.ProgressionOrder != uint8(CPRL) {
+			t.Errorf("progression order = %d, want CPRL", cod.ProgressionOrder)
+		}
+		if cod.NumDecompositions != tt.numDecomp {
+			t.Errorf("decomposition levels = %d, want %d", cod.NumDecompositions, tt.numDecomp)
+		}
+		if cod.NumLayers != 1 {
+			t.Errorf("layers = %d, want 1", cod.NumLayers)
+		}
+		if cod.WaveletTransform != 0 {
+			t.Errorf("wavelet = %d, want 0 (9-7)", cod.WaveletTransform)
+		}
+		if cod.CodeBlockWidth() != 32 || cod.CodeBlockHeight() != 32 {
+			t.Errorf("code-block = %dx%d, want 32x32", cod.CodeBlockWidth(), cod.CodeBlockHeight())
+		}
+		if len(cod.PrecinctSizes) != int(tt.numDecomp)+1 {
+			t.Fatalf("%d precinct sizes, want %d", len(cod.PrecinctSizes), tt.numDecomp+1)
+		}
+		for r, p := range cod.PrecinctSizes {
+			want := uint8(8)
+			if r == 0 {
+				want = 7
+			}
+			if p.WidthExp != want || p.HeightExp != want {
+				t.Errorf("resolution %d precinct = 2^%d x 2^%d, want 2^%d", r, p.WidthExp, p.HeightExp, want)
+			}
+		}
+		for c, comp := range h.ComponentInfo {
+			if comp.Precision() != 12 {
+				t.Errorf("component %d precision = %d, want 12", c, comp.Precision())
+			}
+		}
+
+		if _, err := Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("Decode(%#x) error: %v", tt.profile, err)
+		}
+	}
+}
+
+func TestEncode_CinemaRateLimits(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8((x*x*7 + y*13 + x*y) % 251)
+			img.SetRGBA(x, y, color.RGBA{v, v ^ 0x5A, uint8(x*y) + v, 255})
+		}
+	}
+
+	// An absurd frame rate scales the DCI limits down to a few kilobytes
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Profile = ProfileCinema2K
+	opts.Quality = 100
+	opts.FrameRate = Rational{Num: 12000, Den: 1}
+	var stats EncodeStats
+	opts.CollectStats = &stats
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	frame, component := cinemaMaxBitRate/8/12000, cinemaMaxComponentBitRate/8/12000
+	if buf.Len() > frame {
+		t.Errorf("frame is %d bytes, want at most %d", buf.Len(), frame)
+	}
+	for c, res := range stats.SubbandBytes {
+		var n int64
+		for _, bands := range res {
+			for _, b := range bands {
+				n += b
+			}
+		}
+		if n > int64(component) {
+			t.Errorf("component %d is %d bytes, want at most %d", c, n, component)
+		}
+	}
+
+	// At 24 fps the same frame fits easily, so Quality decides the step
+	opts.FrameRate = Rational{Num: 24, Den: 1}
+	opts.CollectStats = nil
+	var full bytes.Buffer
+	if err := Encode(&full, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if full.Len() <= buf.Len() {
+		t.Errorf("24 fps frame is %d bytes, want more than the capped %d", full.Len(), buf.Len())
+	}
+}
+
+func TestEncode_CinemaContainer(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		size    image.Point
+		ok      bool
+	}{
+		{ProfileCinema2K, image.Point{X: 2048, Y: 1080}, true},
+		{ProfileCinema2K, image.Point{X: 2049, Y: 16}, false},
+		{ProfileCinema2K, image.Point{X: 16, Y: 1081}, false},
+		{ProfileCinema4K, image.Point{X: 4097, Y: 16}, false},
+		{ProfileCinema4K, image.Point{X: 16, Y: 2161}, false},
+	}
+	for _, tt := range tests {
+		img := image.NewGray(image.Rectangle{Max: tt.size})
+		opts := DefaultOptions()
+		opts.Profile = tt.profile
+		_, err := CompressedSize(img, opts)
+		if tt.ok && err != nil {
+			t.Errorf("CompressedSize(%v, %#x) error: %v", tt.size, tt.profile, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("CompressedSize(%v, %#x) succeeded, want a container error", tt.size, tt.profile)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Profile = ProfileCinema2K
+	opts.Precision = 16
+	if err := Encode(io.Discard, image.NewGray(image.Rect(0, 0, 16, 16)), opts); err == nil {
+		t.Error("Encode() with 16-bit cinema precision succeeded, want an error")
+	}
+	if _, err := NewTileEncoder(io.Discard, 16, 16, opts); err == nil {
+		t.Error("NewTileEncoder() with a cinema profile succeeded, want an error")
+	}
+}
+
+func TestEncode_IMFProfile(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 2), uint8(y * 3), uint8(x + y), 255})
+		}
+	}
+
+	tests := []struct {
+		base       Profile
+		reversible bool
+		maxDecomp  uint8
+		maxWidth   int
+	}{
+		{ProfileIMF2K, false, 5, 2048},
+		{ProfileIMF4K, false, 6, 4096},
+		{ProfileIMF8K, false, 7, 8192},
+		{ProfileIMF2KR, true, 5, 2048},
+		{ProfileIMF4KR, true, 6, 4096},
+		{ProfileIMF8KR, true, 7, 8192},
+	}
+	for _, tt := range tests {
+		profile := IMFProfile(tt.base, 4, 2)
+		if c := profile.Constraints(); c.MaxWidth != tt.maxWidth || c.MaxDecompositions != int(tt.maxDecomp) {
+			t.Errorf("Profile(%#04x).Constraints() = %+v", uint16(profile), c)
+		}
+
+		opts := DefaultOptions()
+		opts.Format = FormatJ2K
+		opts.Profile = profile
+		opts.Lossless = !tt.reversible
+		opts.TileSize = image.Point{X: 32, Y: 32}
+		opts.NumResolutions = 10
+		opts.CodeBlockSize = image.Point{X: 4, Y: 5}
+		opts.CodeBlockStyle = CodeBlockStyle{Selective: true}
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode(%#04x) error: %v", uint16(profile), err)
+		}
+
+		h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+		if err != nil {
+			t.Fatalf("ReadHeader() error: %v", err)
+		}
+		cod := h.CodingStyle
+		if want := uint16(tt.base) | 0x24; h.Profile != want {
+			t.Errorf("Rsiz = %#04x, want %#04x", h.Profile, want)
+		}
+		if h.NumTilesX != 1 || h.NumTilesY != 1 {
+			t.Errorf("%#04x: %dx%d tiles, want one", uint16(profile), h.NumTilesX, h.NumTilesY)
+		}
+		if got := cod.WaveletTransform == 1; got != tt.reversible {
+			t.Errorf("%#04x: wavelet = %d, want reversible %v", uint16(profile), cod.WaveletTransform, tt.reversible)
+		}
+		if cod.NumDecompositions != tt.maxDecomp {
+			t.Errorf("%#04x: decomposition levels = %d, want %d", uint16(profile), cod.NumDecompositions, tt.maxDecomp)
+		}
+		if cod.CodeBlockWidth() != 64 || cod.CodeBlockHeight() != 32 || cod.CodeBlockStyle != 0 {
+			t.Errorf("%#04x: code-block = %dx%d style %#x, want 64x32 style 0",
+				uint16(profile), cod.CodeBlockWidth(), cod.CodeBlockHeight(), cod.CodeBlockStyle)
+		}
+		for r, p := range cod.PrecinctSizes {
+			want := uint8(8)
+			if r == 0 {
+				want = 7
+			}
+			if p.WidthExp != want || p.HeightExp != want {
+				t.Errorf("%#04x: resolution %d precinct = 2^%d x 2^%d, want 2^%d", uint16(profile), r, p.WidthExp, p.HeightExp, want)
+			}
+		}
+		if len(cod.PrecinctSizes) != int(tt.maxDecomp)+1 {
+			t.Errorf("%#04x: %d precinct sizes, want %d", uint16(profile), len(cod.PrecinctSizes), tt.maxDecomp+1)
+		}
+
+		decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode(%#04x) error: %v", uint16(profile), err)
+		}
+		if !tt.reversible {
+			continue
+		}
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 96; x++ {
+				r0, g0, b0, _ := decoded.At(x, y).RGBA()
+				r1, g1, b1, _ := img.At(x, y).RGBA()
+				if r0 != r1 || g0 != g1 || b0 != b1 {
+					t.Fatalf("%#04x: pixel (%d, %d) = %v, want %v", uint16(profile), x, y, decoded.At(x, y), img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_IMFLevels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8((x*x*7 + y*13 + x*y) % 251)
+			img.SetRGBA(x, y, color.RGBA{v, v ^ 0x5A, uint8(x*y) + v, 255})
+		}
+	}
+
+	tests := []struct {
+		name    string
+		img     image.Image
+		profile Profile
+		fps     int
+	}{
+		{"main level 12", img, IMFProfile(ProfileIMF2K, 12, 0), 0},
+		{"sublevel above main level", img, IMFProfile(ProfileIMF2K, 1, 2), 0},
+		{"too wide", image.NewRGBA(image.Rect(0, 0, 2049, 8)), ProfileIMF2K, 0},
+		{"too tall", image.NewRGBA(image.Rect(0, 0, 8, 3113)), ProfileIMF4K, 0},
+		{"four components", image.NewNRGBA64(image.Rect(0, 0, 8, 8)), ProfileIMF2K, 0},
+		// 128x128x3 samples at 1500 fps is 73.7 Msamples/s
+		{"sample rate", img, IMFProfile(ProfileIMF2K, 1, 0), 1500},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Profile = tt.profile
+		opts.FrameRate = Rational{Num: tt.fps, Den: 1}
+		if err := Encode(io.Discard, tt.img, opts); err == nil {
+			t.Errorf("%s: Encode() succeeded, want an error", tt.name)
+		}
+	}
+
+	// 1300 fps fits main level 1, and sublevel 1 then caps the frame
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.Profile = IMFProfile(ProfileIMF2K, 1, 1)
+	opts.Quality = 100
+	opts.FrameRate = Rational{Num: 1300, Den: 1}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if limit := imfBaseBitRate / 8 / 1300; buf.Len() > limit {
+		t.Errorf("frame is %d bytes, want at most %d", buf.Len(), limit)
+	}
+
+	// The reversible profiles cannot trade quality for size
+	opts.Profile = IMFProfile(ProfileIMF2KR, 1, 1)
+	if err := Encode(io.Discard, img, opts); err == nil {
+		t.Error("Encode() of an oversized reversible IMF frame succeeded, want an error")
+	}
+}
+
+func TestEncode_LayersImproveMonotonically(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 96; x++ {
+			v := 96 + x + y/2 + (x*7+y*13)%23
+			img.SetRGBA(x, y, color.RGBA{uint8(v), uint8(v * 3 / 4), uint8(255 - v), 255})
+		}
+	}
+
+	for _, lossless := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Format = FormatJ2K
+		opts.Lossless = lossless
+		opts.Quality = 100
+		opts.NumLayers = 5
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+
+		prev := 0.0
+		for layers := 1; layers <= 5; layers++ {
+			decoded, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{QualityLayers: layers})
+			if err != nil {
+				t.Fatalf("Decode(%d layers) error: %v", layers, err)
+			}
+			psnr, err := PSNR(img, decoded)
+			if err != nil {
+				t.Fatalf("PSNR() error: %v", err)
+			}
+			if psnr <= prev {
+				t.Errorf("lossless=%v: PSNR with %d layers = %.2f dB, want above %.2f dB", lossless, layers, psnr, prev)
+			}
+			prev = psnr
+		}
+		if lossless && !math.IsInf(prev, 1) {
+			t.Errorf("PSNR with all layers = %.2f dB, want a lossless round trip", prev)
+		}
+
+		// Decoding every layer matches a single-layer encode
+		opts.NumLayers = 1
+		var single bytes.Buffer
+		if err := Encode(&single, img, opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		a, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() error: %v", err)
+		}
+		b, err := Decode(bytes.NewReader(single.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() error: %v", err)
+		}
+		if mse, err := MSE(a, b); err != nil || mse != 0 {
+			t.Errorf("lossless=%v: all 5 layers differ from one layer: MSE %v, error %v", lossless, mse, err)
+		}
+	}
+}
+
+func TestEncode_Wavelet(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			v := 96 + x + y/2 + (x*7+y*13)%23
+			img.SetRGBA(x, y, color.RGBA{uint8(v), uint8(v * 3 / 4), uint8(255 - v), 255})
+		}
+	}
+
+	tests := []struct {
+		name      string
+		wavelet   Wavelet
+		lossless  bool
+		ratio     float64
+		transform int
+		quantized bool
+		minPSNR   float64
+	}{
+		{"5-3 lossy", WaveletReversible53, false, 8, 1, true, 30},
+		{"5-3 lossless", WaveletReversible53, true, 0, 1, false, math.Inf(1)},
+		{"9-7 near-lossless", WaveletIrreversible97, false, 0, 0, true, 45},
+		{"auto lossless", WaveletAuto, true, 0, 1, false, math.Inf(1)},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Format = FormatJ2K
+		opts.Wavelet = tt.wavelet
+		opts.Lossless = tt.lossless
+		opts.Quality = 100
+		opts.CompressionRatio = tt.ratio
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("%s: Encode() error: %v", tt.name, err)
+		}
+
+		m, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: DecodeMetadata() error: %v", tt.name, err)
+		}
+		if m.WaveletTransform != tt.transform {
+			t.Errorf("%s: WaveletTransform = %d, want %d", tt.name, m.WaveletTransform, tt.transform)
+		}
+		h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+		if err != nil {
+			t.Fatalf("%s: ReadHeader() error: %v", tt.name, err)
+		}
+		if got := h.Quantization.Style() != codestream.QuantizationNone; got != tt.quantized {
+			t.Errorf("%s: quantized = %v, want %v", tt.name, got, tt.quantized)
+		}
+		if tt.ratio > 0 && float64(buf.Len()) > float64(64*48*3)/tt.ratio*1.1 {
+			t.Errorf("%s: %d bytes, want about %.0f", tt.name, buf.Len(), float64(64*48*3)/tt.ratio)
+		}
+
+		decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: Decode() error: %v", tt.name, err)
+		}
+		psnr, err := PSNR(img, decoded)
+		if err != nil {
+			t.Fatalf("%s: PSNR() error: %v", tt.name, err)
+		}
+		if psnr < tt.minPSNR {
+			t.Errorf("%s: PSNR = %.2f dB, want at least %.2f dB", tt.name, psnr, tt.minPSNR)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Wavelet = WaveletIrreversible97
+	opts.Lossless = true
+	if err := Encode(io.Discard, img, opts); err == nil {
+		t.Error("Encode() with Lossless and WaveletIrreversible97 succeeded, want an error")
+	}
+}
+
+func TestEncode_CollectStats(t *testing.T) {
+	// Smooth shading with mild texture, standing in for a photograph
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			v := 96 + x/2 + y/4 + (x*7+y*13)%9
+			img.Set(x, y, color.RGBA{uint8(v), uint8(v * 3 / 4), uint8(v / 2), 255})
+		}
+	}
+
+	var stats EncodeStats
+	opts := DefaultOptions()
+	opts.Format = FormatJ2K
+	opts.CollectStats = &stats
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	if len(stats.SubbandBytes) != 3 {
+		t.Fatalf("len(SubbandBytes) = %d, want 3", len(stats.SubbandBytes))
+	}
+	if stats.CodeBlockCount == 0 {
+		t.Error("CodeBlockCount = 0")
+	}
+	if stats.MeanSparsity <= 0 || stats.MeanSparsity > 1 {
+		t.Errorf("MeanSparsity = %v, want in (0, 1]", stats.MeanSparsity)
+	}
+
+	var total int64
+	top := opts.NumResolutions - 1
+	for c, res := range stats.SubbandBytes {
+		if len(res) != opts.NumResolutions || len(res[0]) != 1 || len(res[top]) != 3 {
+			t.Fatalf("component %d: unexpected SubbandBytes shape", c)
+		}
+		for _, bands := range res {
+			for _, n := range bands {
+				total += n
+			}
+		}
+		ll, hh := res[0][0], res[top][2]
+		if ll >= hh {
+			t.Errorf("component %d: LL bytes %d >= HH bytes %d", c, ll, hh)
+		}
+	}
+	if total == 0 || total >= int64(buf.Len()) {
+		t.Errorf("total subband bytes = %d, output %d", total, buf.Len())
+	}
+}
+
+func TestNormalizePrecision(t *testing.T) {
+	info := []codestream.ComponentInfo{{BitDepth: 15}, {BitDepth: 7}, {BitDepth: 7}}
+	data := [][]int32{
+		{0, 32768, 65535},
+		{0, 128, 255},
+		{0, 64, 255},
+	}
+
+	if got := normalizePrecision(data, info); got != 16 {
+		t.Fatalf("normalizePrecision() = %d, want 16", got)
+	}
+
+	want := [][]int32{
+		{0, 32768, 65535},
+		{0, 32896, 65535},
+		{0, 16448, 65535},
+	}
+	for c := range want {
+		for i := range want[c] {
+			if data[c][i] != want[c][i] {
+				t.Errorf("component %d sample %d = %d, want %d", c, i, data[c][i], want[c][i])
+			}
+		}
+	}
+}
+
+func TestDecode_MixedPrecision(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2, MCT: MCTNone}
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range src.Pix {
+		src.Pix[i] = 128
+	}
+	if err := Encode(&buf, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// Make the first component 16-bit, leaving the others at 8 bits
+	data := buf.Bytes()
+	siz := data[4:]
+	if binary.BigEndian.Uint16(siz[36:]) != 3 {
+		t.Fatalf("Csiz = %d, want 3", binary.BigEndian.Uint16(siz[36:]))
+	}
+	siz[38] = 15
+
+	m, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if want := []int{16, 8, 8}; len(m.BitsPerComponent) != 3 || m.BitsPerComponent[0] != want[0] ||
+		m.BitsPerComponent[1] != want[1] || m.BitsPerComponent[2] != want[2] {
+		t.Fatalf("BitsPerComponent = %v, want %v", m.BitsPerComponent, want)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	rgba, ok := img.(*image.RGBA64)
+	if !ok {
+		t.Fatalf("Decode() returned %T, want *image.RGBA64", img)
+	}
+
+	// Every component is mid-grey, so each must land near the middle of
+	// the 16-bit output range regardless of its own precision.
+	c := rgba.RGBA64At(0, 0)
+	for i, v := range []uint16{c.R, c.G, c.B} {
+		if v < 32768-512 || v > 32768+512 {
+			t.Errorf("component %d = %d, want about 32768", i, v)
+		}
+	}
+}
+
+// layeredCodestream encodes a one-resolution gray image with numLayers
+// quality layers and replaces its tile data with one synthetic packet per
+// layer, located by SOP markers or by a PLT segment.
+func layeredCodestream(t *testing.T, numLayers int, usePLT bool) []byte {
+	t.Helper()
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 1, NumLayers: numLayers, EnableSOP: !usePLT}
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	sot := bytes.Index(buf.Bytes(), []byte{0xFF, 0x90, 0x00, 0x0A})
+	if sot < 0 {
+		t.Fatal("SOT not found")
+	}
+
+	var packets, plt []byte
+	for l := 0; l < numLayers; l++ {
+		var p []byte
+		if !usePLT {
+			p = append(p, 0xFF, 0x91, 0x00, 0x04, 0x00, byte(l))
+		}
+		p = append(p, 0x80)
+		p = append(p, make([]byte, 3*l+1)...)
+		packets = append(packets, p...)
+		plt = append(plt, byte(len(p)))
+	}
+
+	var tileHeader []byte
+	if usePLT {
+		tileHeader = append(tileHeader, 0xFF, 0x58, 0x00, byte(3+len(plt)), 0x00)
+		tileHeader = append(tileHeader, plt...)
+	}
+
+	data := append([]byte{}, buf.Bytes()[:sot]...)
+	data = append(data, 0xFF, 0x90, 0x00, 0x0A, 0x00, 0x00)
+	data = binary.BigEndian.AppendUint32(data, uint32(12+len(tileHeader)+2+len(packets)))
+	data = append(data, 0x00, 0x01)
+	data = append(data, tileHeader...)
+	data = append(data, 0xFF, 0x93)
+	data = append(data, packets...)
+	return append(data, 0xFF, 0xD9)
+}
+
+func TestDecodeMetadata_LayerBoundaries(t *testing.T) {
+	for _, usePLT := range []bool{false, true} {
+		data := layeredCodestream(t, 4, usePLT)
+
+		m, err := DecodeMetadataConfig(bytes.NewReader(data), &Config{ComputeLayerBoundaries: true})
+		if err != nil {
+			t.Fatalf("DecodeMetadataConfig(PLT=%v) error: %v", usePLT, err)
+		}
+		b := m.LayerBoundaries
+		if len(b) != 4 {
+			t.Fatalf("PLT=%v: LayerBoundaries = %v, want 4 entries", usePLT, b)
+		}
+		for i := 1; i < len(b); i++ {
+			if b[i] < b[i-1] {
+				t.Errorf("PLT=%v: LayerBoundaries = %v, not non-decreasing", usePLT, b)
+			}
+		}
+		if b[3] != int64(len(data)) {
+			t.Errorf("PLT=%v: last boundary = %d, want codestream size %d", usePLT, b[3], len(data))
+		}
+		// Layer 0 ends where the layer 1 packet begins
+		want := bytes.Index(data, []byte{0xFF, 0x93}) + 2 + 2
+		if !usePLT {
+			want += 6
+		}
+		if b[0] != int64(want) {
+			t.Errorf("PLT=%v: first boundary = %d, want %d", usePLT, b[0], want)
+		}
+	}
+
+	m, err := DecodeMetadata(bytes.NewReader(layeredCodestream(t, 4, true)))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.LayerBoundaries != nil {
+		t.Errorf("LayerBoundaries = %v without ComputeLayerBoundaries", m.LayerBoundaries)
+	}
+}
+
+func TestEncodeMultiFrame(t *testing.T) {
+	// Frames of increasing size and detail, so each is distinguishable
+	frames := make([]image.Image, 3)
+	for i := range frames {
+		size := 8 << i
+		img := image.NewGray(image.Rect(0, 0, size, size+1))
+		for y := 0; y < size+1; y++ {
+			for x := 0; x < size; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8(x * y * (i + 1))})
+			}
+		}
+		frames[i] = img
+	}
+
+	var buf bytes.Buffer
+	offsets, err := EncodeMultiFrame(&buf, frames, nil)
+	if err != nil {
+		t.Fatalf("EncodeMultiFrame() error: %v", err)
+	}
+	if len(offsets) != len(frames) || offsets[0] != 0 {
+		t.Fatalf("offsets = %v", offsets)
+	}
+
+	data := buf.Bytes()
+	want, err := ExportCodestream(frames[2], nil)
+	if err != nil {
+		t.Fatalf("ExportCodestream() error: %v", err)
+	}
+	got := data[offsets[2]:]
+	if n := binary.BigEndian.Uint32(got); n != uint32(len(want)) || !bytes.Equal(got[4:4+n], want) {
+		t.Error("frame 2 codestream differs from ExportCodestream output")
+	}
+
+	img, err := DecodeFrame(bytes.NewReader(data), 2, offsets, nil)
+	if err != nil {
+		t.Fatalf("DecodeFrame() error: %v", err)
+	}
+	if img.Bounds() != frames[2].Bounds() {
+		t.Errorf("DecodeFrame(2) bounds = %v, want %v", img.Bounds(), frames[2].Bounds())
+	}
+
+	if _, err := DecodeFrame(bytes.NewReader(data), 3, offsets, nil); err == nil {
+		t.Error("DecodeFrame(3) should fail for a 3-frame sequence")
+	}
+}
+
+// debugTrace decodes data with Config.Debug set and returns the lines of
+// the trace.
+func debugTrace(t *testing.T, data []byte) []packetTrace {
+	t.Helper()
+	var trace bytes.Buffer
+	if _, err := DecodeConfig(bytes.NewReader(data), &Config{Debug: &trace}); err != nil {
+		t.Fatalf("DecodeConfig() error: %v", err)
+	}
+	var lines []packetTrace
+	for _, s := range bytes.Split(bytes.TrimSpace(trace.Bytes()), []byte("\n")) {
+		var l packetTrace
+		if err := json.Unmarshal(s, &l); err != nil {
+			t.Fatalf("trace line %q: %v", s, err)
+		}
+		if l.Error != "" || l.Packet == nil {
+			t.Fatalf("trace line %q: want a packet without error", s)
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestDecode_DebugTrace(t *testing.T) {
+	// Two tiles of two packets each (one per resolution), without SOP
+	// or PLT markers; every code-block carries data
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x*37 ^ y*91)})
+		}
+	}
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2, TileSize: image.Pt(8, 8)}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	lines := debugTrace(t, buf.Bytes())
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d lines, want 4", len(lines))
+	}
+	var tileBytes [2]int64
+	for i, l := range lines {
+		tile, res := i/2, i%2
+		if l.Tile != tile || l.Packet.Resolution != res || l.Packet.Layer != 0 || l.Packet.Component != 0 {
+			t.Errorf("line %d: tile %d packet %+v, want tile %d resolution %d", i, l.Tile, *l.Packet, tile, res)
+		}
+		// The LL band has one code-block, and HL, LH and HH one each
+		wantBlocks := 1
+		if res == 1 {
+			wantBlocks = 3
+		}
+		if !l.Present || l.CodeBlocks != wantBlocks || l.Bytes <= 0 {
+			t.Errorf("line %d: present=%v codeBlocks=%d bytes=%d, want true %d and some bytes",
+				i, l.Present, l.CodeBlocks, l.Bytes, wantBlocks)
+		}
+		tileBytes[tile] += l.Bytes
+	}
+	for tile, n := range tileBytes {
+		// The packets fill the tile-part after its SOT and SOD markers
+		start, end := tilePartSpan(t, buf.Bytes(), tile)
+		if want := int64(end - start - 14); n != want {
+			t.Errorf("tile %d: packets take %d bytes, want %d", tile, n, want)
+		}
+	}
+
+	// Hand-made packets with SOP markers, of which only the second
+	// resolution of tile 1 is present, but without any code-block
+	sot := bytes.Index(buf.Bytes(), []byte{0xFF, 0x90, 0x00, 0x0A})
+	data := append([]byte{}, buf.Bytes()[:sot]...)
+	for tile := 0; tile < 2; tile++ {
+		var packets []byte
+		for r := 0; r < 2; r++ {
+			packets = append(packets, 0xFF, 0x91, 0x00, 0x04, 0x00, byte(r))
+			if tile == 1 && r == 1 {
+				packets = append(packets, 0x80) // no code-block included
+			} else {
+				packets = append(packets, 0x00)
+			}
+		}
+		data = append(data, 0xFF, 0x90, 0x00, 0x0A, 0x00, byte(tile))
+		data = binary.BigEndian.AppendUint32(data, uint32(12+2+len(packets)))
+		data = append(data, 0x00, 0x01, 0xFF, 0x93)
+		data = append(data, packets...)
+	}
+	data = append(data, 0xFF, 0xD9)
+	cod, _ := mainHeaderSegment(t, data, codestream.COD)
+	data[cod+4] |= codestream.CodingStyleSOP
+
+	lines = debugTrace(t, data)
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d lines, want 4", len(lines))
+	}
+	for i, l := range lines {
+		tile, res := i/2, i%2
+		wantPresent := tile == 1 && res == 1
+		if l.Tile != tile || l.Packet.Resolution != res || l.Bytes != 7 || l.Present != wantPresent || l.CodeBlocks != 0 {
+			t.Errorf("line %d: tile %d resolution %d bytes=%d present=%v codeBlocks=%d, want %d %d 7 %v 0",
+				i, l.Tile, l.Packet.Resolution, l.Bytes, l.Present, l.CodeBlocks, tile, res, wantPresent)
+		}
+	}
+}
+
+// grib2Section7 returns the data section of the first GRIB2 message in
+// data. For data representation template 5.40 this is a bare J2K
+// codestream.
+func grib2Section7(t *testing.T, data []byte) []byte {
+	t.Helper()
+	if len(data) < 16 || string(data[:4]) != "GRIB" || data[7] != 2 {
+		t.Fatal("not a GRIB edition 2 message")
+	}
+	pos := 16
+	for pos+5 <= len(data) && string(data[pos:pos+4]) != "7777" {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if n < 5 || pos+n > len(data) {
+			t.Fatalf("section at offset %d: invalid length %d", pos, n)
+		}
+		if data[pos+4] == 7 {
+			return data[pos+5 : pos+n]
+		}
+		pos += n
+	}
+	t.Fatal("GRIB2 section 7 not found")
+	return nil
+}
+
+// TestDecode_GRIB2 decodes the JPEG 2000 payload of a synthetic GRIB2
+// message shaped like the CMC/ECMWF/NOAA products that exposed decoded
+// images coming back as flat mid-grey: 935x824, 7-bit unsigned,
+// reversible 5-3, LRCP, one layer, holding values 0-100. The message is
+// written by testdata/grib2/gen.go.
+func TestDecode_GRIB2(t *testing.T) {
+	data, err := os.ReadFile("testdata/grib2/cmc_7bit_935x824.grib2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := grib2Section7(t, data)
+
+	m, err := DecodeMetadata(bytes.NewReader(cs))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if m.Width != 935 || m.Height != 824 || m.NumComponents != 1 {
+		t.Fatalf("got %dx%d with %d components, want 935x824 with 1", m.Width, m.Height, m.NumComponents)
+	}
+	if m.BitsPerComponent[0] != 7 || m.Signed[0] {
+		t.Errorf("component 0: %d bits signed=%v, want 7 bits unsigned", m.BitsPerComponent[0], m.Signed[0])
+	}
+	if m.WaveletTransform != 1 || m.NumQualityLayers != 1 {
+		t.Errorf("wavelet %d with %d layers, want 5-3 (1) with 1 layer", m.WaveletTransform, m.NumQualityLayers)
+	}
+
+	img, err := Decode(bytes.NewReader(cs))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if got := img.Bounds(); got != image.Rect(0, 0, 935, 824) {
+		t.Fatalf("Bounds() = %v, want 935x824", got)
+	}
+
+	// Gray samples are scaled from 7 to 8 bits on decode; round them back.
+	value := func(x, y int) int {
+		return (int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)*127 + 127) / 255
+	}
+	lo, hi := 255, 0
+	for y := 0; y < 824; y++ {
+		for x := 0; x < 935; x++ {
+			v := value(x, y)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	if lo != 0 || hi != 100 {
+		t.Errorf("decoded values span %d-%d, want 0-100", lo, hi)
+	}
+
+	// Values of round(50 + 25*sin(x/60) + 25*cos(y/45)), the field the
+	// generator encoded
+	for _, tt := range []struct{ x, y, want int }{
+		{0, 0, 75}, {94, 0, 100}, {282, 141, 0}, {467, 412, 51},
+		{700, 300, 54}, {123, 777, 72}, {934, 823, 75},
+	} {
+		if got := value(tt.x, tt.y); got != tt.want {
+			t.Errorf("value at (%d,%d) = %d, want %d", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMetadata_Subsampling(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for _, format := range []Format{FormatJ2K, FormatJP2} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Format: format, Lossless: true}); err != nil {
+			t.Fatalf("Encode(%v) error: %v", format, err)
+		}
+		data := buf.Bytes()
+		soc := bytes.Index(data, []byte{0xFF, 0x4F, 0xFF, 0x51})
+		if soc < 0 {
+			t.Fatalf("%v: SIZ not found", format)
+		}
+		// 4:2:0 chroma: XRsiz and YRsiz of components 1 and 2 become 2
+		for c := 1; c < 3; c++ {
+			data[soc+42+3*c+1] = 2
+			data[soc+42+3*c+2] = 2
+		}
+
+		m, err := DecodeMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%v: DecodeMetadata() error: %v", format, err)
+		}
+		if len(m.SubsamplingX) != m.NumComponents || len(m.SubsamplingY) != m.NumComponents {
+			t.Fatalf("%v: subsampling lengths %d/%d, want %d", format, len(m.SubsamplingX), len(m.SubsamplingY), m.NumComponents)
+		}
+		for c := 0; c < m.NumComponents; c++ {
+			want := 1
+			if c > 0 {
+				want = 2
+			}
+			if m.SubsamplingX[c] != want || m.SubsamplingY[c] != want {
+				t.Errorf("%v: component %d subsampling %dx%d, want %dx%d",
+					format, c, m.SubsamplingX[c], m.SubsamplingY[c], want, want)
+			}
+		}
+	}
+}
+
+func TestDecodeTiles(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(16, 16)}
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 20)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	want, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+
+	var covered []image.Rectangle
+	err = DecodeTiles(bytes.NewReader(buf.Bytes()), func(tile image.Image, tileX, tileY int) error {
+		b := tile.Bounds()
+		wantBounds := image.Rect(tileX*16, tileY*16, tileX*16+16, tileY*16+16).Intersect(want.Bounds())
+		if b != wantBounds {
+			t.Errorf("tile (%d,%d) bounds = %v, want %v", tileX, tileY, b, wantBounds)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if tile.At(x, y) != want.At(x, y) {
+					t.Fatalf("tile (%d,%d) pixel (%d,%d) = %v, want %v", tileX, tileY, x, y, tile.At(x, y), want.At(x, y))
+				}
+			}
+		}
+		covered = append(covered, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeTiles() error: %v", err)
+	}
+	if len(covered) != 6 {
+		t.Errorf("DecodeTiles() visited %d tiles, want 6", len(covered))
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = DecodeTiles(bytes.NewReader(buf.Bytes()), func(image.Image, int, int) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("DecodeTiles() with failing callback = %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func TestDecodeComponents(t *testing.T) {
+	// 11-bit samples, which Decode scales to 16 bits
+	src := image.NewGray16(image.Rect(0, 0, 24, 16))
+	want := make([]int32, 0, 24*16)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			v := uint16((x*97 + y*131) % 2048 * 65535 / 2047)
+			src.SetGray16(x, y, color.Gray16{Y: v})
+			want = append(want, int32(v)*2047/65535)
+		}
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, &Options{Format: FormatJ2K, Lossless: true, Precision: 11}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	planes, m, err := DecodeComponents(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("DecodeComponents() error: %v", err)
+	}
+	if len(planes) != 1 || m.NumComponents != 1 || m.BitsPerComponent[0] != 11 {
+		t.Fatalf("DecodeComponents() = %d planes, metadata %d components of %v bits, want 1 of 11",
+			len(planes), m.NumComponents, m.BitsPerComponent)
+	}
+	for i, v := range planes[0] {
+		if v != want[i] {
+			t.Fatalf("sample %d = %d, want %d", i, v, want[i])
+		}
+	}
+
+	// The inverse component transform is applied: RGB values come back
+	// from a lossless encode with the RCT
+	rgb := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range rgb.Pix {
+		rgb.Pix[i] = uint8(i * 7)
+	}
+	buf.Reset()
+	if err := Encode(&buf, rgb, &Options{Format: FormatJ2K, Lossless: true, MCT: MCTForce}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	area := image.Rect(4, 4, 12, 10)
+	planes, _, err = DecodeComponents(bytes.NewReader(buf.Bytes()), &Config{DecodeArea: &area})
+	if err != nil {
+		t.Fatalf("DecodeComponents() error: %v", err)
+	}
+	if len(planes) != 3 {
+		t.Fatalf("DecodeComponents() returned %d planes, want 3", len(planes))
+	}
+	for c, plane := range planes {
+		if len(plane) != area.Dx()*area.Dy() {
+			t.Fatalf("plane %d has %d samples, want %d", c, len(plane), area.Dx()*area.Dy())
+		}
+		for i, v := range plane {
+			x, y := area.Min.X+i%area.Dx(), area.Min.Y+i/area.Dx()
+			if w := int32(rgb.Pix[rgb.PixOffset(x, y)+c]); v != w {
+				t.Fatalf("component %d at (%d,%d) = %d, want %d", c, x, y, v, w)
+			}
+		}
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	encode := func(m image.Image, o *Options) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, o); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Bytes()
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	gray16 := image.NewGray16(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			rgba.SetRGBA(x, y, color.RGBA{uint8(x * 10), uint8(y * 15), uint8(x + y), 255})
+			gray16.SetGray16(x, y, color.Gray16{Y: uint16(x*2500 + y*300)})
+		}
+	}
+	rgbData := encode(rgba, &Options{Format: FormatJ2K, Lossless: true})
+	grayData := encode(image.NewGray(rgba.Bounds()), &Options{Format: FormatJP2, Lossless: true})
+	deepData := encode(gray16, &Options{Format: FormatJ2K, Lossless: true, Precision: 12})
+	checker := image.NewGray(rgba.Bounds())
+	for i := range checker.Pix {
+		if (i%24/4+i/24/4)%2 == 1 {
+			checker.Pix[i] = 255
+		}
+	}
+	bilevelData := encode(checker, &Options{Format: FormatJ2K, Lossless: true, Precision: 1})
+	gray32Data := deepGrayCodestream(t, 24, false)
+
+	// Destinations are pre-filled so that a pixel left untouched shows
+	tests := []struct {
+		name   string
+		data   []byte
+		dst    draw.Image
+		decode func(draw.Image, io.Reader) error
+	}{
+		{"RGBA", rgbData, image.NewRGBA(rgba.Bounds()), func(dst draw.Image, r io.Reader) error {
+			return DecodeInto(dst.(*image.RGBA), r)
+		}},
+		{"Gray", grayData, image.NewGray(rgba.Bounds()), func(dst draw.Image, r io.Reader) error {
+			return DecodeIntoGray(dst.(*image.Gray), r)
+		}},
+		{"Gray16", deepData, image.NewGray16(rgba.Bounds()), func(dst draw.Image, r io.Reader) error {
+			return DecodeIntoGray16(dst.(*image.Gray16), r)
+		}},
+		{"RGBA64 from 8-bit", rgbData, image.NewRGBA64(rgba.Bounds()), func(dst draw.Image, r io.Reader) error {
+			return DecodeIntoRGBA64(dst.(*image.RGBA64), r)
+		}},
+		{"Decoder", rgbData, image.NewRGBA(rgba.Bounds()), NewDecoder(nil).DecodeInto},
+		{"Gray from 1-bit", bilevelData, image.NewGray(rgba.Bounds()), func(dst draw.Image, r io.Reader) error {
+			return DecodeIntoGray(dst.(*image.Gray), r)
+		}},
+		{"Gray32", gray32Data, NewGray32(image.Rect(0, 0, 8, 4), 24, false), NewDecoder(nil).DecodeInto},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.dst.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					tt.dst.Set(x, y, color.RGBA{0xAB, 0xCD, 0xEF, 0x12})
+				}
+			}
+			if err := tt.decode(tt.dst, bytes.NewReader(tt.data)); err != nil {
+				t.Fatalf("decode error: %v", err)
+			}
+			want, err := Decode(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			model := tt.dst.ColorModel()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got, w := tt.dst.At(x, y), model.Convert(want.At(x, y)); got != w {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, w)
+					}
+				}
+			}
+		})
+	}
+
+	// 1-bit and deep grayscale images are decoded into a destination of
+	// their own type rather than copied into it
+	for _, tt := range tests[5:] {
+		d := newDecoder(bytes.NewReader(tt.data))
+		d.dst = tt.dst
+		if img, err := d.decode(nil); err != nil || img != image.Image(tt.dst) {
+			t.Errorf("%s: decode returned %T, %v; want the destination", tt.name, img, err)
+		}
+	}
+
+	if err := DecodeInto(image.NewRGBA(image.Rect(0, 0, 23, 16)), bytes.NewReader(rgbData)); err == nil {
+		t.Error("DecodeInto() with mismatched bounds succeeded")
+	}
+}
+
+func TestDecodeConfig_OutputModel(t *testing.T) {
+	encode := func(m image.Image) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, &Options{Format: FormatJ2K, Lossless: true}); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Bytes()
+	}
+	rgb := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	rgba := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	deep := image.NewRGBA64(image.Rect(0, 0, 16, 8))
+	gray := image.NewGray(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.NRGBA{uint8(x * 16), uint8(y * 32), uint8(x ^ y), uint8(x*16 + y)}
+			rgb.SetRGBA(x, y, color.RGBA{c.R, c.G, c.B, 255})
+			rgba.SetNRGBA(x, y, c)
+			deep.SetRGBA64(x, y, color.RGBA64{uint16(x * 4000), uint16(y * 8000), 0x1234, 0xFFFF})
+			gray.SetGray(x, y, color.Gray{uint8(x*16 + y)})
+		}
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		model color.Model
+		want  func(x, y int) color.Color
+	}{
+		{"RGB to Gray", encode(rgb), color.GrayModel, func(x, y int) color.Color {
+			return color.GrayModel.Convert(rgb.At(x, y))
+		}},
+		{"RGB to NRGBA", encode(rgb), color.NRGBAModel, func(x, y int) color.Color {
+			return color.NRGBAModel.Convert(rgb.At(x, y))
+		}},
+		{"RGBA straight alpha", encode(rgba), color.NRGBAModel, func(x, y int) color.Color {
+			return rgba.At(x, y)
+		}},
+		{"16-bit to 8-bit", encode(deep), color.NRGBAModel, func(x, y int) color.Color {
+			c := deep.RGBA64At(x, y)
+			return color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 255}
+		}},
+		{"Gray to RGBA64", encode(gray), color.RGBA64Model, func(x, y int) color.Color {
+			return color.RGBA64Model.Convert(gray.At(x, y))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := DecodeConfig(bytes.NewReader(tt.data), &Config{OutputModel: tt.model})
+			if err != nil {
+				t.Fatalf("DecodeConfig() error: %v", err)
+			}
+			if img.ColorModel() != tt.model {
+				t.Fatalf("DecodeConfig() returned %T", img)
+			}
+			b := img.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got, want := img.At(x, y), tt.want(x, y); got != want {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+
+	_, err := DecodeConfig(bytes.NewReader(encode(rgb)), &Config{OutputModel: color.CMYKModel})
+	var unsupported *UnsupportedFeatureError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("DecodeConfig() with CMYKModel error = %v, want UnsupportedFeatureError", err)
+	}
+}
+
+func TestDecodeConfig_DecodeArea(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(16, 16)}
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	tests := []struct {
+		area      image.Rectangle
+		want      image.Rectangle
+		wantTiles int
+	}{
+		{image.Rect(20, 20, 40, 30), image.Rect(20, 20, 40, 30), 2},
+		{image.Rect(50, 50, 100, 100), image.Rect(50, 50, 64, 64), 1},
+		{image.Rect(-10, -10, 200, 200), image.Rect(0, 0, 64, 64), 16},
+	}
+	for _, tt := range tests {
+		cache := &mapTileCache{tiles: make(map[string]image.Image)}
+		area := tt.area
+		img, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{DecodeArea: &area, TileCache: cache})
+		if err != nil {
+			t.Fatalf("DecodeConfig(%v) error: %v", tt.area, err)
+		}
+		if img.Bounds() != tt.want {
+			t.Errorf("DecodeConfig(%v) bounds = %v, want %v", tt.area, img.Bounds(), tt.want)
+		}
+		if cache.misses != tt.wantTiles {
+			t.Errorf("DecodeConfig(%v) decoded %d tiles, want %d", tt.area, cache.misses, tt.wantTiles)
+		}
+	}
+
+	area := image.Rect(100, 100, 120, 120)
+	if _, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{DecodeArea: &area}); err == nil {
+		t.Error("DecodeConfig() with area outside the image succeeded, want error")
+	}
+}
+
+func TestDecodeConfig_QualityLayers(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, NumLayers: 3, CompressionRatio: 10}
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 32, 24)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// 0, the layer count and anything above it all decode every layer,
+	// so they share cached tiles.
+	cache := &mapTileCache{tiles: make(map[string]image.Image)}
+	for _, layers := range []int{1, 0, 3, 10} {
+		img, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{QualityLayers: layers, TileCache: cache})
+		if err != nil {
+			t.Fatalf("DecodeConfig(QualityLayers=%d) error: %v", layers, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 32, 24) {
+			t.Errorf("DecodeConfig(QualityLayers=%d) bounds = %v, want 32x24", layers, img.Bounds())
+		}
+	}
+	if cache.misses != 2 {
+		t.Errorf("decoded tiles %d times, want 2 (one partial, one full)", cache.misses)
+	}
+
+	if _, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{QualityLayers: -1}); err == nil {
+		t.Error("DecodeConfig(QualityLayers=-1) succeeded, want error")
+	}
+}
+
+func TestDecode_MCCStages(t *testing.T) {
+	var buf bytes.Buffer
+	src := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range src.Pix {
+		src.Pix[i] = 128
+	}
+	if err := Encode(&buf, src, &Options{Format: FormatJ2K, Lossless: true}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	sot := bytes.Index(buf.Bytes(), []byte{0xFF, 0x90, 0x00, 0x0A})
+	if sot < 0 {
+		t.Fatal("SOT not found")
+	}
+
+	segment := func(marker uint16, payload ...byte) []byte {
+		b := binary.BigEndian.AppendUint16(nil, marker)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+		return append(b, payload...)
+	}
+	// 1x1 int16 decorrelation array 1 holding 1 and int16 offset array
+	// 2 holding 10, used by MCC stage 0 over component 0.
+	markers := segment(0xFF74, 0, 0, 0x01, 1, 0, 0, 0, 1)
+	markers = append(markers, segment(0xFF74, 0, 0, 0x02, 2, 0, 0, 0, 10)...)
+	markers = append(markers, segment(0xFF75, 0, 0, 0, 0, 0, 0, 1, 1, 0, 1, 0, 0, 1, 0, 0, 2, 1)...)
+
+	build := func(stage byte) []byte {
+		data := append([]byte{}, buf.Bytes()[:sot]...)
+		data = append(data, markers...)
+		data = append(data, segment(0xFF77, 1, stage)...)
+		return append(data, buf.Bytes()[sot:]...)
+	}
+
+	img, err := Decode(bytes.NewReader(build(0)))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	// The mid-grey image reconstructs to zero before the component
+	// transform, so the offset moves the DC level from 128 to 138.
+	if got := color.GrayModel.Convert(img.At(3, 3)).(color.Gray).Y; got != 138 {
+		t.Errorf("pixel = %d, want 138", got)
+	}
+
+	if _, err := Decode(bytes.NewReader(build(5))); err == nil {
+		t.Error("Decode() with MCO naming an undefined stage succeeded, want error")
+	}
+}
+
+func TestEncode_PrecinctSizes(t *testing.T) {
+	opts := &Options{
+		Format:         FormatJ2K,
+		Lossless:       true,
+		NumResolutions: 4,
+		PrecinctSize:   []image.Point{{5, 6}, {7, 7}},
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	h, err := codestream.NewParser(bytes.NewReader(buf.Bytes())).ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if h.CodingStyle.CodingStyle&codestream.CodingStylePrecincts == 0 {
+		t.Fatal("COD does not signal precinct sizes")
+	}
+	want := []codestream.PrecinctSize{{WidthExp: 5, HeightExp: 6}, {WidthExp: 7, HeightExp: 7}, {WidthExp: 7, HeightExp: 7}, {WidthExp: 7, HeightExp: 7}}
+	if len(h.CodingStyle.PrecinctSizes) != len(want) {
+		t.Fatalf("PrecinctSizes = %v, want %v", h.CodingStyle.PrecinctSizes, want)
+	}
+	for r, p := range h.CodingStyle.PrecinctSizes {
+		if p != want[r] {
+			t.Errorf("resolution %d: precinct size %+v, want %+v", r, p, want[r])
+		}
+	}
+
+	// Decoding still works with the partitioned layout
+	if _, err := Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("Decode() error: %v", err)
+	}
+
+	for _, sizes := range [][]image.Point{{{16, 6}}, {{6, 6}, {0, 6}}, {{0, 0}}} {
+		opts.PrecinctSize = sizes
+		if err := Encode(&bytes.Buffer{}, image.NewGray(image.Rect(0, 0, 8, 8)), opts); err == nil {
+			t.Errorf("Encode() with PrecinctSize %v succeeded, want error", sizes)
+		}
+	}
+}
+
+func TestEncode_CompressionRatio(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 128, 128))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(i%128) + uint8(seed>>27)
+	}
+
+	encode := func(opts *Options) int {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opts); err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		return buf.Len()
+	}
+
+	uncompressed := len(img.Pix)
+	size20 := encode(&Options{Format: FormatJ2K, CompressionRatio: 20})
+	if budget := uncompressed / 20; float64(size20) > float64(budget)*1.15 {
+		t.Errorf("ratio 20: %d bytes, want about %d", size20, budget)
+	}
+	if size80 := encode(&Options{Format: FormatJ2K, CompressionRatio: 80}); size80 >= size20 {
+		t.Errorf("ratio 80: %d bytes, want fewer than ratio 20 (%d)", size80, size20)
+	}
+
+	// CompressionRatio takes precedence over Quality
+	if size := encode(&Options{Format: FormatJ2K, CompressionRatio: 20, Quality: 95}); size != size20 {
+		t.Errorf("ratio 20 with Quality 95: %d bytes, want %d", size, size20)
+	}
+}
+
+func TestBilevelImage(t *testing.T) {
+	bounds := image.Rect(2, 3, 6, 4)
+	tests := []struct {
+		name   string
+		data   []int32
+		signed bool
+		want   []uint8
+	}{
+		{"unsigned", []int32{0, 1, -1, 2}, false, []uint8{0, 255, 0, 255}},
+		{"signed", []int32{-1, 0, -2, 1}, true, []uint8{0, 255, 0, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := bilevelImage(nil, tt.data, bounds, tt.signed)
+			if img.Bounds() != bounds {
+				t.Fatalf("Bounds() = %v, want %v", img.Bounds(), bounds)
+			}
+			if !bytes.Equal(img.Pix, tt.want) {
+				t.Errorf("Pix = %v, want %v", img.Pix, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode_Bilevel(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if (x/4+y/4)%2 == 1 {
+				img.Pix[y*32+x] = 255
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJP2, Lossless: true, Precision: 1, ColorSpace: ColorSpaceBilevel}
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeMetadata() error: %v", err)
+	}
+	if meta.ColorSpace != ColorSpaceBilevel || meta.BitsPerComponent[0] != 1 {
+		t.Errorf("ColorSpace = %v, precision = %d; want bilevel, 1", meta.ColorSpace, meta.BitsPerComponent[0])
+	}
+
+	decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	gray, ok := decoded.(*image.Gray)
+	if !ok {
+		t.Fatalf("decoded %T, want *image.Gray", decoded)
+	}
+	for i, v := range gray.Pix {
+		if v != 0 && v != 255 {
+			t.Fatalf("pixel %d = %d, want 0 or 255", i, v)
+		}
+	}
+
+	if !bytes.Equal(gray.Pix, img.Pix) {
+		t.Error("decoded checkerboard does not match the original")
+	}
+}
+
+func TestApplyPalette(t *testing.T) {
+	pclr := &box.PaletteBox{
+		NumEntries:   3,
+		NumColumns:   2,
+		BitsPerEntry: []uint8{7, 0x80 | 3},
+		Entries:      [][]uint32{{10, 0x1}, {20, 0xF}, {30, 0x8}},
+	}
+	info := []codestream.ComponentInfo{{BitDepth: 1, SubsamplingX: 1, SubsamplingY: 1}, {BitDepth: 7, SubsamplingX: 1, SubsamplingY: 1}}
+	data := [][]int32{{0, 1, 2, 5, -1}, {9, 9, 9, 9, 9}}
+
+	// Without a cmap box every column is looked up from component 0
+	out, outInfo, err := applyPalette(pclr, nil, data, info)
+	if err != nil {
+		t.Fatalf("applyPalette() error: %v", err)
+	}
+	want := [][]int32{{10, 20, 30, 30, 10}, {1, -1, -8, -8, 1}}
+	for c := range want {
+		for i := range want[c] {
+			if out[c][i] != want[c][i] {
+				t.Errorf("channel %d = %v, want %v", c, out[c], want[c])
+				break
+			}
+		}
+	}
+	if outInfo[0].Precision() != 8 || outInfo[1].Precision() != 4 || !outInfo[1].IsSigned() {
+		t.Errorf("output precisions = %d, %d (signed %v); want 8, 4 (signed)",
+			outInfo[0].Precision(), outInfo[1].Precision(), outInfo[1].IsSigned())
+	}
+
+	// A direct mapping passes the component through
+	cmap := &box.ComponentMapBox{Mappings: []box.ComponentMapping{
+		{Component: 0, MappingType: 1, PaletteColumn: 0},
+		{Component: 1, MappingType: 0},
+	}}
+	out, outInfo, err = applyPalette(pclr, cmap, data, info)
+	if err != nil {
+		t.Fatalf("applyPalette() error: %v", err)
+	}
+	if out[1][0] != 9 || outInfo[1] != info[1] {
+		t.Errorf("direct channel = %v, %+v; want component 1", out[1], outInfo[1])
+	}
+
+	for _, m := range []box.ComponentMapping{
+		{Component: 2, MappingType: 0},
+		{Component: 0, MappingType: 1, PaletteColumn: 2},
+		{Component: 0, MappingType: 2},
+	} {
+		cmap := &box.ComponentMapBox{Mappings: []box.ComponentMapping{m}}
+		if _, _, err := applyPalette(pclr, cmap, data, info); err == nil {
+			t.Errorf("applyPalette(%+v) expected error", m)
+		}
+	}
+}
+
+func TestDecode_ChannelDefinitions(t *testing.T) {
+	// Channels 0-3 hold R, G, B and A of src
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < 64; i++ {
+		src.SetNRGBA(i%8, i/8, color.NRGBA{uint8(i * 4), uint8(255 - i*3), uint8(i * 7), uint8(i*4 + 3)})
+	}
+	var cs bytes.Buffer
+	if err := Encode(&cs, src, &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	jp2 := func(space uint32, defs []box.ChannelDefinition) []byte {
+		ihdr := &box.ImageHeaderBox{Width: 8, Height: 8, NumComponents: 4, BitsPerComponent: 7, CompressionType: 7}
+		colr := &box.ColorSpecBox{Method: box.ColorMethodEnumerated, EnumeratedColorspace: space}
+		cdef := &box.ChannelDefBox{Definitions: defs}
+		var jp2h []byte
+		for _, b := range []*box.Box{
+			{Type: box.TypeImageHeader, Contents: ihdr.Bytes()},
+			{Type: box.TypeColorSpec, Contents: colr.Bytes()},
+			{Type: box.TypeChannelDef, Contents: cdef.Bytes()},
+		} {
+			b.Length = uint64(8 + len(b.Contents))
+			jp2h = append(jp2h, b.Bytes()...)
+		}
+
+		var file bytes.Buffer
+		w := box.NewWriter(&file)
+		if err := w.WriteSignature(); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range []*box.Box{
+			box.CreateFileTypeBox(),
+			{Type: box.TypeJP2Header, Length: uint64(8 + len(jp2h)), Contents: jp2h},
+			box.CreateCodestreamBox(cs.Bytes()),
+		} {
+			if err := w.WriteBox(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return file.Bytes()
+	}
+	rgba := func(alphaType uint16) []box.ChannelDefinition {
+		return []box.ChannelDefinition{
+			{Channel: 0, Type: box.ChannelColor, Association: 1},
+			{Channel: 1, Type: box.ChannelColor, Association: 2},
+			{Channel: 2, Type: box.ChannelColor, Association: 3},
+			{Channel: 3, Type: alphaType, Association: box.AssociationImage},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		file  []byte
+		model color.Model
+		want  func(c color.NRGBA) color.Color
+	}{
+		{
+			name:  "straight alpha",
+			file:  jp2(box.CSSRGB, rgba(box.ChannelOpacity)),
+			model: color.NRGBAModel,
+			want:  func(c color.NRGBA) color.Color { return c },
+		},
+		{
+			name:  "premultiplied alpha",
+			file:  jp2(box.CSSRGB, rgba(box.ChannelPremultipliedOpacity)),
+			model: color.RGBAModel,
+			want:  func(c color.NRGBA) color.Color { return color.RGBA{c.R, c.G, c.B, c.A} },
+		},
+		{
+			name: "reordered channels",
+			file: jp2(box.CSSRGB, []box.ChannelDefinition{
+				{Channel: 3, Type: box.ChannelOpacity, Association: box.AssociationImage},
+				{Channel: 2, Type: box.ChannelColor, Association: 1},
+				{Channel: 0, Type: box.ChannelColor, Association: 2},
+				{Channel: 1, Type: box.ChannelColor, Association: 3},
+			}),
+			model: color.NRGBAModel,
+			want:  func(c color.NRGBA) color.Color { return color.NRGBA{c.B, c.R, c.G, c.A} },
+		},
+		{
+			name:  "unspecified fourth channel",
+			file:  jp2(box.CSSRGB, rgba(box.ChannelUnspecified)),
+			model: color.RGBAModel,
+			want:  func(c color.NRGBA) color.Color { return color.RGBA{c.R, c.G, c.B, 255} },
+		},
+		{
+			name: "four colours",
+			file: jp2(box.CSSRGB, []box.ChannelDefinition{
+				{Channel: 0, Type: box.ChannelColor, Association: 1},
+				{Channel: 1, Type: box.ChannelColor, Association: 2},
+				{Channel: 2, Type: box.ChannelColor, Association: 3},
+				{Channel: 3, Type: box.ChannelColor, Association: 4},
+			}),
+			model: color.CMYKModel,
+			want:  func(c color.NRGBA) color.Color { return color.CMYK{c.R, c.G, c.B, c.A} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Decode(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if got := img.ColorModel(); got != tt.model {
+				t.Errorf("Decode() color model %v, want %v", got, tt.model)
+			}
+			for i := 0; i < 64; i++ {
+				x, y := i%8, i/8
+				if got, want := img.At(x, y), tt.want(src.NRGBAAt(x, y)); got != want {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+				}
+			}
+
+			cfg, err := DecodeImageConfig(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatalf("DecodeImageConfig() error: %v", err)
+			}
+			if cfg.ColorModel != tt.model {
+				t.Errorf("DecodeImageConfig() color model %v, want %v", cfg.ColorModel, tt.model)
+			}
+		})
+	}
+
+	// In a CMYK space the fourth colour is black and the output is RGB
+	img, err := Decode(bytes.NewReader(jp2(box.CSCMYK, []box.ChannelDefinition{
+		{Channel: 0, Type: box.ChannelColor, Association: 1},
+		{Channel: 1, Type: box.ChannelColor, Association: 2},
+		{Channel: 2, Type: box.ChannelColor, Association: 3},
+		{Channel: 3, Type: box.ChannelColor, Association: 4},
+	})))
+	if err != nil {
+		t.Fatalf("Decode() CMYK error: %v", err)
+	}
+	if c := img.At(0, 0).(color.RGBA); c.A != 255 {
+		t.Errorf("Decode() CMYK pixel %v, want opaque", c)
+	}
+
+	if _, err := Decode(bytes.NewReader(jp2(box.CSSRGB, []box.ChannelDefinition{
+		{Channel: 4, Type: box.ChannelColor, Association: 1},
+	}))); err == nil {
+		t.Error("Decode() with a definition for a missing channel succeeded")
+	}
+}
+
+func TestDecode_Palette(t *testing.T) {
+	// A 2-bit index image: Gray values 0, 85, 170 and 255 become 0-3
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i%4) * 85
+	}
+	var cs bytes.Buffer
+	if err := Encode(&cs, img, &Options{Format: FormatJ2K, Lossless: true, Precision: 2, NumResolutions: 2}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	palette := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 0, 255}}
+	pclr := &box.PaletteBox{NumEntries: 4, NumColumns: 3, BitsPerEntry: []uint8{7, 7, 7}}
+	for _, c := range palette {
+		pclr.Entries = append(pclr.Entries, []uint32{uint32(c.R), uint32(c.G), uint32(c.B)})
+	}
+	cmap := &box.ComponentMapBox{}
+	for col := uint8(0); col < 3; col++ {
+		cmap.Mappings = append(cmap.Mappings, box.ComponentMapping{MappingType: 1, PaletteColumn: col})
+	}
+
+	ihdr := &box.ImageHeaderBox{Width: 8, Height: 8, NumComponents: 1, BitsPerComponent: 1, CompressionType: 7}
+	colr := &box.ColorSpecBox{Method: box.ColorMethodEnumerated, EnumeratedColorspace: box.CSSRGB}
+	var jp2h []byte
+	for _, b := range []*box.Box{
+		{Type: box.TypeImageHeader, Contents: ihdr.Bytes()},
+		{Type: box.TypeColorSpec, Contents: colr.Bytes()},
+		{Type: box.TypePalette, Contents: pclr.Bytes()},
+		{Type: box.TypeComponentMap, Contents: cmap.Bytes()},
+	} {
+		b.Length = uint64(8 + len(b.Contents))
+		jp2h = append(jp2h, b.Bytes()...)
+	}
+
+	var file bytes.Buffer
+	w := box.NewWriter(&file)
+	if err := w.WriteSignature(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*box.Box{
+		box.CreateFileTypeBox(),
+		{Type: box.TypeJP2Header, Length: uint64(8 + len(jp2h)), Contents: jp2h},
+		box.CreateCodestreamBox(cs.Bytes()),
+	} {
+		if err := w.WriteBox(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decoded, err := Decode(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	rgba, ok := decoded.(*image.RGBA)
+	if !ok {
+		t.Fatalf("decoded %T, want *image.RGBA", decoded)
+	}
+	for i := 0; i < 64; i++ {
+		got := rgba.RGBAAt(i%8, i/8)
+		found := false
+		for _, c := range palette {
+			found = found || got == c
+		}
+		if !found {
+			t.Fatalf("pixel %d = %v, not a palette colour", i, got)
+		}
+	}
+
+	for i := 0; i < 64; i++ {
+		if got := rgba.RGBAAt(i%8, i/8); got != palette[i%4] {
+			t.Errorf("pixel %d = %v, want %v", i, got, palette[i%4])
+		}
+	}
+
+	cfg, err := DecodeImageConfig(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeImageConfig() error: %v", err)
+	}
+	if cfg.ColorModel != color.RGBAModel {
+		t.Errorf("DecodeImageConfig() color model is not RGBAModel")
+	}
+}
+
+func TestDecodeImageConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		img   image.Image
+		opts  *Options
+		model color.Model
+	}{
+		{"gray", image.NewGray(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJ2K, Lossless: true}, color.GrayModel},
+		{"gray 12-bit", image.NewGray16(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJP2, Lossless: true, Precision: 12}, color.Gray16Model},
+		{"gray16", image.NewGray16(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJ2K, Lossless: true}, color.Gray16Model},
+		{"RGB", image.NewRGBA(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJP2, Lossless: true}, color.RGBAModel},
+		{"RGB64", image.NewRGBA64(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJ2K, Lossless: true}, color.RGBA64Model},
+		{"RGBA", image.NewNRGBA(image.Rect(0, 0, 12, 10)), &Options{Format: FormatJP2, Lossless: true}, color.RGBAModel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, tt.img, tt.opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			cfg, err := DecodeImageConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeImageConfig() error: %v", err)
+			}
+			if cfg.Width != 12 || cfg.Height != 10 {
+				t.Errorf("dimensions = %dx%d, want 12x10", cfg.Width, cfg.Height)
+			}
+			if cfg.ColorModel != tt.model {
+				t.Errorf("color model = %v, want %v", cfg.ColorModel, tt.model)
+			}
+
+			// Decode must agree, and so must image.DecodeConfig
+			img, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if img.ColorModel() != cfg.ColorModel {
+				t.Errorf("Decode() color model = %v, want %v", img.ColorModel(), cfg.ColorModel)
+			}
+			std, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("image.DecodeConfig() error: %v", err)
+			}
+			if std != cfg {
+				t.Errorf("image.DecodeConfig() = %+v, want %+v", std, cfg)
+			}
+		})
+	}
+}
+
+// encodeTiled returns a lossless RGB J2K image of nx x ny tiles of size
+// tileSize, written with a TileEncoder.
+func encodeTiled(tb testing.TB, nx, ny, tileSize int) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 4, TileSize: image.Pt(tileSize, tileSize)}
+	te, err := NewTileEncoder(&buf, nx*tileSize, ny*tileSize, opts)
+	if err != nil {
+		tb.Fatalf("NewTileEncoder() error: %v", err)
+	}
+	for ty := 0; ty < ny; ty++ {
+		for tx := 0; tx < nx; tx++ {
+			r := te.TileBounds(tx, ty)
+			tile := image.NewRGBA(r)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					tile.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+				}
+			}
+			if err := te.WriteTile(tx, ty, tile); err != nil {
+				tb.Fatalf("WriteTile() error: %v", err)
+			}
+		}
+	}
+	if err := te.Close(); err != nil {
+		tb.Fatalf("Close() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeConfig_MaxWorkers(t *testing.T) {
+	data := encodeTiled(t, 4, 4, 32)
+
+	serial, err := DecodeConfig(bytes.NewReader(data), &Config{MaxWorkers: 1})
+	if err != nil {
+		t.Fatalf("DecodeConfig(MaxWorkers: 1) error: %v", err)
+	}
+	for _, workers := range []int{0, 3, 64} {
+		img, err := DecodeConfig(bytes.NewReader(data), &Config{MaxWorkers: workers})
+		if err != nil {
+			t.Fatalf("DecodeConfig(MaxWorkers: %d) error: %v", workers, err)
+		}
+		if mse, err := MSE(img, serial); err != nil || mse != 0 {
+			t.Errorf("MaxWorkers %d: MSE against serial decode = %v, %v; want 0", workers, mse, err)
+		}
+	}
+
+	if _, err := DecodeConfig(bytes.NewReader(data), &Config{MaxWorkers: -1}); err == nil {
+		t.Error("DecodeConfig(MaxWorkers: -1) expected error")
+	}
+}
+
+func TestDecodeConfig_LuminanceOnly(t *testing.T) {
+	rgb := image.NewRGBA(image.Rect(0, 0, 40, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 40; x++ {
+			rgb.SetRGBA(x, y, color.RGBA{uint8(x * 6), uint8(y * 10), uint8(x*y + 40), 255})
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts *Options
+		tol  int
+	}{
+		// The RCT luminance is floor((R+2G+B)/4) exactly; the ICT one
+		// is ITU-R BT.601 luma, up to quantization
+		{"RCT", &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 3, MCT: MCTAuto}, 0},
+		{"ICT", &Options{Format: FormatJ2K, Quality: 95, NumResolutions: 3, MCT: MCTAuto}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, rgb, tt.opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+
+			full, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			img, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{LuminanceOnly: true})
+			if err != nil {
+				t.Fatalf("DecodeConfig(LuminanceOnly) error: %v", err)
+			}
+			gray, ok := img.(*image.Gray)
+			if !ok {
+				t.Fatalf("DecodeConfig(LuminanceOnly) returned %T, want *image.Gray", img)
+			}
+			if gray.Bounds() != full.Bounds() {
+				t.Fatalf("bounds = %v, want %v", gray.Bounds(), full.Bounds())
+			}
+
+			for y := 0; y < 24; y++ {
+				for x := 0; x < 40; x++ {
+					r, g, b, _ := full.At(x, y).RGBA()
+					r, g, b = r>>8, g>>8, b>>8
+					want := int((r + 2*g + b) / 4)
+					if tt.name == "ICT" {
+						want = int((299*r + 587*g + 114*b + 500) / 1000)
+					}
+					if got := int(gray.GrayAt(x, y).Y); got < want-tt.tol || got > want+tt.tol {
+						t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+
+	// Single-component images and RGB without a component transform
+	// decode as usual
+	for _, tt := range []struct {
+		name string
+		img  image.Image
+		opts *Options
+	}{
+		{"gray", codingModesImage(), &Options{Format: FormatJ2K, Lossless: true}},
+		{"RGB without MCT", rgb, &Options{Format: FormatJ2K, Lossless: true, MCT: MCTNone}},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, tt.img, tt.opts); err != nil {
+			t.Fatalf("%s: Encode() error: %v", tt.name, err)
+		}
+		full, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: Decode() error: %v", tt.name, err)
+		}
+		img, err := DecodeConfig(bytes.NewReader(buf.Bytes()), &Config{LuminanceOnly: true})
+		if err != nil {
+			t.Fatalf("%s: DecodeConfig(LuminanceOnly) error: %v", tt.name, err)
+		}
+		if mse, err := MSE(img, full); err != nil || mse != 0 {
+			t.Errorf("%s: MSE against full decode = %v, %v; want 0", tt.name, mse, err)
+		}
+	}
+}
+
+func BenchmarkDecode_Tiles4x4(b *testing.B) {
+	data := encodeTiled(b, 4, 4, 128)
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 1},
+		{"parallel", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			cfg := &Config{MaxWorkers: bm.workers}
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeConfig(bytes.NewReader(data), cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// signedGray12 returns a Gray16 image holding signed 12-bit samples as
+// int16, covering both ends of the range.
+func signedGray12(w, h int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			setInt16(img, x, y, int16((x*w+y)*37%4096-2048))
+		}
+	}
+	setInt16(img, 0, 0, -2048)
+	setInt16(img, 1, 0, 2047)
+	return img
+}
+
+// setInt16 stores v at (x, y) as a two's complement Gray16 sample.
+func setInt16(img *image.Gray16, x, y int, v int16) {
+	img.SetGray16(x, y, color.Gray16{Y: uint16(v)})
+}
+
+func BenchmarkDecode_LuminanceOnly(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Format: FormatJ2K, Lossless: true, MCT: MCTAuto}); err != nil {
+		b.Fatalf("Encode() error: %v", err)
+	}
+	data := buf.Bytes()
+	for _, bm := range []struct {
+		name      string
+		luminance bool
+	}{
+		{"full", false},
+		{"luminance", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			cfg := &Config{LuminanceOnly: bm.luminance}
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeConfig(bytes.NewReader(data), cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncoder_SignedSamples(t *testing.T) {
+	src := signedGray12(16, 16)
+	e := newEncoder(nil, src, &Options{Format: FormatJ2K, Lossless: true, Signed: true, Precision: 12})
+	if err := e.extractImageData(); err != nil {
+		t.Fatalf("extractImageData() error: %v", err)
+	}
+	if !e.signed || e.precision != 12 {
+		t.Fatalf("signed = %v, precision = %d; want true, 12", e.signed, e.precision)
+	}
+	for i, v := range e.componentData[0] {
+		if want := int32(int16(src.Gray16At(i%16, i/16).Y)); v != want {
+			t.Fatalf("sample %d = %d, want %d", i, v, want)
+		}
+	}
+
+	// Signed samples are coded without a DC level shift
+	if err := e.preprocess(); err != nil {
+		t.Fatalf("preprocess() error: %v", err)
+	}
+
+	// Samples outside the signed Precision-bit range are rejected
+	setInt16(src, 2, 0, 2048)
+	if err := Encode(&bytes.Buffer{}, src, &Options{Format: FormatJ2K, Lossless: true, Signed: true, Precision: 12}); err == nil {
+		t.Error("Encode() with a sample outside the 12-bit range: expected error")
+	}
+}
+
+func TestEncodeDecode_Signed12(t *testing.T) {
+	src := signedGray12(32, 24)
+
+	var buf bytes.Buffer
+	opts := &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 3, Signed: true, Precision: 12}
+	if err := Encode(&buf, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeHeader() error: %v", err)
+	}
+	if c := h.Components[0]; !c.Signed || c.Precision != 12 {
+		t.Errorf("component = signed %v, %d bits; want signed 12 bits", c.Signed, c.Precision)
+	}
+
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	got, ok := img.(*image.Gray16)
+	if !ok {
+		t.Fatalf("Decode() returned %T, want *image.Gray16", img)
+	}
+
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			if g, w := int16(got.Gray16At(x, y).Y), int16(src.Gray16At(x, y).Y); g != w {
+				t.Fatalf("(%d, %d) = %d, want %d", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestWrapSigned(t *testing.T) {
+	data := [][]int32{{-2048, -1, 0, 2047}}
+	if p := wrapSigned(data, 12); p != 16 {
+		t.Errorf("wrapSigned(12) = %d, want 16", p)
+	}
+	for i, want := range []int16{-2048, -1, 0, 2047} {
+		if int16(data[0][i]) != want {
+			t.Errorf("sample %d = %#x, want %d", i, data[0][i], want)
+		}
+	}
+
+	data = [][]int32{{-128, -5, 127}}
+	if p := wrapSigned(data, 8); p != 8 {
+		t.Errorf("wrapSigned(8) = %d, want 8", p)
+	}
+	for i, want := range []int8{-128, -5, 127} {
+		if int8(data[0][i]) != want {
+			t.Errorf("sample %d = %#x, want %d", i, data[0][i], want)
+		}
+	}
+}
+
+// ycbcrTestImage returns a w x h YCbCr image with smooth luma and chroma
+// gradients, inside the RGB gamut.
+func ycbcrTestImage(w, h int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Y[img.YOffset(x, y)] = uint8(64 + (x*3+y*2)%128)
+			off := img.COffset(x, y)
+			img.Cb[off] = uint8(112 + x%32)
+			img.Cr[off] = uint8(112 + y%32)
+		}
+	}
+	return img
+}
+
+// ycbcrError returns the summed absolute difference between the YCbCr
+// values of img and the planes of want, which has no subsampling.
+func ycbcrError(img image.Image, want *image.YCbCr) int64 {
+	var sum int64
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			i, j := want.YOffset(x, y), want.COffset(x, y)
+			for _, d := range []int64{int64(yy) - int64(want.Y[i]), int64(cb) - int64(want.Cb[j]), int64(cr) - int64(want.Cr[j])} {
+				sum += max(d, -d)
+			}
+		}
+	}
+	return sum
+}
+
+// opaqueImage hides the concrete type of an image, forcing Encode onto
+// its generic RGB path.
+type opaqueImage struct{ image.Image }
+
+func TestEncodeDecode_YCbCr(t *testing.T) {
+	tests := []struct {
+		ratio  image.YCbCrSubsampleRatio
+		dx, dy int
+	}{
+		{image.YCbCrSubsampleRatio444, 1, 1},
+		{image.YCbCrSubsampleRatio422, 2, 1},
+		{image.YCbCrSubsampleRatio420, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ratio.String(), func(t *testing.T) {
+			src := ycbcrTestImage(37, 29, tt.ratio)
+			opts := &Options{Format: FormatJ2K, Quality: 100, MCT: MCTAuto, NumResolutions: 3}
+
+			var buf bytes.Buffer
+			if err := Encode(&buf, src, opts); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+			meta, err := DecodeMetadata(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeMetadata() error: %v", err)
+			}
+			wantX, wantY := []int{1, tt.dx, tt.dx}, []int{1, tt.dy, tt.dy}
+			if !slices.Equal(meta.SubsamplingX, wantX) || !slices.Equal(meta.SubsamplingY, wantY) {
+				t.Errorf("subsampling = %v x %v, want %v x %v", meta.SubsamplingX, meta.SubsamplingY, wantX, wantY)
+			}
+
+			img, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if img.Bounds() != src.Bounds() {
+				t.Fatalf("bounds = %v, want %v", img.Bounds(), src.Bounds())
+			}
+
+			// Chroma is interpolated on decode, so only the luma is
+			// compared pixel by pixel
+			for y := 0; y < 29; y++ {
+				for x := 0; x < 37; x++ {
+					r, g, b, _ := img.At(x, y).RGBA()
+					luma, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+					if d := int(luma) - int(src.Y[src.YOffset(x, y)]); d < -3 || d > 3 {
+						t.Fatalf("luma at (%d, %d) = %d, want %d", x, y, luma, src.Y[src.YOffset(x, y)])
+					}
+				}
+			}
+		})
+	}
+
+	// Without subsampling, coding the planes directly avoids the
+	// YCbCr to RGB rounding of the generic path
+	src := ycbcrTestImage(37, 29, image.YCbCrSubsampleRatio444)
+	opts := &Options{Format: FormatJ2K, Quality: 100, MCT: MCTAuto, NumResolutions: 3}
+	var direct, generic bytes.Buffer
+	if err := Encode(&direct, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if err := Encode(&generic, opaqueImage{src}, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	directImg, err := Decode(&direct)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	genericImg, err := Decode(&generic)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if d, g := ycbcrError(directImg, src), ycbcrError(genericImg, src); d >= g {
+		t.Errorf("direct YCbCr error %d, want less than the generic path's %d", d, g)
+	}
+}
+
+func TestEncode_YCbCrTiles(t *testing.T) {
+	src := ycbcrTestImage(64, 48, image.YCbCrSubsampleRatio420)
+	opts := &Options{Format: FormatJ2K, Quality: 100, MCT: MCTAuto, NumResolutions: 3, TileSize: image.Pt(32, 16)}
+
+	var whole bytes.Buffer
+	if err := Encode(&whole, src, opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	var tiled bytes.Buffer
+	te, err := NewTileEncoder(&tiled, 64, 48, opts)
+	if err != nil {
+		t.Fatalf("NewTileEncoder() error: %v", err)
+	}
+	for ty := 0; ty < 3; ty++ {
+		for tx := 0; tx < 2; tx++ {
+			tile := src.SubImage(te.TileBounds(tx, ty)).(*image.YCbCr)
+			if err := te.WriteTile(tx, ty, tile); err != nil {
+				t.Fatalf("WriteTile(%d, %d) error: %v", tx, ty, err)
+			}
+		}
+	}
+	if err := te.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if !bytes.Equal(tiled.Bytes(), whole.Bytes()) {
+		t.Error("TileEncoder output differs from Encode")
+	}
+}
+
+func TestDecode_VendorMarkerInTilePart(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 3)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, &Options{Format: FormatJ2K, Lossless: true, NumResolutions: 2}); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+
+	// Insert a segment-less vendor marker and an unknown marker segment
+	// after the SOT segment, growing Psot to match
+	data := buf.Bytes()
+	sot := bytes.Index(data, []byte{0xFF, 0x90})
+	vendor := []byte{0xFF, 0x30, 0xFF, 0x6A, 0x00, 0x04, 0xAB, 0xCD}
+	data = slices.Insert(data, sot+12, vendor...)
+	psot := binary.BigEndian.Uint32(data[sot+6:])
+	binary.BigEndian.PutUint32(data[sot+6:], psot+uint32(len(vendor)))
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if got := img.(*image.Gray); !bytes.Equal(got.Pix, src.Pix) {
+		t.Error("decoded pixels differ from the source")
+	}
+
+	if err := ValidateStructure(bytes.NewReader(data)); err != nil {
+		t.Errorf("ValidateStructure() error: %v", err)
+	}
+	for _, issue := range Validate(bytes.NewReader(data)) {
+		if issue.Severity == SeverityError {
+			t.Errorf("Validate() error: %+v", issue)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package jpeg2000testing provides helpers for testing JPEG 2000 decode and
+// encode output against stored golden files.
+//
+// Golden files are regenerated by running the tests with the
+// JPEG2000_UPDATE_GOLDEN environment variable set to 1:
+//
+//	JPEG2000_UPDATE_GOLDEN=1 go test ./...
+//
+// A test binary that defines its own boolean -update flag can use that
+// instead; the package does not register a flag itself.
+//
+// The helpers are intended for use with the ISO/IEC 15444-4 conformance
+// test images. Those images are not distributed with this module; tests
+// skip when an input file is missing.
+package jpeg2000testing
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	jpeg2000 "github.com/mrjoshuak/go-jpeg2000"
+)
+
+// updateEnv is the environment variable that makes the helpers rewrite
+// golden files instead of comparing against them.
+const updateEnv = "JPEG2000_UPDATE_GOLDEN"
+
+// updating reports whether golden files are to be rewritten: when
+// updateEnv is set to a true value, or when the test binary has set a
+// boolean -update flag of its own.
+func updating() bool {
+	if v, err := strconv.ParseBool(os.Getenv(updateEnv)); err == nil && v {
+		return true
+	}
+	if f := flag.Lookup("update"); f != nil {
+		v, err := strconv.ParseBool(f.Value.String())
+		return err == nil && v
+	}
+	return false
+}
+
+// maxReportedDiffs limits the number of differing pixels listed in a failure.
+const maxReportedDiffs = 8
+
+// GoldenDecode decodes the JPEG 2000 file at j2kPath with cfg and compares
+// the result pixel by pixel against the PNG at goldenPNGPath. The test is
+// skipped if j2kPath does not exist. When updating, the golden PNG is
+// rewritten from the decoded image.
+func GoldenDecode(t testing.TB, j2kPath, goldenPNGPath string, cfg *jpeg2000.Config) {
+	t.Helper()
+	goldenDecode(t, j2kPath, goldenPNGPath, cfg, updating())
+}
+
+// GoldenEncode encodes the image at imgPath with opts and compares the
+// resulting bytes against the file at expectedJ2KPath. The input may be
+// any format registered with the image package. The test is skipped if
+// imgPath does not exist. When updating, the expected file is rewritten.
+func GoldenEncode(t testing.TB, imgPath, expectedJ2KPath string, opts *jpeg2000.Options) {
+	t.Helper()
+	goldenEncode(t, imgPath, expectedJ2KPath, opts, updating())
+}
+
+func goldenDecode(t testing.TB, j2kPath, goldenPNGPath string, cfg *jpeg2000.Config, update bool) {
+	t.Helper()
+
+	f, err := os.Open(j2kPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skipf("input not available: %s", j2kPath)
+	}
+	if err != nil {
+		t.Fatalf("opening %s: %v", j2kPath, err)
+	}
+	defer f.Close()
+
+	got, err := jpeg2000.DecodeConfig(f, cfg)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", j2kPath, err)
+	}
+
+	if update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, got); err != nil {
+			t.Fatalf("encoding golden PNG: %v", err)
+		}
+		writeGolden(t, goldenPNGPath, buf.Bytes())
+		return
+	}
+
+	gf, err := os.Open(goldenPNGPath)
+	if err != nil {
+		t.Fatalf("opening golden file (set JPEG2000_UPDATE_GOLDEN=1 to create): %v", err)
+	}
+	defer gf.Close()
+
+	want, err := png.Decode(gf)
+	if err != nil {
+		t.Fatalf("decoding golden PNG %s: %v", goldenPNGPath, err)
+	}
+
+	if diff := diffImages(got, want); diff != "" {
+		t.Errorf("decode of %s does not match %s:\n%s", j2kPath, goldenPNGPath, diff)
+	}
+}
+
+func goldenEncode(t testing.TB, imgPath, expectedJ2KPath string, opts *jpeg2000.Options, update bool) {
+	t.Helper()
+
+	f, err := os.Open(imgPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skipf("input not available: %s", imgPath)
+	}
+	if err != nil {
+		t.Fatalf("opening %s: %v", imgPath, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", imgPath, err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg2000.Encode(&buf, img, opts); err != nil {
+		t.Fatalf("encoding %s: %v", imgPath, err)
+	}
+
+	if update {
+		writeGolden(t, expectedJ2KPath, buf.Bytes())
+		return
+	}
+
+	want, err := os.ReadFile(expectedJ2KPath)
+	if err != nil {
+		t.Fatalf("reading golden file (set JPEG2000_UPDATE_GOLDEN=1 to create): %v", err)
+	}
+
+	if diff := diffBytes(buf.Bytes(), want); diff != "" {
+		t.Errorf("encode of %s does not match %s:\n%s", imgPath, expectedJ2KPath, diff)
+	}
+}
+
+// writeGolden writes data to path, creating parent directories as needed.
+func writeGolden(t testing.TB, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("creating golden directory: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("writing golden file: %v", err)
+	}
+}
+
+// diffImages returns a description of the differences between got and want,
+// or "" if they are identical when compared as 16-bit RGBA.
+func diffImages(got, want image.Image) string {
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Dx() != wb.Dx() || gb.Dy() != wb.Dy() {
+		return fmt.Sprintf("dimensions: got %dx%d, want %dx%d", gb.Dx(), gb.Dy(), wb.Dx(), wb.Dy())
+	}
+
+	var buf bytes.Buffer
+	numDiffs := 0
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			gr, gg, gbl, ga := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			wr, wg, wbl, wa := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			if gr == wr && gg == wg && gbl == wbl && ga == wa {
+				continue
+			}
+			if numDiffs < maxReportedDiffs {
+				fmt.Fprintf(&buf, "  (%d,%d): got RGBA64(%d,%d,%d,%d), want RGBA64(%d,%d,%d,%d)\n",
+					x, y, gr, gg, gbl, ga, wr, wg, wbl, wa)
+			}
+			numDiffs++
+		}
+	}
+	if numDiffs == 0 {
+		return ""
+	}
+	fmt.Fprintf(&buf, "  %d of %d pixels differ", numDiffs, gb.Dx()*gb.Dy())
+	return buf.String()
+}
+
+// diffBytes returns a description of the first difference between got and
+// want, or "" if they are identical.
+func diffBytes(got, want []byte) string {
+	if bytes.Equal(got, want) {
+		return ""
+	}
+	n := len(got)
+	if len(want) < n {
+		n = len(want)
+	}
+	for i := 0; i < n; i++ {
+		if got[i] != want[i] {
+			return fmt.Sprintf("  first difference at offset %d: got 0x%02X, want 0x%02X (lengths %d and %d)",
+				i, got[i], want[i], len(got), len(want))
+		}
+	}
+	return fmt.Sprintf("  lengths differ: got %d bytes, want %d bytes", len(got), len(want))
+}
@@ -0,0 +1,202 @@
+package jpeg2000testing
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jpeg2000 "github.com/mrjoshuak/go-jpeg2000"
+)
+
+// update is the test binary's own -update flag, as a package importing
+// jpeg2000testing might define; updating honours it.
+var update = flag.Bool("update", false, "update golden files")
+
+// conformanceDir holds ISO/IEC 15444-4 conformance codestreams alongside
+// their golden PNG decodes (e.g. p0_01.j2k and p0_01.png).
+const conformanceDir = "testdata/conformance"
+
+// recorder captures failures instead of reporting them to the real test.
+type recorder struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failed = true
+	r.msg = fmt.Sprintf(format, args...)
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+func writeTestPNG(t *testing.T, path string) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x*16 + y)})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenEncodeDecode(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.png")
+	encoded := filepath.Join(dir, "golden", "input.j2k")
+	decoded := filepath.Join(dir, "golden", "input.png")
+	writeTestPNG(t, input)
+
+	opts := jpeg2000.DefaultOptions()
+	opts.Format = jpeg2000.FormatJ2K
+	opts.Lossless = true
+
+	// Create golden files, then verify against them
+	goldenEncode(t, input, encoded, opts, true)
+	goldenEncode(t, input, encoded, opts, false)
+
+	goldenDecode(t, encoded, decoded, nil, true)
+	goldenDecode(t, encoded, decoded, nil, false)
+}
+
+func TestGoldenEncode_Mismatch(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.png")
+	expected := filepath.Join(dir, "input.j2k")
+	writeTestPNG(t, input)
+	if err := os.WriteFile(expected, []byte{0xFF, 0x4F}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &recorder{TB: t}
+	goldenEncode(r, input, expected, nil, false)
+	if !r.failed {
+		t.Fatal("goldenEncode() did not report a mismatch")
+	}
+	if !strings.Contains(r.msg, "does not match") {
+		t.Errorf("failure message = %q; want a mismatch description", r.msg)
+	}
+}
+
+func TestGoldenDecode_Mismatch(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.png")
+	encoded := filepath.Join(dir, "input.j2k")
+	golden := filepath.Join(dir, "golden.png")
+	writeTestPNG(t, input)
+
+	opts := jpeg2000.DefaultOptions()
+	opts.Format = jpeg2000.FormatJ2K
+	goldenEncode(t, input, encoded, opts, true)
+
+	// A golden image with different dimensions must fail
+	f, err := os.Create(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r := &recorder{TB: t}
+	goldenDecode(r, encoded, golden, nil, false)
+	if !r.failed {
+		t.Fatal("goldenDecode() did not report a mismatch")
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 4, 4))
+	b := image.NewGray(image.Rect(10, 10, 14, 14))
+	if diff := diffImages(a, b); diff != "" {
+		t.Errorf("diffImages() of identical content = %q; want empty", diff)
+	}
+
+	b.SetGray(11, 12, color.Gray{Y: 200})
+	diff := diffImages(a, b)
+	if !strings.Contains(diff, "(1,2)") || !strings.Contains(diff, "1 of 16 pixels differ") {
+		t.Errorf("diffImages() = %q; want report of pixel (1,2)", diff)
+	}
+}
+
+func TestDiffBytes(t *testing.T) {
+	tests := []struct {
+		got, want []byte
+		contains  string
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}, ""},
+		{[]byte{1, 2, 3}, []byte{1, 9, 3}, "offset 1"},
+		{[]byte{1, 2}, []byte{1, 2, 3}, "lengths differ"},
+	}
+	for _, tt := range tests {
+		diff := diffBytes(tt.got, tt.want)
+		if tt.contains == "" && diff != "" {
+			t.Errorf("diffBytes(%v, %v) = %q; want empty", tt.got, tt.want, diff)
+		}
+		if !strings.Contains(diff, tt.contains) {
+			t.Errorf("diffBytes(%v, %v) = %q; want it to contain %q", tt.got, tt.want, diff, tt.contains)
+		}
+	}
+}
+
+func TestUpdating(t *testing.T) {
+	t.Setenv(updateEnv, "")
+	if *update {
+		t.Skip("running with -update")
+	}
+	if updating() {
+		t.Error("updating() = true with neither the environment nor -update set")
+	}
+
+	t.Setenv(updateEnv, "1")
+	if !updating() {
+		t.Errorf("updating() = false with %s=1", updateEnv)
+	}
+
+	t.Setenv(updateEnv, "")
+	flag.Set("update", "true")
+	defer flag.Set("update", "false")
+	if !updating() {
+		t.Error("updating() = false with -update set")
+	}
+}
+
+// TestConformance decodes every ISO/IEC 15444-4 conformance codestream
+// found in testdata/conformance and compares it with its golden PNG.
+func TestConformance(t *testing.T) {
+	var inputs []string
+	for _, pattern := range []string{"*.j2k", "*.j2c", "*.jp2"} {
+		matches, _ := filepath.Glob(filepath.Join(conformanceDir, pattern))
+		inputs = append(inputs, matches...)
+	}
+	if len(inputs) == 0 {
+		t.Skipf("no conformance images in %s", conformanceDir)
+	}
+
+	for _, input := range inputs {
+		input := input
+		name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+		t.Run(name, func(t *testing.T) {
+			GoldenDecode(t, input, filepath.Join(conformanceDir, name+".png"), nil)
+		})
+	}
+}
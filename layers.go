@@ -0,0 +1,375 @@
+package jpeg2000
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+	"github.com/mrjoshuak/go-jpeg2000/internal/tcd"
+)
+
+// errNoPacketIndex is returned when a tile's packets cannot be located.
+var errNoPacketIndex = errors.New("locating packets requires PLT or SOP markers")
+
+// packetSpan locates one packet in the codestream.
+type packetSpan struct {
+	tcd.Packet
+
+	// Start and End are the codestream offsets of the packet, including
+	// any SOP marker.
+	Start, End int64
+}
+
+// walkPackets calls fn for every packet of every tile, in codestream
+// order. Packets are located from PLT marker segments or, failing that,
+// from SOP markers in the packet data, so no packet headers need to be
+// decoded; the position of each packet follows from the progression
+// order. Tiles whose packets cannot be located are passed to tileErr,
+// which may return an error to stop the walk.
+func (d *decoder) walkPackets(fn func(tile *tcd.Tile, p packetSpan), tileErr func(tile int, err error) error) error {
+	if d.tilePartErr != nil {
+		return d.tilePartErr
+	}
+
+	tileDecoder := tcd.NewTileDecoder(d.header)
+
+	for tileIdx, tile := range d.tiles {
+		if tile == nil {
+			continue
+		}
+
+		cod := tile.header.CodingStyle
+		sop := cod.CodingStyle&codestream.CodingStyleSOP != 0
+		spans := tile.packetSpans(d.codestream, sop)
+		if spans == nil {
+			if err := tileErr(tileIdx, errNoPacketIndex); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tileDecoder.SetHeader(tile.header)
+		tileDecoder.InitTile(tileIdx)
+		t := tileDecoder.Tile()
+		it := tilePackets(t, cod, tile.header.ProgressionOrderChanges)
+		for _, span := range spans {
+			p, ok := it.Next()
+			for ok && tilePrecinct(t, p) == nil {
+				p, ok = it.Next()
+			}
+			if !ok {
+				if err := tileErr(tileIdx, errors.New("more packets than the progression allows")); err != nil {
+					return err
+				}
+				break
+			}
+			fn(t, packetSpan{Packet: p, Start: span[0], End: span[1]})
+		}
+	}
+
+	return nil
+}
+
+// layerBoundaries returns, for each quality layer l, the number of
+// codestream bytes needed to hold every packet of layers 0 through l. The
+// final entry is the codestream length.
+func (d *decoder) layerBoundaries() ([]int64, error) {
+	numLayers := int(d.header.CodingStyle.NumLayers)
+	if numLayers == 0 {
+		return nil, fmt.Errorf("invalid number of layers: 0")
+	}
+
+	boundaries := make([]int64, numLayers)
+	err := d.walkPackets(
+		func(tile *tcd.Tile, p packetSpan) {
+			if p.End > boundaries[p.Layer] {
+				boundaries[p.Layer] = p.End
+			}
+		},
+		func(tile int, err error) error {
+			return fmt.Errorf("tile %d: %w", tile, err)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for l := 1; l < numLayers; l++ {
+		if boundaries[l] < boundaries[l-1] {
+			boundaries[l] = boundaries[l-1]
+		}
+	}
+	boundaries[numLayers-1] = int64(len(d.codestream))
+
+	return boundaries, nil
+}
+
+// packetTrace is one line of the Config.Debug packet trace.
+type packetTrace struct {
+	Tile       int          `json:"tile"`
+	Packet     *tracePacket `json:"packet,omitempty"`
+	CodeBlocks int          `json:"codeBlocks"`
+	Bytes      int64        `json:"bytes"`
+	Present    bool         `json:"present"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// tracePacket identifies a packet within its tile.
+type tracePacket struct {
+	Layer      int `json:"layer"`
+	Resolution int `json:"resolution"`
+	Component  int `json:"component"`
+	Precinct   int `json:"precinct"`
+}
+
+// writeTrace writes the packet traces of tiles, in order, to w as JSON
+// lines.
+func writeTrace(w io.Writer, traces [][]packetTrace, tiles []int) error {
+	enc := json.NewEncoder(w)
+	for _, tile := range tiles {
+		for _, t := range traces[tile] {
+			if err := enc.Encode(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tileParts collects the packet data of one tile across its tile-parts.
+type tileParts struct {
+	// header is the main header with the COD, COC, QCD and QCC marker
+	// segments of the tile-part headers applied, and the progression
+	// order changes of their POC marker segments, if any, in place of the
+	// main header's.
+	header *codestream.Header
+
+	// segments holds the [start, end) codestream offsets of the packet
+	// data of each tile-part, in order.
+	segments [][2]int
+
+	// lengths holds the packet lengths signalled in PLT marker segments.
+	lengths []int
+
+	// headers holds the packet headers moved out of the packet data into
+	// PPM or PPT marker segments, in order; nil when the packets carry
+	// their own headers.
+	headers []byte
+
+	// poc reports that a tile-part header had a POC marker segment.
+	poc bool
+}
+
+// packetIterator yields the packets of a tile in codestream order.
+type packetIterator interface {
+	Next() (tcd.Packet, bool)
+}
+
+// tilePackets returns an iterator over the packets of tile in the order
+// cod gives or, when there are progression order changes, in the order of
+// each change in turn. Packets the changes leave out follow in the cod
+// order.
+func tilePackets(tile *tcd.Tile, cod codestream.CodingStyleDefault, pocs []codestream.ProgressionOrderChange) packetIterator {
+	iterator := func(order uint8) *tcd.PacketIterator {
+		return tcd.NewPacketIterator(len(tile.Components), maxResolutions(tile), int(cod.NumLayers),
+			precinctCounts(tile), codestream.ProgressionOrder(order))
+	}
+	if len(pocs) == 0 {
+		return iterator(cod.ProgressionOrder)
+	}
+
+	its := make([]*tcd.PacketIterator, 0, len(pocs)+1)
+	for _, poc := range pocs {
+		compEnd := int(poc.ComponentEnd)
+		if compEnd == 0 {
+			compEnd = 256 // CEpoc of 0 means 256
+		}
+		it := iterator(poc.ProgressionOrder)
+		it.SetBounds(int(poc.ResolutionStart), int(poc.ResolutionEnd),
+			int(poc.ComponentStart), compEnd, int(poc.LayerEnd))
+		its = append(its, it)
+	}
+	return tcd.NewPacketSequence(append(its, iterator(cod.ProgressionOrder))...)
+}
+
+// readTileParts reads the tile-part headers of data with p, which has
+// read the main header h of data from r along with the SOT marker of the
+// first tile-part, and returns the tile-parts of each tile, indexed by
+// tile. An error stops the walk; the tiles read before it are returned
+// with it. A codestream that ends inside a tile-part, or without an EOC
+// marker, is reported with ErrTruncated, and the data of a tile-part cut
+// short is kept.
+func readTileParts(p *codestream.Parser, r *byteReader, h *codestream.Header) ([]*tileParts, error) {
+	data := r.data
+	tiles := make([]*tileParts, int(h.NumTilesX)*int(h.NumTilesY))
+
+	// With PPM, each tile-part takes the next Nppm bytes of the packet
+	// headers of the main header
+	ppm := h.PackedPacketHeaders
+
+	for {
+		start := r.pos - 2 // after the SOT marker
+		tph, err := p.ReadTilePartHeader()
+		if err != nil {
+			return tiles, truncated(fmt.Errorf("tile-part at offset %d: %w", start, err))
+		}
+		tileIdx := int(tph.TileIndex)
+		if tileIdx >= len(tiles) {
+			return tiles, fmt.Errorf("tile-part at offset %d: tile index %d out of range [0, %d)", start, tileIdx, len(tiles))
+		}
+		psot := int(tph.TilePartLength)
+		end := start + psot
+		var eoc bool
+		if psot == 0 {
+			end = len(data)
+			if end-2 >= r.pos && codestream.Marker(binary.BigEndian.Uint16(data[end-2:])) == codestream.EOC {
+				end -= 2
+				eoc = true
+			}
+		}
+		if end < r.pos {
+			return tiles, fmt.Errorf("tile-part at offset %d: invalid length %d", start, psot)
+		}
+		cut := end > len(data)
+		end = min(end, len(data))
+
+		if tiles[tileIdx] == nil {
+			tiles[tileIdx] = &tileParts{header: h}
+		}
+		t := tiles[tileIdx]
+		t.header = withTilePartHeader(t.header, tph)
+		if len(tph.ProgressionOrderChanges) > 0 {
+			if !t.poc {
+				t.header.ProgressionOrderChanges = nil
+				t.poc = true
+			}
+			t.header.ProgressionOrderChanges = append(t.header.ProgressionOrderChanges, tph.ProgressionOrderChanges...)
+		}
+		if ppm != nil {
+			if len(ppm) < 4 {
+				return tiles, fmt.Errorf("tile-part at offset %d: no PPM packet headers", start)
+			}
+			nppm := int(binary.BigEndian.Uint32(ppm))
+			if nppm > len(ppm)-4 {
+				return tiles, fmt.Errorf("tile-part at offset %d: truncated PPM packet headers", start)
+			}
+			t.headers = append(t.headers, ppm[4:4+nppm]...)
+			ppm = ppm[4+nppm:]
+		}
+		t.headers = append(t.headers, tph.PackedPacketHeaders...)
+		for _, l := range tph.PacketLengths {
+			t.lengths = append(t.lengths, int(l))
+		}
+		t.segments = append(t.segments, [2]int{r.pos, end})
+		p.ClearTilePartState()
+
+		// The next tile-part or the EOC marker follows
+		switch {
+		case cut:
+			return tiles, fmt.Errorf("%w: tile-part at offset %d: length %d runs past the end of the codestream",
+				ErrTruncated, start, psot)
+		case psot == 0 && !eoc, psot != 0 && end+2 > len(data):
+			return tiles, fmt.Errorf("%w: no EOC marker", ErrTruncated)
+		case psot == 0 || codestream.Marker(binary.BigEndian.Uint16(data[end:])) != codestream.SOT:
+			return tiles, nil
+		}
+		r.pos = end + 2
+	}
+}
+
+// packetSpans returns the [start, end) codestream offsets of each packet
+// of the tile, or nil when the packets cannot be located.
+func (t *tileParts) packetSpans(data []byte, sop bool) [][2]int64 {
+	if len(t.lengths) > 0 {
+		// Packets never straddle tile-parts, so walk the segments in step
+		// with the signalled lengths.
+		spans := make([][2]int64, 0, len(t.lengths))
+		seg, pos := 0, 0
+		for _, l := range t.lengths {
+			for seg < len(t.segments) && pos == t.segments[seg][1] {
+				seg++
+				if seg < len(t.segments) {
+					pos = t.segments[seg][0]
+				}
+			}
+			if seg == len(t.segments) {
+				return nil
+			}
+			if seg == 0 && len(spans) == 0 {
+				pos = t.segments[0][0]
+			}
+			if pos+l > t.segments[seg][1] {
+				return nil
+			}
+			spans = append(spans, [2]int64{int64(pos), int64(pos + l)})
+			pos += l
+		}
+		return spans
+	}
+
+	if !sop {
+		return nil
+	}
+
+	// Each packet starts with an SOP marker; bit stuffing keeps 0xFF91
+	// out of packet headers and code-block data.
+	var spans [][2]int64
+	for _, s := range t.segments {
+		start := s[0]
+		for p := s[0] + 1; p+1 < s[1]; p++ {
+			if data[p] == 0xFF && data[p+1] == 0x91 {
+				spans = append(spans, [2]int64{int64(start), int64(p)})
+				start = p
+			}
+		}
+		if start < s[1] {
+			spans = append(spans, [2]int64{int64(start), int64(s[1])})
+		}
+	}
+	return spans
+}
+
+// precinctCounts returns the number of precincts of each resolution of
+// each component of tile, in the layout tcd.NewPacketIterator expects.
+func precinctCounts(tile *tcd.Tile) [][][]int {
+	counts := make([][][]int, len(tile.Components))
+	for c, tc := range tile.Components {
+		counts[c] = make([][]int, len(tc.Resolutions))
+		for r, res := range tc.Resolutions {
+			counts[c][r] = []int{len(res.Precincts)}
+		}
+	}
+	return counts
+}
+
+// maxResolutions returns the largest number of resolution levels of the
+// components of tile.
+func maxResolutions(tile *tcd.Tile) int {
+	n := 0
+	for _, tc := range tile.Components {
+		n = max(n, len(tc.Resolutions))
+	}
+	return n
+}
+
+// tilePrecinct returns the precinct of tile that packet p belongs to, or
+// nil if the tile has no such precinct: a component may have fewer
+// resolution levels than the progression covers, and a resolution may
+// have fewer precincts than the iterator visits.
+func tilePrecinct(tile *tcd.Tile, p tcd.Packet) *tcd.Precinct {
+	if p.Component >= len(tile.Components) {
+		return nil
+	}
+	tc := tile.Components[p.Component]
+	if p.Resolution >= len(tc.Resolutions) {
+		return nil
+	}
+	res := tc.Resolutions[p.Resolution]
+	if p.Precinct >= len(res.Precincts) {
+		return nil
+	}
+	return res.Precincts[p.Precinct]
+}
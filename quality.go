@@ -0,0 +1,99 @@
+package jpeg2000
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// MSE returns the mean squared error between a and b, averaged over every
+// channel of every pixel. The images must have the same bounds and color
+// model. Samples are compared at 16-bit precision for 16-bit color models
+// and at 8-bit precision otherwise, so the result is in the units of the
+// model's own sample values.
+func MSE(a, b image.Image) (float64, error) {
+	sum, n, _, err := squaredError(a, b)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return sum / float64(n), nil
+}
+
+// PSNR returns the peak signal-to-noise ratio between a and b in decibels,
+// using a peak of 255 for 8-bit color models and 65535 for 16-bit ones.
+// Identical images return +Inf. The images must have the same bounds and
+// color model.
+func PSNR(a, b image.Image) (float64, error) {
+	sum, n, peak, err := squaredError(a, b)
+	if err != nil {
+		return 0, err
+	}
+	if sum == 0 || n == 0 {
+		return math.Inf(1), nil
+	}
+	mse := sum / float64(n)
+	return 10 * math.Log10(peak*peak/mse), nil
+}
+
+// squaredError returns the summed squared sample differences between a
+// and b, the number of samples compared and the peak sample value.
+func squaredError(a, b image.Image) (sum float64, n int, peak float64, err error) {
+	if a.Bounds() != b.Bounds() {
+		return 0, 0, 0, fmt.Errorf("image bounds differ: %v and %v", a.Bounds(), b.Bounds())
+	}
+	if !sameModel(a.ColorModel(), b.ColorModel()) {
+		return 0, 0, 0, fmt.Errorf("image color models differ")
+	}
+
+	model := a.ColorModel()
+	shift, peak := uint32(8), 255.0
+	switch model {
+	case color.Gray16Model, color.RGBA64Model, color.NRGBA64Model:
+		shift, peak = 0, 65535
+	}
+	channels := 3
+	switch model {
+	case color.GrayModel, color.Gray16Model:
+		channels = 1
+	case color.RGBAModel, color.NRGBAModel, color.RGBA64Model, color.NRGBA64Model:
+		channels = 4
+	}
+
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, aa := a.At(x, y).RGBA()
+			br, bg, bb, ba := b.At(x, y).RGBA()
+			sa := [4]uint32{ar, ag, ab, aa}
+			sb := [4]uint32{br, bg, bb, ba}
+			for c := 0; c < channels; c++ {
+				d := float64(sa[c]>>shift) - float64(sb[c]>>shift)
+				sum += d * d
+			}
+		}
+	}
+	return sum, r.Dx() * r.Dy() * channels, peak, nil
+}
+
+// sameModel reports whether a and b are the same color model. Palettes
+// are slices, so they are compared element by element rather than with ==.
+func sameModel(a, b color.Model) bool {
+	pa, okA := a.(color.Palette)
+	pb, okB := b.(color.Palette)
+	if !okA && !okB {
+		return a == b
+	}
+	if !okA || !okB || len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return false
+		}
+	}
+	return true
+}
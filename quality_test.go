@@ -0,0 +1,62 @@
+package jpeg2000
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestMSEAndPSNR(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 4, 4))
+	b := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range a.Pix {
+		a.Pix[i] = 100
+		b.Pix[i] = 100
+	}
+
+	if got, err := PSNR(a, b); err != nil || !math.IsInf(got, 1) {
+		t.Errorf("PSNR(identical) = %v, %v; want +Inf", got, err)
+	}
+
+	// Four of sixteen samples differ by 4: MSE = 4*16/16 = 4
+	for i := 0; i < 4; i++ {
+		b.Pix[i] = 104
+	}
+	mse, err := MSE(a, b)
+	if err != nil || mse != 4 {
+		t.Errorf("MSE() = %v, %v; want 4", mse, err)
+	}
+	psnr, err := PSNR(a, b)
+	want := 10 * math.Log10(255*255/4.0)
+	if err != nil || math.Abs(psnr-want) > 1e-9 {
+		t.Errorf("PSNR() = %v, %v; want %v", psnr, err, want)
+	}
+
+	// 16-bit models use 16-bit samples and a 65535 peak
+	a16 := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	b16 := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	a16.SetRGBA64(0, 0, color.RGBA64{R: 1000, A: 0xFFFF})
+	b16.SetRGBA64(0, 0, color.RGBA64{R: 1010, A: 0xFFFF})
+	if mse, err := MSE(a16, b16); err != nil || mse != 100.0/8 {
+		t.Errorf("MSE(RGBA64) = %v, %v; want %v", mse, err, 100.0/8)
+	}
+	if psnr, err := PSNR(a16, b16); err != nil || math.Abs(psnr-10*math.Log10(65535*65535/(100.0/8))) > 1e-9 {
+		t.Errorf("PSNR(RGBA64) = %v, %v", psnr, err)
+	}
+
+	if _, err := MSE(a, image.NewGray(image.Rect(0, 0, 4, 5))); err == nil {
+		t.Error("MSE() with different bounds succeeded, want error")
+	}
+	if _, err := PSNR(a, image.NewGray16(image.Rect(0, 0, 4, 4))); err == nil {
+		t.Error("PSNR() with different color models succeeded, want error")
+	}
+
+	pal := color.Palette{color.Black, color.White}
+	p1 := image.NewPaletted(image.Rect(0, 0, 2, 2), pal)
+	p2 := image.NewPaletted(image.Rect(0, 0, 2, 2), pal)
+	p2.SetColorIndex(0, 0, 1)
+	if mse, err := MSE(p1, p2); err != nil || mse != 255*255/4.0 {
+		t.Errorf("MSE(Paletted) = %v, %v; want %v", mse, err, 255*255/4.0)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build experiment
+
+package jpeg2000
+
+// SubbandKey identifies one subband of one component. Resolution 0 holds
+// only the LL band (Band 0); higher resolutions number HL, LH and HH as
+// bands 0, 1 and 2, matching EncodeStats.SubbandBytes.
+type SubbandKey struct {
+	Component, Resolution, Band int
+}
+
+// experimentalOptions holds encoder options that are only available when
+// building with the experiment tag.
+type experimentalOptions struct {
+	// SubbandGain scales the contribution of individual subbands in lossy
+	// encoding. The quantization step size of a listed subband is divided
+	// by its gain, so a gain of 0.5 doubles the step size and attenuates
+	// the subband. Missing or non-positive entries leave the default.
+	SubbandGain map[SubbandKey]float64
+}
+
+// subbandGain returns the gain of band band of resolution res of
+// component comp, 1 unless Options.SubbandGain sets a positive one.
+func (e *encoder) subbandGain(comp, res, band int) float64 {
+	if g, ok := e.options.SubbandGain[SubbandKey{comp, res, band}]; ok && g > 0 {
+		return g
+	}
+	return 1
+}
+
+// hasSubbandGain reports whether Options.SubbandGain lists a band of
+// component comp, which is then given its own step sizes in a QCC marker.
+func (e *encoder) hasSubbandGain(comp int) bool {
+	for k := range e.options.SubbandGain {
+		if k.Component == comp {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !experiment
+
+package jpeg2000
+
+// experimentalOptions is empty unless building with the experiment tag.
+type experimentalOptions struct{}
+
+// subbandGain reports no per-subband gain outside experiment builds.
+func (e *encoder) subbandGain(comp, res, band int) float64 {
+	return 1
+}
+
+// hasSubbandGain reports no per-subband gain outside experiment builds.
+func (e *encoder) hasSubbandGain(comp int) bool {
+	return false
+}
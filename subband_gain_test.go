@@ -0,0 +1,65 @@
+//go:build experiment
+
+package jpeg2000
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// quantizedCoefficients runs the encoder front end and returns component 0.
+func quantizedCoefficients(t *testing.T, img image.Image, opts *Options) []int32 {
+	t.Helper()
+	e := newEncoder(nil, img, opts)
+	if err := e.extractImageData(); err != nil {
+		t.Fatalf("extractImageData() error: %v", err)
+	}
+	if err := e.preprocess(); err != nil {
+		t.Fatalf("preprocess() error: %v", err)
+	}
+	return e.componentData[0]
+}
+
+func TestSubbandGain_HH(t *testing.T) {
+	const size = 64
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8((x*37 + y*91 + x*y) % 256)})
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.NumResolutions = 3
+	base := quantizedCoefficients(t, img, opts)
+
+	// Resolution 2 is the finest level; band 2 is HH
+	opts.SubbandGain = map[SubbandKey]float64{{Component: 0, Resolution: 2, Band: 2}: 0.5}
+	gained := quantizedCoefficients(t, img, opts)
+
+	half := size / 2
+	nonZero := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			i := y*size + x
+			if x >= half && y >= half {
+				// Twice the step size halves the quantized value
+				want := float64(base[i]) / 2
+				if d := float64(gained[i]) - want; d < -1 || d > 1 {
+					t.Fatalf("HH(%d,%d) = %d, want about %.1f", x, y, gained[i], want)
+				}
+				if base[i] != 0 {
+					nonZero++
+				}
+				continue
+			}
+			if gained[i] != base[i] {
+				t.Fatalf("non-HH coefficient (%d,%d) changed: %d -> %d", x, y, base[i], gained[i])
+			}
+		}
+	}
+	if nonZero == 0 {
+		t.Fatal("HH band is all zero; test image has no high-frequency content")
+	}
+}
@@ -0,0 +1,239 @@
+// Package tagtree implements the tag trees that JPEG 2000 packet headers
+// use to code code-block inclusion and zero bit-planes (ITU-T T.800
+// B.10.2).
+//
+// A tag tree holds a non-negative integer for each leaf of a
+// two-dimensional grid, one leaf per code-block of a precinct band. Each
+// internal node holds the minimum of the up to four nodes below it, and
+// coding a leaf against a threshold sends just enough bits for a reader
+// to learn whether the leaf's value is below the threshold, and if so the
+// value itself. Bits already sent for an ancestor shared with earlier
+// leaves are not repeated, so the state of a tree carries over from one
+// packet of a precinct to the next.
+//
+// Packet headers use two trees per band:
+//
+//   - The inclusion tree holds, for each code-block, the index of the
+//     first quality layer that contributes to it. In the packet of layer
+//     l, a code-block not yet included is coded against threshold l+1:
+//     it is included in that layer if and only if its value is below it.
+//     Once included, inclusion in later layers is a single bit outside
+//     the tree.
+//   - The zero bit-plane tree holds the number of missing most
+//     significant bit-planes of each code-block. It is coded in full,
+//     with EncodeValue and DecodeValue, in the packet that first includes
+//     the code-block.
+//
+// Bits are read and written through BitReader and BitWriter, which the
+// caller implements with the bit stuffing of packet headers: after a
+// 0xFF byte only seven bits are used.
+package tagtree
+
+// BitReader reads the bits of a packet header.
+type BitReader interface {
+	ReadBit() (int, error)
+}
+
+// BitWriter writes the bits of a packet header.
+type BitWriter interface {
+	WriteBit(bit int) error
+}
+
+// unknown is the value of a node that has not been set or decoded.
+const unknown = int(^uint(0) >> 1)
+
+// TagTree is a tag tree over a grid of leaves. The zero value is not
+// usable; create trees with NewTagTree.
+type TagTree struct {
+	width  int
+	height int
+	levels int
+	nodes  [][]tagNode
+	widths []int // Node columns at each level
+}
+
+type tagNode struct {
+	value int
+	low   int
+	known bool
+}
+
+// NewTagTree returns a tree over width×height leaves whose values are all
+// unknown, ready for decoding.
+func NewTagTree(width, height int) *TagTree {
+	t := &TagTree{
+		width:  width,
+		height: height,
+	}
+
+	// Calculate number of levels
+	w, h := width, height
+	for w > 1 || h > 1 {
+		t.levels++
+		w = (w + 1) / 2
+		h = (h + 1) / 2
+	}
+	t.levels++
+
+	// Allocate nodes
+	t.nodes = make([][]tagNode, t.levels)
+	t.widths = make([]int, t.levels)
+	w, h = width, height
+	for level := 0; level < t.levels; level++ {
+		t.nodes[level] = make([]tagNode, w*h)
+		t.widths[level] = w
+		for i := range t.nodes[level] {
+			t.nodes[level][i].value = unknown
+		}
+		w = (w + 1) / 2
+		h = (h + 1) / 2
+	}
+
+	return t
+}
+
+// Width returns the number of leaf columns.
+func (t *TagTree) Width() int {
+	return t.width
+}
+
+// Height returns the number of leaf rows.
+func (t *TagTree) Height() int {
+	return t.height
+}
+
+// SetValue sets the value of leaf (x, y) for encoding. Call Propagate
+// once every leaf is set.
+func (t *TagTree) SetValue(x, y, value int) {
+	t.nodes[0][y*t.width+x].value = value
+}
+
+// Value returns the value of leaf (x, y): the one set with SetValue, or
+// the one decoded once Decode has reported it below a threshold.
+func (t *TagTree) Value(x, y int) int {
+	return t.nodes[0][y*t.width+x].value
+}
+
+// Propagate sets every internal node to the minimum of its children, as
+// the encoder requires once all leaf values are set.
+func (t *TagTree) Propagate() {
+	for level := 1; level < t.levels; level++ {
+		below, w := t.nodes[level-1], t.widths[level-1]
+		for i := range t.nodes[level] {
+			t.nodes[level][i].value = unknown
+		}
+		for i := range below {
+			x, y := i%w, i/w
+			n := &t.nodes[level][(y>>1)*t.widths[level]+(x>>1)]
+			if below[i].value < n.value {
+				n.value = below[i].value
+			}
+		}
+	}
+}
+
+// Reset forgets the bits coded so far but keeps the node values, so an
+// encoder can code the same values again from the start.
+func (t *TagTree) Reset() {
+	for level := range t.nodes {
+		for i := range t.nodes[level] {
+			t.nodes[level][i].low = 0
+			t.nodes[level][i].known = false
+		}
+	}
+}
+
+// Clear returns every node to the unknown state a decoder starts from.
+func (t *TagTree) Clear() {
+	for level := range t.nodes {
+		for i := range t.nodes[level] {
+			t.nodes[level][i] = tagNode{value: unknown}
+		}
+	}
+}
+
+// node returns the node covering leaf (x, y) at the given level.
+func (t *TagTree) node(level, x, y int) *tagNode {
+	return &t.nodes[level][(y>>level)*t.widths[level]+(x>>level)]
+}
+
+// Encode codes the value of leaf (x, y) against threshold: enough bits
+// for a decoder to learn the value if it is below threshold, or that it
+// is not otherwise. Bits already sent for shared ancestors are not
+// repeated.
+func (t *TagTree) Encode(w BitWriter, x, y, threshold int) error {
+	low := 0
+	for level := t.levels - 1; level >= 0; level-- {
+		n := t.node(level, x, y)
+		if low > n.low {
+			n.low = low
+		} else {
+			low = n.low
+		}
+		for low < threshold {
+			if low >= n.value {
+				if !n.known {
+					if err := w.WriteBit(1); err != nil {
+						return err
+					}
+					n.known = true
+				}
+				break
+			}
+			if err := w.WriteBit(0); err != nil {
+				return err
+			}
+			low++
+		}
+		n.low = low
+	}
+	return nil
+}
+
+// Decode reads the bits Encode writes for leaf (x, y) and threshold, and
+// reports whether the leaf's value is below threshold. Once it is, the
+// value is available from Value.
+func (t *TagTree) Decode(r BitReader, x, y, threshold int) (bool, error) {
+	low := 0
+	for level := t.levels - 1; level >= 0; level-- {
+		n := t.node(level, x, y)
+		if low > n.low {
+			n.low = low
+		} else {
+			low = n.low
+		}
+		for low < threshold && low < n.value {
+			bit, err := r.ReadBit()
+			if err != nil {
+				return false, err
+			}
+			if bit == 1 {
+				n.value = low
+			} else {
+				low++
+			}
+		}
+		n.low = low
+	}
+	return t.Value(x, y) < threshold, nil
+}
+
+// EncodeValue codes the value of leaf (x, y) in full, as for the zero
+// bit-planes of a code-block.
+func (t *TagTree) EncodeValue(w BitWriter, x, y int) error {
+	return t.Encode(w, x, y, unknown)
+}
+
+// DecodeValue reads the bits EncodeValue writes for leaf (x, y) and
+// returns the leaf's value.
+func (t *TagTree) DecodeValue(r BitReader, x, y int) (int, error) {
+	for threshold := 1; ; threshold++ {
+		ok, err := t.Decode(r, x, y, threshold)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return t.Value(x, y), nil
+		}
+	}
+}
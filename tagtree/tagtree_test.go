@@ -0,0 +1,278 @@
+package tagtree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/bio"
+)
+
+// TestNewTagTree tests TagTree creation.
+func TestNewTagTree(t *testing.T) {
+	tests := []struct {
+		width, height int
+		expectLevels  int
+	}{
+		{1, 1, 1},   // Single node, 1 level
+		{2, 2, 2},   // 2x2, needs 2 levels (4->1)
+		{4, 4, 3},   // 4x4, needs 3 levels (16->4->1)
+		{8, 8, 4},   // 8x8, needs 4 levels
+		{3, 3, 3},   // 3x3, needs 3 levels (9->4->1)
+		{5, 7, 4},   // 5x7, needs 4 levels
+		{16, 16, 5}, // 16x16, needs 5 levels
+	}
+
+	for _, tt := range tests {
+		tree := NewTagTree(tt.width, tt.height)
+		if tree == nil {
+			t.Errorf("NewTagTree(%d, %d) returned nil", tt.width, tt.height)
+			continue
+		}
+		if tree.width != tt.width {
+			t.Errorf("NewTagTree(%d, %d).width = %d; want %d", tt.width, tt.height, tree.width, tt.width)
+		}
+		if tree.height != tt.height {
+			t.Errorf("NewTagTree(%d, %d).height = %d; want %d", tt.width, tt.height, tree.height, tt.height)
+		}
+		if tree.levels != tt.expectLevels {
+			t.Errorf("NewTagTree(%d, %d).levels = %d; want %d", tt.width, tt.height, tree.levels, tt.expectLevels)
+		}
+		// Verify nodes are allocated
+		if len(tree.nodes) != tt.expectLevels {
+			t.Errorf("NewTagTree(%d, %d) has %d node levels; want %d", tt.width, tt.height, len(tree.nodes), tt.expectLevels)
+		}
+	}
+}
+
+// TestTagTreeSetValue tests setting values in the tag tree.
+func TestTagTreeSetValue(t *testing.T) {
+	tree := NewTagTree(4, 4)
+
+	// Set some values
+	tree.SetValue(0, 0, 5)
+	tree.SetValue(1, 0, 3)
+	tree.SetValue(0, 1, 7)
+	tree.SetValue(3, 3, 2)
+
+	// Verify values are set correctly
+	if tree.nodes[0][0].value != 5 {
+		t.Errorf("SetValue(0, 0, 5) failed; got %d", tree.nodes[0][0].value)
+	}
+	if tree.nodes[0][1].value != 3 {
+		t.Errorf("SetValue(1, 0, 3) failed; got %d", tree.nodes[0][1].value)
+	}
+	if tree.nodes[0][4].value != 7 { // y=1 means index=4 for width=4
+		t.Errorf("SetValue(0, 1, 7) failed; got %d", tree.nodes[0][4].value)
+	}
+	if tree.nodes[0][15].value != 2 { // x=3, y=3 means index=15
+		t.Errorf("SetValue(3, 3, 2) failed; got %d", tree.nodes[0][15].value)
+	}
+}
+
+// TestTagTreeReset tests resetting the tag tree state.
+func TestTagTreeReset(t *testing.T) {
+	tree := NewTagTree(4, 4)
+
+	// Set some values and states
+	tree.SetValue(0, 0, 5)
+	tree.SetValue(1, 0, 3)
+
+	// Manually set some state
+	tree.nodes[0][0].low = 2
+	tree.nodes[0][0].known = true
+	tree.nodes[1][0].low = 1
+	tree.nodes[1][0].known = true
+
+	// Reset
+	tree.Reset()
+
+	// Verify values are preserved but state is reset
+	if tree.nodes[0][0].value != 5 {
+		t.Errorf("Reset cleared value; got %d, want 5", tree.nodes[0][0].value)
+	}
+	if tree.nodes[0][0].low != 0 {
+		t.Errorf("Reset didn't clear low; got %d, want 0", tree.nodes[0][0].low)
+	}
+	if tree.nodes[0][0].known != false {
+		t.Errorf("Reset didn't clear known; got %v, want false", tree.nodes[0][0].known)
+	}
+	if tree.nodes[1][0].low != 0 {
+		t.Errorf("Reset didn't clear level 1 low; got %d, want 0", tree.nodes[1][0].low)
+	}
+}
+
+// TestTagTreeEdgeCases tests edge cases for tag trees.
+func TestTagTreeEdgeCases(t *testing.T) {
+	// Very small tree
+	tree1x1 := NewTagTree(1, 1)
+	if tree1x1.levels != 1 {
+		t.Errorf("1x1 tree has %d levels; want 1", tree1x1.levels)
+	}
+	tree1x1.SetValue(0, 0, 42)
+	if tree1x1.nodes[0][0].value != 42 {
+		t.Errorf("1x1 tree SetValue failed")
+	}
+	tree1x1.Reset()
+	if tree1x1.nodes[0][0].value != 42 {
+		t.Error("Reset shouldn't clear values")
+	}
+
+	// Asymmetric tree
+	tree2x4 := NewTagTree(2, 4)
+	if tree2x4.width != 2 || tree2x4.height != 4 {
+		t.Errorf("2x4 tree has wrong dimensions")
+	}
+	tree2x4.SetValue(0, 3, 99)
+	if tree2x4.nodes[0][6].value != 99 { // index = 3*2 + 0 = 6
+		t.Errorf("2x4 tree SetValue at (0,3) failed")
+	}
+}
+
+// BenchmarkNewTagTree benchmarks tag tree creation.
+func BenchmarkNewTagTree(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		NewTagTree(64, 64)
+	}
+}
+
+// BenchmarkTagTreeSetValue benchmarks setting values in tag tree.
+func BenchmarkTagTreeSetValue(b *testing.B) {
+	tree := NewTagTree(64, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.SetValue(i%64, i%64, i)
+	}
+}
+
+// BenchmarkTagTreeReset benchmarks resetting tag tree.
+func BenchmarkTagTreeReset(b *testing.B) {
+	tree := NewTagTree(64, 64)
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			tree.SetValue(x, y, x+y)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Reset()
+	}
+}
+
+// TestTagTreeRoundTrip codes every leaf of a tag tree against rising
+// thresholds, as packet headers do, and checks the decoder learns each
+// value once the threshold passes it.
+func TestTagTreeRoundTrip(t *testing.T) {
+	const w, h = 3, 5
+	values := []int{0, 1, 5, 2, 2, 0, 7, 3, 3, 1, 4, 0, 2, 6, 1}
+
+	enc := NewTagTree(w, h)
+	for i, v := range values {
+		enc.SetValue(i%w, i/w, v)
+	}
+	enc.Propagate()
+
+	var buf bytes.Buffer
+	bw := bio.NewByteStuffingWriter(&buf)
+	for threshold := 1; threshold <= 8; threshold++ {
+		for i := range values {
+			if err := enc.Encode(bw, i%w, i/w, threshold); err != nil {
+				t.Fatalf("Encode error: %v", err)
+			}
+		}
+	}
+	bw.Flush()
+
+	dec := NewTagTree(w, h)
+	dec.Clear()
+	br := bio.NewByteStuffingReader(bytes.NewReader(buf.Bytes()))
+	for threshold := 1; threshold <= 8; threshold++ {
+		for i, v := range values {
+			known, err := dec.Decode(br, i%w, i/w, threshold)
+			if err != nil {
+				t.Fatalf("Decode error: %v", err)
+			}
+			if known != (v < threshold) {
+				t.Fatalf("leaf %d, threshold %d: known = %v; want %v", i, threshold, known, v < threshold)
+			}
+			if known && dec.Value(i%w, i/w) != v {
+				t.Errorf("leaf %d = %d; want %d", i, dec.Value(i%w, i/w), v)
+			}
+		}
+	}
+}
+
+// TestTagTreeSharedBits checks that bits already sent for a common
+// ancestor are not repeated: a 2x2 tree whose leaves all hold 1 codes
+// "01" for the root and then "1" for each leaf.
+func TestTagTreeSharedBits(t *testing.T) {
+	tree := NewTagTree(2, 2)
+	for i := 0; i < 4; i++ {
+		tree.SetValue(i%2, i/2, 1)
+	}
+	tree.Propagate()
+
+	var buf bytes.Buffer
+	bw := bio.NewByteStuffingWriter(&buf)
+	for i := 0; i < 4; i++ {
+		if err := tree.Encode(bw, i%2, i/2, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bw.Flush()
+
+	// 0 1 1 1 1 1, padded with zeros
+	if got := buf.Bytes(); len(got) != 1 || got[0] != 0x7C {
+		t.Errorf("encoded % X; want 7C", got)
+	}
+}
+
+// TestTagTreeValue codes zero bit-plane counts in full, interleaved with
+// an inclusion tree coded against a threshold, as a packet header does.
+func TestTagTreeValue(t *testing.T) {
+	zbp := []int{3, 0, 12, 5, 5, 1}
+	layers := []int{0, 2, 0, 1, 0, 0}
+
+	incl, imsb := NewTagTree(3, 2), NewTagTree(3, 2)
+	for i := range zbp {
+		incl.SetValue(i%3, i/3, layers[i])
+		imsb.SetValue(i%3, i/3, zbp[i])
+	}
+	incl.Propagate()
+	imsb.Propagate()
+
+	var buf bytes.Buffer
+	bw := bio.NewByteStuffingWriter(&buf)
+	for i := range zbp {
+		if err := incl.Encode(bw, i%3, i/3, 1); err != nil {
+			t.Fatal(err)
+		}
+		if layers[i] == 0 {
+			if err := imsb.EncodeValue(bw, i%3, i/3); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bw.Flush()
+
+	incl, imsb = NewTagTree(3, 2), NewTagTree(3, 2)
+	br := bio.NewByteStuffingReader(bytes.NewReader(buf.Bytes()))
+	for i := range zbp {
+		included, err := incl.Decode(br, i%3, i/3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if included != (layers[i] == 0) {
+			t.Fatalf("leaf %d included = %v; want %v", i, included, layers[i] == 0)
+		}
+		if !included {
+			continue
+		}
+		v, err := imsb.DecodeValue(br, i%3, i/3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != zbp[i] {
+			t.Errorf("leaf %d zero bit-planes = %d; want %d", i, v, zbp[i])
+		}
+	}
+}
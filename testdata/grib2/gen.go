@@ -0,0 +1,98 @@
+//go:build ignore
+
+// Gen writes cmc_7bit_935x824.grib2, a GRIB2 message whose data section is
+// a JPEG 2000 codestream shaped like the CMC products that once decoded as
+// flat mid-grey: 935x824, 7-bit unsigned, reversible 5-3 with five
+// decomposition levels, LRCP, one quality layer, holding values 0-100.
+//
+// The codestream is made by this package's encoder from the field
+//
+//	v(x, y) = round(50 + 25*sin(x/60) + 25*cos(y/45))
+//
+// which TestDecode_GRIB2 checks at fixed points. Run from the repository
+// root with:
+//
+//	go run testdata/grib2/gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"image"
+	"log"
+	"math"
+	"os"
+
+	jpeg2000 "github.com/mrjoshuak/go-jpeg2000"
+)
+
+const width, height = 935, 824
+
+func main() {
+	out := flag.String("o", "testdata/grib2/cmc_7bit_935x824.grib2", "output file")
+	flag.Parse()
+
+	// The encoder scales 8-bit samples to 7 bits as v*127/255, so store
+	// the smallest 8-bit value that scales to each 7-bit one
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := int(math.Round(50 + 25*math.Sin(float64(x)/60) + 25*math.Cos(float64(y)/45)))
+			img.Pix[y*width+x] = uint8((v*255 + 126) / 127)
+		}
+	}
+	var cs bytes.Buffer
+	opts := &jpeg2000.Options{
+		Format:           jpeg2000.FormatJ2K,
+		Lossless:         true,
+		Precision:        7,
+		NumResolutions:   6,
+		NumLayers:        1,
+		ProgressionOrder: jpeg2000.LRCP,
+		TileSize:         image.Pt(width, height),
+	}
+	if err := jpeg2000.Encode(&cs, img, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	var msg []byte
+	section := func(num byte, body ...byte) {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(5+len(body)))
+		msg = append(msg, num)
+		msg = append(msg, body...)
+	}
+	// Section 0 (indicator): discipline 0, edition 2, length filled in last
+	msg = append(msg, 'G', 'R', 'I', 'B', 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0)
+	// Section 1 (identification): CMC (centre 54), master tables 2, local
+	// tables 1, analysis at 2024-01-01 00:00:00, operational products
+	section(1, 0, 54, 0, 0, 2, 1, 1, 0x07, 0xE8, 1, 1, 0, 0, 0, 0, 1)
+	// Section 3 (grid definition): template 3.0 with Ni x Nj points, the
+	// remaining grid parameters left at zero
+	grid := make([]byte, 67)
+	binary.BigEndian.PutUint32(grid[1:], width*height)
+	binary.BigEndian.PutUint32(grid[25:], width)
+	binary.BigEndian.PutUint32(grid[29:], height)
+	section(3, grid...)
+	// Section 4 (product definition): template 4.0, all zero
+	section(4, make([]byte, 29)...)
+	// Section 5 (data representation): template 5.40, JPEG 2000 with
+	// reference value 0, scale factors 0, 7 bits, lossless
+	repr := make([]byte, 18)
+	binary.BigEndian.PutUint32(repr[0:], width*height)
+	binary.BigEndian.PutUint16(repr[4:], 40)
+	repr[14] = 7    // bits per value
+	repr[17] = 0xFF // target compression ratio: missing
+	section(5, repr...)
+	// Section 6 (bit-map): none
+	section(6, 0xFF)
+	// Section 7 (data): the codestream
+	section(7, cs.Bytes()...)
+	// Section 8 (end)
+	msg = append(msg, '7', '7', '7', '7')
+	binary.BigEndian.PutUint64(msg[8:], uint64(len(msg)))
+
+	if err := os.WriteFile(*out, msg, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
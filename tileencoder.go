@@ -0,0 +1,206 @@
+package jpeg2000
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"slices"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/box"
+)
+
+// TileEncoder writes an image one tile at a time, so that the full raster
+// never has to be held in memory. Tiles may be written in any order; each
+// becomes a single tile-part.
+type TileEncoder struct {
+	w       io.Writer
+	options *Options
+
+	width, height         int
+	tileWidth, tileHeight int
+	numTilesX, numTilesY  int
+
+	// header describes the components of the first tile written; the
+	// main header is written with it and later tiles must match.
+	header  *encoder
+	written []bool
+	closed  bool
+}
+
+// NewTileEncoder returns a TileEncoder for a width x height image. The
+// tile grid is taken from o.TileSize, or a single tile if it is zero. A
+// nil o uses DefaultOptions. WriteTLM is not supported.
+//
+// The main header is written with the first tile, since the component
+// count and precision are taken from it. For FormatJP2 and FormatJPX the
+// codestream box is written with a length of zero, meaning it extends to
+// the end of the file.
+func NewTileEncoder(w io.Writer, width, height int, o *Options) (*TileEncoder, error) {
+	if o == nil {
+		o = DefaultOptions()
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("jpeg2000: invalid image size %dx%d", width, height)
+	}
+	if o.WriteTLM {
+		return nil, errors.New("jpeg2000: TileEncoder does not support WriteTLM")
+	}
+	if o.Profile.isCinema() || o.Profile.isIMF() {
+		return nil, errors.New("jpeg2000: TileEncoder does not support the single-tile cinema and IMF profiles; use Encode")
+	}
+	if o.Format != FormatJ2K && o.Format != FormatJP2 && o.Format != FormatJPX {
+		return nil, fmt.Errorf("unsupported format: %s", o.Format)
+	}
+
+	te := &TileEncoder{
+		w:          w,
+		options:    o,
+		width:      width,
+		height:     height,
+		tileWidth:  width,
+		tileHeight: height,
+	}
+	if o.TileSize.X > 0 {
+		te.tileWidth = o.TileSize.X
+	}
+	if o.TileSize.Y > 0 {
+		te.tileHeight = o.TileSize.Y
+	}
+	if err := (&encoder{options: o}).checkWavelet(); err != nil {
+		return nil, err
+	}
+	if err := (&encoder{options: o}).checkPrecinctSizes(); err != nil {
+		return nil, err
+	}
+	if err := (&encoder{options: o}).checkProgressionOrderChanges(); err != nil {
+		return nil, err
+	}
+
+	te.numTilesX = (width + te.tileWidth - 1) / te.tileWidth
+	te.numTilesY = (height + te.tileHeight - 1) / te.tileHeight
+	if te.numTilesX*te.numTilesY > 65535 {
+		return nil, fmt.Errorf("jpeg2000: %d tiles exceeds the limit of 65535", te.numTilesX*te.numTilesY)
+	}
+	te.written = make([]bool, te.numTilesX*te.numTilesY)
+	return te, nil
+}
+
+// TileBounds returns the area of the image covered by tile (tileX, tileY).
+// Tiles on the right and bottom edges may be smaller than the nominal
+// tile size.
+func (te *TileEncoder) TileBounds(tileX, tileY int) image.Rectangle {
+	r := image.Rect(tileX*te.tileWidth, tileY*te.tileHeight, (tileX+1)*te.tileWidth, (tileY+1)*te.tileHeight)
+	return r.Intersect(image.Rect(0, 0, te.width, te.height))
+}
+
+// WriteTile encodes img as tile (tileX, tileY) and writes it as a
+// tile-part. The size of img must match TileBounds; its origin is
+// ignored. Every tile must have the same color model and precision as the
+// first.
+func (te *TileEncoder) WriteTile(tileX, tileY int, img image.Image) error {
+	if te.closed {
+		return errors.New("jpeg2000: WriteTile after Close")
+	}
+	if tileX < 0 || tileX >= te.numTilesX || tileY < 0 || tileY >= te.numTilesY {
+		return fmt.Errorf("jpeg2000: tile (%d, %d) outside the %dx%d tile grid", tileX, tileY, te.numTilesX, te.numTilesY)
+	}
+	tileIdx := tileY*te.numTilesX + tileX
+	if te.written[tileIdx] {
+		return fmt.Errorf("jpeg2000: tile (%d, %d) already written", tileX, tileY)
+	}
+	if want := te.TileBounds(tileX, tileY).Size(); img.Bounds().Size() != want {
+		return fmt.Errorf("jpeg2000: tile (%d, %d) is %v, want %v", tileX, tileY, img.Bounds().Size(), want)
+	}
+
+	// Every tile is quantized with the step sizes of the main header,
+	// which rate control picks for the first tile
+	e := newEncoder(nil, img, te.options)
+	if te.header != nil {
+		e.stepSize = te.header.stepSize
+	}
+	if err := e.rateControl(); err != nil {
+		return err
+	}
+	e.origin = te.TileBounds(tileX, tileY).Min
+	if err := e.extractImageData(); err != nil {
+		return fmt.Errorf("extracting image data: %w", err)
+	}
+
+	if te.header == nil {
+		e.resetStats()
+		if err := te.writeHeader(e); err != nil {
+			return err
+		}
+	} else if e.numComponents != te.header.numComponents || e.precision != te.header.precision || e.signed != te.header.signed {
+		return fmt.Errorf("jpeg2000: tile (%d, %d) has %d components of %d bits, want %d of %d",
+			tileX, tileY, e.numComponents, e.precision, te.header.numComponents, te.header.precision)
+	} else if !slices.Equal(e.subsampling, te.header.subsampling) {
+		return fmt.Errorf("jpeg2000: tile (%d, %d) has component subsampling %v, want %v",
+			tileX, tileY, e.subsampling, te.header.subsampling)
+	}
+
+	h, err := te.header.codestreamHeader()
+	if err != nil {
+		return err
+	}
+	e.header = h
+
+	if err := e.preprocess(); err != nil {
+		return fmt.Errorf("preprocessing: %w", err)
+	}
+	tilePart, err := e.encodeTile(h, tileIdx)
+	if err != nil {
+		return err
+	}
+	if _, err := te.w.Write(tilePart); err != nil {
+		return err
+	}
+	te.written[tileIdx] = true
+	return nil
+}
+
+// writeHeader writes the JP2 boxes, if any, and the main header, using
+// the components of the first tile.
+func (te *TileEncoder) writeHeader(first *encoder) error {
+	te.header = &encoder{
+		w:             te.w,
+		options:       te.options,
+		width:         te.width,
+		height:        te.height,
+		numComponents: first.numComponents,
+		precision:     first.precision,
+		precisions:    first.precisions,
+		signed:        first.signed,
+		subsampling:   first.subsampling,
+		stepSize:      first.stepSize,
+	}
+
+	if te.options.Format != FormatJ2K {
+		if err := te.header.writeJP2Header(); err != nil {
+			return err
+		}
+		jp2c := &box.Box{Type: box.TypeContCodestream}
+		if _, err := te.w.Write(jp2c.Header()); err != nil {
+			return err
+		}
+	}
+	_, err := te.w.Write(te.header.generateMainHeader())
+	return err
+}
+
+// Close writes the EOC marker. Every tile must have been written.
+func (te *TileEncoder) Close() error {
+	if te.closed {
+		return nil
+	}
+	for i, ok := range te.written {
+		if !ok {
+			return fmt.Errorf("jpeg2000: tile (%d, %d) not written", i%te.numTilesX, i/te.numTilesX)
+		}
+	}
+	te.closed = true
+	// EOC marker
+	_, err := te.w.Write([]byte{0xFF, 0xD9})
+	return err
+}
@@ -0,0 +1,95 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTileEncoder(t *testing.T) {
+	for _, format := range []Format{FormatJ2K, FormatJP2} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := &Options{Format: format, Lossless: true, NumResolutions: 3, TileSize: image.Pt(64, 64)}
+			te, err := NewTileEncoder(&buf, 160, 100, opts)
+			if err != nil {
+				t.Fatalf("NewTileEncoder() error: %v", err)
+			}
+
+			// Write the tiles bottom-up to check that order does not matter
+			for ty := 1; ty >= 0; ty-- {
+				for tx := 0; tx < 3; tx++ {
+					r := te.TileBounds(tx, ty)
+					tile := image.NewRGBA(r)
+					for y := r.Min.Y; y < r.Max.Y; y++ {
+						for x := r.Min.X; x < r.Max.X; x++ {
+							tile.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+						}
+					}
+					if err := te.WriteTile(tx, ty, tile); err != nil {
+						t.Fatalf("WriteTile(%d, %d) error: %v", tx, ty, err)
+					}
+				}
+			}
+			if err := te.Close(); err != nil {
+				t.Fatalf("Close() error: %v", err)
+			}
+
+			if issues := Validate(bytes.NewReader(buf.Bytes())); len(issues) > 0 {
+				t.Errorf("Validate() = %v", issues)
+			}
+			if err := ValidateStructure(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Errorf("ValidateStructure() error: %v", err)
+			}
+
+			h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeHeader() error: %v", err)
+			}
+			if h.Width != 160 || h.Height != 100 || h.NumTilesX != 3 || h.NumTilesY != 2 || len(h.Components) != 3 {
+				t.Errorf("header = %dx%d, %dx%d tiles, %d components; want 160x100, 3x2 tiles, 3 components",
+					h.Width, h.Height, h.NumTilesX, h.NumTilesY, len(h.Components))
+			}
+
+			img, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 160, 100) {
+				t.Errorf("Bounds() = %v, want 160x100", img.Bounds())
+			}
+		})
+	}
+}
+
+func TestTileEncoder_Errors(t *testing.T) {
+	opts := &Options{Format: FormatJ2K, Lossless: true, TileSize: image.Pt(32, 32)}
+	te, err := NewTileEncoder(&bytes.Buffer{}, 64, 48, opts)
+	if err != nil {
+		t.Fatalf("NewTileEncoder() error: %v", err)
+	}
+
+	if err := te.WriteTile(2, 0, image.NewGray(image.Rect(0, 0, 32, 32))); err == nil {
+		t.Error("WriteTile outside the grid: expected error")
+	}
+	if err := te.WriteTile(0, 1, image.NewGray(image.Rect(0, 0, 32, 32))); err == nil {
+		t.Error("WriteTile with the wrong size: expected error")
+	}
+	if err := te.WriteTile(0, 0, image.NewGray(image.Rect(0, 0, 32, 32))); err != nil {
+		t.Fatalf("WriteTile(0, 0) error: %v", err)
+	}
+	if err := te.WriteTile(0, 0, image.NewGray(image.Rect(0, 0, 32, 32))); err == nil {
+		t.Error("writing a tile twice: expected error")
+	}
+	if err := te.WriteTile(1, 0, image.NewRGBA(image.Rect(0, 0, 32, 32))); err == nil {
+		t.Error("WriteTile with a different color model: expected error")
+	}
+	if err := te.Close(); err == nil {
+		t.Error("Close with missing tiles: expected error")
+	}
+
+	if _, err := NewTileEncoder(&bytes.Buffer{}, 64, 64, &Options{Format: FormatJ2K, WriteTLM: true}); err == nil {
+		t.Error("NewTileEncoder with WriteTLM: expected error")
+	}
+}
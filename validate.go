@@ -0,0 +1,798 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/mrjoshuak/go-jpeg2000/internal/box"
+	"github.com/mrjoshuak/go-jpeg2000/internal/codestream"
+)
+
+// Severity levels reported in ValidationIssue.Severity.
+const (
+	// SeverityError marks a violation of ISO/IEC 15444-1 that makes the
+	// file non-conformant.
+	SeverityError = "error"
+	// SeverityWarning marks a non-standard construct that decoders
+	// commonly tolerate.
+	SeverityWarning = "warning"
+)
+
+// ValidationIssue describes one conformance problem found by Validate.
+type ValidationIssue struct {
+	// Severity is SeverityError or SeverityWarning.
+	Severity string
+
+	// Marker names the box type (such as "jp2h") or marker segment
+	// (such as "COD") the issue was found in.
+	Marker string
+
+	// Description explains the problem.
+	Description string
+}
+
+// String formats the issue for display.
+func (v ValidationIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Severity, v.Marker, v.Description)
+}
+
+// Validate checks the structure of a JP2 file or raw J2K codestream
+// without decoding any image data. It verifies the JP2 box layout and
+// required boxes, the length of every marker segment, and the consistency
+// of the SIZ, COD and QCD parameters, and reports every problem it finds.
+// A fully conformant file yields no issues.
+//
+// The checks are a superset of those applied by Decode when reading the
+// main header.
+func Validate(r io.Reader) []ValidationIssue {
+	v := &validator{}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		v.errorf("", "reading input: %v", err)
+		return v.issues
+	}
+
+	switch {
+	case len(data) >= 12 && bytes.Equal(data[:12], jp2Signature[:]):
+		v.validateJP2(data)
+	case len(data) >= 2 && data[0] == 0xFF && data[1] == 0x4F:
+		v.validateCodestream(data)
+	default:
+		v.errorf("", "unrecognized file format")
+	}
+
+	return v.issues
+}
+
+// jp2Signature is the complete JP2 signature box.
+var jp2Signature = [12]byte{0x00, 0x00, 0x00, 0x0C, 'j', 'P', ' ', ' ', 0x0D, 0x0A, 0x87, 0x0A}
+
+// validator accumulates issues for Validate.
+type validator struct {
+	issues []ValidationIssue
+
+	// ihdr holds the JP2 image header, checked against SIZ.
+	ihdr *box.ImageHeaderBox
+
+	// jpx is set when the file type box has the JPX brand.
+	jpx bool
+}
+
+func (v *validator) errorf(marker, format string, args ...any) {
+	v.issues = append(v.issues, ValidationIssue{SeverityError, marker, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(marker, format string, args ...any) {
+	v.issues = append(v.issues, ValidationIssue{SeverityWarning, marker, fmt.Sprintf(format, args...)})
+}
+
+// validateJP2 checks the top-level box sequence of a JP2 file.
+func (v *validator) validateJP2(data []byte) {
+	r := box.NewReader(bytes.NewReader(data))
+
+	var seenFtyp, seenRreq, seenHeader, seenCodestream bool
+	for i := 0; ; i++ {
+		b, err := r.ReadBox()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.errorf("", "box at offset %d: %v", r.Offset(), err)
+			break
+		}
+
+		name := b.Type.String()
+		switch b.Type {
+		case box.TypeJP2Signature:
+			if i != 0 {
+				v.errorf(name, "signature box must be the first box")
+			}
+		case box.TypeFileType:
+			if i != 1 {
+				v.errorf(name, "file type box must immediately follow the signature box")
+			}
+			seenFtyp = true
+			v.validateFileType(b.Contents)
+		case box.TypeReaderReq:
+			if i != 2 {
+				v.errorf(name, "reader requirements box must immediately follow the file type box")
+			}
+			seenRreq = true
+			var rreq box.ReaderRequirementsBox
+			if err := rreq.Parse(b.Contents); err != nil {
+				v.errorf(name, "%v", err)
+			}
+		case box.TypeJP2Header:
+			if !seenFtyp {
+				v.errorf(name, "JP2 header box precedes the file type box")
+			}
+			if seenHeader {
+				v.errorf(name, "more than one JP2 header box")
+			}
+			seenHeader = true
+			v.validateJP2Header(b.Contents)
+		case box.TypeContCodestream:
+			if !seenHeader {
+				v.errorf(name, "codestream box precedes the JP2 header box")
+			}
+			if !seenCodestream {
+				v.validateCodestream(b.Contents)
+			}
+			seenCodestream = true
+		}
+	}
+
+	if !seenFtyp {
+		v.errorf("ftyp", "missing file type box")
+	}
+	if v.jpx && !seenRreq {
+		v.errorf("rreq", "missing reader requirements box in a JPX file")
+	}
+	if !seenHeader {
+		v.errorf("jp2h", "missing JP2 header box")
+	}
+	if !seenCodestream {
+		v.errorf("jp2c", "missing contiguous codestream box")
+	}
+}
+
+// validateFileType checks that the file declares JP2 compatibility.
+func (v *validator) validateFileType(contents []byte) {
+	var ftyp box.FileTypeBox
+	if err := ftyp.Parse(contents); err != nil {
+		v.errorf("ftyp", "%v", err)
+		return
+	}
+	if len(contents)%4 != 0 {
+		v.errorf("ftyp", "compatibility list length %d is not a multiple of 4", len(contents)-8)
+	}
+
+	compatible := false
+	for _, c := range ftyp.Compatibility {
+		if c == box.BrandJP2 {
+			compatible = true
+		}
+	}
+	if !compatible {
+		v.errorf("ftyp", "compatibility list does not include %q", box.BrandJP2.String())
+	}
+	v.jpx = ftyp.Brand == box.BrandJPX
+	if ftyp.Brand != box.BrandJP2 && !v.jpx {
+		v.warnf("ftyp", "brand %q is not %q", ftyp.Brand.String(), box.BrandJP2.String())
+	}
+}
+
+// validateJP2Header checks the sub-boxes of the JP2 header super-box.
+func (v *validator) validateJP2Header(contents []byte) {
+	r := box.NewReader(bytes.NewReader(contents))
+
+	var seenColr bool
+	for i := 0; ; i++ {
+		b, err := r.ReadBox()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.errorf("jp2h", "sub-box at offset %d: %v", r.Offset(), err)
+			return
+		}
+
+		name := b.Type.String()
+		switch b.Type {
+		case box.TypeImageHeader:
+			if i != 0 {
+				v.errorf(name, "image header box must be the first box in jp2h")
+			}
+			if len(b.Contents) != 14 {
+				v.errorf(name, "length %d, want 14", len(b.Contents))
+				continue
+			}
+			ihdr := &box.ImageHeaderBox{}
+			if err := ihdr.Parse(b.Contents); err != nil {
+				v.errorf(name, "%v", err)
+				continue
+			}
+			if ihdr.CompressionType != 7 {
+				v.errorf(name, "compression type %d, want 7", ihdr.CompressionType)
+			}
+			v.ihdr = ihdr
+		case box.TypeColorSpec:
+			seenColr = true
+			if len(b.Contents) < 3 {
+				v.errorf(name, "box too short: %d bytes", len(b.Contents))
+				continue
+			}
+			switch meth := b.Contents[0]; meth {
+			case 1:
+				if len(b.Contents) != 7 {
+					v.errorf(name, "enumerated colour space length %d, want 7", len(b.Contents))
+				}
+			case 2:
+			default:
+				v.warnf(name, "non-standard specification method %d", meth)
+			}
+		}
+	}
+
+	if v.ihdr == nil {
+		v.errorf("ihdr", "missing image header box")
+	}
+	if !seenColr {
+		v.errorf("colr", "missing colour specification box")
+	}
+}
+
+// validateCodestream walks every marker segment of a codestream.
+func (v *validator) validateCodestream(data []byte) {
+	if len(data) < 2 || codestream.Marker(binary.BigEndian.Uint16(data)) != codestream.SOC {
+		v.errorf("SOC", "codestream does not start with SOC")
+		return
+	}
+
+	h := v.validateMainHeader(data)
+	if h == nil {
+		return
+	}
+
+	// Header.Validate covers the basic SIZ consistency checks
+	p := codestream.NewParser(bytes.NewReader(data))
+	if _, err := p.ReadHeader(); err != nil {
+		v.errorf("SIZ", "%v", err)
+	}
+
+	v.checkImageHeader(h)
+	v.validateTileParts(data, h.tileStart)
+}
+
+// mainHeaderInfo collects what the tile-part checks need from the main
+// header.
+type mainHeaderInfo struct {
+	width, height uint32
+	numComponents int
+	bitDepths     []uint8
+	tileStart     int
+}
+
+// segment reads the marker segment at data[pos:], reporting truncation.
+// It returns the segment payload (after the length field) and the offset
+// of the next marker, or ok false when the segment is malformed.
+func (v *validator) segment(data []byte, pos int, m codestream.Marker) (payload []byte, next int, ok bool) {
+	if pos+4 > len(data) {
+		v.errorf(m.String(), "truncated marker segment at offset %d", pos)
+		return nil, 0, false
+	}
+	length := int(binary.BigEndian.Uint16(data[pos+2:]))
+	if length < 2 {
+		v.errorf(m.String(), "invalid segment length %d", length)
+		return nil, 0, false
+	}
+	end := pos + 2 + length
+	if end > len(data) {
+		v.errorf(m.String(), "segment length %d runs past the end of the data", length)
+		return nil, 0, false
+	}
+	return data[pos+4 : end], end, true
+}
+
+// validateMainHeader checks SOC, SIZ and the main header marker segments
+// up to the first SOT.
+func (v *validator) validateMainHeader(data []byte) *mainHeaderInfo {
+	if len(data) < 4 || codestream.Marker(binary.BigEndian.Uint16(data[2:])) != codestream.SIZ {
+		v.errorf("SIZ", "SIZ marker must immediately follow SOC")
+		return nil
+	}
+
+	siz, pos, ok := v.segment(data, 2, codestream.SIZ)
+	if !ok {
+		return nil
+	}
+	info := v.checkSIZ(siz)
+	if info == nil {
+		return nil
+	}
+
+	var cod, qcd []byte
+	for {
+		if pos+2 > len(data) {
+			v.errorf("SOT", "main header is not followed by a tile-part")
+			return nil
+		}
+		m := codestream.Marker(binary.BigEndian.Uint16(data[pos:]))
+		if m == codestream.SOT {
+			info.tileStart = pos
+			break
+		}
+		if data[pos] != 0xFF || m < 0xFF30 {
+			v.errorf("", "invalid marker 0x%04X at offset %d", uint16(m), pos)
+			return nil
+		}
+		if m.IsDelimiter() || m == codestream.EPH {
+			v.errorf(m.String(), "unexpected %s marker in main header at offset %d", m, pos)
+			return nil
+		}
+		if !m.HasLength() {
+			v.warnf(fmt.Sprintf("0x%04X", uint16(m)), "unknown marker without segment in main header")
+			pos += 2
+			continue
+		}
+
+		payload, next, ok := v.segment(data, pos, m)
+		if !ok {
+			return nil
+		}
+
+		switch m {
+		case codestream.COD:
+			if cod != nil {
+				v.errorf("COD", "more than one COD marker in the main header")
+			}
+			cod = payload
+		case codestream.QCD:
+			if qcd != nil {
+				v.errorf("QCD", "more than one QCD marker in the main header")
+			}
+			qcd = payload
+		case codestream.COM:
+			if len(payload) < 2 {
+				v.errorf("COM", "segment too short: %d bytes", len(payload))
+			} else if r := binary.BigEndian.Uint16(payload); r > codestream.CommentLatin1 {
+				v.warnf("COM", "unknown registration value %d", r)
+			}
+		case codestream.COC, codestream.QCC, codestream.RGN, codestream.POC, codestream.TLM,
+			codestream.PLM, codestream.PPM, codestream.CRG, codestream.CAP, codestream.CBD,
+			codestream.MCT, codestream.MCC, codestream.MCO:
+		default:
+			v.warnf(fmt.Sprintf("0x%04X", uint16(m)), "unknown marker segment in main header")
+		}
+		pos = next
+	}
+
+	if cod == nil {
+		v.errorf("COD", "missing COD marker in the main header")
+	}
+	if qcd == nil {
+		v.errorf("QCD", "missing QCD marker in the main header")
+	}
+	if cod != nil {
+		numDecomp, reversible, ok := v.checkCOD(cod, info.numComponents)
+		if ok && qcd != nil {
+			v.checkQCD(qcd, numDecomp, reversible)
+		}
+	}
+
+	return info
+}
+
+// checkSIZ validates the SIZ payload.
+func (v *validator) checkSIZ(siz []byte) *mainHeaderInfo {
+	if len(siz) < 36 {
+		v.errorf("SIZ", "segment too short: %d bytes", len(siz))
+		return nil
+	}
+	be := binary.BigEndian
+	info := &mainHeaderInfo{
+		width:         be.Uint32(siz[2:]) - be.Uint32(siz[10:]),
+		height:        be.Uint32(siz[6:]) - be.Uint32(siz[14:]),
+		numComponents: int(be.Uint16(siz[34:])),
+	}
+	if want := 36 + 3*info.numComponents; len(siz) != want {
+		v.errorf("SIZ", "segment length %d inconsistent with %d components (want %d)",
+			len(siz)+2, info.numComponents, want+2)
+		return nil
+	}
+
+	xo, yo := be.Uint32(siz[10:]), be.Uint32(siz[14:])
+	xt, yt := be.Uint32(siz[18:]), be.Uint32(siz[22:])
+	xto, yto := be.Uint32(siz[26:]), be.Uint32(siz[30:])
+	if xto > xo || yto > yo {
+		v.errorf("SIZ", "tile offset (%d,%d) exceeds image offset (%d,%d)", xto, yto, xo, yo)
+	}
+	if xt != 0 && yt != 0 && (uint64(xto)+uint64(xt) <= uint64(xo) || uint64(yto)+uint64(yt) <= uint64(yo)) {
+		v.errorf("SIZ", "first tile does not overlap the image area")
+	}
+
+	for c := 0; c < info.numComponents; c++ {
+		ssiz := siz[36+3*c]
+		info.bitDepths = append(info.bitDepths, ssiz)
+		if siz[37+3*c] == 0 || siz[38+3*c] == 0 {
+			v.errorf("SIZ", "component %d has zero subsampling", c)
+		}
+	}
+	return info
+}
+
+// checkCOD validates the COD payload and returns the number of
+// decomposition levels and whether the reversible wavelet is used.
+func (v *validator) checkCOD(cod []byte, numComponents int) (numDecomp int, reversible, ok bool) {
+	if len(cod) < 10 {
+		v.errorf("COD", "segment too short: %d bytes", len(cod))
+		return 0, false, false
+	}
+
+	scod := cod[0]
+	numDecomp = int(cod[5])
+	if numDecomp > 32 {
+		v.errorf("COD", "%d decomposition levels exceeds the maximum of 32", numDecomp)
+	}
+
+	want := 10
+	if scod&codestream.CodingStylePrecincts != 0 {
+		want += numDecomp + 1
+	}
+	if len(cod) != want {
+		v.errorf("COD", "segment length %d inconsistent with %d decomposition levels (want %d)",
+			len(cod)+2, numDecomp, want+2)
+	}
+	if scod&^0x07 != 0 {
+		v.warnf("COD", "reserved Scod bits set: 0x%02X", scod)
+	}
+	if prog := cod[1]; prog > uint8(codestream.CPRL) {
+		v.errorf("COD", "invalid progression order %d", prog)
+	}
+	if layers := binary.BigEndian.Uint16(cod[2:]); layers == 0 {
+		v.errorf("COD", "number of layers is 0")
+	}
+	if mct := cod[4]; mct > 1 {
+		v.errorf("COD", "invalid multiple component transform %d", mct)
+	} else if mct == 1 && numComponents < 3 {
+		v.errorf("COD", "multiple component transform requires 3 components, have %d", numComponents)
+	}
+
+	xcb, ycb := int(cod[6])+2, int(cod[7])+2
+	if xcb > 10 || ycb > 10 || xcb+ycb > 12 {
+		v.errorf("COD", "invalid code-block size 2^%d x 2^%d", xcb, ycb)
+	}
+	if cod[8]&codestream.CodeBlockHT != 0 {
+		v.warnf("COD", "HT block coding requires ISO/IEC 15444-15 support")
+	}
+
+	switch cod[9] {
+	case 0:
+	case 1:
+		reversible = true
+	default:
+		v.errorf("COD", "invalid wavelet transform %d", cod[9])
+	}
+
+	return numDecomp, reversible, true
+}
+
+// checkQCD validates the QCD payload against the COD parameters.
+func (v *validator) checkQCD(qcd []byte, numDecomp int, reversible bool) {
+	if len(qcd) < 1 {
+		v.errorf("QCD", "segment too short")
+		return
+	}
+
+	numBands := 3*numDecomp + 1
+	style := qcd[0] & 0x1F
+	var want int
+	switch style {
+	case codestream.QuantizationNone:
+		want = 1 + numBands
+		if !reversible {
+			v.warnf("QCD", "no quantization combined with the irreversible 9-7 wavelet")
+		}
+	case codestream.QuantizationScalarDerived:
+		want = 3
+		if reversible {
+			v.warnf("QCD", "scalar quantization combined with the reversible 5-3 wavelet")
+		}
+	case codestream.QuantizationScalarExpounded:
+		want = 1 + 2*numBands
+		if reversible {
+			v.warnf("QCD", "scalar quantization combined with the reversible 5-3 wavelet")
+		}
+	default:
+		v.errorf("QCD", "invalid quantization style %d", style)
+		return
+	}
+
+	if len(qcd) != want {
+		v.errorf("QCD", "segment length %d inconsistent with %d subbands (want %d)",
+			len(qcd)+2, numBands, want+2)
+	}
+}
+
+// checkImageHeader compares the JP2 image header with SIZ.
+func (v *validator) checkImageHeader(h *mainHeaderInfo) {
+	if v.ihdr == nil {
+		return
+	}
+	if v.ihdr.Width != h.width || v.ihdr.Height != h.height {
+		v.errorf("ihdr", "size %dx%d does not match SIZ %dx%d",
+			v.ihdr.Width, v.ihdr.Height, h.width, h.height)
+	}
+	if int(v.ihdr.NumComponents) != h.numComponents {
+		v.errorf("ihdr", "%d components does not match SIZ %d", v.ihdr.NumComponents, h.numComponents)
+	}
+	if v.ihdr.BitsPerComponent != 0xFF && len(h.bitDepths) > 0 {
+		for c, d := range h.bitDepths {
+			if d != v.ihdr.BitsPerComponent {
+				v.errorf("ihdr", "bit depth 0x%02X does not match SIZ component %d (0x%02X)",
+					v.ihdr.BitsPerComponent, c, d)
+				break
+			}
+		}
+	}
+}
+
+// validateTileParts walks the tile-parts starting at pos and checks for
+// the closing EOC marker.
+func (v *validator) validateTileParts(data []byte, pos int) {
+	for pos+2 <= len(data) {
+		m := codestream.Marker(binary.BigEndian.Uint16(data[pos:]))
+		if m == codestream.EOC {
+			if pos+2 != len(data) {
+				v.warnf("EOC", "%d bytes of trailing data after EOC", len(data)-pos-2)
+			}
+			return
+		}
+		if m != codestream.SOT {
+			v.errorf("SOT", "expected SOT at offset %d, found 0x%04X", pos, uint16(m))
+			return
+		}
+
+		sot, next, ok := v.segment(data, pos, codestream.SOT)
+		if !ok {
+			return
+		}
+		if len(sot) != 8 {
+			v.errorf("SOT", "segment length %d, want 10", len(sot)+2)
+			return
+		}
+		psot := int(binary.BigEndian.Uint32(sot[2:]))
+		if !v.validateTilePartHeader(data, next) {
+			return
+		}
+
+		if psot == 0 {
+			// The last tile-part extends to EOC
+			if len(data) >= 2 && binary.BigEndian.Uint16(data[len(data)-2:]) != uint16(codestream.EOC) {
+				v.warnf("EOC", "missing EOC marker")
+			}
+			return
+		}
+		if psot < 14 || pos+psot > len(data) {
+			v.errorf("SOT", "tile-part length %d at offset %d runs past the end of the data", psot, pos)
+			return
+		}
+		pos += psot
+	}
+
+	v.warnf("EOC", "missing EOC marker")
+}
+
+// validateTilePartHeader checks the marker segments between SOT and SOD.
+func (v *validator) validateTilePartHeader(data []byte, pos int) bool {
+	for {
+		if pos+2 > len(data) {
+			v.errorf("SOD", "tile-part header is not terminated by SOD")
+			return false
+		}
+		m := codestream.Marker(binary.BigEndian.Uint16(data[pos:]))
+		switch m {
+		case codestream.SOD:
+			return true
+		case codestream.COD, codestream.COC, codestream.QCD, codestream.QCC, codestream.RGN,
+			codestream.POC, codestream.PLT, codestream.PPT, codestream.COM:
+		default:
+			if data[pos] != 0xFF || m < 0xFF30 {
+				v.errorf("", "invalid marker 0x%04X at offset %d", uint16(m), pos)
+				return false
+			}
+			if m.IsDelimiter() || m == codestream.EPH {
+				v.errorf(m.String(), "unexpected %s marker in tile-part header at offset %d", m, pos)
+				return false
+			}
+			if !m.HasLength() {
+				v.warnf(fmt.Sprintf("0x%04X", uint16(m)), "unknown marker without segment in tile-part header")
+				pos += 2
+				continue
+			}
+			v.warnf(fmt.Sprintf("0x%04X", uint16(m)), "unexpected marker segment in tile-part header")
+		}
+		_, next, ok := v.segment(data, pos, m)
+		if !ok {
+			return false
+		}
+		pos = next
+	}
+}
+
+// ValidateStructure checks the marker structure of a JP2 file or raw J2K
+// codestream and returns an error describing the first problem found. It
+// reads the main header and every tile-part header, checks each Psot
+// against the bytes that follow, checks tile-part ordering and requires
+// an EOC marker at the end of the codestream. Tile data is skipped rather
+// than read into memory, so it is cheap enough to screen untrusted input.
+//
+// Unlike Validate it stops at the first problem and does not check the
+// coding parameters in depth.
+func ValidateStructure(r io.Reader) error {
+	var sig [12]byte
+	n, err := io.ReadFull(r, sig[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("jpeg2000: reading input: %w", err)
+	}
+	r = io.MultiReader(bytes.NewReader(sig[:n]), r)
+
+	switch {
+	case n == 12 && sig == jp2Signature:
+		cs, err := findCodestreamBox(r)
+		if err != nil {
+			return fmt.Errorf("jpeg2000: %w", err)
+		}
+		r = cs
+	case n >= 2 && sig[0] == 0xFF && sig[1] == 0x4F:
+	default:
+		return fmt.Errorf("jpeg2000: unrecognized file format")
+	}
+
+	if err := validateCodestreamStructure(&countingReader{r: r}); err != nil {
+		return fmt.Errorf("jpeg2000: %w", err)
+	}
+	return nil
+}
+
+// findCodestreamBox skips the JP2 boxes before the first contiguous
+// codestream box and returns a reader limited to its contents.
+func findCodestreamBox(r io.Reader) (io.Reader, error) {
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("missing contiguous codestream box")
+			}
+			return nil, fmt.Errorf("reading box header: %w", err)
+		}
+		length := uint64(binary.BigEndian.Uint32(hdr[:4]))
+		boxType := box.Type(binary.BigEndian.Uint32(hdr[4:8]))
+		headerLen := uint64(8)
+		if length == 1 {
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, fmt.Errorf("reading %s extended length: %w", boxType, err)
+			}
+			length, headerLen = binary.BigEndian.Uint64(hdr[8:16]), 16
+		}
+
+		if length == 0 {
+			// The box extends to the end of the file
+			if boxType != box.TypeContCodestream {
+				return nil, fmt.Errorf("missing contiguous codestream box")
+			}
+			return r, nil
+		}
+		if length < headerLen {
+			return nil, fmt.Errorf("%s box length %d is shorter than its header", boxType, length)
+		}
+		size := int64(length - headerLen)
+		if boxType == box.TypeContCodestream {
+			return io.LimitReader(r, size), nil
+		}
+		if n, err := io.CopyN(io.Discard, r, size); err != nil {
+			return nil, fmt.Errorf("%s box length %d runs past the end of the file (%d bytes left)", boxType, length, n)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// validateCodestreamStructure walks the main header and tile-parts of a
+// codestream for ValidateStructure.
+func validateCodestreamStructure(r *countingReader) error {
+	p := codestream.NewParser(r)
+	h, err := p.ReadHeader()
+	if err != nil {
+		return err
+	}
+	numTiles := int(h.NumTilesX * h.NumTilesY)
+	nextPart := make(map[uint16]int)
+
+	var marker [2]byte
+	sotStart := r.n - 2 // ReadHeader stops after the first SOT marker
+	for {
+		tph, err := p.ReadTilePartHeader()
+		if err != nil {
+			return fmt.Errorf("tile-part at offset %d: %w", sotStart, err)
+		}
+		if int(tph.TileIndex) >= numTiles {
+			return fmt.Errorf("tile-part at offset %d: tile index %d out of range [0, %d)", sotStart, tph.TileIndex, numTiles)
+		}
+		if want := nextPart[tph.TileIndex]; int(tph.TilePartIndex) != want {
+			return fmt.Errorf("tile-part at offset %d: tile %d part %d, want part %d", sotStart, tph.TileIndex, tph.TilePartIndex, want)
+		}
+		if tph.NumTileParts != 0 && tph.TilePartIndex >= tph.NumTileParts {
+			return fmt.Errorf("tile-part at offset %d: part %d of tile %d exceeds TNsot %d", sotStart, tph.TilePartIndex, tph.TileIndex, tph.NumTileParts)
+		}
+		nextPart[tph.TileIndex]++
+
+		if tph.TilePartLength == 0 {
+			// The last tile-part runs to the EOC marker
+			return checkTrailingEOC(r)
+		}
+		headerLen := r.n - sotStart
+		if int64(tph.TilePartLength) < headerLen {
+			return fmt.Errorf("tile-part at offset %d: Psot %d is shorter than its %d-byte header", sotStart, tph.TilePartLength, headerLen)
+		}
+		remaining := int64(tph.TilePartLength) - headerLen
+		if n, err := io.CopyN(io.Discard, r, remaining); err != nil {
+			return fmt.Errorf("tile-part at offset %d: Psot %d runs past the end of the data (%d bytes short)", sotStart, tph.TilePartLength, remaining-n)
+		}
+
+		sotStart = r.n
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return fmt.Errorf("missing EOC marker at offset %d", sotStart)
+		}
+		switch m := codestream.Marker(binary.BigEndian.Uint16(marker[:])); m {
+		case codestream.SOT:
+		case codestream.EOC:
+			if n, _ := io.Copy(io.Discard, r); n > 0 {
+				return fmt.Errorf("%d bytes of trailing data after EOC", n)
+			}
+			return nil
+		default:
+			return fmt.Errorf("expected SOT or EOC at offset %d, found 0x%04X", sotStart, uint16(m))
+		}
+	}
+}
+
+// checkTrailingEOC reads to the end of r and checks that the data ends
+// with an EOC marker.
+func checkTrailingEOC(r io.Reader) error {
+	var last [2]byte
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n >= 2 {
+			copy(last[:], buf[n-2:n])
+		} else if n == 1 {
+			last[0], last[1] = last[1], buf[0]
+		}
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if total < 2 || codestream.Marker(binary.BigEndian.Uint16(last[:])) != codestream.EOC {
+		return fmt.Errorf("codestream does not end with an EOC marker")
+	}
+	return nil
+}
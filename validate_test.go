@@ -0,0 +1,229 @@
+package jpeg2000
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// encodeForValidation returns a small encoded RGB image in format f.
+func encodeForValidation(t *testing.T, f Format) []byte {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Format = f
+	opts.Comment = "validate"
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 33, 17)), opts); err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// findMarker returns the offset of the first occurrence of marker m.
+func findMarker(t *testing.T, data []byte, m uint16) int {
+	t.Helper()
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], m)
+	i := bytes.Index(data, b[:])
+	if i < 0 {
+		t.Fatalf("marker 0x%04X not found", m)
+	}
+	return i
+}
+
+func TestValidate_Conformant(t *testing.T) {
+	for _, f := range []Format{FormatJ2K, FormatJP2} {
+		if issues := Validate(bytes.NewReader(encodeForValidation(t, f))); len(issues) != 0 {
+			t.Errorf("Validate(%s) = %v, want no issues", f, issues)
+		}
+	}
+}
+
+func TestValidate_Issues(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   Format
+		corrupt  func(t *testing.T, data []byte) []byte
+		severity string
+		marker   string
+	}{
+		{
+			name:   "unknown format",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return []byte("not a jpeg 2000 file")
+			},
+			severity: SeverityError,
+		},
+		{
+			name:   "invalid wavelet",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				data[findMarker(t, data, 0xFF52)+13] = 7
+				return data
+			},
+			severity: SeverityError,
+			marker:   "COD",
+		},
+		{
+			name:   "COD length",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				// Claim precinct sizes without providing them
+				data[findMarker(t, data, 0xFF52)+4] |= 0x01
+				return data
+			},
+			severity: SeverityError,
+			marker:   "COD",
+		},
+		{
+			name:   "QCD subband count",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				// Switch to a derived step size, keeping every
+				// expounded one
+				i := findMarker(t, data, 0xFF5C) + 4
+				data[i] = data[i]&0xE0 | 0x01
+				return data
+			},
+			severity: SeverityError,
+			marker:   "QCD",
+		},
+		{
+			name:   "missing EOC",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return data[:len(data)-2]
+			},
+			severity: SeverityWarning,
+			marker:   "EOC",
+		},
+		{
+			name:   "ihdr mismatch",
+			format: FormatJP2,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				i := bytes.Index(data, []byte("ihdr"))
+				binary.BigEndian.PutUint32(data[i+4:], 99) // Height
+				return data
+			},
+			severity: SeverityError,
+			marker:   "ihdr",
+		},
+		{
+			name:   "missing colr",
+			format: FormatJP2,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				copy(data[bytes.Index(data, []byte("colr")):], "xxxx")
+				return data
+			},
+			severity: SeverityError,
+			marker:   "colr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.corrupt(t, encodeForValidation(t, tt.format))
+			issues := Validate(bytes.NewReader(data))
+
+			found := false
+			for _, issue := range issues {
+				if issue.Severity == tt.severity && issue.Marker == tt.marker {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Validate() = %v, want a %s for %q", issues, tt.severity, tt.marker)
+			}
+		})
+	}
+}
+
+func TestValidateStructure(t *testing.T) {
+	for _, f := range []Format{FormatJ2K, FormatJP2} {
+		if err := ValidateStructure(bytes.NewReader(encodeForValidation(t, f))); err != nil {
+			t.Errorf("ValidateStructure(%s) error: %v", f, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		format  Format
+		corrupt func(t *testing.T, data []byte) []byte
+	}{
+		{
+			name:   "unknown format",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return []byte("not a jpeg 2000 file")
+			},
+		},
+		{
+			name:   "missing SIZ",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				binary.BigEndian.PutUint16(data[2:], 0xFF64)
+				return data
+			},
+		},
+		{
+			name:   "Psot too long",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				sot := findMarker(t, data, 0xFF90)
+				psot := binary.BigEndian.Uint32(data[sot+6:])
+				binary.BigEndian.PutUint32(data[sot+6:], psot+100)
+				return data
+			},
+		},
+		{
+			name:   "Psot too short",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				sot := findMarker(t, data, 0xFF90)
+				binary.BigEndian.PutUint32(data[sot+6:], 12)
+				return data
+			},
+		},
+		{
+			name:   "tile index out of range",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				sot := findMarker(t, data, 0xFF90)
+				binary.BigEndian.PutUint16(data[sot+4:], 5)
+				return data
+			},
+		},
+		{
+			name:   "missing EOC",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return data[:len(data)-2]
+			},
+		},
+		{
+			name:   "trailing data",
+			format: FormatJ2K,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return append(data, 0, 0, 0)
+			},
+		},
+		{
+			name:   "truncated JP2",
+			format: FormatJP2,
+			corrupt: func(t *testing.T, data []byte) []byte {
+				return data[:len(data)-50]
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.corrupt(t, encodeForValidation(t, tt.format))
+			if err := ValidateStructure(bytes.NewReader(data)); err == nil {
+				t.Error("ValidateStructure() = nil, want error")
+			}
+		})
+	}
+}